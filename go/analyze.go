@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// buildLogFile is where 'build' captures the output of the build, next to the
+// packages so that 'artifacts' collects it.
+const buildLogFile = "build.log"
+
+// Message categories counted in a build log.
+var logCategories = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"makepkg-error", regexp.MustCompile(`^==> ERROR:`)},
+	{"makepkg-warning", regexp.MustCompile(`^==> WARNING:`)},
+	{"compiler-error", regexp.MustCompile(`(?i)(^|:\d+(:\d+)?: |^)(fatal )?error(\[E\d+\])?: `)},
+	{"compiler-warning", regexp.MustCompile(`(?i)(^|:\d+(:\d+)?: )warning(\[[^\]]+\])?: `)},
+}
+
+// failureSignature is a known cause of build failures.
+type failureSignature struct {
+	name string
+	re   *regexp.Regexp
+	hint string
+}
+
+// failureSignatures are checked in order; earlier entries are more specific.
+var failureSignatures = []failureSignature{
+	{"missing-header", regexp.MustCompile(`fatal error: ([^:]+\.h(pp)?): No such file or directory`),
+		"A header is missing: add the package providing it to makedepends."},
+	{"missing-library", regexp.MustCompile(`(ld|mold|lld)(\.\w+)?: (error: )?(cannot find|unable to find library) -l(\S+)`),
+		"A library to link against is missing: add the package providing it to makedepends."},
+	{"linker-error", regexp.MustCompile(`undefined reference to|undefined symbol:|collect2: error: ld returned`),
+		"Linking failed: check for missing libraries, ABI changes after a dependency update, or LTO issues (try options=(!lto))."},
+	{"rustc-version", regexp.MustCompile(`requires rustc \d+\.\d+|is not supported by the following package|rustc \d+\.\d+(\.\d+)? is not supported`),
+		"The crate needs a newer Rust toolchain than the one installed."},
+	{"pkgconfig-missing", regexp.MustCompile(`Package '?([\w.+-]+)'?,? .*(was not found in the pkg-config search path|not found)`),
+		"A pkg-config module is missing: add the package providing its .pc file to makedepends."},
+	{"cmake-package-missing", regexp.MustCompile(`Could not find a package configuration file provided by "([^"]+)"|Could NOT find (\w+)`),
+		"CMake could not find a dependency: add it to makedepends."},
+	{"python-module-missing", regexp.MustCompile(`ModuleNotFoundError: No module named '([^']+)'`),
+		"A Python module is missing: add the python-* package to makedepends."},
+	{"command-not-found", regexp.MustCompile(`(\S+): (command not found|not found)$`),
+		"A build tool is missing: add it to makedepends."},
+	{"out-of-memory", regexp.MustCompile(`Killed signal terminated program|virtual memory exhausted|out of memory|SIGKILL`),
+		"The build ran out of memory: reduce parallelism (MAKEFLAGS=-j2) or use a larger runner."},
+	{"pgp-key", regexp.MustCompile(`unknown public key|One or more PGP signatures could not be verified`),
+		"A source signature could not be verified: add the key to validpgpkeys/keys/pgp or the keyring config."},
+	{"checksum", regexp.MustCompile(`Validity check failed|One or more files did not pass the validity check`),
+		"A source does not match its checksum: the upstream file changed or the download is corrupt."},
+	{"network", regexp.MustCompile(`Could not resolve host|Failed to connect to|Connection timed out|Failure while downloading`),
+		"A download failed: check the network, proxy settings or mirrors."},
+	{"test-failure", regexp.MustCompile(`(?i)^(FAIL(ED)?:|\d+ tests? failed|test result: FAILED)|A failure occurred in check\(\)`),
+		"The test suite failed: check the test output or whether checkdepends are missing."},
+}
+
+// probableCause is a failure signature found in the log.
+type probableCause struct {
+	Signature string `json:"signature"`
+	Line      int    `json:"line"`
+	Text      string `json:"text"`
+	Hint      string `json:"hint"`
+}
+
+// logAnalysis summarizes a build log.
+type logAnalysis struct {
+	Counts map[string]int  `json:"counts"`
+	Causes []probableCause `json:"causes,omitempty"`
+}
+
+// maxCauses is the number of distinct probable causes kept.
+const maxCauses = 5
+
+// analyzeLog scans a build log for categorized messages and failure signatures.
+func analyzeLog(r io.Reader) (*logAnalysis, error) {
+	a := &logAnalysis{Counts: map[string]int{}}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		for _, c := range logCategories {
+			if c.re.MatchString(line) {
+				a.Counts[c.name]++
+				break
+			}
+		}
+		for _, sig := range failureSignatures {
+			if seen[sig.name] || !sig.re.MatchString(line) {
+				continue
+			}
+			seen[sig.name] = true
+			a.Causes = append(a.Causes, probableCause{
+				Signature: sig.name,
+				Line:      n,
+				Text:      strings.TrimSpace(line),
+				Hint:      sig.hint,
+			})
+			break
+		}
+	}
+	// Most specific signatures first
+	rank := map[string]int{}
+	for i, sig := range failureSignatures {
+		rank[sig.name] = i
+	}
+	sort.SliceStable(a.Causes, func(i, j int) bool {
+		return rank[a.Causes[i].Signature] < rank[a.Causes[j].Signature]
+	})
+	if len(a.Causes) > maxCauses {
+		a.Causes = a.Causes[:maxCauses]
+	}
+	return a, scanner.Err()
+}
+
+// analyzeLogFile analyzes the log at path.
+func analyzeLogFile(path string) (*logAnalysis, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return analyzeLog(f)
+}
+
+// Summary returns a one-line categorized count such as
+// "3 compiler-warning, 1 makepkg-warning".
+func (a *logAnalysis) Summary() string {
+	var parts []string
+	for _, c := range logCategories {
+		if n := a.Counts[c.name]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, c.name))
+		}
+	}
+	if len(parts) == 0 {
+		return "no warnings or errors"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ProbableCause returns a short description of the most likely failure cause, if any.
+func (a *logAnalysis) ProbableCause() string {
+	if len(a.Causes) == 0 {
+		return ""
+	}
+	c := a.Causes[0]
+	return fmt.Sprintf("Probable cause (%s, %s line %d): %s\n  %s", c.Signature, buildLogFile, c.Line, c.Hint, c.Text)
+}
+
+// printAnalysis logs a concise analysis report.
+func printAnalysis(a *logAnalysis) {
+	log.Printf("Build log summary: %s", a.Summary())
+	for _, c := range a.Causes {
+		log.Printf("  [%s] line %d: %s", c.Signature, c.Line, c.Text)
+	}
+}
+
+// newAnalyzeCmd creates the 'analyze' command.
+func newAnalyzeCmd() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:         "analyze [log]",
+		Short:       "Summarizes warnings, errors and probable failure causes of a build log.",
+		Annotations: map[string]string{annotationJSONResult: "true"},
+		Args:        cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := buildLogFile
+			if len(args) == 1 {
+				path = args[0]
+			}
+			a, err := analyzeLogFile(path)
+			if err != nil {
+				return errorf(errGeneral, "could not analyze %s: %w", path, err)
+			}
+			if asJSON || jsonOutput() {
+				return printResult(a)
+			}
+			printAnalysis(a)
+			if cause := a.ProbableCause(); cause != "" {
+				log.Println(cause)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the analysis as JSON (as --output-format json)")
+	return cmd
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+// Ecosystems of vendored language dependencies, named like their package URL
+// types.
+const (
+	ecosystemCargo = "cargo"
+	ecosystemNPM   = "npm"
+	ecosystemPyPI  = "pypi"
+)
+
+// lockfileParsers read the pinned dependencies of a lockfile by base name.
+var lockfileParsers = map[string]func([]byte) ([]langDep, error){
+	"Cargo.lock":        parseCargoLock,
+	"package-lock.json": parsePackageLock,
+	"requirements.txt":  parseRequirements,
+}
+
+// auditSkipDirs are not searched for lockfiles: their lockfiles belong to
+// dependencies already listed by the lockfile of the project.
+var auditSkipDirs = []string{".git", "node_modules", "target", "site-packages"}
+
+// defaultOSVURL is the vulnerability database pins are checked against.
+const defaultOSVURL = "https://api.osv.dev"
+
+// osvBatchSize is the maximum number of queries of one OSV request.
+const osvBatchSize = 1000
+
+// langDep is a dependency pinned by a lockfile; Version is empty for
+// requirements that are not pinned to one version.
+type langDep struct {
+	Ecosystem string
+	Name      string
+	Version   string
+	// Lockfile is where the dependency was found, relative to the
+	// package directory
+	Lockfile string
+	Vulns    []string
+}
+
+// purl returns the package URL of d.
+func (d *langDep) purl() string {
+	name := d.Name
+	switch d.Ecosystem {
+	case ecosystemNPM:
+		name = strings.Replace(name, "@", "%40", 1)
+	case ecosystemPyPI:
+		name = normalizePyPIName(name)
+	}
+	if d.Version == "" {
+		return "pkg:" + d.Ecosystem + "/" + name
+	}
+	return "pkg:" + d.Ecosystem + "/" + name + "@" + url.PathEscape(d.Version)
+}
+
+var rePyPISeparators = regexp.MustCompile(`[-_.]+`)
+
+// normalizePyPIName normalizes a Python project name as in PEP 503.
+func normalizePyPIName(name string) string {
+	return strings.ToLower(rePyPISeparators.ReplaceAllString(name, "-"))
+}
+
+// parseCargoLock reads the registry packages of a Cargo.lock; path and git
+// dependencies are crates of the workspace or not on crates.io.
+func parseCargoLock(data []byte) ([]langDep, error) {
+	var deps []langDep
+	var name, version, source string
+	flush := func() {
+		if name != "" && strings.HasPrefix(source, "registry+") {
+			deps = append(deps, langDep{Ecosystem: ecosystemCargo, Name: name, Version: version})
+		}
+		name, version, source = "", "", ""
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") {
+			flush()
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "name":
+			name = value
+		case "version":
+			version = value
+		case "source":
+			source = value
+		}
+	}
+	flush()
+	return deps, sc.Err()
+}
+
+// parsePackageLock reads an npm package-lock.json of any lockfile version.
+func parsePackageLock(data []byte) ([]langDep, error) {
+	type lockDep struct {
+		Version      string          `json:"version"`
+		Link         bool            `json:"link"`
+		Dependencies json.RawMessage `json:"dependencies"`
+	}
+	var lock struct {
+		Packages     map[string]*lockDep `json:"packages"`
+		Dependencies map[string]*lockDep `json:"dependencies"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	var deps []langDep
+	// Lockfile versions 2 and 3 list every installed path
+	for p, d := range lock.Packages {
+		i := strings.LastIndex(p, "node_modules/")
+		if p == "" || i < 0 || d.Link || d.Version == "" {
+			continue
+		}
+		deps = append(deps, langDep{Ecosystem: ecosystemNPM, Name: p[i+len("node_modules/"):], Version: d.Version})
+	}
+	if len(lock.Packages) > 0 {
+		return deps, nil
+	}
+	// Version 1 nests the dependencies of dependencies
+	var walk func(m map[string]*lockDep) error
+	walk = func(m map[string]*lockDep) error {
+		for name, d := range m {
+			if d.Version != "" && !strings.Contains(d.Version, ":") {
+				deps = append(deps, langDep{Ecosystem: ecosystemNPM, Name: name, Version: d.Version})
+			}
+			if len(d.Dependencies) > 0 && d.Dependencies[0] == '{' {
+				var nested map[string]*lockDep
+				if err := json.Unmarshal(d.Dependencies, &nested); err != nil {
+					return err
+				}
+				if err := walk(nested); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return deps, walk(lock.Dependencies)
+}
+
+// reRequirement matches a requirement line: the project name, extras and
+// an optional exact pin.
+var reRequirement = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)\s*(?:\[[^\]]*\])?\s*(?:===?\s*([^\s;,]+))?`)
+
+// parseRequirements reads a pip requirements file; options, URLs and
+// includes are skipped.
+func parseRequirements(data []byte) ([]langDep, error) {
+	var deps []langDep
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(line), "\\"))
+		if line == "" || strings.HasPrefix(line, "-") || strings.Contains(line, "://") {
+			continue
+		}
+		m := reRequirement.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		version := m[2]
+		if strings.Contains(version, "*") {
+			version = ""
+		}
+		deps = append(deps, langDep{Ecosystem: ecosystemPyPI, Name: m[1], Version: version})
+	}
+	return deps, sc.Err()
+}
+
+// parseLockfile parses the lockfile data of name, recording where it was
+// found.
+func parseLockfile(name string, data []byte) ([]langDep, error) {
+	deps, err := lockfileParsers[path.Base(name)](data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	for i := range deps {
+		deps[i].Lockfile = name
+	}
+	return deps, nil
+}
+
+// isSourceArchive reports whether a source file is a tarball lockfiles are
+// looked for in.
+func isSourceArchive(name string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.xz", ".tar.zst", ".tar.bz2", ".crate"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// findLangDeps collects the dependencies of the lockfiles in dir, including
+// the sources extracted to src/, and in its downloaded source tarballs.
+func findLangDeps(dir string, archives []string) ([]langDep, error) {
+	var deps []langDep
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// pkg/ is what the package installs, not its sources
+			if p != dir && slices.Contains(auditSkipDirs, d.Name()) || p == filepath.Join(dir, "pkg") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := lockfileParsers[d.Name()]; !ok || !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		found, err := parseLockfile(filepath.ToSlash(rel), data)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			return nil
+		}
+		deps = append(deps, found...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Unless src/ holds what makepkg extracted from them already
+	if _, err := os.Stat(filepath.Join(dir, "src")); err == nil {
+		archives = nil
+	}
+	for _, archive := range archives {
+		found, err := archiveLangDeps(archive)
+		if err != nil {
+			log.Printf("Warning: could not search %s: %v", archive, err)
+		}
+		deps = append(deps, found...)
+	}
+	return dedupeLangDeps(deps), nil
+}
+
+// archiveLangDeps reads the lockfiles in a source tarball without
+// extracting it.
+func archiveLangDeps(archive string) ([]langDep, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec, err := pkgarchive.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	var deps []langDep
+	tr := tar.NewReader(dec)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return deps, nil
+		}
+		if err != nil {
+			return deps, err
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if _, ok := lockfileParsers[path.Base(name)]; !ok || hdr.Typeflag != tar.TypeReg ||
+			slices.ContainsFunc(strings.Split(path.Dir(name), "/"), func(dir string) bool { return slices.Contains(auditSkipDirs, dir) }) {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return deps, err
+		}
+		found, err := parseLockfile(filepath.Base(archive)+"/"+name, data)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		deps = append(deps, found...)
+	}
+}
+
+// dedupeLangDeps sorts deps and keeps one entry per package URL.
+func dedupeLangDeps(deps []langDep) []langDep {
+	slices.SortFunc(deps, func(a, b langDep) int {
+		if c := strings.Compare(a.purl(), b.purl()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Lockfile, b.Lockfile)
+	})
+	return slices.CompactFunc(deps, func(a, b langDep) bool { return a.purl() == b.purl() })
+}
+
+// checkOSV looks up the pinned deps in the OSV database and records the
+// IDs of the known vulnerabilities affecting them, except ignored ones.
+func checkOSV(ctx context.Context, deps []langDep) error {
+	base := cfg.Audit.OSVURL
+	if base == "" {
+		base = defaultOSVURL
+	}
+	var pinned []int
+	for i, d := range deps {
+		if d.Version != "" {
+			pinned = append(pinned, i)
+		}
+	}
+	for start := 0; start < len(pinned); start += osvBatchSize {
+		batch := pinned[start:min(start+osvBatchSize, len(pinned))]
+		type query struct {
+			Package struct {
+				PURL string `json:"purl"`
+			} `json:"package"`
+		}
+		queries := make([]query, len(batch))
+		for i, idx := range batch {
+			queries[i].Package.PURL = deps[idx].purl()
+		}
+		body, err := json.Marshal(map[string]any{"queries": queries})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(base, "/")+"/v1/querybatch", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := httpClient().Do(req)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Results []struct {
+				Vulns []struct {
+					ID string `json:"id"`
+				} `json:"vulns"`
+			} `json:"results"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("OSV query: HTTP %s", resp.Status)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid OSV response: %w", err)
+		}
+		for i, r := range result.Results {
+			if i >= len(batch) {
+				break
+			}
+			for _, v := range r.Vulns {
+				if !slices.Contains(cfg.Audit.Ignore, v.ID) {
+					deps[batch[i]].Vulns = append(deps[batch[i]].Vulns, v.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// langDepsSBOM returns a CycloneDX document listing deps as the components
+// vendored into the package name of version.
+func langDepsSBOM(name, version string, deps []langDep) ([]byte, error) {
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type component struct {
+		Type       string     `json:"type"`
+		BOMRef     string     `json:"bom-ref,omitempty"`
+		Name       string     `json:"name"`
+		Version    string     `json:"version,omitempty"`
+		PURL       string     `json:"purl,omitempty"`
+		Properties []property `json:"properties,omitempty"`
+	}
+	type affects struct {
+		Ref string `json:"ref"`
+	}
+	type vulnerability struct {
+		ID      string            `json:"id"`
+		Source  map[string]string `json:"source"`
+		Affects []affects         `json:"affects"`
+	}
+	bom := struct {
+		BOMFormat   string `json:"bomFormat"`
+		SpecVersion string `json:"specVersion"`
+		Version     int    `json:"version"`
+		Metadata    struct {
+			Component component `json:"component"`
+		} `json:"metadata"`
+		Components      []component     `json:"components"`
+		Vulnerabilities []vulnerability `json:"vulnerabilities,omitempty"`
+	}{BOMFormat: "CycloneDX", SpecVersion: "1.5", Version: 1, Components: []component{}}
+	bom.Metadata.Component = component{Type: "application", Name: name, Version: version}
+	vulns := map[string]int{}
+	for _, d := range deps {
+		ref := d.purl()
+		bom.Components = append(bom.Components, component{
+			Type: "library", BOMRef: ref, Name: d.Name, Version: d.Version, PURL: ref,
+			Properties: []property{{"builder:lockfile", d.Lockfile}},
+		})
+		for _, id := range d.Vulns {
+			i, ok := vulns[id]
+			if !ok {
+				i = len(bom.Vulnerabilities)
+				vulns[id] = i
+				bom.Vulnerabilities = append(bom.Vulnerabilities, vulnerability{ID: id, Source: map[string]string{"name": "OSV", "url": "https://osv.dev/vulnerability/" + id}})
+			}
+			bom.Vulnerabilities[i].Affects = append(bom.Vulnerabilities[i].Affects, affects{Ref: ref})
+		}
+	}
+	data, err := json.MarshalIndent(bom, "", "  ")
+	return append(data, '\n'), err
+}
+
+// auditPackage finds the vendored dependencies of the package in dir,
+// checks them against OSV unless offline and writes their SBOM to out if
+// not empty. It returns the dependencies with known vulnerabilities.
+func auditPackage(ctx context.Context, dir, out string, offline bool) ([]langDep, error) {
+	info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+	if err != nil {
+		return nil, errorf(errParse, "%w", err)
+	}
+	srcDest := os.Getenv("SRCDEST")
+	if srcDest == "" {
+		srcDest = dir
+	}
+	var archives []string
+	entries, _ := pkgbuildSources(info, carch())
+	for _, e := range entries {
+		if !isSourceArchive(e.Name) {
+			continue
+		}
+		for _, p := range []string{filepath.Join(dir, e.Name), filepath.Join(srcDest, e.Name)} {
+			if _, err := os.Stat(p); err == nil {
+				archives = append(archives, p)
+				break
+			}
+		}
+	}
+	deps, err := findLangDeps(dir, archives)
+	if err != nil {
+		return nil, errorf(errGeneral, "%w", err)
+	}
+	counts := map[string]int{}
+	for _, d := range deps {
+		counts[d.Ecosystem]++
+	}
+	if len(deps) == 0 {
+		log.Printf("No Cargo.lock, package-lock.json or requirements.txt in the sources of %s", info.PkgName)
+	} else {
+		log.Printf("Found %d vendored dependencies of %s: %d cargo, %d npm, %d pypi", len(deps), info.PkgName, counts[ecosystemCargo], counts[ecosystemNPM], counts[ecosystemPyPI])
+	}
+
+	var vulnerable []langDep
+	if !offline && len(deps) > 0 {
+		if err := checkOSV(ctx, deps); err != nil {
+			log.Printf("Warning: could not check for known vulnerabilities: %v", err)
+		}
+		for _, d := range deps {
+			if len(d.Vulns) > 0 {
+				log.Printf("Warning: %s %s (%s) has known vulnerabilities: %s", d.Name, d.Version, d.Lockfile, strings.Join(d.Vulns, ", "))
+				vulnerable = append(vulnerable, d)
+			}
+		}
+	}
+	if out != "" {
+		data, err := langDepsSBOM(info.PkgName, info.PkgVer+"-"+info.PkgRel, deps)
+		if err != nil {
+			return nil, errorf(errGeneral, "%w", err)
+		}
+		if err := os.WriteFile(out, data, 0644); err != nil {
+			return nil, errorf(errArtifact, "could not write %s: %w", out, err)
+		}
+		log.Printf("  SBOM: %s", out)
+	}
+	return vulnerable, nil
+}
+
+// langDepsSBOMName is the file the SBOM of the vendored dependencies of a
+// package is written to after 'build' with audit.on_build.
+func langDepsSBOMName(pkgname string) string {
+	return pkgname + ".deps.cdx.json"
+}
+
+// newAuditCmd creates the 'audit' command.
+func newAuditCmd() *cobra.Command {
+	var out string
+	var offline, strict bool
+	cmd := &cobra.Command{
+		Use:   "audit [package-dir]",
+		Short: "Lists the language dependencies vendored in the sources and their known vulnerabilities.",
+		Long: `Finds the Cargo.lock, package-lock.json and requirements.txt files of the
+sources of a package (in src/ after a build or 'makepkg -o', otherwise in the
+downloaded source tarballs), lists the crates, npm and Python packages they
+pin and looks them up in the OSV vulnerability database (audit.osv_url).
+
+With --sbom the dependencies are written as a CycloneDX document that
+supplements the package, e.g. for 'publish oci'. With audit.on_build 'build'
+writes <pkgname>.deps.cdx.json after every build.`,
+		Example: `  builder audit --sbom foo.deps.cdx.json
+  builder audit --strict packages/foo`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completePackageDirs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := "."
+			if len(args) == 1 {
+				dir = args[0]
+			}
+			vulnerable, err := auditPackage(cmd.Context(), dir, out, offline)
+			if err != nil {
+				return err
+			}
+			if len(vulnerable) > 0 && strict {
+				var lines []string
+				for _, d := range vulnerable {
+					lines = append(lines, fmt.Sprintf("%s %s: %s", d.Name, d.Version, strings.Join(d.Vulns, ", ")))
+				}
+				return &builderError{
+					Category: errDependency,
+					Err:      fmt.Errorf("%d vendored dependencies with known vulnerabilities:\n  %s", len(vulnerable), strings.Join(lines, "\n  ")),
+					Hint:     "Update the lockfile upstream or patch it in prepare(); list vulnerabilities that do not apply in audit.ignore.",
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&out, "sbom", "", "Write the dependencies as a CycloneDX SBOM to this file")
+	cmd.Flags().BoolVar(&offline, "offline", false, "Only list the dependencies, without querying OSV")
+	cmd.Flags().BoolVar(&strict, "strict", false, "Fail when a dependency has known vulnerabilities")
+	return cmd
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles of the clients of the coordinator API.
+const (
+	// roleSubmit queues builds and reads jobs
+	roleSubmit = "submit"
+	// rolePublish adds the packages of finished jobs to a channel
+	rolePublish = "publish"
+	// roleWorker claims and runs jobs
+	roleWorker = "worker"
+	// roleAdmin may do everything, including reading the schedule and audit log
+	roleAdmin = "admin"
+)
+
+var serveRoles = []string{roleSubmit, rolePublish, roleWorker, roleAdmin}
+
+const (
+	// jwksRefresh is how often the signing keys of the OIDC issuer are
+	// fetched again, and at most how often a token signed by an unknown key
+	// triggers a fetch
+	jwksRefresh = time.Hour
+	jwksRetry   = time.Minute
+	// tokenLeeway tolerates clock skew with the issuer
+	tokenLeeway = time.Minute
+	// auditLogFile records who triggered what, below the data directory
+	auditLogFile = "audit.log"
+)
+
+// principal is an authenticated client of the coordinator.
+type principal struct {
+	Name  string
+	Roles []string
+	// Projects restricts the projects (group/name patterns) the client may
+	// build and publish; nil allows any
+	Projects []string
+}
+
+// can reports whether the principal has a role.
+func (p *principal) can(role string) bool {
+	return slices.Contains(p.Roles, roleAdmin) || slices.Contains(p.Roles, role)
+}
+
+// allowed reports whether the principal may build and publish a project.
+// Jobs without a project are only allowed to unrestricted principals.
+func (p *principal) allowed(project string) bool {
+	if p.Projects == nil {
+		return true
+	}
+	return project != "" && slices.ContainsFunc(p.Projects, func(pattern string) bool {
+		ok, _ := path.Match(pattern, project)
+		return ok
+	})
+}
+
+// projectOfRepo returns the project path (group/name) of a git repository
+// URL, e.g. prismlinux/packages for https://gitlab.example.com/prismlinux/packages.git
+// or git@gitlab.example.com:prismlinux/packages.git.
+func projectOfRepo(repo string) string {
+	p := repo
+	if u, err := url.Parse(repo); err == nil && u.Host != "" {
+		p = u.Path
+	} else if _, after, ok := strings.Cut(repo, ":"); ok {
+		p = after
+	}
+	return strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+}
+
+type principalKey struct{}
+
+// principalOf returns the principal authenticated for a request.
+func principalOf(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	if p == nil {
+		return &principal{Name: "anonymous"}
+	}
+	return p
+}
+
+// requireRole wraps a handler of the API so that it only serves principals
+// with role, or any authenticated principal for "".
+func (c *coordinator) requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p := principalOf(r); role != "" && !p.can(role) {
+			c.audit(p, "denied", r.Method+" "+r.URL.Path, "", fmt.Errorf("role %s required", role))
+			http.Error(w, fmt.Sprintf("%s lacks the %s role", p.Name, role), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// staticToken is a token of serve.auth.tokens, or BUILDER_SERVE_TOKEN.
+type staticToken struct {
+	value string
+	p     *principal
+}
+
+// authenticator identifies the clients of the API by their bearer token: a
+// static token or an OIDC ID token.
+type authenticator struct {
+	tokens []staticToken
+	oidc   *oidcVerifier
+}
+
+// newAuthenticator reads the tokens of serve.auth; adminToken, if set, is
+// granted every role.
+func newAuthenticator(adminToken string) (*authenticator, error) {
+	a := &authenticator{}
+	if adminToken != "" {
+		a.tokens = append(a.tokens, staticToken{adminToken, &principal{Name: "serve-token", Roles: []string{roleAdmin}}})
+	}
+	for _, t := range cfg.Serve.Auth.Tokens {
+		_, value, err := lookupSecret(secretSpec{Name: "token " + t.Name, Vars: []string{t.Env}})
+		if err != nil {
+			return nil, newError(errConfig, err)
+		}
+		if value == "" {
+			log.Printf("Warning: %s is not set, token %s is disabled", t.Env, t.Name)
+			continue
+		}
+		addMask(value)
+		a.tokens = append(a.tokens, staticToken{value, &principal{Name: t.Name, Roles: t.Roles, Projects: t.Projects}})
+	}
+	if o := cfg.Serve.Auth.OIDC; o.Issuer != "" {
+		a.oidc = &oidcVerifier{issuer: strings.TrimSuffix(o.Issuer, "/"), audience: o.Audience, rules: o.Rules}
+	}
+	return a, nil
+}
+
+// enabled reports whether requests must authenticate.
+func (a *authenticator) enabled() bool {
+	return len(a.tokens) > 0 || a.oidc != nil
+}
+
+// authenticate returns the principal of a request. Without any tokens
+// configured, everyone is an administrator; serve only allows that on
+// loopback addresses or with --no-auth.
+func (a *authenticator) authenticate(r *http.Request) (*principal, error) {
+	if !a.enabled() {
+		return &principal{Name: "anonymous", Roles: []string{roleAdmin}}, nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		// The dashboard takes the token as the password of a browser login
+		_, token, ok = r.BasicAuth()
+	}
+	if !ok || token == "" {
+		return nil, errors.New("no bearer token")
+	}
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.value)) == 1 {
+			return t.p, nil
+		}
+	}
+	if a.oidc != nil && strings.Count(token, ".") == 2 {
+		return a.oidc.verify(r.Context(), token)
+	}
+	return nil, errors.New("invalid token")
+}
+
+// oidcVerifier validates RS256 ID tokens of an OIDC issuer and maps their
+// GitLab CI claims to roles.
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	rules    []oidcRule
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// idClaims are the claims of an ID token used for authorization; see
+// https://docs.gitlab.com/ci/secrets/id_token_authentication/.
+type idClaims struct {
+	Issuer       string          `json:"iss"`
+	Audience     json.RawMessage `json:"aud"`
+	Expires      int64           `json:"exp"`
+	NotBefore    int64           `json:"nbf"`
+	ProjectPath  string          `json:"project_path"`
+	Ref          string          `json:"ref"`
+	RefProtected string          `json:"ref_protected"`
+	UserLogin    string          `json:"user_login"`
+}
+
+// hasAudience reports whether the aud claim, a string or an array, names aud.
+func (c *idClaims) hasAudience(aud string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == aud
+	}
+	var many []string
+	return json.Unmarshal(c.Audience, &many) == nil && slices.Contains(many, aud)
+}
+
+// key returns the public key with the given ID, fetching the issuer's keys
+// when it is not known yet.
+func (v *oidcVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok && time.Since(v.fetched) < jwksRefresh {
+		return key, nil
+	}
+	if time.Since(v.fetched) < jwksRetry {
+		if key, ok := v.keys[kid]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	keys, err := fetchJWKS(ctx, v.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch the signing keys of %s: %w", v.issuer, err)
+	}
+	v.keys, v.fetched = keys, time.Now()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// fetchJWKS returns the RSA signing keys of an issuer by key ID, found
+// through its discovery document.
+func fetchJWKS(ctx context.Context, issuer string) (map[string]*rsa.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(ctx, issuer+"/.well-known/openid-configuration", nil, &discovery); err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, discovery.JWKSURI, nil, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			debugPrint("Skipping invalid key %q of %s", k.Kid, issuer)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// verify checks the signature, issuer, audience and lifetime of an ID
+// token and returns its principal, restricted to the token's project.
+func (v *oidcVerifier) verify(ctx context.Context, token string) (*principal, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %w", err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims idClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != v.issuer:
+		return nil, fmt.Errorf("token issued by %q", claims.Issuer)
+	case !claims.hasAudience(v.audience):
+		return nil, fmt.Errorf("token not issued for %s", v.audience)
+	case now.After(time.Unix(claims.Expires, 0).Add(tokenLeeway)):
+		return nil, errors.New("token expired")
+	case claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-tokenLeeway)):
+		return nil, errors.New("token not valid yet")
+	case claims.ProjectPath == "":
+		return nil, errors.New("token has no project_path claim")
+	}
+
+	p := &principal{Name: claims.ProjectPath + "@" + claims.Ref, Projects: []string{claims.ProjectPath}}
+	if claims.UserLogin != "" {
+		p.Name += " (" + claims.UserLogin + ")"
+	}
+	for _, rule := range v.rules {
+		if rule.matches(&claims) {
+			for _, role := range rule.Roles {
+				if !slices.Contains(p.Roles, role) {
+					p.Roles = append(p.Roles, role)
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+// matches reports whether a rule applies to the job of an ID token.
+func (rule *oidcRule) matches(claims *idClaims) bool {
+	match := func(patterns []string, value string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool {
+			ok, _ := path.Match(pattern, value)
+			return ok
+		})
+	}
+	if !match(rule.Projects, claims.ProjectPath) {
+		return false
+	}
+	if len(rule.Refs) > 0 && !match(rule.Refs, claims.Ref) {
+		return false
+	}
+	return !rule.ProtectedRefs || claims.RefProtected == "true"
+}
+
+// decodeJWTPart decodes a base64url JSON part of a token.
+func decodeJWTPart(part string, out any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+	return nil
+}
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Project   string    `json:"project,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// audit records who triggered what in the audit log of the data directory,
+// as one JSON object per line.
+func (c *coordinator) audit(p *principal, action, target, project string, err error) {
+	entry := auditEntry{Time: time.Now().UTC(), Principal: p.Name, Action: action, Target: target, Project: project}
+	if err != nil {
+		entry.Error = err.Error()
+		log.Printf("Warning: %s: %s %s: %v", p.Name, action, target, err)
+	} else {
+		log.Printf("  Audit: %s %s %s", p.Name, action, target)
+	}
+	line, _ := json.Marshal(entry)
+	c.auditMu.Lock()
+	defer c.auditMu.Unlock()
+	f, ferr := os.OpenFile(filepath.Join(c.dir, auditLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if ferr != nil {
+		log.Printf("Warning: could not write the audit log: %v", ferr)
+		return
+	}
+	defer f.Close()
+	if _, ferr := f.Write(append(line, '\n')); ferr != nil {
+		log.Printf("Warning: could not write the audit log: %v", ferr)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://gitlab.example.com"
+
+// signTestToken returns an ID token with the given header and claims,
+// signed with key.
+func signTestToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	part := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := part(header) + "." + part(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	header := func(alg, kid string) map[string]any { return map[string]any{"alg": alg, "kid": kid} }
+	claims := func(change func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":           testIssuer,
+			"aud":           "builder",
+			"exp":           now.Add(time.Hour).Unix(),
+			"project_path":  "prismlinux/packages",
+			"ref":           "main",
+			"ref_protected": "true",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		key     *rsa.PrivateKey
+		header  map[string]any
+		claims  map[string]any
+		wantErr string
+	}{
+		{"valid", key, header("RS256", "k1"), claims(nil), ""},
+		{"audience array", key, header("RS256", "k1"), claims(func(c map[string]any) { c["aud"] = []string{"other", "builder"} }), ""},
+		{"alg none", key, header("none", "k1"), claims(nil), "unsupported token algorithm"},
+		{"alg HS256", key, header("HS256", "k1"), claims(nil), "unsupported token algorithm"},
+		{"unknown kid", key, header("RS256", "k2"), claims(nil), "unknown signing key"},
+		{"wrong key", other, header("RS256", "k1"), claims(nil), "invalid token signature"},
+		{"wrong audience", key, header("RS256", "k1"), claims(func(c map[string]any) { c["aud"] = "other" }), "not issued for"},
+		{"wrong issuer", key, header("RS256", "k1"), claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" }), "token issued by"},
+		{"expired", key, header("RS256", "k1"), claims(func(c map[string]any) { c["exp"] = now.Add(-2 * tokenLeeway).Unix() }), "token expired"},
+		{"expired within leeway", key, header("RS256", "k1"), claims(func(c map[string]any) { c["exp"] = now.Add(-tokenLeeway / 2).Unix() }), ""},
+		{"not yet valid", key, header("RS256", "k1"), claims(func(c map[string]any) { c["nbf"] = now.Add(2 * tokenLeeway).Unix() }), "not valid yet"},
+		{"no project", key, header("RS256", "k1"), claims(func(c map[string]any) { delete(c, "project_path") }), "no project_path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Known keys fetched just now, so an unknown kid is not fetched
+			v := &oidcVerifier{
+				issuer:   testIssuer,
+				audience: "builder",
+				rules:    []oidcRule{{Projects: []string{"prismlinux/*"}, Roles: []string{roleSubmit}, ProtectedRefs: true}},
+				keys:     map[string]*rsa.PublicKey{"k1": &key.PublicKey},
+				fetched:  time.Now(),
+			}
+			p, err := v.verify(context.Background(), signTestToken(t, tt.key, tt.header, tt.claims))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verify() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verify() error = %v", err)
+			}
+			if !p.can(roleSubmit) || p.can(roleAdmin) {
+				t.Errorf("roles = %v, want [%s]", p.Roles, roleSubmit)
+			}
+			if !p.allowed("prismlinux/packages") || p.allowed("other/project") {
+				t.Errorf("projects = %v, want only prismlinux/packages", p.Projects)
+			}
+		})
+	}
+}
+
+func TestOIDCVerifyNoMatchingRule(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &oidcVerifier{
+		issuer:   testIssuer,
+		audience: "builder",
+		rules:    []oidcRule{{Projects: []string{"prismlinux/*"}, Roles: []string{roleSubmit}}},
+		keys:     map[string]*rsa.PublicKey{"k1": &key.PublicKey},
+		fetched:  time.Now(),
+	}
+	token := signTestToken(t, key, map[string]any{"alg": "RS256", "kid": "k1"}, map[string]any{
+		"iss": testIssuer, "aud": "builder", "exp": time.Now().Add(time.Hour).Unix(), "project_path": "elsewhere/project", "ref": "main",
+	})
+	p, err := v.verify(context.Background(), token)
+	if err != nil {
+		t.Fatalf("verify() error = %v", err)
+	}
+	if len(p.Roles) != 0 {
+		t.Errorf("roles = %v, want none", p.Roles)
+	}
+}
+
+func TestLoopbackAddress(t *testing.T) {
+	for listen, want := range map[string]bool{
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.5:8080":  false,
+		"[::]:8080":      false,
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		"invalid":        false,
+	} {
+		if got := loopbackAddress(listen); got != want {
+			t.Errorf("loopbackAddress(%q) = %v, want %v", listen, got, want)
+		}
+	}
+}
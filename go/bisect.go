@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// newBisectCmd creates the 'bisect' command.
+func newBisectCmd() *cobra.Command {
+	var runs int
+	var serial, clean, stopOnFailure bool
+	cmd := &cobra.Command{
+		Use:   "bisect",
+		Short: "Re-runs the build repeatedly to tell flaky failures from real regressions.",
+		Long: `Builds the PKGBUILD in the current directory --runs times with identical inputs
+and compares the results. Mixed results point to a flaky build or infrastructure
+problem, consistent failures to a real regression. With --j1 the builds run with
+MAKEFLAGS=-j1 to expose parallel build races. Every run is recorded in the
+build history.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if runs < 1 {
+				return errorf(errConfig, "--runs must be at least 1")
+			}
+			self, err := os.Executable()
+			if err != nil {
+				return errorf(errGeneral, "could not find the builder executable: %w", err)
+			}
+			buildArgs, err := childBuilderArgs(cmd)
+			if err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+			buildArgs = append(buildArgs, "build")
+			if clean {
+				buildArgs = append(buildArgs, "--clean")
+			}
+
+			var results []string
+			var failures int
+			for i := 1; i <= runs; i++ {
+				setPhase(fmt.Sprintf("bisect run %d/%d", i, runs))
+				log.Printf("=== Run %d/%d ===", i, runs)
+				run := newCommand(cmd.Context(), self, buildArgs...)
+				if serial {
+					run.Env = append(os.Environ(), "MAKEFLAGS=-j1")
+				}
+				start := time.Now()
+				err := run.Run()
+				if cmd.Context().Err() != nil {
+					return errorf(errCancelled, "bisect cancelled after %d run(s)", i-1)
+				}
+				result := resultSuccess
+				if err != nil {
+					result = resultFailed
+					failures++
+				}
+				results = append(results, result)
+				log.Printf("=== Run %d/%d: %s (%s) ===", i, runs, result, time.Since(start).Round(time.Second))
+				if err != nil && stopOnFailure {
+					break
+				}
+			}
+
+			log.Printf("Results: %v", results)
+			switch {
+			case failures == 0:
+				log.Printf("All %d run(s) succeeded: the failure could not be reproduced (likely flaky or infrastructure related).", len(results))
+				return nil
+			case failures == len(results):
+				return &builderError{
+					Category: errBuild,
+					Err:      fmt.Errorf("all %d run(s) failed", len(results)),
+					Hint:     "The failure is consistent with identical inputs: this is a real regression, not flakiness.",
+				}
+			default:
+				return &builderError{
+					Category: errBuild,
+					Err:      fmt.Errorf("%d of %d run(s) failed", failures, len(results)),
+					Hint:     "Results differ with identical inputs: the build is flaky. Try --j1 to check for parallel build races.",
+				}
+			}
+		},
+	}
+	cmd.Flags().IntVar(&runs, "runs", 5, "Number of builds to run")
+	cmd.Flags().BoolVar(&serial, "j1", false, "Build with MAKEFLAGS=-j1 to rule out parallel build races")
+	cmd.Flags().BoolVar(&clean, "clean", true, "Clean previous build state before each run")
+	cmd.Flags().BoolVar(&stopOnFailure, "stop-on-failure", false, "Stop at the first failed run")
+	return cmd
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// maxAuditPaths limits the paths listed per kind in an audit.
+const maxAuditPaths = 50
+
+// straceArgs trace the file and network system calls of the build and its
+// children — paths and addresses only, no file contents.
+var straceArgs = []string{"-f", "-qq", "-s", "4096", "-e", "trace=%file,%network", "-e", "signal=none"}
+
+var (
+	reStraceCall = regexp.MustCompile(`^(?:\[pid\s+)?\d+\]?\s+(\w+)\((.*)$`)
+	reStracePath = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"`)
+	reStraceInet = regexp.MustCompile(`sa_family=AF_INET6?, sin6?_port=htons\((\d+)\).*?(?:inet_addr\("([^"]+)"\)|inet_pton\(AF_INET6, "([^"]+)")`)
+	reStraceRet  = regexp.MustCompile(`\) = (-?\d+)`)
+)
+
+// straceWrites are the system calls that change the path they are given;
+// open calls write with these flags.
+var (
+	straceWrites     = []string{"creat", "unlink", "unlinkat", "rename", "renameat", "renameat2", "mkdir", "mkdirat", "rmdir", "chmod", "fchmodat", "chown", "lchown", "fchownat", "symlink", "symlinkat", "link", "linkat", "truncate", "utimensat", "mknod", "mknodat", "setxattr", "lsetxattr", "removexattr"}
+	straceWriteFlags = []string{"O_WRONLY", "O_RDWR", "O_CREAT", "O_TRUNC", "O_APPEND"}
+)
+
+// buildAudit is what a build touched outside of its directory, recorded
+// with --audit to vet packages of new contributors.
+type buildAudit struct {
+	// Reads counts the paths read by directory, e.g. /usr/lib
+	Reads map[string]int `json:"reads,omitempty"`
+	// Writes are the paths changed or attempted to change, beyond /tmp
+	Writes []string `json:"writes,omitempty"`
+	// TempWrites counts those under /tmp and /var/tmp
+	TempWrites int `json:"temp_writes,omitempty"`
+	// Network are the addresses connected or sent to, as host:port
+	Network []string `json:"network,omitempty"`
+	// Truncated is set when more paths were touched than listed
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// auditIgnored reports whether an absolute path is expected for any build:
+// the build directory and the kernel interfaces.
+func auditIgnored(path, buildDir string) bool {
+	if path == buildDir || strings.HasPrefix(path, buildDir+"/") {
+		return true
+	}
+	for _, prefix := range []string{"/dev/", "/proc/", "/sys/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return path == "/" || path == "/dev" || path == "/proc"
+}
+
+// auditDir returns the directory reads are counted by: the first two
+// components of path.
+func auditDir(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(parts) < 3 {
+		return filepath.Dir(path)
+	}
+	return "/" + parts[0] + "/" + parts[1]
+}
+
+// parseStraceLog summarizes the strace output of a build in buildDir. Calls
+// strace shows as unfinished are parsed from the line with their arguments;
+// relative paths are taken to be in the build directory.
+func parseStraceLog(path, buildDir string) (*buildAudit, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	audit := &buildAudit{Reads: map[string]int{}}
+	reads := map[string]bool{}
+	writes := map[string]bool{}
+	network := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		m := reStraceCall.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		call, args := m[1], m[2]
+		failed := false
+		if r := reStraceRet.FindStringSubmatch(args); r != nil {
+			failed = strings.HasPrefix(r[1], "-")
+		}
+		if n := reStraceInet.FindStringSubmatch(args); n != nil && (call == "connect" || call == "sendto" || call == "sendmsg") {
+			host := n[2]
+			if host == "" {
+				host = "[" + n[3] + "]"
+			}
+			network[host+":"+n[1]] = true
+			continue
+		}
+		p := reStracePath.FindStringSubmatch(args)
+		if p == nil || !strings.HasPrefix(p[1], "/") {
+			continue
+		}
+		file := filepath.Clean(p[1])
+		if auditIgnored(file, buildDir) {
+			continue
+		}
+		write := slices.Contains(straceWrites, call)
+		if call == "open" || call == "openat" || call == "openat2" {
+			write = slices.ContainsFunc(straceWriteFlags, func(flag string) bool { return strings.Contains(args, flag) })
+		}
+		switch {
+		case write:
+			// Attempts count as well: a build writing to /etc is suspect
+			// whether or not it may
+			writes[file] = true
+		case !failed && !reads[file]:
+			// Failed lookups are mostly searches through PATH and the like
+			reads[file] = true
+			audit.Reads[auditDir(file)]++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for _, file := range slices.Sorted(maps.Keys(writes)) {
+		if strings.HasPrefix(file, "/tmp/") || strings.HasPrefix(file, "/var/tmp/") {
+			audit.TempWrites++
+		} else if len(audit.Writes) < maxAuditPaths {
+			audit.Writes = append(audit.Writes, file)
+		} else {
+			audit.Truncated = true
+		}
+	}
+	audit.Network = slices.Sorted(maps.Keys(network))
+	return audit, nil
+}
+
+// printAudit logs the summary of an audited build.
+func printAudit(a *buildAudit) {
+	log.Printf("Build audit: read %d file(s) in %d directories outside the build directory, wrote %d (and %d temporary), %d network address(es)",
+		sumCounts(a.Reads), len(a.Reads), len(a.Writes), a.TempWrites, len(a.Network))
+	for _, file := range a.Writes {
+		log.Printf("  Wrote: %s", file)
+	}
+	if a.Truncated {
+		log.Printf("  ... more writes not listed")
+	}
+	for _, addr := range a.Network {
+		log.Printf("  Network: %s", addr)
+	}
+}
+
+// sumCounts returns the sum of the values of counts.
+func sumCounts(counts map[string]int) int {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+// auditReport renders an audit for the merge request note.
+func auditReport(a *buildAudit) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n**Build audit:** %d network address(es), %d write(s) outside the build directory and /tmp\n", len(a.Network), len(a.Writes))
+	for _, addr := range a.Network {
+		fmt.Fprintf(&b, "- :warning: network: `%s`\n", addr)
+	}
+	for _, file := range a.Writes {
+		fmt.Fprintf(&b, "- wrote `%s`\n", file)
+	}
+	if a.Truncated {
+		b.WriteString("- …\n")
+	}
+	if len(a.Reads) > 0 {
+		b.WriteString("\n<details><summary>Files read by directory</summary>\n\n")
+		for _, dir := range slices.Sorted(maps.Keys(a.Reads)) {
+			fmt.Fprintf(&b, "- `%s`: %d\n", dir, a.Reads[dir])
+		}
+		b.WriteString("\n</details>\n")
+	}
+	return b.String()
+}
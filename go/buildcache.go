@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// buildCacheVersion is part of every build cache key; bump it whenever the
+// packages built from the same inputs change, e.g. with the build options.
+const buildCacheVersion = "1"
+
+// buildCacheEntry is the index of a cached build, stored as
+// builds/<key>/build.json next to its package files.
+type buildCacheEntry struct {
+	Key string `json:"key"`
+	// Report is the history record of the build that made the packages
+	Report *buildRecord `json:"report"`
+	// Files are the SHA-256 of the package files by name
+	Files map[string]string `json:"files"`
+}
+
+// buildCache returns the storage builds are shared through, or nil when
+// cache.builds is off or the package cannot be cached: VCS packages build
+// whatever upstream has now from the same PKGBUILD.
+func buildCache(info *pkgbuildInfo) storage {
+	if !cfg.Cache.Builds {
+		return nil
+	}
+	if info != nil && isVCSPackage(info) {
+		debugPrint("Not caching the build of VCS package %s", info.PkgName)
+		return nil
+	}
+	return sharedCache()
+}
+
+// buildCacheKey returns the key of the packages built from the inputs of
+// fingerprint with the given variant and options, which change the packages
+// without changing the inputs.
+func buildCacheKey(fingerprint, variant, march string, env []string, sign bool) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%s\n", buildCacheVersion, fingerprint, carch(), variant, march)
+	fmt.Fprintf(h, "compression=%s nocheck=%t sign=%t key=%s\n", cfg.Build.Compression, cfg.Build.NoCheck, sign, cfg.Build.SignKey)
+	for _, kv := range env {
+		fmt.Fprintln(h, kv)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fetchCachedBuild downloads the packages of the cached build key into the
+// current directory and returns its entry and files, or nil if key is not
+// cached.
+// Files are verified before they replace local ones.
+func fetchCachedBuild(ctx context.Context, st storage, key string) (*buildCacheEntry, []string, error) {
+	tmp, err := os.MkdirTemp(".", ".builder-cache-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tmp)
+	index := filepath.Join(tmp, "build.json")
+	if err := st.Get(ctx, "builds/"+key+"/build.json", index); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entry buildCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, nil, fmt.Errorf("invalid cached build %.12s: %w", key, err)
+	}
+	if entry.Key != key || entry.Report == nil || len(entry.Files) == 0 {
+		return nil, nil, fmt.Errorf("invalid cached build %.12s: no packages", key)
+	}
+
+	names := slices.Sorted(maps.Keys(entry.Files))
+	for _, name := range names {
+		if filepath.Base(name) != name || checkStorageName(name) != nil {
+			return nil, nil, fmt.Errorf("invalid cached build %.12s: file name %q", key, name)
+		}
+		local := filepath.Join(tmp, name)
+		if err := st.Get(ctx, "builds/"+key+"/"+name, local); err != nil {
+			return nil, nil, err
+		}
+		if sum, err := sha256File(local); err != nil {
+			return nil, nil, err
+		} else if sum != entry.Files[name] {
+			return nil, nil, fmt.Errorf("%s of cached build %.12s does not match its checksum", name, key)
+		}
+	}
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(tmp, name), name); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &entry, names, nil
+}
+
+// storeCachedBuild uploads the packages of a successful build and then its
+// index, so the entry is only found once it is complete.
+func storeCachedBuild(ctx context.Context, st storage, key string, rec *buildRecord, packageFiles []string) error {
+	report := *rec
+	report.Result = resultSuccess
+	report.Duration = time.Since(rec.StartedAt)
+	entry := buildCacheEntry{Key: key, Report: &report, Files: artifactChecksums(packageFiles)}
+	for _, file := range packageFiles {
+		if err := st.Put(ctx, "builds/"+key+"/"+filepath.Base(file), file); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp("", "builder-build-*.json")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := writeJSONAtomic(tmp.Name(), entry); err != nil {
+		return err
+	}
+	if err := st.Put(ctx, "builds/"+key+"/build.json", tmp.Name()); err != nil {
+		return err
+	}
+	log.Printf("Cached the build as %.12s in %s", key, st)
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// buildDirTmpfs is the --builddir value building in a tmpfs.
+const buildDirTmpfs = "tmpfs"
+
+// Factors of the estimate of the space a build needs: sources are extracted
+// and built next to the archives, and package() copies what it installs.
+const (
+	tmpfsSourceFactor    = 4
+	tmpfsInstalledFactor = 2
+)
+
+// parseBuildDir parses --builddir: tmpfs, tmpfs:<size> such as tmpfs:8G, or
+// a directory. It returns the size of tmpfs build directories, 0 for the
+// default of half of the memory.
+func parseBuildDir(spec string) (tmpfs bool, size int64, err error) {
+	rest, ok := strings.CutPrefix(spec, buildDirTmpfs)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, ":")) {
+		return false, 0, nil
+	}
+	if rest == "" {
+		return true, 0, nil
+	}
+	size, err = parseRate(rest[1:])
+	if err != nil {
+		return true, 0, fmt.Errorf("invalid tmpfs size %q (expected e.g. 4G or 512M)", rest[1:])
+	}
+	return true, size, nil
+}
+
+// memInfo returns the total and available memory from /proc/meminfo.
+func memInfo() (total, available int64, err error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseInt(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb << 10
+		case "MemAvailable:":
+			available = kb << 10
+		}
+	}
+	return total, available, sc.Err()
+}
+
+// buildSpaceEstimate returns how much space the build of the PKGBUILD in
+// the current directory likely needs: the space its last build on a tmpfs
+// used, or a multiple of its downloaded sources and of the installed size of
+// its last packages.
+func buildSpaceEstimate(info *pkgbuildInfo, prev *buildRecord) int64 {
+	var sources int64
+	if info != nil {
+		srcDest := os.Getenv("SRCDEST")
+		if srcDest == "" {
+			srcDest = "."
+		}
+		entries, _ := pkgbuildSources(info, carch())
+		for _, e := range entries {
+			sources += pathSize(filepath.Join(srcDest, e.Name))
+		}
+	}
+	var installed int64
+	if prev != nil {
+		for _, s := range prev.Sizes {
+			installed += s.Installed
+		}
+	}
+	estimate := sources*tmpfsSourceFactor + installed*tmpfsInstalledFactor
+	if prev != nil && prev.BuildDirUsed > estimate {
+		estimate = prev.BuildDirUsed
+	}
+	return estimate
+}
+
+// setupBuildDir prepares the build directory of --builddir and returns the
+// directory for BUILDDIR, or "" to build in the package directory, and a
+// function removing it. A tmpfs is mounted only when the estimate of the
+// space the build needs fits into it and into the available memory, and the
+// build falls back to the disk when it does not or the mount is not
+// permitted.
+func setupBuildDir(ctx context.Context, spec string, info *pkgbuildInfo, prev *buildRecord) (string, func(), error) {
+	tmpfs, size, err := parseBuildDir(spec)
+	if err != nil {
+		return "", nil, errorf(errConfig, "--builddir: %w", err)
+	}
+	if !tmpfs {
+		dir, err := filepath.Abs(spec)
+		if err != nil {
+			return "", nil, errorf(errConfig, "--builddir: %w", err)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", nil, errorf(errBuild, "could not create the build directory: %w", err)
+		}
+		log.Printf("Building in %s", dir)
+		return dir, func() {}, nil
+	}
+
+	total, available, err := memInfo()
+	if err != nil {
+		log.Printf("Warning: not building in a tmpfs, the available memory is unknown: %v", err)
+		return "", func() {}, nil
+	}
+	limit := size
+	if limit == 0 {
+		// The default size of a tmpfs
+		limit = total / 2
+	}
+	estimate := buildSpaceEstimate(info, prev)
+	switch {
+	case limit > available:
+		log.Printf("Building on disk: the tmpfs of %s exceeds the %s of available memory", formatSize(limit), formatSize(available))
+		return "", func() {}, nil
+	case estimate > limit:
+		log.Printf("Building on disk: the build likely needs %s, more than the tmpfs of %s", formatSize(estimate), formatSize(limit))
+		return "", func() {}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "builder-builddir-")
+	if err != nil {
+		return "", nil, errorf(errBuild, "%w", err)
+	}
+	opts := fmt.Sprintf("size=%d,mode=0755,uid=%d,gid=%d", limit, os.Getuid(), os.Getgid())
+	if err := runAsRoot(ctx, "mount", "-t", "tmpfs", "-o", opts, "tmpfs", dir); err != nil {
+		os.Remove(dir)
+		log.Printf("Warning: building on disk, could not mount a tmpfs build directory: %v", err)
+		return "", func() {}, nil
+	}
+	log.Printf("Building in a tmpfs of %s at %s (estimated need %s)", formatSize(limit), dir, formatSize(estimate))
+	return dir, func() {
+		ctx := context.WithoutCancel(ctx)
+		if err := runAsRoot(ctx, "umount", dir); err != nil {
+			if err := runAsRoot(ctx, "umount", "--lazy", dir); err != nil {
+				log.Printf("Warning: could not unmount the build directory %s: %v", dir, err)
+				return
+			}
+		}
+		if !isMountPoint(dir) {
+			os.Remove(dir)
+		}
+	}, nil
+}
+
+// usedSpace returns the space used on the filesystem of dir.
+func usedSpace(dir string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0
+	}
+	return int64(st.Blocks-st.Bfree) * st.Bsize
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// buildEnvironment is what a build ran with beyond its inputs, so builds
+// that differ between runners can be told apart from their reports.
+type buildEnvironment struct {
+	// Toolchains are the versions of the compilers and interpreters found,
+	// by gcc, clang, rustc, go and python
+	Toolchains map[string]string `json:"toolchains,omitempty"`
+	// MakepkgConf is the SHA-256 of the makepkg.conf files makepkg reads
+	MakepkgConf string `json:"makepkg_conf,omitempty"`
+	Kernel      string `json:"kernel,omitempty"`
+	Arch        string `json:"arch"`
+	// Image and ImageDigest are the container image of the CI job
+	Image       string `json:"image,omitempty"`
+	ImageDigest string `json:"image_digest,omitempty"`
+	Runner      string `json:"runner,omitempty"`
+}
+
+// environmentToolchains are the toolchains captureEnvironment records, with
+// the command printing their version.
+var environmentToolchains = []struct {
+	name string
+	args []string
+}{
+	{"gcc", []string{"gcc", "--version"}},
+	{"clang", []string{"clang", "--version"}},
+	{"rustc", []string{"rustc", "--version"}},
+	{"go", []string{"go", "version"}},
+	{"python", []string{"python", "--version"}},
+}
+
+// reToolchainVersion matches the version in the first line of the version
+// output of a toolchain, e.g. "gcc (GCC) 14.2.1 20240910" or "go version
+// go1.23.2 linux/amd64".
+var reToolchainVersion = regexp.MustCompile(`(?:^|[\s(v]|go)(\d+\.\d+(?:\.\d+)?(?:[-+.~]?[0-9A-Za-z.]+)?)`)
+
+// reImageDigest matches the digest of an image reference.
+var reImageDigest = regexp.MustCompile(`@(sha256:[0-9a-f]{64})$`)
+
+// captureEnvironment records the toolchains a build with the environment
+// env (on top of the builder's) uses, the makepkg.conf, the kernel and the
+// container image of the job. The digest of the image comes from
+// $BUILDER_IMAGE_DIGEST, or from $CI_JOB_IMAGE when the job references the
+// image by digest.
+func captureEnvironment(ctx context.Context, env []string) *buildEnvironment {
+	e := &buildEnvironment{Toolchains: map[string]string{}, Arch: carch()}
+	for _, tc := range environmentToolchains {
+		if _, err := exec.LookPath(tc.args[0]); err != nil {
+			continue
+		}
+		cmd := newCommand(ctx, tc.args[0], tc.args[1:]...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stderr = nil
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			debugPrint("Could not get the version of %s: %v", tc.name, err)
+			continue
+		}
+		first, _, _ := strings.Cut(string(out), "\n")
+		if m := reToolchainVersion.FindStringSubmatch(first); m != nil {
+			e.Toolchains[tc.name] = m[1]
+		} else {
+			e.Toolchains[tc.name] = strings.TrimSpace(first)
+		}
+	}
+	var conf string
+	for _, kv := range env {
+		if c, ok := strings.CutPrefix(kv, "MAKEPKG_CONF="); ok {
+			conf = c
+		}
+	}
+	e.MakepkgConf = hashMakepkgConf(conf)
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		e.Kernel = strings.TrimSpace(string(release))
+	}
+	e.Image = os.Getenv("CI_JOB_IMAGE")
+	e.ImageDigest = os.Getenv("BUILDER_IMAGE_DIGEST")
+	if m := reImageDigest.FindStringSubmatch(e.Image); m != nil && e.ImageDigest == "" {
+		e.ImageDigest = m[1]
+	}
+	if id := os.Getenv("CI_RUNNER_ID"); id != "" {
+		e.Runner = strings.TrimSpace(id + " " + os.Getenv("CI_RUNNER_DESCRIPTION"))
+	}
+	return e
+}
+
+// hashMakepkgConf returns the SHA-256 of the makepkg.conf files makepkg
+// reads with conf as its MAKEPKG_CONF, or "" if there are none. Only their
+// contents count, as the configurations for --march and build.distcc are
+// temporary files.
+func hashMakepkgConf(conf string) string {
+	h := sha256.New()
+	found := false
+	for _, file := range makepkgConfFiles(conf) {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		_, err = io.Copy(h, f)
+		h.Write([]byte{0})
+		f.Close()
+		if err == nil {
+			found = true
+		}
+	}
+	if !found {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// buildEnvName is the file writeBuildEnv writes next to the packages of
+// pkgname, collected by 'artifacts'.
+func buildEnvName(pkgname string) string {
+	return pkgname + ".buildenv"
+}
+
+// writeBuildEnv writes the environment of a build as key = value lines, as
+// in the .BUILDINFO of packages; keys with several values are repeated.
+func writeBuildEnv(path string, e *buildEnvironment, started time.Time) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "format = 1\nbuilddate = %d\nbuildarch = %s\n", started.Unix(), e.Arch)
+	for _, kv := range [][2]string{{"kernel", e.Kernel}, {"makepkgconf", e.MakepkgConf}, {"image", e.Image}, {"imagedigest", e.ImageDigest}, {"runner", e.Runner}} {
+		if kv[1] != "" {
+			fmt.Fprintf(&b, "%s = %s\n", kv[0], kv[1])
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(e.Toolchains)) {
+		fmt.Fprintf(&b, "toolchain = %s %s\n", name, e.Toolchains[name])
+	}
+	return os.WriteFile(filepath.Clean(path), []byte(b.String()), 0644)
+}
+
+// environmentReport renders the environment of a build for reports.
+func environmentReport(e *buildEnvironment) string {
+	var b strings.Builder
+	b.WriteString("\n<details><summary>Build environment</summary>\n\n")
+	for _, name := range slices.Sorted(maps.Keys(e.Toolchains)) {
+		fmt.Fprintf(&b, "- %s `%s`\n", name, e.Toolchains[name])
+	}
+	fmt.Fprintf(&b, "- kernel `%s` (%s)\n", cmp.Or(e.Kernel, "unknown"), e.Arch)
+	if e.MakepkgConf != "" {
+		fmt.Fprintf(&b, "- makepkg.conf sha256 `%.16s…`\n", e.MakepkgConf)
+	}
+	switch {
+	case e.ImageDigest != "" && !strings.HasSuffix(e.Image, e.ImageDigest):
+		fmt.Fprintf(&b, "- image `%s` `%s`\n", cmp.Or(e.Image, "unknown"), e.ImageDigest)
+	case e.Image != "":
+		fmt.Fprintf(&b, "- image `%s`\n", e.Image)
+	}
+	if e.Runner != "" {
+		fmt.Fprintf(&b, "- runner %s\n", e.Runner)
+	}
+	b.WriteString("\n</details>\n")
+	return b.String()
+}
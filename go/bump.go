@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// rePkgverLine and rePkgrelLine match the value of the top-level
+	// assignments, keeping comments after it.
+	rePkgverLine = regexp.MustCompile(`(?m)^(pkgver=)("[^"\n]*"|'[^'\n]*'|[^\s#]*)`)
+	rePkgrelLine = regexp.MustCompile(`(?m)^(pkgrel=)("[^"\n]*"|'[^'\n]*'|[^\s#]*)`)
+	// rePkgverFunc finds a pkgver() function, whose packages are versioned
+	// from their sources
+	rePkgverFunc = regexp.MustCompile(`(?m)^\s*(function\s+)?pkgver\s*\(\s*\)`)
+	// reValidPkgver is what a pkgver may consist of. The version is written
+	// unquoted into the PKGBUILD, which makepkg sources, so nothing the shell
+	// interprets may pass.
+	reValidPkgver = regexp.MustCompile(`^[A-Za-z0-9._+~]+$`)
+)
+
+// checkPkgver validates a version for pkgver, which makepkg restricts.
+func checkPkgver(version string) error {
+	if !reValidPkgver.MatchString(version) {
+		return fmt.Errorf("%q is not a valid pkgver: it may only contain letters, digits, periods, underscores, plus signs and tildes", version)
+	}
+	return nil
+}
+
+// setPkgver returns a PKGBUILD with pkgver set to version and pkgrel reset
+// to 1.
+func setPkgver(content []byte, version string) ([]byte, error) {
+	if !rePkgverLine.Match(content) || !rePkgrelLine.Match(content) {
+		return nil, fmt.Errorf("no top-level pkgver= and pkgrel= assignments found")
+	}
+	// Literally, not as a template expanding $ in version
+	content = rePkgverLine.ReplaceAllFunc(content, func([]byte) []byte { return []byte("pkgver=" + version) })
+	return rePkgrelLine.ReplaceAll(content, []byte("${1}1")), nil
+}
+
+// bumpPackage updates the PKGBUILD in dir to version: pkgver, pkgrel, the
+// checksums (updpkgsums) and a committed .SRCINFO. It reports whether the
+// version changed.
+func bumpPackage(ctx context.Context, dir, version string, checksums bool) (bool, error) {
+	if err := checkPkgver(version); err != nil {
+		return false, err
+	}
+	path := filepath.Join(dir, "PKGBUILD")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("could not read PKGBUILD file: %w", err)
+	}
+	info, err := parsePKGBUILDContent(content)
+	if err != nil {
+		return false, err
+	}
+	if info.PkgVer == version {
+		return false, nil
+	}
+	if rePkgverFunc.Match(content) {
+		log.Printf("Warning: the PKGBUILD has a pkgver() function, which sets the version from the sources at build time")
+	}
+	updated, err := setPkgver(content, version)
+	if err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(path, updated, 0644); err != nil {
+		return false, fmt.Errorf("could not write PKGBUILD file: %w", err)
+	}
+	log.Printf("  Updated: pkgver %s -> %s, pkgrel 1", info.PkgVer, version)
+
+	if checksums {
+		sums := newCommand(ctx, "updpkgsums")
+		sums.Dir = dir
+		if err := sums.Run(); err != nil {
+			return true, fmt.Errorf("updpkgsums failed: %w", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".SRCINFO")); err == nil {
+		srcinfo, err := generateSrcinfo(ctx, dir)
+		if err != nil {
+			return true, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, ".SRCINFO"), []byte(srcinfo), 0644); err != nil {
+			return true, fmt.Errorf("could not write .SRCINFO: %w", err)
+		}
+		log.Printf("  Updated: .SRCINFO")
+	}
+	return true, nil
+}
+
+// newBumpCmd creates the 'bump' command.
+func newBumpCmd() *cobra.Command {
+	var dir, push string
+	var noChecksums, commit, signoff, gpgSign bool
+	cmd := &cobra.Command{
+		Use:   "bump <version>",
+		Short: "Updates the PKGBUILD to a new upstream version.",
+		Long: `Sets pkgver to <version> and pkgrel to 1, updates the checksums with
+updpkgsums and regenerates .SRCINFO if the package has one. Packages already
+at <version> are left alone.
+
+With --commit the changes of the package directory are committed with the
+message of git.commit_message (default "upgpkg: <pkgbase> <version>"), with
+--signoff and --gpg-sign as in git commit, and pushed to the branch of --push.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if push != "" && !commit {
+				return errorf(errConfig, "--push needs --commit")
+			}
+			if push == "" {
+				push = cfg.Git.Push
+			}
+			old, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+			if err != nil {
+				return errorf(errParse, "%w", err)
+			}
+			changed, err := bumpPackage(cmd.Context(), dir, args[0], !noChecksums)
+			if err != nil {
+				return errorf(errParse, "%w", err)
+			}
+			if !changed {
+				log.Printf("The package is already at %s.", args[0])
+				return nil
+			}
+			if commit {
+				info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+				if err != nil {
+					return errorf(errParse, "%w", err)
+				}
+				opts := commitOptions{Signoff: signoff || cfg.Git.Signoff, GPGSign: gpgSign || cfg.Git.GPGSign, Push: push}
+				if _, err := commitPackage(cmd.Context(), dir, info, fullVersion(old), opts); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&dir, "dir", ".", "Package directory")
+	cmd.Flags().BoolVar(&noChecksums, "no-checksums", false, "Do not run updpkgsums")
+	cmd.Flags().BoolVar(&commit, "commit", false, "Commit the updated package files (see git.commit_message)")
+	cmd.Flags().BoolVar(&signoff, "signoff", false, "With --commit, add a Signed-off-by trailer (see git.signoff)")
+	cmd.Flags().BoolVar(&gpgSign, "gpg-sign", false, "With --commit, sign the commit with GPG (see git.gpg_sign)")
+	cmd.Flags().StringVar(&push, "push", "", "With --commit, push the commit to this branch (see git.push)")
+	return cmd
+}
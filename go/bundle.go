@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+// Files of a reproducibility bundle, see newBundleCmd.
+const (
+	bundleManifestFile = "bundle.json"
+	bundlePackageDir   = "package"
+	bundleLockFile     = "deps.lock"
+	bundleMakepkgConf  = "makepkg.conf"
+	bundleConfigFile   = "builder.yaml"
+	bundleFormat       = 1
+)
+
+// archiveURL is the Arch Linux Archive 'bundle build --exact' installs the
+// locked versions of packages from.
+const archiveURL = "https://archive.archlinux.org/packages"
+
+// bundleManifest describes a bundle and the build it reproduces.
+type bundleManifest struct {
+	Format  int            `json:"format"`
+	Created time.Time      `json:"created"`
+	Builder string         `json:"builder"`
+	Package string         `json:"package"`
+	Version string         `json:"version"`
+	Arch    string         `json:"arch"`
+	Profile string         `json:"profile,omitempty"`
+	Sources []bundleSource `json:"sources,omitempty"`
+	Keys    []string       `json:"keys,omitempty"`
+	// LockedFrom is the package whose .BUILDINFO the lockfile comes from,
+	// or empty for the packages installed when the bundle was exported
+	LockedFrom string `json:"locked_from,omitempty"`
+	// Artifacts are the SHA-256 of the packages built originally, which
+	// rebuilds are compared against
+	Artifacts map[string]string `json:"artifacts,omitempty"`
+}
+
+// bundleSource is a remote source; Included sources are in the package
+// directory of the bundle, the others are downloaded and checked against
+// Checksums when the bundle is built.
+type bundleSource struct {
+	Name      string            `json:"name"`
+	URL       string            `json:"url"`
+	Checksums map[string]string `json:"checksums,omitempty"`
+	Included  bool              `json:"included"`
+}
+
+// lockedPackage is a package of the build environment.
+type lockedPackage struct {
+	Name, Version, Arch string
+}
+
+func (p lockedPackage) String() string {
+	return strings.TrimSpace(p.Name + " " + p.Version + " " + p.Arch)
+}
+
+// parseInstalled parses an installed entry of .BUILDINFO:
+// <name>-<pkgver>-<pkgrel>-<arch>.
+func parseInstalled(s string) (lockedPackage, bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 {
+		return lockedPackage{}, false
+	}
+	n := len(parts)
+	return lockedPackage{
+		Name:    strings.Join(parts[:n-3], "-"),
+		Version: parts[n-3] + "-" + parts[n-2],
+		Arch:    parts[n-1],
+	}, true
+}
+
+// hostPackages returns the packages installed on this machine.
+func hostPackages(ctx context.Context) ([]lockedPackage, error) {
+	out, err := newCommand(ctx, "pacman", "-Q").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the installed packages: %w", err)
+	}
+	var pkgs []lockedPackage
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if name, ver, ok := strings.Cut(line, " "); ok {
+			pkgs = append(pkgs, lockedPackage{Name: name, Version: ver})
+		}
+	}
+	return pkgs, nil
+}
+
+func writeLockFile(path string, pkgs []lockedPackage) error {
+	var b strings.Builder
+	b.WriteString("# Packages of the build environment: name version [arch]\n")
+	for _, p := range pkgs {
+		b.WriteString(p.String() + "\n")
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+func readLockFile(path string) ([]lockedPackage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var pkgs []lockedPackage
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		p := lockedPackage{Name: fields[0], Version: fields[1]}
+		if len(fields) > 2 {
+			p.Arch = fields[2]
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, s.Err()
+}
+
+// copyTree links or copies the files of src to dst, leaving out what skip
+// rejects.
+func copyTree(src, dst string, skip func(rel string, d fs.DirEntry) bool) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if skip != nil && skip(filepath.ToSlash(rel), d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return linkOrCopy(p, target)
+	})
+}
+
+// exportBundle writes the bundle of the package in dir to out.
+func exportBundle(ctx context.Context, dir, out string, builtPackages []string, withSources bool) (*bundleManifest, error) {
+	info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+	if err != nil {
+		return nil, errorf(errParse, "%w", err)
+	}
+	// Bundles of the same commit are byte-identical
+	created, ok := sourceEpoch(ctx, dir)
+	if !ok {
+		created = time.Now().UTC()
+	}
+	m := &bundleManifest{
+		Format: bundleFormat, Created: created, Builder: version,
+		Package: info.PkgName, Version: info.PkgVer + "-" + info.PkgRel, Arch: carch(), Profile: profileName,
+	}
+	stage, err := os.MkdirTemp("", "builder-bundle-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stage)
+
+	// Remote sources are references unless --sources includes them
+	remote := map[string]bool{}
+	entries, sums := pkgbuildSources(info, carch())
+	for i, e := range entries {
+		_, err := os.Stat(filepath.Join(dir, e.Name))
+		included := withSources && err == nil
+		if withSources && !included {
+			log.Printf("Warning: source %s is not downloaded, the bundle only references it", e.Name)
+		}
+		remote[e.Name] = !included
+		m.Sources = append(m.Sources, bundleSource{Name: e.Name, URL: e.URL, Checksums: sums[i], Included: included})
+	}
+	if err := copyTree(dir, filepath.Join(stage, bundlePackageDir), func(rel string, d fs.DirEntry) bool {
+		return skipSource(rel, d) || remote[rel]
+	}); err != nil {
+		return nil, fmt.Errorf("could not copy %s: %w", dir, err)
+	}
+
+	// The lockfile comes from what the packages were built with, when known
+	var locked []lockedPackage
+	for _, file := range builtPackages {
+		sum, err := sha256File(file)
+		if err != nil {
+			return nil, errorf(errArtifact, "%w", err)
+		}
+		if m.Artifacts == nil {
+			m.Artifacts = map[string]string{}
+		}
+		m.Artifacts[filepath.Base(file)] = sum
+		if locked != nil {
+			continue
+		}
+		bi, err := pkgarchive.ReadBuildInfo(file)
+		if err != nil {
+			return nil, errorf(errArtifact, "%w", err)
+		}
+		for _, s := range bi["installed"] {
+			if p, ok := parseInstalled(s); ok {
+				locked = append(locked, p)
+			}
+		}
+		if locked != nil {
+			m.LockedFrom = filepath.Base(file)
+		}
+	}
+	if locked == nil {
+		if locked, err = hostPackages(ctx); err != nil {
+			return nil, errorf(errDependency, "%w", err)
+		}
+	}
+	if err := writeLockFile(filepath.Join(stage, bundleLockFile), locked); err != nil {
+		return nil, err
+	}
+
+	conf := os.Getenv("MAKEPKG_CONF")
+	if conf == "" {
+		conf = "/etc/makepkg.conf"
+	}
+	if err := copyFile(conf, filepath.Join(stage, bundleMakepkgConf)); err != nil {
+		log.Printf("Warning: could not include %s: %v", conf, err)
+	} else if _, err := os.Stat(conf + ".d"); err == nil {
+		if err := copyTree(conf+".d", filepath.Join(stage, bundleMakepkgConf+".d"), nil); err != nil {
+			return nil, fmt.Errorf("could not copy %s.d: %w", conf, err)
+		}
+	}
+	if _, err := os.Stat(configFile); err == nil {
+		if err := copyFile(configFile, filepath.Join(stage, bundleConfigFile)); err != nil {
+			return nil, err
+		}
+	}
+
+	m.Keys = slices.Clone(info.Arrays["validpgpkeys"])
+	m.Keys = append(m.Keys, cfg.Keyring.Keys...)
+	for _, file := range cfg.Keyring.KeyFiles {
+		fprs, err := keyFileFingerprints(file)
+		if err != nil {
+			log.Printf("Warning: could not read the fingerprints of %s: %v", file, err)
+			continue
+		}
+		m.Keys = append(m.Keys, fprs...)
+	}
+	slices.Sort(m.Keys)
+	m.Keys = slices.Compact(m.Keys)
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(stage, bundleManifestFile), append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	if err := tarSources(stage, created, f); err != nil {
+		f.Close()
+		os.Remove(out)
+		return nil, fmt.Errorf("could not write %s: %w", out, err)
+	}
+	return m, f.Close()
+}
+
+// restoreLockedPackages reports the packages installed in other versions
+// than locked and, with exact, installs the locked versions from the Arch
+// Linux Archive.
+func restoreLockedPackages(ctx context.Context, locked []lockedPackage, exact bool) error {
+	host, err := hostPackages(ctx)
+	if err != nil {
+		return err
+	}
+	installed := map[string]string{}
+	for _, p := range host {
+		installed[p.Name] = p.Version
+	}
+	var urls []string
+	differ := 0
+	for _, p := range locked {
+		have := installed[p.Name]
+		if have == p.Version {
+			continue
+		}
+		differ++
+		if have == "" {
+			have = "not installed"
+		}
+		log.Printf("  Differs: %s %s (locked %s)", p.Name, have, p.Version)
+		if p.Arch == "" {
+			continue
+		}
+		// Packages are zstd-compressed since 2020, older ones are not found
+		file := fmt.Sprintf("%s-%s-%s.pkg.tar.zst", p.Name, p.Version, p.Arch)
+		urls = append(urls, fmt.Sprintf("%s/%c/%s/%s", archiveURL, p.Name[0], p.Name, file))
+	}
+	if differ == 0 {
+		log.Printf("The build environment matches the lockfile (%d packages).", len(locked))
+		return nil
+	}
+	if !exact {
+		log.Printf("Warning: %d package(s) differ from the lockfile; --exact installs the locked versions", differ)
+		return nil
+	}
+	if len(urls) < differ {
+		log.Printf("Warning: %d package(s) have no architecture in the lockfile and keep their installed version", differ-len(urls))
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	log.Printf("Installing %d locked package version(s) from %s...", len(urls), archiveURL)
+	if err := runAsRoot(ctx, "pacman", append([]string{"-U", "--noconfirm"}, urls...)...); err != nil {
+		return errorf(errDependency, "could not install the locked packages (packages outside the official repositories are not archived): %w", err)
+	}
+	return nil
+}
+
+// newBundleCmd creates the 'bundle' command.
+func newBundleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bundle",
+		Short: "Exports and rebuilds reproducibility bundles.",
+		Long: `A bundle holds everything needed to reproduce a build later: the package
+directory, its remote sources or references to them with their checksums, a
+lockfile of the build environment, makepkg.conf, the fingerprints of the
+source and keyring keys, and the builder configuration.`,
+	}
+
+	var output string
+	var packages []string
+	var withSources bool
+	exportCmd := &cobra.Command{
+		Use:   "export [package-dir]",
+		Short: "Writes the reproducibility bundle of a package.",
+		Long: `Writes the reproducibility bundle of the package in package-dir (default: the
+current directory). The lockfile lists the packages the build environment had:
+from the .BUILDINFO of a package given with --package, otherwise the packages
+installed on this machine. Packages given with --package are also recorded by
+their SHA-256, so 'bundle build' can tell whether a rebuild is identical.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := "."
+			if len(args) == 1 {
+				dir = args[0]
+			}
+			if output == "" {
+				info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+				if err != nil {
+					return errorf(errParse, "%w", err)
+				}
+				output = fmt.Sprintf("%s-%s-%s.bundle.tar.gz", info.PkgName, info.PkgVer, info.PkgRel)
+			}
+			m, err := exportBundle(cmd.Context(), dir, output, packages, withSources)
+			if err != nil {
+				return err
+			}
+			included := 0
+			for _, s := range m.Sources {
+				if s.Included {
+					included++
+				}
+			}
+			log.Printf("Bundle of %s %s written to %s (%s, %d of %d remote sources included).", m.Package, m.Version, output, formatSize(fileSize(output)), included, len(m.Sources))
+			return nil
+		},
+	}
+	exportCmd.Flags().StringVarP(&output, "output", "o", "", "Bundle file (default <pkgname>-<version>.bundle.tar.gz)")
+	exportCmd.Flags().StringArrayVar(&packages, "package", nil, "Built package whose .BUILDINFO provides the lockfile and whose checksum is recorded (repeatable)")
+	exportCmd.Flags().BoolVar(&withSources, "sources", false, "Include the downloaded remote sources instead of referencing them")
+
+	var dest, workDir string
+	var exact, keep bool
+	buildCmd := &cobra.Command{
+		Use:   "build <bundle>",
+		Short: "Rebuilds the package of a reproducibility bundle.",
+		Long: `Rebuilds the package of a bundle with the bundled configuration and
+makepkg.conf. Packages installed in other versions than the lockfile are
+reported; --exact installs the locked versions from the Arch Linux Archive
+first. The built packages are copied to --dest and compared with the packages
+the bundle was exported with.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return errorf(errGeneral, "%w", err)
+			}
+			defer f.Close()
+			if workDir == "" {
+				if workDir, err = os.MkdirTemp("", "builder-bundle-"); err != nil {
+					return err
+				}
+				if !keep {
+					defer os.RemoveAll(workDir)
+				}
+			}
+			if err := untarSources(f, workDir); err != nil {
+				return errorf(errGeneral, "could not extract %s: %w", args[0], err)
+			}
+			data, err := os.ReadFile(filepath.Join(workDir, bundleManifestFile))
+			if err != nil {
+				return errorf(errGeneral, "%s is not a bundle: %w", args[0], err)
+			}
+			var m bundleManifest
+			if err := json.Unmarshal(data, &m); err != nil {
+				return errorf(errParse, "invalid %s: %w", bundleManifestFile, err)
+			}
+			if m.Format > bundleFormat {
+				return errorf(errGeneral, "%s has bundle format %d; this builder reads up to %d", args[0], m.Format, bundleFormat)
+			}
+			log.Printf("Rebuilding %s %s (bundle of %s, builder %s)", m.Package, m.Version, m.Created.Format(time.DateOnly), m.Builder)
+			if m.Arch != carch() {
+				log.Printf("Warning: the bundle was exported on %s, this machine is %s", m.Arch, carch())
+			}
+
+			locked, err := readLockFile(filepath.Join(workDir, bundleLockFile))
+			if err != nil {
+				return errorf(errGeneral, "could not read the lockfile: %w", err)
+			}
+			if err := restoreLockedPackages(cmd.Context(), locked, exact); err != nil {
+				return err
+			}
+
+			self, err := os.Executable()
+			if err != nil {
+				return err
+			}
+			var bundleConfig string
+			if _, err := os.Stat(filepath.Join(workDir, bundleConfigFile)); err == nil {
+				bundleConfig = filepath.Join(workDir, bundleConfigFile)
+			}
+			childArgs, err := globalBuilderArgs(bundleConfig, m.Profile)
+			if err != nil {
+				return err
+			}
+			pkgDir := filepath.Join(workDir, bundlePackageDir)
+			for _, step := range []string{"deps", "build"} {
+				run := newCommand(cmd.Context(), self, append(slices.Clone(childArgs), step)...)
+				run.Dir = pkgDir
+				run.Env = os.Environ()
+				if _, err := os.Stat(filepath.Join(workDir, bundleMakepkgConf)); err == nil {
+					run.Env = append(run.Env, "MAKEPKG_CONF="+filepath.Join(workDir, bundleMakepkgConf))
+				}
+				log.Printf("Running 'builder %s'...", step)
+				if err := run.Run(); err != nil {
+					return errorf(errBuild, "builder %s failed: %w", step, err)
+				}
+			}
+
+			built := builtPackages(pkgDir)
+			if len(built) == 0 {
+				return errorf(errBuild, "the build produced no package files")
+			}
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return errorf(errArtifact, "%w", err)
+			}
+			differs := 0
+			for _, file := range built {
+				name := filepath.Base(file)
+				if err := copyFile(file, filepath.Join(dest, name)); err != nil {
+					return errorf(errArtifact, "%w", err)
+				}
+				want, ok := m.Artifacts[name]
+				if !ok || strings.HasSuffix(name, ".sig") {
+					log.Printf("  Built: %s", name)
+					continue
+				}
+				if got, err := sha256File(file); err != nil {
+					return errorf(errArtifact, "%w", err)
+				} else if got == want {
+					log.Printf("  Reproduced: %s (identical)", name)
+				} else {
+					differs++
+					log.Printf("  Differs: %s (sha256 %s, originally %s)", name, got, want)
+				}
+			}
+			if keep {
+				log.Printf("The bundle is kept in %s", workDir)
+			}
+			if differs > 0 {
+				return &builderError{
+					Category: errArtifact,
+					Err:      fmt.Errorf("%d package(s) differ from the original build", differs),
+					Hint:     "Compare them with diffoscope to find the sources of non-determinism.",
+				}
+			}
+			return nil
+		},
+	}
+	buildCmd.Flags().StringVar(&dest, "dest", ".", "Directory the built packages are copied to")
+	buildCmd.Flags().StringVar(&workDir, "dir", "", "Directory the bundle is extracted to (default: a temporary directory)")
+	buildCmd.Flags().BoolVar(&exact, "exact", false, "Install the locked package versions from the Arch Linux Archive before building")
+	buildCmd.Flags().BoolVar(&keep, "keep", false, "Keep the extracted bundle and build directory")
+
+	cmd.AddCommand(exportCmd, buildCmd)
+	return cmd
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// metadataCacheVersion is part of every cache key; bump it whenever the
+// PKGBUILD parser or pkgbuildInfo changes.
+const metadataCacheVersion = "1"
+
+// pkgbuildCache holds the parsed PKGBUILDs of this process.
+var pkgbuildCache = &metadataCache{entries: map[string]*pkgbuildInfo{}}
+
+// metadataCache caches parsed PKGBUILD metadata by content hash in memory
+// and, with cache.metadata, on disk.
+type metadataCache struct {
+	mu      sync.Mutex
+	entries map[string]*pkgbuildInfo
+}
+
+// sharedCacheStorage is the storage of cache.storage, opened on first use;
+// nil when not configured or unavailable.
+var sharedCacheStorage struct {
+	once sync.Once
+	st   storage
+}
+
+// sharedCache returns the storage caches are shared through, if any.
+func sharedCache() storage {
+	sharedCacheStorage.once.Do(func() {
+		if cfg.Cache.Storage == "" {
+			return
+		}
+		st, err := openStorage(cfg.Cache.Storage)
+		if err != nil {
+			log.Printf("Warning: not sharing caches: %v", err)
+			return
+		}
+		sharedCacheStorage.st = st
+	})
+	return sharedCacheStorage.st
+}
+
+// closeSharedCache closes the storage of sharedCache when it was opened.
+func closeSharedCache() {
+	if st := sharedCacheStorage.st; st != nil {
+		st.Close()
+	}
+}
+
+// cacheDir returns cache.dir or the builder directory in the XDG cache directory.
+func cacheDir() string {
+	if cfg.Cache.Dir != "" {
+		return cfg.Cache.Dir
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "builder")
+	}
+	return filepath.Join(os.TempDir(), "builder-cache")
+}
+
+// get returns the cached metadata for content, parsing it on a miss. Parse
+// errors are not cached.
+func (c *metadataCache) get(content []byte, parse func([]byte) (*pkgbuildInfo, error)) (*pkgbuildInfo, error) {
+	sum := sha256.Sum256(append([]byte(metadataCacheVersion+"\n"), content...))
+	key := hex.EncodeToString(sum[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, ok := c.entries[key]; ok {
+		debugPrint("Using parsed PKGBUILD %.12s from memory", key)
+		return info, nil
+	}
+	path := filepath.Join(cacheDir(), "metadata", key+".json")
+	if cfg.Cache.Metadata {
+		if _, err := os.Stat(path); err != nil {
+			if st := sharedCache(); st != nil && os.MkdirAll(filepath.Dir(path), 0755) == nil {
+				if err := st.Get(context.Background(), "metadata/"+key+".json", path); err != nil {
+					debugPrint("Parsed PKGBUILD %.12s not in %s: %v", key, st, err)
+				}
+			}
+		}
+		if data, err := os.ReadFile(path); err == nil {
+			var info pkgbuildInfo
+			if err := json.Unmarshal(data, &info); err == nil {
+				debugPrint("Using parsed PKGBUILD %.12s from %s", key, path)
+				c.entries[key] = &info
+				return &info, nil
+			}
+		}
+	}
+
+	info, err := parse(content)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[key] = info
+	if cfg.Cache.Metadata {
+		if err := writeJSONAtomic(path, info); err != nil {
+			debugPrint("Could not cache PKGBUILD metadata: %v", err)
+		} else if st := sharedCache(); st != nil {
+			if err := st.Put(context.Background(), "metadata/"+key+".json", path); err != nil {
+				log.Printf("Warning: could not share parsed PKGBUILD metadata: %v", err)
+			}
+		}
+	}
+	return info, nil
+}
+
+// writeJSONAtomic stores v as JSON at path via a temporary file and rename.
+func writeJSONAtomic(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// writeFileAtomic stores data at path via a temporary file and rename, so
+// readers never see partial content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultChrootPool   = 2
+	defaultChrootMaxAge = 24 * time.Hour
+)
+
+// chrootSlot is a chroot of the pool of the chroot backend. The chroot
+// itself is <dir>/builder-<n>/root, created by mkarchroot; makechrootpkg
+// builds in a copy next to it, so the root stays clean and warm. The lock
+// and the time of the last update are files next to the slot, owned by the
+// builder user.
+type chrootSlot struct {
+	N   int
+	Dir string
+}
+
+func (s chrootSlot) root() string      { return filepath.Join(s.Dir, "root") }
+func (s chrootSlot) lockPath() string  { return s.Dir + ".lock" }
+func (s chrootSlot) stampPath() string { return s.Dir + ".updated" }
+
+// exists reports whether mkarchroot completed the chroot.
+func (s chrootSlot) exists() bool {
+	_, err := os.Stat(filepath.Join(s.root(), ".arch-chroot"))
+	return err == nil
+}
+
+// updatedAt returns when the chroot was created or last updated.
+func (s chrootSlot) updatedAt() time.Time {
+	data, err := os.ReadFile(s.stampPath())
+	if err != nil {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	return t
+}
+
+// stale reports whether the chroot is older than chroot.max_age.
+func (s chrootSlot) stale() bool {
+	maxAge := cfg.Chroot.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultChrootMaxAge
+	}
+	return time.Since(s.updatedAt()) > maxAge
+}
+
+// chrootDir returns chroot.dir or defaultChrootDir.
+func chrootDir() string {
+	if cfg.Chroot.Dir != "" {
+		return cfg.Chroot.Dir
+	}
+	return defaultChrootDir
+}
+
+// chrootSlots returns the slots of the pool, chroot.pool of them.
+func chrootSlots() []chrootSlot {
+	n := cfg.Chroot.Pool
+	if n == 0 {
+		n = defaultChrootPool
+	}
+	slots := make([]chrootSlot, n)
+	for i := range slots {
+		slots[i] = chrootSlot{N: i + 1, Dir: filepath.Join(chrootDir(), fmt.Sprintf("builder-%d", i+1))}
+	}
+	return slots
+}
+
+// prepareChrootDir creates the pool directory owned by the builder user,
+// who keeps the locks and stamps in it.
+func prepareChrootDir(ctx context.Context) error {
+	dir := chrootDir()
+	if f, err := os.CreateTemp(dir, ".probe-"); err == nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil
+	}
+	if err := runAsRoot(ctx, "install", "-d", "-o", strconv.Itoa(os.Getuid()), "-g", strconv.Itoa(os.Getgid()), dir); err != nil {
+		return errorf(errDependency, "could not create the chroot directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// prepareChroot creates the chroot of a locked slot if it is missing and
+// updates it if it is stale or force is set.
+func prepareChroot(ctx context.Context, s chrootSlot, force bool) error {
+	if s.exists() {
+		if !force && !s.stale() {
+			return nil
+		}
+		setPhase("chroot update")
+		log.Printf("Updating chroot %d (last updated %s)...", s.N, formatUpdated(s.updatedAt()))
+		if err := runAsRoot(ctx, "arch-nspawn", s.root(), "pacman", "-Syuu", "--noconfirm"); err != nil {
+			return errorf(errDependency, "could not update chroot %d: %w", s.N, err)
+		}
+	} else {
+		setPhase("chroot create")
+		log.Printf("Creating chroot %d in %s...", s.N, s.Dir)
+		if err := os.MkdirAll(s.Dir, 0755); err != nil {
+			return errorf(errDependency, "%w", err)
+		}
+		// A partly created root from an interrupted mkarchroot is replaced
+		if _, err := removePaths(ctx, []string{s.root()}, false); err != nil {
+			return errorf(errDependency, "%w", err)
+		}
+		var args []string
+		if cfg.Chroot.PacmanConf != "" {
+			args = append(args, "-C", cfg.Chroot.PacmanConf)
+		}
+		if cfg.Chroot.MakepkgConf != "" {
+			args = append(args, "-M", cfg.Chroot.MakepkgConf)
+		}
+		packages := cfg.Chroot.Packages
+		if len(packages) == 0 {
+			packages = []string{"base-devel"}
+		}
+		args = append(append(args, s.root()), packages...)
+		if err := runAsRoot(ctx, "mkarchroot", args...); err != nil {
+			return errorf(errDependency, "could not create chroot %d: %w", s.N, err)
+		}
+	}
+	return os.WriteFile(s.stampPath(), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+}
+
+// formatUpdated renders the update time of a chroot, or "never".
+func formatUpdated(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// acquireChroot locks a free slot of the pool, preferring ready chroots,
+// and creates or updates it as needed. It waits while all slots are busy.
+func acquireChroot(ctx context.Context) (chrootSlot, *fileLock, error) {
+	if err := prepareChrootDir(ctx); err != nil {
+		return chrootSlot{}, nil, err
+	}
+	slots := chrootSlots()
+	slices.SortStableFunc(slots, func(a, b chrootSlot) int {
+		score := func(s chrootSlot) int {
+			switch {
+			case !s.exists():
+				return 2
+			case s.stale():
+				return 1
+			}
+			return 0
+		}
+		return score(a) - score(b)
+	})
+	start := time.Now()
+	reported := false
+	for {
+		for _, s := range slots {
+			l, err := tryLockFile(s.lockPath())
+			if err != nil {
+				return chrootSlot{}, nil, errorf(errDependency, "%w", err)
+			}
+			if l == nil {
+				continue
+			}
+			if waited := time.Since(start); waited >= lockPoll {
+				lockWaitTotal.Add(int64(waited))
+			}
+			if err := prepareChroot(ctx, s, false); err != nil {
+				l.unlock()
+				return chrootSlot{}, nil, err
+			}
+			log.Printf("Building in chroot %d (updated %s)", s.N, formatUpdated(s.updatedAt()))
+			return s, l, nil
+		}
+		if !reported && time.Since(start) >= lockReportThreshold {
+			log.Printf("Waiting for one of the %d chroots to be released by another job...", len(slots))
+			reported = true
+		}
+		select {
+		case <-ctx.Done():
+			return chrootSlot{}, nil, errorf(errCancelled, "cancelled while waiting for a chroot: %w", ctx.Err())
+		case <-time.After(lockPoll):
+		}
+	}
+}
+
+// chrootBuildCommand returns the command line building the package in the
+// current directory in slot s, passing makepkgArgs to makepkg. Without an
+// overlay copy, makechrootpkg builds in a fresh copy of the chroot (-c).
+// makechrootpkg elevates itself with sudo and returns the packages to the
+// invoking user.
+func chrootBuildCommand(s chrootSlot, overlay string, makepkgArgs []string) (string, []string) {
+	args := []string{"-c", "-r", s.Dir}
+	if overlay != "" {
+		args = []string{"-r", s.Dir, "-l", overlay}
+	}
+	return "makechrootpkg", append(append(args, "--"), makepkgArgs...)
+}
+
+// selectChrootSlots returns the slots of args (numbers) or all slots.
+func selectChrootSlots(args []string) ([]chrootSlot, error) {
+	slots := chrootSlots()
+	if len(args) == 0 {
+		return slots, nil
+	}
+	var selected []chrootSlot
+	for _, arg := range args {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(slots) {
+			return nil, errorf(errConfig, "invalid chroot %q: the pool has chroots 1 to %d", arg, len(slots))
+		}
+		selected = append(selected, slots[n-1])
+	}
+	return selected, nil
+}
+
+// withChroots runs fn for each of slots while holding its lock and prints
+// the pool afterwards.
+func withChroots(ctx context.Context, slots []chrootSlot, fn func(chrootSlot) error) error {
+	if err := prepareChrootDir(ctx); err != nil {
+		return err
+	}
+	for _, s := range slots {
+		l, err := lockFile(ctx, s.lockPath(), fmt.Sprintf("chroot %d", s.N))
+		if err != nil {
+			return errorf(errDependency, "%w", err)
+		}
+		err = fn(s)
+		l.unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return printChroots(slots)
+}
+
+// newChrootCmd creates the 'chroot' command and its subcommands.
+func newChrootCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "chroot",
+		Short: "Manages the pool of build chroots of the chroot backend.",
+		Long: `Manages the chroots build.backend chroot builds in: chroot.pool chroots in
+chroot.dir, created with mkarchroot and reused by every build on the runner.
+A build locks a free chroot, updating it first when it is older than
+chroot.max_age, and makechrootpkg builds in a fresh copy of it or, with
+chroot.overlay, in an overlayfs over it that is removed after the build. Schedule
+'chroot update' (e.g. in serve.schedule) to keep builds from doing that.`,
+	}
+
+	createCmd := &cobra.Command{
+		Use:   "create [<n>...]",
+		Short: "Creates the missing chroots of the pool.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			slots, err := selectChrootSlots(args)
+			if err != nil {
+				return err
+			}
+			return withChroots(cmd.Context(), slots, func(s chrootSlot) error {
+				if s.exists() {
+					return nil
+				}
+				return prepareChroot(cmd.Context(), s, false)
+			})
+		},
+	}
+
+	var force bool
+	updateCmd := &cobra.Command{
+		Use:   "update [<n>...]",
+		Short: "Updates stale chroots of the pool, creating missing ones.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			slots, err := selectChrootSlots(args)
+			if err != nil {
+				return err
+			}
+			return withChroots(cmd.Context(), slots, func(s chrootSlot) error {
+				return prepareChroot(cmd.Context(), s, force)
+			})
+		},
+	}
+	updateCmd.Flags().BoolVar(&force, "force", false, "Update chroots that are not stale as well")
+
+	destroyCmd := &cobra.Command{
+		Use:   "destroy [<n>...]",
+		Short: "Removes chroots of the pool, waiting for builds using them.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			slots, err := selectChrootSlots(args)
+			if err != nil {
+				return err
+			}
+			var freed int64
+			for _, s := range slots {
+				if _, err := os.Stat(s.Dir); errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				l, err := lockFile(cmd.Context(), s.lockPath(), fmt.Sprintf("chroot %d", s.N))
+				if err != nil {
+					return errorf(errDependency, "%w", err)
+				}
+				if err := removeOverlays(cmd.Context(), s); err != nil {
+					l.unlock()
+					return err
+				}
+				n, err := removePaths(cmd.Context(), []string{s.Dir}, false)
+				os.Remove(s.stampPath())
+				l.unlock()
+				if err != nil {
+					return errorf(errGeneral, "could not remove chroot %d: %w", s.N, err)
+				}
+				freed += n
+				log.Printf("Removed chroot %d", s.N)
+			}
+			log.Printf("Freed %s", formatSize(freed))
+			return nil
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Shows the chroots of the pool and whether they are in use.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return printChroots(chrootSlots())
+		},
+	}
+
+	cmd.AddCommand(createCmd, updateCmd, destroyCmd, listCmd)
+	return cmd
+}
+
+// printChroots prints the state of slots.
+func printChroots(slots []chrootSlot) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHROOT\tSTATE\tUPDATED\tPATH")
+	for _, s := range slots {
+		state := "ready"
+		switch {
+		case !s.exists():
+			state = "missing"
+		case s.stale():
+			state = "stale"
+		}
+		if s.exists() {
+			if l, err := tryLockFile(s.lockPath()); err == nil && l == nil {
+				state += ", in use"
+			} else if l != nil {
+				l.unlock()
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.N, state, formatUpdated(s.updatedAt()), s.Dir)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultCCacheDir = "/home/builder/.ccache"
+	defaultChrootDir = "/var/lib/archbuild"
+)
+
+// sourceArchivePatterns match downloaded source archives in the package directory.
+var sourceArchivePatterns = []string{"*.tar.gz", "*.tar.xz", "*.tar.bz2", "*.tar.zst", "*.tgz", "*.tbz2", "*.txz", "*.zip"}
+
+// cleanTarget is a named group of paths removed by the clean command.
+type cleanTarget struct {
+	name  string
+	paths []string
+}
+
+// pathSize returns the total size of a file or directory tree.
+func pathSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// formatSize renders a byte count in human readable binary units.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// removePaths deletes the given paths and returns the number of bytes freed.
+// Paths that cannot be removed as the current user are retried as root.
+func removePaths(ctx context.Context, paths []string, dryRun bool) (int64, error) {
+	var freed int64
+	for _, path := range paths {
+		if _, err := os.Lstat(path); err != nil {
+			continue
+		}
+		size := pathSize(path)
+		if dryRun {
+			log.Printf("  Would remove: %s (%s)", path, formatSize(size))
+			freed += size
+			continue
+		}
+		debugPrint("Removing %s (%s)", path, formatSize(size))
+		if err := os.RemoveAll(path); err != nil {
+			if !os.IsPermission(err) {
+				return freed, fmt.Errorf("could not remove %s: %w", path, err)
+			}
+			if err := runAsRoot(ctx, "rm", "-rf", path); err != nil {
+				return freed, fmt.Errorf("could not remove %s: %w", path, err)
+			}
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// dirContents lists the entries of a directory so the directory itself is kept.
+func dirContents(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	paths := make([]string, 0, len(entries))
+	for _, e := range entries {
+		paths = append(paths, filepath.Join(dir, e.Name()))
+	}
+	return paths
+}
+
+// buildStatePaths lists previous build outputs and makepkg work directories.
+func buildStatePaths() []string {
+	return append(builtPackages("."), "src", "pkg")
+}
+
+// sourcePaths lists downloaded sources: the SRCDEST contents when set, otherwise
+// source archives and bare VCS clones in the package directory.
+func sourcePaths() []string {
+	if srcDest := os.Getenv("SRCDEST"); srcDest != "" {
+		return dirContents(srcDest)
+	}
+	var paths []string
+	for _, pattern := range sourceArchivePatterns {
+		files, _ := filepath.Glob(pattern)
+		for _, f := range files {
+			if !strings.Contains(f, ".pkg.tar.") {
+				paths = append(paths, f)
+			}
+		}
+	}
+	entries, _ := os.ReadDir(".")
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		_, errHead := os.Stat(filepath.Join(e.Name(), "HEAD"))
+		_, errObjects := os.Stat(filepath.Join(e.Name(), "objects"))
+		if errHead == nil && errObjects == nil {
+			paths = append(paths, e.Name())
+		}
+	}
+	return paths
+}
+
+// cleanBuildState removes previous build outputs before a clean build.
+func cleanBuildState(ctx context.Context) {
+	freed, err := removePaths(ctx, buildStatePaths(), false)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	log.Printf("Freed %s of previous build state.", formatSize(freed))
+}
+
+// newCleanCmd creates the 'clean' command.
+func newCleanCmd() *cobra.Command {
+	var sources, ccache, chroots, artifacts, all, dryRun bool
+	var artifactsDir, ccacheDir, chrootDir string
+	cmd := &cobra.Command{
+		Use:   "clean",
+		Short: "Removes build state, caches and collected artifacts.",
+		Long: `Removes previous build outputs (packages, src/ and pkg/) and, when requested,
+downloaded sources, the ccache directory, build chroots and collected artifacts,
+reporting how much space was freed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if all {
+				sources, ccache, chroots, artifacts = true, true, true, true
+			}
+			if ccacheDir == "" {
+				ccacheDir = os.Getenv("CCACHE_DIR")
+			}
+			if ccacheDir == "" {
+				ccacheDir = defaultCCacheDir
+			}
+
+			targets := []cleanTarget{{"build state", buildStatePaths()}}
+			if sources {
+				targets = append(targets, cleanTarget{"sources", sourcePaths()})
+			}
+			if ccache {
+				targets = append(targets, cleanTarget{"ccache", dirContents(ccacheDir)})
+			}
+			if chroots {
+				targets = append(targets, cleanTarget{"chroots", dirContents(chrootDir)})
+			}
+			if artifacts {
+				targets = append(targets, cleanTarget{"artifacts", []string{artifactsDir}})
+			}
+
+			var total int64
+			for _, t := range targets {
+				log.Printf("Cleaning %s...", t.name)
+				freed, err := removePaths(cmd.Context(), t.paths, dryRun)
+				if err != nil {
+					return errorf(errGeneral, "%w", err)
+				}
+				log.Printf("  %s: %s", t.name, formatSize(freed))
+				total += freed
+			}
+
+			if dryRun {
+				log.Printf("Would free %s in total.", formatSize(total))
+				return nil
+			}
+			log.Printf("Freed %s in total.", formatSize(total))
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&sources, "sources", false, "Remove downloaded sources (SRCDEST or archives and VCS clones in the current directory)")
+	cmd.Flags().BoolVar(&ccache, "ccache", false, "Empty the ccache directory")
+	cmd.Flags().BoolVar(&chroots, "chroots", false, "Remove build chroots")
+	cmd.Flags().BoolVar(&artifacts, "artifacts", false, "Remove the collected artifacts directory")
+	cmd.Flags().BoolVar(&all, "all", false, "Clean everything")
+	cmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "Only report what would be removed")
+	cmd.Flags().StringVar(&artifactsDir, "artifacts-dir", "artifacts", "The artifacts directory to remove")
+	cmd.Flags().StringVar(&ccacheDir, "ccache-dir", "", "The ccache directory (default $CCACHE_DIR or "+defaultCCacheDir+")")
+	cmd.Flags().StringVar(&chrootDir, "chroot-dir", defaultChrootDir, "The directory containing build chroots")
+	return cmd
+}
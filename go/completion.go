@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// completePackageDirs completes directories containing a PKGBUILD, descending
+// into the directory typed so far.
+func completePackageDirs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	base := filepath.Dir(toComplete + "x")
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var dirs []string
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		dir := e.Name()
+		if base != "." || strings.HasPrefix(toComplete, "./") {
+			dir = filepath.Join(base, e.Name())
+		}
+		if _, err := os.Stat(filepath.Join(dir, "PKGBUILD")); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeRepoPackages completes the package names in the database given as first argument.
+func completeRepoPackages(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	db, err := repodb.Read(repoDBPath(args[0]))
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return db.Names(), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeHistoryPackages completes the package names recorded in the build history.
+func completeHistoryPackages(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	records, err := loadBuilds(nil, 0)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	seen := map[string]bool{}
+	for _, r := range records {
+		seen[r.Package] = true
+	}
+	return sortedKeys(seen), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeCommandNames completes the names of the root command's subcommands.
+func completeCommandNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var names []string
+	for _, c := range cmd.Root().Commands() {
+		if c.IsAvailableCommand() {
+			names = append(names, c.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
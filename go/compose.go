@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// defaultArchisoProfile is the mkarchiso profile 'compose iso' starts from.
+const defaultArchisoProfile = "/usr/share/archiso/configs/releng"
+
+// composeRepoSection returns the pacman.conf section enabling the repository
+// of dbPath as a local file repository.
+func composeRepoSection(dbPath string) (string, error) {
+	abs, err := filepath.Abs(dbPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return "", fmt.Errorf("repository database: %w", err)
+	}
+	// Packages are signed (or not) by our own pipeline, not by a key in the
+	// keyring of the image being composed
+	return fmt.Sprintf("[%s]\nSigLevel = Optional TrustAll\nServer = file://%s\n\n", repoName(dbPath), filepath.Dir(abs)), nil
+}
+
+// withRepo returns the pacman.conf text with section inserted before the
+// first repository, so our packages take precedence over official ones.
+func withRepo(conf, section string) string {
+	reRepo := regexp.MustCompile(`(?m)^\[`)
+	for _, loc := range reRepo.FindAllStringIndex(conf, -1) {
+		if !strings.HasPrefix(conf[loc[0]:], "[options]") {
+			return conf[:loc[0]] + section + conf[loc[0]:]
+		}
+	}
+	return conf + "\n" + section
+}
+
+// composeProfileFor returns the named profile and the database it installs from.
+func composeProfileFor(name string) (composeProfile, string, error) {
+	p, ok := cfg.Compose.Profiles[name]
+	if !ok {
+		return p, "", errorf(errConfig, "unknown compose profile %q (configured: %s)", name, strings.Join(slices.Sorted(maps.Keys(cfg.Compose.Profiles)), ", "))
+	}
+	repo := p.Repo
+	if repo == "" {
+		repo = cfg.Compose.Repo
+	}
+	if repo == "" {
+		return p, "", errorf(errConfig, "compose profile %s: no repository; set compose.repo or compose.profiles.%s.repo", name, name)
+	}
+	return p, repoDBPath(repo), nil
+}
+
+// runComposeHooks runs the shell commands of a profile as root with $ROOTFS
+// set to the tree being composed.
+func runComposeHooks(ctx context.Context, hooks []string, rootfs string) error {
+	for _, hook := range hooks {
+		log.Printf("Running hook: %s", hook)
+		if err := runAsRoot(ctx, "env", "ROOTFS="+rootfs, "sh", "-c", hook); err != nil {
+			return errorf(errBuild, "hook %q failed: %w", hook, err)
+		}
+	}
+	return nil
+}
+
+// newComposeCmd creates the 'compose' command.
+func newComposeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "compose",
+		Short: "Composes root filesystems and ISO images from our repository.",
+		Long: `Installs the packages of a profile (compose.profiles.<name>) with our repository
+(compose.repo, a channel or database path, e.g. staging) enabled ahead of the
+official ones, and collects the result as an artifact. The commands in the
+profile's hooks run as root before packing, with $ROOTFS set to the tree.`,
+	}
+
+	var profileName, outputDir string
+	cmd.PersistentFlags().StringVar(&profileName, "profile", "", "Profile to compose (compose.profiles.<name>)")
+	cmd.PersistentFlags().StringVarP(&outputDir, "output-dir", "o", "artifacts", "Directory the image is written to")
+	cmd.MarkPersistentFlagRequired("profile")
+	cmd.RegisterFlagCompletionFunc("profile", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return slices.Sorted(maps.Keys(cfg.Compose.Profiles)), cobra.ShellCompDirectiveNoFileComp
+	})
+
+	// composeConf writes a pacman.conf based on base with our repository and
+	// returns its path
+	composeConf := func(base, dbPath, dir string) (string, error) {
+		section, err := composeRepoSection(dbPath)
+		if err != nil {
+			return "", errorf(errPublish, "%w", err)
+		}
+		conf, err := os.ReadFile(base)
+		if err != nil {
+			return "", errorf(errConfig, "could not read %s: %w", base, err)
+		}
+		path := filepath.Join(dir, "pacman.conf")
+		if err := os.WriteFile(path, []byte(withRepo(string(conf), section)), 0644); err != nil {
+			return "", errorf(errGeneral, "could not write %s: %w", path, err)
+		}
+		return path, nil
+	}
+
+	rootfsCmd := &cobra.Command{
+		Use:   "rootfs",
+		Short: "Builds a root filesystem tarball with pacstrap.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, dbPath, err := composeProfileFor(profileName)
+			if err != nil {
+				return err
+			}
+			if len(p.Packages) == 0 {
+				return errorf(errConfig, "compose profile %s has no packages", profileName)
+			}
+			if err := os.MkdirAll(outputDir, 0755); err != nil {
+				return errorf(errArtifact, "could not create %s: %w", outputDir, err)
+			}
+			work, err := os.MkdirTemp("", "builder-compose-")
+			if err != nil {
+				return errorf(errGeneral, "could not create work directory: %w", err)
+			}
+			rootfs := filepath.Join(work, "rootfs")
+			defer runAsRoot(context.WithoutCancel(cmd.Context()), "rm", "-rf", "--one-file-system", work)
+			conf, err := composeConf(pacmanConf, dbPath, work)
+			if err != nil {
+				return err
+			}
+			if err := os.Mkdir(rootfs, 0755); err != nil {
+				return errorf(errGeneral, "%w", err)
+			}
+
+			setPhase("pacstrap")
+			log.Printf("Installing %d package(s) into the %s rootfs...", len(p.Packages), profileName)
+			// -c uses the host cache, -G keeps the host keyring out, -M the mirrorlist
+			if err := runAsRoot(cmd.Context(), "pacstrap", append([]string{"-C", conf, "-c", "-G", "-M", rootfs}, p.Packages...)...); err != nil {
+				return errorf(errDependency, "pacstrap failed: %w", err)
+			}
+			if err := runComposeHooks(cmd.Context(), p.Hooks, rootfs); err != nil {
+				return err
+			}
+
+			setPhase("pack rootfs")
+			date := time.Now().UTC()
+			// Sorted entries without access times, clamped to SOURCE_DATE_EPOCH
+			// when set, pack the same packages into the same bytes
+			tarArgs := []string{"--numeric-owner", "--xattrs", "--acls", "--sort=name", "--pax-option=delete=atime,delete=ctime"}
+			if epoch, ok := sourceDateEpoch(); ok {
+				date = epoch
+				tarArgs = append(tarArgs, fmt.Sprintf("--mtime=@%d", epoch.Unix()), "--clamp-mtime")
+			}
+			out, err := filepath.Abs(filepath.Join(outputDir, fmt.Sprintf("%s-rootfs-%s.tar.zst", profileName, date.Format("20060102"))))
+			if err != nil {
+				return errorf(errGeneral, "%w", err)
+			}
+			if err := runAsRoot(cmd.Context(), "tar", append(tarArgs, "--zstd", "-cf", out, "-C", rootfs, ".")...); err != nil {
+				return errorf(errArtifact, "could not pack the rootfs: %w", err)
+			}
+			if os.Geteuid() != 0 {
+				runAsRoot(cmd.Context(), "chown", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()), out)
+			}
+			log.Printf("  Collected: %s", out)
+			return nil
+		},
+	}
+
+	isoCmd := &cobra.Command{
+		Use:   "iso",
+		Short: "Builds an ISO image with mkarchiso.",
+		Long: `Builds an ISO image with mkarchiso from a copy of the profile's archiso profile
+(compose.profiles.<name>.archiso, default the releng profile), with our
+repository added to its pacman.conf and the profile's packages appended to its
+package list. Hooks see the airootfs directory of the copy as $ROOTFS.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, dbPath, err := composeProfileFor(profileName)
+			if err != nil {
+				return err
+			}
+			source := p.Archiso
+			if source == "" {
+				source = defaultArchisoProfile
+			}
+			out, err := filepath.Abs(outputDir)
+			if err != nil {
+				return errorf(errGeneral, "%w", err)
+			}
+			if err := os.MkdirAll(out, 0755); err != nil {
+				return errorf(errArtifact, "could not create %s: %w", outputDir, err)
+			}
+			work, err := os.MkdirTemp("", "builder-compose-")
+			if err != nil {
+				return errorf(errGeneral, "could not create work directory: %w", err)
+			}
+			defer runAsRoot(context.WithoutCancel(cmd.Context()), "rm", "-rf", "--one-file-system", work)
+
+			profile := filepath.Join(work, "profile")
+			if err := runCommand(cmd.Context(), "cp", "-a", source, profile); err != nil {
+				return errorf(errConfig, "could not copy archiso profile %s: %w", source, err)
+			}
+			if _, err := composeConf(filepath.Join(profile, "pacman.conf"), dbPath, profile); err != nil {
+				return err
+			}
+			if len(p.Packages) > 0 {
+				list := filepath.Join(profile, "packages."+carch())
+				f, err := os.OpenFile(list, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+				if err != nil {
+					return errorf(errConfig, "could not extend %s: %w", list, err)
+				}
+				_, err = f.WriteString("\n" + strings.Join(p.Packages, "\n") + "\n")
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil {
+					return errorf(errConfig, "could not extend %s: %w", list, err)
+				}
+			}
+			if err := runComposeHooks(cmd.Context(), p.Hooks, filepath.Join(profile, "airootfs")); err != nil {
+				return err
+			}
+
+			setPhase("mkarchiso")
+			log.Printf("Building the %s ISO...", profileName)
+			started := time.Now()
+			if err := runAsRoot(cmd.Context(), "mkarchiso", "-v", "-w", filepath.Join(work, "work"), "-o", out, profile); err != nil {
+				return errorf(errBuild, "mkarchiso failed: %w", err)
+			}
+			isos, _ := filepath.Glob(filepath.Join(out, "*.iso"))
+			for _, iso := range isos {
+				if st, err := os.Stat(iso); err == nil && !st.ModTime().Before(started) {
+					if os.Geteuid() != 0 {
+						runAsRoot(cmd.Context(), "chown", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()), iso)
+					}
+					log.Printf("  Collected: %s", iso)
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.AddCommand(rootfsCmd, isoCmd)
+	return cmd
+}
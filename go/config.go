@@ -0,0 +1,1503 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is read from the working directory when --config is not given.
+const defaultConfigFile = "builder.yaml"
+
+// packageConfigFile in a package directory overrides the configuration for
+// that package; it is read from the working directory as well.
+const packageConfigFile = ".pkgbuilder.yaml"
+
+// annotationNoConfig marks commands that must run even when the configuration
+// file is invalid; it is inherited by subcommands.
+const annotationNoConfig = "builder/no-config"
+
+// config holds the settings of the optional YAML configuration file.
+// The desc tags document each key in the generated JSON schema.
+type config struct {
+	Build   buildConfig   `yaml:"build" desc:"Settings for 'builder build', usually overridden per package in .pkgbuilder.yaml"`
+	Package packageMeta   `yaml:"package" desc:"What workspace commands know about the package, set in its .pkgbuilder.yaml"`
+	Keyring keyringConfig `yaml:"keyring" desc:"Settings for 'builder keyring init'"`
+	Fetch   fetchConfig   `yaml:"fetch" desc:"Settings for downloading sources"`
+	Repo    repoConfig    `yaml:"repo" desc:"Settings for 'builder repo'"`
+	Cache   cacheConfig   `yaml:"cache" desc:"Settings for caches shared between runs"`
+	Pacman  pacmanConfig  `yaml:"pacman" desc:"Settings for running pacman"`
+	Image   imageConfig   `yaml:"image" desc:"Settings for 'builder image'"`
+	Compose composeConfig `yaml:"compose" desc:"Settings for 'builder compose'"`
+	Serve   serveConfig   `yaml:"serve" desc:"Settings for 'builder serve' and its workers"`
+	// Storage backends are opened by name with openStorage
+	Storage map[string]storageConfig `yaml:"storage" desc:"Named destinations of published files, repositories and shared caches"`
+	// SizeGuard catches packages that grew unexpectedly, see checkSizeGrowth
+	SizeGuard sizeGuardConfig `yaml:"size_guard" desc:"Warnings and failures for packages that grew since their last build or published version"`
+	// PackageCheck configures checkPackageFiles
+	PackageCheck packageCheckConfig `yaml:"package_check" desc:"Checks of file ownership, setuid files and systemd unit paths in built packages"`
+	// Hardening configures checkHardening
+	Hardening hardeningConfig `yaml:"hardening" desc:"Checks of RELRO, PIE, stack canaries and NX of the ELF files in built packages"`
+	// Lint configures lintInstallScript
+	Lint lintConfig `yaml:"lint" desc:"Settings for 'builder lint' of install scriptlets"`
+	// Audit configures auditPackage
+	Audit auditConfig `yaml:"audit" desc:"Settings for 'builder audit' of vendored language dependencies"`
+	// Kernel configures checkKernelPackages
+	Kernel kernelConfig `yaml:"kernel" desc:"Checks of DKMS and kernel module packages against the target kernel"`
+	// Chroot configures the pool of acquireChroot
+	Chroot chrootConfig `yaml:"chroot" desc:"Pool of build chroots of the chroot backend"`
+	// Toolchain pins are checked by prepareToolchains
+	Toolchain toolchainConfig `yaml:"toolchain" desc:"Language toolchain versions builds must use, installed or verified before building"`
+	// Sandbox configures evaluateCommand
+	Sandbox sandboxConfig `yaml:"sandbox" desc:"Sandbox PKGBUILDs are evaluated in outside of builds"`
+	// Debuginfod configures publishDebugInfo
+	Debuginfod debuginfodConfig `yaml:"debuginfod" desc:"Upload of the debug symbols of -debug packages to a debuginfod server"`
+	// Git configures commitPackage
+	Git gitConfig `yaml:"git" desc:"Commits of bumped packages made by 'bump --commit'"`
+	// Pipeline configures the phases of 'builder pipeline'
+	Pipeline pipelineConfig `yaml:"pipeline" desc:"Phases of 'builder pipeline'"`
+	// Redact configures setupRedaction
+	Redact redactConfig `yaml:"redact" desc:"Values and patterns masked in all output, besides the secrets of 'builder secrets'"`
+	// Timeouts override defaultTimeouts by command name, e.g. gpg: 2m
+	Timeouts map[string]time.Duration `yaml:"timeouts" desc:"Maximum run time of external commands by name (gpg, pacman, paru, ...; default for all others); 0 disables the limit"`
+	// Profiles are checked as configuration documents themselves and
+	// decoded onto the configuration by applyProfile
+	Profiles map[string]yaml.Node `yaml:"profiles" desc:"Named sets of settings (dev, release, ...) applied on top of this file with --profile"`
+}
+
+// buildConfig configures 'build'.
+type buildConfig struct {
+	Backend string            `yaml:"backend" desc:"Tool that builds the package: paru (default), makepkg or chroot (makechrootpkg in a chroot of the pool, see 'builder chroot')"`
+	NoCheck bool              `yaml:"nocheck" desc:"Skip the check() function of the PKGBUILD"`
+	Timeout time.Duration     `yaml:"timeout" desc:"Maximum build time, overriding timeouts.<backend>; 0 keeps the default"`
+	Env     map[string]string `yaml:"env" desc:"Environment variables set for the build"`
+	SignKey string            `yaml:"sign_key" desc:"GPG key packages and databases are signed with (default: gpg default key)"`
+	Channel string            `yaml:"channel" desc:"Channel or database 'repo add' publishes to when no database is given"`
+	Sign    bool              `yaml:"sign" desc:"Sign packages and repository databases as if --sign were given"`
+	Offline bool              `yaml:"offline" desc:"Build without network after fetching the sources, as if --offline-build were given"`
+	Audit   bool              `yaml:"audit" desc:"Trace the files and network addresses the build uses, as if --audit were given"`
+	// BuildDir is parsed by parseBuildDir
+	BuildDir string `yaml:"builddir" desc:"Directory makepkg builds in, as with --builddir: tmpfs, tmpfs:<size> or a path (default: the package directory)"`
+	// Compression selects PKGEXT, e.g. zst for .pkg.tar.zst
+	Compression string `yaml:"compression" desc:"Package compression: zst, xz, gz, bz2, lz4, lrz, lzo or Z (default: makepkg.conf)"`
+	// March selects a microarchitecture level, see marchMakepkgConf
+	March string `yaml:"march" desc:"x86_64 microarchitecture level to optimize for (x86-64-v2, x86-64-v3, x86-64-v4); also routes 'repo add' to the per-ISA repository, e.g. <repo>-v3"`
+	// Variants are built one after another by 'build', see buildVariants
+	Variants map[string]buildVariant `yaml:"variants" desc:"Build variants by name, each built with its own environment and producing its own packages"`
+	// Distcc configures startDistcc
+	Distcc distccConfig `yaml:"distcc" desc:"Distributed compilation of builds with distcc or icecream"`
+}
+
+// packageMeta describes a package of a workspace, see readPackageMeta.
+type packageMeta struct {
+	Stage    int `yaml:"stage" desc:"Build stage: packages of a stage are built after every package of the lower stages, e.g. 0 for toolchains and 2 for leaf packages (default 0)"`
+	Priority int `yaml:"priority" desc:"Among packages whose dependencies and earlier stages are built, those with a higher priority are built first (default 0)"`
+	// Labels are matched by --select, see parseSelector
+	Labels []string `yaml:"labels" desc:"Labels --select expressions of workspace commands match, e.g. [desktop, large]"`
+	// Status quarantines the package, see skipQuarantined
+	Status string `yaml:"status" desc:"broken or on-hold: workspace builds skip the package unless --include-quarantined is given, and 'builder status' lists it"`
+	Reason string `yaml:"reason" desc:"Why the package is broken or on hold, e.g. a link to the upstream issue"`
+	Since  string `yaml:"since" desc:"Date (YYYY-MM-DD) the package was quarantined (default: the last commit of its .pkgbuilder.yaml)"`
+}
+
+// distccConfig configures distributed compilation.
+type distccConfig struct {
+	Tool      string   `yaml:"tool" desc:"distcc (default) or icecream"`
+	Hosts     []string `yaml:"hosts" desc:"distcc hosts as in DISTCC_HOSTS, e.g. ['10.0.0.2/8,lzo', +zeroconf]"`
+	SRV       string   `yaml:"srv" desc:"DNS SRV record listing further distcc hosts, e.g. _distccd._tcp.example.com"`
+	Jobs      int      `yaml:"jobs" desc:"Parallel make jobs (default: the sum of the host limits with distcc, twice the CPUs with icecream)"`
+	Scheduler string   `yaml:"scheduler" desc:"icecream scheduler the local iceccd is started with (default: found by broadcast)"`
+}
+
+// buildVariant is one entry of the build matrix of a package.
+type buildVariant struct {
+	Env   map[string]string `yaml:"env" desc:"Environment variables of this variant, added to build.env; $BUILDER_VARIANT holds its name"`
+	March string            `yaml:"march" desc:"Microarchitecture level of this variant, overriding build.march"`
+}
+
+// packageCompressions are the package compressions makepkg supports.
+var packageCompressions = []string{"zst", "xz", "gz", "bz2", "lz4", "lrz", "lzo", "Z"}
+
+// pkgext returns the PKGEXT of a build.compression value.
+func pkgext(compression string) string {
+	return ".pkg.tar." + compression
+}
+
+// keyringConfig configures 'keyring init'.
+type keyringConfig struct {
+	Keyrings  []string `yaml:"keyrings" desc:"Keyrings to populate; defaults to every known keyring that is installed"`
+	Keys      []string `yaml:"keys" desc:"Key fingerprints fetched from the keyserver and locally signed"`
+	KeyFiles  []string `yaml:"key_files" desc:"Armored public key files imported and locally signed"`
+	Keyserver string   `yaml:"keyserver" desc:"Keyserver used to fetch keys"`
+	SigLevel  string   `yaml:"siglevel" desc:"SigLevel written to the [options] section of pacman.conf"`
+}
+
+// fetchConfig configures 'fetch'.
+type fetchConfig struct {
+	Mirrors   map[string][]string `yaml:"mirrors" desc:"Alternative URL prefixes tried in order when a source URL with the given prefix fails"`
+	Jobs      int                 `yaml:"jobs" desc:"Number of parallel downloads"`
+	Retries   int                 `yaml:"retries" desc:"Attempts per URL before falling back to the next mirror"`
+	LimitRate string              `yaml:"limit_rate" desc:"Total bandwidth limit such as 500K or 2M (bytes per second)"`
+	// IPFSGateways are HTTP gateways for ipfs:// sources, e.g. http://127.0.0.1:8080/ipfs/
+	IPFSGateways []string `yaml:"ipfs_gateways" desc:"HTTP gateways used for ipfs:// sources, tried in order"`
+	VendorDir    string   `yaml:"vendor_dir" desc:"Source mirror created by 'sources vendor', preferred over upstream"`
+}
+
+// pacmanConfig configures how pacman is run.
+type pacmanConfig struct {
+	LockWait        time.Duration `yaml:"lock_wait" desc:"How long to wait for another pacman to release the database lock (default 10m)"`
+	RemoveStaleLock bool          `yaml:"remove_stale_lock" desc:"Remove a database lock left behind when no pacman process is running"`
+	// RankMirrors is a download size such as 200M, see rankMirrors
+	RankMirrors string             `yaml:"rank_mirrors" desc:"Rank the mirrorlist by measured throughput before 'deps' downloads more than this much, e.g. 200M"`
+	Static      pacmanStaticConfig `yaml:"static" desc:"Pinned pacman-static used when pacman is not installed"`
+	// SnapshotDate is YYYY-MM-DD, see useSnapshot
+	SnapshotDate string `yaml:"snapshot_date" desc:"Install dependencies from the Arch Linux Archive as of this date, e.g. 2024-03-01"`
+}
+
+// pacmanStaticConfig pins the pacman-static binary, see resolvePacman.
+type pacmanStaticConfig struct {
+	URL    string `yaml:"url" desc:"Download URL of pacman-static (default: the x86_64 build on pkgbuild.com)"`
+	SHA256 string `yaml:"sha256" desc:"SHA-256 the binary is pinned to; setting it enables the fallback"`
+}
+
+// imageConfig configures 'image'.
+type imageConfig struct {
+	Name     string   `yaml:"name" desc:"Repository the builder image is tagged and pushed as; default $CI_REGISTRY_IMAGE/builder"`
+	Base     string   `yaml:"base" desc:"Base image (default archlinux:base-devel)"`
+	Packages []string `yaml:"packages" desc:"Toolchains and other packages installed into the image"`
+	// Containerfile replaces defaultContainerfile, see containerfileData
+	Containerfile string `yaml:"containerfile" desc:"Go template of the Containerfile, rendered with .Base, .Packages and .Version"`
+	Engine        string `yaml:"engine" desc:"Container engine: podman, docker or buildah (default: the first installed)"`
+	// DependencyProxy is a GitLab dependency proxy image prefix, see proxiedImage
+	DependencyProxy string `yaml:"dependency_proxy" desc:"Image prefix of the GitLab dependency proxy Docker Hub images are pulled through (default $CI_DEPENDENCY_PROXY_GROUP_IMAGE_PREFIX); off disables it"`
+}
+
+// composeConfig configures 'compose'.
+type composeConfig struct {
+	Repo     string                    `yaml:"repo" desc:"Channel or database path of the repository images are composed from, e.g. staging"`
+	Profiles map[string]composeProfile `yaml:"profiles" desc:"Image profiles by name, selected with --profile"`
+}
+
+// composeProfile is an image composed by 'compose rootfs' or 'compose iso'.
+type composeProfile struct {
+	Packages []string `yaml:"packages" desc:"Packages installed into the image"`
+	Repo     string   `yaml:"repo" desc:"Repository of this profile, overriding compose.repo"`
+	Archiso  string   `yaml:"archiso" desc:"archiso profile directory 'compose iso' starts from (default /usr/share/archiso/configs/releng)"`
+	Hooks    []string `yaml:"hooks" desc:"Shell commands run as root before packing, with $ROOTFS set to the image tree"`
+}
+
+// packageCheckConfig configures the checks of built packages.
+type packageCheckConfig struct {
+	SetuidAllowed []string `yaml:"setuid_allowed" desc:"Paths (globs) of files that may be setuid or setgid, e.g. /usr/bin/foo-helper"`
+	WarnOnly      bool     `yaml:"warn_only" desc:"Only warn about problems of severity error instead of failing the build"`
+}
+
+// hardeningConfig configures checkHardening.
+type hardeningConfig struct {
+	// Require holds percentages by property, see hardeningProperties
+	Require map[string]int `yaml:"require" desc:"Minimum percentage of the ELF files of a package with each property (relro, full-relro, pie, canary, nx) below which the build fails; properties not listed are only reported"`
+	Ignore  []string       `yaml:"ignore" desc:"Paths (globs) of ELF files not checked, e.g. /usr/lib/foo/plugins/*"`
+}
+
+// lintConfig configures 'lint'.
+type lintConfig struct {
+	InstallHooks []string `yaml:"install_hooks" desc:"Functions install scriptlets may define (default: all six pre_/post_ install, upgrade and remove hooks)"`
+	Disable      []string `yaml:"disable" desc:"Lint rules not checked, e.g. install-systemctl"`
+}
+
+// auditConfig configures 'audit'.
+type auditConfig struct {
+	OnBuild bool     `yaml:"on_build" desc:"Write <pkgname>.deps.cdx.json and warn about vulnerable dependencies after every 'build'"`
+	OSVURL  string   `yaml:"osv_url" desc:"OSV API dependencies are checked against (default https://api.osv.dev)"`
+	Ignore  []string `yaml:"ignore" desc:"Vulnerability IDs that do not apply, e.g. RUSTSEC-2023-0071"`
+}
+
+// kernelConfig configures the checks of kernel module packages.
+type kernelConfig struct {
+	Headers   string `yaml:"headers" desc:"Headers package of the target kernel (default linux-headers)"`
+	Release   string `yaml:"release" desc:"Kernel release (uname -r) modules must be built for, e.g. 6.10.3-arch1-1 (default: that of the installed headers)"`
+	DKMSCheck bool   `yaml:"dkms_check" desc:"Build the modules of DKMS packages against the headers in a clean container after 'build'"`
+	Image     string `yaml:"image" desc:"Image of the DKMS check container (default archlinux:base-devel)"`
+}
+
+type chrootConfig struct {
+	Dir         string        `yaml:"dir" desc:"Directory of the chroots (default /var/lib/archbuild)"`
+	Pool        int           `yaml:"pool" desc:"Number of chroots, i.e. of concurrent chroot builds on the runner (default 2)"`
+	MaxAge      time.Duration `yaml:"max_age" desc:"Age after which a chroot is updated before it is built in (default 24h)"`
+	Packages    []string      `yaml:"packages" desc:"Packages chroots are created with (default base-devel)"`
+	PacmanConf  string        `yaml:"pacman_conf" desc:"pacman.conf of the chroots (mkarchroot -C)"`
+	MakepkgConf string        `yaml:"makepkg_conf" desc:"makepkg.conf of the chroots (mkarchroot -M)"`
+	// Overlay builds in an overlayfs over the chroot, see mountOverlay
+	Overlay bool `yaml:"overlay" desc:"Build in an overlayfs over the chroot, discarded afterwards, instead of a copy of it (needs a privileged runner)"`
+}
+
+type toolchainConfig struct {
+	Rust string `yaml:"rust" desc:"rustup toolchain, e.g. 1.79.0 or nightly-2024-06-01; installed with rustup when missing and selected with RUSTUP_TOOLCHAIN"`
+	Go   string `yaml:"go" desc:"Go release, e.g. 1.22.5; selected with GOTOOLCHAIN, which downloads it unless the installed go is that release"`
+	GCC  string `yaml:"gcc" desc:"gcc version, e.g. 14 or 13.2; a versioned gcc-<major> is used through CC and CXX when the default gcc differs"`
+}
+
+type sandboxConfig struct {
+	Mode string `yaml:"mode" desc:"Evaluate PKGBUILDs (makepkg --printsrcinfo) in a bubblewrap sandbox without network and environment: auto (default, when bwrap is installed), require or off"`
+}
+
+type debuginfodConfig struct {
+	URL          string `yaml:"url" desc:"debuginfod server the debug symbols of built -debug packages are uploaded to with PUT <url>/buildid/<id>/debuginfo"`
+	DropPackages bool   `yaml:"drop_packages" desc:"Remove the -debug packages after uploading their symbols, so they are not published"`
+}
+
+type gitConfig struct {
+	CommitMessage string `yaml:"commit_message" desc:"Template of commit messages with .Name (pkgbase), .Version (full version), .PkgVer, .PkgRel and .OldVersion (default: upgpkg: {{.Name}} {{.Version}})"`
+	Signoff       bool   `yaml:"signoff" desc:"Add a Signed-off-by trailer to commits, as if --signoff were given"`
+	GPGSign       bool   `yaml:"gpg_sign" desc:"Sign commits and tags with GPG, as if --gpg-sign were given"`
+	SignKey       string `yaml:"sign_key" desc:"GPG key commits and tags are signed with (default: user.signingkey of git)"`
+	Remote        string `yaml:"remote" desc:"Remote commits and tags are pushed to (default origin)"`
+	Push          string `yaml:"push" desc:"Branch commits are pushed to, as if --push were given"`
+	// TagName and TagMessage are rendered like CommitMessage
+	TagName    string `yaml:"tag_name" desc:"Template of the tags of 'release tag' (default: {{.Version}}, with the colon of an epoch replaced by a hyphen)"`
+	TagMessage string `yaml:"tag_message" desc:"Template of the messages of annotated tags (default: Release {{.Name}} {{.Version}})"`
+}
+
+type redactConfig struct {
+	Env      []string `yaml:"env" desc:"Environment variables whose values are masked, e.g. [NPM_TOKEN, CARGO_REGISTRY_TOKEN]"`
+	Patterns []string `yaml:"patterns" desc:"Regular expressions of further values to mask; with a group, only the group is masked"`
+	// NoBuiltin disables redactBuiltinPatterns
+	NoBuiltin bool `yaml:"no_builtin_patterns" desc:"Do not mask common token formats: GitLab, GitHub, AWS and Slack tokens, URL passwords and Authorization headers"`
+}
+
+type pipelineConfig struct {
+	Publish []string `yaml:"publish" desc:"Builder command line of the publish phase, e.g. [publish, packages, artifacts/*.pkg.tar.zst]; globs are expanded"`
+}
+
+// sizeGuardConfig configures the package size regression checks.
+type sizeGuardConfig struct {
+	WarnPercent float64 `yaml:"warn_percent" desc:"Warn when a package or installed size grows by more than this percentage (default 20)"`
+	FailPercent float64 `yaml:"fail_percent" desc:"Fail when a size grows by more than this percentage; 0 only warns"`
+}
+
+// cacheConfig configures the caches kept between runs.
+type cacheConfig struct {
+	Dir      string `yaml:"dir" desc:"Cache directory; default $XDG_CACHE_HOME/builder"`
+	Metadata bool   `yaml:"metadata" desc:"Keep parsed PKGBUILD metadata on disk, keyed by the PKGBUILD's hash"`
+	// Storage shares the metadata cache, see sharedCache
+	Storage string `yaml:"storage" desc:"Storage sharing the metadata cache between runners (with metadata) and builds (with builds)"`
+	// Builds are shared by fingerprint, see buildCache
+	Builds bool `yaml:"builds" desc:"Share built packages through cache.storage by the fingerprint of their inputs; builds of the same inputs download them instead of building"`
+	// Sccache is shared between runners, unlike the local ccache
+	Sccache sccacheConfig `yaml:"sccache" desc:"Compiler cache shared through S3 or Redis with sccache; also enabled by the SCCACHE_BUCKET or SCCACHE_REDIS_ENDPOINT CI variables"`
+}
+
+// sccacheConfig configures the shared compiler cache of builds.
+type sccacheConfig struct {
+	Backend  string `yaml:"backend" desc:"Storage of the cache: s3 or redis (endpoint from the sccache-redis secret)"`
+	Bucket   string `yaml:"bucket" desc:"S3 bucket (default $SCCACHE_BUCKET)"`
+	Endpoint string `yaml:"endpoint" desc:"S3 endpoint of non-AWS storage such as MinIO (default $SCCACHE_ENDPOINT)"`
+	Region   string `yaml:"region" desc:"S3 region (default $SCCACHE_REGION)"`
+	Prefix   string `yaml:"prefix" desc:"Key prefix separating caches sharing a bucket or server, e.g. per toolchain"`
+}
+
+// serveConfig configures 'serve'.
+type serveConfig struct {
+	// Repositories restrict builds by git ref, see gitSource.check
+	Repositories []string `yaml:"repositories" desc:"Git repositories, or groups of them, the API may request builds by ref from; none are allowed by default"`
+	// Webhooks are matched by releaseJobs
+	Webhooks []webhookPackage `yaml:"webhooks" desc:"Packages updated and built when their upstream publishes a release ('serve --webhooks')"`
+	Schedule []scheduledTask  `yaml:"schedule" desc:"Tasks the coordinator runs periodically"`
+	Auth     serveAuth        `yaml:"auth" desc:"Clients allowed to use the API and their roles"`
+	// Workspace is checked by the dashboard, see dashboard.refreshOutdated
+	Workspace string `yaml:"workspace" desc:"Package workspace whose outdated packages the dashboard lists"`
+}
+
+// serveAuth configures who may use the coordinator API, see authenticator.
+type serveAuth struct {
+	Tokens []serveToken `yaml:"tokens" desc:"Static bearer tokens, e.g. of bots and workers"`
+	OIDC   oidcConfig   `yaml:"oidc" desc:"Accept OIDC ID tokens, such as the id_tokens of GitLab CI jobs"`
+}
+
+// serveToken is a named static token with its roles.
+type serveToken struct {
+	Name string `yaml:"name" desc:"Name of the client in the audit log"`
+	// Env keeps the token itself out of the configuration file
+	Env      string   `yaml:"env" desc:"Environment variable holding the token ($<env>_FILE may name a file instead)"`
+	Roles    []string `yaml:"roles" desc:"Roles of the token: submit, publish, worker or admin"`
+	Projects []string `yaml:"projects" desc:"Projects (group/name patterns) the token may build and publish; default any"`
+}
+
+// oidcConfig configures the validation of OIDC ID tokens.
+type oidcConfig struct {
+	Issuer   string     `yaml:"issuer" desc:"Issuer URL, e.g. https://gitlab.example.com"`
+	Audience string     `yaml:"audience" desc:"Audience the tokens must be issued for, e.g. the coordinator's URL"`
+	Rules    []oidcRule `yaml:"rules" desc:"Roles granted to the CI jobs of matching projects; tokens matching no rule have none"`
+}
+
+// oidcRule grants roles to tokens matching its projects and refs.
+type oidcRule struct {
+	Projects      []string `yaml:"projects" desc:"Patterns matching the project_path claim, e.g. prismlinux/*"`
+	Refs          []string `yaml:"refs" desc:"Patterns matching the ref claim (branch or tag); default any"`
+	ProtectedRefs bool     `yaml:"protected_refs" desc:"Only match jobs of protected branches and tags"`
+	Roles         []string `yaml:"roles" desc:"Roles granted: submit, publish, worker or admin"`
+}
+
+// scheduledTask is a periodic task of the coordinator, run by scheduler.
+type scheduledTask struct {
+	Name        string           `yaml:"name" desc:"Name of the task in the status endpoint and logs"`
+	Every       time.Duration    `yaml:"every" desc:"Interval between runs, e.g. 6h"`
+	Cron        string           `yaml:"cron" desc:"Cron expression (minute hour day month weekday, UTC) instead of every"`
+	Run         []string         `yaml:"run" desc:"builder command run on the coordinator, e.g. [outdated, --workspace, /srv/packages]"`
+	Builds      []scheduledBuild `yaml:"builds" desc:"Builds queued for the workers instead of a command, e.g. of VCS packages"`
+	Concurrency int              `yaml:"concurrency" desc:"Runs of the command, or builds of the task, in progress at once (default 1)"`
+}
+
+// scheduledBuild is a package of a git repository built by a task.
+type scheduledBuild struct {
+	Repo string `yaml:"repo" desc:"Git repository of the package, listed in serve.repositories"`
+	Ref  string `yaml:"ref" desc:"Branch to build (default HEAD)"`
+	Path string `yaml:"path" desc:"Package directory within the repository"`
+}
+
+// webhookPackage maps an upstream project to the package following it.
+type webhookPackage struct {
+	Upstream  string `yaml:"upstream" desc:"Released project: owner/name on GitHub or the project path on GitLab"`
+	Package   string `yaml:"package" desc:"Name of the package in job listings (default: the directory name)"`
+	Repo      string `yaml:"repo" desc:"Git repository of the package, listed in serve.repositories"`
+	Ref       string `yaml:"ref" desc:"Branch the update is built from (default HEAD)"`
+	Path      string `yaml:"path" desc:"Package directory within the repository"`
+	TagPrefix string `yaml:"tag_prefix" desc:"Prefix stripped from release tags to get pkgver (default v)"`
+}
+
+// storageConfig is a destination files are uploaded to, see newStorage.
+type storageConfig struct {
+	URL      string `yaml:"url" desc:"A directory (path or file://), s3://<bucket>/<prefix>, ssh://[user@]host[:port]/<dir> (rsync), gitlab+https://<host>/api/v4/projects/<id>/packages/generic/<package>/<version> or webdav+https://[user@]host/<dir>"`
+	Endpoint string `yaml:"endpoint" desc:"S3 endpoint of non-AWS storage such as MinIO"`
+	Region   string `yaml:"region" desc:"S3 region (default us-east-1)"`
+}
+
+// repoConfig configures 'repo'.
+type repoConfig struct {
+	// Channels maps channel names such as stable or testing to their database
+	Channels      map[string]string `yaml:"channels" desc:"Named channels (stable, testing, ...) and their database paths, usable wherever 'repo' takes a <db>"`
+	SyncDBs       []string          `yaml:"sync_dbs" desc:"Databases (globs) of the official repositories that dependencies may come from; default /var/lib/pacman/sync/*.db"`
+	Snapshot      bool              `yaml:"snapshot" desc:"Snapshot the repository before every change made by 'repo'"`
+	KeepSnapshots int               `yaml:"keep_snapshots" desc:"Number of automatic snapshots to keep (default 10)"`
+	Arches        []string          `yaml:"arches" desc:"Architectures whose databases receive arch=(any) packages when a database path contains $arch (default: this machine's)"`
+	// Marches have a repository next to every channel, see optimizedDBPath
+	Marches []string `yaml:"marches" desc:"Optimized levels (x86-64-v3, ...) maintained next to the baseline repositories; publishing and promoting baseline packages keeps them consistent"`
+	// PostPublish commands see BUILDER_REPO_DB and BUILDER_REPO_NAME
+	PostPublish []string `yaml:"post_publish" desc:"Shell commands run after 'repo add' or 'promote' published packages, with $BUILDER_REPO_DB set to the database"`
+	// Storage is mirrored by mirrorRepoDir
+	Storage string `yaml:"storage" desc:"Storage the repository directories are mirrored to after every change"`
+	// Deltas are made by makeDeltas when packages are replaced
+	Deltas deltaConfig `yaml:"deltas" desc:"Deltas and zsync files published next to large packages"`
+}
+
+// deltaConfig configures the deltas of large packages, see makeDeltas.
+type deltaConfig struct {
+	Formats    []string `yaml:"formats" desc:"Delta formats: xdelta3 (binary delta from the replaced version) and zsync (control file); empty disables deltas"`
+	MinSizeMiB int      `yaml:"min_size_mib" desc:"Packages smaller than this many MiB get no deltas (default 50)"`
+}
+
+var (
+	configFile  string
+	profileName string
+	cfg         = &config{}
+)
+
+// configIssue is a problem found in a configuration file.
+type configIssue struct {
+	Line, Column int
+	Msg          string
+}
+
+// configError reports every issue of a configuration file with its position.
+type configError struct {
+	Path   string
+	Issues []configIssue
+}
+
+func (e *configError) Error() string {
+	lines := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		lines[i] = fmt.Sprintf("%s:%d:%d: %s", e.Path, issue.Line, issue.Column, issue.Msg)
+	}
+	return fmt.Sprintf("invalid config file %s:\n%s", e.Path, strings.Join(lines, "\n"))
+}
+
+// loadConfig reads the configuration file at path. A missing default file
+// is not an error; a missing explicitly requested file is.
+func loadConfig(path string, explicit bool) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			debugPrint("No configuration file %s, using defaults", path)
+			return &config{}, nil
+		}
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	c, err := parseConfig(path, data)
+	if err != nil {
+		return nil, err
+	}
+	debugPrint("Loaded configuration from %s", path)
+	return c, nil
+}
+
+// packageConfigDenied are the top-level keys a package configuration file
+// may not set: it comes with the PKGBUILD, and these would let a merge
+// request disable the sandbox and redaction or change the coordinator and
+// storage credentials.
+var packageConfigDenied = []string{"sandbox", "redact", "serve", "storage"}
+
+// checkPackageConfigKeys reports the keys of packageConfigDenied in the
+// package configuration document root, and in its profiles.
+func checkPackageConfigKeys(root *yaml.Node) []configIssue {
+	var issues []configIssue
+	var check func(n *yaml.Node, at string)
+	check = func(n *yaml.Node, at string) {
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			switch {
+			case slices.Contains(packageConfigDenied, k.Value):
+				issues = append(issues, configIssue{k.Line, k.Column, fmt.Sprintf("%s%s cannot be set in %s, only in the configuration file", at, k.Value, packageConfigFile)})
+			case k.Value == "profiles" && at == "" && v.Kind == yaml.MappingNode:
+				for j := 0; j+1 < len(v.Content); j += 2 {
+					check(v.Content[j+1], "profiles."+v.Content[j].Value+".")
+				}
+			}
+		}
+	}
+	check(root, "")
+	return issues
+}
+
+// loadPackageConfig merges the package configuration file at path, if it
+// exists, into c: its keys override those of c and maps such as build.env
+// are merged key by key. The keys of packageConfigDenied are refused.
+func loadPackageConfig(c *config, path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read package config file: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if len(doc.Content) > 0 {
+		if issues := checkPackageConfigKeys(doc.Content[0]); len(issues) > 0 {
+			return &configError{Path: path, Issues: issues}
+		}
+	}
+	if err := parseConfigOnto(c, path, data); err != nil {
+		return err
+	}
+	debugPrint("Merged package configuration from %s", path)
+	return nil
+}
+
+// applyProfile decodes the profile name of c, if c defines it, onto c and
+// reports whether it did. The profiles of c are dropped either way, so that
+// a later file merged onto c contributes its own.
+func applyProfile(c *config, name, path string) (bool, error) {
+	node, ok := c.Profiles[name]
+	c.Profiles = nil
+	if !ok {
+		return false, nil
+	}
+	if err := node.Decode(c); err != nil {
+		return true, fmt.Errorf("invalid profile %s in %s: %w", name, path, err)
+	}
+	c.Profiles = nil
+	if issues := c.check(&node); len(issues) > 0 {
+		for i := range issues {
+			issues[i].Msg = "profile " + name + ": " + issues[i].Msg
+		}
+		return true, &configError{Path: path, Issues: issues}
+	}
+	debugPrint("Applied profile %s from %s", name, path)
+	return true, nil
+}
+
+// parseConfig checks the structure and values of a configuration document
+// before decoding it, so that all problems are reported with their position.
+func parseConfig(path string, data []byte) (*config, error) {
+	c := &config{}
+	if err := parseConfigOnto(c, path, data); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseConfigOnto checks a configuration document like parseConfig and
+// decodes it onto c, keeping the settings it does not mention.
+func parseConfigOnto(c *config, path string, data []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+
+	var issues []configIssue
+	checkNode(root, reflect.TypeOf(*c), "", &issues)
+	if len(issues) == 0 {
+		if err := root.Decode(c); err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		issues = c.check(root)
+	}
+	if len(issues) > 0 {
+		return &configError{Path: path, Issues: issues}
+	}
+	return nil
+}
+
+// checkNode verifies that node has the shape expected by the Go type t.
+func checkNode(node *yaml.Node, t reflect.Type, key string, issues *[]configIssue) {
+	add := func(n *yaml.Node, format string, args ...any) {
+		*issues = append(*issues, configIssue{n.Line, n.Column, fmt.Sprintf(format, args...)})
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Tag == "!!null" {
+		return
+	}
+	if t == reflect.TypeOf(yaml.Node{}) {
+		checkNode(node, reflect.TypeOf(config{}), key, issues)
+		return
+	}
+	name := key
+	if name == "" {
+		name = "the document"
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			add(node, "%s must be a mapping", name)
+			return
+		}
+		fields := map[string]reflect.StructField{}
+		for i := 0; i < t.NumField(); i++ {
+			fields[yamlKey(t.Field(i))] = t.Field(i)
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k, v := node.Content[i], node.Content[i+1]
+			child := k.Value
+			if key != "" {
+				child = key + "." + k.Value
+			}
+			f, ok := fields[k.Value]
+			if !ok {
+				add(k, "unknown key %q (valid keys: %s)", child, strings.Join(sortedFieldKeys(fields), ", "))
+				continue
+			}
+			checkNode(v, f.Type, child, issues)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			add(node, "%s must be a mapping", name)
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			checkNode(node.Content[i+1], t.Elem(), key+"."+node.Content[i].Value, issues)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			add(node, "%s must be a list", name)
+			return
+		}
+		for i, item := range node.Content {
+			checkNode(item, t.Elem(), fmt.Sprintf("%s[%d]", key, i), issues)
+		}
+	case reflect.Bool:
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+			add(node, "%s must be true or false", name)
+		}
+	case reflect.Int, reflect.Int64:
+		if t == reflect.TypeOf(time.Duration(0)) {
+			if _, err := time.ParseDuration(node.Value); node.Kind != yaml.ScalarNode || err != nil {
+				add(node, "%s must be a duration such as 30s or 5m", name)
+			}
+		} else if node.Kind != yaml.ScalarNode || node.Tag != "!!int" {
+			add(node, "%s must be an integer", name)
+		}
+	case reflect.Float32, reflect.Float64:
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!int" && node.Tag != "!!float" {
+			add(node, "%s must be a number", name)
+		}
+	default:
+		if node.Kind != yaml.ScalarNode {
+			add(node, "%s must be a string", name)
+		}
+	}
+}
+
+// yamlKey returns the YAML key of a struct field.
+func yamlKey(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	return name
+}
+
+func sortedFieldKeys(fields map[string]reflect.StructField) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	reFingerprint = regexp.MustCompile(`^(0x)?([0-9A-Fa-f]{16}|[0-9A-Fa-f]{40})$`)
+	reSHA256      = regexp.MustCompile(`^[0-9A-Fa-f]{64}$`)
+	// reGoRelease matches the Go releases GOTOOLCHAIN accepts, e.g. 1.22.5
+	reGoRelease = regexp.MustCompile(`^(go)?1\.\d+(\.\d+|rc\d+)$`)
+	reGCCPin    = regexp.MustCompile(`^\d+(\.\d+){0,2}$`)
+	// reSigLevelOption matches a single pacman SigLevel option.
+	reSigLevelOption = regexp.MustCompile(`^(Package|Database)?(Never|Optional|Required|TrustedOnly|TrustAll)$`)
+)
+
+// check validates the values of a decoded configuration. Positions refer to root.
+func (c *config) check(root *yaml.Node) []configIssue {
+	var issues []configIssue
+	add := func(path, format string, args ...any) {
+		n := lookupNode(root, path)
+		issues = append(issues, configIssue{n.Line, n.Column, fmt.Sprintf(format, args...)})
+	}
+
+	if c.Package.Stage < 0 {
+		add("package.stage", "package.stage: must not be negative")
+	}
+	if st := c.Package.Status; st != "" && st != statusBroken && st != statusOnHold {
+		add("package.status", "package.status: %q must be %s or %s", st, statusBroken, statusOnHold)
+	}
+	if _, err := time.Parse(time.DateOnly, c.Package.Since); c.Package.Since != "" && err != nil {
+		add("package.since", "package.since: %q is not a YYYY-MM-DD date", c.Package.Since)
+	}
+	if v := c.Toolchain.Go; v != "" && !reGoRelease.MatchString(v) {
+		add("toolchain.go", "toolchain.go: %q must be a Go release such as 1.22.5", v)
+	}
+	if v := c.Toolchain.GCC; v != "" && !reGCCPin.MatchString(v) {
+		add("toolchain.gcc", "toolchain.gcc: %q must be a version such as 14 or 13.2", v)
+	}
+	if v := c.Toolchain.Rust; strings.ContainsAny(v, " \t/") {
+		add("toolchain.rust", "toolchain.rust: %q is not a rustup toolchain name", v)
+	}
+	if t := c.Build.Distcc.Tool; t != "" && t != distccTool && t != icecreamTool {
+		add("build.distcc.tool", "build.distcc.tool: %q must be distcc or icecream", t)
+	}
+	if c.Build.Distcc.Tool == icecreamTool && (len(c.Build.Distcc.Hosts) > 0 || c.Build.Distcc.SRV != "") {
+		add("build.distcc.hosts", "build.distcc.hosts: icecream finds its hosts through the scheduler; set build.distcc.scheduler instead")
+	}
+	if c.Build.Distcc.Jobs < 0 {
+		add("build.distcc.jobs", "build.distcc.jobs: must not be negative")
+	}
+	if _, _, err := parseBuildDir(c.Build.BuildDir); err != nil {
+		add("build.builddir", "build.builddir: %v", err)
+	}
+	if b := c.Build.Backend; b != "" && b != "paru" && b != "makepkg" && b != "chroot" {
+		add("build.backend", "build.backend: %q must be paru, makepkg or chroot", b)
+	}
+	if m := c.Sandbox.Mode; m != "" && m != sandboxAuto && m != sandboxRequire && m != sandboxOff {
+		add("sandbox.mode", "sandbox.mode: %q must be auto, require or off", m)
+	}
+	if u := c.Debuginfod.URL; u != "" && !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		add("debuginfod.url", "debuginfod.url: %q must be an http:// or https:// URL", u)
+	}
+	if c.Debuginfod.DropPackages && c.Debuginfod.URL == "" {
+		add("debuginfod.drop_packages", "debuginfod.drop_packages: needs debuginfod.url")
+	}
+	for _, t := range []struct{ name, text string }{{"commit_message", c.Git.CommitMessage}, {"tag_name", c.Git.TagName}, {"tag_message", c.Git.TagMessage}} {
+		if _, err := gitTemplate(t.name, t.text, ""); err != nil {
+			add("git."+t.name, "git.%s: %v", t.name, err)
+		}
+	}
+	for i, p := range c.Redact.Patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			add(fmt.Sprintf("redact.patterns[%d]", i), "redact.patterns: %q: %v", p, err)
+		}
+	}
+	if c.Git.SignKey != "" && !c.Git.GPGSign {
+		add("git.sign_key", "git.sign_key: needs git.gpg_sign")
+	}
+	for _, property := range slices.Sorted(maps.Keys(c.Hardening.Require)) {
+		if !slices.Contains(hardeningProperties, property) {
+			add("hardening.require."+property, "hardening.require: %q must be one of %s", property, strings.Join(hardeningProperties, ", "))
+		} else if p := c.Hardening.Require[property]; p < 0 || p > 100 {
+			add("hardening.require."+property, "hardening.require.%s: %d must be a percentage from 0 to 100", property, p)
+		}
+	}
+	if c.Chroot.Pool < 0 {
+		add("chroot.pool", "chroot.pool: must not be negative")
+	}
+	if c.Chroot.MaxAge < 0 {
+		add("chroot.max_age", "chroot.max_age: must not be negative")
+	}
+	if cmp := c.Build.Compression; cmp != "" && !slices.Contains(packageCompressions, cmp) {
+		add("build.compression", "build.compression: %q must be one of %s", cmp, strings.Join(packageCompressions, ", "))
+	}
+	if m := c.Build.March; m != "" && !slices.Contains(marchLevels, m) {
+		add("build.march", "build.march: %q must be one of %s", m, strings.Join(marchLevels, ", "))
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Build.Variants)) {
+		if v := c.Build.Variants[name]; v.March != "" && !slices.Contains(marchLevels, v.March) {
+			add("build.variants."+name+".march", "build.variants.%s.march: %q must be one of %s", name, v.March, strings.Join(marchLevels, ", "))
+		}
+	}
+	if c.Build.Timeout < 0 {
+		add("build.timeout", "build.timeout: must not be negative")
+	}
+	if c.Build.SignKey != "" && !reFingerprint.MatchString(strings.ReplaceAll(c.Build.SignKey, " ", "")) && !strings.Contains(c.Build.SignKey, "@") {
+		add("build.sign_key", "build.sign_key: %q is not a key fingerprint or e-mail address", c.Build.SignKey)
+	}
+
+	kc := c.Keyring
+	for i, key := range kc.Keys {
+		if !reFingerprint.MatchString(strings.ReplaceAll(key, " ", "")) {
+			add(fmt.Sprintf("keyring.keys[%d]", i), "keyring.keys[%d]: %q is not a 16 or 40 digit key fingerprint", i, key)
+		}
+	}
+	if kc.Keyserver != "" {
+		if scheme, _, ok := strings.Cut(kc.Keyserver, "://"); !ok || !slices.Contains([]string{"hkp", "hkps", "http", "https", "ldap"}, scheme) {
+			add("keyring.keyserver", "keyring.keyserver: %q must be a hkp://, hkps:// or http(s):// URL", kc.Keyserver)
+		}
+	}
+	for _, opt := range strings.Fields(kc.SigLevel) {
+		if !reSigLevelOption.MatchString(opt) {
+			add("keyring.siglevel", "keyring.siglevel: invalid option %q", opt)
+		}
+	}
+
+	fc := c.Fetch
+	if fc.Jobs < 0 {
+		add("fetch.jobs", "fetch.jobs: must not be negative")
+	}
+	if fc.Retries < 0 {
+		add("fetch.retries", "fetch.retries: must not be negative")
+	}
+	if _, err := parseRate(fc.LimitRate); err != nil {
+		add("fetch.limit_rate", "fetch.limit_rate: %v", err)
+	}
+
+	if c.SizeGuard.WarnPercent < 0 {
+		add("size_guard.warn_percent", "size_guard.warn_percent: must not be negative")
+	}
+	if c.SizeGuard.FailPercent < 0 {
+		add("size_guard.fail_percent", "size_guard.fail_percent: must not be negative")
+	}
+	if _, err := parseRate(c.Pacman.RankMirrors); err != nil {
+		add("pacman.rank_mirrors", "pacman.rank_mirrors: %v", err)
+	}
+	if sum := c.Pacman.Static.SHA256; sum != "" && !reSHA256.MatchString(sum) {
+		add("pacman.static.sha256", "pacman.static.sha256: %q is not a SHA-256 checksum", sum)
+	}
+	for _, id := range c.Lint.Disable {
+		if !slices.ContainsFunc(installRules, func(r installRule) bool { return r.ID == id }) {
+			add("lint.disable", "lint.disable: unknown rule %q", id)
+		}
+	}
+	if d := c.Pacman.SnapshotDate; d != "" {
+		if _, err := parseSnapshotDate(d); err != nil {
+			add("pacman.snapshot_date", "pacman.snapshot_date: %v", err)
+		}
+	}
+	if c.Pacman.LockWait < 0 {
+		add("pacman.lock_wait", "pacman.lock_wait: must not be negative")
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Timeouts)) {
+		if c.Timeouts[name] < 0 {
+			add("timeouts."+name, "timeouts.%s: must not be negative", name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Repo.Channels)) {
+		if c.Repo.Channels[name] == "" {
+			add("repo.channels."+name, "repo.channels.%s: database path is empty", name)
+		}
+	}
+	if e := c.Image.Engine; e != "" && !slices.Contains([]string{"podman", "docker", "buildah"}, e) {
+		add("image.engine", "image.engine: %q must be podman, docker or buildah", e)
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Compose.Profiles)) {
+		p := c.Compose.Profiles[name]
+		if p.Repo == "" && c.Compose.Repo == "" {
+			add("compose.profiles."+name, "compose.profiles.%s: no repository; set compose.repo or its repo", name)
+		}
+	}
+	for i, pattern := range c.PackageCheck.SetuidAllowed {
+		if _, err := path.Match(pattern, ""); err != nil {
+			add(fmt.Sprintf("package_check.setuid_allowed[%d]", i), "package_check.setuid_allowed[%d]: invalid pattern %q", i, pattern)
+		}
+	}
+	for i, m := range c.Repo.Marches {
+		if m == baselineMarch || !slices.Contains(marchLevels, m) {
+			add(fmt.Sprintf("repo.marches[%d]", i), "repo.marches[%d]: %q must be one of %s", i, m, strings.Join(marchLevels[1:], ", "))
+		}
+	}
+	if b := c.Cache.Sccache.Backend; b != "" && b != "s3" && b != "redis" {
+		add("cache.sccache.backend", "cache.sccache.backend: %q must be s3 or redis", b)
+	}
+	for _, f := range c.Repo.Deltas.Formats {
+		if !slices.Contains(deltaFormats, f) {
+			add("repo.deltas.formats", "repo.deltas.formats: %q must be %s", f, strings.Join(deltaFormats, " or "))
+		}
+	}
+	if c.Repo.Deltas.MinSizeMiB < 0 {
+		add("repo.deltas.min_size_mib", "repo.deltas.min_size_mib: must not be negative")
+	}
+	if c.Repo.KeepSnapshots < 0 {
+		add("repo.keep_snapshots", "repo.keep_snapshots: must not be negative")
+	}
+	for name, sc := range c.Storage {
+		if name == "oci" {
+			add("storage."+name, "storage.oci: the name is reserved for 'publish oci'")
+		} else if sc.URL == "" {
+			add("storage."+name, "storage.%s: url is required", name)
+		} else if _, err := parseStorageURL(sc.URL); err != nil {
+			add("storage."+name+".url", "storage.%s.url: %v", name, err)
+		}
+	}
+	for at, name := range map[string]string{"repo.storage": c.Repo.Storage, "cache.storage": c.Cache.Storage} {
+		if _, ok := c.Storage[name]; name != "" && !ok {
+			add(at, "%s: storage %q is not configured", at, name)
+		}
+	}
+	if c.Cache.Builds && c.Cache.Storage == "" {
+		add("cache.builds", "cache.builds: needs cache.storage")
+	}
+	if strings.HasPrefix(c.Storage[c.Cache.Storage].URL, "gitlab+") {
+		add("cache.storage", "cache.storage: the GitLab package registry of %s stores no directories", c.Cache.Storage)
+	}
+	taskNames := map[string]bool{}
+	for i, t := range c.Serve.Schedule {
+		at := fmt.Sprintf("serve.schedule[%d]", i)
+		if !validArtifactName(t.Name) || taskNames[t.Name] {
+			add(at+".name", "%s.name: %q must be a unique name without slashes", at, t.Name)
+		}
+		taskNames[t.Name] = true
+		if (t.Every > 0) == (t.Cron != "") {
+			add(at, "%s: set either every or cron", at)
+		} else if t.Cron != "" {
+			if cron, err := parseCron(t.Cron); err != nil {
+				add(at+".cron", "%s.cron: %v", at, err)
+			} else if cron.next(time.Now()).IsZero() {
+				add(at+".cron", "%s.cron: %q never matches a date", at, t.Cron)
+			}
+		}
+		if (len(t.Run) > 0) == (len(t.Builds) > 0) {
+			add(at, "%s: set either run or builds", at)
+		}
+		if t.Concurrency < 0 {
+			add(at+".concurrency", "%s.concurrency: must not be negative", at)
+		}
+		for j, b := range t.Builds {
+			if !repositoryAllowed(b.Repo, c.Serve.Repositories) {
+				add(fmt.Sprintf("%s.builds[%d].repo", at, j), "%s.builds[%d].repo: %q is not listed in serve.repositories", at, j, b.Repo)
+			}
+		}
+	}
+	for i, wh := range c.Serve.Webhooks {
+		at := fmt.Sprintf("serve.webhooks[%d]", i)
+		switch {
+		case wh.Upstream == "" || wh.Repo == "":
+			add(at, "%s: upstream and repo are required", at)
+		case !repositoryAllowed(wh.Repo, c.Serve.Repositories):
+			add(at+".repo", "%s.repo: %s is not listed in serve.repositories", at, wh.Repo)
+		case wh.Path != "" && !filepath.IsLocal(wh.Path):
+			add(at+".path", "%s.path: %q must be a relative path within the repository", at, wh.Path)
+		}
+	}
+	checkRoles := func(at string, roles []string) {
+		if len(roles) == 0 {
+			add(at+".roles", "%s.roles: at least one role is required", at)
+		}
+		for j, role := range roles {
+			if !slices.Contains(serveRoles, role) {
+				add(fmt.Sprintf("%s.roles[%d]", at, j), "%s.roles[%d]: %q must be one of %s", at, j, role, strings.Join(serveRoles, ", "))
+			}
+		}
+	}
+	checkPatterns := func(at string, patterns []string) {
+		for j, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil || p == "" {
+				add(fmt.Sprintf("%s[%d]", at, j), "%s[%d]: %q is not a valid pattern", at, j, p)
+			}
+		}
+	}
+	tokenNames := map[string]bool{}
+	for i, t := range c.Serve.Auth.Tokens {
+		at := fmt.Sprintf("serve.auth.tokens[%d]", i)
+		if t.Name == "" || t.Env == "" {
+			add(at, "%s: name and env are required", at)
+		} else if tokenNames[t.Name] {
+			add(at+".name", "%s.name: %q is used by another token", at, t.Name)
+		}
+		tokenNames[t.Name] = true
+		checkRoles(at, t.Roles)
+		checkPatterns(at+".projects", t.Projects)
+	}
+	if o := c.Serve.Auth.OIDC; o.Issuer != "" || len(o.Rules) > 0 {
+		if !strings.HasPrefix(o.Issuer, "https://") {
+			add("serve.auth.oidc.issuer", "serve.auth.oidc.issuer: %q must be an https:// URL", o.Issuer)
+		}
+		if o.Audience == "" {
+			add("serve.auth.oidc.audience", "serve.auth.oidc.audience: required with an issuer")
+		}
+		for i, rule := range o.Rules {
+			at := fmt.Sprintf("serve.auth.oidc.rules[%d]", i)
+			if len(rule.Projects) == 0 {
+				add(at+".projects", "%s.projects: at least one project is required", at)
+			}
+			checkPatterns(at+".projects", rule.Projects)
+			checkPatterns(at+".refs", rule.Refs)
+			checkRoles(at, rule.Roles)
+		}
+	}
+	return issues
+}
+
+// lookupNode returns the node at a dotted path such as "keyring.keys[1]",
+// or the closest existing parent.
+func lookupNode(root *yaml.Node, path string) *yaml.Node {
+	node := root
+	for _, part := range strings.Split(path, ".") {
+		name, index, hasIndex := strings.Cut(strings.TrimSuffix(part, "]"), "[")
+		next := (*yaml.Node)(nil)
+		for i := 0; node.Kind == yaml.MappingNode && i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == name {
+				next = node.Content[i+1]
+			}
+		}
+		if next == nil {
+			return node
+		}
+		node = next
+		if hasIndex {
+			if i, err := strconv.Atoi(index); err == nil && node.Kind == yaml.SequenceNode && i < len(node.Content) {
+				node = node.Content[i]
+			}
+		}
+	}
+	return node
+}
+
+// configSchema returns a JSON schema describing the Go type t.
+func configSchema(t reflect.Type, desc string) map[string]any {
+	schema := map[string]any{}
+	// A profile is a configuration document of its own
+	if t == reflect.TypeOf(yaml.Node{}) {
+		schema["$ref"] = "#"
+		return schema
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		props := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			props[yamlKey(f)] = configSchema(f.Type, f.Tag.Get("desc"))
+		}
+		schema["type"] = "object"
+		schema["properties"] = props
+		schema["additionalProperties"] = false
+	case reflect.Map:
+		schema["type"] = "object"
+		schema["additionalProperties"] = configSchema(t.Elem(), "")
+	case reflect.Slice:
+		schema["type"] = "array"
+		schema["items"] = configSchema(t.Elem(), "")
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	case reflect.Int, reflect.Int64:
+		if t == reflect.TypeOf(time.Duration(0)) {
+			schema["type"] = "string"
+			schema["pattern"] = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+		} else {
+			schema["type"] = "integer"
+		}
+	case reflect.Float32, reflect.Float64:
+		schema["type"] = "number"
+	default:
+		schema["type"] = "string"
+	}
+	if desc != "" {
+		schema["description"] = desc
+	}
+	return schema
+}
+
+// starterConfig is written by 'config init'.
+const starterConfig = `# Configuration for builder (https://gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux).
+# Validate with 'builder config validate'; all keys are optional.
+
+# Set in the .pkgbuilder.yaml of a package, for workspace commands such as
+# 'generate-pipeline': stages are built one after another, and within the
+# order dependencies leave free, higher priorities first.
+package:
+  # stage: 0
+  # priority: 0
+  # Matched by --select of workspace commands, e.g. --select 'large and not
+  # name:*-git'.
+  # labels: [desktop, large]
+  # Quarantine the package: workspace builds skip it (--include-quarantined
+  # builds it anyway) and 'builder status' lists it.
+  # status: broken
+  # reason: fails to build with gcc 15, https://example.com/issues/42
+  # since: 2024-06-01
+
+# Build settings; a .pkgbuilder.yaml in a package directory may override any
+# key of this file for that package except sandbox, redact, serve and
+# storage, e.g.
+#   build: {backend: makepkg, nocheck: true, timeout: 3h, env: {CARGO_INCREMENTAL: "0"}}
+build:
+  # backend: paru
+  # nocheck: false
+  # timeout: 0
+  # env:
+  #   RUSTFLAGS: -C target-cpu=x86-64-v2
+  # sign_key: 0123456789ABCDEF0123456789ABCDEF01234567
+  # sign: false
+  # Build without network once the sources are fetched (build --offline-build).
+  # offline: true
+  # Record what the build touches outside of its directory (build --audit).
+  # audit: true
+  # Build in a tmpfs of this size when the build fits into memory, on disk
+  # otherwise (build --builddir).
+  # builddir: tmpfs:8G
+  # compression: zst
+  # channel: testing
+  # Optimize for an x86_64 level; 'repo add' then publishes to the per-ISA
+  # repository of the channel, e.g. testing-v3 (see repo.marches).
+  # march: x86-64-v3
+  # Build matrix, usually in .pkgbuilder.yaml: every variant is built in turn
+  # and must produce distinctly named packages, e.g. through
+  # pkgname=foo${_suffix} in the PKGBUILD.
+  # variants:
+  #   generic:
+  #     env: {_build_type: generic}
+  #   x86-64-v3:
+  #     env: {_build_type: x86-64-v3, _suffix: -v3}
+  #     march: x86-64-v3
+  # Distribute compilations to other machines; the job distribution is
+  # reported after the build.
+  # distcc:
+  #   hosts: ["10.0.0.2/8,lzo", "10.0.0.3/8,lzo"]
+  #   srv: _distccd._tcp.example.com
+  #   # or with icecream, whose daemon finds the scheduler:
+  #   tool: icecream
+  #   scheduler: icecc-scheduler.example.com
+
+# Settings switched together with --profile (or $BUILDER_PROFILE), applied on
+# top of everything else; any key of this file may appear in a profile.
+# profiles:
+#   dev:
+#     build: {compression: gz, channel: testing}
+#   release:
+#     build: {sign: true, compression: zst, channel: stable}
+#     repo: {snapshot: true}
+
+keyring:
+  # Keyrings to populate; defaults to every known keyring that is installed.
+  # keyrings: [archlinux, prismlinux]
+
+  # Key fingerprints fetched from the keyserver and locally signed.
+  # keys:
+  #   - 0123456789ABCDEF0123456789ABCDEF01234567
+
+  # Armored public key files imported and locally signed.
+  # key_files:
+  #   - keys/maintainer.asc
+
+  # keyserver: hkps://keyserver.ubuntu.com
+
+  # SigLevel written to the [options] section of pacman.conf.
+  # siglevel: Required DatabaseOptional
+
+fetch:
+  # Alternative URL prefixes tried in order when a source URL fails.
+  # mirrors:
+  #   https://github.com/:
+  #     - https://github-mirror.example.com/
+  # jobs: 4
+  # retries: 3
+  # limit_rate: 2M
+  # Gateways for ipfs:// sources; magnet: sources need aria2c installed.
+  # ipfs_gateways: [http://127.0.0.1:8080/ipfs/, https://ipfs.io/ipfs/]
+  # Source mirror created by 'builder sources vendor', preferred over upstream.
+  # vendor_dir: sources
+
+repo:
+  # Channels with their own databases, promoted with 'builder promote'.
+  # channels:
+  #   testing: /srv/repo/testing/x86_64/myrepo.db.tar.gz
+  #   stable: /srv/repo/stable/x86_64/myrepo.db.tar.gz
+  # Databases of the repositories packages may depend on, checked before
+  # 'repo add' publishes anything.
+  # sync_dbs: [/var/lib/pacman/sync/*.db]
+  # Snapshot the repository before every publish ('builder repo rollback').
+  # snapshot: false
+  # keep_snapshots: 10
+  # Database paths may contain $arch; arch=(any) packages are then added to
+  # the database of each of these architectures.
+  # arches: [x86_64, aarch64]
+  # Optimized levels with a repository next to every channel (prism-v3 next
+  # to prism); older optimized builds are dropped when a newer baseline
+  # version is published or promoted, and promote moves both.
+  # marches: [x86-64-v3]
+  # Commands run after 'repo add' or 'promote', with $BUILDER_REPO_DB set.
+  # post_publish:
+  #   - builder compose rootfs --profile minimal
+  #   - builder repo site "$BUILDER_REPO_DB"
+  # Storage (see storage below) the repository directories are mirrored to
+  # after every change: new packages first, then the databases.
+  # storage: mirror
+  # Deltas of large packages from the version they replace (xdelta3) and
+  # zsync control files, listed in <repo>.deltas.json for clients. They only
+  # pay off for packages compressed with zstd --rsyncable.
+  # deltas:
+  #   formats: [xdelta3, zsync]
+  #   min_size_mib: 50
+
+# Destinations of 'builder publish <name>', repo.storage and cache.storage.
+# Credentials come from the s3-access-key/s3-secret-key, ssh-key,
+# gitlab-token and webdav-user/webdav-password secrets.
+# storage:
+#   mirror:
+#     url: s3://prismlinux-repo/x86_64
+#     endpoint: https://minio.example.com
+#   mirror-ssh:
+#     url: ssh://deploy@repo.example.com/srv/repo/x86_64
+#   releases:
+#     url: gitlab+https://gitlab.example.com/api/v4/projects/42/packages/generic/prism/stable
+#   nextcloud:
+#     url: webdav+https://ci@cloud.example.com/remote.php/dav/files/ci/repo/x86_64
+
+# Maximum run time of external commands by name; 0 disables the limit.
+# Builds (paru, makepkg, makechrootpkg) are unlimited by default.
+# timeouts:
+#   default: 10m
+#   gpg: 5m
+#   pacman: 30m
+#   paru: 6h
+
+# Packages that grew by more than these percentages since their last build
+# (or the version 'repo add' replaces) are reported; growth below 1 MiB is ignored.
+size_guard:
+  # warn_percent: 20
+  # fail_percent: 0
+
+# Checks of the files in built packages: files owned by the builder's uid,
+# setuid/setgid files and systemd units outside /usr/lib/systemd are errors;
+# other non-root ownership is a warning.
+package_check:
+  # setuid_allowed: [/usr/bin/foo-sandbox]
+  # warn_only: false
+
+# RELRO, PIE, stack canaries and NX of the executables and libraries in built
+# packages are reported after every build; the build fails when fewer than
+# these percentages of the ELF files of a package have them.
+hardening:
+  # require: {nx: 100, relro: 100, pie: 100, canary: 80}
+  # ignore: [/usr/lib/foo/prebuilt/*]
+
+# Policy checks of .install scriptlets by 'builder lint'.
+lint:
+  # install_hooks: [post_install, post_upgrade, pre_remove]
+  # disable: [install-systemctl]
+
+# Crates, npm and Python packages pinned by lockfiles in the sources, checked
+# against OSV by 'builder audit'.
+audit:
+  # on_build: true
+  # ignore: [RUSTSEC-2023-0071]
+
+# Packages with modules in /usr/lib/modules must match the release of the
+# headers; DKMS packages (depends=(dkms)) can be built in a container.
+kernel:
+  # headers: linux-lts-headers
+  # release: 6.6.44-1-lts
+  # dkms_check: true
+
+# Chroots of build.backend chroot, kept warm between builds; schedule
+# 'builder chroot update' to refresh them outside of builds.
+chroot:
+  # dir: /var/lib/archbuild
+  # pool: 2
+  # max_age: 24h
+  # packages: [base-devel]
+  # pacman_conf: /usr/share/devtools/pacman.conf.d/extra.conf
+  # Build in a throwaway overlayfs over the chroot instead of copying it.
+  # overlay: true
+
+# Toolchains builds must use, usually in .pkgbuilder.yaml; they are installed
+# or verified before the build starts, which fails on a mismatch.
+toolchain:
+  # rust: 1.79.0
+  # go: 1.22.5
+  # gcc: 14
+
+# 'check-srcinfo' and 'bump' run makepkg --printsrcinfo, which executes the
+# PKGBUILD; bubblewrap isolates it from the network, files and secrets.
+sandbox:
+  # Fail instead of evaluating without a sandbox, e.g. for merge requests.
+  # mode: require
+
+# With OPTIONS=(debug strip), upload the symbols of the -debug packages to a
+# debuginfod server; build IDs are recorded in <pkgname>.buildids.json.
+debuginfod:
+  # url: https://debuginfod.example.com
+  # Publish the packages without their -debug packages.
+  # drop_packages: false
+
+# 'bump --commit' commits the bumped PKGBUILD, its checksums and .SRCINFO;
+# 'release tag' tags the release.
+git:
+  # commit_message: "upgpkg: {{.Name}} {{.Version}}"
+  # signoff: false
+  # gpg_sign: false
+  # Push the commits to this branch of the remote.
+  # push: main
+  # remote: origin
+  # Tags of monorepos need the package name, e.g. {{.Name}}-{{.Version}}.
+  # tag_name: "{{.Version}}"
+  # tag_message: "Release {{.Name}} {{.Version}}"
+
+# Secrets of 'builder secrets' are masked in all output; so are these.
+redact:
+  # env: [NPM_TOKEN]
+  # patterns: ['password=(\S+)']
+  # no_builtin_patterns: false
+
+# 'builder pipeline' runs deps, build, artifacts and this builder command line.
+pipeline:
+  # publish: [publish, packages, artifacts/*.pkg.tar.zst]
+
+pacman:
+  # Wait for other jobs holding /var/lib/pacman/db.lck.
+  # lock_wait: 10m
+  # remove_stale_lock: false
+  # Probe the mirrors and keep the fastest in /etc/pacman.d/mirrorlist before
+  # 'deps' downloads more than this (or always with 'deps --rank-mirrors').
+  # rank_mirrors: 200M
+  # Rebuild against the Arch Linux Archive of a day instead of the mirrors
+  # (or 'deps --snapshot-date'); the system is synced (and downgraded) to it.
+  # snapshot_date: 2024-03-01
+  # Without pacman (e.g. minimal artifact-only images), download this pinned
+  # pacman-static and use it for every pacman command.
+  # static:
+  #   url: https://pkgbuild.com/~morganamilo/pacman-static/x86_64/bin/pacman-static
+  #   sha256: 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+
+# The CI image built by 'builder image build'.
+image:
+  # name: registry.example.com/ci/builder
+  # base: archlinux:base-devel
+  # packages: [rustup, go, cmake]
+  # Go template replacing the built-in Containerfile ('builder image build --print').
+  # containerfile: ci/Containerfile.tmpl
+  # engine: podman
+  # Docker Hub base images are pulled through the GitLab dependency proxy of
+  # the group in CI ($CI_DEPENDENCY_PROXY_GROUP_IMAGE_PREFIX); off disables it.
+  # dependency_proxy: gitlab.example.com:443/mygroup/dependency_proxy/containers
+
+# The build queue of 'builder serve'. Builds by git ref (POST /api/v1/builds)
+# are only accepted from these repositories, fetched with the workers' git
+# credentials.
+serve:
+  # repositories:
+  #   - https://gitlab.example.com/prismlinux/packages.git
+  # Checkout of the packages whose upstream releases the dashboard (/ui/)
+  # compares with pkgver, every few hours.
+  # workspace: /srv/packages
+  # Release webhooks ('serve --webhooks') updating a package to the released
+  # version (the tag without tag_prefix), then building it.
+  # webhooks:
+  #   - upstream: owner/foo
+  #     repo: https://gitlab.example.com/prismlinux/packages.git
+  #     path: foo
+  #     tag_prefix: v
+  # Periodic tasks: builder commands run on the coordinator, or builds queued
+  # for the workers. A task at its concurrency limit (default 1) skips a run.
+  # schedule:
+  #   - name: outdated
+  #     cron: "0 6 * * *"
+  #     run: [outdated, --workspace, /srv/packages]
+  #   - name: vcs
+  #     every: 24h
+  #     builds:
+  #       - repo: https://gitlab.example.com/prismlinux/packages.git
+  #         path: foo-git
+  #     concurrency: 2
+  #   - name: staging-mirror
+  #     every: 1h
+  #     run: [repo, sync, --from, https://repo.example.com/staging/os/x86_64/staging.db, --to, /srv/mirror/staging]
+  #   - name: prune-caches
+  #     cron: "30 3 * * 0"
+  #     run: [clean, --ccache, --chroots]
+  # Clients of the API. BUILDER_SERVE_TOKEN remains an admin token. Roles:
+  # submit queues builds, publish adds built packages to a channel of
+  # repo.channels, worker runs jobs and admin may do everything. Projects
+  # restrict what a client may build and publish. Workers should get a token
+  # with only the worker role (in BUILDER_SERVE_TOKEN on the worker), not the
+  # admin token.
+  # auth:
+  #   tokens:
+  #     - name: release-bot
+  #       env: BUILDER_RELEASE_BOT_TOKEN
+  #       roles: [submit, publish]
+  #       projects: [prismlinux/*]
+  #     - name: workers
+  #       env: BUILDER_WORKER_TOKEN
+  #       roles: [worker]
+  #   # ID tokens of GitLab CI jobs (id_tokens: BUILDER_ID_TOKEN with this
+  #   # audience), which may only build and publish their own project.
+  #   oidc:
+  #     issuer: https://gitlab.example.com
+  #     audience: https://builder.example.com
+  #     rules:
+  #       - projects: [prismlinux/*]
+  #         roles: [submit]
+  #       - projects: [prismlinux/packages]
+  #         refs: [main]
+  #         protected_refs: true
+  #         roles: [submit, publish]
+
+# Root filesystems and ISO images built from our repository by
+# 'builder compose rootfs|iso --profile <name>'.
+compose:
+  # repo: staging
+  # profiles:
+  #   minimal:
+  #     packages: [base, prismlinux-keyring]
+  #     hooks:
+  #       - echo prismlinux > "$ROOTFS/etc/hostname"
+  #   live:
+  #     packages: [calamares]
+  #     archiso: iso/profile
+
+cache:
+  # dir: ~/.cache/builder
+  # Reuse parsed PKGBUILD metadata across runs (keyed by the file's hash).
+  # metadata: false
+  # Share the parsed metadata between runners through a storage.
+  # storage: mirror
+  # Also share built packages by the fingerprint of their inputs: a pipeline
+  # building the same inputs downloads them instead (build --force rebuilds).
+  # builds: true
+  # Compiler cache shared by all runners (cargo and CMake builds). Credentials
+  # come from the s3-access-key/s3-secret-key or sccache-redis secrets.
+  # sccache:
+  #   backend: s3
+  #   bucket: builder-sccache
+  #   endpoint: https://minio.example.com
+  #   prefix: x86_64
+`
+
+// newConfigCmd creates the 'config' command and its subcommands.
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "config",
+		Short:       "Validates and creates configuration files.",
+		Annotations: map[string]string{annotationNoConfig: "true"},
+	}
+
+	validateCmd := &cobra.Command{
+		Use:   "validate [file]",
+		Short: "Checks a configuration file and reports every problem with its location.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := configFile
+			if len(args) == 1 {
+				path = args[0]
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return errorf(errConfig, "could not read config file: %w", err)
+			}
+			c, err := parseConfig(path, data)
+			if err != nil {
+				return newError(errConfig, err)
+			}
+			for _, name := range slices.Sorted(maps.Keys(c.Profiles)) {
+				// Profiles are only fully checked on top of the file
+				fresh, _ := parseConfig(path, data)
+				if _, err := applyProfile(fresh, name, path); err != nil {
+					return newError(errConfig, err)
+				}
+			}
+			log.Printf("%s is valid.", path)
+			return nil
+		},
+	}
+
+	schemaCmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Prints the JSON schema of the configuration file.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schema := configSchema(reflect.TypeOf(config{}), "Configuration file of builder")
+			schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(schema)
+		},
+	}
+
+	var force bool
+	initCmd := &cobra.Command{
+		Use:   "init [file]",
+		Short: "Writes a commented starter configuration file.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := configFile
+			if len(args) == 1 {
+				path = args[0]
+			}
+			flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+			if force {
+				flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			}
+			f, err := os.OpenFile(path, flags, 0644)
+			if errors.Is(err, os.ErrExist) {
+				return errorf(errConfig, "%s already exists (use --force to overwrite)", path)
+			}
+			if err != nil {
+				return errorf(errConfig, "could not create config file: %w", err)
+			}
+			defer f.Close()
+			if _, err := f.WriteString(starterConfig); err != nil {
+				return errorf(errConfig, "could not write config file: %w", err)
+			}
+			log.Printf("Wrote starter configuration to %s", path)
+			return nil
+		},
+	}
+	initCmd.Flags().BoolVar(&force, "force", false, "Overwrite an existing file")
+
+	cmd.AddCommand(validateCmd, schemaCmd, initCmd)
+	return cmd
+}
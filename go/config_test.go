@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPackageConfigDeniedKeys(t *testing.T) {
+	for _, src := range []string{
+		"sandbox:\n  mode: off\n",
+		"redact:\n  no_builtin: true\n",
+		"serve:\n  repositories: [https://evil.example.com/x]\n",
+		"storage:\n  evil:\n    url: s3://evil/x\n",
+		"profiles:\n  release:\n    sandbox:\n      mode: off\n",
+	} {
+		path := filepath.Join(t.TempDir(), packageConfigFile)
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var ce *configError
+		if err := loadPackageConfig(&config{}, path); !errors.As(err, &ce) || !strings.Contains(ce.Error(), "cannot be set") {
+			t.Errorf("loadPackageConfig(%q) error = %v, want a denied key", src, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), packageConfigFile)
+	if err := os.WriteFile(path, []byte("build:\n  nocheck: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &config{}
+	if err := loadPackageConfig(c, path); err != nil || !c.Build.NoCheck {
+		t.Errorf("loadPackageConfig() = %v, nocheck %v", err, c.Build.NoCheck)
+	}
+}
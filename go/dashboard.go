@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+const (
+	// outdatedRefresh is how often the dashboard checks serve.workspace for
+	// upstream releases
+	outdatedRefresh = 6 * time.Hour
+	// dashboardJobs is the number of recent jobs on the overview
+	dashboardJobs = 50
+	// dashboardHistory is the number of builds on a package page
+	dashboardHistory = 50
+)
+
+// dashboard is the web UI of the coordinator, answering what was built and
+// which versions the channels hold.
+type dashboard struct {
+	c *coordinator
+
+	mu       sync.Mutex
+	outdated []outdatedResult
+	checked  time.Time
+}
+
+// refreshOutdated checks the packages of serve.workspace for upstream
+// releases every outdatedRefresh until ctx is cancelled.
+func (d *dashboard) refreshOutdated(ctx context.Context) {
+	for {
+		infos, err := workspacePKGBUILDs(cfg.Serve.Workspace)
+		if err != nil {
+			log.Printf("Warning: dashboard: could not scan %s: %v", cfg.Serve.Workspace, err)
+		}
+		var dirs []string
+		for _, dir := range slices.Sorted(maps.Keys(infos)) {
+			if !isVCSPackage(infos[dir]) {
+				dirs = append(dirs, dir)
+			}
+		}
+		results := make([]outdatedResult, len(dirs))
+		indexes := make([]int, len(dirs))
+		for i := range indexes {
+			indexes[i] = i
+		}
+		runParallel(defaultJobs, indexes, func(i int) error {
+			results[i] = checkOutdated(ctx, dirs[i], infos[dirs[i]])
+			return nil
+		})
+		var outdated []outdatedResult
+		for _, r := range results {
+			if r.Err == nil && repodb.VerCmp(r.Latest, r.Current) > 0 {
+				outdated = append(outdated, r)
+			} else if r.Err != nil {
+				debugPrint("Dashboard: %s: %v", r.Package, r.Err)
+			}
+		}
+		d.mu.Lock()
+		d.outdated, d.checked = outdated, time.Now()
+		d.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(outdatedRefresh):
+		}
+	}
+}
+
+// channelPackage is a package of a channel database.
+type channelPackage struct {
+	Name    string
+	Base    string
+	Version string
+	Arch    string
+	Size    int64
+	Built   time.Time
+}
+
+// channelInfo is the content of one channel, with $arch expanded.
+type channelInfo struct {
+	Name     string
+	Path     string
+	Packages []channelPackage
+	Err      error
+}
+
+// readChannels reads the databases of repo.channels, one per architecture
+// for paths containing $arch.
+func readChannels() []channelInfo {
+	arches := cfg.Repo.Arches
+	if len(arches) == 0 {
+		arches = []string{carch()}
+	}
+	var channels []channelInfo
+	for _, name := range slices.Sorted(maps.Keys(cfg.Repo.Channels)) {
+		paths := []string{cfg.Repo.Channels[name]}
+		if strings.Contains(paths[0], "$arch") {
+			paths = nil
+			for _, arch := range arches {
+				paths = append(paths, strings.ReplaceAll(cfg.Repo.Channels[name], "$arch", arch))
+			}
+		}
+		for _, path := range paths {
+			ch := channelInfo{Name: name, Path: path}
+			db, err := repodb.Read(path)
+			if err != nil {
+				ch.Err = err
+				channels = append(channels, ch)
+				continue
+			}
+			for _, e := range db.Entries {
+				p := channelPackage{Name: e.Name, Base: e.Base, Version: e.Version, Arch: e.Arch, Size: e.CSize}
+				if e.BuildDate > 0 {
+					p.Built = time.Unix(e.BuildDate, 0).UTC()
+				}
+				ch.Packages = append(ch.Packages, p)
+			}
+			slices.SortFunc(ch.Packages, func(a, b channelPackage) int { return strings.Compare(a.Name, b.Name) })
+			channels = append(channels, ch)
+		}
+	}
+	return channels
+}
+
+// recentJobs returns the newest jobs p may read first, those of pkg if set.
+func (c *coordinator) recentJobs(p *principal, pkg string, limit int) []serveJob {
+	if !p.can(roleSubmit) {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var jobs []serveJob
+	for _, id := range slices.Backward(c.order) {
+		if job := c.jobs[id]; (pkg == "" || job.Package == pkg) && p.allowed(job.Project) {
+			jobs = append(jobs, *job)
+			if len(jobs) >= limit {
+				break
+			}
+		}
+	}
+	return jobs
+}
+
+// handle registers the pages of the dashboard below /ui/.
+func (d *dashboard) handle(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ui/", http.StatusFound)
+	})
+	mux.HandleFunc("GET /ui/{$}", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		outdated, checked := d.outdated, d.checked
+		d.mu.Unlock()
+		d.render(w, "overview", map[string]any{
+			"Jobs":      d.c.recentJobs(principalOf(r), "", dashboardJobs),
+			"Channels":  readChannels(),
+			"Workspace": cfg.Serve.Workspace,
+			"Outdated":  outdated,
+			"Checked":   checked,
+		})
+	})
+	mux.HandleFunc("GET /ui/channels/{name}", func(w http.ResponseWriter, r *http.Request) {
+		var channels []channelInfo
+		for _, ch := range readChannels() {
+			if ch.Name == r.PathValue("name") {
+				channels = append(channels, ch)
+			}
+		}
+		if len(channels) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		d.render(w, "channel", map[string]any{"Name": r.PathValue("name"), "Channels": channels})
+	})
+	mux.HandleFunc("GET /ui/packages/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name, p := r.PathValue("name"), principalOf(r)
+		type channelVersion struct {
+			Channel string
+			Path    string
+			channelPackage
+		}
+		var history []*buildRecord
+		var versions []channelVersion
+		// Builds and channels have no project, like jobs of old clients
+		restricted := !p.can(roleSubmit) || !p.allowed("")
+		if !restricted {
+			var err error
+			if history, err = loadBuilds(func(rec *buildRecord) bool { return rec.Package == name }, dashboardHistory); err != nil {
+				log.Printf("Warning: dashboard: could not read the build history: %v", err)
+			}
+			for _, ch := range readChannels() {
+				for _, cp := range ch.Packages {
+					if cp.Name == name || cp.Base == name {
+						versions = append(versions, channelVersion{ch.Name, ch.Path, cp})
+					}
+				}
+			}
+		}
+		d.render(w, "package", map[string]any{
+			"Name":       name,
+			"Jobs":       d.c.recentJobs(p, name, dashboardJobs),
+			"Restricted": restricted,
+			"History":    history,
+			"Versions":   versions,
+		})
+	})
+}
+
+// render writes a page of the dashboard.
+func (d *dashboard) render(w http.ResponseWriter, page string, data map[string]any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplates.ExecuteTemplate(w, page, data); err != nil {
+		log.Printf("Warning: dashboard: %v", err)
+	}
+}
+
+var dashboardTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"size": formatSize,
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format("2006-01-02 15:04")
+	},
+	"duration": func(d time.Duration) string { return d.Round(time.Second).String() },
+	"base":     filepath.Base,
+}).Parse(dashboardHTML))
+
+const dashboardHTML = `
+{{define "head"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.}} - builder</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: .25em .75em; border-bottom: 1px solid #ddd; }
+th { background: #f4f4f4; }
+.succeeded, .success { color: #2a7d2a; } .failed { color: #b52a2a; } .running { color: #b57a00; }
+.muted { color: #888; }
+</style></head><body>
+<p><a href="/ui/">builder</a></p>{{end}}
+
+{{define "jobs"}}<table>
+<tr><th>Job</th><th>Package</th><th>Status</th><th>Source</th><th>Submitted by</th><th>Worker</th><th>Submitted</th><th>Files</th></tr>
+{{range .}}<tr>
+<td>{{.ID}}</td>
+<td><a href="/ui/packages/{{.Package}}">{{.Package}}</a>{{if .Bump}} &rarr; {{.Bump}}{{end}}</td>
+<td class="{{.Status}}">{{.Status}}{{if .Error}} <span class="muted">{{.Error}}</span>{{end}}</td>
+<td>{{with .Source}}{{.Repo}} {{.Ref}}{{end}}{{if .Commit}} <span class="muted">{{printf "%.10s" .Commit}}</span>{{end}}</td>
+<td>{{.SubmittedBy}}{{if .Task}} (task {{.Task}}){{end}}</td>
+<td>{{.Worker}}</td>
+<td>{{time .Submitted}}</td>
+<td><a href="/api/v1/jobs/{{.ID}}/log">log</a>{{$id := .ID}}{{range .Artifacts}} <a href="/api/v1/jobs/{{$id}}/artifacts/{{.}}">{{.}}</a>{{end}}</td>
+</tr>{{else}}<tr><td colspan="8" class="muted">No jobs since the coordinator started.</td></tr>{{end}}
+</table>{{end}}
+
+{{define "overview"}}{{template "head" "Overview"}}
+<h2>Channels</h2>
+<table><tr><th>Channel</th><th>Database</th><th>Packages</th></tr>
+{{range .Channels}}<tr><td><a href="/ui/channels/{{.Name}}">{{.Name}}</a></td><td>{{.Path}}</td>
+<td>{{if .Err}}<span class="failed">{{.Err}}</span>{{else}}{{len .Packages}}{{end}}</td></tr>
+{{else}}<tr><td colspan="3" class="muted">No channels in repo.channels.</td></tr>{{end}}
+</table>
+<h2>Outdated packages</h2>
+{{if not .Workspace}}<p class="muted">Set serve.workspace to compare the packages with their upstream releases.</p>
+{{else if .Checked.IsZero}}<p class="muted">Checking {{.Workspace}}...</p>
+{{else}}<table><tr><th>Package</th><th>Current</th><th>Latest</th><th>Upstream</th></tr>
+{{range .Outdated}}<tr><td><a href="/ui/packages/{{.Package}}">{{.Package}}</a></td><td>{{.Current}}</td><td>{{.Latest}}</td><td>{{.Upstream}}</td></tr>
+{{else}}<tr><td colspan="4" class="muted">All packages are up to date.</td></tr>{{end}}
+</table><p class="muted">Checked {{time .Checked}} UTC.</p>{{end}}
+<h2>Recent builds</h2>
+{{template "jobs" .Jobs}}
+</body></html>{{end}}
+
+{{define "channel"}}{{template "head" .Name}}
+{{range .Channels}}<h2>{{.Name}} <span class="muted">{{.Path}}</span></h2>
+{{if .Err}}<p class="failed">{{.Err}}</p>{{else}}<table>
+<tr><th>Package</th><th>Version</th><th>Arch</th><th>Size</th><th>Built</th></tr>
+{{range .Packages}}<tr><td><a href="/ui/packages/{{.Name}}">{{.Name}}</a>{{if and .Base (ne .Base .Name)}} <span class="muted">({{.Base}})</span>{{end}}</td>
+<td>{{.Version}}</td><td>{{.Arch}}</td><td>{{size .Size}}</td><td>{{time .Built}}</td></tr>{{end}}
+</table>{{end}}{{end}}
+</body></html>{{end}}
+
+{{define "package"}}{{template "head" .Name}}
+<h1>{{.Name}}</h1>
+{{if not .Restricted}}<h2>Channels</h2>
+<table><tr><th>Channel</th><th>Package</th><th>Version</th><th>Arch</th><th>Built</th></tr>
+{{range .Versions}}<tr><td><a href="/ui/channels/{{.Channel}}">{{.Channel}}</a> <span class="muted">{{base .Path}}</span></td><td>{{.Name}}</td><td>{{.Version}}</td><td>{{.Arch}}</td><td>{{time .Built}}</td></tr>
+{{else}}<tr><td colspan="5" class="muted">Not in any channel.</td></tr>{{end}}
+</table>{{end}}
+<h2>Jobs</h2>
+{{template "jobs" .Jobs}}
+<h2>History</h2>
+{{if .Restricted}}<p class="muted">The channels and build history are only shown to clients that may read every project.</p>
+{{else}}<table><tr><th>Build</th><th>Version</th><th>Result</th><th>Started</th><th>Duration</th><th>Log</th></tr>
+{{range .History}}<tr><td>#{{.ID}}</td><td>{{.Version}}</td><td class="{{.Result}}">{{.Result}}{{with .Analysis}} <span class="muted">{{.Summary}}</span>{{end}}</td>
+<td>{{time .StartedAt}}</td><td>{{duration .Duration}}</td><td>{{if .Job}}<a href="/api/v1/jobs/{{.Job}}/log">{{.Job}}</a>{{end}}</td></tr>
+{{else}}<tr><td colspan="6" class="muted">No builds recorded.</td></tr>{{end}}
+</table>{{end}}
+</body></html>{{end}}
+`
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+// buildIDPrefix is the directory of debug files named by build ID,
+// .build-id/<xx>/<rest>.debug, in -debug packages.
+const buildIDPrefix = "usr/lib/debug/.build-id/"
+
+// debugFileBuildID returns the build ID of a file of a -debug package, or
+// "" if it is not a debug file named by build ID.
+func debugFileBuildID(name string) string {
+	rel, ok := strings.CutPrefix(strings.TrimPrefix(name, "./"), buildIDPrefix)
+	if !ok {
+		return ""
+	}
+	dir, file, ok := strings.Cut(rel, "/")
+	if !ok || len(dir) != 2 || !strings.HasSuffix(file, ".debug") || strings.Contains(file, "/") {
+		return ""
+	}
+	return dir + strings.TrimSuffix(file, ".debug")
+}
+
+// debugBuildIDs returns the build IDs of the debug files of a -debug package.
+func debugBuildIDs(file string) ([]string, error) {
+	var ids []string
+	err := pkgarchive.Walk(file, func(hdr *tar.Header, r io.Reader) error {
+		if id := debugFileBuildID(hdr.Name); id != "" && hdr.Typeflag == tar.TypeReg {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	slices.Sort(ids)
+	return ids, err
+}
+
+// uploadDebugInfo uploads the debug files of a -debug package to the
+// debuginfod server of debuginfod.url with PUT <url>/buildid/<id>/debuginfo,
+// the path debuginfod serves them at, skipping those the server has. It
+// returns the build IDs of the package.
+func uploadDebugInfo(ctx context.Context, file string) ([]string, error) {
+	base := strings.TrimSuffix(cfg.Debuginfod.URL, "/")
+	token, err := getSecret("debuginfod-token")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	uploaded := 0
+	err = pkgarchive.Walk(file, func(hdr *tar.Header, r io.Reader) error {
+		id := debugFileBuildID(hdr.Name)
+		if id == "" || hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		ids = append(ids, id)
+		target := base + "/buildid/" + id + "/debuginfo"
+		if resp, err := debuginfodRequest(ctx, http.MethodHead, target, token, nil, 0); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				debugPrint("%s: %s is on the server already", path.Base(file), id)
+				return nil
+			}
+		}
+		resp, err := debuginfodRequest(ctx, http.MethodPut, target, token, r, hdr.Size)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("PUT %s: %s: %s", target, resp.Status, strings.TrimSpace(string(body)))
+		}
+		uploaded++
+		return nil
+	})
+	if err != nil {
+		return ids, err
+	}
+	slices.Sort(ids)
+	log.Printf("  Debug symbols: %s, %d of %d build ID(s) uploaded to %s", path.Base(file), uploaded, len(ids), base)
+	return ids, nil
+}
+
+// debuginfodRequest sends a request to the debuginfod server with the
+// debuginfod-token secret as bearer token, if set.
+func debuginfodRequest(ctx context.Context, method, target, token string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return httpClient().Do(req)
+}
+
+// buildIDsName is the file the build IDs of the debug symbols a build
+// uploaded are written to, by -debug package name. It is collected with the
+// artifacts, so job manifests list them when the -debug packages are dropped.
+func buildIDsName(pkgname string) string {
+	return pkgname + ".buildids.json"
+}
+
+// publishDebugInfo uploads the debug symbols of the -debug packages among
+// packageFiles and returns their build IDs by package name. With
+// debuginfod.drop_packages the -debug packages and their signatures are
+// removed afterwards and left out of the returned files, so they are not
+// published.
+func publishDebugInfo(ctx context.Context, packageFiles []string) (map[string][]string, []string, error) {
+	ids := map[string][]string{}
+	dropped := map[string]bool{}
+	for _, file := range packageFiles {
+		if strings.HasSuffix(file, ".sig") {
+			continue
+		}
+		info, err := pkgarchive.ReadPkgInfo(file)
+		if err != nil || !strings.HasSuffix(info.PkgName, "-debug") {
+			continue
+		}
+		fileIDs, err := uploadDebugInfo(ctx, file)
+		if err != nil {
+			return nil, nil, &builderError{
+				Category: errPublish,
+				Err:      fmt.Errorf("could not upload the debug symbols of %s: %w", file, err),
+				Hint:     "Check debuginfod.url and that the debuginfod-token secret may upload to it.",
+			}
+		}
+		ids[info.PkgName] = fileIDs
+		if cfg.Debuginfod.DropPackages {
+			dropped[file], dropped[file+".sig"] = true, true
+		}
+	}
+	var kept []string
+	for _, file := range packageFiles {
+		if !dropped[file] {
+			kept = append(kept, file)
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return nil, nil, errorf(errArtifact, "%w", err)
+		}
+		log.Printf("  Removed: %s (its symbols are served by debuginfod)", file)
+	}
+	return ids, kept, nil
+}
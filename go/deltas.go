@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// Delta formats of repo.deltas.formats.
+const (
+	deltaXdelta3 = "xdelta3"
+	deltaZsync   = "zsync"
+)
+
+var deltaFormats = []string{deltaXdelta3, deltaZsync}
+
+// defaultDeltaMinSize is the size below which packages get no deltas.
+const defaultDeltaMinSize = 50
+
+// deltaMaxRatio drops deltas that save too little compared to downloading
+// the package: without zstd --rsyncable most of a compressed package changes.
+const deltaMaxRatio = 0.7
+
+// deltaIndex is <repo>.deltas.json next to a repository database: the
+// deltas and zsync files clients can update packages with. A client that
+// has FromFilename with FromSHA256 runs 'xdelta3 -d -s <old> <file> <new>'
+// and checks the result against SHA256, or 'zsync -i <old> <zsync URL>'.
+type deltaIndex struct {
+	Packages map[string]*deltaPackage `json:"packages"`
+}
+
+type deltaPackage struct {
+	Version  string         `json:"version"`
+	Filename string         `json:"filename"`
+	SHA256   string         `json:"sha256sum"`
+	Zsync    string         `json:"zsync,omitempty"`
+	Deltas   []packageDelta `json:"deltas,omitempty"`
+}
+
+type packageDelta struct {
+	From         string `json:"from"`
+	FromFilename string `json:"from_filename"`
+	FromSHA256   string `json:"from_sha256sum"`
+	File         string `json:"file"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256sum"`
+}
+
+// isDeltaFile reports whether name is a delta or zsync file of makeDeltas.
+func isDeltaFile(name string) bool {
+	return strings.HasSuffix(name, ".delta") || strings.HasSuffix(name, ".zsync")
+}
+
+// deltaIndexPath returns the delta index of the repository of dbPath.
+func deltaIndexPath(dbPath string) string {
+	return filepath.Join(filepath.Dir(dbPath), repoName(dbPath)+".deltas.json")
+}
+
+func readDeltaIndex(path string) (*deltaIndex, error) {
+	index := &deltaIndex{Packages: map[string]*deltaPackage{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	if index.Packages == nil {
+		index.Packages = map[string]*deltaPackage{}
+	}
+	return index, nil
+}
+
+func writeDeltaIndex(path string, index *deltaIndex) error {
+	if len(index.Packages) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// makeDeltas generates the formats of repo.deltas for a large package that
+// replaces old in the repository of dbPath, while old's file is still
+// there. Failures only warn: clients fall back to the full package.
+func makeDeltas(ctx context.Context, dbPath string, old, e *repodb.Entry) {
+	formats := cfg.Repo.Deltas.Formats
+	minSize := int64(cfg.Repo.Deltas.MinSizeMiB)
+	if minSize == 0 {
+		minSize = defaultDeltaMinSize
+	}
+	if len(formats) == 0 || e.CSize < minSize<<20 {
+		return
+	}
+	dir := filepath.Dir(dbPath)
+	pkg := &deltaPackage{Version: e.Version, Filename: e.Filename, SHA256: e.SHA256Sum}
+	newFile := filepath.Join(dir, e.Filename)
+
+	if slices.Contains(formats, deltaZsync) {
+		if err := makeZsync(ctx, newFile); err != nil {
+			log.Printf("Warning: could not create the zsync file of %s: %v", e.Filename, err)
+		} else {
+			pkg.Zsync = e.Filename + ".zsync"
+		}
+	}
+	oldFile := filepath.Join(dir, old.Filename)
+	if _, err := os.Stat(oldFile); slices.Contains(formats, deltaXdelta3) && old.Filename != e.Filename && err == nil {
+		delta, err := makeXdelta(ctx, oldFile, old, e)
+		if err != nil {
+			log.Printf("Warning: could not create a delta of %s: %v", e.Filename, err)
+		} else if delta != nil {
+			pkg.Deltas = append(pkg.Deltas, *delta)
+		}
+	}
+	if pkg.Zsync == "" && len(pkg.Deltas) == 0 {
+		return
+	}
+
+	path := deltaIndexPath(dbPath)
+	index, err := readDeltaIndex(path)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	if prev := index.Packages[e.Name]; prev != nil {
+		current := pkg.files()
+		removeDeltaFiles(dbPath, slices.DeleteFunc(prev.files(), func(f string) bool { return slices.Contains(current, f) }))
+	}
+	index.Packages[e.Name] = pkg
+	if err := writeDeltaIndex(path, index); err != nil {
+		log.Printf("Warning: could not write %s: %v", path, err)
+	}
+}
+
+// makeZsync writes the zsync control file of file next to it.
+func makeZsync(ctx context.Context, file string) error {
+	if _, err := exec.LookPath("zsyncmake"); err != nil {
+		return errors.New("zsyncmake is not installed")
+	}
+	out := file + ".zsync"
+	if err := newCommand(ctx, "zsyncmake", "-u", filepath.Base(file), "-o", out+".tmp", file).Run(); err != nil {
+		os.Remove(out + ".tmp")
+		return err
+	}
+	log.Printf("  Zsync: %s", filepath.Base(out))
+	return os.Rename(out+".tmp", out)
+}
+
+// makeXdelta writes the binary delta from old to e next to e's file; it
+// returns nil when the delta would not save enough.
+func makeXdelta(ctx context.Context, oldFile string, old, e *repodb.Entry) (*packageDelta, error) {
+	if _, err := exec.LookPath("xdelta3"); err != nil {
+		return nil, errors.New("xdelta3 is not installed")
+	}
+	dir := filepath.Dir(oldFile)
+	name := fmt.Sprintf("%s-%s_to_%s-%s.delta", e.Name, old.Version, e.Version, e.Arch)
+	file := filepath.Join(dir, name)
+	if err := newCommand(ctx, "xdelta3", "-e", "-9", "-f", "-s", oldFile, filepath.Join(dir, e.Filename), file+".tmp").Run(); err != nil {
+		os.Remove(file + ".tmp")
+		return nil, err
+	}
+	size := fileSize(file + ".tmp")
+	if float64(size) > deltaMaxRatio*float64(e.CSize) {
+		os.Remove(file + ".tmp")
+		log.Printf("  Delta: %s skipped, it would be %s of %s (compress packages with zstd --rsyncable)", name, formatSize(size), formatSize(e.CSize))
+		return nil, nil
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return nil, err
+	}
+	sum, err := sha256File(file)
+	if err != nil {
+		return nil, err
+	}
+	fromSum := old.SHA256Sum
+	if fromSum == "" {
+		if fromSum, err = sha256File(oldFile); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("  Delta: %s (%s instead of %s)", name, formatSize(size), formatSize(e.CSize))
+	return &packageDelta{From: old.Version, FromFilename: old.Filename, FromSHA256: fromSum, File: name, Size: size, SHA256: sum}, nil
+}
+
+// files returns the delta and zsync files of pkg.
+func (pkg *deltaPackage) files() []string {
+	var files []string
+	if pkg.Zsync != "" {
+		files = append(files, pkg.Zsync)
+	}
+	for _, d := range pkg.Deltas {
+		files = append(files, d.File)
+	}
+	return files
+}
+
+// removeDeltaFiles deletes files from the directory of dbPath unless the
+// index of another repository in the directory still lists them.
+func removeDeltaFiles(dbPath string, files []string) {
+	used := map[string]bool{}
+	others, _ := filepath.Glob(filepath.Join(filepath.Dir(dbPath), "*.deltas.json"))
+	for _, other := range others {
+		if other == deltaIndexPath(dbPath) {
+			continue
+		}
+		if oi, err := readDeltaIndex(other); err == nil {
+			for _, pkg := range oi.Packages {
+				for _, f := range pkg.files() {
+					used[f] = true
+				}
+			}
+		}
+	}
+	for _, file := range files {
+		if used[file] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(filepath.Dir(dbPath), file)); err == nil {
+			log.Printf("  Removed: %s", file)
+		}
+	}
+}
+
+// pruneDeltas drops the deltas of packages the database no longer has in
+// the version they lead to and deletes their files.
+func pruneDeltas(dbPath string, db *repodb.DB) error {
+	path := deltaIndexPath(dbPath)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	index, err := readDeltaIndex(path)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for name, pkg := range index.Packages {
+		if e, ok := db.Entries[name]; ok && e.Version == pkg.Version && e.Filename == pkg.Filename {
+			continue
+		}
+		delete(index.Packages, name)
+		stale = append(stale, pkg.files()...)
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	removeDeltaFiles(dbPath, stale)
+	return writeDeltaIndex(path, index)
+}
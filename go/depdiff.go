@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// dependencyChanges lists how the runtime dependencies of a package changed,
+// as lines such as "added foo>=2" or "changed bar: bar>=1 -> bar>=2".
+type dependencyChanges []string
+
+// packageDepends returns the runtime dependencies of the given package files
+// keyed by pkgname. Unreadable packages are skipped.
+func packageDepends(files []string) map[string][]string {
+	depends := map[string][]string{}
+	for _, f := range files {
+		info, err := pkgarchive.ReadPkgInfo(f)
+		if err != nil {
+			debugPrint("Could not read %s: %v", f, err)
+			continue
+		}
+		depends[info.PkgName] = slices.Clone(info.Depends)
+		if depends[info.PkgName] == nil {
+			depends[info.PkgName] = []string{}
+		}
+	}
+	return depends
+}
+
+// diffDependencies compares two dependency lists by dependency name, so that
+// a changed version constraint is reported as such rather than as a removal
+// and an addition.
+func diffDependencies(old, new []string) dependencyChanges {
+	byName := func(deps []string) map[string]string {
+		m := map[string]string{}
+		for _, dep := range deps {
+			m[repodb.ParseDependency(dep).Name] = dep
+		}
+		return m
+	}
+	before, after := byName(old), byName(new)
+	var changes dependencyChanges
+	for _, name := range slices.Sorted(maps.Keys(after)) {
+		switch prev, ok := before[name]; {
+		case !ok:
+			changes = append(changes, "added "+after[name])
+		case prev != after[name]:
+			changes = append(changes, fmt.Sprintf("changed %s: %s -> %s", name, prev, after[name]))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(before)) {
+		if _, ok := after[name]; !ok {
+			changes = append(changes, "removed "+before[name])
+		}
+	}
+	return changes
+}
+
+// reportDependencyChanges logs the dependency changes of every package that
+// also exists in previous, described by against (e.g. "the published
+// version"), and returns them keyed by pkgname.
+func reportDependencyChanges(current, previous map[string][]string, against string) map[string]dependencyChanges {
+	report := map[string]dependencyChanges{}
+	for _, name := range slices.Sorted(maps.Keys(current)) {
+		old, ok := previous[name]
+		if !ok {
+			continue
+		}
+		changes := diffDependencies(old, current[name])
+		if len(changes) == 0 {
+			continue
+		}
+		report[name] = changes
+		log.Printf("Dependencies of %s changed since %s:", name, against)
+		for _, c := range changes {
+			log.Printf("  %s", c)
+		}
+	}
+	return report
+}
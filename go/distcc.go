@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Tools of build.distcc.tool.
+const (
+	distccTool   = "distcc"
+	icecreamTool = "icecream"
+)
+
+// distccDefaultSlots is the number of jobs distcc sends to a host without a
+// /LIMIT in its specification.
+const distccDefaultSlots = 4
+
+var (
+	// reDistccJob matches what distcc logs for every compilation with
+	// DISTCC_VERBOSE, e.g. "compile foo.c on 10.0.0.2/8,lzo completed ok"
+	reDistccJob = regexp.MustCompile(`compile \S+ on (\S+) completed ok`)
+	// reIcecreamJob matches the icecc client choosing the host of a job
+	reIcecreamJob = regexp.MustCompile(`Have to use host ([^\s:]+)`)
+)
+
+// distributedStats is how the compilations of a build were distributed.
+type distributedStats struct {
+	Tool string `json:"tool"`
+	// Hosts counts the compilations by host; localhost ran locally
+	Hosts map[string]int `json:"hosts,omitempty"`
+}
+
+// String renders the job distribution for build logs and reports.
+func (s *distributedStats) String() string {
+	total := sumCounts(s.Hosts)
+	hosts := slices.SortedFunc(maps.Keys(s.Hosts), func(a, b string) int { return s.Hosts[b] - s.Hosts[a] })
+	parts := make([]string, len(hosts))
+	for i, h := range hosts {
+		parts[i] = fmt.Sprintf("%s %d", h, s.Hosts[h])
+	}
+	if total == 0 {
+		return fmt.Sprintf("no compilations recorded by %s", s.Tool)
+	}
+	return fmt.Sprintf("%d compilation(s) with %s: %s", total, s.Tool, strings.Join(parts, ", "))
+}
+
+// distccHosts returns build.distcc.hosts with the hosts of the DNS SRV
+// record build.distcc.srv, e.g. _distccd._tcp.example.com, appended.
+func distccHosts(ctx context.Context) ([]string, error) {
+	dc := cfg.Build.Distcc
+	hosts := slices.Clone(dc.Hosts)
+	if dc.SRV != "" {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", dc.SRV)
+		if err != nil {
+			return nil, fmt.Errorf("could not discover the distcc hosts: %w", err)
+		}
+		for _, r := range records {
+			hosts = append(hosts, fmt.Sprintf("%s:%d", strings.TrimSuffix(r.Target, "."), r.Port))
+		}
+		debugPrint("Discovered %d distcc host(s) through %s", len(records), dc.SRV)
+	}
+	return hosts, nil
+}
+
+// distccJobs returns build.distcc.jobs, or the parallel jobs the hosts take:
+// the sum of their limits for distcc, twice the local CPUs otherwise.
+func distccJobs(hosts []string) int {
+	if cfg.Build.Distcc.Jobs > 0 {
+		return cfg.Build.Distcc.Jobs
+	}
+	jobs := 0
+	for _, h := range hosts {
+		if strings.HasPrefix(h, "+zeroconf") {
+			return 2 * runtime.NumCPU()
+		}
+		slots := distccDefaultSlots
+		if _, limit, ok := strings.Cut(h, "/"); ok {
+			limit, _, _ = strings.Cut(limit, ",")
+			if n, err := strconv.Atoi(limit); err == nil && n > 0 {
+				slots = n
+			}
+		}
+		jobs += slots
+	}
+	if jobs == 0 {
+		jobs = 2 * runtime.NumCPU()
+	}
+	return jobs
+}
+
+// startDistcc sets up distributed compilation with build.distcc: it writes
+// a makepkg.conf loading base, the makepkg.conf the build uses so far, that
+// enables the compiler wrappers of the tool and raises MAKEFLAGS to the
+// jobs the hosts take. It returns the build environment using it and the
+// log the jobs are read from afterwards; without the tool installed or any
+// hosts the build compiles locally.
+func startDistcc(ctx context.Context, base string) (env []string, logFile string, err error) {
+	tool := distributedTool()
+	wrappers := "/usr/lib/distcc/bin"
+	if tool == icecreamTool {
+		wrappers = "/usr/lib/icecream/bin"
+	}
+	if _, err := os.Stat(wrappers); err != nil {
+		log.Printf("Warning: build.distcc is configured but %s is not installed; compiling locally", tool)
+		return nil, "", nil
+	}
+	var conf string
+	var jobs int
+	switch tool {
+	case distccTool:
+		hosts, err := distccHosts(ctx)
+		if err != nil {
+			log.Printf("Warning: %v; compiling locally", err)
+			return nil, "", nil
+		}
+		if len(hosts) == 0 {
+			log.Printf("Warning: build.distcc has no hosts; compiling locally")
+			return nil, "", nil
+		}
+		jobs = distccJobs(hosts)
+		log.Printf("Distributing compilations with distcc to %s (%d jobs)", strings.Join(hosts, " "), jobs)
+		// makepkg puts its wrappers first in PATH and exports DISTCC_HOSTS
+		conf = fmt.Sprintf(`BUILDENV=("${BUILDENV[@]/#!distcc/distcc}")
+[[ " ${BUILDENV[*]} " == *" distcc "* ]] || BUILDENV+=(distcc)
+DISTCC_HOSTS=%q
+`, strings.Join(hosts, " "))
+	case icecreamTool:
+		if err := startIceccd(ctx); err != nil {
+			log.Printf("Warning: %v; compiling locally", err)
+			return nil, "", nil
+		}
+		jobs = distccJobs(nil)
+		log.Printf("Distributing compilations with icecream (%d jobs)", jobs)
+		conf = fmt.Sprintf("export PATH=%q:\"$PATH\"\n", wrappers)
+	}
+	conf = fmt.Sprintf(`# Generated by builder for build.distcc
+source %[1]q
+for conf in %[1]q.d/*.conf; do
+  [[ -f $conf ]] && source "$conf"
+done
+%[2]sMAKEFLAGS="-j%[3]d"
+`, base, conf, jobs)
+	f, err := os.CreateTemp("", "builder-makepkg-*.conf")
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = f.WriteString(conf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, "", fmt.Errorf("could not write makepkg.conf for %s: %w", tool, err)
+	}
+	env = []string{"MAKEPKG_CONF=" + f.Name()}
+	logFile = strings.TrimSuffix(f.Name(), ".conf") + ".log"
+	switch tool {
+	case distccTool:
+		env = append(env, "DISTCC_LOG="+logFile, "DISTCC_VERBOSE=1")
+	case icecreamTool:
+		env = append(env, "ICECC_LOGFILE="+logFile, "ICECC_DEBUG=debug")
+	}
+	return env, logFile, nil
+}
+
+// startIceccd starts the local icecream daemon, which finds the scheduler
+// of the network or connects to build.distcc.scheduler, unless it runs.
+func startIceccd(ctx context.Context) error {
+	pgrep := newCommand(ctx, "pgrep", "-x", "iceccd")
+	pgrep.Stdout, pgrep.Stderr = nil, nil
+	if pgrep.Run() == nil {
+		return nil
+	}
+	args := []string{"-d"}
+	if s := cfg.Build.Distcc.Scheduler; s != "" {
+		args = append(args, "-s", s)
+	}
+	if err := runAsRoot(ctx, "iceccd", args...); err != nil {
+		return fmt.Errorf("could not start iceccd: %w", err)
+	}
+	return nil
+}
+
+// readDistributedStats counts the compilations by host in the log of the
+// distcc or icecream clients of a build.
+func readDistributedStats(logFile string) (*distributedStats, error) {
+	f, err := os.Open(logFile)
+	if os.IsNotExist(err) {
+		// No compilation ran through the wrappers
+		return &distributedStats{Tool: distributedTool()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stats := &distributedStats{Tool: distributedTool(), Hosts: map[string]int{}}
+	re := reDistccJob
+	if stats.Tool == icecreamTool {
+		re = reIcecreamJob
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if m := re.FindStringSubmatch(sc.Text()); m != nil {
+			// Host specifications carry the limit and options
+			host, _, _ := strings.Cut(m[1], "/")
+			stats.Hosts[host]++
+		}
+	}
+	return stats, sc.Err()
+}
+
+// distccEnabled reports whether build.distcc sets up distributed
+// compilation.
+func distccEnabled() bool {
+	dc := cfg.Build.Distcc
+	return dc.Tool != "" || len(dc.Hosts) > 0 || dc.SRV != ""
+}
+
+// distributedTool returns build.distcc.tool with its default.
+func distributedTool() string {
+	if t := cfg.Build.Distcc.Tool; t != "" {
+		return t
+	}
+	return distccTool
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+// newDocsCmd creates the 'docs' command used when packaging the builder itself.
+func newDocsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "docs",
+		Short: "Generates documentation for the builder.",
+	}
+
+	var outputDir string
+	manCmd := &cobra.Command{
+		Use:   "man",
+		Short: "Generates man pages for all commands.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := os.MkdirAll(outputDir, 0755); err != nil {
+				return errorf(errArtifact, "could not create man page directory: %w", err)
+			}
+			header := &doc.GenManHeader{Title: "BUILDER", Section: "1", Source: "builder " + version}
+			root := cmd.Root()
+			root.DisableAutoGenTag = true
+			if err := doc.GenManTree(root, header, outputDir); err != nil {
+				return errorf(errArtifact, "could not generate man pages: %w", err)
+			}
+			log.Printf("Man pages written to %s", outputDir)
+			return nil
+		},
+	}
+	manCmd.Flags().StringVarP(&outputDir, "output-dir", "o", "man", "The directory to write man pages to")
+
+	cmd.AddCommand(manCmd)
+	return cmd
+}
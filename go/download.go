@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// progressInterval is how often running downloads report their progress.
+const progressInterval = 5 * time.Second
+
+// checksumHashes maps PKGBUILD checksum arrays to their hash functions.
+var checksumHashes = map[string]func() hash.Hash{
+	"b2sums": func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+	"sha512sums": sha512.New,
+	"sha384sums": sha512.New384,
+	"sha256sums": sha256.New,
+	"sha224sums": sha256.New224,
+	"sha1sums":   sha1.New,
+	"md5sums":    md5.New,
+}
+
+// downloadJob is a file to download from the first working URL.
+type downloadJob struct {
+	Name string
+	URLs []string
+	Dest string
+	// Checksums maps checksum array names (sha256sums, ...) to expected values
+	Checksums map[string]string
+}
+
+// downloader fetches files in parallel with resume, mirror failover and an
+// optional shared bandwidth limit.
+type downloader struct {
+	client  *http.Client
+	jobs    int
+	retries int
+	limiter *rateLimiter
+}
+
+// parseRate parses a rate such as 500K, 2M or 1G (bytes per second); "" means unlimited.
+func parseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q (expected e.g. 500K or 2M)", s)
+	}
+	return n * mult, nil
+}
+
+// rateLimiter limits the combined throughput of all downloads.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// wait blocks until n more bytes may be transferred.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || l.rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader applies the rate limit and counts transferred bytes.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+	n       *int64
+	mu      *sync.Mutex
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > 32<<10 {
+		p = p[:32<<10]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		lr.mu.Lock()
+		*lr.n += int64(n)
+		lr.mu.Unlock()
+		if werr := lr.limiter.wait(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// verifyChecksums checks a file against the expected PKGBUILD checksums.
+func verifyChecksums(path string, sums map[string]string) error {
+	for kind, want := range sums {
+		newHash, ok := checksumHashes[kind]
+		if !ok || want == "SKIP" {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		h := newHash()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, want) {
+			return fmt.Errorf("%s mismatch: expected %s, got %s", kind, want, got)
+		}
+	}
+	return nil
+}
+
+// run downloads all jobs and returns the combined errors of the failed ones.
+func (d *downloader) run(ctx context.Context, jobs []downloadJob) error {
+	return runParallel(d.jobs, jobs, func(job downloadJob) error {
+		if err := d.fetch(ctx, job); err != nil {
+			return fmt.Errorf("%s: %w", job.Name, err)
+		}
+		return nil
+	})
+}
+
+// fetch downloads one job, trying each URL (with retries) until the file is
+// complete and matches its checksums. Concurrent jobs sharing the
+// destination take turns, so the second one finds the finished file.
+func (d *downloader) fetch(ctx context.Context, job downloadJob) error {
+	lock, err := lockFile(ctx, job.Dest+".lock", job.Dest)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	if _, err := os.Stat(job.Dest); err == nil {
+		if err := verifyChecksums(job.Dest, job.Checksums); err == nil {
+			log.Printf("  Found: %s", job.Name)
+			return nil
+		}
+		log.Printf("Warning: existing %s does not match its checksums, downloading again", job.Name)
+		os.Remove(job.Dest)
+	}
+
+	var lastErr error
+	for _, url := range job.URLs {
+		for attempt := 1; attempt <= max(d.retries, 1); attempt++ {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var err error
+			if strings.HasPrefix(url, "magnet:") {
+				err = d.downloadTorrent(ctx, job, url)
+			} else {
+				started, before := time.Now(), fileSize(job.Dest+".part")
+				err = d.download(ctx, job, url)
+				mirrorHealth.record(url, max(fileSize(job.Dest+".part")-before, 0), time.Since(started), err)
+			}
+			if err == nil {
+				err = verifyChecksums(job.Dest+".part", job.Checksums)
+				if err != nil {
+					// A corrupt file cannot be resumed
+					os.Remove(job.Dest + ".part")
+				}
+			}
+			if err == nil {
+				if err := os.Rename(job.Dest+".part", job.Dest); err != nil {
+					return err
+				}
+				log.Printf("  Downloaded: %s", job.Name)
+				return nil
+			}
+			lastErr = err
+			log.Printf("Warning: downloading %s from %s failed (attempt %d): %v", job.Name, url, attempt, maskSecrets(err.Error()))
+			var perm permanentError
+			if errors.As(err, &perm) {
+				break
+			}
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return lastErr
+}
+
+// permanentError marks download errors that retrying the same URL cannot fix.
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// fileSize returns the size of a file, or 0 when it does not exist.
+func fileSize(path string) int64 {
+	if info, err := os.Stat(path); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+// download fetches url into <dest>.part, resuming a previous partial download.
+func (d *downloader) download(ctx context.Context, job downloadJob, url string) error {
+	part := job.Dest + ".part"
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("User-Agent", "builder/"+version)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		flags |= os.O_APPEND
+		debugPrint("Resuming %s at %d bytes", job.Name, offset)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file is already complete (or larger than the remote file)
+		return nil
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusGone:
+		return permanentError{fmt.Errorf("HTTP %s", resp.Status)}
+	default:
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var mu sync.Mutex
+	received := offset
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		last, lastTime := offset, time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				mu.Lock()
+				n := received
+				mu.Unlock()
+				speed := float64(n-last) / now.Sub(lastTime).Seconds()
+				last, lastTime = n, now
+				if total > 0 {
+					log.Printf("  %s: %s / %s (%d%%) %s/s", job.Name, formatSize(n), formatSize(total), n*100/total, formatSize(int64(speed)))
+				} else {
+					log.Printf("  %s: %s %s/s", job.Name, formatSize(n), formatSize(int64(speed)))
+				}
+			}
+		}
+	}()
+
+	body := &limitedReader{ctx: ctx, r: resp.Body, limiter: d.limiter, n: &received, mu: &mu}
+	if _, err := io.Copy(f, body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// downloadTorrent retrieves a magnet link with aria2c into <dest>.part. aria2c
+// keeps its own control file, so interrupted transfers resume as well.
+func (d *downloader) downloadTorrent(ctx context.Context, job downloadJob, magnet string) error {
+	if _, err := exec.LookPath("aria2c"); err != nil {
+		return permanentError{errors.New("aria2c is required for magnet: sources")}
+	}
+	dir := job.Dest + ".torrent"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	args := []string{"--dir", dir, "--seed-time=0", "--follow-torrent=mem", "--bt-save-metadata=false",
+		"--summary-interval=" + strconv.Itoa(int(progressInterval.Seconds())), "--console-log-level=warn"}
+	if d.limiter != nil && d.limiter.rate > 0 {
+		args = append(args, "--max-overall-download-limit="+strconv.FormatInt(d.limiter.rate, 10))
+	}
+	if caBundlePath != "" {
+		args = append(args, "--ca-certificate="+caBundlePath)
+	}
+	if insecureSkipVerify {
+		args = append(args, "--check-certificate=false")
+	}
+	if err := runCommand(ctx, "aria2c", append(args, magnet)...); err != nil {
+		return fmt.Errorf("aria2c failed: %w", err)
+	}
+
+	// Single-file torrents contain the file itself; look it up by name first
+	src := filepath.Join(dir, job.Name)
+	if _, err := os.Stat(src); err != nil {
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 1 || entries[0].IsDir() {
+			return permanentError{fmt.Errorf("torrent does not contain a single file named %s", job.Name)}
+		}
+		src = filepath.Join(dir, entries[0].Name())
+	}
+	if err := os.Rename(src, job.Dest+".part"); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
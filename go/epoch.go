@@ -0,0 +1,64 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sourceDateEpoch returns SOURCE_DATE_EPOCH, the timestamp reproducible
+// outputs use instead of the current time, if it is set.
+func sourceDateEpoch() (time.Time, bool) {
+	sec, err := strconv.ParseInt(strings.TrimSpace(os.Getenv("SOURCE_DATE_EPOCH")), 10, 64)
+	if err != nil || sec < 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0).UTC(), true
+}
+
+// sourceEpoch returns the timestamp of the sources in dir: SOURCE_DATE_EPOCH,
+// else the time of the last commit touching dir. Either is the same on
+// every checkout, unlike file modification times.
+func sourceEpoch(ctx context.Context, dir string) (time.Time, bool) {
+	if t, ok := sourceDateEpoch(); ok {
+		return t, true
+	}
+	cmd := newCommand(ctx, "git", "log", "-1", "--format=%ct", "--", ".")
+	cmd.Dir = dir
+	cmd.Stderr = nil
+	out, err := cmd.Output()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0).UTC(), true
+}
+
+// normalizeHeader strips what differs between machines and runs from a
+// tarball entry: owners become root, modes only keep the executable bit and
+// every entry gets the modification time epoch (the Unix epoch if zero).
+func normalizeHeader(hdr *tar.Header, epoch time.Time) {
+	if epoch.IsZero() {
+		epoch = time.Unix(0, 0)
+	}
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.ModTime = epoch.Truncate(time.Second)
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	hdr.PAXRecords = nil
+	switch {
+	case hdr.Typeflag == tar.TypeSymlink:
+		hdr.Mode = 0777
+	case hdr.Typeflag == tar.TypeDir || fs.FileMode(hdr.Mode)&0111 != 0:
+		hdr.Mode = 0755
+	default:
+		hdr.Mode = 0644
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// errorCategory classifies failures so CI rules can branch on the exit code.
+type errorCategory int
+
+const (
+	errGeneral errorCategory = iota
+	errConfig
+	errParse
+	errDependency
+	errBuild
+	errSigning
+	errArtifact
+	errPublish
+	errUnsupportedArch
+	errCancelled
+)
+
+// categoryInfo describes the exit code and default remediation hint of each category.
+var categoryInfo = map[errorCategory]struct {
+	name string
+	code int
+	hint string
+}{
+	errGeneral:    {"general", 1, "Check the log output above for details."},
+	errConfig:     {"config", 2, "Fix the configuration file or command line flags."},
+	errParse:      {"parse", 10, "Check that PKGBUILD defines pkgname, pkgver and pkgrel with plain assignments."},
+	errDependency: {"dependency", 11, "Check that all dependencies exist in the enabled repositories and the mirrors are reachable."},
+	errBuild:      {"build", 12, "Review the build output; retry with --clean if stale src/ or pkg/ directories are present."},
+	errSigning:    {"signing", 13, "Check that the signing key is imported and the keyring is initialized (builder keyring init)."},
+	errArtifact:   {"artifact", 14, "Check that the build produced package files and the output directory is writable."},
+	errPublish:    {"publish", 15, "Check the repository path, database permissions and storage credentials."},
+	// Not a failure in workspace builds, where the package is skipped
+	errUnsupportedArch: {"unsupported-arch", 16, "The package does not support this architecture; build it on a matching runner or add the architecture to the arch array."},
+	errCancelled:       {"cancelled", 130, "The job was cancelled; partial results were discarded."},
+}
+
+func (c errorCategory) String() string { return categoryInfo[c].name }
+
+// ExitCode returns the process exit code used for the category.
+func (c errorCategory) ExitCode() int { return categoryInfo[c].code }
+
+// categoryOfExitCode returns the category of a builder exit code, so that
+// commands running child builders can fail the same way.
+func categoryOfExitCode(code int) errorCategory {
+	for cat, info := range categoryInfo {
+		if info.code == code {
+			return cat
+		}
+	}
+	return errGeneral
+}
+
+// builderError is an error tagged with its category and an optional remediation hint.
+type builderError struct {
+	Category errorCategory
+	Err      error
+	Hint     string
+	// Reason is a machine-readable cause within the category, e.g. why a
+	// build produced no packages
+	Reason string
+}
+
+func (e *builderError) Error() string { return e.Err.Error() }
+func (e *builderError) Unwrap() error { return e.Err }
+
+// newError tags err with a category.
+func newError(cat errorCategory, err error) *builderError {
+	return &builderError{Category: cat, Err: err}
+}
+
+// errorReport is the document written to --error-json.
+type errorReport struct {
+	Category string    `json:"category"`
+	ExitCode int       `json:"exit_code"`
+	Message  string    `json:"message"`
+	Hint     string    `json:"hint"`
+	Reason   string    `json:"reason,omitempty"`
+	Command  string    `json:"command,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+var (
+	errorJSONPath  string
+	currentCommand string
+)
+
+// classify returns the category and hint of err. A categorized error anywhere
+// in the chain takes precedence over the fallback category.
+func classify(err error, fallback errorCategory) (errorCategory, string) {
+	cat, hint := fallback, ""
+	var be *builderError
+	if errors.As(err, &be) {
+		cat, hint = be.Category, be.Hint
+	}
+	if hint == "" {
+		hint = categoryInfo[cat].hint
+	}
+	return cat, hint
+}
+
+// reasonOf returns the Reason of the categorized error in the chain of err.
+func reasonOf(err error) string {
+	var be *builderError
+	if errors.As(err, &be) {
+		return be.Reason
+	}
+	return ""
+}
+
+// newErrorReport returns the machine-readable error document of err.
+func newErrorReport(err error, cat errorCategory, hint string) errorReport {
+	return errorReport{
+		Category: cat.String(),
+		ExitCode: cat.ExitCode(),
+		Message:  maskSecrets(err.Error()),
+		Hint:     hint,
+		Reason:   reasonOf(err),
+		Command:  currentCommand,
+		Time:     time.Now().UTC(),
+	}
+}
+
+// writeErrorReport writes the machine-readable error document if requested.
+func writeErrorReport(err error, cat errorCategory, hint string) {
+	if errorJSONPath == "" {
+		return
+	}
+	data, jerr := json.MarshalIndent(newErrorReport(err, cat, hint), "", "  ")
+	if jerr == nil {
+		jerr = os.WriteFile(errorJSONPath, append(data, '\n'), 0644)
+	}
+	if jerr != nil {
+		log.Printf("Warning: could not write error report %s: %v", errorJSONPath, jerr)
+	}
+}
+
+// exitWithError prints a summary of err and terminates with the exit code of
+// its category. It must only be called once all cleanup has run.
+func exitWithError(err error, fallback errorCategory) {
+	cat, hint := classify(err, fallback)
+	log.Printf("Error (%s, exit code %d): %v", cat, cat.ExitCode(), err)
+	log.Printf("Hint: %s", hint)
+	writeErrorReport(err, cat, hint)
+	if jsonOutput() {
+		// Commands with results print them even when failing, e.g. lint
+		printResult(newErrorReport(err, cat, hint))
+	}
+	os.Exit(cat.ExitCode())
+}
+
+// errorf formats an error tagged with the given category. An error wrapped
+// with %w that has a category other than general keeps it, with its hint and
+// reason, so that e.g. signing failures stay signing failures when passed on
+// by the commands publishing.
+func errorf(cat errorCategory, format string, args ...any) error {
+	err := fmt.Errorf(format, args...)
+	var inner *builderError
+	if errors.As(err, &inner) && inner.Category != errGeneral {
+		return &builderError{Category: inner.Category, Err: err, Hint: inner.Hint, Reason: inner.Reason}
+	}
+	return newError(cat, err)
+}
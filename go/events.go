@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The events of workspace runs, see buildEvent.
+const (
+	eventRunStarted       = "run_started"
+	eventPackageStarted   = "package_started"
+	eventPackageSucceeded = "package_succeeded"
+	eventPackageFailed    = "package_failed"
+	eventPackageSkipped   = "package_skipped"
+	eventRunFinished      = "run_finished"
+)
+
+// buildEvent is one line of the NDJSON event stream of a workspace run.
+type buildEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Package is the pkgbase, Dir its directory, Index its position in the
+	// run from 1
+	Package string `json:"package,omitempty"`
+	Dir     string `json:"dir,omitempty"`
+	Index   int    `json:"index,omitempty"`
+	Total   int    `json:"total,omitempty"`
+	// Step is the builder command a package failed in
+	Step      string   `json:"step,omitempty"`
+	Duration  float64  `json:"duration_seconds,omitempty"`
+	Artifacts []string `json:"artifacts,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Category  string   `json:"category,omitempty"`
+	ExitCode  int      `json:"exit_code,omitempty"`
+	// Reason is why a package was skipped
+	Reason    string `json:"reason,omitempty"`
+	Succeeded *int   `json:"succeeded,omitempty"`
+	Failed    *int   `json:"failed,omitempty"`
+	Skipped   *int   `json:"skipped,omitempty"`
+}
+
+// eventStream writes buildEvents as NDJSON, one line per event, so that
+// orchestrators can follow a run as it happens. A nil stream discards them.
+type eventStream struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// openEventStream opens the target of --events: a file, or fd:N for an
+// inherited file descriptor such as fd:3. It returns nil for no target.
+func openEventStream(target string) (*eventStream, error) {
+	if target == "" {
+		return nil, nil
+	}
+	var w io.WriteCloser
+	if fd, ok := strings.CutPrefix(target, "fd:"); ok {
+		n, err := strconv.Atoi(fd)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %q", target)
+		}
+		f := os.NewFile(uintptr(n), target)
+		if _, err := f.Stat(); err != nil {
+			return nil, fmt.Errorf("file descriptor %d is not open: %w", n, err)
+		}
+		w = f
+	} else {
+		f, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &eventStream{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// emit stamps an event with the current time and writes it. Failing writes
+// stop the stream rather than the run.
+func (s *eventStream) emit(e *buildEvent) {
+	e.Time = time.Now().UTC()
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.enc == nil {
+		return
+	}
+	if err := s.enc.Encode(e); err != nil {
+		log.Printf("Warning: could not write to the event stream, no more events are written: %v", err)
+		s.enc = nil
+	}
+}
+
+// Close closes the target of the stream.
+func (s *eventStream) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.w.Close()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// vcsPrefixes mark sources that makepkg clones instead of downloading.
+var vcsPrefixes = []string{"git+", "svn+", "hg+", "bzr+", "fossil+"}
+
+// sourceEntry is a parsed entry of a PKGBUILD source array.
+type sourceEntry struct {
+	// Name is the file name the source is stored as.
+	Name string
+	URL  string
+}
+
+var reVarRef = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}|\$([a-zA-Z_][a-zA-Z0-9_]*)`)
+
+// expandVars substitutes $var and ${var} references with known PKGBUILD
+// variables; unknown references are left untouched.
+func expandVars(s string, vars map[string]string) string {
+	return reVarRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := strings.Trim(ref, "${}")
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// carch returns the pacman architecture name of this machine.
+func carch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	case "386":
+		return "i686"
+	case "riscv64":
+		return "riscv64"
+	}
+	return runtime.GOARCH
+}
+
+// checkArch fails with errUnsupportedArch unless the PKGBUILD can be built for
+// this machine, so that unsupported packages are rejected before their
+// dependencies are installed instead of by makepkg afterwards.
+func checkArch(info *pkgbuildInfo) error {
+	arch := carch()
+	// makepkg reports a missing arch array itself
+	if len(info.Arch) == 0 || slices.Contains(info.Arch, "any") || slices.Contains(info.Arch, arch) {
+		return nil
+	}
+	return errorf(errUnsupportedArch, "%s does not support %s (arch=(%s))", info.PkgName, arch, strings.Join(info.Arch, " "))
+}
+
+// remote reports whether the source is downloaded rather than a local file
+// next to the PKGBUILD.
+func (e sourceEntry) remote() bool {
+	return strings.Contains(e.URL, "://") || strings.HasPrefix(e.URL, "magnet:")
+}
+
+// arraySources returns the non-VCS sources of one source array (source or
+// source_<arch>) with their checksums keyed by checksum array name.
+func arraySources(info *pkgbuildInfo, array string) ([]sourceEntry, []map[string]string) {
+	var entries []sourceEntry
+	var sums []map[string]string
+	suffix := strings.TrimPrefix(array, "source")
+	for i, raw := range info.Arrays[array] {
+		raw = expandVars(raw, info.Vars)
+		name, url, ok := strings.Cut(raw, "::")
+		if !ok {
+			url, name = raw, sourceFileName(raw)
+		}
+		if hasVCSPrefix(url) {
+			continue
+		}
+		s := map[string]string{}
+		for kind := range checksumHashes {
+			if values := info.Arrays[kind+suffix]; i < len(values) {
+				s[kind] = values[i]
+			}
+		}
+		entries = append(entries, sourceEntry{Name: name, URL: url})
+		sums = append(sums, s)
+	}
+	return entries, sums
+}
+
+// pkgbuildSources returns the remote sources for arch (source and
+// source_<arch>) with their checksums keyed by checksum array name.
+func pkgbuildSources(info *pkgbuildInfo, arch string) ([]sourceEntry, []map[string]string) {
+	var entries []sourceEntry
+	var sums []map[string]string
+	for _, array := range []string{"source", "source_" + arch} {
+		arrayEntries, arraySums := arraySources(info, array)
+		for i, e := range arrayEntries {
+			if e.remote() {
+				entries = append(entries, e)
+				sums = append(sums, arraySums[i])
+			}
+		}
+	}
+	return entries, sums
+}
+
+func hasVCSPrefix(url string) bool {
+	for _, p := range vcsPrefixes {
+		if strings.HasPrefix(url, p) {
+			return true
+		}
+	}
+	return strings.HasPrefix(url, "git://")
+}
+
+// sourceFileName returns the file name makepkg uses for a source without an
+// explicit name: the last path element, or the dn= name of a magnet link.
+func sourceFileName(source string) string {
+	if strings.HasPrefix(source, "magnet:") {
+		if q, err := url.ParseQuery(strings.TrimPrefix(source, "magnet:?")); err == nil && q.Get("dn") != "" {
+			return q.Get("dn")
+		}
+	}
+	return path.Base(strings.TrimSuffix(source, "/"))
+}
+
+// defaultIPFSGateways are tried for ipfs:// sources when none are configured:
+// a local node first, then a public gateway.
+var defaultIPFSGateways = []string{"http://127.0.0.1:8080/ipfs/", "https://ipfs.io/ipfs/"}
+
+// sourceURLs returns the URLs to try for a source: IPFS sources through each
+// gateway, others followed by their alternatives from the configured mirrors.
+func sourceURLs(source string, fc fetchConfig) []string {
+	if cid, ok := strings.CutPrefix(source, "ipfs://"); ok {
+		gateways := fc.IPFSGateways
+		if len(gateways) == 0 {
+			gateways = defaultIPFSGateways
+		}
+		var urls []string
+		for _, gw := range gateways {
+			urls = append(urls, strings.TrimSuffix(gw, "/")+"/"+cid)
+		}
+		return urls
+	}
+	return mirrorURLs(source, fc.Mirrors)
+}
+
+// mirrorURLs returns url followed by its alternatives from the configured mirrors.
+func mirrorURLs(url string, mirrors map[string][]string) []string {
+	urls := []string{url}
+	for prefix, alternatives := range mirrors {
+		if !strings.HasPrefix(url, prefix) {
+			continue
+		}
+		for _, alt := range alternatives {
+			urls = append(urls, alt+strings.TrimPrefix(url, prefix))
+		}
+	}
+	return urls
+}
+
+// newFetchCmd creates the 'fetch' command.
+func newFetchCmd() *cobra.Command {
+	var destDir, limitRate, vendorDir string
+	var jobs, retries int
+	var skipPGPCheck bool
+	cmd := &cobra.Command{
+		Use:   "fetch",
+		Short: "Downloads the PKGBUILD sources in parallel with resume and mirror fallback.",
+		Long: `Downloads the remote sources of the PKGBUILD in the current directory before the
+build, verifying them against the PKGBUILD checksums. Partial downloads are
+resumed, failing URLs are retried and then replaced by the mirrors configured
+under fetch.mirrors. ipfs:// sources are fetched through the gateways in
+fetch.ipfs_gateways and magnet: sources with aria2c; makepkg then finds them
+already downloaded. VCS sources are left to makepkg. Sources with a detached
+signature (.sig, .asc, .sign) are then verified against validpgpkeys, using the
+keys in keys/pgp or from the keyserver.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fc := cfg.Fetch
+			if !cmd.Flags().Changed("jobs") && fc.Jobs > 0 {
+				jobs = fc.Jobs
+			}
+			if !cmd.Flags().Changed("retries") && fc.Retries > 0 {
+				retries = fc.Retries
+			}
+			if !cmd.Flags().Changed("limit-rate") && fc.LimitRate != "" {
+				limitRate = fc.LimitRate
+			}
+			rate, err := parseRate(limitRate)
+			if err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+			if destDir == "" {
+				destDir = os.Getenv("SRCDEST")
+			}
+			if destDir == "" {
+				destDir = "."
+			}
+			if err := os.MkdirAll(destDir, 0755); err != nil {
+				return errorf(errDependency, "could not create source directory: %w", err)
+			}
+
+			info, err := parsePKGBUILD("PKGBUILD")
+			if err != nil {
+				return errorf(errParse, "%w", err)
+			}
+			if vendorDir == "" {
+				vendorDir = fc.VendorDir
+			}
+			if vendorDir != "" {
+				if _, err := useVendoredSources(vendorDir, info, destDir); err != nil {
+					return errorf(errDependency, "%w", err)
+				}
+			}
+			downloads := sourceDownloads(info, fc, destDir)
+			if len(downloads) == 0 {
+				log.Println("No remote sources to download.")
+			} else {
+				log.Printf("Downloading %d source(s) into %s...", len(downloads), destDir)
+				d := &downloader{client: httpClient(), jobs: jobs, retries: retries, limiter: &rateLimiter{rate: rate}}
+				err := d.run(cmd.Context(), downloads)
+				printMirrorHealth()
+				if err != nil {
+					return errorf(errDependency, "could not download sources:\n%w", err)
+				}
+				log.Println("All sources downloaded.")
+			}
+			if skipPGPCheck {
+				return nil
+			}
+			return verifySourceSignatures(cmd.Context(), info, destDir)
+		},
+	}
+	cmd.Flags().StringVar(&destDir, "dest", "", "Directory to store sources in (default $SRCDEST or the current directory)")
+	cmd.Flags().IntVarP(&jobs, "jobs", "j", 4, "Number of parallel downloads")
+	cmd.Flags().IntVar(&retries, "retries", 3, "Attempts per URL before trying the next mirror")
+	cmd.Flags().StringVar(&vendorDir, "vendor-dir", "", "Prefer sources from this mirror created by 'sources vendor'")
+	cmd.Flags().StringVar(&limitRate, "limit-rate", "", "Total bandwidth limit, e.g. 500K or 2M (bytes per second)")
+	cmd.Flags().BoolVar(&skipPGPCheck, "skip-pgp-check", false, "Do not verify source signatures")
+	return cmd
+}
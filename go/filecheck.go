@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+// Severities of package file issues.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// systemdUnitExts are the file extensions of systemd units.
+var systemdUnitExts = []string{".service", ".socket", ".timer", ".target", ".path", ".mount", ".automount", ".swap", ".slice", ".scope", ".device"}
+
+// systemdUnitDirs are where packages install systemd units.
+var systemdUnitDirs = []string{"usr/lib/systemd/system/", "usr/lib/systemd/user/"}
+
+// fileIssue is a problem with a file in a built package.
+type fileIssue struct {
+	Severity string
+	Path     string
+	Msg      string
+}
+
+// checkPackageFiles checks the file list of a package: files must be owned
+// by root unless explicitly expected, setuid and setgid files must be listed
+// in package_check.setuid_allowed and systemd units must be installed below
+// /usr/lib/systemd.
+func checkPackageFiles(files []pkgarchive.File, builderUID int) []fileIssue {
+	pc := cfg.PackageCheck
+	var issues []fileIssue
+	for _, f := range files {
+		p := strings.TrimSuffix(f.Path, "/")
+		switch {
+		case f.Uid == builderUID && builderUID != 0:
+			issues = append(issues, fileIssue{severityError, p, fmt.Sprintf("owned by the builder's uid %d; the package was not built under fakeroot", f.Uid)})
+		case f.Uid != 0 || f.Gid != 0:
+			issues = append(issues, fileIssue{severityWarning, p, fmt.Sprintf("owned by %d:%d instead of root", f.Uid, f.Gid)})
+		}
+
+		if f.Mode&(fs.ModeSetuid|fs.ModeSetgid) != 0 && f.Mode.IsRegular() {
+			if !slices.ContainsFunc(pc.SetuidAllowed, func(pattern string) bool {
+				ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), p)
+				return ok
+			}) {
+				kind := "setuid"
+				if f.Mode&fs.ModeSetuid == 0 {
+					kind = "setgid"
+				}
+				issues = append(issues, fileIssue{severityError, p, kind + " file not listed in package_check.setuid_allowed"})
+			}
+		}
+
+		if strings.Contains(p, "systemd/") && slices.Contains(systemdUnitExts, path.Ext(p)) && !f.Mode.IsDir() {
+			if !slices.ContainsFunc(systemdUnitDirs, func(dir string) bool { return strings.HasPrefix(p, dir) }) {
+				issues = append(issues, fileIssue{severityError, p, "systemd unit outside /usr/lib/systemd/system and /usr/lib/systemd/user"})
+			}
+		}
+	}
+	return issues
+}
+
+// checkPackages checks the files of the built packages and fails on errors,
+// unless package_check.warn_only is set. Warnings are only reported.
+func checkPackages(packageFiles []string) error {
+	var failed []string
+	for _, file := range packageFiles {
+		a, err := pkgarchive.Open(file)
+		if err != nil {
+			log.Printf("Warning: could not check the files of %s: %v", file, err)
+			continue
+		}
+		issues := checkPackageFiles(a.Files, os.Getuid())
+		for _, issue := range issues {
+			msg := fmt.Sprintf("%s: /%s: %s", a.Info.PkgName, issue.Path, issue.Msg)
+			if issue.Severity == severityError && !cfg.PackageCheck.WarnOnly {
+				failed = append(failed, msg)
+				continue
+			}
+			log.Printf("Warning: [%s] %s", issue.Severity, msg)
+		}
+	}
+	if len(failed) > 0 {
+		return &builderError{
+			Category: errArtifact,
+			Err:      fmt.Errorf("%d package file problem(s):\n  %s", len(failed), strings.Join(failed, "\n  ")),
+			Hint:     "Fix ownership and permissions in package() (install -o root, chmod), move units to /usr/lib/systemd, or allow intended setuid files in package_check.setuid_allowed.",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	lockPoll = 100 * time.Millisecond
+	// Waits shorter than this are only shown in debug mode
+	lockReportThreshold = time.Second
+)
+
+// lockWaitTotal is the time (nanoseconds) this process spent waiting for
+// file locks held by other jobs; it is recorded with the build.
+var lockWaitTotal atomic.Int64
+
+// fileLock is an advisory lock (flock) on a lock file. Sources in SRCDEST,
+// the vendor directory and repository databases may be shared by concurrent
+// jobs on one runner; the lock keeps them from writing the same files at
+// once. Lock files are left in place, as removing them would race with
+// jobs waiting for them.
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile takes an exclusive lock on path, creating it if needed, and waits
+// for other holders until ctx is done. What names the protected resource in
+// messages.
+func lockFile(ctx context.Context, path, what string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file %s: %w", path, err)
+	}
+	start := time.Now()
+	reported := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			f.Close()
+			return nil, fmt.Errorf("could not lock %s: %w", path, err)
+		}
+		if !reported && time.Since(start) >= lockReportThreshold {
+			log.Printf("Waiting for another job to release the lock on %s...", what)
+			reported = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("cancelled while waiting for the lock on %s: %w", what, ctx.Err())
+		case <-time.After(lockPoll):
+		}
+	}
+
+	if waited := time.Since(start); waited >= lockPoll {
+		lockWaitTotal.Add(int64(waited))
+		if reported {
+			log.Printf("Acquired the lock on %s after %s", what, waited.Round(time.Millisecond))
+		} else {
+			debugPrint("Acquired the lock on %s after %s", what, waited.Round(time.Millisecond))
+		}
+	}
+	return &fileLock{f: f}, nil
+}
+
+// tryLockFile takes an exclusive lock on path like lockFile, but returns
+// nil instead of waiting when another job holds it.
+func tryLockFile(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) || errors.Is(err, syscall.EINTR) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not lock %s: %w", path, err)
+	}
+	return &fileLock{f: f}, nil
+}
+
+// unlock releases the lock.
+func (l *fileLock) unlock() {
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+}
+
+// lockRepoDB locks a repository database for a read-modify-write update.
+// The lock file is not <db>.lck, which repo-add uses as its own lock.
+func lockRepoDB(ctx context.Context, dbPath string) (*fileLock, error) {
+	return lockFile(ctx, dbPath+".lock", dbPath)
+}
+
+// lockWaitTime returns the total time spent waiting for file locks.
+func lockWaitTime() time.Duration {
+	return time.Duration(lockWaitTotal.Load())
+}
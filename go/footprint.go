@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// dependencyFootprint is what installing a package takes: the package and
+// every package of its runtime dependency closure.
+type dependencyFootprint struct {
+	// Installed is the installed size of the package and its closure
+	Installed int64 `json:"installed"`
+	// Closure are the names of the packages installed with it
+	Closure []string `json:"closure,omitempty"`
+	// Unresolved are dependencies no repository provides
+	Unresolved []string `json:"unresolved,omitempty"`
+}
+
+// footprintPool returns the databases dependencies are resolved against:
+// the channel of build.channel, as packages are published to it, and
+// repo.sync_dbs.
+func footprintPool() []*repodb.DB {
+	var pool []*repodb.DB
+	if cfg.Build.Channel != "" {
+		path := strings.ReplaceAll(repoDBPath(cfg.Build.Channel), "$arch", carch())
+		if db, err := repodb.ReadFile(path); err == nil {
+			pool = append(pool, db)
+		} else {
+			debugPrint("Not resolving dependencies against %s: %v", path, err)
+		}
+	}
+	syncDBs, err := loadSyncDBs(cfg.Repo.SyncDBs)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return append(pool, syncDBs...)
+}
+
+// dependencyFootprints computes the footprint of the built packages, whose
+// dependencies are resolved against the other built packages first and pool
+// then, and returns them by pkgname. -debug packages are left out.
+func dependencyFootprints(packageFiles []string, pool []*repodb.DB) map[string]*dependencyFootprint {
+	built := repodb.New()
+	for _, file := range packageFiles {
+		if strings.HasSuffix(file, ".sig") {
+			continue
+		}
+		e, err := repodb.EntryFromPackage(file)
+		if err != nil {
+			debugPrint("Could not read %s: %v", file, err)
+			continue
+		}
+		built.Add(e)
+	}
+	pool = append([]*repodb.DB{built}, pool...)
+	footprints := map[string]*dependencyFootprint{}
+	for _, name := range built.Names() {
+		if strings.HasSuffix(name, "-debug") {
+			continue
+		}
+		footprints[name] = closureFootprint(built.Entries[name], pool)
+	}
+	return footprints
+}
+
+// closureFootprint walks the runtime dependencies of e breadth-first; each
+// dependency is satisfied by the first database of pool providing it, as
+// pacman picks from the first repository.
+func closureFootprint(e *repodb.Entry, pool []*repodb.DB) *dependencyFootprint {
+	fp := &dependencyFootprint{Installed: e.ISize}
+	seen := map[string]bool{e.Name: true}
+	unresolved := map[string]bool{}
+	queue := slices.Clone(e.Depends)
+	for len(queue) > 0 {
+		dep := repodb.ParseDependency(queue[0])
+		queue = queue[1:]
+		var found *repodb.Entry
+		for _, db := range pool {
+			if found = db.FindSatisfier(dep); found != nil {
+				break
+			}
+		}
+		switch {
+		case found == nil:
+			unresolved[dep.Name] = true
+		case !seen[found.Name]:
+			seen[found.Name] = true
+			fp.Installed += found.ISize
+			fp.Closure = append(fp.Closure, found.Name)
+			queue = append(queue, found.Depends...)
+		}
+	}
+	slices.Sort(fp.Closure)
+	fp.Unresolved = slices.Sorted(maps.Keys(unresolved))
+	return fp
+}
+
+// closureChanges lists the packages that joined or left the closure since
+// old, as "+name" and "-name".
+func closureChanges(old, new []string) []string {
+	var changes []string
+	for _, name := range new {
+		if !slices.Contains(old, name) {
+			changes = append(changes, "+"+name)
+		}
+	}
+	for _, name := range old {
+		if !slices.Contains(new, name) {
+			changes = append(changes, "-"+name)
+		}
+	}
+	return changes
+}
+
+// reportFootprints logs the footprints of the built packages with their
+// change since previous, described by against, when known.
+func reportFootprints(footprints, previous map[string]*dependencyFootprint, against string) {
+	for _, name := range slices.Sorted(maps.Keys(footprints)) {
+		fp := footprints[name]
+		size := formatSize(fp.Installed)
+		old := previous[name]
+		if old != nil {
+			size = sizeChange(old.Installed, fp.Installed)
+		}
+		log.Printf("Footprint: %s installs %s with %d dependencies", name, size, len(fp.Closure))
+		if old != nil {
+			if changes := closureChanges(old.Closure, fp.Closure); len(changes) > 0 {
+				log.Printf("  Closure changed since %s: %s", against, strings.Join(changes, " "))
+			}
+		}
+		if len(fp.Unresolved) > 0 {
+			log.Printf("  Not in the repositories, so not counted: %s", strings.Join(fp.Unresolved, ", "))
+		}
+	}
+}
+
+// footprintReport renders the footprints for the merge request note,
+// compared with those of prev (may be nil).
+func footprintReport(footprints map[string]*dependencyFootprint, prev *buildRecord) string {
+	var b strings.Builder
+	b.WriteString("\n| Package | Dependencies | Installed with dependencies |\n|---|---|---|\n")
+	var changed []string
+	for _, name := range slices.Sorted(maps.Keys(footprints)) {
+		fp := footprints[name]
+		var old dependencyFootprint
+		if prev != nil && prev.Footprint[name] != nil {
+			old = *prev.Footprint[name]
+			if changes := closureChanges(old.Closure, fp.Closure); len(changes) > 0 {
+				changed = append(changed, fmt.Sprintf("- `%s`: %s", name, strings.Join(changes, " ")))
+			}
+		}
+		fmt.Fprintf(&b, "| %s | %d | %s |\n", name, len(fp.Closure), sizeChange(old.Installed, fp.Installed))
+	}
+	if len(changed) > 0 {
+		fmt.Fprintf(&b, "\n**Dependency closure** changed since %s:\n%s\n", prev.Version, strings.Join(changed, "\n"))
+	}
+	return b.String()
+}
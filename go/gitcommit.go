@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+)
+
+// defaultCommitMessage is the message of package updates in Arch packaging
+// repositories, as 'pkgctl release' writes it.
+const defaultCommitMessage = "upgpkg: {{.Name}} {{.Version}}"
+
+// commitData is what the templates of git, e.g. git.commit_message, are
+// rendered with.
+type commitData struct {
+	// Name is the pkgbase, or pkgname if there is none
+	Name string
+	// Version is the full version, [epoch:]pkgver-pkgrel
+	Version    string
+	PkgVer     string
+	PkgRel     string
+	OldVersion string
+}
+
+// commitOptions are how commitPackage commits, from the flags of bump and
+// git.
+type commitOptions struct {
+	Signoff bool
+	GPGSign bool
+	// Push is the branch to push to, if any
+	Push string
+}
+
+// fullVersion returns the [epoch:]pkgver-pkgrel of a PKGBUILD.
+func fullVersion(info *pkgbuildInfo) string {
+	v := info.PkgVer + "-" + info.PkgRel
+	if epoch := info.Vars["epoch"]; epoch != "" && epoch != "0" {
+		v = epoch + ":" + v
+	}
+	return v
+}
+
+// gitTemplate parses a template of git, or def if it is not set.
+func gitTemplate(name, text, def string) (*template.Template, error) {
+	if text == "" {
+		text = def
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// newCommitData returns the template data of a package updated from
+// oldVersion (may be empty).
+func newCommitData(info *pkgbuildInfo, oldVersion string) commitData {
+	data := commitData{
+		Name:       info.Vars["pkgbase"],
+		Version:    fullVersion(info),
+		PkgVer:     info.PkgVer,
+		PkgRel:     info.PkgRel,
+		OldVersion: oldVersion,
+	}
+	if data.Name == "" {
+		data.Name = info.PkgName
+	}
+	return data
+}
+
+// renderGitTemplate renders the template git.<name>, or def, with data.
+func renderGitTemplate(name, text, def string, data commitData) (string, error) {
+	tmpl, err := gitTemplate(name, text, def)
+	if err != nil {
+		return "", fmt.Errorf("git.%s: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid git.%s: %w", name, err)
+	}
+	out := strings.TrimSpace(buf.String())
+	if out == "" {
+		return "", fmt.Errorf("git.%s renders to nothing", name)
+	}
+	return out, nil
+}
+
+// gitRun runs git in dir, with its output going to the log.
+func gitRun(ctx context.Context, dir string, args ...string) error {
+	git := newCommand(ctx, "git", append([]string{"-C", dir}, args...)...)
+	if err := git.Run(); err != nil {
+		return fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return nil
+}
+
+// commitPackage commits the changes of the package directory dir, and only
+// those, with the message of git.commit_message, and pushes the commit when
+// opts.Push is set. It returns the commit.
+func commitPackage(ctx context.Context, dir string, info *pkgbuildInfo, oldVersion string, opts commitOptions) (string, error) {
+	toplevel := newCommand(ctx, "git", "-C", dir, "rev-parse", "--show-toplevel")
+	toplevel.Stderr = nil
+	if _, err := toplevel.Output(); err != nil {
+		return "", &builderError{
+			Category: errConfig,
+			Err:      fmt.Errorf("%s is not in a git repository", dir),
+			Hint:     "Run bump --commit in a clone of the packaging repository.",
+		}
+	}
+	msg, err := renderGitTemplate("commit_message", cfg.Git.CommitMessage, defaultCommitMessage, newCommitData(info, oldVersion))
+	if err != nil {
+		return "", errorf(errConfig, "%w", err)
+	}
+	if err := gitRun(ctx, dir, "add", "--all", "--", "."); err != nil {
+		return "", errorf(errGeneral, "%w", err)
+	}
+	args := []string{"commit", "--quiet", "--message", msg}
+	if opts.Signoff {
+		args = append(args, "--signoff")
+	}
+	if opts.GPGSign {
+		args = append(args, "--gpg-sign"+gpgKeyArg(cfg.Git.SignKey))
+	}
+	// Other staged changes of the repository are left out of the commit
+	args = append(args, "--", ".")
+	if err := gitRun(ctx, dir, args...); err != nil {
+		hint := "Set user.name and user.email in the git configuration."
+		if opts.GPGSign {
+			hint = "Check that gpg can sign with git.sign_key or user.signingkey, and that user.name and user.email are set."
+		}
+		return "", &builderError{Category: errGeneral, Err: err, Hint: hint}
+	}
+	rev := newCommand(ctx, "git", "-C", dir, "rev-parse", "HEAD")
+	out, err := rev.Output()
+	if err != nil {
+		return "", errorf(errGeneral, "git rev-parse failed: %w", err)
+	}
+	commit := strings.TrimSpace(string(out))
+	log.Printf("Committed %s: %s", commit[:min(len(commit), 12)], msg)
+
+	if opts.Push != "" {
+		remote := gitRemote()
+		if err := gitRun(ctx, dir, "push", "--quiet", remote, "HEAD:refs/heads/"+opts.Push); err != nil {
+			return commit, &builderError{
+				Category: errPublish,
+				Err:      err,
+				Hint:     fmt.Sprintf("The commit was made but not pushed; check the credentials for %s, or pull and push %s again.", remote, opts.Push),
+			}
+		}
+		log.Printf("Pushed to %s %s", remote, opts.Push)
+	}
+	return commit, nil
+}
+
+// gpgKeyArg returns the value of --gpg-sign for a key, none for the
+// default key.
+func gpgKeyArg(key string) string {
+	if key == "" {
+		return ""
+	}
+	return "=" + key
+}
+
+// gitRemote returns git.remote with its default.
+func gitRemote() string {
+	if r := cfg.Git.Remote; r != "" {
+		return r
+	}
+	return "origin"
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"slices"
+	"strings"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+// Hardening properties of ELF files, the keys of hardening.require.
+const (
+	hardenRELRO     = "relro"
+	hardenFullRELRO = "full-relro"
+	hardenPIE       = "pie"
+	hardenCanary    = "canary"
+	hardenNX        = "nx"
+)
+
+// hardeningProperties are the properties in the order they are reported.
+var hardeningProperties = []string{hardenRELRO, hardenFullRELRO, hardenPIE, hardenCanary, hardenNX}
+
+// stackCheckSymbols are those referenced by code compiled with stack
+// protectors (-fstack-protector), by gcc, clang and icc.
+var stackCheckSymbols = []string{"__stack_chk_fail", "__stack_chk_fail_local", "__stack_chk_guard", "__intel_security_cookie"}
+
+// elfHardening is the hardening of one executable or shared library in a
+// package, as checksec reports it.
+type elfHardening struct {
+	Path string
+	// Executable is unset for shared libraries, where PIE does not apply
+	Executable bool
+	RELRO      bool
+	FullRELRO  bool
+	PIE        bool
+	Canary     bool
+	NX         bool
+}
+
+// has reports whether the file has a property, and whether it applies.
+func (h elfHardening) has(property string) (has, applies bool) {
+	switch property {
+	case hardenRELRO:
+		return h.RELRO, true
+	case hardenFullRELRO:
+		return h.FullRELRO, true
+	case hardenPIE:
+		return h.PIE, h.Executable
+	case hardenCanary:
+		return h.Canary, true
+	case hardenNX:
+		return h.NX, true
+	}
+	return false, false
+}
+
+// missing describes what the file lacks, e.g. "partial RELRO, no canary".
+func (h elfHardening) missing() []string {
+	var m []string
+	switch {
+	case !h.RELRO:
+		m = append(m, "no RELRO")
+	case !h.FullRELRO:
+		m = append(m, "partial RELRO")
+	}
+	if h.Executable && !h.PIE {
+		m = append(m, "no PIE")
+	}
+	if !h.Canary {
+		m = append(m, "no canary")
+	}
+	if !h.NX {
+		m = append(m, "executable stack")
+	}
+	return m
+}
+
+// inspectHardening returns the hardening of an ELF file, or false for files
+// it does not apply to: object files, kernel modules and the like.
+func inspectHardening(f *elf.File) (elfHardening, bool) {
+	var h elfHardening
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return h, false
+	}
+	interp, stack := false, false
+	for _, p := range f.Progs {
+		switch p.Type {
+		case elf.PT_INTERP:
+			interp = true
+		case elf.PT_GNU_RELRO:
+			h.RELRO = true
+		case elf.PT_GNU_STACK:
+			stack = true
+			h.NX = p.Flags&elf.PF_X == 0
+		}
+	}
+	if !stack {
+		// Without PT_GNU_STACK the kernel makes the stack executable
+		h.NX = false
+	}
+	flags, _ := dynValue(f, elf.DT_FLAGS)
+	flags1, _ := dynValue(f, elf.DT_FLAGS_1)
+	_, bindNow := dynValue(f, elf.DT_BIND_NOW)
+	h.FullRELRO = h.RELRO && (bindNow || flags&uint64(elf.DF_BIND_NOW) != 0 || flags1&uint64(elf.DF_1_NOW) != 0)
+	pie := flags1&uint64(elf.DF_1_PIE) != 0
+	// Shared libraries are ET_DYN as PIE executables are, but have no
+	// interpreter; static executables have no interpreter either, but are
+	// ET_EXEC unless linked with -static-pie, which sets DF_1_PIE
+	h.Executable = f.Type == elf.ET_EXEC || interp || pie
+	h.PIE = f.Type == elf.ET_DYN && h.Executable
+	h.Canary = referencesSymbol(f, stackCheckSymbols)
+	return h, true
+}
+
+// dynValue returns the value of a dynamic entry of f and whether it exists.
+func dynValue(f *elf.File, tag elf.DynTag) (uint64, bool) {
+	values, err := f.DynValue(tag)
+	if err != nil || len(values) == 0 {
+		return 0, false
+	}
+	return values[0], true
+}
+
+// referencesSymbol reports whether f defines or imports any of names, per
+// its dynamic symbols or, in static executables, its symbol table.
+func referencesSymbol(f *elf.File, names []string) bool {
+	for _, load := range []func() ([]elf.Symbol, error){f.DynamicSymbols, f.Symbols} {
+		syms, err := load()
+		if err != nil {
+			continue
+		}
+		if slices.ContainsFunc(syms, func(s elf.Symbol) bool {
+			// Versioned symbols are listed without their version
+			return slices.Contains(names, s.Name)
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanPackageHardening returns the hardening of the executables and shared
+// libraries of a package file, sorted by path.
+func scanPackageHardening(pkgFile string) ([]elfHardening, error) {
+	var files []elfHardening
+	err := pkgarchive.Walk(pkgFile, func(hdr *tar.Header, r io.Reader) error {
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if hdr.Typeflag != tar.TypeReg || hdr.Size < 4 || strings.HasPrefix(name, "usr/lib/debug/") || hardeningIgnored(name) {
+			return nil
+		}
+		br := bufio.NewReader(r)
+		if magic, err := br.Peek(4); err != nil || !bytes.Equal(magic, []byte(elf.ELFMAG)) {
+			return nil
+		}
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return fmt.Errorf("could not read %s from %s: %w", hdr.Name, pkgFile, err)
+		}
+		f, err := elf.NewFile(bytes.NewReader(data))
+		if err != nil {
+			debugPrint("Skipping malformed ELF file %s: %v", hdr.Name, err)
+			return nil
+		}
+		defer f.Close()
+		if h, ok := inspectHardening(f); ok {
+			h.Path = name
+			files = append(files, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not scan %s: %w", pkgFile, err)
+	}
+	slices.SortFunc(files, func(a, b elfHardening) int { return strings.Compare(a.Path, b.Path) })
+	return files, nil
+}
+
+// hardeningIgnored reports whether a path of a package matches
+// hardening.ignore.
+func hardeningIgnored(name string) bool {
+	return slices.ContainsFunc(cfg.Hardening.Ignore, func(pattern string) bool {
+		ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), name)
+		return ok
+	})
+}
+
+// countHardening returns how many of files have a property and how many it
+// applies to.
+func countHardening(files []elfHardening, property string) (has, total int) {
+	for _, h := range files {
+		if ok, applies := h.has(property); applies {
+			total++
+			if ok {
+				has++
+			}
+		}
+	}
+	return has, total
+}
+
+// checkHardening reports the hardening of the ELF files of the built
+// packages, with the files lacking any listed, and fails when a package has
+// fewer files with a property than hardening.require demands.
+func checkHardening(packageFiles []string) error {
+	var failed []string
+	for _, file := range packageFiles {
+		if strings.HasSuffix(file, ".sig") {
+			continue
+		}
+		info, err := pkgarchive.ReadPkgInfo(file)
+		if err != nil || strings.HasSuffix(info.PkgName, "-debug") {
+			continue
+		}
+		files, err := scanPackageHardening(file)
+		if err != nil {
+			log.Printf("Warning: could not check the hardening of %s: %v", file, err)
+			continue
+		}
+		if len(files) == 0 {
+			continue
+		}
+		var summary []string
+		for _, property := range hardeningProperties {
+			has, total := countHardening(files, property)
+			if total == 0 {
+				continue
+			}
+			summary = append(summary, fmt.Sprintf("%s %d/%d", property, has, total))
+			if want, ok := cfg.Hardening.Require[property]; ok && has*100 < want*total {
+				failed = append(failed, fmt.Sprintf("%s: %s in %d of %d ELF file(s) (%d%%), hardening.require.%s is %d%%",
+					info.PkgName, property, has, total, has*100/total, property, want))
+			}
+		}
+		log.Printf("Hardening: %s: %d ELF file(s), %s", info.PkgName, len(files), strings.Join(summary, ", "))
+		for _, h := range files {
+			if m := h.missing(); len(m) > 0 {
+				log.Printf("  /%s: %s", h.Path, strings.Join(m, ", "))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &builderError{
+			Category: errArtifact,
+			Err:      fmt.Errorf("%d hardening requirement(s) not met:\n  %s", len(failed), strings.Join(failed, "\n  ")),
+			Hint:     "Keep the default CFLAGS and LDFLAGS of makepkg.conf (-fstack-protector-strong, -z relro -z now, PIE), pass them on to the upstream build system, or exempt files with hardening.ignore.",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	heartbeatInterval time.Duration
+
+	// lastOutput is the time (unix nanoseconds) child processes last wrote output.
+	lastOutput   atomic.Int64
+	currentPhase atomic.Value
+)
+
+// activityWriter forwards writes and records the time of the last output.
+type activityWriter struct {
+	w io.Writer
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	lastOutput.Store(time.Now().UnixNano())
+	return a.w.Write(p)
+}
+
+// trackOutput wraps w so that writes count as build activity for the heartbeat.
+func trackOutput(w io.Writer) io.Writer {
+	return activityWriter{w}
+}
+
+// setPhase names the current phase in heartbeat messages.
+func setPhase(phase string) {
+	currentPhase.Store(phase)
+}
+
+// startHeartbeat prints a progress line whenever no output was produced for a
+// full interval, so CI runners do not kill quiet jobs for inactivity.
+// It stops when ctx is done.
+func startHeartbeat(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	start := time.Now()
+	lastOutput.Store(start.UnixNano())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				quiet := now.Sub(time.Unix(0, lastOutput.Load()))
+				if quiet < interval {
+					continue
+				}
+				phase, _ := currentPhase.Load().(string)
+				fmt.Fprintf(os.Stderr, "[heartbeat] %s elapsed, phase: %s, last output %s ago\n",
+					now.Sub(start).Round(time.Second), phase, quiet.Round(time.Second))
+			}
+		}
+	}()
+}
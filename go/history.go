@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// flakyReport describes a package whose builds of identical inputs both
+// succeeded and failed.
+type flakyReport struct {
+	Package     string `json:"package"`
+	Fingerprint string `json:"fingerprint"`
+	Successes   int    `json:"successes"`
+	Failures    int    `json:"failures"`
+	// Flips counts result changes between consecutive builds
+	Flips int `json:"flips"`
+}
+
+// findFlaky groups records by package and fingerprint and returns the groups
+// whose results alternate between success and failure.
+func findFlaky(records []*buildRecord) []flakyReport {
+	type key struct{ pkg, fp string }
+	groups := map[key][]*buildRecord{}
+	var order []key
+	for _, r := range records {
+		if r.Fingerprint == "" || r.Result == resultCancelled {
+			continue
+		}
+		k := key{r.Package, r.Fingerprint}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], r)
+	}
+
+	var reports []flakyReport
+	for _, k := range order {
+		rep := flakyReport{Package: k.pkg, Fingerprint: k.fp}
+		prev := ""
+		for _, r := range groups[k] {
+			if r.Result == resultSuccess {
+				rep.Successes++
+			} else {
+				rep.Failures++
+			}
+			if prev != "" && r.Result != prev {
+				rep.Flips++
+			}
+			prev = r.Result
+		}
+		if rep.Successes > 0 && rep.Failures > 0 {
+			reports = append(reports, rep)
+		}
+	}
+	return reports
+}
+
+// warnIfFlaky points out that a failed build's exact inputs succeeded before.
+func warnIfFlaky(rec *buildRecord) {
+	if rec.Fingerprint == "" {
+		return
+	}
+	ok, err := loadBuilds(func(r *buildRecord) bool {
+		return r.Package == rec.Package && r.Fingerprint == rec.Fingerprint && r.Result == resultSuccess
+	}, 1)
+	if err != nil || len(ok) == 0 {
+		return
+	}
+	log.Printf("Warning: build #%d of the same inputs succeeded on %s; this failure may be flaky or caused by the infrastructure (confirm with 'builder bisect')",
+		ok[0].ID, ok[0].StartedAt.Local().Format(time.DateTime))
+}
+
+// newHistoryCmd creates the 'history' command.
+func newHistoryCmd() *cobra.Command {
+	var limit int
+	var result string
+	var asJSON, flaky bool
+	cmd := &cobra.Command{
+		Use:               "history [package]",
+		Short:             "Shows previously recorded builds.",
+		Annotations:       map[string]string{annotationJSONResult: "true"},
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeHistoryPackages,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var pkg string
+			if len(args) == 1 {
+				pkg = args[0]
+			}
+			if flaky {
+				return printFlaky(pkg, asJSON || jsonOutput())
+			}
+			records, err := loadBuilds(func(r *buildRecord) bool {
+				return (pkg == "" || r.Package == pkg) && (result == "" || r.Result == result)
+			}, limit)
+			if err != nil {
+				return errorf(errGeneral, "%w", err)
+			}
+
+			if asJSON || jsonOutput() {
+				return printResult(records)
+			}
+			if len(records) == 0 {
+				log.Println("No builds recorded.")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tPACKAGE\tVERSION\tRESULT\tDURATION\tSTARTED\tFINGERPRINT")
+			for _, r := range records {
+				pkg := r.Package
+				if r.Variant != "" {
+					pkg += " [" + r.Variant + "]"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%.12s\n",
+					r.ID, pkg, r.Version, r.Result,
+					r.Duration.Round(time.Second), r.StartedAt.Local().Format(time.DateTime), r.Fingerprint)
+			}
+			w.Flush()
+			return nil
+		},
+	}
+	cmd.Flags().IntVarP(&limit, "limit", "n", 20, "Maximum number of builds to show (0 for all)")
+	cmd.Flags().StringVar(&result, "result", "", "Only show builds with this result (success, failed)")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the records as JSON (as --output-format json)")
+	cmd.Flags().BoolVar(&flaky, "flaky", false, "List packages whose builds of identical inputs both succeeded and failed")
+	cmd.RegisterFlagCompletionFunc("result", cobra.FixedCompletions(
+		[]string{resultSuccess, resultFailed, resultCancelled}, cobra.ShellCompDirectiveNoFileComp))
+	return cmd
+}
+
+// printFlaky lists the flaky packages found in the whole history.
+func printFlaky(pkg string, asJSON bool) error {
+	records, err := loadBuilds(func(r *buildRecord) bool {
+		return pkg == "" || r.Package == pkg
+	}, 0)
+	if err != nil {
+		return errorf(errGeneral, "%w", err)
+	}
+	reports := findFlaky(records)
+	if asJSON {
+		return printResult(reports)
+	}
+	if len(reports) == 0 {
+		log.Println("No flaky builds found.")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tFINGERPRINT\tSUCCESSES\tFAILURES\tFLIPS")
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s\t%.12s\t%d\t%d\t%d\n", r.Package, r.Fingerprint, r.Successes, r.Failures, r.Flips)
+	}
+	w.Flush()
+	return nil
+}
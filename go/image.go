@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const defaultImageBase = "archlinux:base-devel"
+
+// defaultContainerfile is the template of the builder image. Layers are
+// ordered from the least to the most frequently changing, so a new builder
+// binary or toolchain does not rebuild the base system and paru.
+const defaultContainerfile = `FROM {{.Base}}
+
+RUN pacman -Syu --noconfirm --needed base-devel git sudo ccache \
+ && pacman -Scc --noconfirm
+
+RUN useradd -m builder \
+ && echo 'builder ALL=(ALL) NOPASSWD: ALL' > /etc/sudoers.d/builder
+
+USER builder
+WORKDIR /home/builder
+RUN git clone --depth 1 https://aur.archlinux.org/paru-bin.git /tmp/paru \
+ && cd /tmp/paru && makepkg -si --noconfirm \
+ && rm -rf /tmp/paru \
+ && mkdir -p /home/builder/.ccache
+{{if .Packages}}
+RUN sudo pacman -S --noconfirm --needed{{range .Packages}} {{.}}{{end}} \
+ && sudo pacman -Scc --noconfirm
+{{end}}
+COPY builder /usr/local/bin/builder
+LABEL org.opencontainers.image.title="builder" org.opencontainers.image.version="{{.Version}}"
+`
+
+// containerfileData is what the Containerfile template is rendered with.
+type containerfileData struct {
+	Base     string
+	Packages []string
+	Version  string
+}
+
+// containerEngine returns the configured container engine or the first
+// installed one of podman, docker and buildah.
+func containerEngine() (string, error) {
+	if cfg.Image.Engine != "" {
+		return cfg.Image.Engine, nil
+	}
+	for _, engine := range []string{"podman", "docker", "buildah"} {
+		if _, err := exec.LookPath(engine); err == nil {
+			return engine, nil
+		}
+	}
+	return "", errorf(errDependency, "no container engine found: install podman, docker or buildah, or set image.engine")
+}
+
+// imageName returns the repository the image is tagged as.
+func imageName() (string, error) {
+	if cfg.Image.Name != "" {
+		return cfg.Image.Name, nil
+	}
+	if ci := os.Getenv("CI_REGISTRY_IMAGE"); ci != "" {
+		return ci + "/builder", nil
+	}
+	return "", errorf(errConfig, "no image name: set image.name or run in GitLab CI")
+}
+
+// renderContainerfile renders the configured or built-in Containerfile.
+func renderContainerfile() (string, error) {
+	text := defaultContainerfile
+	if cfg.Image.Containerfile != "" {
+		data, err := os.ReadFile(cfg.Image.Containerfile)
+		if err != nil {
+			return "", fmt.Errorf("could not read image.containerfile: %w", err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("Containerfile").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid Containerfile template: %w", err)
+	}
+	data := containerfileData{Base: cfg.Image.Base, Packages: cfg.Image.Packages, Version: version}
+	if data.Base == "" {
+		data.Base = defaultImageBase
+	}
+	data.Base = proxiedImage(data.Base)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid Containerfile template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// imageHash identifies an image by its Containerfile and builder binary, so
+// the image is rebuilt exactly when one of them changes.
+func imageHash(containerfile, binary string) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(containerfile))
+	sum, err := sha256File(binary)
+	if err != nil {
+		return "", err
+	}
+	h.Write([]byte(sum))
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+// imageTags returns the tags of the image with the given hash: the hash, the
+// current date and latest.
+func imageTags(name, hash string) []string {
+	return []string{name + ":" + hash, name + ":" + time.Now().UTC().Format("20060102"), name + ":latest"}
+}
+
+// registryOf returns the registry of an image reference. Like docker, a
+// reference without a host (a first component with a dot or port, or
+// localhost) is a Docker Hub image.
+func registryOf(ref string) string {
+	registry, _, ok := strings.Cut(ref, "/")
+	if !ok || !strings.ContainsAny(registry, ".:") && registry != "localhost" {
+		return "docker.io"
+	}
+	return registry
+}
+
+// dependencyProxyPrefix returns the GitLab dependency proxy Docker Hub images
+// are pulled through: image.dependency_proxy, or in GitLab CI the proxy of
+// the project's group unless it is off.
+func dependencyProxyPrefix() string {
+	switch p := cfg.Image.DependencyProxy; p {
+	case "off":
+		return ""
+	case "":
+		return os.Getenv("CI_DEPENDENCY_PROXY_GROUP_IMAGE_PREFIX")
+	default:
+		return strings.TrimSuffix(p, "/")
+	}
+}
+
+// proxiedImage returns the reference ref is pulled as: through the dependency
+// proxy for Docker Hub images, avoiding its rate limits on shared runners.
+func proxiedImage(ref string) string {
+	prefix := dependencyProxyPrefix()
+	if prefix == "" || registryOf(ref) != "docker.io" {
+		return ref
+	}
+	return prefix + "/" + strings.TrimPrefix(ref, "docker.io/")
+}
+
+// engineLogin logs the engine in to registry with the password on stdin.
+func engineLogin(cmd *cobra.Command, engine, registry, user, password string) error {
+	login := newCommand(cmd.Context(), engine, "login", "--username", user, "--password-stdin", registry)
+	login.Stdin = strings.NewReader(password)
+	debugPrint("Running command: %s login --username %s --password-stdin %s", engine, user, registry)
+	if err := login.Run(); err != nil {
+		return errorf(errPublish, "could not log in to %s: %w", registry, err)
+	}
+	return nil
+}
+
+// registryCredentials returns the container registry credentials: the
+// GitLab CI registry variables or CI_JOB_TOKEN by default. The password is
+// empty when none are available.
+func registryCredentials() (user, password string, err error) {
+	password, err = getSecret("registry-password")
+	if err != nil || password == "" {
+		return "", "", err
+	}
+	user = os.Getenv("BUILDER_REGISTRY_USER")
+	if user == "" {
+		user = os.Getenv("CI_REGISTRY_USER")
+	}
+	if user == "" && password == os.Getenv("CI_JOB_TOKEN") {
+		user = "gitlab-ci-token"
+	}
+	return user, password, nil
+}
+
+// registryLogin logs the engine in to the registry of name when credentials
+// are available.
+func registryLogin(cmd *cobra.Command, engine, name string) error {
+	user, password, err := registryCredentials()
+	if err != nil || password == "" {
+		return err
+	}
+	return engineLogin(cmd, engine, registryOf(name), user, password)
+}
+
+// dependencyProxyLogin logs the engine in to the dependency proxy when the
+// base image is pulled through it.
+func dependencyProxyLogin(cmd *cobra.Command, engine string) error {
+	prefix := dependencyProxyPrefix()
+	if prefix == "" {
+		return nil
+	}
+	password, err := getSecret("dependency-proxy-password")
+	if err != nil || password == "" {
+		return err
+	}
+	user := os.Getenv("BUILDER_DEPENDENCY_PROXY_USER")
+	if user == "" {
+		user = os.Getenv("CI_DEPENDENCY_PROXY_USER")
+	}
+	return engineLogin(cmd, engine, registryOf(prefix), user, password)
+}
+
+// pushImage tags the image of hash with all its tags and pushes them.
+func pushImage(cmd *cobra.Command, engine, name, hash string) error {
+	if err := registryLogin(cmd, engine, name); err != nil {
+		return err
+	}
+	tags := imageTags(name, hash)
+	for _, tag := range tags[1:] {
+		if err := runCommand(cmd.Context(), engine, "tag", tags[0], tag); err != nil {
+			return errorf(errPublish, "could not tag %s: %w", tag, err)
+		}
+	}
+	for _, tag := range tags {
+		if err := runCommand(cmd.Context(), engine, "push", tag); err != nil {
+			return errorf(errPublish, "could not push %s: %w", tag, err)
+		}
+		log.Printf("  Pushed: %s", tag)
+	}
+	return nil
+}
+
+// newImageCmd creates the 'image' command.
+func newImageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "image",
+		Short: "Builds and pushes the builder container image.",
+		Long: `Builds the CI image the builder runs in from a Containerfile template: the base
+image (image.base, default archlinux:base-devel), paru, the packages in
+image.packages and this builder binary. Images are tagged <image.name>:<hash>,
+where the hash covers the rendered Containerfile and the binary, and with the
+date and latest. An image whose hash tag already exists is not rebuilt, and
+earlier layers are reused from <image.name>:latest.
+
+In GitLab CI, Docker Hub base images are pulled through the group's dependency
+proxy (image.dependency_proxy), and the builder logs in to the project registry
+with CI_REGISTRY_PASSWORD or CI_JOB_TOKEN.`,
+	}
+
+	// prepare renders the Containerfile and returns the engine, image name,
+	// hash and the Containerfile
+	prepare := func() (engine, name, hash, containerfile string, err error) {
+		if engine, err = containerEngine(); err != nil {
+			return
+		}
+		if name, err = imageName(); err != nil {
+			return
+		}
+		if containerfile, err = renderContainerfile(); err != nil {
+			err = newError(errConfig, err)
+			return
+		}
+		var self string
+		if self, err = os.Executable(); err != nil {
+			err = errorf(errGeneral, "could not locate the builder binary: %w", err)
+			return
+		}
+		if hash, err = imageHash(containerfile, self); err != nil {
+			err = errorf(errGeneral, "%w", err)
+		}
+		return
+	}
+
+	var push, force, noCache, printOnly bool
+	buildCmd := &cobra.Command{
+		Use:   "build",
+		Short: "Builds the builder image from the Containerfile template.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if printOnly {
+				containerfile, err := renderContainerfile()
+				if err != nil {
+					return newError(errConfig, err)
+				}
+				fmt.Print(containerfile)
+				return nil
+			}
+			engine, name, hash, containerfile, err := prepare()
+			if err != nil {
+				return err
+			}
+			tags := imageTags(name, hash)
+
+			inspectArgs := []string{"image", "inspect", tags[0]}
+			if engine == "buildah" {
+				inspectArgs = []string{"inspect", "--type", "image", tags[0]}
+			}
+			inspect := newCommand(cmd.Context(), engine, inspectArgs...)
+			inspect.Stderr = nil
+			if _, err := inspect.Output(); err == nil && !force {
+				log.Printf("Image %s is up to date.", tags[0])
+			} else {
+				setPhase("image build")
+				dir, err := os.MkdirTemp("", "builder-image-")
+				if err != nil {
+					return errorf(errGeneral, "could not create build context: %w", err)
+				}
+				defer os.RemoveAll(dir)
+				self, _ := os.Executable()
+				if err := copyFile(self, filepath.Join(dir, "builder")); err != nil {
+					return errorf(errGeneral, "could not copy the builder binary: %w", err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "Containerfile"), []byte(containerfile), 0644); err != nil {
+					return errorf(errGeneral, "could not write the Containerfile: %w", err)
+				}
+
+				if err := dependencyProxyLogin(cmd, engine); err != nil {
+					return err
+				}
+				// Earlier layers are pulled from the registry pushed to
+				if err := registryLogin(cmd, engine, name); err != nil {
+					return err
+				}
+				buildArgs := []string{"build", "-f", filepath.Join(dir, "Containerfile")}
+				for _, tag := range tags {
+					buildArgs = append(buildArgs, "-t", tag)
+				}
+				switch {
+				case noCache:
+					buildArgs = append(buildArgs, "--no-cache")
+				case engine == "docker":
+					buildArgs = append(buildArgs, "--cache-from", name+":latest", "--build-arg", "BUILDKIT_INLINE_CACHE=1")
+				default:
+					buildArgs = append(buildArgs, "--layers", "--cache-from", name)
+				}
+				log.Printf("Building %s with %s...", tags[0], engine)
+				if err := runCommand(cmd.Context(), engine, append(buildArgs, dir)...); err != nil {
+					return errorf(errBuild, "image build failed: %w", err)
+				}
+				log.Printf("Built %s", strings.Join(tags, ", "))
+			}
+			if push {
+				return pushImage(cmd, engine, name, hash)
+			}
+			return nil
+		},
+	}
+	buildCmd.Flags().BoolVar(&push, "push", false, "Push the image after building it")
+	buildCmd.Flags().BoolVar(&force, "force", false, "Rebuild even if an image with the same hash exists")
+	buildCmd.Flags().BoolVar(&noCache, "no-cache", false, "Build without reusing cached layers")
+	buildCmd.Flags().BoolVar(&printOnly, "print", false, "Print the rendered Containerfile instead of building")
+
+	pushCmd := &cobra.Command{
+		Use:   "push",
+		Short: "Pushes the builder image built by 'image build'.",
+		Long: `Pushes the image matching the current Containerfile and builder binary with all
+its tags. Registry credentials are read from BUILDER_REGISTRY_USER and
+BUILDER_REGISTRY_PASSWORD, or CI_REGISTRY_USER and CI_REGISTRY_PASSWORD.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			engine, name, hash, _, err := prepare()
+			if err != nil {
+				return err
+			}
+			return pushImage(cmd, engine, name, hash)
+		},
+	}
+
+	cmd.AddCommand(buildCmd, pushCmd)
+	return cmd
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+// defaultKernelHeaders is the package kernel.headers defaults to.
+const defaultKernelHeaders = "linux-headers"
+
+// reModuleProvide matches the virtual provides of kernel module packages,
+// e.g. NVIDIA-MODULE or VIRTUALBOX-GUEST-MODULES.
+var reModuleProvide = regexp.MustCompile(`^[A-Z0-9-]+-MODULES?$`)
+
+// kernelPackage is what a built package contributes to the kernel: DKMS
+// module sources or modules built for one kernel release.
+type kernelPackage struct {
+	File string
+	Name string
+	// DKMS are the name/version of the DKMS modules in usr/src
+	DKMS []string
+	// Releases are the kernel releases of the modules in usr/lib/modules
+	Releases []string
+	// Kernel is set for kernels themselves, which ship a vmlinuz
+	Kernel bool
+}
+
+// inspectKernelPackage returns the kernel contents of a package file, or
+// nil for ordinary packages.
+func inspectKernelPackage(file string) (*kernelPackage, error) {
+	a, err := pkgarchive.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	kp := &kernelPackage{File: file, Name: a.Info.PkgName}
+	isDKMS := slices.ContainsFunc(a.Info.Depends, func(dep string) bool { return depName(dep) == "dkms" })
+	provides := slices.ContainsFunc(a.Info.Provides, func(p string) bool { return reModuleProvide.MatchString(depName(p)) })
+	var confs []string
+	for _, f := range a.Files {
+		parts := strings.Split(f.Path, "/")
+		switch {
+		case len(parts) == 4 && parts[0] == "usr" && parts[1] == "src" && parts[3] == "dkms.conf":
+			confs = append(confs, f.Path)
+		case len(parts) >= 5 && parts[0] == "usr" && parts[1] == "lib" && parts[2] == "modules":
+			if parts[4] == "vmlinuz" {
+				kp.Kernel = true
+			}
+			if isModuleFile(f.Path) && !slices.Contains(kp.Releases, parts[3]) {
+				kp.Releases = append(kp.Releases, parts[3])
+			}
+		}
+	}
+	if len(confs) > 0 {
+		if kp.DKMS, err = dkmsModules(file, confs); err != nil {
+			return nil, err
+		}
+	}
+	if len(kp.DKMS) == 0 && len(kp.Releases) == 0 && !kp.Kernel && !isDKMS && !provides {
+		return nil, nil
+	}
+	if isDKMS && len(kp.DKMS) == 0 {
+		log.Printf("Warning: %s depends on dkms but ships no usr/src/<module>-<version>/dkms.conf", kp.Name)
+	}
+	return kp, nil
+}
+
+// isModuleFile reports whether name is a kernel module, possibly compressed.
+func isModuleFile(name string) bool {
+	for _, ext := range []string{".ko", ".ko.zst", ".ko.xz", ".ko.gz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// dkmsModules reads PACKAGE_NAME and PACKAGE_VERSION of the dkms.conf files
+// confs of a package, falling back to their <module>-<version> directory.
+func dkmsModules(file string, confs []string) ([]string, error) {
+	var modules []string
+	err := pkgarchive.Walk(file, func(hdr *tar.Header, r io.Reader) error {
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if !slices.Contains(confs, name) {
+			return nil
+		}
+		vars := map[string]string{}
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			key, value, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+			if ok && (key == "PACKAGE_NAME" || key == "PACKAGE_VERSION") {
+				vars[key] = strings.Trim(value, `"'`)
+			}
+		}
+		// Placeholders and shell variables are expanded by dkms itself
+		dir := path.Base(path.Dir(name))
+		if i := strings.LastIndex(dir, "-"); i > 0 {
+			if vars["PACKAGE_NAME"] == "" || strings.ContainsAny(vars["PACKAGE_NAME"], "$@#") {
+				vars["PACKAGE_NAME"] = dir[:i]
+			}
+			if vars["PACKAGE_VERSION"] == "" || strings.ContainsAny(vars["PACKAGE_VERSION"], "$@#") {
+				vars["PACKAGE_VERSION"] = dir[i+1:]
+			}
+		}
+		modules = append(modules, vars["PACKAGE_NAME"]+"/"+vars["PACKAGE_VERSION"])
+		return sc.Err()
+	})
+	return modules, err
+}
+
+// headersRelease returns the kernel release the installed headers package
+// builds modules for, from its /usr/lib/modules/<release>/build directory.
+func headersRelease(ctx context.Context, headers string) (string, error) {
+	cmd := newCommand(ctx, "pacman", "-Qlq", headers)
+	cmd.Stderr = nil
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s is not installed", headers)
+	}
+	for line := range strings.Lines(string(out)) {
+		rel, ok := strings.CutPrefix(strings.TrimSpace(line), "/usr/lib/modules/")
+		if release, ok2 := strings.CutSuffix(rel, "/build/"); ok && ok2 && !strings.Contains(release, "/") {
+			return release, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no /usr/lib/modules/<release>/build", headers)
+}
+
+// checkKernelPackages verifies the kernel module packages among the built
+// packages: modules must be built for the configured kernel release (or
+// that of the installed headers) and, with kernel.dkms_check, DKMS modules
+// must build against the headers in a clean container.
+func checkKernelPackages(ctx context.Context, packageFiles []string) error {
+	var kps []*kernelPackage
+	for _, file := range packageFiles {
+		kp, err := inspectKernelPackage(file)
+		if err != nil {
+			log.Printf("Warning: could not inspect %s: %v", file, err)
+		} else if kp != nil {
+			kps = append(kps, kp)
+		}
+	}
+	if len(kps) == 0 {
+		return nil
+	}
+	headers := cfg.Kernel.Headers
+	if headers == "" {
+		headers = defaultKernelHeaders
+	}
+
+	var dkms []*kernelPackage
+	var failed []string
+	for _, kp := range kps {
+		switch {
+		case kp.Kernel:
+			log.Printf("Kernel package: %s (modules for %s)", kp.Name, strings.Join(kp.Releases, ", "))
+			continue
+		case len(kp.DKMS) > 0:
+			log.Printf("DKMS package: %s (%s)", kp.Name, strings.Join(kp.DKMS, ", "))
+			dkms = append(dkms, kp)
+		}
+		if len(kp.Releases) == 0 {
+			continue
+		}
+		want := cfg.Kernel.Release
+		if want == "" {
+			release, err := headersRelease(ctx, headers)
+			if err != nil {
+				log.Printf("Warning: cannot verify the kernel release of %s: %v", kp.Name, err)
+				continue
+			}
+			want = release
+		}
+		for _, release := range kp.Releases {
+			if release != want {
+				failed = append(failed, fmt.Sprintf("%s: modules are built for %s instead of %s", kp.Name, release, want))
+			} else {
+				log.Printf("Module package: %s (built for %s)", kp.Name, release)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &builderError{
+			Category: errArtifact,
+			Err:      fmt.Errorf("%d kernel module problem(s):\n  %s", len(failed), strings.Join(failed, "\n  ")),
+			Hint:     fmt.Sprintf("Build against the headers of the target kernel: depend on %s and derive the release from /usr/lib/modules/*/build, or update kernel.release.", headers),
+		}
+	}
+	if len(dkms) == 0 || !cfg.Kernel.DKMSCheck {
+		return nil
+	}
+	return checkDKMSBuild(ctx, headers, dkms)
+}
+
+// dkmsCheckScript installs the headers, dkms and the packages in a clean
+// container and fails unless every module is installed for the release of
+// the headers, showing the make.log of those that did not build.
+const dkmsCheckScript = `set -e
+pacman -Syu --noconfirm --needed dkms "$HEADERS" >/dev/null
+release=$(pacman -Qlq "$HEADERS" | sed -n 's|^/usr/lib/modules/\([^/]*\)/build/$|\1|p' | head -n1)
+if [ -n "$KERNEL_RELEASE" ] && [ "$release" != "$KERNEL_RELEASE" ]; then
+	echo "$HEADERS is for $release, not $KERNEL_RELEASE" >&2
+	exit 1
+fi
+pacman -U --noconfirm /packages/*
+status=0
+for module in $MODULES; do
+	if dkms status -k "$release" "$module" | grep -q ': installed'; then
+		echo "Built: $module for $release"
+	else
+		echo "Failed: $module for $release" >&2
+		cat /var/lib/dkms/$module/build/make.log >&2 || true
+		status=1
+	fi
+done
+exit $status
+`
+
+// checkDKMSBuild runs dkmsCheckScript for the DKMS packages kps.
+func checkDKMSBuild(ctx context.Context, headers string, kps []*kernelPackage) error {
+	engine, err := containerEngine()
+	if err != nil {
+		return err
+	}
+	if engine == "buildah" {
+		return errorf(errDependency, "kernel.dkms_check needs podman or docker to run a container")
+	}
+	stage, err := os.MkdirTemp("", "builder-dkms-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+	var modules []string
+	for _, kp := range kps {
+		if err := linkOrCopy(kp.File, filepath.Join(stage, filepath.Base(kp.File))); err != nil {
+			return errorf(errArtifact, "%w", err)
+		}
+		modules = append(modules, kp.DKMS...)
+	}
+	image := cfg.Kernel.Image
+	if image == "" {
+		image = defaultImageBase
+	}
+
+	setPhase("dkms check")
+	log.Printf("Building %s against %s in %s...", strings.Join(modules, ", "), headers, image)
+	args := []string{"run", "--rm", "-v", stage + ":/packages:ro",
+		"-e", "HEADERS=" + headers, "-e", "KERNEL_RELEASE=" + cfg.Kernel.Release, "-e", "MODULES=" + strings.Join(modules, " "),
+		proxiedImage(image), "sh", "-c", dkmsCheckScript}
+	if err := runCommand(ctx, engine, args...); err != nil {
+		return &builderError{
+			Category: errBuild,
+			Err:      fmt.Errorf("DKMS modules do not build against %s: %w", headers, err),
+			Hint:     "See the make.log above; out-of-tree modules often break on new kernel APIs and need a patch or a newer upstream release.",
+		}
+	}
+	return nil
+}
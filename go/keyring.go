@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	pacmanConf        = "/etc/pacman.conf"
+	pacmanGnupgDir    = "/etc/pacman.d/gnupg"
+	pacmanKeyringsDir = "/usr/share/pacman/keyrings"
+	defaultSigLevel   = "Required DatabaseOptional"
+	defaultKeyserver  = "hkps://keyserver.ubuntu.com"
+)
+
+// knownKeyrings are populated by default when their keyring files are installed.
+var knownKeyrings = []string{"archlinux", "prismlinux"}
+
+// runAsRoot runs a command directly when already root and through sudo otherwise.
+func runAsRoot(ctx context.Context, name string, args ...string) error {
+	if os.Geteuid() == 0 {
+		return runCommand(ctx, name, args...)
+	}
+	return runCommand(ctx, "sudo", append([]string{name}, args...)...)
+}
+
+// splitList splits a comma or whitespace separated CI variable value.
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+}
+
+// keyFileFingerprints lists the primary key fingerprints of an armored key file.
+func keyFileFingerprints(path string) ([]string, error) {
+	out, err := newCommand(context.Background(), "gpg", "--with-colons", "--show-keys", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not read keys from %s: %w", path, err)
+	}
+	var fprs []string
+	expectFpr := false
+	for line := range strings.SplitSeq(string(out), "\n") {
+		fields := strings.Split(line, ":")
+		switch {
+		case fields[0] == "pub":
+			expectFpr = true
+		case fields[0] == "fpr" && expectFpr && len(fields) > 9:
+			fprs = append(fprs, fields[9])
+			expectFpr = false
+		}
+	}
+	return fprs, nil
+}
+
+// setSigLevel rewrites the global SigLevel of pacman.conf.
+func setSigLevel(ctx context.Context, confPath, sigLevel string) error {
+	content, err := os.ReadFile(confPath)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", confPath, err)
+	}
+
+	reOptions := regexp.MustCompile(`(?m)^\[options\]\s*$`)
+	reSection := regexp.MustCompile(`(?m)^\[`)
+	reSigLevel := regexp.MustCompile(`(?m)^#?\s*SigLevel\s*=.*$`)
+	line := "SigLevel = " + sigLevel
+
+	text := string(content)
+	opts := reOptions.FindStringIndex(text)
+	if opts == nil {
+		return fmt.Errorf("no [options] section found in %s", confPath)
+	}
+	end := len(text)
+	if next := reSection.FindStringIndex(text[opts[1]:]); next != nil {
+		end = opts[1] + next[0]
+	}
+
+	var updated string
+	if loc := reSigLevel.FindStringIndex(text[opts[1]:end]); loc != nil {
+		updated = text[:opts[1]+loc[0]] + line + text[opts[1]+loc[1]:]
+	} else {
+		updated = text[:opts[1]] + "\n" + line + text[opts[1]:]
+	}
+	if updated == string(content) {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp("", "pacman.conf-")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(updated); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write temporary file: %w", err)
+	}
+	tmp.Close()
+	return runAsRoot(ctx, "install", "-m", "644", tmp.Name(), confPath)
+}
+
+// newKeyringCmd creates the 'keyring' command.
+func newKeyringCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keyring",
+		Short: "Manages the pacman keyring of the build container.",
+	}
+
+	var refresh bool
+	var reinit bool
+	var sigLevel string
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Initializes and populates the pacman keyring and imports extra keys.",
+		Long: `Initializes the pacman keyring, populates the distribution keyrings and imports
+extra keys from the config file and the BUILDER_KEYRING_KEYS (fingerprints) and
+BUILDER_KEYRING_FILE (armored key file, e.g. a GitLab CI file variable) variables.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			kc := cfg.Keyring
+
+			if _, err := os.Stat(filepath.Join(pacmanGnupgDir, "pubring.gpg")); reinit || err != nil {
+				log.Println("Initializing pacman keyring...")
+				if err := runAsRoot(ctx, "pacman-key", "--init"); err != nil {
+					return errorf(errSigning, "failed to initialize pacman keyring: %w", err)
+				}
+			} else {
+				log.Println("Pacman keyring already initialized.")
+			}
+
+			if refresh {
+				log.Println("Refreshing keyring packages...")
+				if err := waitForPacmanLock(ctx); err != nil {
+					return err
+				}
+				if err := runAsRoot(ctx, "pacman", "-Sy", "--noconfirm", "--needed", "archlinux-keyring"); err != nil {
+					log.Printf("Warning: could not refresh archlinux-keyring: %v", err)
+				}
+			}
+
+			keyrings := kc.Keyrings
+			if len(keyrings) == 0 {
+				for _, name := range knownKeyrings {
+					if _, err := os.Stat(filepath.Join(pacmanKeyringsDir, name+".gpg")); err == nil {
+						keyrings = append(keyrings, name)
+					}
+				}
+			}
+			for _, name := range keyrings {
+				log.Printf("Populating keyring %s...", name)
+				if err := runAsRoot(ctx, "pacman-key", "--populate", name); err != nil {
+					return errorf(errSigning, "failed to populate keyring %s: %w", name, err)
+				}
+			}
+
+			keyserver := kc.Keyserver
+			if keyserver == "" {
+				keyserver = defaultKeyserver
+			}
+			keys := slices.Concat(kc.Keys, splitList(os.Getenv("BUILDER_KEYRING_KEYS")))
+			for _, fpr := range keys {
+				log.Printf("Importing key %s from %s...", fpr, keyserver)
+				if err := runAsRoot(ctx, "pacman-key", "--keyserver", keyserver, "--recv-keys", fpr); err != nil {
+					return errorf(errSigning, "failed to receive key %s: %w", fpr, err)
+				}
+				if err := runAsRoot(ctx, "pacman-key", "--lsign-key", fpr); err != nil {
+					return errorf(errSigning, "failed to locally sign key %s: %w", fpr, err)
+				}
+			}
+
+			keyFiles := slices.Clone(kc.KeyFiles)
+			if f := os.Getenv("BUILDER_KEYRING_FILE"); f != "" {
+				keyFiles = append(keyFiles, f)
+			}
+			for _, file := range keyFiles {
+				fprs, err := keyFileFingerprints(file)
+				if err != nil {
+					return errorf(errSigning, "%w", err)
+				}
+				log.Printf("Importing %d key(s) from %s...", len(fprs), file)
+				if err := runAsRoot(ctx, "pacman-key", "--add", file); err != nil {
+					return errorf(errSigning, "failed to import keys from %s: %w", file, err)
+				}
+				for _, fpr := range fprs {
+					if err := runAsRoot(ctx, "pacman-key", "--lsign-key", fpr); err != nil {
+						return errorf(errSigning, "failed to locally sign key %s: %w", fpr, err)
+					}
+				}
+			}
+
+			if sigLevel == "" {
+				sigLevel = kc.SigLevel
+			}
+			if sigLevel == "" {
+				sigLevel = defaultSigLevel
+			}
+			log.Printf("Setting SigLevel = %s in %s", sigLevel, pacmanConf)
+			if err := setSigLevel(ctx, pacmanConf, sigLevel); err != nil {
+				return errorf(errConfig, "failed to set SigLevel: %w", err)
+			}
+
+			log.Println("Keyring initialized successfully.")
+			return nil
+		},
+	}
+	initCmd.Flags().BoolVar(&refresh, "refresh", false, "Upgrade archlinux-keyring before populating")
+	initCmd.Flags().BoolVar(&reinit, "reinit", false, "Re-run pacman-key --init even if the keyring exists")
+	initCmd.Flags().StringVar(&sigLevel, "siglevel", "", "SigLevel to set in pacman.conf (default \""+defaultSigLevel+"\")")
+
+	cmd.AddCommand(initCmd)
+	return cmd
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// installHooks are the functions pacman calls in an install scriptlet.
+var installHooks = []string{"pre_install", "post_install", "pre_upgrade", "post_upgrade", "pre_remove", "post_remove"}
+
+// installRule is a PrismLinux policy rule for install scriptlets, matched
+// against each line with comments and quoted strings removed.
+type installRule struct {
+	ID       string
+	Severity string
+	Pattern  *regexp.Regexp
+	Msg      string
+}
+
+// installRules forbid what breaks unattended and offline installs; disable
+// single rules with lint.disable.
+var installRules = []installRule{
+	{"install-network", severityError, regexp.MustCompile(`\b(curl|wget|aria2c|nc|ncat|ssh|scp|ftp)\b|\bgit\s+(clone|fetch|pull)\b|\b(pip3?|npm|cargo|gem)\s+install\b|/dev/(tcp|udp)/`),
+		"accesses the network; installs must work offline, ship the files in the package instead"},
+	{"install-prompt", severityError, regexp.MustCompile(`(^|[;&|({])\s*read\b|\bselect\s+\w+\s+in\b|\b(whiptail|dialog|zenity|kdialog)\b|/dev/tty\b`),
+		"prompts for input; installs run unattended"},
+	{"install-pacman", severityError, regexp.MustCompile(`\bpacman\s+(-[A-Za-z]*[SURD]|--(sync|upgrade|remove|database))|\b(paru|yay|makepkg)(\s|$)`),
+		"changes packages, which deadlocks on the database lock held by the running transaction"},
+	{"install-systemctl", severityWarning, regexp.MustCompile(`\bsystemctl\s+(--\S+\s+)*(enable|start|restart|reload)\b`),
+		"enables or starts a unit; leave that to the administrator or use a systemd preset"},
+}
+
+var (
+	reInstallVar   = regexp.MustCompile(`(?m)^\s*install=(\S+)`)
+	reShellFunc    = regexp.MustCompile(`^\s*(?:function\s+)?([A-Za-z_][A-Za-z0-9_]*)\s*\(\s*\)`)
+	reQuoted       = regexp.MustCompile(`'[^']*'|"(?:[^"\\]|\\.)*"`)
+	reShellComment = regexp.MustCompile(`(^|\s)#.*$`)
+	reShellcheck   = regexp.MustCompile(`^[^:]+:(\d+):\d+: (\w+): (.*)$`)
+)
+
+// installFiles returns the install scriptlets a PKGBUILD references: its
+// install variable and those of the package functions of split packages.
+func installFiles(dir string, info *pkgbuildInfo) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, "PKGBUILD"))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, m := range reInstallVar.FindAllStringSubmatch(string(content), -1) {
+		name := expandVars(strings.Trim(m[1], `"'`), info.Vars)
+		if name != "" && !slices.Contains(files, name) {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// lintInstallScript checks the install scriptlet at path: its syntax,
+// shellcheck findings if shellcheck is installed, the hooks it defines
+// and installRules.
+func lintInstallScript(ctx context.Context, path string) ([]fileIssue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	var issues []fileIssue
+	if out, err := newCommand(ctx, "bash", "-n", path).CombinedOutput(); err != nil {
+		issues = append(issues, fileIssue{severityError, name, "syntax error: " + strings.TrimSpace(string(out))})
+	}
+	if _, err := exec.LookPath("shellcheck"); err == nil {
+		// Scriptlets are sourced by bash; a missing shebang is expected
+		cmd := newCommand(ctx, "shellcheck", "--shell=bash", "--format=gcc", "--exclude=SC2148", path)
+		out, _ := cmd.Output()
+		for line := range strings.Lines(string(out)) {
+			m := reShellcheck.FindStringSubmatch(strings.TrimSpace(line))
+			if m == nil {
+				continue
+			}
+			severity := severityWarning
+			if m[2] == "error" {
+				severity = severityError
+			}
+			issues = append(issues, fileIssue{severity, name + ":" + m[1], m[3]})
+		}
+	}
+
+	allowed := cfg.Lint.InstallHooks
+	if len(allowed) == 0 {
+		allowed = installHooks
+	}
+	hooks := 0
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := reShellComment.ReplaceAllString(reQuoted.ReplaceAllString(sc.Text(), `""`), "")
+		at := fmt.Sprintf("%s:%d", name, n)
+		if m := reShellFunc.FindStringSubmatch(line); m != nil {
+			switch fn := m[1]; {
+			case slices.Contains(allowed, fn):
+				hooks++
+			case slices.Contains(installHooks, fn) || strings.HasPrefix(fn, "pre_") || strings.HasPrefix(fn, "post_"):
+				issues = append(issues, fileIssue{severityError, at, fmt.Sprintf("hook %s is not allowed (lint.install_hooks: %s)", fn, strings.Join(allowed, ", "))})
+			}
+		}
+		for _, rule := range installRules {
+			if slices.Contains(cfg.Lint.Disable, rule.ID) || !rule.Pattern.MatchString(line) {
+				continue
+			}
+			issues = append(issues, fileIssue{rule.Severity, at, fmt.Sprintf("%s [%s]", rule.Msg, rule.ID)})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if hooks == 0 {
+		issues = append(issues, fileIssue{severityWarning, name, "defines no install hook; drop install= from the PKGBUILD"})
+	}
+	return issues, nil
+}
+
+// newLintCmd creates the 'lint' command.
+func newLintCmd() *cobra.Command {
+	var workspace, selection string
+	cmd := &cobra.Command{
+		Use:         "lint [<dir>...]",
+		Short:       "Checks the install scriptlets of packages against the packaging policy.",
+		Annotations: map[string]string{annotationJSONResult: "true"},
+		Long: `Checks the .install scriptlets each PKGBUILD references (install=, also in the
+package functions of split packages): bash syntax, shellcheck findings when
+shellcheck is installed, that only the hooks of lint.install_hooks are
+defined, and the PrismLinux policy rules:
+
+  install-network    no network access (curl, wget, git clone, pip install, ...)
+  install-prompt     no interactive prompts (read, select, dialog, /dev/tty)
+  install-pacman     no package managers, which deadlock on the database lock
+  install-systemctl  no enabling or starting of units (warning)
+
+Errors fail the command; rules can be disabled with lint.disable.`,
+		ValidArgsFunction: completePackageDirs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dirs := args
+			if workspace != "" {
+				infos, err := workspacePKGBUILDs(workspace)
+				if err != nil {
+					return errorf(errGeneral, "could not scan workspace %s: %w", workspace, err)
+				}
+				dirs = append(dirs, slices.Sorted(maps.Keys(infos))...)
+			}
+			if len(dirs) == 0 && workspace == "" {
+				dirs = []string{"."}
+			}
+			dirs, err := selectDirs(selection, dirs)
+			if err != nil {
+				return err
+			}
+
+			var failed []string
+			checked := 0
+			result := lintResult{Findings: []lintFinding{}}
+			for _, dir := range dirs {
+				info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+				if err != nil {
+					return errorf(errParse, "%s: %w", dir, err)
+				}
+				files, err := installFiles(dir, info)
+				if err != nil {
+					return errorf(errParse, "%s: %w", dir, err)
+				}
+				for _, file := range files {
+					checked++
+					issues, err := lintInstallScript(cmd.Context(), filepath.Join(dir, file))
+					if os.IsNotExist(err) {
+						failed = append(failed, fmt.Sprintf("%s: %s is referenced by install= but missing", dir, file))
+						result.Findings = append(result.Findings, lintFinding{Dir: dir, File: file, Severity: severityError, Message: "referenced by install= but missing"})
+						continue
+					} else if err != nil {
+						return errorf(errParse, "%s: %w", dir, err)
+					}
+					for _, issue := range issues {
+						result.Findings = append(result.Findings, lintFinding{Dir: dir, File: file, Severity: issue.Severity, Path: issue.Path, Message: issue.Msg})
+						msg := fmt.Sprintf("%s: %s: %s", dir, issue.Path, issue.Msg)
+						if issue.Severity == severityError {
+							failed = append(failed, msg)
+							continue
+						}
+						log.Printf("Warning: %s", msg)
+					}
+					if !slices.ContainsFunc(issues, func(i fileIssue) bool { return i.Severity == severityError }) {
+						log.Printf("  Passed: %s", filepath.Join(dir, file))
+					}
+				}
+			}
+			if jsonOutput() {
+				result.Checked, result.Passed = checked, len(failed) == 0
+				if err := printResult(result); err != nil {
+					return err
+				}
+			}
+			if len(failed) > 0 {
+				return &builderError{
+					Category: errParse,
+					Err:      fmt.Errorf("%d install scriptlet problem(s):\n  %s", len(failed), strings.Join(failed, "\n  ")),
+					Hint:     "Install scriptlets run unattended inside the pacman transaction: move downloads and setup into the package, or disable a rule that does not apply with lint.disable.",
+				}
+			}
+			log.Printf("%d install scriptlet(s) checked.", checked)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&workspace, "workspace", "", "Check every package below this directory")
+	cmd.Flags().StringVar(&selection, "select", "", selectUsage)
+	return cmd
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -17,10 +22,13 @@ import (
 
 var debugMode bool
 
+// version is set at build time through -ldflags (see Makefile).
+var version = "dev"
+
 // debugPrint prints debug messages only when debug mode is enabled
 func debugPrint(format string, args ...any) {
 	if debugMode {
-		fmt.Printf("DEBUG: "+format+"\n", args...)
+		fmt.Print(maskSecrets(fmt.Sprintf("DEBUG: "+format+"\n", args...)))
 	}
 }
 
@@ -33,158 +41,76 @@ type pkgbuildInfo struct {
 	Depends      []string
 	MakeDepends  []string
 	CheckDepends []string
+	// Vars holds every plain scalar assignment, used to expand source URLs
+	Vars map[string]string
+	// Arrays holds every array assignment, e.g. source or sha256sums
+	Arrays map[string][]string
 }
 
-// parsePKGBUILD safely reads a PKGBUILD file and extracts variables without executing it.
+// parsePKGBUILD safely reads a PKGBUILD file and extracts variables without
+// executing it. Results are cached by content (see metadataCache), so every
+// phase of a run sees the same metadata.
 func parsePKGBUILD(path string) (*pkgbuildInfo, error) {
 	content, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("could not read PKGBUILD file: %w", err)
 	}
-	info := &pkgbuildInfo{}
-	sContent := string(content)
-
-	lines := strings.Split(sContent, "\n")
-	debugPrint("First 15 lines of PKGBUILD:")
-	for i, line := range lines {
-		if i >= 15 {
-			break
-		}
-		debugPrint("%2d: %s", i+1, line)
-	}
-
-	// Single-line variable assignments with double quotes
-	reDoubleQuoted := regexp.MustCompile(`(?m)^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*"([^"\n#]*?)"\s*(?:#.*)?$`)
-	// Single-line variable assignments with single quotes
-	reSingleQuoted := regexp.MustCompile(`(?m)^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*'([^'\n#]*?)'\s*(?:#.*)?$`)
-	// Single-line variable assignments without quotes
-	reUnquoted := regexp.MustCompile(`(?m)^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*([^'"\n#]+?)\s*(?:#.*)?$`)
-
-	// For array variables - handles multi-line arrays better
-	reArray := regexp.MustCompile(`(?ms)^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*\(\s*(.*?)\s*\)`)
-
-	// Helper function to process matches
-	processMatches := func(matches [][]string, valueIndex int) {
-		debugPrint("Found %d variable matches", len(matches))
-		for _, match := range matches {
-			if len(match) < valueIndex+1 {
-				continue
-			}
-			key := strings.TrimSpace(match[1])
-			val := strings.TrimSpace(match[valueIndex])
+	return pkgbuildCache.get(content, parsePKGBUILDContent)
+}
 
-			debugPrint("Found variable: %s = '%s'", key, val)
+// parsePKGBUILDContent extracts the variables of a PKGBUILD.
+func parsePKGBUILDContent(content []byte) (*pkgbuildInfo, error) {
+	info := &pkgbuildInfo{Vars: map[string]string{}, Arrays: map[string][]string{}}
 
-			switch key {
-			case "pkgname":
-				if info.PkgName == "" {
-					info.PkgName = val
-				}
-			case "pkgver":
-				if info.PkgVer == "" {
-					info.PkgVer = val
-				}
-			case "pkgrel":
-				if info.PkgRel == "" {
-					info.PkgRel = val
-				}
+	if debugMode {
+		debugPrint("First 15 lines of PKGBUILD:")
+		for i, line := range strings.SplitN(string(content), "\n", 16) {
+			if i >= 15 {
+				break
 			}
+			debugPrint("%2d: %s", i+1, line)
 		}
 	}
 
-	// Extract single-string variables with different quote types
-	processMatches(reDoubleQuoted.FindAllStringSubmatch(sContent, -1), 2)
-	processMatches(reSingleQuoted.FindAllStringSubmatch(sContent, -1), 2)
-	processMatches(reUnquoted.FindAllStringSubmatch(sContent, -1), 2)
-
-	// Extract array variables
-	arrayMatches := reArray.FindAllStringSubmatch(sContent, -1)
-	debugPrint("Found %d array matches", len(arrayMatches))
-
-	for _, match := range arrayMatches {
-		if len(match) < 3 {
-			continue
+	// Later assignments override earlier ones, as when bash sources the file
+	scanner := &pkgbuildScanner{src: string(content)}
+	for {
+		a, ok := scanner.next()
+		if !ok {
+			break
 		}
-		key := strings.TrimSpace(match[1])
-		val := match[2]
-
-		// Clean up the array content more thoroughly
-		// Remove comments first
-		reComment := regexp.MustCompile(`(?m)#.*$`)
-		val = reComment.ReplaceAllString(val, "")
-
-		// Remove quotes and newlines, normalize whitespace
-		cleanVal := strings.NewReplacer(
-			"\n", " ",
-			"\t", " ",
-			"'", "",
-			"\"", "",
-			"  ", " ", // double spaces
-		).Replace(val)
-
-		// Split by whitespace and filter empty strings
-		rawFields := strings.Fields(cleanVal)
-		var fields []string
-		for _, field := range rawFields {
-			field = strings.TrimSpace(field)
-			if field != "" {
-				fields = append(fields, field)
-			}
+		switch {
+		case a.IsArray && a.Append:
+			info.Arrays[a.Name] = append(info.Arrays[a.Name], a.Values...)
+		case a.IsArray:
+			info.Arrays[a.Name] = a.Values
+		case a.Append:
+			info.Vars[a.Name] += a.Value
+		default:
+			info.Vars[a.Name] = a.Value
 		}
-
-		debugPrint("Found array: %s = %v", key, fields)
-
-		switch key {
-		case "arch":
-			info.Arch = fields
-		case "depends":
-			info.Depends = fields
-		case "makedepends":
-			info.MakeDepends = fields
-		case "checkdepends":
-			info.CheckDepends = fields
+		if a.IsArray {
+			debugPrint("Found array: %s = %q", a.Name, info.Arrays[a.Name])
+		} else {
+			debugPrint("Found variable: %s = '%s'", a.Name, info.Vars[a.Name])
 		}
 	}
 
-	// Fallback: try to extract with simpler regex if nothing found
-	if info.PkgName == "" || info.PkgVer == "" || info.PkgRel == "" {
-		debugPrint("Primary parsing failed, trying fallback method...")
-
-		// Very simple regex as fallback
-		simpleRegex := regexp.MustCompile(`(?m)^([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*(.*)$`)
-		simpleMatches := simpleRegex.FindAllStringSubmatch(sContent, -1)
-
-		for _, match := range simpleMatches {
-			if len(match) < 3 {
-				continue
-			}
-			key := strings.TrimSpace(match[1])
-			val := strings.TrimSpace(match[2])
-
-			// Remove quotes and comments
-			val = regexp.MustCompile(`\s*#.*$`).ReplaceAllString(val, "")
-			val = strings.Trim(val, `"'`)
-
-			debugPrint("Fallback found: %s = '%s'", key, val)
-
-			switch key {
-			case "pkgname":
-				if info.PkgName == "" {
-					info.PkgName = val
-				}
-			case "pkgver":
-				if info.PkgVer == "" {
-					info.PkgVer = val
-				}
-			case "pkgrel":
-				if info.PkgRel == "" {
-					info.PkgRel = val
-				}
-			}
+	// Like bash, $name of an array is its first element; split packages are
+	// therefore named after their first package
+	for name, values := range info.Arrays {
+		if _, ok := info.Vars[name]; !ok && len(values) > 0 {
+			info.Vars[name] = values[0]
 		}
 	}
+	info.PkgName = info.Vars["pkgname"]
+	info.PkgVer = info.Vars["pkgver"]
+	info.PkgRel = info.Vars["pkgrel"]
+	info.Arch = info.Arrays["arch"]
+	info.Depends = info.Arrays["depends"]
+	info.MakeDepends = info.Arrays["makedepends"]
+	info.CheckDepends = info.Arrays["checkdepends"]
 
-	// Debug final parsed values
 	debugPrint("Final parsed values - pkgname:'%s', pkgver:'%s', pkgrel:'%s'",
 		info.PkgName, info.PkgVer, info.PkgRel)
 
@@ -196,13 +122,23 @@ func parsePKGBUILD(path string) (*pkgbuildInfo, error) {
 	return info, nil
 }
 
-// copyFile copies a file from src to dst
+// copyChunk is how much copyFile copies between progress updates.
+const copyChunk = 64 << 20
+
+// copyFile copies a file from src to dst, preserving its mode, timestamps and,
+// where permitted, ownership and extended attributes. On filesystems with
+// reflinks (btrfs, XFS) the copy shares the data blocks and is instant;
+// otherwise the kernel copies the data with copy_file_range.
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer sourceFile.Close()
+	info, err := sourceFile.Stat()
+	if err != nil {
+		return err
+	}
 
 	destFile, err := os.Create(dst)
 	if err != nil {
@@ -210,51 +146,219 @@ func copyFile(src, dst string) error {
 	}
 	defer destFile.Close()
 
-	_, err = io.Copy(destFile, sourceFile)
-	if err != nil {
+	if err := reflink(destFile, sourceFile); err != nil {
+		debugPrint("No reflink for %s (%v), copying", src, err)
+		// io.CopyN passes the *os.File on to copy_file_range
+		progress := newProgressReader(nil, "copying "+filepath.Base(src), info.Size())
+		for {
+			n, err := io.CopyN(destFile, sourceFile, copyChunk)
+			progress.n.Add(n)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				progress.stop()
+				return err
+			}
+		}
+		progress.stop()
+	}
+	if err := destFile.Close(); err != nil {
 		return err
 	}
+	return copyMetadata(sourceFile, dst, info)
+}
 
-	// Copy file permissions
-	info, err := os.Stat(src)
-	if err != nil {
-		return err
+// newCommand prepares a command that streams its output to stdout/stderr, is
+// limited by the timeout of its operation (see defaultTimeouts) and is sent
+// SIGTERM when ctx is cancelled or the timeout expires, then killed if it does
+// not exit in time. Without a terminal the whole process group is signalled,
+// so nothing the command started keeps running.
+func newCommand(ctx context.Context, name string, args ...string) *command {
+	op := commandName(name, args)
+	timeout := commandTimeout(op)
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
 	}
-	return os.Chmod(dst, info.Mode())
+	name, args = resolvePacman(ctx, name, args)
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Output is masked line by line, see redactingWriter
+	stdout, stderr := newRedactingWriter(os.Stdout), newRedactingWriter(os.Stderr)
+	cmd.Stdout = trackOutput(stdout)
+	cmd.Stderr = trackOutput(stderr)
+	if usesProcessGroup() {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	cmd.Cancel = func() error {
+		if cmd.SysProcAttr != nil {
+			// WaitDelay only kills the process itself, not its children
+			time.AfterFunc(commandKillDelay, func() { signalCommand(cmd, syscall.SIGKILL) })
+		}
+		return signalCommand(cmd, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = commandKillDelay
+	return &command{Cmd: cmd, op: op, timeout: timeout, ctx: ctx, cancel: cancel, redactors: []*redactingWriter{stdout, stderr}}
 }
 
 // runCommand executes a command and streams its output to stdout/stderr.
-func runCommand(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func runCommand(ctx context.Context, name string, args ...string) error {
+	cmd := newCommand(ctx, name, args...)
 	debugPrint("Running command: %s %s", name, strings.Join(args, " "))
 	if !debugMode {
-		fmt.Printf("+ Running command: %s %s\n", name, strings.Join(args, " "))
+		fmt.Print(maskSecrets(fmt.Sprintf("+ Running command: %s %s\n", name, strings.Join(args, " "))))
 	}
 	return cmd.Run()
 }
 
+// childBuilderArgs returns the global flags that builder processes started by
+// cmd need to share its history database and configuration. The
+// configuration file is always given when there is one, as children running
+// in package directories would not find builder.yaml themselves.
+func childBuilderArgs(cmd *cobra.Command) ([]string, error) {
+	var config string
+	if _, err := os.Stat(configFile); cmd.Flags().Changed("config") || err == nil {
+		config = configFile
+	}
+	return globalBuilderArgs(config, profileName)
+}
+
+// globalBuilderArgs returns the global flags of a builder process sharing the
+// history database, with the given configuration file and profile unless
+// they are empty. Paths are absolute, as children may run in another
+// directory.
+func globalBuilderArgs(config, profile string) ([]string, error) {
+	stateDB, err := filepath.Abs(stateDBPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve state database path: %w", err)
+	}
+	args := []string{"--state-db", stateDB}
+	if config != "" {
+		abs, err := filepath.Abs(config)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve config path: %w", err)
+		}
+		args = append(args, "--config", abs)
+	}
+	if profile != "" {
+		args = append(args, "--profile", profile)
+	}
+	if debugMode {
+		args = append(args, "--debug")
+	}
+	return args, nil
+}
+
 // --- COBRA COMMANDS ---
 
 func main() {
+	// Secret values are masked in everything the builder logs, and log
+	// lines count as output for the heartbeat
+	log.SetOutput(trackOutput(maskingWriter{os.Stderr}))
+
 	var rootCmd = &cobra.Command{
 		Use:   "builder",
 		Short: "A reliable tool for building Arch Linux/PrismLinux packages in GitLab CI.",
 		Long:  `This tool replaces fragile shell scripts for dependency installation, package building, and artifact collection. It safely parses PKGBUILD files without sourcing them.`,
 	}
-	rootCmd.CompletionOptions = cobra.CompletionOptions{DisableDefaultCmd: true}
 	rootCmd.PersistentFlags().BoolVar(&debugMode, "debug", false, "Enable debug output")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", defaultConfigFile, "Path to the YAML configuration file")
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", os.Getenv("BUILDER_PROFILE"), "Configuration profile to apply (profiles.<name>, default $BUILDER_PROFILE)")
+	rootCmd.PersistentFlags().StringVar(&stateDBPath, "state-db", defaultStateDBPath(), "Path to the build history database")
+	rootCmd.PersistentFlags().StringVar(&metricsFile, "metrics-file", "", "Write metrics such as mirror throughput and failures to this file (Prometheus text format)")
+	rootCmd.PersistentFlags().StringVar(&errorJSONPath, "error-json", "", "Write a machine-readable error report to this file on failure")
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "output-format", cmp.Or(os.Getenv("BUILDER_OUTPUT_FORMAT"), outputText), "Print the result of the command as text, or as one JSON document on stdout with the logs on stderr (json), default $BUILDER_OUTPUT_FORMAT")
+	rootCmd.PersistentFlags().DurationVar(&heartbeatInterval, "heartbeat", 0, "Print a progress line after this long without output (e.g. 5m, 0 disables)")
+	rootCmd.PersistentFlags().StringSliceVar(&caCertFiles, "ca-cert", nil, "Additional CA certificate (PEM) to trust for network operations (default $BUILDER_CA_CERT)")
+	rootCmd.PersistentFlags().BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Disable TLS certificate verification (dangerous, for debugging proxies only)")
+	rootCmd.SilenceErrors = true
+	rootCmd.RegisterFlagCompletionFunc("config", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"yaml", "yml"}, cobra.ShellCompDirectiveFilterFileExt
+	})
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		// Flags and arguments are valid at this point; later errors are not usage errors
+		cmd.SilenceUsage = true
+		if err := setupOutput(cmd); err != nil {
+			return newError(errConfig, err)
+		}
+		currentCommand = cmd.CommandPath()
+		setPhase(cmd.Name())
+		startHeartbeat(cmd.Context(), heartbeatInterval)
+		if err := setupNetwork(); err != nil {
+			return newError(errConfig, err)
+		}
+		for c := cmd; c != nil; c = c.Parent() {
+			if c.Annotations[annotationNoConfig] != "" {
+				setupRedaction(&config{})
+				return nil
+			}
+		}
+		c, err := loadConfig(configFile, cmd.Flags().Changed("config"))
+		if err != nil {
+			return newError(errConfig, err)
+		}
+		// The profile overrides the file it is defined in: the configuration
+		// file, then the package configuration
+		found, err := applyProfile(c, profileName, configFile)
+		if err != nil {
+			return newError(errConfig, err)
+		}
+		if err := loadPackageConfig(c, packageConfigFile); err != nil {
+			return newError(errConfig, err)
+		}
+		foundPackage, err := applyProfile(c, profileName, packageConfigFile)
+		if err != nil {
+			return newError(errConfig, err)
+		}
+		if profileName != "" && !found && !foundPackage {
+			return errorf(errConfig, "unknown profile %q: define it under profiles in %s or %s", profileName, configFile, packageConfigFile)
+		}
+		cfg = c
+		setupRedaction(c)
+		return nil
+	}
 
 	// --- 'deps' command ---
+	var strictDeps, rankMirrorsFlag bool
+	var snapshotDate string
 	var depsCmd = &cobra.Command{
-		Use:   "deps",
-		Short: "Parses PKGBUILD and installs dependencies using paru.",
-		Run: func(cmd *cobra.Command, args []string) {
+		Use:         "deps",
+		Short:       "Parses PKGBUILD and installs dependencies using paru.",
+		Annotations: map[string]string{annotationJSONResult: "true"},
+		Long: `Parses PKGBUILD and installs dependencies using paru.
+
+With --snapshot-date (or pacman.snapshot_date) the mirrorlist points to the
+Arch Linux Archive of that day and the system is synced to it first, so
+historical releases are rebuilt against the package set of their time.`,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			log.Println("Installing PKGBUILD dependencies...")
 			info, err := parsePKGBUILD("PKGBUILD")
 			if err != nil {
-				log.Fatalf("Error: %v", err)
+				return errorf(errParse, "%w", err)
+			}
+			if err := checkArch(info); err != nil {
+				return err
+			}
+			if snapshotDate == "" {
+				snapshotDate = cfg.Pacman.SnapshotDate
+			}
+			plan := depsPlan{Depends: append([]string{}, info.Depends...), MakeDepends: append([]string{}, info.MakeDepends...), CheckDepends: append([]string{}, info.CheckDepends...), Install: []string{}, SnapshotDate: snapshotDate}
+			defer func() {
+				if err == nil && jsonOutput() {
+					err = printResult(plan)
+				}
+			}()
+			if snapshotDate != "" {
+				date, err := parseSnapshotDate(snapshotDate)
+				if err != nil {
+					return errorf(errConfig, "%w", err)
+				}
+				setPhase("sync snapshot")
+				if err := useSnapshot(cmd.Context(), date); err != nil {
+					return &builderError{Category: errDependency, Err: err, Hint: "The archive keeps daily snapshots since 2013-08-31. Old snapshots may need pacman-key --populate or an older archlinux-keyring."}
+				}
 			}
 
 			allDeps := append(info.Depends, info.MakeDepends...)
@@ -262,7 +366,7 @@ func main() {
 
 			if len(allDeps) == 0 {
 				log.Println("No dependencies found in PKGBUILD.")
-				return
+				return nil
 			}
 
 			log.Printf("Found dependencies: %v\n", allDeps)
@@ -283,10 +387,10 @@ func main() {
 				}
 			}
 
-			// Handle rust/rustup conflict
-			if hasRust || hasRustup {
+			// Handle rust/rustup conflict; pinned toolchains need rustup
+			if hasRust || hasRustup || cfg.Toolchain.Rust != "" {
 				// Check if rustup is already installed
-				if err := runCommand("which", "rustup"); err == nil {
+				if err := runCommand(cmd.Context(), "which", "rustup"); err == nil {
 					log.Println("rustup is already available, skipping rust package")
 					// Remove cargo from filtered deps if it exists since rustup includes it
 					newFilteredDeps := []string{}
@@ -305,149 +409,686 @@ func main() {
 
 			if len(filteredDeps) == 0 {
 				log.Println("All dependencies are already satisfied.")
-				return
+				return nil
+			}
+
+			rank := rankMirrorsFlag && snapshotDate == ""
+			if !rank && snapshotDate == "" && cfg.Pacman.RankMirrors != "" {
+				threshold, _ := parseRate(cfg.Pacman.RankMirrors)
+				if size, err := downloadSize(cmd.Context(), filteredDeps); err == nil && size > threshold {
+					log.Printf("Dependencies need %s of downloads", formatSize(size))
+					rank = true
+				}
+			}
+			if rank {
+				setPhase("rank mirrors")
+				if err := rankMirrors(cmd.Context()); err != nil {
+					log.Printf("Warning: could not rank mirrors: %v", err)
+				}
+				printMirrorHealth()
 			}
 
 			// Try paru first
+			setPhase("install dependencies")
+			if err := waitForPacmanLock(cmd.Context()); err != nil {
+				return err
+			}
+			plan.Install = filteredDeps
 			paruArgs := []string{"-S", "--noconfirm", "--needed", "--asdeps"}
 			paruArgs = append(paruArgs, filteredDeps...)
 
-			if err := runCommand("paru", paruArgs...); err != nil {
+			if err := runCommand(cmd.Context(), "paru", paruArgs...); err != nil {
 				log.Printf("Paru failed, trying with sudo pacman: %v", err)
 				// Try pacman with sudo
+				if err := waitForPacmanLock(cmd.Context()); err != nil {
+					return err
+				}
 				pacmanArgs := []string{"-S", "--noconfirm", "--needed", "--asdeps"}
 				pacmanArgs = append(pacmanArgs, filteredDeps...)
-				if err := runCommand("sudo", append([]string{"pacman"}, pacmanArgs...)...); err != nil {
+				if err := runCommand(cmd.Context(), "sudo", append([]string{"pacman"}, pacmanArgs...)...); err != nil {
+					if strictDeps {
+						return errorf(errDependency, "could not install dependencies: %w", err)
+					}
 					log.Printf("Warning: Some dependencies might not be available: %v", err)
+					plan.Incomplete = true
 				}
 			}
 			log.Println("Dependencies installation attempted!")
+			return nil
 		},
 	}
+	depsCmd.Flags().BoolVar(&strictDeps, "strict", false, "Fail when dependencies cannot be installed instead of only warning")
+	depsCmd.Flags().BoolVar(&rankMirrorsFlag, "rank-mirrors", false, "Rank the mirrorlist by measured throughput before installing (see pacman.rank_mirrors)")
+	depsCmd.Flags().StringVar(&snapshotDate, "snapshot-date", "", "Install dependencies from the Arch Linux Archive as of this YYYY-MM-DD date (see pacman.snapshot_date)")
+	depsCmd.MarkFlagsMutuallyExclusive("rank-mirrors", "snapshot-date")
 
 	// --- 'build' command ---
-	var cleanBuild bool
+	var cleanBuild, forceBuild, offlineBuild, auditBuild bool
 	var signPackage bool
+	var vendorDir, variant, march, buildDirSpec string
 	var buildCmd = &cobra.Command{
-		Use:   "build",
-		Short: "Builds the package using paru.",
-		Run: func(cmd *cobra.Command, args []string) {
+		Use:         "build",
+		Short:       "Builds the package using paru (or makepkg, see build.backend).",
+		Annotations: map[string]string{annotationJSONResult: "true"},
+		Long: `Builds the package in the current directory. When build.variants is configured,
+every variant is built in turn by a separate builder process, each recorded
+as its own build; --variant builds only one of them. --march (or build.march)
+optimizes for an x86_64 microarchitecture level through a generated
+makepkg.conf adding -march to CFLAGS and CXXFLAGS and target-cpu to RUSTFLAGS.
+--force rebuilds a version that was built already (makepkg -f, paru
+--rebuild), e.g. after a change of the packaging rules, replacing pkg/.
+With cache.builds, packages built from the same inputs and options are
+downloaded from cache.storage instead of built (unless --force), and
+successful builds are stored there. --offline-build fetches the sources
+and then runs makepkg in a network namespace of its own, failing builds that
+download in prepare(), build() or package(). --audit traces the build with
+strace and records the files it read or wrote outside of the package
+directory and the addresses it connected to, for the history and 'report'.
+--builddir tmpfs[:size] builds in a tmpfs when the build likely fits into it
+and into the available memory, and on disk otherwise. The versions of gcc, clang, rustc, go and python, the
+hash of makepkg.conf, the kernel and the container image ($CI_JOB_IMAGE, its
+digest from $BUILDER_IMAGE_DIGEST) are recorded in the history, the report
+and <pkgname>.buildenv. PKGDEST, SRCPKGDEST and LOGDEST, from the environment
+or makepkg.conf, are honored: the package's files there are found by 'build'
+and collected by 'artifacts'. build.backend chroot builds with
+makechrootpkg in a chroot of the pool managed by 'builder chroot'.`,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if info, err := parsePKGBUILD("PKGBUILD"); err == nil {
+				if err := checkArch(info); err != nil {
+					return err
+				}
+			}
+			if cfg.Package.Status != "" {
+				log.Printf("Warning: the package is quarantined (%s): %s", cfg.Package.Status, cmp.Or(cfg.Package.Reason, "no reason given"))
+			}
+			var v buildVariant
+			if variant != "" {
+				var ok bool
+				if v, ok = cfg.Build.Variants[variant]; !ok {
+					return errorf(errConfig, "unknown variant %q (build.variants: %s)", variant, strings.Join(slices.Sorted(maps.Keys(cfg.Build.Variants)), ", "))
+				}
+			} else if len(cfg.Build.Variants) > 0 {
+				return buildVariants(cmd, cleanBuild)
+			}
+			if march == "" {
+				march = v.March
+			}
+			if march == "" {
+				march = cfg.Build.March
+			}
+			if march == baselineMarch {
+				march = ""
+			}
+			if march != "" {
+				if !slices.Contains(marchLevels, march) {
+					return errorf(errConfig, "unknown --march %q (one of %s)", march, strings.Join(marchLevels, ", "))
+				}
+				if err := checkMarch(march); err != nil {
+					return err
+				}
+			}
 			if cleanBuild {
+				setPhase("clean")
 				log.Println("Cleaning previous builds...")
-				files, _ := filepath.Glob("*.pkg.tar.*")
-				for _, f := range files {
-					os.Remove(f)
-				}
-				for _, dir := range []string{"src", "pkg"} {
-					os.RemoveAll(dir)
+				cleanBuildState(cmd.Context())
+			} else if forceBuild {
+				// A previous package() may have left files the new one does not install
+				if _, err := removePaths(cmd.Context(), []string{"pkg"}, false); err != nil {
+					log.Printf("Warning: %v", err)
 				}
 			}
 
-			log.Println("Building package with paru...")
-			buildArgs := []string{"-B", "--noconfirm", "./"}
+			rec := startBuildRecord()
+			rec.Variant = variant
+			rec.March = march
+			previousPackages := packageModTimes(".")
+			var packageFiles []string
+			defer func() {
+				result := resultSuccess
+				switch {
+				case cmd.Context().Err() != nil:
+					result = resultCancelled
+					removePartialPackages(rec.StartedAt)
+				case err != nil:
+					result = resultFailed
+				}
+				finishBuildRecord(rec, result, packageFiles)
+				if result == resultFailed {
+					warnIfFlaky(rec)
+				}
+				if result == resultSuccess && jsonOutput() {
+					err = printResult(rec)
+				}
+			}()
+
+			if cfg.Build.Sign && !cmd.Flags().Changed("sign") {
+				signPackage = true
+			}
+			backend := cfg.Build.Backend
+			if backend == "" {
+				backend = "paru"
+			}
+			if backend == "chroot" && (variant != "" || march != "") {
+				return errorf(errConfig, "the chroot backend builds with the makepkg.conf of the chroot; variants and --march need the paru or makepkg backend")
+			}
+			if cfg.Build.Offline && !cmd.Flags().Changed("offline-build") {
+				offlineBuild = true
+			}
+			if cfg.Build.Audit && !cmd.Flags().Changed("audit") {
+				auditBuild = true
+			}
+			if buildDirSpec == "" {
+				buildDirSpec = cfg.Build.BuildDir
+			}
+			if _, _, err := parseBuildDir(buildDirSpec); err != nil {
+				return errorf(errConfig, "--builddir: %w", err)
+			}
+			if buildDirSpec != "" && backend == "chroot" {
+				return errorf(errConfig, "--builddir needs the paru or makepkg backend; makechrootpkg builds in the chroot")
+			}
+			if toolchainPinned() && backend == "chroot" {
+				return errorf(errConfig, "toolchain pins need the paru or makepkg backend; the chroot has its own toolchains")
+			}
+			if distccEnabled() && backend == "chroot" {
+				return errorf(errConfig, "build.distcc needs the paru or makepkg backend; the chroot builds with its own makepkg.conf")
+			}
+			if (offlineBuild || auditBuild) && backend == "chroot" {
+				return errorf(errConfig, "--offline-build and --audit need the paru or makepkg backend; makechrootpkg runs the build through sudo in a container of its own")
+			} else if offlineBuild || auditBuild {
+				// paru could not look up AUR packages without network, and
+				// sudo does not work under strace
+				backend = "makepkg"
+			}
+			setPhase(backend + " build")
 			if signPackage {
+				if err := prepareSigning(cmd.Context()); err != nil {
+					return err
+				}
+			}
+			if vendorDir == "" {
+				vendorDir = cfg.Fetch.VendorDir
+			}
+			if vendorDir != "" {
+				if err := primeVendoredSources(vendorDir); err != nil {
+					return errorf(errDependency, "%w", err)
+				}
+			}
+			buildArgs := []string{"-B", "--noconfirm", "./"}
+			if forceBuild {
+				// paru skips packages it considers built unless told otherwise
+				buildArgs = append(buildArgs, "--rebuild", "--mflags", "-f")
+			}
+			if backend == "makepkg" || backend == "chroot" {
+				// Dependencies are installed by 'builder deps', or by
+				// makechrootpkg in the chroot
+				buildArgs = []string{"--noconfirm"}
+				if forceBuild {
+					buildArgs = append(buildArgs, "--force")
+				}
+			}
+			tool := backend
+			if backend == "chroot" {
+				// The keys to sign with are outside of the chroot
+				tool = "makechrootpkg"
+				if len(cfg.Build.Env) > 0 {
+					log.Printf("Warning: build.env is not passed into the chroot")
+				}
+			} else if signPackage {
 				buildArgs = append(buildArgs, "--sign")
 			}
+			if cfg.Build.NoCheck {
+				buildArgs = append(buildArgs, "--nocheck")
+			}
+			if offlineBuild {
+				tool, buildArgs = offlineBuildCommand(buildArgs)
+			}
+			var traceFile string
+			if auditBuild {
+				if _, err := exec.LookPath("strace"); err != nil {
+					return errorf(errDependency, "--audit needs strace: %w", err)
+				}
+				f, err := os.CreateTemp("", "builder-strace-*.log")
+				if err != nil {
+					return errorf(errBuild, "%w", err)
+				}
+				f.Close()
+				traceFile = f.Name()
+				defer os.Remove(traceFile)
+				tool, buildArgs = "strace", append(append(slices.Clone(straceArgs), "-o", traceFile, "--", tool), buildArgs...)
+			}
+			if cfg.Build.Timeout > 0 {
+				if cfg.Timeouts == nil {
+					cfg.Timeouts = map[string]time.Duration{}
+				}
+				cfg.Timeouts[tool] = cfg.Build.Timeout
+			}
 
-			paruCmd := exec.Command("paru", buildArgs...)
-			paruCmd.Env = append(os.Environ(), "CCACHE_DIR=/home/builder/.ccache")
-			paruCmd.Stdout = os.Stdout
-			paruCmd.Stderr = os.Stderr
-			debugPrint("Running command: CCACHE_DIR=/home/builder/.ccache paru %s", strings.Join(buildArgs, " "))
+			buildEnv := []string{"CCACHE_DIR=/home/builder/.ccache"}
+			for _, name := range slices.Sorted(maps.Keys(cfg.Build.Env)) {
+				if _, ok := v.Env[name]; !ok {
+					buildEnv = append(buildEnv, name+"="+cfg.Build.Env[name])
+				}
+			}
+			if variant != "" {
+				buildEnv = append(buildEnv, "BUILDER_VARIANT="+variant)
+				for _, name := range slices.Sorted(maps.Keys(v.Env)) {
+					buildEnv = append(buildEnv, name+"="+v.Env[name])
+				}
+			}
+			// Pins are part of the cache key; the toolchains are prepared if built
+			buildEnv = append(buildEnv, toolchainEnv()...)
+			var cacheKey string
+			info, _ := parsePKGBUILD("PKGBUILD")
+			if st := buildCache(info); st != nil && rec.Fingerprint != "" {
+				cacheKey = buildCacheKey(rec.Fingerprint, variant, march, buildEnv[1:], signPackage)
+				if !forceBuild {
+					entry, files, err := fetchCachedBuild(cmd.Context(), st, cacheKey)
+					if err != nil {
+						log.Printf("Warning: could not use the build cache: %v", err)
+					} else if entry != nil {
+						// The packages passed the checks of the build that made them
+						packageFiles = files
+						rec.CachedFrom = cacheKey
+						rec.Sizes = packageSizes(packageFiles)
+						rec.Depends = packageDepends(packageFiles)
+						log.Printf("Using %d cached package(s) of %s %s built at %s instead of building: %v",
+							len(files), entry.Report.Package, entry.Report.Version, entry.Report.StartedAt.Local().Format(time.DateTime), files)
+						return nil
+					}
+					debugPrint("Build %.12s is not cached in %s", cacheKey, st)
+				}
+			}
+			log.Printf("Building package with %s...", backend)
+			if toolchainPinned() {
+				setPhase("toolchains")
+				env, versions, err := prepareToolchains(cmd.Context())
+				if err != nil {
+					return err
+				}
+				rec.Toolchains = versions
+				buildEnv = append(buildEnv, env...)
+				setPhase(backend + " build")
+			}
+			if march != "" {
+				conf, err := marchMakepkgConf(march)
+				if err != nil {
+					return errorf(errBuild, "%w", err)
+				}
+				defer os.Remove(conf)
+				log.Printf("Optimizing for %s", march)
+				buildEnv = append(buildEnv, "MAKEPKG_CONF="+conf, "BUILDER_MARCH="+march)
+				buildEnv = append(buildEnv, marchEnv(march)...)
+			}
+			if cfg.Build.Compression != "" {
+				buildEnv = append(buildEnv, "PKGEXT="+pkgext(cfg.Build.Compression))
+			}
+			if cfg.Build.SignKey != "" {
+				// makepkg, also when run by paru, signs with $GPGKEY
+				buildEnv = append(buildEnv, "GPGKEY="+cfg.Build.SignKey)
+			}
+			if backend := sccacheBackend(); backend != "" {
+				env, err := startSccache(cmd.Context(), backend)
+				if err != nil {
+					return err
+				}
+				if env != nil {
+					defer func() {
+						if rec.Cache = stopSccache(context.WithoutCancel(cmd.Context()), backend); rec.Cache != nil {
+							log.Printf("Compiler cache: %s", rec.Cache)
+						}
+					}()
+					buildEnv = append(buildEnv, env...)
+				}
+			}
+			var distccLog string
+			if distccEnabled() && offlineBuild {
+				log.Printf("Warning: offline builds cannot reach the build.distcc hosts; compiling locally")
+			} else if distccEnabled() {
+				base := os.Getenv("MAKEPKG_CONF")
+				if base == "" {
+					base = "/etc/makepkg.conf"
+				}
+				for _, e := range buildEnv {
+					if conf, ok := strings.CutPrefix(e, "MAKEPKG_CONF="); ok {
+						base = conf
+					}
+				}
+				env, logFile, err := startDistcc(cmd.Context(), base)
+				if err != nil {
+					return errorf(errBuild, "%w", err)
+				}
+				if env != nil {
+					conf := strings.TrimPrefix(env[0], "MAKEPKG_CONF=")
+					defer os.Remove(conf)
+					defer os.Remove(logFile)
+					distccLog = logFile
+					buildEnv = append(buildEnv, env...)
+				}
+			}
+			var tmpfsDir string
+			if buildDirSpec != "" {
+				setPhase("build directory")
+				prev := lastSuccessfulBuild(rec.Package, func(r *buildRecord) bool { return r.Variant == variant && r.March == march })
+				dir, cleanup, err := setupBuildDir(cmd.Context(), buildDirSpec, info, prev)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				if dir != "" {
+					buildEnv = append(buildEnv, "BUILDDIR="+dir)
+					if tmpfs, _, _ := parseBuildDir(buildDirSpec); tmpfs {
+						tmpfsDir = dir
+					}
+				}
+				setPhase(backend + " build")
+			}
+			if backend == "chroot" {
+				slot, lock, err := acquireChroot(cmd.Context())
+				if err != nil {
+					return err
+				}
+				defer lock.unlock()
+				var overlay string
+				if cfg.Chroot.Overlay {
+					name, unmount, err := mountOverlay(cmd.Context(), slot)
+					if err != nil {
+						return err
+					}
+					defer unmount()
+					overlay = name
+				}
+				setPhase(backend + " build")
+				tool, buildArgs = chrootBuildCommand(slot, overlay, buildArgs)
+			}
+			if offlineBuild {
+				setPhase("fetch sources")
+				if err := fetchBuildSources(cmd.Context(), buildEnv); err != nil {
+					return err
+				}
+				setPhase(backend + " build")
+				log.Println("Building without network...")
+			}
+			rec.Environment = captureEnvironment(cmd.Context(), buildEnv)
+			if err := writeBuildEnv(buildEnvName(rec.Package), rec.Environment, rec.StartedAt); err != nil {
+				log.Printf("Warning: could not write %s: %v", buildEnvName(rec.Package), err)
+			}
+			paruCmd := newCommand(cmd.Context(), tool, buildArgs...)
+			paruCmd.Env = append(os.Environ(), buildEnv...)
+			debugPrint("Running command: %s %s %s", strings.Join(buildEnv, " "), tool, strings.Join(buildArgs, " "))
 			if !debugMode {
-				fmt.Printf("+ Running command: CCACHE_DIR=/home/builder/.ccache paru %s\n", strings.Join(buildArgs, " "))
+				fmt.Print(maskSecrets(fmt.Sprintf("+ Running command: %s %s %s\n", strings.Join(buildEnv, " "), tool, strings.Join(buildArgs, " "))))
 			}
 
-			if err := paruCmd.Run(); err != nil {
-				log.Fatalf("Package build failed: %v", err)
+			// Capture the build output for the log analysis and the artifacts
+			buildLog, lerr := os.Create(buildLogFile)
+			if lerr != nil {
+				log.Printf("Warning: could not create %s: %v", buildLogFile, lerr)
+			} else {
+				defer buildLog.Close()
+				paruCmd.Stdout = io.MultiWriter(paruCmd.Stdout, paruCmd.redacting(buildLog))
+				paruCmd.Stderr = io.MultiWriter(paruCmd.Stderr, paruCmd.redacting(buildLog))
 			}
 
+			runErr := paruCmd.Run()
+			if tmpfsDir != "" {
+				rec.BuildDirUsed = usedSpace(tmpfsDir)
+			}
+			if distccLog != "" {
+				if stats, err := readDistributedStats(distccLog); err != nil {
+					log.Printf("Warning: could not read the job distribution: %v", err)
+				} else {
+					rec.Distributed = stats
+					log.Printf("Distributed compilation: %s", stats)
+				}
+			}
+			if traceFile != "" {
+				wd, _ := os.Getwd()
+				if audit, err := parseStraceLog(traceFile, wd); err != nil {
+					log.Printf("Warning: could not read the build audit: %v", err)
+				} else {
+					rec.Audit = audit
+					printAudit(audit)
+				}
+			}
+			var analysis *logAnalysis
+			if buildLog != nil {
+				if analysis, lerr = analyzeLogFile(buildLogFile); lerr == nil {
+					rec.Analysis = analysis
+					printAnalysis(analysis)
+				}
+			}
+			if runErr != nil && offlineBuild && cmd.Context().Err() == nil {
+				if data, err := os.ReadFile(buildLogFile); err == nil {
+					if be := offlineNetworkError(string(data), runErr); be != nil {
+						return be
+					}
+				}
+			}
+			if runErr != nil && tmpfsDir != "" {
+				if data, err := os.ReadFile(buildLogFile); err == nil && strings.Contains(string(data), "No space left on device") {
+					return &builderError{
+						Category: errBuild,
+						Err:      fmt.Errorf("package build failed: the tmpfs build directory ran full: %w", runErr),
+						Hint:     "Give the tmpfs more space with --builddir tmpfs:<size>, or build on disk without --builddir.",
+					}
+				}
+			}
+			if runErr != nil {
+				be := newError(errBuild, fmt.Errorf("package build failed: %w", runErr))
+				if analysis != nil && analysis.ProbableCause() != "" {
+					be.Hint = analysis.ProbableCause() + "\n" + categoryInfo[errBuild].hint
+				}
+				return be
+			}
+
+			setPhase("collect packages")
 			log.Println("Build completed successfully!")
-			packageFiles, err := filepath.Glob("*.pkg.tar.*")
-			if err != nil {
-				log.Fatalf("Failed to search for package files: %v", err)
+			packageFiles = builtPackages(".")
+			if variant != "" || makepkgDestDir(".", makepkgPKGDEST) != "" {
+				// The packages of the variants built before stay in place, as
+				// do those of other packages in a shared PKGDEST
+				packageFiles = changedPackages(".", previousPackages)
 			}
 			if len(packageFiles) == 0 {
-				log.Fatalf(`No package file (*.pkg.tar.*) was generated by paru.
-
-This usually means:
-• The build was skipped (e.g. due to existing src/ or pkg/ directories)
-• The PKGBUILD has a conditional 'exit 0'
-• paru failed silently (check logs above)
-• Dynamic pkgver/pkgrel caused unexpected naming
-
-Please review the build output carefully for warnings or skipped steps.
-`)
+				cause := diagnoseNoPackages(backend, rec.Version, rec.StartedAt)
+				return &builderError{
+					Category: errBuild,
+					Err:      fmt.Errorf("no package file (*.pkg.tar.*) was generated by %s: %s", backend, cause.Detail),
+					Hint:     cause.Suggestion,
+					Reason:   cause.Reason,
+				}
 			}
 
+			if backend == "chroot" && signPackage {
+				for _, file := range packageFiles {
+					if strings.HasSuffix(file, ".sig") {
+						continue
+					}
+					if err := signFile(cmd.Context(), file, cfg.Build.SignKey); err != nil {
+						return err
+					}
+					if !slices.Contains(packageFiles, file+".sig") {
+						packageFiles = append(packageFiles, file+".sig")
+					}
+				}
+			}
 			sort.Strings(packageFiles)
 
 			log.Printf("Successfully built %d package(s): %v", len(packageFiles), packageFiles)
+			rec.Sizes = packageSizes(packageFiles)
+			rec.Depends = packageDepends(packageFiles)
+			if prev := lastSuccessfulBuild(rec.Package, func(r *buildRecord) bool { return r.Variant == variant && r.March == march && r.Depends != nil }); prev != nil {
+				reportDependencyChanges(rec.Depends, prev.Depends, "the last build of "+prev.Version)
+			}
+			if pool := footprintPool(); len(pool) > 0 {
+				rec.Footprint = dependencyFootprints(packageFiles, pool)
+				var previous map[string]*dependencyFootprint
+				against := ""
+				if prev := lastSuccessfulBuild(rec.Package, func(r *buildRecord) bool { return r.Variant == variant && r.March == march && r.Footprint != nil }); prev != nil {
+					previous, against = prev.Footprint, "the last build of "+prev.Version
+				}
+				reportFootprints(rec.Footprint, previous, against)
+			}
+			if prev := lastSuccessfulBuild(rec.Package, func(r *buildRecord) bool { return r.Variant == variant && r.March == march && len(r.Sizes) > 0 }); prev != nil {
+				if err := checkSizeGrowth(rec.Sizes, prev.Sizes, "the last build of "+prev.Version); err != nil {
+					return err
+				}
+			}
+
+			if err := checkPackages(packageFiles); err != nil {
+				return err
+			}
+			if err := checkHardening(packageFiles); err != nil {
+				return err
+			}
+			if err := checkKernelPackages(cmd.Context(), packageFiles); err != nil {
+				return err
+			}
+			if cfg.Audit.OnBuild {
+				if _, err := auditPackage(cmd.Context(), ".", langDepsSBOMName(rec.Package), false); err != nil {
+					log.Printf("Warning: could not audit the vendored dependencies: %v", err)
+				}
+			}
+
+			if cfg.Debuginfod.URL != "" {
+				setPhase("debug symbols")
+				ids, kept, err := publishDebugInfo(cmd.Context(), packageFiles)
+				if err != nil {
+					return err
+				}
+				if len(ids) > 0 {
+					rec.BuildIDs = ids
+					packageFiles = kept
+					if err := writeJSONAtomic(buildIDsName(rec.Package), ids); err != nil {
+						log.Printf("Warning: could not write %s: %v", buildIDsName(rec.Package), err)
+					}
+				}
+			}
+
+			if cacheKey != "" {
+				if err := storeCachedBuild(cmd.Context(), sharedCache(), cacheKey, rec, packageFiles); err != nil {
+					log.Printf("Warning: could not cache the build: %v", err)
+				}
+			}
 
 			lsArgs := append([]string{"-la"}, packageFiles...)
-			if err := runCommand("ls", lsArgs...); err != nil {
+			if err := runCommand(cmd.Context(), "ls", lsArgs...); err != nil {
 				log.Printf("Warning: could not run 'ls' on generated packages: %v", err)
 			}
+			return nil
 		},
 	}
 	buildCmd.Flags().BoolVar(&cleanBuild, "clean", false, "Clean previous build artifacts and directories before building")
+	buildCmd.Flags().BoolVarP(&forceBuild, "force", "f", false, "Rebuild even if this version was built already, replacing its packages and pkg/")
+	buildCmd.Flags().BoolVar(&offlineBuild, "offline-build", false, "Fetch the sources first, then build with makepkg without network (see build.offline)")
+	buildCmd.Flags().BoolVar(&auditBuild, "audit", false, "Record the files outside the package directory and the network addresses the build used, with strace (see build.audit)")
+	buildCmd.Flags().StringVar(&buildDirSpec, "builddir", "", "Build in tmpfs, tmpfs:<size> (e.g. tmpfs:8G) when the build fits into memory, or in this directory (see build.builddir)")
 	buildCmd.Flags().BoolVar(&signPackage, "sign", false, "Sign the package using GPG")
+	buildCmd.Flags().StringVar(&vendorDir, "vendor-dir", "", "Prefer sources from this mirror created by 'sources vendor'")
+	buildCmd.Flags().StringVar(&variant, "variant", "", "Build only this variant of build.variants")
+	buildCmd.Flags().StringVar(&march, "march", "", "x86_64 microarchitecture level to optimize for, e.g. x86-64-v3 (default build.march)")
+	buildCmd.RegisterFlagCompletionFunc("march", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return marchLevels, cobra.ShellCompDirectiveNoFileComp
+	})
+	buildCmd.RegisterFlagCompletionFunc("variant", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return slices.Sorted(maps.Keys(cfg.Build.Variants)), cobra.ShellCompDirectiveNoFileComp
+	})
 
 	// --- 'artifacts' command ---
 	var artifactsDir string
+	var artifactJobs int
 	var artifactsCmd = &cobra.Command{
-		Use:   "artifacts",
-		Short: "Collects build artifacts (packages, logs, etc.).",
-		Run: func(cmd *cobra.Command, args []string) {
+		Use:         "artifacts",
+		Short:       "Collects build artifacts (packages, logs, etc.).",
+		Annotations: map[string]string{annotationJSONResult: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
 			log.Printf("Collecting build artifacts into directory: %s\n", artifactsDir)
+			result := artifactsResult{Dir: artifactsDir, Files: []string{}, Packages: []string{}}
 			if err := os.MkdirAll(artifactsDir, 0755); err != nil {
-				log.Fatalf("Could not create artifacts directory: %v", err)
+				return errorf(errArtifact, "could not create artifacts directory: %w", err)
 			}
 
-			foundPackages := false
-			patterns := []string{"*.pkg.tar.*", "*.log", "PKGBUILD", ".SRCINFO"}
-			for _, pattern := range patterns {
-				files, _ := filepath.Glob(pattern)
-				for _, f := range files {
-					dest := filepath.Join(artifactsDir, filepath.Base(f))
-
-					if filepath.Base(f) == "PKGBUILD" {
-						if err := copyFile(f, dest); err != nil {
-							log.Printf("Warning: could not copy artifact %s: %v", f, err)
-						} else {
-							log.Printf("  Copied: %s", dest)
-						}
+			var files []string
+			for _, pattern := range []string{"*.pkg.tar.*", "*.log", "PKGBUILD", ".SRCINFO", "*.deps.cdx.json", "*.buildids.json", "*.buildenv"} {
+				matches, _ := filepath.Glob(pattern)
+				files = append(files, matches...)
+			}
+			// makepkg writes to PKGDEST, SRCPKGDEST and LOGDEST when set
+			files = append(files, destOutputs(".", "*.pkg.tar.*", makepkgPKGDEST)...)
+			files = append(files, destOutputs(".", "*.src.tar.*", makepkgSRCPKGDEST)...)
+			files = append(files, destOutputs(".", "*.log", makepkgLOGDEST)...)
+
+			// Large packages are moved (or copied across filesystems) concurrently
+			var mu sync.Mutex
+			var packages []string
+			runParallel(artifactJobs, files, func(f string) error {
+				dest := filepath.Join(artifactsDir, filepath.Base(f))
+				if filepath.Base(f) == "PKGBUILD" {
+					if err := copyFile(f, dest); err != nil {
+						log.Printf("Warning: could not copy artifact %s: %v", f, err)
 					} else {
-						if err := os.Rename(f, dest); err != nil {
-							log.Printf("Warning: could not move artifact %s: %v", f, err)
-						} else {
-							log.Printf("  Collected: %s", dest)
-							if strings.Contains(pattern, ".pkg.tar.") {
-								foundPackages = true
-							}
-						}
+						log.Printf("  Copied: %s", dest)
+						mu.Lock()
+						result.Files = append(result.Files, dest)
+						mu.Unlock()
 					}
+					return nil
+				}
+				if err := moveFile(f, dest); err != nil {
+					log.Printf("Warning: could not move artifact %s: %v", f, err)
+					return nil
+				}
+				log.Printf("  Collected: %s", dest)
+				mu.Lock()
+				defer mu.Unlock()
+				result.Files = append(result.Files, dest)
+				if strings.Contains(f, ".pkg.tar.") && !strings.HasSuffix(f, ".sig") {
+					packages = append(packages, dest)
+				}
+				return nil
+			})
+			foundPackages := len(packages) > 0
+
+			if foundPackages {
+				var names []string
+				for _, p := range packages {
+					names = append(names, filepath.Base(p))
+				}
+				if err := writeVendorSums(artifactsDir, names); err != nil {
+					log.Printf("Warning: could not write %s: %v", vendorSumsFile, err)
+				} else {
+					result.Checksums = filepath.Join(artifactsDir, vendorSumsFile)
+					log.Printf("  Checksums: %s", result.Checksums)
 				}
 			}
 
 			if !foundPackages {
-				log.Fatalf("Error: No package files (*.pkg.tar.*) were found to collect.")
+				return errorf(errArtifact, "no package files (*.pkg.tar.*) were found to collect")
 			}
 			log.Println("Artifacts collected successfully.")
+			if jsonOutput() {
+				sort.Strings(result.Files)
+				result.Packages = packages
+				sort.Strings(result.Packages)
+				return printResult(result)
+			}
+			return nil
 		},
 	}
 	artifactsCmd.Flags().StringVarP(&artifactsDir, "output-dir", "o", "artifacts", "The directory to place artifacts in")
+	artifactsCmd.Flags().IntVarP(&artifactJobs, "jobs", "j", defaultJobs, "Number of artifacts to move and hash concurrently")
 
 	// --- 'version' command ---
 	var versionFile string
 	var versionCmd = &cobra.Command{
-		Use:   "version",
-		Short: "Generates a .env file with version information for GitLab CI.",
-		Run: func(cmd *cobra.Command, args []string) {
+		Use:         "version",
+		Short:       "Generates a .env file with version information for GitLab CI.",
+		Annotations: map[string]string{annotationJSONResult: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
 			log.Printf("Generating version info file at %s\n", versionFile)
 			info, err := parsePKGBUILD("PKGBUILD")
 			if err != nil {
-				log.Fatalf("Error: %v", err)
+				return errorf(errParse, "%w", err)
 			}
 
 			ciCommitTag := os.Getenv("CI_COMMIT_TAG")
@@ -459,29 +1100,64 @@ Please review the build output carefully for warnings or skipped steps.
 				ciJobID = "local"
 			}
 
+			v := versionInfo{
+				Version:     info.PkgVer,
+				PkgRelease:  info.PkgRel,
+				FullVersion: info.PkgVer + "-" + info.PkgRel,
+				PackageName: info.PkgName,
+				TagVersion:  ciCommitTag,
+				BuildJobID:  ciJobID,
+				BuildDate:   time.Now().UTC().Format(time.RFC3339),
+				Arch:        info.Arch,
+				File:        versionFile,
+			}
 			content := fmt.Sprintf(
-				"VERSION=%s\nPKG_RELEASE=%s\nFULL_VERSION=%s-%s\nPACKAGE_NAME=%s\nTAG_VERSION=%s\nBUILD_JOB_ID=%s\nBUILD_DATE=%s\nARCH=\"%s\"\n",
-				info.PkgVer,
-				info.PkgRel,
-				info.PkgVer, info.PkgRel,
-				info.PkgName,
-				ciCommitTag,
-				ciJobID,
-				time.Now().UTC().Format(time.RFC3339),
-				strings.Join(info.Arch, " "),
+				"VERSION=%s\nPKG_RELEASE=%s\nFULL_VERSION=%s\nPACKAGE_NAME=%s\nTAG_VERSION=%s\nBUILD_JOB_ID=%s\nBUILD_DATE=%s\nARCH=\"%s\"\n",
+				v.Version,
+				v.PkgRelease,
+				v.FullVersion,
+				v.PackageName,
+				v.TagVersion,
+				v.BuildJobID,
+				v.BuildDate,
+				strings.Join(v.Arch, " "),
 			)
 
+			if cfg.Build.March != "" && cfg.Build.March != baselineMarch {
+				v.March = cfg.Build.March
+				content += "MARCH=" + v.March + "\n"
+			}
+
 			if err := os.WriteFile(versionFile, []byte(content), 0644); err != nil {
-				log.Fatalf("Failed to write version file: %v", err)
+				return errorf(errArtifact, "failed to write version file: %w", err)
 			}
 			log.Println("Version info generated successfully:")
+			if jsonOutput() {
+				return printResult(v)
+			}
 			fmt.Println(content)
+			return nil
 		},
 	}
 	versionCmd.Flags().StringVarP(&versionFile, "output-file", "o", "version.env", "The .env file to generate")
 
-	rootCmd.AddCommand(depsCmd, buildCmd, artifactsCmd, versionCmd)
-	if err := rootCmd.Execute(); err != nil {
-		os.Exit(1)
+	rootCmd.AddCommand(depsCmd, buildCmd, artifactsCmd, versionCmd, newSonamesCmd(), newRepoCmd(), newKeyringCmd(), newCleanCmd(), newHistoryCmd(), newTuiCmd(), newDocsCmd(), newConfigCmd(), newSecretsCmd(), newFetchCmd(), newSourcesCmd(), newAnalyzeCmd(), newBisectCmd(), newPromoteCmd(), newReportCmd(), newVerifySourcesCmd(), newRebuildListCmd(), newGeneratePipelineCmd(), newImageCmd(), newComposeCmd(), newCheckSrcinfoCmd(), newServeCmd(), newWorkerCmd(), newSubmitCmd(), newBumpCmd(), newOutdatedCmd(), newPublishCmd(), newBundleCmd(), newAuditCmd(), newLintCmd(), newPipelineCmd(), newChrootCmd(), newReleaseCmd(), newStatusCmd(), newBuildWorkspaceCmd())
+
+	ctx, stop := signalContext()
+	err := rootCmd.ExecuteContext(ctx)
+	cancelled := ctx.Err() != nil
+	stop()
+	cleanupNetwork()
+	closeSharedCache()
+	writeMetrics()
+	if err != nil {
+		if cancelled {
+			err = newError(errCancelled, fmt.Errorf("cancelled: %w", err))
+		}
+		// Errors returned by cobra itself are flag and argument errors
+		exitWithError(err, errConfig)
+	}
+	if jsonOutput() && currentCommand != "" {
+		printResult(commandResult{Command: currentCommand, OK: true})
 	}
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// maintainersFile lists the maintainers of the package in its directory,
+// one per line: a GitLab @username or Name <email>.
+const maintainersFile = "MAINTAINERS"
+
+// codeownersPaths are where GitLab and GitHub look for CODEOWNERS, relative
+// to the root of the repository.
+var codeownersPaths = []string{"CODEOWNERS", ".gitlab/CODEOWNERS", ".github/CODEOWNERS", "docs/CODEOWNERS"}
+
+// reMaintainerComment matches the maintainer comments of PKGBUILDs, e.g.
+// "# Maintainer: Jane Doe <jane@example.com>"
+var reMaintainerComment = regexp.MustCompile(`(?m)^#\s*Maintainer:\s*(.+?)\s*$`)
+
+// packageMaintainers returns the maintainers of the package in dir: those
+// of its MAINTAINERS file, else the owners of its PKGBUILD in the CODEOWNERS
+// of the repository, else the Maintainer comments of the PKGBUILD.
+func packageMaintainers(dir string) []string {
+	if owners := readMaintainersFile(filepath.Join(dir, maintainersFile)); len(owners) > 0 {
+		return owners
+	}
+	if root, codeowners, ok := findCodeowners(dir); ok {
+		abs, _ := filepath.Abs(dir)
+		if rel, err := filepath.Rel(root, filepath.Join(abs, "PKGBUILD")); err == nil {
+			if owners := codeownersFor(codeowners, filepath.ToSlash(rel)); len(owners) > 0 {
+				return owners
+			}
+		}
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "PKGBUILD"))
+	if err != nil {
+		return nil
+	}
+	var owners []string
+	for _, m := range reMaintainerComment.FindAllSubmatch(content, -1) {
+		owners = append(owners, string(m[1]))
+	}
+	return owners
+}
+
+// readMaintainersFile reads a MAINTAINERS file, skipping comments.
+func readMaintainersFile(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var owners []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			owners = append(owners, line)
+		}
+	}
+	return owners
+}
+
+// findCodeowners looks for the CODEOWNERS of the repository dir is in: the
+// first directory from dir upwards with a CODEOWNERS file or a .git. It
+// returns the root of the repository and the CODEOWNERS file.
+func findCodeowners(dir string) (root, codeowners string, ok bool) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", false
+	}
+	for d := abs; ; d = filepath.Dir(d) {
+		for _, p := range codeownersPaths {
+			if _, err := os.Stat(filepath.Join(d, p)); err == nil {
+				return d, filepath.Join(d, p), true
+			}
+		}
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil || d == filepath.Dir(d) {
+			return "", "", false
+		}
+	}
+}
+
+// codeownersFor returns the owners of a path of the repository by a
+// CODEOWNERS file: those of the last rule matching it, as GitLab and GitHub
+// apply them. GitLab sections are read as one list of rules.
+func codeownersFor(codeowners, path string) []string {
+	f, err := os.Open(codeowners)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var owners []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == '[' || line[0] == '^' {
+			continue
+		}
+		fields := strings.Fields(line)
+		var rule []string
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "#") {
+				break
+			}
+			rule = append(rule, field)
+		}
+		if codeownersMatch(fields[0], path) {
+			owners = rule
+		}
+	}
+	return owners
+}
+
+// codeownersMatch reports whether a CODEOWNERS pattern, with the syntax of
+// gitignore, matches a file or one of the directories it is in.
+func codeownersMatch(pattern, path string) bool {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	// Patterns with a slash are relative to the root, others match at any depth
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	var re strings.Builder
+	if !anchored {
+		re.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if dirOnly {
+		re.WriteString("/.*")
+	} else {
+		re.WriteString("(/.*)?")
+	}
+	ok, _ := regexp.MatchString("^(?:"+re.String()+")$", path)
+	return ok
+}
+
+// gitlabUsernames returns the GitLab usernames among maintainers, which are
+// given as @username; groups (@group/subgroup) and emails are left out.
+func gitlabUsernames(maintainers []string) []string {
+	var names []string
+	for _, m := range maintainers {
+		if name, ok := strings.CutPrefix(m, "@"); ok && !strings.Contains(name, "/") && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// assignReviewers makes the maintainers with a GitLab user the reviewers of
+// a merge request, keeping its other reviewers. It returns the usernames
+// assigned.
+func (c *gitlabClient) assignReviewers(ctx context.Context, mr string, maintainers []string) ([]string, error) {
+	var current struct {
+		Reviewers []struct {
+			ID int64 `json:"id"`
+		} `json:"reviewers"`
+	}
+	if _, err := c.do(ctx, http.MethodGet, "/merge_requests/"+mr, nil, &current); err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, r := range current.Reviewers {
+		ids = append(ids, r.ID)
+	}
+	var assigned []string
+	for _, name := range gitlabUsernames(maintainers) {
+		var users []struct {
+			ID int64 `json:"id"`
+		}
+		if _, err := c.request(ctx, http.MethodGet, "/users?username="+url.QueryEscape(name), nil, &users); err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			// e.g. a group without subgroups
+			debugPrint("No GitLab user %s", name)
+			continue
+		}
+		if !slices.Contains(ids, users[0].ID) {
+			ids = append(ids, users[0].ID)
+		}
+		assigned = append(assigned, name)
+	}
+	if len(assigned) == 0 {
+		return nil, nil
+	}
+	_, err := c.do(ctx, http.MethodPut, "/merge_requests/"+mr, map[string]any{"reviewer_ids": ids}, nil)
+	return assigned, err
+}
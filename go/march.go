@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// baselineMarch is the microarchitecture level of the official x86_64 packages.
+const baselineMarch = "x86-64"
+
+// marchLevels are the x86_64 microarchitecture levels packages can be built for.
+var marchLevels = []string{"x86-64", "x86-64-v2", "x86-64-v3", "x86-64-v4"}
+
+// marchMakepkgConf writes a makepkg.conf that loads the system configuration
+// and then targets march, and returns its path. The compilers use the last
+// -march and target-cpu given, so appending overrides the distribution flags.
+func marchMakepkgConf(march string) (string, error) {
+	base := os.Getenv("MAKEPKG_CONF")
+	if base == "" {
+		base = "/etc/makepkg.conf"
+	}
+	conf := fmt.Sprintf(`# Generated by builder for --march %[1]s
+source %[2]q
+# makepkg only reads the drop-in directory of the file it was given
+for conf in %[2]q.d/*.conf; do
+  [[ -f $conf ]] && source "$conf"
+done
+CFLAGS+=" -march=%[1]s -mtune=generic"
+CXXFLAGS+=" -march=%[1]s -mtune=generic"
+RUSTFLAGS+=" -C target-cpu=%[1]s"
+`, march, base)
+	f, err := os.CreateTemp("", "builder-makepkg-*.conf")
+	if err != nil {
+		return "", fmt.Errorf("could not create makepkg.conf for %s: %w", march, err)
+	}
+	_, err = f.WriteString(conf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("could not write makepkg.conf for %s: %w", march, err)
+	}
+	return f.Name(), nil
+}
+
+// marchEnv returns the environment selecting march for toolchains that do
+// not read makepkg.conf, such as Go's GOAMD64.
+func marchEnv(march string) []string {
+	if level, ok := strings.CutPrefix(march, "x86-64-"); ok {
+		return []string{"GOAMD64=" + level}
+	}
+	return nil
+}
+
+// isaSuffix returns the suffix of the repositories holding packages
+// optimized for march, e.g. -v3 for x86-64-v3.
+func isaSuffix(march string) string {
+	return "-" + strings.TrimPrefix(march, "x86-64-")
+}
+
+// optimizedDBPath returns the database of the repository holding the march
+// optimized packages of the channel or database arg: the channel
+// <channel>-v3 when configured, otherwise the database of arg with its
+// repository name suffixed in the directory and file names, e.g.
+// /srv/prism-v3/os/$arch/prism-v3.db.tar.gz for /srv/prism/os/$arch/prism.db.tar.gz.
+func optimizedDBPath(arg, march string) string {
+	suffix := isaSuffix(march)
+	if path, ok := cfg.Repo.Channels[arg+suffix]; ok {
+		return path
+	}
+	dbPath := repoDBPath(arg)
+	name := repoName(dbPath)
+	dir, base := filepath.Split(dbPath)
+	parts := strings.Split(filepath.Clean(dir), string(filepath.Separator))
+	renamed := false
+	for i, part := range parts {
+		if part == name {
+			parts[i], renamed = name+suffix, true
+		}
+	}
+	dir = strings.Join(parts, string(filepath.Separator))
+	if !renamed {
+		// The package files have the same names as the baseline ones
+		dir = filepath.Join(dir, name+suffix)
+	}
+	return filepath.Join(dir, name+suffix+strings.TrimPrefix(base, name))
+}
+
+// warnBaselineMismatch warns about optimized packages whose version differs
+// from the one in the baseline repository, as clients use whichever
+// repository comes first.
+func warnBaselineMismatch(baseline string, entries []*repodb.Entry) {
+	db, err := repodb.Read(baseline)
+	if err != nil {
+		log.Printf("Warning: could not read the baseline repository: %v", err)
+		return
+	}
+	for _, e := range entries {
+		if b, ok := db.Entries[e.Name]; !ok {
+			log.Printf("Warning: %s is not in the baseline repository %s", e.Name, baseline)
+		} else if b.Version != e.Version {
+			log.Printf("Warning: %s %s differs from %s in the baseline repository %s", e.Name, e.Version, b.Version, baseline)
+		}
+	}
+}
+
+// pruneOptimized removes the packages of the optimized database dbPath that
+// are older than the baseline entries just published, so a stale optimized
+// build never shadows a newer baseline one. It reports whether the database
+// changed.
+func pruneOptimized(ctx context.Context, dbPath string, entries []*repodb.Entry, sign bool, key string) (bool, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return false, nil
+	}
+	lock, err := lockRepoDB(ctx, dbPath)
+	if err != nil {
+		return false, err
+	}
+	defer lock.unlock()
+	db, err := repodb.Read(dbPath)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for _, e := range entries {
+		if old, ok := db.Entries[e.Name]; ok && repodb.VerCmp(old.Version, e.Version) < 0 {
+			db.Remove(e.Name)
+			removePackageFile(dbPath, old)
+			log.Printf("  Removed stale: %s %s from %s (baseline now %s)", old.Name, old.Version, repoName(dbPath), e.Version)
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	if err := writeRepoDB(ctx, db, dbPath, sign, key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkMarch reports whether march can be built for on this machine.
+func checkMarch(march string) error {
+	if arch := carch(); arch != "x86_64" {
+		return errorf(errUnsupportedArch, "--march %s needs an x86_64 host, not %s", march, arch)
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	mirrorlistPath = "/etc/pacman.d/mirrorlist"
+	// rankedMirrors is the number of mirrors a ranked mirrorlist keeps
+	rankedMirrors = 5
+	// mirrorProbes is the maximum number of mirrors probed when ranking
+	mirrorProbes       = 20
+	mirrorProbeTimeout = 10 * time.Second
+	// archiveReposURL holds the daily repository snapshots of the Arch
+	// Linux Archive
+	archiveReposURL = "https://archive.archlinux.org/repos"
+)
+
+// metricsFile is where the metrics of the run are written, see writeMetrics.
+var metricsFile string
+
+// mirrorStat accumulates the transfers from one mirror.
+type mirrorStat struct {
+	Mirror   string
+	Requests int
+	Failures int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// Throughput returns the average transfer rate in bytes per second.
+func (s *mirrorStat) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// mirrorHealth collects the mirror statistics of this run.
+var mirrorHealth = &mirrorStats{stats: map[string]*mirrorStat{}}
+
+// mirrorStats is a concurrency-safe set of mirror statistics.
+type mirrorStats struct {
+	mu    sync.Mutex
+	stats map[string]*mirrorStat
+}
+
+// mirrorOf returns the mirror a URL is served by, its scheme and host.
+func mirrorOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// record adds a transfer of n bytes from rawURL that took d and failed with
+// err, if not nil. Only successful transfers count towards the throughput.
+func (m *mirrorStats) record(rawURL string, n int64, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := mirrorOf(rawURL)
+	s, ok := m.stats[key]
+	if !ok {
+		s = &mirrorStat{Mirror: key}
+		m.stats[key] = s
+	}
+	s.Requests++
+	if err != nil {
+		// Failed requests would distort the throughput
+		s.Failures++
+		return
+	}
+	s.Bytes += n
+	s.Duration += d
+}
+
+// sorted returns the statistics ordered by mirror.
+func (m *mirrorStats) sorted() []mirrorStat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var stats []mirrorStat
+	for _, s := range m.stats {
+		stats = append(stats, *s)
+	}
+	slices.SortFunc(stats, func(a, b mirrorStat) int { return strings.Compare(a.Mirror, b.Mirror) })
+	return stats
+}
+
+// printMirrorHealth logs a table of the mirrors used so far.
+func printMirrorHealth() {
+	stats := mirrorHealth.sorted()
+	if len(stats) == 0 {
+		return
+	}
+	log.Println("Mirror health:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  MIRROR\tREQUESTS\tFAILURES\tTRANSFERRED\tTHROUGHPUT")
+	for _, s := range stats {
+		fmt.Fprintf(w, "  %s\t%d\t%d\t%s\t%s/s\n", s.Mirror, s.Requests, s.Failures, formatSize(s.Bytes), formatSize(int64(s.Throughput())))
+	}
+	w.Flush()
+}
+
+// writeMetrics writes the metrics of the run to --metrics-file in the
+// Prometheus text format, e.g. for the node_exporter textfile collector.
+func writeMetrics() {
+	if metricsFile == "" {
+		return
+	}
+	var b strings.Builder
+	stats := mirrorHealth.sorted()
+	metrics := []struct {
+		name, help, kind string
+		value            func(s mirrorStat) float64
+	}{
+		{"builder_mirror_requests_total", "Downloads attempted from the mirror.", "counter", func(s mirrorStat) float64 { return float64(s.Requests) }},
+		{"builder_mirror_failures_total", "Downloads from the mirror that failed.", "counter", func(s mirrorStat) float64 { return float64(s.Failures) }},
+		{"builder_mirror_bytes_total", "Bytes downloaded from the mirror.", "counter", func(s mirrorStat) float64 { return float64(s.Bytes) }},
+		{"builder_mirror_throughput_bytes", "Average download rate from the mirror in bytes per second.", "gauge", func(s mirrorStat) float64 { return s.Throughput() }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range stats {
+			fmt.Fprintf(&b, "%s{mirror=%q} %g\n", m.name, s.Mirror, m.value(s))
+		}
+	}
+	if err := os.WriteFile(metricsFile, []byte(b.String()), 0644); err != nil {
+		log.Printf("Warning: could not write metrics to %s: %v", metricsFile, err)
+	}
+}
+
+// mirrorServers returns the Server URLs of a mirrorlist. Commented servers,
+// as in the default list, are candidates too when few are enabled.
+func mirrorServers(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var enabled, commented []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		isComment := strings.HasPrefix(line, "#")
+		key, value, ok := strings.Cut(strings.TrimLeft(line, "# "), "=")
+		if !ok || strings.TrimSpace(key) != "Server" {
+			continue
+		}
+		if isComment {
+			commented = append(commented, strings.TrimSpace(value))
+		} else {
+			enabled = append(enabled, strings.TrimSpace(value))
+		}
+	}
+	if len(enabled) < rankedMirrors {
+		enabled = append(enabled, commented...)
+	}
+	return enabled, scanner.Err()
+}
+
+// probeMirror downloads the core database from a Server URL and returns
+// the throughput in bytes per second.
+func probeMirror(ctx context.Context, client *http.Client, server string) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, mirrorProbeTimeout)
+	defer cancel()
+	u := strings.NewReplacer("$repo", "core", "$arch", carch()).Replace(server) + "/core.db"
+	started := time.Now()
+	var n int64
+	err := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "builder/"+version)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("HTTP %s", resp.Status)
+		}
+		n, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}()
+	elapsed := time.Since(started)
+	mirrorHealth.record(u, n, elapsed, err)
+	if err != nil {
+		return 0, err
+	}
+	return float64(n) / elapsed.Seconds(), nil
+}
+
+// rankMirrors probes the mirrors of the mirrorlist and replaces it with the
+// fastest ones, keeping the original as mirrorlist.builder-orig.
+func rankMirrors(ctx context.Context) error {
+	// Rank from the original list again, not from a previous ranking
+	source := mirrorlistPath
+	if _, err := os.Stat(mirrorlistPath + ".builder-orig"); err == nil {
+		source = mirrorlistPath + ".builder-orig"
+	}
+	servers, err := mirrorServers(source)
+	if err != nil {
+		return fmt.Errorf("could not read the mirrorlist: %w", err)
+	}
+	if len(servers) > mirrorProbes {
+		servers = servers[:mirrorProbes]
+	}
+	log.Printf("Ranking %d mirror(s)...", len(servers))
+	client := httpClient()
+	rates := make([]float64, len(servers))
+	indexes := make([]int, len(servers))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	runParallel(defaultJobs, indexes, func(i int) error {
+		rate, err := probeMirror(ctx, client, servers[i])
+		if err != nil {
+			debugPrint("Mirror %s failed: %v", servers[i], err)
+			return nil
+		}
+		rates[i] = rate
+		return nil
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	slices.SortStableFunc(indexes, func(a, b int) int {
+		switch {
+		case rates[a] > rates[b]:
+			return -1
+		case rates[a] < rates[b]:
+			return 1
+		}
+		return 0
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Ranked by builder on %s\n", time.Now().UTC().Format(time.RFC3339))
+	kept := 0
+	for _, i := range indexes {
+		if rates[i] <= 0 || kept == rankedMirrors {
+			break
+		}
+		fmt.Fprintf(&b, "# %s/s\nServer = %s\n", formatSize(int64(rates[i])), servers[i])
+		kept++
+	}
+	if kept == 0 {
+		return fmt.Errorf("none of the %d mirrors responded", len(servers))
+	}
+	if err := installMirrorlist(ctx, b.String()); err != nil {
+		return err
+	}
+	log.Printf("Wrote the %d fastest mirror(s) to %s", kept, mirrorlistPath)
+	return nil
+}
+
+// installMirrorlist replaces the mirrorlist with content, backing the
+// original up as mirrorlist.builder-orig the first time.
+func installMirrorlist(ctx context.Context, content string) error {
+	tmp, err := os.CreateTemp("", "builder-mirrorlist-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if _, err := os.Stat(mirrorlistPath + ".builder-orig"); os.IsNotExist(err) {
+		if err := runAsRoot(ctx, "cp", "-p", mirrorlistPath, mirrorlistPath+".builder-orig"); err != nil {
+			return fmt.Errorf("could not back up the mirrorlist: %w", err)
+		}
+	}
+	if err := runAsRoot(ctx, "install", "-m", "0644", tmp.Name(), mirrorlistPath); err != nil {
+		return fmt.Errorf("could not write the mirrorlist: %w", err)
+	}
+	return nil
+}
+
+// parseSnapshotDate parses a YYYY-MM-DD date of the Arch Linux Archive.
+func parseSnapshotDate(date string) (time.Time, error) {
+	t, err := time.Parse(time.DateOnly, date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid snapshot date %q: must be YYYY-MM-DD", date)
+	}
+	if t.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("snapshot date %s is in the future", date)
+	}
+	return t, nil
+}
+
+// useSnapshot points the mirrorlist at the Arch Linux Archive as of date
+// and syncs the system to it, downgrading packages newer than the
+// snapshot, so dependencies resolve against the package set of that day.
+func useSnapshot(ctx context.Context, date time.Time) error {
+	server := fmt.Sprintf("%s/%s/$repo/os/$arch", archiveReposURL, date.Format("2006/01/02"))
+	log.Printf("Using the Arch Linux Archive snapshot of %s", date.Format(time.DateOnly))
+	content := fmt.Sprintf("# Arch Linux Archive snapshot of %s, written by builder\nServer = %s\n", date.Format(time.DateOnly), server)
+	if err := installMirrorlist(ctx, content); err != nil {
+		return err
+	}
+	if err := waitForPacmanLock(ctx); err != nil {
+		return err
+	}
+	// -yy refreshes databases newer than the snapshot, -uu allows downgrades
+	if err := runAsRoot(ctx, "pacman", "-Syyuu", "--noconfirm"); err != nil {
+		return fmt.Errorf("could not sync to the snapshot of %s: %w", date.Format(time.DateOnly), err)
+	}
+	return nil
+}
+
+// downloadSize returns the number of bytes pacman would download to install
+// packages.
+func downloadSize(ctx context.Context, packages []string) (int64, error) {
+	cmd := newCommand(ctx, "pacman", append([]string{"-Sp", "--needed", "--print-format", "%s"}, packages...)...)
+	cmd.Stderr = nil
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, field := range strings.Fields(string(out)) {
+		var n int64
+		if _, err := fmt.Sscan(field, &n); err == nil {
+			total += n
+		}
+	}
+	return total, nil
+}
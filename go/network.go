@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// systemCABundles are the usual locations of the system certificate bundle.
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/ca-certificates/extracted/tls-ca-bundle.pem",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+}
+
+var (
+	caCertFiles        []string
+	insecureSkipVerify bool
+
+	httpClientOnce sync.Once
+	sharedClient   *http.Client
+	tlsConfig      *tls.Config
+
+	// caBundlePath is the combined bundle exported to child processes.
+	caBundlePath string
+)
+
+// setupNetwork loads the extra CA certificates and prepares the TLS settings
+// used by every HTTP client. Child processes (curl in makepkg, git, gpg) get
+// the combined bundle through SSL_CERT_FILE and friends. The proxy variables
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored as is.
+func setupNetwork() error {
+	if envCA := os.Getenv("BUILDER_CA_CERT"); envCA != "" && len(caCertFiles) == 0 {
+		caCertFiles = splitList(envCA)
+	}
+	tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	for _, env := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		// Proxy credentials must not show up in logs
+		if u, err := url.Parse(os.Getenv(env)); err == nil && u.User != nil {
+			if pass, ok := u.User.Password(); ok {
+				addMask(pass)
+			}
+		}
+	}
+	debugPrint("Network: %s", proxyDescription())
+
+	if insecureSkipVerify {
+		log.Println("WARNING: ******************************************************************")
+		log.Println("WARNING: TLS certificate verification is DISABLED (--insecure-skip-verify).")
+		log.Println("WARNING: Downloads and uploads can be intercepted or tampered with.")
+		log.Println("WARNING: ******************************************************************")
+		tlsConfig.InsecureSkipVerify = true
+		os.Setenv("GIT_SSL_NO_VERIFY", "1")
+	}
+	if len(caCertFiles) == 0 {
+		return nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	var bundle []byte
+	for _, path := range systemCABundles {
+		if data, err := os.ReadFile(path); err == nil {
+			bundle = append(bundle, data...)
+			break
+		}
+	}
+	for _, path := range caCertFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read CA certificate: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no PEM certificates found in %s", path)
+		}
+		bundle = append(append(bundle, '\n'), data...)
+		debugPrint("Trusting CA certificates from %s", path)
+	}
+	tlsConfig.RootCAs = pool
+
+	caBundlePath = filepath.Join(os.TempDir(), fmt.Sprintf("builder-ca-%d.pem", os.Getpid()))
+	if err := os.WriteFile(caBundlePath, bundle, 0644); err != nil {
+		return fmt.Errorf("could not write CA bundle: %w", err)
+	}
+	for _, env := range []string{"SSL_CERT_FILE", "CURL_CA_BUNDLE", "GIT_SSL_CAINFO", "REQUESTS_CA_BUNDLE", "NODE_EXTRA_CA_CERTS"} {
+		os.Setenv(env, caBundlePath)
+	}
+	return nil
+}
+
+// cleanupNetwork removes the temporary CA bundle.
+func cleanupNetwork() {
+	if caBundlePath != "" {
+		os.Remove(caBundlePath)
+	}
+}
+
+// httpClient returns the client every network operation must use, so that
+// proxy and certificate settings apply everywhere.
+func httpClient() *http.Client {
+	httpClientOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyFromEnvironment
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig
+		}
+		sharedClient = &http.Client{Transport: transport, Timeout: 30 * time.Minute}
+	})
+	return sharedClient
+}
+
+// proxyDescription summarizes the proxy environment for debug output.
+func proxyDescription() string {
+	var parts []string
+	for _, env := range []string{"HTTPS_PROXY", "HTTP_PROXY", "NO_PROXY"} {
+		v := os.Getenv(env)
+		if v == "" {
+			v = os.Getenv(strings.ToLower(env))
+		}
+		if v != "" {
+			parts = append(parts, env+"="+v)
+		}
+	}
+	if len(parts) == 0 {
+		return "no proxy"
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Reasons a build produced no package files, reported in --error-json.
+const (
+	noPackagesPKGDEST     = "pkgdest"
+	noPackagesBuilt       = "already-built"
+	noPackagesUpToDate    = "up-to-date"
+	noPackagesExit        = "exit-in-pkgbuild"
+	noPackagesNotStarted  = "not-started"
+	noPackagesStalePkgDir = "stale-pkg-dir"
+	noPackagesUnknown     = "unknown"
+)
+
+// noPackagesCause is why a build produced no package files and what to do.
+type noPackagesCause struct {
+	Reason     string
+	Detail     string
+	Suggestion string
+}
+
+// reTopLevelExit matches an exit outside of the PKGBUILD functions, which
+// stops makepkg while sourcing it.
+var reTopLevelExit = regexp.MustCompile(`(?m)^[^\s#][^#\n]*\bexit(\s+\d+)?\s*(;|$)`)
+
+// diagnoseNoPackages finds out why the build that started at startedAt with
+// the PKGBUILD at version produced no package files in the current
+// directory, from the build log and the state of the package directory.
+func diagnoseNoPackages(backend, version string, startedAt time.Time) noPackagesCause {
+	var logText string
+	if data, err := os.ReadFile(buildLogFile); err == nil {
+		logText = string(data)
+	}
+	// makepkg runs pkgver() and rewrites the PKGBUILD before building
+	var detail string
+	if info, err := parsePKGBUILD("PKGBUILD"); err == nil && version != "" {
+		if now := info.PkgVer + "-" + info.PkgRel; now != version {
+			detail = fmt.Sprintf(" (pkgver() changed the version from %s to %s)", version, now)
+		}
+	}
+
+	if dest := makepkgDestDir(".", makepkgPKGDEST); dest != "" {
+		if fi, err := os.Stat(dest); err != nil || !fi.IsDir() {
+			return noPackagesCause{noPackagesPKGDEST,
+				fmt.Sprintf("packages are written to PKGDEST=%s, which is not a directory%s", dest, detail),
+				"Create the PKGDEST directory, or unset PKGDEST for builds (or in makepkg.conf)."}
+		}
+		detail += fmt.Sprintf(" (packages were looked for in PKGDEST=%s as well)", dest)
+	}
+	switch {
+	case strings.Contains(logText, "A package has already been built"):
+		return noPackagesCause{noPackagesBuilt,
+			fmt.Sprintf("makepkg found this version already built and stopped%s", detail),
+			"Rebuild the same version with --force, or bump pkgrel for a new release."}
+	case strings.Contains(logText, "is up to date -- skipping") || strings.Contains(logText, "there is nothing to do"):
+		return noPackagesCause{noPackagesUpToDate,
+			fmt.Sprintf("%s considered the package up to date and skipped it%s", backend, detail),
+			"Rebuild the same version with --force, or bump pkgrel if the packaging changed."}
+	}
+	if !strings.Contains(logText, "==> Making package:") {
+		if content, err := os.ReadFile("PKGBUILD"); err == nil && reTopLevelExit.Match(content) {
+			return noPackagesCause{noPackagesExit,
+				"the PKGBUILD calls exit outside of its functions, which stops makepkg before it builds" + detail,
+				"Remove the top-level exit from the PKGBUILD; skip architectures or conditions with arch= or in the functions instead."}
+		}
+		return noPackagesCause{noPackagesNotStarted,
+			fmt.Sprintf("%s never started makepkg%s", backend, detail),
+			fmt.Sprintf("Check the %s output above (also in %s) for why the build was skipped.", backend, buildLogFile)}
+	}
+	if fi, err := os.Stat("pkg"); err == nil && fi.IsDir() && fi.ModTime().Before(startedAt) {
+		return noPackagesCause{noPackagesStalePkgDir,
+			"makepkg ran but left pkg/ from a previous build untouched" + detail,
+			"Rebuild with --force to replace pkg/, or with --clean to remove src/ as well."}
+	}
+	return noPackagesCause{noPackagesUnknown,
+		"makepkg ran but wrote no package" + detail,
+		fmt.Sprintf("Check %s for a package() that returned early or a failing step whose exit status was ignored.", buildLogFile)}
+}
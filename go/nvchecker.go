@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// nvcheckerFile is the nvchecker configuration of Arch packaging repositories,
+// which 'pkgctl version check' reads.
+const nvcheckerFile = ".nvchecker.toml"
+
+// nvcheckerMaxPages bounds the pages of tags fetched from a forge API.
+const nvcheckerMaxPages = 10
+
+// rePythonGroupRef matches the group references of Python replacements, \1
+var rePythonGroupRef = regexp.MustCompile(`\\(\d+)`)
+
+// nvcheckerEntry is the options of one table of an nvchecker configuration,
+// e.g. source = "github" and github = "owner/repo".
+type nvcheckerEntry struct {
+	Name    string
+	Options map[string]any
+}
+
+// str returns a string option, or "" if it is not set.
+func (e *nvcheckerEntry) str(key string) string {
+	s, _ := e.Options[key].(string)
+	return s
+}
+
+// flag returns a boolean option.
+func (e *nvcheckerEntry) flag(key string) bool {
+	b, _ := e.Options[key].(bool)
+	return b
+}
+
+// nameOr returns a string option, defaulting to the name of the entry as
+// nvchecker does for the package name of registries.
+func (e *nvcheckerEntry) nameOr(key string) string {
+	if s := e.str(key); s != "" {
+		return s
+	}
+	return e.Name
+}
+
+// parseNvchecker parses the subset of TOML nvchecker configurations use:
+// tables of keys with strings, booleans, integers and arrays of strings.
+// The __config__ table of nvchecker itself is left out.
+func parseNvchecker(r io.Reader) (map[string]*nvcheckerEntry, error) {
+	entries := map[string]*nvcheckerEntry{}
+	var cur *nvcheckerEntry
+	sc := bufio.NewScanner(r)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.LastIndex(line, "]")
+			if end < 0 || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table %q", n, line)
+			}
+			if rest := strings.TrimSpace(line[end+1:]); rest != "" && rest[0] != '#' {
+				return nil, fmt.Errorf("line %d: unexpected %q after the table", n, rest)
+			}
+			name, err := tomlKey(strings.TrimSpace(line[1:end]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			cur = &nvcheckerEntry{Name: name, Options: map[string]any{}}
+			if name != "__config__" {
+				entries[name] = cur
+			}
+			continue
+		}
+		rawKey, rawValue, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("line %d: key outside of a table", n)
+		}
+		key, err := tomlKey(strings.TrimSpace(rawKey))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rawValue = strings.TrimSpace(rawValue)
+		// Arrays may span lines
+		for strings.HasPrefix(rawValue, "[") && !tomlArrayClosed(rawValue) && sc.Scan() {
+			n++
+			rawValue += "\n" + sc.Text()
+		}
+		value, rest, err := tomlValue(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+			return nil, fmt.Errorf("line %d: unexpected %q after %s", n, rest, key)
+		}
+		cur.Options[key] = value
+	}
+	return entries, sc.Err()
+}
+
+// tomlKey returns a bare or quoted TOML key.
+func tomlKey(s string) (string, error) {
+	if s == "" {
+		return "", fmt.Errorf("empty key")
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		key, rest, err := tomlString(s)
+		if err == nil && strings.TrimSpace(rest) != "" {
+			err = fmt.Errorf("invalid key %q", s)
+		}
+		return key, err
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return "", fmt.Errorf("invalid key %q; dotted keys are not supported", s)
+		}
+	}
+	return s, nil
+}
+
+// tomlString parses the basic or literal string s starts with and returns
+// what follows it.
+func tomlString(s string) (string, string, error) {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote == '"':
+			i++
+		case s[i] == quote:
+			if quote == '\'' {
+				return s[1:i], s[i+1:], nil
+			}
+			// TOML escapes are those of Go besides \e and \U
+			v, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+			}
+			return v, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string %s", s)
+}
+
+// tomlArrayClosed reports whether the array s starts with ends in it,
+// ignoring brackets in strings and comments.
+func tomlArrayClosed(s string) bool {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'':
+			_, rest, err := tomlString(s[i:])
+			if err != nil {
+				return false
+			}
+			i = len(s) - len(rest) - 1
+		case '#':
+			nl := strings.IndexByte(s[i:], '\n')
+			if nl < 0 {
+				return false
+			}
+			i += nl
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tomlValue parses the value s starts with and returns what follows it.
+func tomlValue(s string) (any, string, error) {
+	switch {
+	case s == "":
+		return nil, "", fmt.Errorf("missing value")
+	case s[0] == '"' || s[0] == '\'':
+		if strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''") {
+			return nil, "", fmt.Errorf("multi-line strings are not supported")
+		}
+		return tomlString(s)
+	case s[0] == '[':
+		var values []string
+		rest := s[1:]
+		for {
+			rest = skipTOMLSpace(rest)
+			if strings.HasPrefix(rest, "]") {
+				return values, rest[1:], nil
+			}
+			if rest == "" || (rest[0] != '"' && rest[0] != '\'') {
+				return nil, "", fmt.Errorf("only arrays of strings are supported")
+			}
+			v, after, err := tomlString(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, v)
+			rest = skipTOMLSpace(after)
+			rest = strings.TrimPrefix(rest, ",")
+		}
+	}
+	end := strings.IndexAny(s, " \t#")
+	if end < 0 {
+		end = len(s)
+	}
+	word := s[:end]
+	switch word {
+	case "true":
+		return true, s[end:], nil
+	case "false":
+		return false, s[end:], nil
+	}
+	i, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 0, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("unsupported value %q", word)
+	}
+	return i, s[end:], nil
+}
+
+// skipTOMLSpace skips whitespace, newlines and comments within an array.
+func skipTOMLSpace(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		nl := strings.IndexByte(s, '\n')
+		if nl < 0 {
+			return ""
+		}
+		s = s[nl:]
+	}
+}
+
+// nvcheckerEntryOf returns the entry of the .nvchecker.toml of a package
+// directory for its pkgbase, or pkgname, as pkgctl looks it up, and false
+// if the directory has no .nvchecker.toml.
+func nvcheckerEntryOf(dir string, info *pkgbuildInfo) (*nvcheckerEntry, bool, error) {
+	f, err := os.Open(filepath.Join(dir, nvcheckerFile))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	defer f.Close()
+	entries, err := parseNvchecker(f)
+	if err != nil {
+		return nil, true, fmt.Errorf("%s: %w", nvcheckerFile, err)
+	}
+	name := info.Vars["pkgbase"]
+	if name == "" {
+		name = info.PkgName
+	}
+	e, ok := entries[name]
+	if !ok {
+		return nil, true, fmt.Errorf("%s has no [%s] entry", nvcheckerFile, name)
+	}
+	return e, true, nil
+}
+
+// nvcheckerUpstream describes where an entry looks for new versions.
+func nvcheckerUpstream(e *nvcheckerEntry) string {
+	switch source := e.str("source"); source {
+	case "github":
+		return "github.com/" + e.str("github")
+	case "gitlab":
+		return nvcheckerGitLabHost(e) + "/" + e.str("gitlab")
+	case "pypi":
+		return "pypi.org/project/" + e.nameOr("pypi")
+	case "npm":
+		return "npmjs.com/package/" + e.nameOr("npm")
+	case "cratesio":
+		return "crates.io/crates/" + e.nameOr("cratesio")
+	case "git":
+		return e.str("git")
+	case "regex":
+		return e.str("url")
+	default:
+		return source
+	}
+}
+
+// nvcheckerGitLabHost returns the host of a gitlab entry.
+func nvcheckerGitLabHost(e *nvcheckerEntry) string {
+	if h := e.str("host"); h != "" {
+		return h
+	}
+	return "gitlab.com"
+}
+
+// nvcheckerVersion returns the latest version of an nvchecker entry, with
+// the list options (include_regex, exclude_regex, ignored) applied to the
+// versions the source lists and prefix, from_pattern and to_pattern applied
+// to the result, as nvchecker reports it.
+func nvcheckerVersion(ctx context.Context, e *nvcheckerEntry) (string, error) {
+	versions, err := nvcheckerSourceVersions(ctx, e)
+	if err != nil {
+		return "", err
+	}
+	if len(versions) > 1 {
+		if versions, err = nvcheckerListOptions(e, versions); err != nil {
+			return "", err
+		}
+	}
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no version found at %s", nvcheckerUpstream(e))
+	}
+	v := versions[0]
+	for _, other := range versions[1:] {
+		if repodb.VerCmp(other, v) > 0 {
+			v = other
+		}
+	}
+	return nvcheckerSubstitute(e, v)
+}
+
+// nvcheckerSourceVersions queries the source of an entry. Sources listing
+// tags return every one; the others return the one version they report.
+func nvcheckerSourceVersions(ctx context.Context, e *nvcheckerEntry) ([]string, error) {
+	switch source := e.str("source"); source {
+	case "github":
+		project := e.str("github")
+		if project == "" {
+			return nil, fmt.Errorf("source github needs the github option")
+		}
+		u := upstreamProject{"github", "github.com", project}
+		switch {
+		case e.flag("use_max_tag"):
+			return forgeTags(ctx, "https://api.github.com/repos/"+project+"/tags?per_page=100", githubHeader)
+		case e.flag("use_latest_release"):
+			tag, err := latestRelease(ctx, u)
+			return []string{tag}, err
+		}
+		return nil, fmt.Errorf("source github needs use_latest_release or use_max_tag (the latest commit is not supported)")
+	case "gitlab":
+		project := e.str("gitlab")
+		if project == "" {
+			return nil, fmt.Errorf("source gitlab needs the gitlab option")
+		}
+		if !e.flag("use_max_tag") {
+			return nil, fmt.Errorf("source gitlab needs use_max_tag (the latest commit is not supported)")
+		}
+		return forgeTags(ctx, "https://"+nvcheckerGitLabHost(e)+"/api/v4/projects/"+url.PathEscape(project)+"/repository/tags?per_page=100", nil)
+	case "pypi":
+		var project struct {
+			Info struct {
+				Version string `json:"version"`
+			} `json:"info"`
+		}
+		err := getJSON(ctx, "https://pypi.org/pypi/"+url.PathEscape(e.nameOr("pypi"))+"/json", nil, &project)
+		return []string{project.Info.Version}, err
+	case "npm":
+		var pkg struct {
+			DistTags map[string]string `json:"dist-tags"`
+		}
+		err := getJSON(ctx, "https://registry.npmjs.org/"+strings.ReplaceAll(e.nameOr("npm"), "/", "%2F"), nil, &pkg)
+		return []string{pkg.DistTags["latest"]}, err
+	case "cratesio":
+		var crate struct {
+			Crate struct {
+				MaxStable string `json:"max_stable_version"`
+			} `json:"crate"`
+		}
+		err := getJSON(ctx, "https://crates.io/api/v1/crates/"+url.PathEscape(e.nameOr("cratesio")), nil, &crate)
+		return []string{crate.Crate.MaxStable}, err
+	case "git":
+		return gitTags(ctx, e.str("git"))
+	case "regex":
+		return regexVersions(ctx, e.str("url"), e.str("regex"))
+	case "":
+		return nil, fmt.Errorf("%s: [%s] has no source", nvcheckerFile, e.Name)
+	default:
+		return nil, fmt.Errorf("nvchecker source %s is not supported (supported: github, gitlab, pypi, npm, cratesio, git, regex)", source)
+	}
+}
+
+// githubHeader returns the headers of GitHub API requests, authenticated
+// with the github-token secret when it is set.
+func githubHeader() (http.Header, error) {
+	header := http.Header{"Accept": {"application/vnd.github+json"}}
+	token, err := getSecret("github-token")
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return header, nil
+}
+
+// forgeTags lists the tag names of the paginated GitHub or GitLab tags API
+// at rawURL.
+func forgeTags(ctx context.Context, rawURL string, headerFn func() (http.Header, error)) ([]string, error) {
+	var header http.Header
+	if headerFn != nil {
+		var err error
+		if header, err = headerFn(); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for page := 1; page <= nvcheckerMaxPages; page++ {
+		var tags []struct {
+			Name string `json:"name"`
+		}
+		if err := getJSON(ctx, fmt.Sprintf("%s&page=%d", rawURL, page), header, &tags); err != nil {
+			return nil, err
+		}
+		for _, t := range tags {
+			names = append(names, t.Name)
+		}
+		if len(tags) < 100 {
+			break
+		}
+	}
+	return names, nil
+}
+
+// gitTags lists the tags of a git repository.
+func gitTags(ctx context.Context, repo string) ([]string, error) {
+	if repo == "" {
+		return nil, fmt.Errorf("source git needs the git option")
+	}
+	cmd := newCommand(ctx, "git", "ls-remote", "--tags", "--refs", repo)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the tags of %s: %w", repo, err)
+	}
+	var tags []string
+	for line := range strings.Lines(string(out)) {
+		if _, ref, ok := strings.Cut(strings.TrimSpace(line), "\t"); ok {
+			tags = append(tags, strings.TrimPrefix(ref, "refs/tags/"))
+		}
+	}
+	return tags, nil
+}
+
+// regexVersions returns the matches of pattern in the page at rawURL: the
+// first group of each, or the whole match without groups.
+func regexVersions(ctx context.Context, rawURL, pattern string) ([]string, error) {
+	if rawURL == "" || pattern == "" {
+		return nil, fmt.Errorf("source regex needs the url and regex options")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: %w", err)
+	}
+	if re.NumSubexp() > 1 {
+		return nil, fmt.Errorf("regex must have at most one group")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "builder/"+version)
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: HTTP %s", rawURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, m := range re.FindAllStringSubmatch(string(body), -1) {
+		versions = append(versions, m[len(m)-1])
+	}
+	return versions, nil
+}
+
+// nvcheckerListOptions filters the versions a source lists.
+func nvcheckerListOptions(e *nvcheckerEntry, versions []string) ([]string, error) {
+	for _, opt := range []string{"include_regex", "exclude_regex"} {
+		pattern := e.str(opt)
+		if pattern == "" {
+			continue
+		}
+		// nvchecker matches the whole version
+		re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", opt, err)
+		}
+		include := opt == "include_regex"
+		versions = slices.DeleteFunc(versions, func(v string) bool { return re.MatchString(v) != include })
+	}
+	if ignored := strings.Fields(e.str("ignored")); len(ignored) > 0 {
+		versions = slices.DeleteFunc(versions, func(v string) bool { return slices.Contains(ignored, v) })
+	}
+	return versions, nil
+}
+
+// nvcheckerSubstitute applies prefix, and from_pattern with to_pattern, to
+// a version.
+func nvcheckerSubstitute(e *nvcheckerEntry, v string) (string, error) {
+	if prefix := e.str("prefix"); prefix != "" {
+		v = strings.TrimPrefix(v, prefix)
+	}
+	if from := e.str("from_pattern"); from != "" {
+		re, err := regexp.Compile(from)
+		if err != nil {
+			return "", fmt.Errorf("invalid from_pattern: %w", err)
+		}
+		// Python writes group references as \1, Go as ${1}
+		to := rePythonGroupRef.ReplaceAllString(e.str("to_pattern"), "$${$1}")
+		v = re.ReplaceAllString(v, to)
+	}
+	return v, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+// ociArtifactType is the artifact type of package artifacts pushed by
+// 'publish oci'.
+const ociArtifactType = "application/vnd.archlinux.package.v1"
+
+// ociMediaType returns the media type of a file pushed as an OCI layer.
+func ociMediaType(file string) string {
+	switch name := filepath.Base(file); {
+	case strings.HasSuffix(name, ".sig"):
+		return "application/pgp-signature"
+	case isPackageFile(name):
+		switch filepath.Ext(name) {
+		case ".zst":
+			return ociArtifactType + ".tar+zstd"
+		case ".xz":
+			return ociArtifactType + ".tar+xz"
+		case ".gz":
+			return ociArtifactType + ".tar+gzip"
+		}
+		return ociArtifactType + ".tar"
+	case strings.HasSuffix(name, ".spdx.json"):
+		return "application/spdx+json"
+	case strings.HasSuffix(name, ".cdx.json"):
+		return "application/vnd.cyclonedx+json"
+	}
+	return "application/octet-stream"
+}
+
+// ociRepository splits ref into its repository and whether it names a tag
+// or digest.
+func ociRepository(ref string) (repository string, tagged bool) {
+	slash := strings.LastIndex(ref, "/")
+	if i := strings.IndexAny(ref[slash+1:], ":@"); i >= 0 {
+		return ref[:slash+1+i], true
+	}
+	return ref, false
+}
+
+// ociTag turns a package version into a valid tag, which matches
+// [A-Za-z0-9_][A-Za-z0-9._-]{0,127}: other characters, such as the colon of
+// an epoch or the + of a git version, become underscores.
+func ociTag(version string) string {
+	tag := []byte(version)
+	for i, c := range tag {
+		valid := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+		if !valid && (i == 0 || c != '.' && c != '-') {
+			tag[i] = '_'
+		}
+	}
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return string(tag)
+}
+
+// newPublishOCICmd creates the 'publish oci' command.
+func newPublishOCICmd() *cobra.Command {
+	var ref, cosignKey string
+	var annotations []string
+	var sign bool
+	cmd := &cobra.Command{
+		Use:   "oci --ref <registry>/<repository>[:<tag>] <files...>",
+		Short: "Pushes packages as an OCI artifact to a container registry.",
+		Long: `Pushes packages, their signatures and SBOMs as one OCI artifact with ORAS, so
+existing registries, their retention policies and cosign can be reused.
+Without a tag in --ref the artifact is tagged with the version of the
+packages. Registry credentials come from the registry-password secret
+(CI_REGISTRY_PASSWORD or CI_JOB_TOKEN in GitLab CI).
+
+With --sign the pushed digest is signed with cosign, keyless unless
+--cosign-key is given (e.g. env://COSIGN_PRIVATE_KEY).`,
+		Example: `  builder publish oci --ref registry.example.com/prismlinux/foo:1.2.3-1 foo-1.2.3-1-x86_64.pkg.tar.zst*
+  builder publish oci --ref $CI_REGISTRY_IMAGE/packages/foo --sign out/*`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := exec.LookPath("oras"); err != nil {
+				return errorf(errDependency, "oras is not installed: see https://oras.land/docs/installation")
+			}
+			if sign {
+				if _, err := exec.LookPath("cosign"); err != nil {
+					return errorf(errDependency, "cosign is not installed, which --sign needs")
+				}
+			}
+
+			// Annotations describe the packages; the version also tags them
+			var info *pkgarchive.PkgInfo
+			versions := map[string]bool{}
+			for _, file := range args {
+				if !isPackageFile(file) || strings.HasSuffix(file, ".sig") {
+					continue
+				}
+				pi, err := pkgarchive.ReadPkgInfo(file)
+				if err != nil {
+					return errorf(errArtifact, "%w", err)
+				}
+				if info == nil {
+					info = pi
+				}
+				versions[pi.PkgVer] = true
+			}
+			if info == nil {
+				return errorf(errGeneral, "no package among %s", strings.Join(args, " "))
+			}
+			repository, tagged := ociRepository(ref)
+			if !tagged {
+				if len(versions) > 1 {
+					return errorf(errGeneral, "packages of different versions need a tag in --ref")
+				}
+				ref += ":" + ociTag(info.PkgVer)
+			}
+			base := info.PkgBase
+			if base == "" {
+				base = info.PkgName
+			}
+			pushArgs := []string{"push", "--format", "json", "--artifact-type", ociArtifactType,
+				"--annotation", "org.opencontainers.image.title=" + base,
+				"--annotation", "org.opencontainers.image.version=" + info.PkgVer}
+			if info.BuildDate > 0 {
+				pushArgs = append(pushArgs, "--annotation", "org.opencontainers.image.created="+time.Unix(info.BuildDate, 0).UTC().Format(time.RFC3339))
+			}
+			if info.URL != "" {
+				pushArgs = append(pushArgs, "--annotation", "org.opencontainers.image.url="+info.URL)
+			}
+			if len(versions) == 1 && info.PkgDesc != "" {
+				pushArgs = append(pushArgs, "--annotation", "org.opencontainers.image.description="+info.PkgDesc)
+			}
+			for _, a := range annotations {
+				if !strings.Contains(a, "=") {
+					return errorf(errGeneral, "invalid --annotation %q: must be key=value", a)
+				}
+				pushArgs = append(pushArgs, "--annotation", a)
+			}
+			user, password, err := registryCredentials()
+			if err != nil {
+				return err
+			}
+			if password != "" {
+				pushArgs = append(pushArgs, "--username", user, "--password-stdin")
+			}
+
+			// ORAS names layers after the paths given, so push base names
+			stage, err := os.MkdirTemp("", "builder-oci-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(stage)
+			pushArgs = append(pushArgs, ref)
+			for _, file := range args {
+				name := filepath.Base(file)
+				if _, err := os.Lstat(filepath.Join(stage, name)); err == nil {
+					return errorf(errGeneral, "%s is given twice: layers are named by file name", name)
+				}
+				if err := linkOrCopy(file, filepath.Join(stage, name)); err != nil {
+					return errorf(errArtifact, "%w", err)
+				}
+				pushArgs = append(pushArgs, name+":"+ociMediaType(name))
+			}
+
+			log.Printf("Pushing %d file(s) to %s", len(args), ref)
+			push := newCommand(cmd.Context(), "oras", pushArgs...)
+			push.Dir = stage
+			if password != "" {
+				push.Stdin = strings.NewReader(password)
+			}
+			debugPrint("Running command: oras %s", strings.Join(pushArgs, " "))
+			out, err := push.Output()
+			if err != nil {
+				return errorf(errPublish, "could not push %s: %w", ref, err)
+			}
+			var pushed struct {
+				Digest string `json:"digest"`
+			}
+			if err := json.Unmarshal(out, &pushed); err != nil || pushed.Digest == "" {
+				return errorf(errPublish, "unexpected output of oras push (oras 1.2 or newer is needed): %s", strings.TrimSpace(string(out)))
+			}
+			log.Printf("  Pushed: %s@%s", repository, pushed.Digest)
+
+			if !sign {
+				return nil
+			}
+			signArgs := []string{"sign", "--yes"}
+			if cosignKey != "" {
+				signArgs = append(signArgs, "--key", cosignKey)
+			}
+			signArgs = append(signArgs, repository+"@"+pushed.Digest)
+			signCmd := newCommand(cmd.Context(), "cosign", signArgs...)
+			if password != "" {
+				// A login of its own keeps the password off the command line,
+				// where other processes could read it
+				dockerConfig, err := os.MkdirTemp("", "builder-cosign-")
+				if err != nil {
+					return err
+				}
+				defer os.RemoveAll(dockerConfig)
+				env := append(os.Environ(), "DOCKER_CONFIG="+dockerConfig)
+				registry, _, _ := strings.Cut(repository, "/")
+				login := newCommand(cmd.Context(), "cosign", "login", registry, "--username", user, "--password-stdin")
+				login.Env = env
+				login.Stdin = strings.NewReader(password)
+				if out, err := login.CombinedOutput(); err != nil {
+					return errorf(errPublish, "could not log in to %s for cosign: %w: %s", registry, err, strings.TrimSpace(maskSecrets(string(out))))
+				}
+				signCmd.Env = env
+			}
+			debugPrint("Running command: cosign %s", strings.Join(signArgs, " "))
+			if !debugMode {
+				fmt.Printf("+ Running command: cosign %s\n", strings.Join(signArgs, " "))
+			}
+			if err := signCmd.Run(); err != nil {
+				return errorf(errPublish, "could not sign %s@%s: %w", repository, pushed.Digest, err)
+			}
+			log.Printf("  Signed: %s@%s", repository, pushed.Digest)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&ref, "ref", "", "Registry repository, with an optional tag, the artifact is pushed to")
+	cmd.Flags().StringArrayVar(&annotations, "annotation", nil, "Additional manifest annotation as key=value (repeatable)")
+	cmd.Flags().BoolVar(&sign, "sign", false, "Sign the pushed artifact with cosign")
+	cmd.Flags().StringVar(&cosignKey, "cosign-key", "", "Key cosign signs with, e.g. env://COSIGN_PRIVATE_KEY (default: keyless)")
+	cmd.MarkFlagRequired("ref")
+	return cmd
+}
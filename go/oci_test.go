@@ -0,0 +1,28 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestOCITag(t *testing.T) {
+	reTag := regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+	for version, want := range map[string]string{
+		"1.2.3-1":                "1.2.3-1",
+		"2:1.0-1":                "2_1.0-1",
+		"1.2+git20240101.abc-1":  "1.2_git20240101.abc-1",
+		"1.0~rc1-2":              "1.0_rc1-2",
+		".hidden-1":              "_hidden-1",
+		"-1":                     "_1",
+		strings.Repeat("1", 200): strings.Repeat("1", 128),
+	} {
+		got := ociTag(version)
+		if got != want {
+			t.Errorf("ociTag(%q) = %q, want %q", version, got, want)
+		}
+		if !reTag.MatchString(got) {
+			t.Errorf("ociTag(%q) = %q is not a valid tag", version, got)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// reasonNetworkAccess is the reason of offline builds that tried to use
+// the network, reported in --error-json.
+const reasonNetworkAccess = "network-access"
+
+// reNetworkFailure matches what curl, git, pip, npm, cargo, go and others
+// print when they cannot reach the network.
+var reNetworkFailure = regexp.MustCompile(`(?i)could not resolve host|temporary failure in name resolution|name or service not known|network is unreachable|getaddrinfo (enotfound|eai_again)|failed to lookup address|dial tcp: lookup|no address associated with hostname`)
+
+// fetchBuildSources downloads and verifies the sources of the PKGBUILD in
+// the current directory, VCS sources included, so the build can then run
+// without network.
+func fetchBuildSources(ctx context.Context, env []string) error {
+	cmd := newCommand(ctx, "makepkg", "--verifysource", "--noconfirm")
+	cmd.Env = append(os.Environ(), env...)
+	fmt.Printf("+ Running command: makepkg --verifysource --noconfirm\n")
+	if err := cmd.Run(); err != nil {
+		return errorf(errDependency, "could not fetch the sources: %w", err)
+	}
+	return nil
+}
+
+// offlineBuildCommand returns the command line running makepkg with
+// makepkgArgs in a network namespace of its own: only loopback exists, so
+// downloads in prepare(), build() or package() fail. VCS sources are held
+// at the fetched revision.
+func offlineBuildCommand(makepkgArgs []string) (string, []string) {
+	return "unshare", append([]string{"--net", "--map-current-user", "--", "makepkg", "--holdver"}, makepkgArgs...)
+}
+
+// offlineNetworkError explains an offline build whose log shows attempts to
+// use the network, or returns nil.
+func offlineNetworkError(logText string, err error) *builderError {
+	m := reNetworkFailure.FindString(logText)
+	if m == "" {
+		return nil
+	}
+	return &builderError{
+		Category: errBuild,
+		Err:      fmt.Errorf("package build failed: the PKGBUILD accessed the network during the offline build (%q): %w", strings.ToLower(m), err),
+		Hint:     "Add what the build downloads to source=() with checksums or vendor it into a source archive; prepare() runs without network as well.",
+		Reason:   reasonNetworkAccess,
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// upstreamProject is the project on a forge a package is released from.
+type upstreamProject struct {
+	// Forge is github or gitlab
+	Forge   string
+	Host    string
+	Project string
+}
+
+func (u upstreamProject) String() string {
+	return u.Host + "/" + u.Project
+}
+
+// upstreamOf finds the upstream project of a package from its source URLs,
+// e.g. GitHub release archives or a git+https clone of a GitLab project.
+func upstreamOf(info *pkgbuildInfo) (upstreamProject, bool) {
+	for _, array := range sourceArrays(info) {
+		for _, raw := range info.Arrays[array] {
+			raw = expandVars(raw, info.Vars)
+			if _, after, ok := strings.Cut(raw, "::"); ok {
+				raw = after
+			}
+			for _, p := range vcsPrefixes {
+				raw = strings.TrimPrefix(raw, p)
+			}
+			u, err := url.Parse(raw)
+			if err != nil || u.Host == "" {
+				continue
+			}
+			p := strings.Trim(u.Path, "/")
+			switch {
+			case u.Host == "github.com":
+				parts := strings.Split(p, "/")
+				if len(parts) >= 2 {
+					return upstreamProject{"github", u.Host, parts[0] + "/" + strings.TrimSuffix(parts[1], ".git")}, true
+				}
+			case strings.Contains(u.Host, "gitlab"):
+				project, _, _ := strings.Cut(p, "/-/")
+				if project = strings.TrimSuffix(project, ".git"); strings.Contains(project, "/") {
+					return upstreamProject{"gitlab", u.Host, project}, true
+				}
+			}
+		}
+	}
+	return upstreamProject{}, false
+}
+
+// getJSON fetches a forge API URL and decodes the JSON response into out.
+func getJSON(ctx context.Context, rawURL string, header http.Header, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	maps.Copy(req.Header, header)
+	req.Header.Set("User-Agent", "builder/"+version)
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("GET %s: HTTP %s: %s", rawURL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// latestRelease returns the tag of the latest release of an upstream project.
+func latestRelease(ctx context.Context, u upstreamProject) (string, error) {
+	switch u.Forge {
+	case "github":
+		header, err := githubHeader()
+		if err != nil {
+			return "", err
+		}
+		var release struct {
+			TagName string `json:"tag_name"`
+		}
+		if err := getJSON(ctx, "https://api.github.com/repos/"+u.Project+"/releases/latest", header, &release); err != nil {
+			return "", err
+		}
+		return release.TagName, nil
+	case "gitlab":
+		var releases []struct {
+			TagName string `json:"tag_name"`
+		}
+		if err := getJSON(ctx, "https://"+u.Host+"/api/v4/projects/"+url.PathEscape(u.Project)+"/releases?per_page=1", nil, &releases); err != nil {
+			return "", err
+		}
+		if len(releases) == 0 {
+			return "", fmt.Errorf("%s has no releases", u)
+		}
+		return releases[0].TagName, nil
+	}
+	return "", fmt.Errorf("unsupported forge %s", u.Forge)
+}
+
+// versionFromTag derives pkgver from a release tag such as v1.2.3 or
+// foo-1.2.3.
+func versionFromTag(tag, pkgname string) string {
+	v := strings.TrimPrefix(tag, pkgname+"-")
+	v = strings.TrimPrefix(v, "release-")
+	return strings.TrimLeft(v, "vV")
+}
+
+// isVCSPackage reports whether a package is built from the latest VCS
+// sources, by its -git, -svn, ... name; release checks do not apply to them.
+func isVCSPackage(info *pkgbuildInfo) bool {
+	for _, suffix := range []string{"-git", "-svn", "-hg", "-bzr", "-fossil"} {
+		if strings.HasSuffix(info.PkgName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// outdatedResult is the release check of one package.
+type outdatedResult struct {
+	Dir      string `json:"dir"`
+	Package  string `json:"package"`
+	Current  string `json:"current"`
+	Latest   string `json:"latest,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+	Outdated bool   `json:"outdated"`
+	Err      error  `json:"-"`
+	// Error is Err for --output-format json
+	Error string `json:"error,omitempty"`
+}
+
+// checkOutdated compares the pkgver of a package with the latest upstream
+// release: the version its .nvchecker.toml finds, or else the latest release
+// of the project its sources come from.
+func checkOutdated(ctx context.Context, dir string, info *pkgbuildInfo) outdatedResult {
+	r := outdatedResult{Dir: dir, Package: info.PkgName, Current: info.PkgVer}
+	e, found, err := nvcheckerEntryOf(dir, info)
+	if found {
+		if err != nil {
+			r.Err = err
+			return r
+		}
+		r.Upstream = nvcheckerUpstream(e)
+		r.Latest, r.Err = nvcheckerVersion(ctx, e)
+		return r
+	}
+	u, ok := upstreamOf(info)
+	if !ok {
+		r.Err = fmt.Errorf("no GitHub or GitLab upstream found in the sources")
+		return r
+	}
+	r.Upstream = u.String()
+	tag, err := latestRelease(ctx, u)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	r.Latest = versionFromTag(tag, info.PkgName)
+	return r
+}
+
+// newOutdatedCmd creates the 'outdated' command.
+func newOutdatedCmd() *cobra.Command {
+	var workspace, selection string
+	var all bool
+	cmd := &cobra.Command{
+		Use:         "outdated [<dir>...]",
+		Short:       "Lists packages with a newer upstream release.",
+		Annotations: map[string]string{annotationJSONResult: "true"},
+		Long: `Compares the pkgver of each package with the latest upstream version. Packages
+with a .nvchecker.toml, as Arch packaging repositories have for 'pkgctl version',
+are checked with the entry of their pkgbase: the github (use_latest_release or
+use_max_tag), gitlab (use_max_tag), pypi, npm, cratesio, git and regex sources
+are supported, with prefix, from_pattern/to_pattern, include_regex,
+exclude_regex and ignored. Otherwise the upstream project is found from the
+sources (GitHub or GitLab archives and clones) and its latest release tag is
+stripped of a v, release- or <pkgname>- prefix. The directories default to the
+current one; --workspace checks every package below it. VCS packages (-git,
+...) are skipped. Set BUILDER_GITHUB_TOKEN (or GITHUB_TOKEN) to avoid the
+GitHub API rate limit.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			infos := map[string]*pkgbuildInfo{}
+			if workspace != "" {
+				var err error
+				if infos, err = workspacePKGBUILDs(workspace); err != nil {
+					return errorf(errGeneral, "could not scan workspace %s: %w", workspace, err)
+				}
+			}
+			if len(args) == 0 && workspace == "" {
+				args = []string{"."}
+			}
+			for _, dir := range args {
+				info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+				if err != nil {
+					return errorf(errParse, "%s: %w", dir, err)
+				}
+				infos[dir] = info
+			}
+
+			candidates, err := selectDirs(selection, slices.Sorted(maps.Keys(infos)))
+			if err != nil {
+				return err
+			}
+			var dirs []string
+			for _, dir := range candidates {
+				if isVCSPackage(infos[dir]) {
+					debugPrint("%s: VCS package, skipped", dir)
+					continue
+				}
+				dirs = append(dirs, dir)
+			}
+			results := make([]outdatedResult, len(dirs))
+			indexes := make([]int, len(dirs))
+			for i := range indexes {
+				indexes[i] = i
+			}
+			runParallel(defaultJobs, indexes, func(i int) error {
+				results[i] = checkOutdated(cmd.Context(), dirs[i], infos[dirs[i]])
+				return nil
+			})
+			if cmd.Context().Err() != nil {
+				return newError(errCancelled, cmd.Context().Err())
+			}
+
+			outdated := 0
+			var listed []outdatedResult
+			for _, r := range results {
+				if r.Err != nil {
+					log.Printf("Warning: %s: %v", r.Package, r.Err)
+					r.Error = r.Err.Error()
+					listed = append(listed, r)
+					continue
+				}
+				r.Outdated = repodb.VerCmp(r.Latest, r.Current) > 0
+				if r.Outdated {
+					outdated++
+				}
+				if r.Outdated || all {
+					listed = append(listed, r)
+				}
+			}
+			if jsonOutput() {
+				return printResult(listed)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "PACKAGE\tCURRENT\tLATEST\tUPSTREAM")
+			for _, r := range listed {
+				if r.Err == nil {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Package, r.Current, r.Latest, r.Upstream)
+				}
+			}
+			w.Flush()
+			log.Printf("%d of %d package(s) outdated.", outdated, len(results))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&workspace, "workspace", "", "Check every package below this directory")
+	cmd.Flags().BoolVar(&all, "all", false, "Also list packages that are up to date")
+	cmd.Flags().StringVar(&selection, "select", "", selectUsage)
+	return cmd
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// The formats of --output-format.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var (
+	outputFormat string
+	// resultOut is where printResult writes: stdout, while everything else
+	// goes to stderr with --output-format json
+	resultOut io.Writer = os.Stdout
+	// printedResult records that the command printed its result
+	printedResult bool
+)
+
+// annotationJSONResult marks the commands printing their result with
+// printResult; others keep their usual output with --output-format json.
+const annotationJSONResult = "builder/json-result"
+
+// setupOutput checks --output-format. With json, for commands with a result
+// os.Stdout is pointed at stderr, so that the logs and the output of commands
+// go there and stdout only gets the JSON document of printResult.
+func setupOutput(cmd *cobra.Command) error {
+	switch outputFormat {
+	case outputText:
+	case outputJSON:
+		if cmd.Annotations[annotationJSONResult] == "" {
+			log.Printf("Warning: %s has no JSON result, --output-format json is ignored", cmd.CommandPath())
+			outputFormat = outputText
+			return nil
+		}
+		resultOut, os.Stdout = os.Stdout, os.Stderr
+	default:
+		return fmt.Errorf("unknown --output-format %q (text or json)", outputFormat)
+	}
+	return nil
+}
+
+// jsonOutput reports whether the primary result of commands is printed as
+// JSON, see printResult.
+func jsonOutput() bool {
+	return outputFormat == outputJSON
+}
+
+// printResult prints v as the JSON document of the command. Only the first
+// result of a run is printed, so the document stays a single one.
+func printResult(v any) error {
+	if printedResult {
+		return nil
+	}
+	printedResult = true
+	enc := json.NewEncoder(resultOut)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return errorf(errGeneral, "could not print the result: %w", err)
+	}
+	return nil
+}
+
+// commandResult is the document of commands without a result of their own.
+type commandResult struct {
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+}
+
+// depsPlan is the result of 'deps': the dependencies of the PKGBUILD and
+// those installed.
+type depsPlan struct {
+	Depends      []string `json:"depends"`
+	MakeDepends  []string `json:"makedepends"`
+	CheckDepends []string `json:"checkdepends"`
+	Install      []string `json:"install"`
+	SnapshotDate string   `json:"snapshot_date,omitempty"`
+	// Incomplete is set when the installation failed without --strict
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// artifactsResult is the result of 'artifacts'.
+type artifactsResult struct {
+	Dir       string   `json:"dir"`
+	Files     []string `json:"files"`
+	Packages  []string `json:"packages"`
+	Checksums string   `json:"checksums,omitempty"`
+}
+
+// versionInfo is the result of 'version', and what it writes to the .env
+// file.
+type versionInfo struct {
+	Version     string   `json:"version"`
+	PkgRelease  string   `json:"pkg_release"`
+	FullVersion string   `json:"full_version"`
+	PackageName string   `json:"package_name"`
+	TagVersion  string   `json:"tag_version"`
+	BuildJobID  string   `json:"build_job_id"`
+	BuildDate   string   `json:"build_date"`
+	Arch        []string `json:"arch"`
+	March       string   `json:"march,omitempty"`
+	File        string   `json:"file"`
+}
+
+// lintResult is the result of 'lint'.
+type lintResult struct {
+	Checked  int           `json:"checked"`
+	Passed   bool          `json:"passed"`
+	Findings []lintFinding `json:"findings"`
+}
+
+type lintFinding struct {
+	Dir      string `json:"dir"`
+	File     string `json:"file"`
+	Severity string `json:"severity"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// overlayPrefix names the overlay build roots in a chroot slot: the mounted
+// root <slot>/overlay-<pid> that makechrootpkg uses as its copy, and the
+// upper and work directories in <slot>/.overlay-<pid>.
+const overlayPrefix = "overlay-"
+
+// mountOverlay mounts an overlayfs over the chroot of the locked slot s:
+// the chroot is the read-only lower directory and the changes of the build
+// go to a directory of their own, so no copy of the chroot is made and
+// nothing of the build survives it. It returns the copy name to build in
+// and a function unmounting and removing the overlay, which also runs when
+// the build fails or is cancelled.
+func mountOverlay(ctx context.Context, s chrootSlot) (string, func(), error) {
+	if err := removeOverlays(ctx, s); err != nil {
+		return "", nil, err
+	}
+	name := overlayPrefix + strconv.Itoa(os.Getpid())
+	merged := filepath.Join(s.Dir, name)
+	state := filepath.Join(s.Dir, "."+name)
+	upper, work := filepath.Join(state, "upper"), filepath.Join(state, "work")
+	// The root directory of the overlay is the upper directory, which
+	// must belong to root like that of the chroot
+	if err := runAsRoot(ctx, "install", "-d", "-m", "0755", upper, work, merged); err != nil {
+		return "", nil, errorf(errDependency, "could not create the overlay of chroot %d: %w", s.N, err)
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", s.root(), upper, work)
+	if err := runAsRoot(ctx, "mount", "-t", "overlay", "overlay", "-o", opts, merged); err != nil {
+		removePaths(context.WithoutCancel(ctx), []string{merged, state}, false)
+		return "", nil, &builderError{
+			Category: errDependency,
+			Err:      fmt.Errorf("could not mount the overlay of chroot %d: %w", s.N, err),
+			Hint:     "Overlay build roots need a privileged runner with overlayfs; disable chroot.overlay to build in a copy of the chroot instead.",
+		}
+	}
+	debugPrint("Mounted overlay %s over %s", merged, s.root())
+	return name, func() {
+		if err := unmountOverlay(context.WithoutCancel(ctx), merged, state); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}, nil
+}
+
+// unmountOverlay unmounts the overlay at merged and removes it with its
+// upper and work directories in state.
+func unmountOverlay(ctx context.Context, merged, state string) error {
+	// Stale overlays are not mounted anymore after a reboot of the runner
+	if isMountPoint(merged) {
+		if err := runAsRoot(ctx, "umount", merged); err != nil {
+			// Processes left in the build root keep it busy
+			if err := runAsRoot(ctx, "umount", "--lazy", merged); err != nil {
+				return fmt.Errorf("could not unmount the overlay %s: %w", merged, err)
+			}
+		}
+	}
+	if isMountPoint(merged) {
+		return fmt.Errorf("the overlay %s is still mounted", merged)
+	}
+	if _, err := removePaths(ctx, []string{merged, state}, false); err != nil {
+		return fmt.Errorf("could not remove the overlay %s: %w", merged, err)
+	}
+	return nil
+}
+
+// isMountPoint reports whether path is mounted, per /proc/self/mountinfo.
+// Removing a mounted overlay would remove the files of the chroot below.
+func isMountPoint(path string) bool {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	abs, _ := filepath.Abs(path)
+	for line := range strings.Lines(string(data)) {
+		// Fields: ID, parent ID, major:minor, root, mount point, ...
+		if fields := strings.Fields(line); len(fields) > 4 && unescapeMountinfo(fields[4]) == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeMountinfo undoes the octal escapes of spaces, tabs, newlines and
+// backslashes in mountinfo paths.
+func unescapeMountinfo(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+// removeOverlays removes the overlays of the locked slot s that builds
+// killed before their cleanup left behind.
+func removeOverlays(ctx context.Context, s chrootSlot) error {
+	stale, _ := filepath.Glob(filepath.Join(s.Dir, overlayPrefix+"*"))
+	for _, merged := range stale {
+		// makechrootpkg locks its copy with <copy>.lock
+		if fi, err := os.Stat(merged); err != nil || !fi.IsDir() {
+			continue
+		}
+		log.Printf("Removing overlay %s of an interrupted build...", merged)
+		state := filepath.Join(s.Dir, "."+filepath.Base(merged))
+		if err := unmountOverlay(ctx, merged, state); err != nil {
+			return errorf(errDependency, "%w", err)
+		}
+	}
+	return nil
+}
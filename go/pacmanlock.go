@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pacmanLockFile        = "/var/lib/pacman/db.lck"
+	defaultPacmanLockWait = 10 * time.Minute
+	pacmanLockPoll        = 2 * time.Second
+	// A lock this young without a visible pacman process may belong to
+	// another container sharing the database, so it is not stale yet
+	pacmanStaleLockAge = time.Minute
+)
+
+// pacmanLockers are the programs that take the pacman database lock.
+var pacmanLockers = []string{"pacman", "paru", "yay", "makepkg", "pacman-key", "pamac", "pacstrap"}
+
+// pacmanLockHolders lists the running processes that may hold the pacman
+// lock, as "pid (command line)".
+func pacmanLockHolders() []string {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	self := os.Getpid()
+	var holders []string
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", e.Name(), "comm"))
+		if err != nil || !slices.Contains(pacmanLockers, strings.TrimSpace(string(comm))) {
+			continue
+		}
+		cmdline, _ := os.ReadFile(filepath.Join("/proc", e.Name(), "cmdline"))
+		args := strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		holders = append(holders, fmt.Sprintf("%d (%s)", pid, args))
+	}
+	return holders
+}
+
+// waitForPacmanLock waits until the pacman database is unlocked, so that
+// concurrent jobs on the same runner take turns instead of failing. A lock
+// without any pacman process is stale: it is reported, and removed when
+// pacman.remove_stale_lock is set.
+func waitForPacmanLock(ctx context.Context) error {
+	info, err := os.Stat(pacmanLockFile)
+	if err != nil {
+		return nil
+	}
+	wait := cfg.Pacman.LockWait
+	if wait == 0 {
+		wait = defaultPacmanLockWait
+	}
+
+	start := time.Now()
+	lastReport := time.Time{}
+	for {
+		holders := pacmanLockHolders()
+		if age := time.Since(info.ModTime()).Round(time.Second); len(holders) == 0 && age >= pacmanStaleLockAge {
+			if !cfg.Pacman.RemoveStaleLock {
+				return &builderError{
+					Category: errDependency,
+					Err:      fmt.Errorf("%s is stale: it is %s old and no pacman process is running", pacmanLockFile, age),
+					Hint:     "A previous pacman run was interrupted. Remove the lock file, or set pacman.remove_stale_lock to do so automatically.",
+				}
+			}
+			log.Printf("Warning: removing stale pacman lock %s (%s old, no pacman process running)", pacmanLockFile, age)
+			if err := runAsRoot(ctx, "rm", "-f", pacmanLockFile); err != nil {
+				return errorf(errDependency, "could not remove stale pacman lock: %w", err)
+			}
+			return nil
+		}
+		if len(holders) == 0 {
+			holders = []string{"unknown process"}
+		}
+		if time.Since(lastReport) >= 30*time.Second {
+			log.Printf("Waiting for the pacman lock %s, held by: %s", pacmanLockFile, strings.Join(holders, ", "))
+			lastReport = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return errorf(errCancelled, "cancelled while waiting for the pacman lock")
+		case <-time.After(pacmanLockPoll):
+		}
+		if info, err = os.Stat(pacmanLockFile); err != nil {
+			log.Printf("Pacman lock released after %s", time.Since(start).Round(time.Second))
+			return nil
+		}
+		if time.Since(start) > wait {
+			return &builderError{
+				Category: errDependency,
+				Err:      fmt.Errorf("pacman database still locked after %s, held by: %s", wait, strings.Join(holders, ", ")),
+				Hint:     "Another job on this runner is using pacman. Raise pacman.lock_wait or limit concurrent jobs per runner.",
+			}
+		}
+	}
+}
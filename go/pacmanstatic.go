@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// defaultPacmanStaticURL is the statically linked pacman of the Arch Linux
+// developers for x86_64.
+const defaultPacmanStaticURL = "https://pkgbuild.com/~morganamilo/pacman-static/x86_64/bin/pacman-static"
+
+var pacmanStatic struct {
+	once sync.Once
+	path string
+}
+
+// pacmanStaticPath downloads and verifies the pinned pacman-static binary
+// (once per process) and returns its path, or "" when it is not configured
+// or could not be fetched. Binaries are cached by their checksum.
+func pacmanStaticPath(ctx context.Context) string {
+	pacmanStatic.once.Do(func() {
+		ps := cfg.Pacman.Static
+		if ps.SHA256 == "" {
+			return
+		}
+		url := ps.URL
+		if url == "" {
+			url = defaultPacmanStaticURL
+		}
+		sum := strings.ToLower(ps.SHA256)
+		bin := filepath.Join(cacheDir(), "pacman-static", sum, "pacman")
+		if err := os.MkdirAll(filepath.Dir(bin), 0755); err != nil {
+			log.Printf("Warning: could not create pacman-static cache: %v", err)
+			return
+		}
+		log.Printf("pacman is not installed, using pacman-static %.12s", sum)
+		d := &downloader{client: httpClient(), jobs: 1, retries: 3}
+		job := downloadJob{Name: "pacman-static", URLs: []string{url}, Dest: bin, Checksums: map[string]string{"sha256sums": sum}}
+		if err := d.fetch(ctx, job); err != nil {
+			log.Printf("Warning: could not fetch pacman-static: %v", err)
+			return
+		}
+		if err := os.Chmod(bin, 0755); err != nil {
+			log.Printf("Warning: could not make pacman-static executable: %v", err)
+			return
+		}
+		pacmanStatic.path = bin
+	})
+	return pacmanStatic.path
+}
+
+// resolvePacman replaces pacman, also when run through sudo, by the pinned
+// pacman-static when pacman is not installed, e.g. in minimal containers
+// running only artifact and repository stages.
+func resolvePacman(ctx context.Context, name string, args []string) (string, []string) {
+	i := slices.Index(append([]string{name}, args...), "pacman")
+	if i < 0 || i > 1 || (i == 1 && name != "sudo") {
+		return name, args
+	}
+	if _, err := exec.LookPath("pacman"); err == nil {
+		return name, args
+	}
+	path := pacmanStaticPath(ctx)
+	if path == "" {
+		return name, args
+	}
+	if i == 0 {
+		return path, args
+	}
+	return name, append([]string{path}, args[1:]...)
+}
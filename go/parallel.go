@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultJobs is the parallelism of hashing and copying: enough to keep fast
+// disks busy without starving the rest of the runner.
+var defaultJobs = min(runtime.NumCPU(), 4)
+
+// runParallel calls fn for every item with at most jobs calls running at once
+// and returns the combined errors.
+func runParallel[T any](jobs int, items []T, fn func(T) error) error {
+	sem := make(chan struct{}, max(jobs, 1))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for _, item := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(item); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// progressReader counts bytes read and logs the progress of long operations
+// every progressInterval until stop is called.
+type progressReader struct {
+	r    io.Reader
+	n    atomic.Int64
+	done chan struct{}
+}
+
+// newProgressReader starts reporting the progress of reading total bytes from r
+// as label. r may be nil if the caller adds to n itself.
+func newProgressReader(r io.Reader, label string, total int64) *progressReader {
+	pr := &progressReader{r: r, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pr.done:
+				return
+			case <-ticker.C:
+				n := pr.n.Load()
+				if total > 0 {
+					log.Printf("  %s: %s / %s (%d%%)", label, formatSize(n), formatSize(total), n*100/total)
+				} else {
+					log.Printf("  %s: %s", label, formatSize(n))
+				}
+			}
+		}
+	}()
+	return pr
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.n.Add(int64(n))
+	return n, err
+}
+
+// stop ends the progress reports.
+func (pr *progressReader) stop() { close(pr.done) }
+
+// hashFileProgress is sha256File with progress reports for large files.
+func hashFileProgress(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var size int64
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+	pr := newProgressReader(f, "hashing "+filepath.Base(path), size)
+	defer pr.stop()
+	h := sha256.New()
+	if _, err := io.Copy(h, pr); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFiles returns the SHA-256 of every given file keyed by base name,
+// hashing up to jobs files at once. Unreadable files are skipped.
+func hashFiles(files []string, jobs int) map[string]string {
+	sums := map[string]string{}
+	var mu sync.Mutex
+	runParallel(jobs, files, func(f string) error {
+		sum, err := hashFileProgress(f)
+		if err != nil {
+			debugPrint("Could not hash %s: %v", f, err)
+			return nil
+		}
+		mu.Lock()
+		sums[filepath.Base(f)] = sum
+		mu.Unlock()
+		return nil
+	})
+	return sums
+}
+
+// moveFile renames src to dst, copying across filesystems, which is
+// the common case for CI artifact directories on a different mount.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	debugPrint("%s is on another filesystem than %s, copying it", src, filepath.Dir(dst))
+	if err := copyFile(src, dst); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("could not copy %s: %w", src, err)
+	}
+	return os.Remove(src)
+}
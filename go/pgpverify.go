@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+// pgpKeysDir holds the armored public keys of validpgpkeys, named
+// <fingerprint>.asc, as makepkg expects them next to the PKGBUILD.
+const pgpKeysDir = "keys/pgp"
+
+// signatureExts are the extensions makepkg recognizes as detached signatures.
+var signatureExts = []string{".sig", ".asc", ".sign"}
+
+// sourceSignature is a detached signature among the sources and the file it
+// signs, as paths. Decompress is set when the signature covers the
+// uncompressed content of File.
+type sourceSignature struct {
+	Sig        string
+	File       string
+	Decompress bool
+}
+
+// sourceSignatures pairs every signature source of info with the source it
+// signs. Like makepkg, a signature of foo.tar also verifies a compressed
+// foo.tar.gz after decompressing it. Downloaded sources are expected in
+// destDir and local ones next to the PKGBUILD.
+func sourceSignatures(info *pkgbuildInfo, destDir string) []sourceSignature {
+	paths := map[string]string{}
+	var names []string
+	for _, array := range []string{"source", "source_" + carch()} {
+		entries, _ := arraySources(info, array)
+		for _, e := range entries {
+			paths[e.Name] = e.Name
+			if e.remote() {
+				paths[e.Name] = filepath.Join(destDir, e.Name)
+			}
+			names = append(names, e.Name)
+		}
+	}
+
+	var sigs []sourceSignature
+	for _, name := range names {
+		for _, ext := range signatureExts {
+			signed, ok := strings.CutSuffix(name, ext)
+			if !ok {
+				continue
+			}
+			s := sourceSignature{Sig: paths[name]}
+			file, ok := paths[signed]
+			if !ok {
+				for _, other := range names {
+					if strings.HasPrefix(other, signed+".") && other != name {
+						file, ok, s.Decompress = paths[other], true, true
+						break
+					}
+				}
+			}
+			if ok {
+				s.File = file
+				sigs = append(sigs, s)
+			}
+			break
+		}
+	}
+	return sigs
+}
+
+// fingerprint returns the upper case hex fingerprint of a primary key.
+func fingerprint(e *openpgp.Entity) string {
+	return strings.ToUpper(hex.EncodeToString(e.PrimaryKey.Fingerprint))
+}
+
+// fetchPGPKey downloads a public key by fingerprint from the configured
+// keyserver (HKP) and caches it.
+func fetchPGPKey(ctx context.Context, fpr string) ([]byte, error) {
+	cached := filepath.Join(cacheDir(), "pgp", fpr+".asc")
+	if data, err := os.ReadFile(cached); err == nil {
+		return data, nil
+	}
+	keyserver := cfg.Keyring.Keyserver
+	if keyserver == "" {
+		keyserver = defaultKeyserver
+	}
+	base := strings.TrimSuffix(keyserver, "/")
+	base = strings.Replace(strings.Replace(base, "hkps://", "https://", 1), "hkp://", "http://", 1)
+	lookup := base + "/pks/lookup?op=get&options=mr&search=" + url.QueryEscape("0x"+fpr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lookup, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "builder/"+version)
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP %s", keyserver, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err == nil {
+		os.WriteFile(cached, data, 0644)
+	}
+	return data, nil
+}
+
+// loadValidPGPKeys returns the public keys of the given fingerprints from
+// keys/pgp, falling back to the keyserver. Keys in the files that are not
+// listed are ignored.
+func loadValidPGPKeys(ctx context.Context, fprs []string) (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	for _, fpr := range fprs {
+		fpr = strings.ToUpper(strings.TrimSpace(fpr))
+		data, err := os.ReadFile(filepath.Join(pgpKeysDir, fpr+".asc"))
+		if err != nil {
+			debugPrint("Key %s not in %s, fetching it from the keyserver", fpr, pgpKeysDir)
+			if data, err = fetchPGPKey(ctx, fpr); err != nil {
+				return nil, fmt.Errorf("could not get key %s: %w", fpr, err)
+			}
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		if err != nil {
+			entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read key %s: %w", fpr, err)
+		}
+		found := false
+		for _, e := range entities {
+			if fingerprint(e) == fpr {
+				keyring = append(keyring, e)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("key %s not found in its key file", fpr)
+		}
+	}
+	return keyring, nil
+}
+
+// verifyDetached checks one detached signature, armored or binary.
+func verifyDetached(keyring openpgp.EntityList, s sourceSignature) (*openpgp.Entity, error) {
+	sig, err := os.ReadFile(s.Sig)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var signed io.Reader = f
+	if s.Decompress {
+		dec, err := pkgarchive.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		signed = dec
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN PGP")) {
+		return openpgp.CheckArmoredDetachedSignature(keyring, signed, bytes.NewReader(sig), nil)
+	}
+	return openpgp.CheckDetachedSignature(keyring, signed, bytes.NewReader(sig), nil)
+}
+
+// verifySourceSignatures verifies every signed source of info against the
+// keys in validpgpkeys in-process, before makepkg would, and reports each
+// source that fails.
+func verifySourceSignatures(ctx context.Context, info *pkgbuildInfo, destDir string) error {
+	sigs := sourceSignatures(info, destDir)
+	if len(sigs) == 0 {
+		return nil
+	}
+	fprs := info.Arrays["validpgpkeys"]
+	if len(fprs) == 0 {
+		log.Printf("Warning: %d source signature(s) but no validpgpkeys; leaving them to makepkg", len(sigs))
+		return nil
+	}
+	keyring, err := loadValidPGPKeys(ctx, fprs)
+	if err != nil {
+		return &builderError{
+			Category: errDependency,
+			Err:      err,
+			Hint:     fmt.Sprintf("Add the armored public keys as %s/<fingerprint>.asc or check the keyserver (keyring.keyserver).", pgpKeysDir),
+		}
+	}
+
+	var failed []error
+	for _, s := range sigs {
+		signer, err := verifyDetached(keyring, s)
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s (%s): %w", filepath.Base(s.File), filepath.Base(s.Sig), err))
+			continue
+		}
+		log.Printf("  Verified: %s signed by %s", filepath.Base(s.File), fingerprint(signer))
+	}
+	if len(failed) > 0 {
+		return &builderError{
+			Category: errDependency,
+			Err:      fmt.Errorf("source signature verification failed:\n%w", errors.Join(failed...)),
+			Hint:     "The source does not match a signature by a key in validpgpkeys: the download is corrupt, upstream changed its key, or validpgpkeys is outdated.",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// pipelineStateFile records the phases 'pipeline' ran in a package
+// directory, so a later run can resume after them.
+const pipelineStateFile = ".builder-pipeline.json"
+
+// pipelinePhases are the phases of 'pipeline' in the order they run.
+var pipelinePhases = []string{"deps", "build", "artifacts", "publish"}
+
+// pipelineState is the content of pipelineStateFile.
+type pipelineState struct {
+	Phases map[string]*phaseState `json:"phases"`
+}
+
+// phaseState is the outcome of a phase. Fingerprint holds the build inputs
+// the phase ran with and Files the SHA-256 of what it produced, by base
+// name, so resuming can check the products are still those of these inputs.
+type phaseState struct {
+	Result      string            `json:"result"`
+	FinishedAt  time.Time         `json:"finished_at"`
+	Fingerprint string            `json:"fingerprint"`
+	Files       map[string]string `json:"files,omitempty"`
+}
+
+func readPipelineState() (*pipelineState, error) {
+	state := &pipelineState{Phases: map[string]*phaseState{}}
+	data, err := os.ReadFile(pipelineStateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", pipelineStateFile, err)
+	}
+	if state.Phases == nil {
+		state.Phases = map[string]*phaseState{}
+	}
+	return state, nil
+}
+
+func (s *pipelineState) write() error {
+	return writeJSONAtomic(pipelineStateFile, s)
+}
+
+// phaseFiles returns the products of a phase: the packages in the package
+// directory after build and in dir after artifacts.
+func phaseFiles(phase, dir string) []string {
+	var files []string
+	switch phase {
+	case "build":
+		files = builtPackages(".")
+	case "artifacts":
+		files, _ = filepath.Glob(filepath.Join(dir, "*.pkg.tar.*"))
+	}
+	return files
+}
+
+// checkResumable returns why the recorded phase cannot be skipped by
+// --from, or nil if its products are still those of the current inputs.
+func checkResumable(state *pipelineState, phase, fingerprint, dir string) error {
+	ps := state.Phases[phase]
+	if phase == "deps" || phase == "publish" {
+		// Installed dependencies and published files are not in the workspace
+		return nil
+	}
+	if ps == nil || ps.Result != resultSuccess {
+		return fmt.Errorf("%s has not succeeded in this workspace", phase)
+	}
+	if ps.Fingerprint != fingerprint {
+		return fmt.Errorf("the build inputs changed since %s ran at %s", phase, ps.FinishedAt.Format(time.DateTime))
+	}
+	for name, sum := range ps.Files {
+		// artifacts moves the packages of the build into its directory
+		candidates := []string{name}
+		if phase == "build" {
+			candidates = append(candidates, filepath.Join(dir, name))
+		} else {
+			candidates = []string{filepath.Join(dir, name)}
+		}
+		found := false
+		for _, file := range candidates {
+			if got, err := sha256File(file); err == nil && got == sum {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s of %s is missing or was modified", name, phase)
+		}
+	}
+	return nil
+}
+
+// phaseArgs returns the builder command line of a phase, or nil if the
+// phase has nothing to do.
+func phaseArgs(phase, dir string) ([]string, error) {
+	switch phase {
+	case "deps":
+		return []string{"deps", "--strict"}, nil
+	case "build":
+		return []string{"build"}, nil
+	case "artifacts":
+		return []string{"artifacts", "-o", dir}, nil
+	}
+	var args []string
+	for _, arg := range cfg.Pipeline.Publish {
+		if !strings.ContainsAny(arg, "*?[") {
+			args = append(args, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline.publish: %w", err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("pipeline.publish: %s matches no files", arg)
+		}
+		args = append(args, matches...)
+	}
+	return args, nil
+}
+
+// newPipelineCmd creates the 'pipeline' command.
+func newPipelineCmd() *cobra.Command {
+	var skip []string
+	var from, artifactsDir string
+	cmd := &cobra.Command{
+		Use:   "pipeline",
+		Short: "Runs deps, build, artifacts and publish, resuming after recorded phases.",
+		Long: `Runs the phases of a package job in the current directory: deps (deps --strict),
+build, artifacts (into --artifacts-dir) and publish, the builder command line
+of pipeline.publish (e.g. [publish, packages, artifacts/*.pkg.tar.zst]; publish is
+skipped when it is not set). Globs in it are expanded.
+
+The outcome of every phase is recorded in ` + pipelineStateFile + `, so a failed
+artifacts or publish phase can be retried with --from without rebuilding.
+Phases before --from are skipped if their recorded products still match the
+current build inputs and files; --skip leaves out phases without any check,
+e.g. deps in an image that has them installed.`,
+		Example: `  builder pipeline
+  builder pipeline --skip deps --from artifacts
+  builder pipeline --from publish`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, phase := range append(slices.Clone(skip), from) {
+				if phase != "" && !slices.Contains(pipelinePhases, phase) {
+					return errorf(errConfig, "unknown phase %q (one of %s)", phase, strings.Join(pipelinePhases, ", "))
+				}
+			}
+			self, err := os.Executable()
+			if err != nil {
+				return errorf(errGeneral, "could not find the builder executable: %w", err)
+			}
+			childArgs, err := childBuilderArgs(cmd)
+			if err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+			state, err := readPipelineState()
+			if err != nil {
+				return errorf(errGeneral, "%w", err)
+			}
+			fingerprint, err := buildFingerprint()
+			if err != nil {
+				return errorf(errParse, "%w", err)
+			}
+
+			start := 0
+			if from != "" {
+				start = slices.Index(pipelinePhases, from)
+			}
+			for i, phase := range pipelinePhases {
+				switch {
+				case slices.Contains(skip, phase):
+					log.Printf("=== %s: skipped ===", phase)
+					continue
+				case i < start:
+					if err := checkResumable(state, phase, fingerprint, artifactsDir); err != nil {
+						return &builderError{
+							Category: errConfig,
+							Err:      fmt.Errorf("cannot resume from %s: %w", from, err),
+							Hint:     fmt.Sprintf("Run the pipeline from %s again, or --skip it if you know its results are in place.", phase),
+						}
+					}
+					ps := state.Phases[phase]
+					if ps != nil {
+						log.Printf("=== %s: done at %s ===", phase, ps.FinishedAt.Local().Format(time.DateTime))
+					} else {
+						log.Printf("=== %s: assumed done ===", phase)
+					}
+					continue
+				}
+
+				phaseCmd, err := phaseArgs(phase, artifactsDir)
+				if err != nil {
+					return errorf(errConfig, "%w", err)
+				}
+				if phaseCmd == nil {
+					log.Printf("=== %s: nothing to do (pipeline.publish is not set) ===", phase)
+					continue
+				}
+				setPhase(phase)
+				log.Printf("=== %s ===", phase)
+				// A new run of a phase invalidates those after it
+				for _, later := range pipelinePhases[i:] {
+					delete(state.Phases, later)
+				}
+				runErr := newCommand(cmd.Context(), self, append(slices.Clone(childArgs), phaseCmd...)...).Run()
+				ps := &phaseState{Result: resultSuccess, FinishedAt: time.Now().UTC(), Fingerprint: fingerprint}
+				switch {
+				case cmd.Context().Err() != nil:
+					ps.Result = resultCancelled
+				case runErr != nil:
+					ps.Result = resultFailed
+				default:
+					ps.Files = artifactChecksums(phaseFiles(phase, artifactsDir))
+				}
+				if phase == "build" && ps.Result == resultSuccess {
+					// pkgver() may have rewritten the PKGBUILD
+					if fp, err := buildFingerprint(); err == nil {
+						ps.Fingerprint, fingerprint = fp, fp
+					}
+				}
+				state.Phases[phase] = ps
+				if err := state.write(); err != nil {
+					log.Printf("Warning: could not record the %s phase: %v", phase, err)
+				}
+				if cmd.Context().Err() != nil {
+					return errorf(errCancelled, "cancelled during %s", phase)
+				}
+				if runErr != nil {
+					cat := errGeneral
+					var exitErr *exec.ExitError
+					if errors.As(runErr, &exitErr) {
+						cat = categoryOfExitCode(exitErr.ExitCode())
+					}
+					return &builderError{
+						Category: cat,
+						Err:      fmt.Errorf("%s failed: %w", phase, runErr),
+						Hint:     fmt.Sprintf("Fix the problem and retry with 'builder pipeline --from %s'.", phase),
+					}
+				}
+			}
+			log.Printf("Pipeline finished: %s", strings.Join(slices.Sorted(maps.Keys(state.Phases)), ", "))
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&skip, "skip", nil, "Phase to leave out (repeatable): "+strings.Join(pipelinePhases, ", "))
+	cmd.Flags().StringVar(&from, "from", "", "Phase to resume from; earlier phases must have succeeded with the current inputs")
+	cmd.Flags().StringVar(&artifactsDir, "artifacts-dir", "artifacts", "Directory the artifacts phase collects into")
+	for _, name := range []string{"skip", "from"} {
+		cmd.RegisterFlagCompletionFunc(name, func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return pipelinePhases, cobra.ShellCompDirectiveNoFileComp
+		})
+	}
+	return cmd
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultJobTemplate is the job of a package when no --template is given.
+const defaultJobTemplate = `script:
+  - cd "{{.Dir}}"
+  - builder deps --strict
+  - builder build
+  - builder artifacts -o "$CI_PROJECT_DIR/artifacts/{{.Name}}"
+artifacts:
+  when: always
+  paths:
+    - artifacts/{{.Name}}/
+`
+
+// pipelineJob is the data a job template is rendered with.
+type pipelineJob struct {
+	// Name is the pkgbase, or pkgname if there is none
+	Name string
+	// Dir is the PKGBUILD directory relative to the workspace
+	Dir string
+	// Job is the name of the job
+	Job string
+	// Needs holds the jobs of the packages this one depends on
+	Needs []string
+	// Maintainers are those of the package, see packageMaintainers
+	Maintainers []string
+	// Stage and Priority are package.stage and package.priority
+	Stage    int
+	Priority int
+}
+
+// changedFiles returns the files changed since base, relative to dir. base
+// defaults to the merge request diff base or the commit before the push.
+func changedFiles(ctx context.Context, dir, base string) ([]string, error) {
+	if base == "" {
+		base = os.Getenv("CI_MERGE_REQUEST_DIFF_BASE_SHA")
+	}
+	if before := os.Getenv("CI_COMMIT_BEFORE_SHA"); base == "" && strings.Trim(before, "0") != "" {
+		base = before
+	}
+	if base == "" {
+		base = "HEAD~1"
+	}
+	debugPrint("Listing files changed since %s", base)
+	cmd := newCommand(ctx, "git", "-C", dir, "diff", "--name-only", "--relative", "-z", base, "HEAD")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list files changed since %s: %w", base, err)
+	}
+	var files []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// selectPackages returns the nodes a pipeline is generated for: all, those
+// with changed files, or those listed (by name or directory) in a file.
+func selectPackages(ctx context.Context, nodes []*pkgNode, workspace, from, base string) ([]*pkgNode, error) {
+	switch from {
+	case "all":
+		return nodes, nil
+	case "changed":
+		files, err := changedFiles(ctx, workspace, base)
+		if err != nil {
+			return nil, err
+		}
+		var selected []*pkgNode
+		for _, n := range nodes {
+			dir, _ := filepath.Rel(workspace, n.Dir)
+			if slices.ContainsFunc(files, func(f string) bool { return dir == "." || strings.HasPrefix(f, dir+"/") }) {
+				selected = append(selected, n)
+			}
+		}
+		return selected, nil
+	}
+
+	var r io.Reader = os.Stdin
+	if from != "-" {
+		f, err := os.Open(from)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var selected []*pkgNode
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := slices.IndexFunc(nodes, func(n *pkgNode) bool {
+			return n.Name == line || slices.Contains(n.Provides, line) || filepath.Clean(n.Dir) == filepath.Clean(line)
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("%s: no PKGBUILD in %s defines %s", from, workspace, line)
+		}
+		if !slices.Contains(selected, nodes[i]) {
+			selected = append(selected, nodes[i])
+		}
+	}
+	return selected, scanner.Err()
+}
+
+// renderJob renders the job template for j and adds the needs of j to those
+// the template declares.
+func renderJob(tmpl *template.Template, j pipelineJob) (*yaml.Node, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, j); err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		return nil, fmt.Errorf("template output for %s is not valid YAML: %w", j.Name, err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("template output for %s is not a job mapping", j.Name)
+	}
+	job := doc.Content[0]
+	if len(j.Needs) == 0 {
+		return job, nil
+	}
+	var needs *yaml.Node
+	for i := 0; i+1 < len(job.Content); i += 2 {
+		if job.Content[i].Value == "needs" {
+			needs = job.Content[i+1]
+		}
+	}
+	if needs == nil {
+		needs = &yaml.Node{Kind: yaml.SequenceNode}
+		job.Content = append(job.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "needs"}, needs)
+	}
+	if needs.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("template output for %s: needs is not a list", j.Name)
+	}
+	for _, n := range j.Needs {
+		needs.Content = append(needs.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: n})
+	}
+	return job, nil
+}
+
+// newGeneratePipelineCmd creates the 'generate-pipeline' command.
+func newGeneratePipelineCmd() *cobra.Command {
+	var workspace, from, base, templateFile, prefix, output, selection string
+	var withDependents, includeQuarantined bool
+	cmd := &cobra.Command{
+		Use:   "generate-pipeline",
+		Short: "Generates a GitLab child pipeline with a job per package.",
+		Long: `Writes the YAML of a GitLab dynamic child pipeline with one job per affected
+package below --workspace. --packages-from selects the packages: changed (those
+with files changed since --base, by default the merge request diff base or the
+commit before the push), all, or a file (- for stdin) listing package names or
+directories, e.g. the output of rebuild-list. With --with-dependents the
+packages depending on them are added as well. --select restricts all of this
+to the packages matching a selection, by the package.labels of their
+.pkgbuilder.yaml or their name:, group:, dir: or status:. Packages with a
+package.status of broken or on-hold get no job and are reported, unless
+--include-quarantined is given.
+
+Each job is rendered from --template, a Go template of the job mapping with
+.Name (pkgbase), .Dir, .Job, .Needs, .Maintainers (see 'report mr'), .Stage
+and .Priority. The jobs of the packages a package depends on, and those of the
+previous package.stage of the .pkgbuilder.yaml files, are added to its needs,
+so the pipeline builds in dependency and stage order. Jobs are written by
+stage, then by descending package.priority where dependencies allow.
+Without affected packages a single no-op job is written, as GitLab rejects
+empty pipelines.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			text := defaultJobTemplate
+			if templateFile != "" {
+				data, err := os.ReadFile(templateFile)
+				if err != nil {
+					return errorf(errConfig, "could not read job template: %w", err)
+				}
+				text = string(data)
+			}
+			tmpl, err := template.New("job").Option("missingkey=error").Parse(text)
+			if err != nil {
+				return errorf(errConfig, "invalid job template: %w", err)
+			}
+
+			nodes, err := workspaceNodes(workspace)
+			if err != nil {
+				return errorf(errGeneral, "could not scan workspace %s: %w", workspace, err)
+			}
+			if nodes, err = selectNodes(selection, nodes); err != nil {
+				return err
+			}
+			selected, err := selectPackages(cmd.Context(), nodes, workspace, from, base)
+			if err != nil {
+				return errorf(errGeneral, "%w", err)
+			}
+			if withDependents {
+				var names []string
+				for _, n := range selected {
+					names = append(names, n.Provides...)
+				}
+				for _, n := range dependents(nodes, names, true) {
+					if !slices.Contains(selected, n) {
+						selected = append(selected, n)
+					}
+				}
+			}
+			if !includeQuarantined {
+				selected = skipQuarantined(selected)
+			}
+			order, cyclic := buildOrder(selected)
+			if len(cyclic) > 0 {
+				var names []string
+				for _, n := range cyclic {
+					names = append(names, n.Name)
+				}
+				return errorf(errConfig, "dependency cycle, or dependency on a later package.stage, between %s; their jobs cannot be ordered", strings.Join(names, ", "))
+			}
+
+			provider := map[string]*pkgNode{}
+			for _, n := range order {
+				for _, p := range n.Provides {
+					provider[p] = n
+				}
+			}
+			root := &yaml.Node{Kind: yaml.MappingNode}
+			// The jobs of a stage need those of the stage before, since the
+			// order is sorted by stage
+			var stageJobs, prevStageJobs []string
+			for i, n := range order {
+				if i > 0 && order[i-1].Stage != n.Stage {
+					prevStageJobs, stageJobs = stageJobs, nil
+				}
+				dir, _ := filepath.Rel(workspace, n.Dir)
+				j := pipelineJob{Name: n.Name, Dir: dir, Job: prefix + n.Name, Maintainers: packageMaintainers(n.Dir), Stage: n.Stage, Priority: n.Priority}
+				for _, d := range n.Depends {
+					if p, ok := provider[d]; ok && p != n && !slices.Contains(j.Needs, prefix+p.Name) {
+						j.Needs = append(j.Needs, prefix+p.Name)
+					}
+				}
+				for _, job := range prevStageJobs {
+					if !slices.Contains(j.Needs, job) {
+						j.Needs = append(j.Needs, job)
+					}
+				}
+				stageJobs = append(stageJobs, j.Job)
+				job, err := renderJob(tmpl, j)
+				if err != nil {
+					return errorf(errConfig, "%w", err)
+				}
+				root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: j.Job}, job)
+				log.Printf("  Job: %s (needs %d)", j.Job, len(j.Needs))
+			}
+			if len(order) == 0 {
+				log.Println("No affected packages, writing a no-op pipeline.")
+				var noop yaml.Node
+				yaml.Unmarshal([]byte("script:\n  - echo \"No packages to build\"\n"), &noop)
+				root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: prefix + "nothing"}, noop.Content[0])
+			}
+			root.HeadComment = "Generated by builder generate-pipeline; do not edit."
+
+			var buf bytes.Buffer
+			enc := yaml.NewEncoder(&buf)
+			enc.SetIndent(2)
+			if err := enc.Encode(root); err != nil {
+				return errorf(errGeneral, "could not encode the pipeline: %w", err)
+			}
+			enc.Close()
+			if output == "" || output == "-" {
+				_, err = os.Stdout.Write(buf.Bytes())
+				return err
+			}
+			if err := os.WriteFile(output, buf.Bytes(), 0644); err != nil {
+				return errorf(errArtifact, "could not write %s: %w", output, err)
+			}
+			log.Printf("Wrote %d job(s) to %s", len(order), output)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&workspace, "workspace", ".", "Directory containing the package sources")
+	cmd.Flags().StringVar(&from, "packages-from", "changed", "Packages to generate jobs for: changed, all, or a file listing them (- for stdin)")
+	cmd.Flags().StringVar(&base, "base", "", "Revision to detect changes against (default: merge request diff base or previous commit)")
+	cmd.Flags().StringVar(&templateFile, "template", "", "Go template of a job (default: deps, build and artifacts of the package)")
+	cmd.Flags().StringVar(&prefix, "job-prefix", "build:", "Prefix of the job names")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the pipeline to (default stdout)")
+	cmd.Flags().BoolVar(&withDependents, "with-dependents", false, "Also generate jobs for the packages depending on the selected ones")
+	cmd.Flags().BoolVar(&includeQuarantined, "include-quarantined", false, "Generate jobs for broken and on-hold packages too")
+	cmd.Flags().StringVar(&selection, "select", "", selectUsage)
+	return cmd
+}
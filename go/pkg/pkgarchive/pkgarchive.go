@@ -0,0 +1,363 @@
+// Package pkgarchive reads pacman package archives (.pkg.tar.{zst,xz,gz,bz2})
+// without shelling out to bsdtar.
+package pkgarchive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Metadata file names stored at the root of every package archive.
+const (
+	PkgInfoName   = ".PKGINFO"
+	BuildInfoName = ".BUILDINFO"
+	MTreeName     = ".MTREE"
+	InstallName   = ".INSTALL"
+	ChangelogName = ".CHANGELOG"
+)
+
+// errStop ends a Walk early without reporting an error.
+var errStop = errors.New("stop walking archive")
+
+// File describes a single entry of the package file list.
+type File struct {
+	Path     string
+	Mode     fs.FileMode
+	Size     int64
+	Uid      int
+	Gid      int
+	Uname    string
+	Gname    string
+	Linkname string
+	ModTime  time.Time
+}
+
+// PkgInfo holds the fields of a .PKGINFO file.
+type PkgInfo struct {
+	PkgName      string
+	PkgBase      string
+	PkgVer       string
+	PkgDesc      string
+	URL          string
+	BuildDate    int64
+	Packager     string
+	Size         int64
+	Arch         string
+	License      []string
+	Groups       []string
+	Depends      []string
+	OptDepends   []string
+	MakeDepends  []string
+	CheckDepends []string
+	Provides     []string
+	Conflicts    []string
+	Replaces     []string
+	Backup       []string
+
+	// Fields contains every key of the file, including unknown ones.
+	Fields map[string][]string
+}
+
+// Archive is the parsed content of a package archive.
+type Archive struct {
+	Path      string
+	Info      *PkgInfo
+	BuildInfo map[string][]string
+	// MTree is the decompressed .MTREE content.
+	MTree   []byte
+	Install []byte
+	// Files lists the package payload, excluding the metadata files.
+	Files []File
+}
+
+// zstdDecoders are reused across archives. Creating a decoder allocates its
+// window buffers, which dominates reading the .PKGINFO of many packages, e.g.
+// when verifying or indexing a whole workspace.
+var zstdDecoders sync.Pool
+
+// pooledDecoder returns its zstd decoder to zstdDecoders when closed.
+type pooledDecoder struct {
+	*zstd.Decoder
+}
+
+func (d pooledDecoder) Close() error {
+	d.Decoder.Reset(nil)
+	zstdDecoders.Put(d.Decoder)
+	return nil
+}
+
+// newZstdReader returns a pooled zstd decoder reading r. It decodes
+// synchronously, so stopping after the metadata entries does not decompress
+// the payload ahead in the background.
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	if dec, ok := zstdDecoders.Get().(*zstd.Decoder); ok {
+		if err := dec.Reset(r); err != nil {
+			return nil, err
+		}
+		return pooledDecoder{dec}, nil
+	}
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return pooledDecoder{dec}, nil
+}
+
+// NewReader wraps r into a decompressing reader, detecting zstd, xz, gzip
+// and bzip2 by their magic bytes. Uncompressed data is passed through.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not read archive header: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		dec, err := newZstdReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("could not create zstd reader: %w", err)
+		}
+		return dec, nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		dec, err := xz.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("could not create xz reader: %w", err)
+		}
+		return io.NopCloser(dec), nil
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		dec, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("could not create gzip reader: %w", err)
+		}
+		return dec, nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// Walk calls fn for every entry of the archive at path. The reader passed to
+// fn is only valid until fn returns.
+func Walk(path string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open package archive: %w", err)
+	}
+	defer f.Close()
+
+	dec, err := NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer dec.Close()
+
+	tr := tar.NewReader(dec)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read package archive %s: %w", path, err)
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Open reads the metadata and file list of the package archive at path.
+func Open(path string) (*Archive, error) {
+	a := &Archive{Path: path}
+	err := Walk(path, func(hdr *tar.Header, r io.Reader) error {
+		name := strings.TrimPrefix(hdr.Name, "./")
+		switch name {
+		case PkgInfoName:
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("could not read %s: %w", name, err)
+			}
+			a.Info = ParsePkgInfo(data)
+		case BuildInfoName:
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("could not read %s: %w", name, err)
+			}
+			a.BuildInfo = parseKeyValues(data)
+		case MTreeName:
+			dec, err := NewReader(r)
+			if err != nil {
+				return fmt.Errorf("could not read %s: %w", name, err)
+			}
+			defer dec.Close()
+			if a.MTree, err = io.ReadAll(dec); err != nil {
+				return fmt.Errorf("could not read %s: %w", name, err)
+			}
+		case InstallName:
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("could not read %s: %w", name, err)
+			}
+			a.Install = data
+		case ChangelogName:
+		default:
+			a.Files = append(a.Files, File{
+				Path:     name,
+				Mode:     hdr.FileInfo().Mode(),
+				Size:     hdr.Size,
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				Uname:    hdr.Uname,
+				Gname:    hdr.Gname,
+				Linkname: hdr.Linkname,
+				ModTime:  hdr.ModTime,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if a.Info == nil {
+		return nil, fmt.Errorf("%s: no %s found, not a pacman package", path, PkgInfoName)
+	}
+	return a, nil
+}
+
+// ReadPkgInfo reads only the .PKGINFO of the package archive at path.
+func ReadPkgInfo(path string) (*PkgInfo, error) {
+	var info *PkgInfo
+	err := Walk(path, func(hdr *tar.Header, r io.Reader) error {
+		if strings.TrimPrefix(hdr.Name, "./") != PkgInfoName {
+			return nil
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", PkgInfoName, err)
+		}
+		info = ParsePkgInfo(data)
+		// .PKGINFO is the first entry; stop instead of decompressing the payload
+		return errStop
+	})
+	if err != nil && err != errStop {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("%s: no %s found, not a pacman package", path, PkgInfoName)
+	}
+	return info, nil
+}
+
+// ReadChangelog reads only the .CHANGELOG of the package archive at path;
+// it returns nil when the package has none.
+func ReadChangelog(path string) ([]byte, error) {
+	return readMetadataFile(path, ChangelogName)
+}
+
+// ReadBuildInfo reads only the .BUILDINFO of the package archive at path;
+// it returns nil when the package has none.
+func ReadBuildInfo(path string) (map[string][]string, error) {
+	data, err := readMetadataFile(path, BuildInfoName)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return parseKeyValues(data), nil
+}
+
+// readMetadataFile reads the metadata file name of the package archive at
+// path without decompressing the payload.
+func readMetadataFile(path, name string) ([]byte, error) {
+	var content []byte
+	err := Walk(path, func(hdr *tar.Header, r io.Reader) error {
+		entry := strings.TrimPrefix(hdr.Name, "./")
+		if !strings.HasPrefix(entry, ".") {
+			// Metadata files come first, makepkg sorts them before the payload
+			return errStop
+		}
+		if entry != name {
+			return nil
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", name, err)
+		}
+		content = data
+		return errStop
+	})
+	if err != nil && err != errStop {
+		return nil, err
+	}
+	return content, nil
+}
+
+// ParsePkgInfo parses the content of a .PKGINFO file.
+func ParsePkgInfo(data []byte) *PkgInfo {
+	fields := parseKeyValues(data)
+	get := func(key string) string {
+		if v := fields[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	num := func(key string) int64 {
+		n, _ := strconv.ParseInt(get(key), 10, 64)
+		return n
+	}
+
+	return &PkgInfo{
+		PkgName:      get("pkgname"),
+		PkgBase:      get("pkgbase"),
+		PkgVer:       get("pkgver"),
+		PkgDesc:      get("pkgdesc"),
+		URL:          get("url"),
+		BuildDate:    num("builddate"),
+		Packager:     get("packager"),
+		Size:         num("size"),
+		Arch:         get("arch"),
+		License:      fields["license"],
+		Groups:       fields["group"],
+		Depends:      fields["depend"],
+		OptDepends:   fields["optdepend"],
+		MakeDepends:  fields["makedepend"],
+		CheckDepends: fields["checkdepend"],
+		Provides:     fields["provides"],
+		Conflicts:    fields["conflict"],
+		Replaces:     fields["replaces"],
+		Backup:       fields["backup"],
+		Fields:       fields,
+	}
+}
+
+// parseKeyValues parses the "key = value" format shared by .PKGINFO and .BUILDINFO.
+func parseKeyValues(data []byte) map[string][]string {
+	fields := map[string][]string{}
+	for line := range strings.SplitSeq(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		fields[key] = append(fields[key], strings.TrimSpace(val))
+	}
+	return fields
+}
@@ -0,0 +1,457 @@
+// Package repodb reads and writes pacman repository databases
+// (<repo>.db.tar.* and <repo>.files.tar.*) natively, replacing repo-add.
+package repodb
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+// Entry is a single package of a repository database.
+type Entry struct {
+	Filename     string
+	Name         string
+	Base         string
+	Version      string
+	Desc         string
+	Groups       []string
+	CSize        int64
+	ISize        int64
+	MD5Sum       string
+	SHA256Sum    string
+	PGPSig       string
+	URL          string
+	License      []string
+	Arch         string
+	BuildDate    int64
+	Packager     string
+	Replaces     []string
+	Conflicts    []string
+	Provides     []string
+	Depends      []string
+	OptDepends   []string
+	MakeDepends  []string
+	CheckDepends []string
+
+	// Files is only populated from (and written to) the files database.
+	Files []string
+}
+
+// DB is an in-memory repository database keyed by package name.
+type DB struct {
+	Entries map[string]*Entry
+	// ModTime is the modification time of the archive entries written by
+	// Write, the current time if zero; set it for reproducible databases
+	ModTime time.Time
+}
+
+// New returns an empty database.
+func New() *DB {
+	return &DB{Entries: map[string]*Entry{}}
+}
+
+// FilesPath returns the files database path belonging to a db path,
+// e.g. repo.db.tar.gz becomes repo.files.tar.gz.
+func FilesPath(dbPath string) string {
+	dir, base := filepath.Split(dbPath)
+	if i := strings.LastIndex(base, ".db"); i >= 0 {
+		return filepath.Join(dir, base[:i]+".files"+base[i+3:])
+	}
+	return dbPath + ".files"
+}
+
+// Read loads the database at dbPath. When the matching files database
+// exists it is read instead so that file lists are kept.
+func Read(dbPath string) (*DB, error) {
+	path := dbPath
+	if _, err := os.Stat(FilesPath(dbPath)); err == nil {
+		path = FilesPath(dbPath)
+	}
+	return ReadFile(path)
+}
+
+// ReadFile loads exactly the database archive at path, for example a pacman
+// sync database without its much larger files database.
+func ReadFile(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open repository database: %w", err)
+	}
+	defer f.Close()
+
+	r, err := pkgarchive.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress repository database %s: %w", path, err)
+	}
+	defer r.Close()
+
+	entries := map[string]map[string][]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read repository database %s: %w", path, err)
+		}
+		dir, name := filepath.Split(strings.TrimSuffix(hdr.Name, "/"))
+		if hdr.Typeflag != tar.TypeReg || dir == "" {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s from repository database: %w", hdr.Name, err)
+		}
+		switch name {
+		case "desc", "depends", "files":
+			fields, ok := entries[dir]
+			if !ok {
+				fields = map[string][]string{}
+				entries[dir] = fields
+			}
+			for k, v := range ParseDesc(string(data)) {
+				fields[k] = append(fields[k], v...)
+			}
+		}
+	}
+
+	db := New()
+	for _, fields := range entries {
+		e := entryFromFields(fields)
+		if e.Name != "" {
+			db.Entries[e.Name] = e
+		}
+	}
+	return db, nil
+}
+
+// ParseDesc splits a desc/files/depends file into its %SECTION% value lists.
+func ParseDesc(content string) map[string][]string {
+	fields := map[string][]string{}
+	var section string
+	for line := range strings.SplitSeq(content, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			section = ""
+		case strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") && len(line) > 2:
+			section = strings.Trim(line, "%")
+		case section != "":
+			fields[section] = append(fields[section], line)
+		}
+	}
+	return fields
+}
+
+func entryFromFields(fields map[string][]string) *Entry {
+	get := func(key string) string {
+		if v := fields[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	num := func(key string) int64 {
+		n, _ := strconv.ParseInt(get(key), 10, 64)
+		return n
+	}
+	return &Entry{
+		Filename:     get("FILENAME"),
+		Name:         get("NAME"),
+		Base:         get("BASE"),
+		Version:      get("VERSION"),
+		Desc:         get("DESC"),
+		Groups:       fields["GROUPS"],
+		CSize:        num("CSIZE"),
+		ISize:        num("ISIZE"),
+		MD5Sum:       get("MD5SUM"),
+		SHA256Sum:    get("SHA256SUM"),
+		PGPSig:       get("PGPSIG"),
+		URL:          get("URL"),
+		License:      fields["LICENSE"],
+		Arch:         get("ARCH"),
+		BuildDate:    num("BUILDDATE"),
+		Packager:     get("PACKAGER"),
+		Replaces:     fields["REPLACES"],
+		Conflicts:    fields["CONFLICTS"],
+		Provides:     fields["PROVIDES"],
+		Depends:      fields["DEPENDS"],
+		OptDepends:   fields["OPTDEPENDS"],
+		MakeDepends:  fields["MAKEDEPENDS"],
+		CheckDepends: fields["CHECKDEPENDS"],
+		Files:        fields["FILES"],
+	}
+}
+
+// EntryFromPackage builds a database entry from a package archive, including
+// checksums and the detached signature (<pkg>.sig) when present.
+func EntryFromPackage(pkgFile string) (*Entry, error) {
+	a, err := pkgarchive.Open(pkgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(pkgFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not open package: %w", err)
+	}
+	defer f.Close()
+	md5h, sha256h := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5h, sha256h), f)
+	if err != nil {
+		return nil, fmt.Errorf("could not checksum %s: %w", pkgFile, err)
+	}
+
+	info := a.Info
+	e := &Entry{
+		Filename:     filepath.Base(pkgFile),
+		Name:         info.PkgName,
+		Base:         info.PkgBase,
+		Version:      info.PkgVer,
+		Desc:         info.PkgDesc,
+		Groups:       info.Groups,
+		CSize:        size,
+		ISize:        info.Size,
+		MD5Sum:       hex.EncodeToString(md5h.Sum(nil)),
+		SHA256Sum:    hex.EncodeToString(sha256h.Sum(nil)),
+		URL:          info.URL,
+		License:      info.License,
+		Arch:         info.Arch,
+		BuildDate:    info.BuildDate,
+		Packager:     info.Packager,
+		Replaces:     info.Replaces,
+		Conflicts:    info.Conflicts,
+		Provides:     info.Provides,
+		Depends:      info.Depends,
+		OptDepends:   info.OptDepends,
+		MakeDepends:  info.MakeDepends,
+		CheckDepends: info.CheckDepends,
+	}
+	if sig, err := os.ReadFile(pkgFile + ".sig"); err == nil {
+		e.PGPSig = base64.StdEncoding.EncodeToString(sig)
+	}
+	for _, file := range a.Files {
+		path := file.Path
+		if file.Mode.IsDir() && !strings.HasSuffix(path, "/") {
+			path += "/"
+		}
+		e.Files = append(e.Files, path)
+	}
+	sort.Strings(e.Files)
+	return e, nil
+}
+
+// Add inserts or replaces the entry for e.Name and returns the replaced entry, if any.
+func (db *DB) Add(e *Entry) *Entry {
+	old := db.Entries[e.Name]
+	db.Entries[e.Name] = e
+	return old
+}
+
+// Remove deletes the named package and reports whether it was present.
+func (db *DB) Remove(name string) bool {
+	_, ok := db.Entries[name]
+	delete(db.Entries, name)
+	return ok
+}
+
+// Names returns the package names in sorted order.
+func (db *DB) Names() []string {
+	names := make([]string, 0, len(db.Entries))
+	for name := range db.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// desc renders the desc file of an entry in the layout used by repo-add.
+func (e *Entry) desc() []byte {
+	var b strings.Builder
+	section := func(name string, values ...string) {
+		var nonEmpty []string
+		for _, v := range values {
+			if v != "" {
+				nonEmpty = append(nonEmpty, v)
+			}
+		}
+		if len(nonEmpty) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "%%%s%%\n%s\n\n", name, strings.Join(nonEmpty, "\n"))
+	}
+	number := func(n int64) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.FormatInt(n, 10)
+	}
+
+	section("FILENAME", e.Filename)
+	section("NAME", e.Name)
+	section("BASE", e.Base)
+	section("VERSION", e.Version)
+	section("DESC", e.Desc)
+	section("GROUPS", e.Groups...)
+	section("CSIZE", number(e.CSize))
+	section("ISIZE", number(e.ISize))
+	section("MD5SUM", e.MD5Sum)
+	section("SHA256SUM", e.SHA256Sum)
+	section("PGPSIG", e.PGPSig)
+	section("URL", e.URL)
+	section("LICENSE", e.License...)
+	section("ARCH", e.Arch)
+	section("BUILDDATE", number(e.BuildDate))
+	section("PACKAGER", e.Packager)
+	section("REPLACES", e.Replaces...)
+	section("CONFLICTS", e.Conflicts...)
+	section("PROVIDES", e.Provides...)
+	section("DEPENDS", e.Depends...)
+	section("OPTDEPENDS", e.OptDepends...)
+	section("MAKEDEPENDS", e.MakeDepends...)
+	section("CHECKDEPENDS", e.CheckDepends...)
+	return []byte(b.String())
+}
+
+// files renders the files file of an entry.
+func (e *Entry) files() []byte {
+	if len(e.Files) == 0 {
+		return []byte("%FILES%\n\n")
+	}
+	return []byte("%FILES%\n" + strings.Join(e.Files, "\n") + "\n\n")
+}
+
+// Write atomically writes the database to dbPath and the files database next
+// to it, and points the <repo>.db / <repo>.files symlinks at them.
+func (db *DB) Write(dbPath string) error {
+	if err := db.writeArchive(dbPath, false); err != nil {
+		return err
+	}
+	if err := db.writeArchive(FilesPath(dbPath), true); err != nil {
+		return err
+	}
+	for _, path := range []string{dbPath, FilesPath(dbPath)} {
+		if err := updateSymlink(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeArchive writes one database archive via a temporary file and rename.
+func (db *DB) writeArchive(path string, withFiles bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("could not create temporary database file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	cw, err := newCompressor(tmp, path)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	now := db.ModTime
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	writeFile := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	for _, name := range db.Names() {
+		e := db.Entries[name]
+		dir := e.Name + "-" + e.Version + "/"
+		if err := tw.WriteHeader(&tar.Header{Name: dir, Mode: 0755, ModTime: now, Typeflag: tar.TypeDir}); err != nil {
+			return fmt.Errorf("could not write database entry %s: %w", dir, err)
+		}
+		if err := writeFile(dir+"desc", e.desc()); err != nil {
+			return fmt.Errorf("could not write database entry %s: %w", dir, err)
+		}
+		if withFiles {
+			if err := writeFile(dir+"files", e.files()); err != nil {
+				return fmt.Errorf("could not write database entry %s: %w", dir, err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("could not finish database archive: %w", err)
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("could not finish database compression: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("could not sync database file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not close database file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("could not set database permissions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not replace database %s: %w", path, err)
+	}
+	return nil
+}
+
+// newCompressor picks the compression from the file extension, defaulting to gzip.
+func newCompressor(w io.Writer, path string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(path, ".zst"):
+		return zstd.NewWriter(w)
+	case strings.HasSuffix(path, ".xz"):
+		return xz.NewWriter(w)
+	case strings.HasSuffix(path, ".tar"):
+		return nopWriteCloser{w}, nil
+	}
+	return gzip.NewWriter(w), nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// updateSymlink points <repo>.db at <repo>.db.tar.* (and likewise for .files).
+func updateSymlink(path string) error {
+	base := filepath.Base(path)
+	i := strings.Index(base, ".tar")
+	if i < 0 {
+		return nil
+	}
+	link := filepath.Join(filepath.Dir(path), base[:i])
+	tmpLink := link + ".tmp-link"
+	os.Remove(tmpLink)
+	if err := os.Symlink(base, tmpLink); err != nil {
+		return fmt.Errorf("could not create symlink %s: %w", link, err)
+	}
+	if err := os.Rename(tmpLink, link); err != nil {
+		return fmt.Errorf("could not replace symlink %s: %w", link, err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package repodb
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFilesPath(t *testing.T) {
+	for dbPath, want := range map[string]string{
+		"repo.db.tar.gz":              "repo.files.tar.gz",
+		"/srv/x86_64/core.db.tar.zst": "/srv/x86_64/core.files.tar.zst",
+		"my.db.repo.db.tar.xz":        "my.db.repo.files.tar.xz",
+		"repo.db":                     "repo.files",
+		"repo":                        "repo.files",
+	} {
+		if got := FilesPath(dbPath); got != want {
+			t.Errorf("FilesPath(%q) = %q, want %q", dbPath, got, want)
+		}
+	}
+}
+
+// testEntries returns entries using every field of the desc and files
+// entries.
+func testEntries() []*Entry {
+	return []*Entry{
+		{
+			Filename:     "foo-1:1.2.3-1-x86_64.pkg.tar.zst",
+			Name:         "foo",
+			Base:         "foo-base",
+			Version:      "1:1.2.3-1",
+			Desc:         "A package with a description",
+			Groups:       []string{"base-devel", "tools"},
+			CSize:        1234,
+			ISize:        56789,
+			MD5Sum:       "d41d8cd98f00b204e9800998ecf8427e",
+			SHA256Sum:    "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			PGPSig:       "iQEzBAABCAAdFiEE",
+			URL:          "https://example.com/foo",
+			License:      []string{"MIT", "Apache-2.0"},
+			Arch:         "x86_64",
+			BuildDate:    1700000000,
+			Packager:     "Someone <someone@example.com>",
+			Replaces:     []string{"foo-old"},
+			Conflicts:    []string{"foo-git"},
+			Provides:     []string{"libfoo.so=1-64"},
+			Depends:      []string{"glibc", "openssl>=3"},
+			OptDepends:   []string{"bash: completion"},
+			MakeDepends:  []string{"cmake"},
+			CheckDepends: []string{"python"},
+			Files:        []string{"usr/", "usr/bin/", "usr/bin/foo"},
+		},
+		{
+			Filename: "bar-2.0-1-any.pkg.tar.zst",
+			Name:     "bar",
+			Version:  "2.0-1",
+			Arch:     "any",
+		},
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, ext := range []string{".tar.gz", ".tar.zst", ".tar.xz", ".tar"} {
+		t.Run(ext, func(t *testing.T) {
+			dir := t.TempDir()
+			dbPath := filepath.Join(dir, "repo.db"+ext)
+			db := New()
+			db.ModTime = time.Unix(1700000000, 0)
+			for _, e := range testEntries() {
+				db.Add(e)
+			}
+			if err := db.Write(dbPath); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+
+			// Read prefers the files database, which keeps the file lists
+			got, err := Read(dbPath)
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if !slices.Equal(got.Names(), []string{"bar", "foo"}) {
+				t.Fatalf("Names() = %q", got.Names())
+			}
+			for _, want := range testEntries() {
+				if !reflect.DeepEqual(got.Entries[want.Name], want) {
+					t.Errorf("entry %s = %+v, want %+v", want.Name, got.Entries[want.Name], want)
+				}
+			}
+
+			only, err := ReadFile(dbPath)
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if foo := only.Entries["foo"]; foo == nil || foo.Files != nil || foo.Version != "1:1.2.3-1" {
+				t.Errorf("entry foo of the database = %+v, want no files", foo)
+			}
+
+			for link, target := range map[string]string{"repo.db": "repo.db" + ext, "repo.files": "repo.files" + ext} {
+				if got, err := os.Readlink(filepath.Join(dir, link)); err != nil || got != target {
+					t.Errorf("%s -> %q (%v), want %q", link, got, err, target)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteReplace(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "repo.db.tar.gz")
+	db := New()
+	for _, e := range testEntries() {
+		db.Add(e)
+	}
+	if err := db.Write(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Remove("bar") || db.Remove("bar") {
+		t.Fatal("Remove() did not report the removed package once")
+	}
+	if err := db.Write(dbPath); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	got, err := Read(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Names(), []string{"foo"}) {
+		t.Errorf("Names() = %q, want [foo]", got.Names())
+	}
+	// The temporary files and symlinks are renamed into place
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"repo.db", "repo.db.tar.gz", "repo.files", "repo.files.tar.gz"}; !slices.Equal(names, want) {
+		t.Errorf("directory holds %q, want %q", names, want)
+	}
+}
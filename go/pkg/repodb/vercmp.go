@@ -0,0 +1,200 @@
+package repodb
+
+import (
+	"strings"
+)
+
+// VerCmp compares two package versions ([epoch:]pkgver[-pkgrel]) like
+// pacman's vercmp: it returns -1, 0 or 1.
+func VerCmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	ea, va, ra := splitEVR(a)
+	eb, vb, rb := splitEVR(b)
+	if c := rpmVerCmp(ea, eb); c != 0 {
+		return c
+	}
+	if c := rpmVerCmp(va, vb); c != 0 {
+		return c
+	}
+	// A missing pkgrel matches any pkgrel
+	if ra == "" || rb == "" {
+		return 0
+	}
+	return rpmVerCmp(ra, rb)
+}
+
+// splitEVR splits a version into epoch, version and release.
+func splitEVR(s string) (epoch, version, release string) {
+	epoch = "0"
+	if e, rest, ok := strings.Cut(s, ":"); ok && e != "" && strings.Trim(e, "0123456789") == "" {
+		epoch, s = e, rest
+	}
+	if i := strings.LastIndex(s, "-"); i >= 0 {
+		return epoch, s[:i], s[i+1:]
+	}
+	return epoch, s, ""
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// rpmVerCmp is the segment comparison algorithm used by libalpm.
+func rpmVerCmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		// Skip separators, remembering how many were seen
+		si, sj := i, j
+		for i < len(a) && !isAlnum(a[i]) {
+			i++
+		}
+		for j < len(b) && !isAlnum(b[j]) {
+			j++
+		}
+		if i >= len(a) || j >= len(b) {
+			break
+		}
+		if i-si != j-sj {
+			if i-si < j-sj {
+				return -1
+			}
+			return 1
+		}
+
+		// Grab the next segment: all digits or all letters
+		numeric := isDigit(a[i])
+		ei, ej := i, j
+		if numeric {
+			for ei < len(a) && isDigit(a[ei]) {
+				ei++
+			}
+			for ej < len(b) && isDigit(b[ej]) {
+				ej++
+			}
+		} else {
+			for ei < len(a) && isAlnum(a[ei]) && !isDigit(a[ei]) {
+				ei++
+			}
+			for ej < len(b) && isAlnum(b[ej]) && !isDigit(b[ej]) {
+				ej++
+			}
+		}
+		segA, segB := a[i:ei], b[j:ej]
+		if segB == "" {
+			// Numeric segments are newer than alphabetic ones
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		if numeric {
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				if len(segA) > len(segB) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+		i, j = ei, ej
+	}
+
+	restA, restB := i < len(a), j < len(b)
+	switch {
+	case !restA && !restB:
+		return 0
+	// The version with a remaining alphabetic segment is older (1.0alpha < 1.0),
+	// one with a remaining numeric segment is newer (1.0.1 > 1.0)
+	case !restA:
+		if isAlnum(b[j]) && !isDigit(b[j]) {
+			return 1
+		}
+		return -1
+	default:
+		if isAlnum(a[i]) && !isDigit(a[i]) {
+			return -1
+		}
+		return 1
+	}
+}
+
+// Dependency is a parsed dependency such as "foo>=1.2".
+type Dependency struct {
+	Name    string
+	Op      string
+	Version string
+}
+
+// ParseDependency splits a dependency into name, comparison operator and version.
+func ParseDependency(dep string) Dependency {
+	if i := strings.IndexAny(dep, "<>="); i >= 0 {
+		op := dep[i : i+1]
+		if i+1 < len(dep) && dep[i+1] == '=' {
+			op = dep[i : i+2]
+		}
+		return Dependency{Name: dep[:i], Op: op, Version: dep[i+len(op):]}
+	}
+	return Dependency{Name: dep}
+}
+
+// matches reports whether version satisfies the constraint of d.
+func (d Dependency) matches(version string) bool {
+	if d.Op == "" {
+		return true
+	}
+	if version == "" {
+		return false
+	}
+	c := VerCmp(version, d.Version)
+	switch d.Op {
+	case "=":
+		return c == 0
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	}
+	return false
+}
+
+// Satisfies reports whether the entry satisfies dep by its name or one of its provides.
+func (e *Entry) Satisfies(dep Dependency) bool {
+	if e.Name == dep.Name && dep.matches(e.Version) {
+		return true
+	}
+	for _, p := range e.Provides {
+		provide := ParseDependency(p)
+		if provide.Name == dep.Name && dep.matches(provide.Version) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindSatisfier returns an entry of db that satisfies dep, or nil.
+func (db *DB) FindSatisfier(dep Dependency) *Entry {
+	if e, ok := db.Entries[dep.Name]; ok && e.Satisfies(dep) {
+		return e
+	}
+	for _, e := range db.Entries {
+		if e.Satisfies(dep) {
+			return e
+		}
+	}
+	return nil
+}
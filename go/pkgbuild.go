@@ -0,0 +1,226 @@
+package main
+
+import "strings"
+
+// pkgbuildAssignment is a top-level variable assignment found in a PKGBUILD.
+type pkgbuildAssignment struct {
+	Name    string
+	Append  bool // += instead of =
+	IsArray bool
+	Value   string
+	Values  []string
+}
+
+// pkgbuildScanner reads the top-level assignments of a PKGBUILD in a single
+// pass, the way bash would split them: it understands quotes, escapes,
+// multi-line arrays, comments, $(...) and ${...} and skips function bodies,
+// so assignments inside package() or pkgver() are not picked up. Values are
+// not expanded.
+type pkgbuildScanner struct {
+	src string
+	pos int
+}
+
+func (s *pkgbuildScanner) eof() bool { return s.pos >= len(s.src) }
+
+func (s *pkgbuildScanner) peek() byte {
+	if s.eof() {
+		return 0
+	}
+	return s.src[s.pos]
+}
+
+func isIdentByte(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+// skipLine moves past the end of the current line.
+func (s *pkgbuildScanner) skipLine() {
+	if i := strings.IndexByte(s.src[s.pos:], '\n'); i >= 0 {
+		s.pos += i + 1
+	} else {
+		s.pos = len(s.src)
+	}
+}
+
+// skipStatement moves past a statement that is not an assignment, including
+// the body of a function or any other braced block it opens.
+func (s *pkgbuildScanner) skipStatement() {
+	depth := 0
+	wordStart := true
+	for !s.eof() {
+		c := s.peek()
+		switch {
+		case c == '\'' || c == '"' || c == '\\' || c == '$':
+			s.readWord(false)
+			wordStart = false
+			continue
+		case c == '#' && wordStart:
+			s.skipLine()
+			if depth <= 0 {
+				return
+			}
+			continue
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		case c == '\n':
+			s.pos++
+			if depth <= 0 {
+				return
+			}
+			wordStart = true
+			continue
+		}
+		wordStart = c == ' ' || c == '\t' || c == ';' || c == '(' || c == '{'
+		s.pos++
+	}
+}
+
+// readQuoted reads until the closing quote and returns the unquoted text.
+func (s *pkgbuildScanner) readQuoted(quote byte) string {
+	var b strings.Builder
+	s.pos++ // opening quote
+	for !s.eof() {
+		c := s.peek()
+		s.pos++
+		switch {
+		case c == quote:
+			return b.String()
+		case c == '\\' && quote == '"' && !s.eof():
+			next := s.peek()
+			switch next {
+			case '"', '\\', '$', '`':
+				b.WriteByte(next)
+				s.pos++
+			case '\n':
+				s.pos++
+			default:
+				b.WriteByte(c)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// readNested copies an expansion such as $(...) or ${...} verbatim.
+func (s *pkgbuildScanner) readNested(b *strings.Builder, open, close byte) {
+	depth := 0
+	for !s.eof() {
+		c := s.peek()
+		b.WriteByte(c)
+		s.pos++
+		switch c {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return
+			}
+		}
+	}
+}
+
+// readWord reads one shell word, removing quotes. Inside arrays a closing
+// parenthesis ends the word.
+func (s *pkgbuildScanner) readWord(inArray bool) string {
+	var b strings.Builder
+	for !s.eof() {
+		c := s.peek()
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == ';' || c == '&' || c == '|':
+			return b.String()
+		case c == ')' && inArray:
+			return b.String()
+		case c == '\'' || c == '"':
+			b.WriteString(s.readQuoted(c))
+		case c == '\\':
+			s.pos++
+			if !s.eof() && s.peek() != '\n' {
+				b.WriteByte(s.peek())
+			}
+			s.pos++
+		case c == '$' && s.pos+1 < len(s.src) && s.src[s.pos+1] == '(':
+			b.WriteByte('$')
+			s.pos++
+			s.readNested(&b, '(', ')')
+		case c == '$' && s.pos+1 < len(s.src) && s.src[s.pos+1] == '{':
+			b.WriteByte('$')
+			s.pos++
+			s.readNested(&b, '{', '}')
+		default:
+			b.WriteByte(c)
+			s.pos++
+		}
+	}
+	return b.String()
+}
+
+// readArray reads the elements of an array up to the closing parenthesis.
+func (s *pkgbuildScanner) readArray() []string {
+	s.pos++ // (
+	values := []string{}
+	for !s.eof() {
+		switch c := s.peek(); {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			s.pos++
+		case c == ')':
+			s.pos++
+			return values
+		case c == '#':
+			s.skipLine()
+		case c == ';' || c == '&' || c == '|':
+			// A syntax error for bash; taken as a separator, as readWord stops
+			// at them without moving on
+			s.pos++
+		default:
+			values = append(values, s.readWord(true))
+		}
+	}
+	return values
+}
+
+// next returns the next top-level assignment, or false at the end.
+func (s *pkgbuildScanner) next() (pkgbuildAssignment, bool) {
+	for !s.eof() {
+		switch c := s.peek(); {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ';':
+			s.pos++
+			continue
+		case c == '#':
+			s.skipLine()
+			continue
+		}
+
+		start := s.pos
+		for !s.eof() && isIdentByte(s.peek(), s.pos == start) {
+			s.pos++
+		}
+		a := pkgbuildAssignment{Name: s.src[start:s.pos]}
+		if a.Name != "" && strings.HasPrefix(s.src[s.pos:], "+=") {
+			a.Append = true
+			s.pos++
+		}
+		if a.Name == "" || s.peek() != '=' {
+			s.pos = start
+			s.skipStatement()
+			continue
+		}
+		s.pos++ // =
+		switch s.peek() {
+		case '(':
+			a.IsArray = true
+			a.Values = s.readArray()
+		case ' ', '\t', '\n', '\r', ';', 0:
+			// Empty value
+		default:
+			a.Value = s.readWord(false)
+		}
+		return a, true
+	}
+	return pkgbuildAssignment{}, false
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// scanAll returns every top-level assignment of src, failing the test if the
+// scanner does not finish.
+func scanAll(t *testing.T, src string) []pkgbuildAssignment {
+	t.Helper()
+	done := make(chan []pkgbuildAssignment, 1)
+	go func() {
+		s := &pkgbuildScanner{src: src}
+		var all []pkgbuildAssignment
+		for {
+			a, ok := s.next()
+			if !ok {
+				break
+			}
+			all = append(all, a)
+		}
+		done <- all
+	}()
+	select {
+	case all := <-done:
+		return all
+	case <-time.After(5 * time.Second):
+		t.Fatalf("scanning %q did not finish", src)
+		return nil
+	}
+}
+
+func TestParsePKGBUILDContent(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		vars   map[string]string
+		arrays map[string][]string
+	}{
+		{
+			name: "plain",
+			src:  "pkgname=foo\npkgver=1.2.3\npkgrel=1\narch=(x86_64 aarch64)\n",
+			vars: map[string]string{"pkgname": "foo", "pkgver": "1.2.3", "pkgrel": "1"},
+			arrays: map[string][]string{
+				"arch": {"x86_64", "aarch64"},
+			},
+		},
+		{
+			name: "quotes and escapes",
+			src: `pkgname='foo'
+pkgver="1.2.3"
+pkgrel=1
+pkgdesc="A \"quoted\" description with 'single' quotes"
+url=https://example.com/foo\ bar
+depends=('glibc' "openssl>=3" bash\ completion)
+`,
+			vars: map[string]string{
+				"pkgname": "foo",
+				"pkgver":  "1.2.3",
+				"pkgdesc": `A "quoted" description with 'single' quotes`,
+				"url":     "https://example.com/foo bar",
+			},
+			arrays: map[string][]string{
+				"depends": {"glibc", "openssl>=3", "bash completion"},
+			},
+		},
+		{
+			name: "expansions are kept verbatim",
+			src:  "pkgname=foo\npkgver=1\npkgrel=1\n_commit=abc\nsource=(\"git+https://example.com/foo.git#commit=${_commit}\" \"$(echo x)\")\n",
+			arrays: map[string][]string{
+				"source": {"git+https://example.com/foo.git#commit=${_commit}", "$(echo x)"},
+			},
+		},
+		{
+			name: "appending",
+			src:  "pkgname=foo\npkgver=1\npkgrel=1\ndepends=(a)\ndepends+=(b c)\noptions=()\noptions+=('!lto')\npkgdesc=foo\npkgdesc+=' bar'\n",
+			vars: map[string]string{"pkgdesc": "foo bar"},
+			arrays: map[string][]string{
+				"depends": {"a", "b", "c"},
+				"options": {"!lto"},
+			},
+		},
+		{
+			name: "later assignments override earlier ones",
+			src:  "pkgname=foo\npkgver=1\npkgver=2\npkgrel=1\ndepends=(a)\ndepends=(b)\n",
+			vars: map[string]string{"pkgver": "2"},
+			arrays: map[string][]string{
+				"depends": {"b"},
+			},
+		},
+		{
+			name: "functions are skipped",
+			src: `pkgname=foo
+pkgver=1
+pkgrel=1
+pkgver() {
+  pkgver=9.9
+  echo "}"
+}
+build() { depends=(inner); }
+function package {
+  if true; then
+    pkgrel=5
+  fi
+}
+depends=(outer)
+`,
+			vars: map[string]string{"pkgver": "1", "pkgrel": "1"},
+			arrays: map[string][]string{
+				"depends": {"outer"},
+			},
+		},
+		{
+			name: "comments",
+			src: `# Maintainer: someone <a@example.com>
+pkgname=foo # the name
+pkgver=1
+pkgrel=1
+# pkgrel=7
+depends=(
+  a # first
+  # b
+  c
+)
+pkgdesc="not # a comment"
+`,
+			vars: map[string]string{"pkgname": "foo", "pkgrel": "1", "pkgdesc": "not # a comment"},
+			arrays: map[string][]string{
+				"depends": {"a", "c"},
+			},
+		},
+		{
+			name: "split packages are named after the first",
+			src:  "pkgbase=foo-base\npkgname=(foo foo-docs)\npkgver=1\npkgrel=1\n",
+			vars: map[string]string{"pkgname": "foo", "pkgbase": "foo-base"},
+			arrays: map[string][]string{
+				"pkgname": {"foo", "foo-docs"},
+			},
+		},
+		{
+			name: "several statements on a line",
+			src:  "pkgname=foo; pkgver=1; pkgrel=2\n",
+			vars: map[string]string{"pkgname": "foo", "pkgver": "1", "pkgrel": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parsePKGBUILDContent([]byte(tt.src))
+			if err != nil {
+				t.Fatalf("parsePKGBUILDContent() error = %v", err)
+			}
+			for name, want := range tt.vars {
+				if got := info.Vars[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			for name, want := range tt.arrays {
+				if got := info.Arrays[name]; !slices.Equal(got, want) {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePKGBUILDContentMissingVariables(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"pkgname=foo\npkgver=1\n",
+		"package() {\n  pkgname=foo\n  pkgver=1\n  pkgrel=1\n}\n",
+	} {
+		if _, err := parsePKGBUILDContent([]byte(src)); err == nil {
+			t.Errorf("parsePKGBUILDContent(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+func TestPKGBUILDScannerMalformed(t *testing.T) {
+	tests := []struct {
+		src  string
+		want map[string][]string
+	}{
+		{"depends=(foo|bar)\n", map[string][]string{"depends": {"foo", "bar"}}},
+		{"source=(a;b)\n", map[string][]string{"source": {"a", "b"}}},
+		{"depends=(a & b&&c)\n", map[string][]string{"depends": {"a", "b", "c"}}},
+		{"depends=(a b\n", map[string][]string{"depends": {"a", "b"}}},
+		{"depends=('unterminated\n", map[string][]string{"depends": {"unterminated\n"}}},
+		{"source=(\"$(echo\n", map[string][]string{"source": {"$(echo\n"}}},
+		{"pkgdesc=&foo\n", nil},
+		{"pkgdesc=|\n", nil},
+		{"pkgver=\"unterminated\n", nil},
+		{"build() {\n", nil},
+		{"}}}\n(((\n", nil},
+		{"\\", nil},
+		{"a=$", nil},
+		{"x+=", nil},
+		{"=()", nil},
+	}
+	for _, tt := range tests {
+		all := scanAll(t, tt.src)
+		for name, want := range tt.want {
+			i := slices.IndexFunc(all, func(a pkgbuildAssignment) bool { return a.Name == name })
+			if i < 0 {
+				t.Errorf("scanning %q: no %s assignment", tt.src, name)
+				continue
+			}
+			if got := all[i].Values; !slices.Equal(got, want) {
+				t.Errorf("scanning %q: %s = %q, want %q", tt.src, name, got, want)
+			}
+		}
+	}
+}
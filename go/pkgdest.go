@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The makepkg.conf variables of the directories makepkg writes its outputs
+// to instead of the package directory when set.
+const (
+	makepkgPKGDEST    = "PKGDEST"
+	makepkgSRCPKGDEST = "SRCPKGDEST"
+	makepkgLOGDEST    = "LOGDEST"
+)
+
+// makepkgConfFiles returns the makepkg.conf files makepkg reads with conf
+// as its MAKEPKG_CONF, $MAKEPKG_CONF for "", in the order it sources them;
+// they need not exist.
+func makepkgConfFiles(conf string) []string {
+	if conf == "" {
+		conf = os.Getenv("MAKEPKG_CONF")
+	}
+	if conf == "" {
+		conf = "/etc/makepkg.conf"
+	}
+	files := []string{conf}
+	dropins, _ := filepath.Glob(conf + ".d/*.conf")
+	files = append(files, dropins...)
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if home, err := os.UserHomeDir(); err == nil {
+		if configHome == "" {
+			configHome = filepath.Join(home, ".config")
+		}
+		files = append(files, filepath.Join(configHome, "pacman", "makepkg.conf"), filepath.Join(home, ".makepkg.conf"))
+	}
+	return files
+}
+
+// makepkgConfVar returns the value of the makepkg.conf variable name, from
+// the environment, which makepkg lets override it, or the makepkg.conf
+// files makepkg reads. It returns "" if it is not set.
+func makepkgConfVar(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	// Later files override earlier ones, as makepkg sources them in order
+	var value string
+	for _, file := range makepkgConfFiles("") {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimPrefix(strings.TrimSpace(sc.Text()), "export ")
+			if v, ok := strings.CutPrefix(line, name+"="); ok {
+				value = os.ExpandEnv(strings.Trim(v, `"'`))
+			}
+		}
+		f.Close()
+	}
+	return value
+}
+
+// makepkgDestDir returns the directory the makepkg.conf variable name
+// (PKGDEST, SRCPKGDEST or LOGDEST) points makepkg building in dir to, or ""
+// if it writes to dir itself. Relative values are relative to dir.
+func makepkgDestDir(dir, name string) string {
+	dest := makepkgConfVar(name)
+	if dest == "" {
+		return ""
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(dir, dest)
+	}
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		return dest
+	}
+	if absDir, err := filepath.Abs(dir); err == nil && absDir == abs {
+		return ""
+	}
+	return abs
+}
+
+// isMakepkgOutput reports whether file is a package or signature, source
+// package or log file makepkg wrote for version ([epoch:]pkgver-pkgrel) of
+// one of pkgnames or its -debug package, named
+// <pkgname>-<version>-<arch>.pkg.tar.zst, <pkgbase>-<version>.src.tar.gz or
+// <pkgbase>-<version>-<arch>-<step>.log.
+func isMakepkgOutput(file string, pkgnames []string, version string) bool {
+	base := filepath.Base(file)
+	for _, name := range pkgnames {
+		for _, n := range []string{name, name + "-debug"} {
+			rest, ok := strings.CutPrefix(base, n+"-"+version)
+			if !ok {
+				continue
+			}
+			switch {
+			case isPackageFile(base):
+				arch, _, _ := strings.Cut(strings.TrimPrefix(rest, "-"), ".pkg.tar")
+				if strings.HasPrefix(rest, "-") && arch != "" && !strings.Contains(arch, "-") {
+					return true
+				}
+			case strings.HasPrefix(rest, ".src.tar"):
+				return true
+			case strings.HasSuffix(base, ".log") && strings.HasPrefix(rest, "-"):
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// destOutputs returns the files matching pattern that makepkg wrote for the
+// package in dir to the directories of the makepkg.conf variables names,
+// where they are not in dir. As these directories are usually shared by
+// packages and keep their older versions, only the files of the current
+// version of the pkgnames, their -debug packages and the pkgbase of the
+// PKGBUILD in dir are returned.
+func destOutputs(dir, pattern string, names ...string) []string {
+	var dests []string
+	for _, name := range names {
+		if dest := makepkgDestDir(dir, name); dest != "" && !slices.Contains(dests, dest) {
+			dests = append(dests, dest)
+		}
+	}
+	if len(dests) == 0 {
+		return nil
+	}
+	info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+	if err != nil {
+		return nil
+	}
+	pkgnames, current := packageNames(info), fullVersion(info)
+	var files []string
+	for _, dest := range dests {
+		matches, _ := filepath.Glob(filepath.Join(dest, pattern))
+		for _, f := range matches {
+			if isMakepkgOutput(f, pkgnames, current) {
+				files = append(files, f)
+			}
+		}
+	}
+	return files
+}
+
+// builtPackages returns the package files and signatures of the package in
+// dir: those in dir and those makepkg wrote to PKGDEST.
+func builtPackages(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pkg.tar.*"))
+	return append(files, destOutputs(dir, "*.pkg.tar.*", makepkgPKGDEST)...)
+}
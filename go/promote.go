@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// completeChannels completes the channel names configured under repo.channels.
+func completeChannels(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return slices.Sorted(maps.Keys(cfg.Repo.Channels)), cobra.ShellCompDirectiveNoFileComp
+}
+
+// newPromoteCmd creates the 'promote' command.
+func newPromoteCmd() *cobra.Command {
+	var from, to, signKey, march string
+	var sign, keep, snapshot, noDepCheck, noFileCheck bool
+	var promote func(ctx context.Context, fromPath, toPath string, names []string, optional bool) ([]*repodb.Entry, error)
+	cmd := &cobra.Command{
+		Use:   "promote --from <channel> --to <channel> <package...>",
+		Short: "Moves packages between repository channels without rebuilding them.",
+		Long: `Moves packages, their signatures and database entries from one channel to
+another, e.g. from testing to stable. Channels are the names configured under
+repo.channels, or database paths. Older versions in the target channel are
+replaced and their files deleted. With --keep the packages stay in the source
+channel as well. Like 'repo add', promote refuses packages whose dependencies
+the target channel and the sync databases cannot satisfy, or that contain files
+other packages of the target channel own.
+
+With repo.marches, the optimized builds of the packages move from the per-ISA
+repositories of the source channel to those of the target channel as well,
+and optimized builds older than the promoted packages are dropped there.
+--march promotes only within the per-ISA repositories of that level.`,
+		Args: cobra.MinimumNArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return completeRepoPackages(cmd, []string{from}, toComplete)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if from == "" || to == "" {
+				return errorf(errConfig, "--from and --to are required")
+			}
+			fromPath, toPath := repoDBPath(from), repoDBPath(to)
+			if march != "" && march != baselineMarch {
+				fromPath, toPath = optimizedDBPath(from, march), optimizedDBPath(to, march)
+			}
+			if fromPath == toPath {
+				return errorf(errConfig, "--from and --to are the same repository database")
+			}
+			entries, err := promote(cmd.Context(), fromPath, toPath, args, false)
+			if err != nil {
+				return err
+			}
+			published := []string{toPath}
+			if march == "" || march == baselineMarch {
+				// Move the optimized builds along, or drop those the promoted
+				// baseline packages supersede
+				for _, level := range cfg.Repo.Marches {
+					optFrom, optTo := optimizedDBPath(from, level), optimizedDBPath(to, level)
+					if _, err := os.Stat(optFrom); err == nil {
+						moved, err := promote(cmd.Context(), optFrom, optTo, args, true)
+						if err != nil {
+							return err
+						}
+						if len(moved) > 0 {
+							published = append(published, optTo)
+						}
+					}
+					changed, err := pruneOptimized(cmd.Context(), optTo, entries, sign, signKey)
+					if err != nil {
+						return errorf(errPublish, "%w", err)
+					}
+					if changed && !slices.Contains(published, optTo) {
+						published = append(published, optTo)
+					}
+				}
+			}
+			for _, path := range published {
+				if err := runPostPublish(cmd.Context(), path); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	// promote moves the named packages from the database fromPath to toPath and
+	// returns their entries. When optional, packages missing in fromPath are
+	// skipped and the checks left to the baseline promotion.
+	promote = func(ctx context.Context, fromPath, toPath string, names []string, optional bool) ([]*repodb.Entry, error) {
+		fromDir, toDir := filepath.Dir(fromPath), filepath.Dir(toPath)
+		if err := os.MkdirAll(toDir, 0755); err != nil {
+			return nil, errorf(errPublish, "could not create %s: %w", toDir, err)
+		}
+		// Lock in a fixed order so that opposite promotions cannot deadlock
+		paths := []string{fromPath, toPath}
+		slices.Sort(paths)
+		for _, path := range paths {
+			lock, err := lockRepoDB(ctx, path)
+			if err != nil {
+				return nil, errorf(errPublish, "%w", err)
+			}
+			defer lock.unlock()
+		}
+		src, err := repodb.Read(fromPath)
+		if err != nil {
+			return nil, errorf(errPublish, "%w", err)
+		}
+		dst, err := openRepoDB(toPath)
+		if err != nil {
+			return nil, errorf(errPublish, "%w", err)
+		}
+
+		var entries []*repodb.Entry
+		for _, name := range names {
+			e, ok := src.Entries[name]
+			if !ok && optional {
+				continue
+			}
+			if !ok {
+				return nil, errorf(errPublish, "package %s is not in %s", name, fromPath)
+			}
+			if e.Filename == "" {
+				return nil, errorf(errPublish, "package %s has no package file in %s", name, fromPath)
+			}
+			entries = append(entries, e)
+		}
+		if len(entries) == 0 {
+			return nil, nil
+		}
+
+		if !noDepCheck && !optional {
+			syncDBs, err := loadSyncDBs(cfg.Repo.SyncDBs)
+			if err != nil {
+				return nil, errorf(errPublish, "%w", err)
+			}
+			if err := checkDependencies(entries, pendingDB(dst, entries), syncDBs); err != nil {
+				return nil, err
+			}
+		}
+		if !noFileCheck && !optional {
+			if err := checkFileConflicts(entries, pendingDB(dst, entries)); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, path := range []string{toPath, fromPath} {
+			if err := snapshotBeforePublish(path, snapshot, fmt.Sprintf("before promoting %s from %s to %s", strings.Join(names, " "), repoName(fromPath), repoName(toPath))); err != nil {
+				return nil, errorf(errPublish, "%w", err)
+			}
+		}
+
+		// Channels may share a package directory, then only the databases change
+		sharedDir := false
+		if a, err := filepath.Abs(fromDir); err == nil {
+			if b, err := filepath.Abs(toDir); err == nil {
+				sharedDir = a == b
+			}
+		}
+		for _, e := range entries {
+			for _, file := range []string{e.Filename, e.Filename + ".sig"} {
+				if sharedDir {
+					break
+				}
+				srcFile, dstFile := filepath.Join(fromDir, file), filepath.Join(toDir, file)
+				if _, err := os.Stat(srcFile); os.IsNotExist(err) && file != e.Filename {
+					continue
+				}
+				os.Remove(dstFile)
+				if err := linkOrCopy(srcFile, dstFile); err != nil {
+					return nil, errorf(errPublish, "could not copy %s to %s: %w", file, toDir, err)
+				}
+			}
+			old := dst.Add(e)
+			if old == nil {
+				log.Printf("  Promoted: %s %s", e.Name, e.Version)
+				continue
+			}
+			log.Printf("  Promoted: %s %s -> %s", e.Name, old.Version, e.Version)
+			makeDeltas(ctx, toPath, old, e)
+			if old.Filename != e.Filename && !sharedDir {
+				removePackageFile(toPath, old)
+			}
+		}
+		if err := writeRepoDB(ctx, dst, toPath, sign, signKey); err != nil {
+			return nil, errorf(errPublish, "%w", err)
+		}
+		log.Printf("Repository database %s updated (%d packages).", toPath, len(dst.Entries))
+
+		if !keep {
+			for _, e := range entries {
+				src.Remove(e.Name)
+			}
+			if err := writeRepoDB(ctx, src, fromPath, sign, signKey); err != nil {
+				return nil, errorf(errPublish, "%w", err)
+			}
+			if !sharedDir {
+				for _, e := range entries {
+					removePackageFile(fromPath, e)
+				}
+			}
+			log.Printf("Repository database %s updated (%d packages).", fromPath, len(src.Entries))
+		}
+		return entries, nil
+	}
+	cmd.Flags().StringVar(&from, "from", "", "Channel (or database) to take the packages from")
+	cmd.Flags().StringVar(&to, "to", "", "Channel (or database) to promote the packages to")
+	cmd.Flags().BoolVar(&keep, "keep", false, "Keep the packages in the source channel")
+	cmd.Flags().BoolVar(&sign, "sign", false, "Sign the updated databases using GPG")
+	cmd.Flags().StringVar(&signKey, "key", "", "GPG key to sign with (default: gpg default key)")
+	cmd.Flags().BoolVar(&snapshot, "snapshot", false, "Snapshot both channels before changing them")
+	cmd.Flags().BoolVar(&noDepCheck, "no-dep-check", false, "Promote even if runtime dependencies cannot be satisfied")
+	cmd.Flags().BoolVar(&noFileCheck, "no-file-check", false, "Promote even if packages contain files owned by other packages of the target channel")
+	cmd.Flags().StringVar(&march, "march", "", "Promote between the per-ISA repositories of this level (e.g. x86-64-v3) only")
+	cmd.RegisterFlagCompletionFunc("from", completeChannels)
+	cmd.RegisterFlagCompletionFunc("to", completeChannels)
+	return cmd
+}
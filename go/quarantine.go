@@ -0,0 +1,147 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// The package.status values quarantining a package.
+const (
+	statusBroken = "broken"
+	statusOnHold = "on-hold"
+)
+
+// skipQuarantined returns nodes without the broken and on-hold ones, which
+// it reports.
+func skipQuarantined(nodes []*pkgNode) []*pkgNode {
+	return slices.DeleteFunc(slices.Clone(nodes), func(n *pkgNode) bool {
+		if n.Status == "" {
+			return false
+		}
+		reason := cmp.Or(n.Reason, "no reason given")
+		log.Printf("  Skipped (%s): %s: %s", n.Status, n.Name, reason)
+		return true
+	})
+}
+
+// quarantineSince returns when the package in dir was quarantined: since
+// (its package.since) if set, else the time of the last commit of its
+// .pkgbuilder.yaml, else the modification time of the file.
+func quarantineSince(ctx context.Context, dir, since string) (time.Time, bool) {
+	if t, err := time.Parse(time.DateOnly, since); err == nil {
+		return t, true
+	}
+	cmd := newCommand(ctx, "git", "log", "-1", "--format=%ct", "--", packageConfigFile)
+	cmd.Dir = dir
+	cmd.Stderr = nil
+	if out, err := cmd.Output(); err == nil {
+		if sec, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64); err == nil {
+			return time.Unix(sec, 0), true
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, packageConfigFile)); err == nil {
+		return fi.ModTime(), true
+	}
+	return time.Time{}, false
+}
+
+// formatAge formats how long ago t was in days, or hours under a day.
+func formatAge(t time.Time) string {
+	d := time.Since(t)
+	if d < 24*time.Hour {
+		return fmt.Sprintf("%dh", int(max(d, 0).Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+// newStatusCmd creates the 'status' command.
+func newStatusCmd() *cobra.Command {
+	var workspace, selection string
+	cmd := &cobra.Command{
+		Use:         "status",
+		Short:       "Lists the broken and on-hold packages of the workspace.",
+		Annotations: map[string]string{annotationJSONResult: "true"},
+		Long: `Lists the packages below --workspace quarantined by the package.status of their
+.pkgbuilder.yaml, broken or on-hold, with the package.reason and how long they
+have been quarantined: since package.since, or else the last commit of the
+.pkgbuilder.yaml. Workspace builds (generate-pipeline, rebuild-list) skip these
+packages unless --include-quarantined is given. The oldest are listed first.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			nodes, err := workspaceNodes(workspace)
+			if err != nil {
+				return errorf(errGeneral, "could not scan workspace %s: %w", workspace, err)
+			}
+			if nodes, err = selectNodes(selection, nodes); err != nil {
+				return err
+			}
+			type quarantined struct {
+				node  *pkgNode
+				since time.Time
+			}
+			var list []quarantined
+			for _, n := range nodes {
+				if n.Status == "" {
+					continue
+				}
+				meta, err := readPackageMeta(n.Dir)
+				if err != nil {
+					return errorf(errConfig, "%w", err)
+				}
+				q := quarantined{node: n}
+				q.since, _ = quarantineSince(cmd.Context(), n.Dir, meta.Since)
+				list = append(list, q)
+			}
+			slices.SortStableFunc(list, func(a, b quarantined) int { return a.since.Compare(b.since) })
+			if jsonOutput() {
+				type entry struct {
+					Package string     `json:"package"`
+					Dir     string     `json:"dir"`
+					Status  string     `json:"status"`
+					Reason  string     `json:"reason,omitempty"`
+					Since   *time.Time `json:"since,omitempty"`
+				}
+				entries := []entry{}
+				for _, q := range list {
+					e := entry{Package: q.node.Name, Dir: q.node.Dir, Status: q.node.Status, Reason: q.node.Reason}
+					if !q.since.IsZero() {
+						e.Since = &q.since
+					}
+					entries = append(entries, e)
+				}
+				return printResult(entries)
+			}
+			if len(list) == 0 {
+				log.Printf("No quarantined packages among %d.", len(nodes))
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "PACKAGE\tSTATUS\tAGE\tREASON")
+			for _, q := range list {
+				age := "-"
+				if !q.since.IsZero() {
+					age = formatAge(q.since)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", q.node.Name, q.node.Status, age, cmp.Or(q.node.Reason, "-"))
+			}
+			w.Flush()
+			log.Printf("%d of %d package(s) quarantined", len(list), len(nodes))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&workspace, "workspace", ".", "Directory containing the package sources")
+	cmd.Flags().StringVar(&selection, "select", "", selectUsage)
+	return cmd
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// pkgNode is a package we build, from a PKGBUILD of the workspace or from a
+// repository database, as a node of the dependency graph between our packages.
+type pkgNode struct {
+	// Name is the pkgbase, or pkgname if there is none
+	Name string
+	// Dir is the directory of the PKGBUILD; empty for database packages
+	Dir string
+	// Provides holds the package names and provides of the node
+	Provides []string
+	// Depends holds the names of all its depends, makedepends and checkdepends
+	Depends []string
+	// Stage and Priority are those of its package.stage and package.priority
+	Stage    int
+	Priority int
+	// Status and Reason quarantine the node, see skipQuarantined
+	Status string
+	Reason string
+}
+
+// readPackageMeta returns the package section of the .pkgbuilder.yaml in a
+// package directory, if it has one.
+func readPackageMeta(dir string) (packageMeta, error) {
+	c, err := loadConfig(filepath.Join(dir, packageConfigFile), false)
+	if err != nil {
+		return packageMeta{}, err
+	}
+	return c.Package, nil
+}
+
+// workspaceNodes returns a node for every PKGBUILD below root.
+func workspaceNodes(root string) ([]*pkgNode, error) {
+	infos, err := workspacePKGBUILDs(root)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*pkgNode
+	for _, dir := range slices.Sorted(maps.Keys(infos)) {
+		info := infos[dir]
+		meta, err := readPackageMeta(dir)
+		if err != nil {
+			return nil, err
+		}
+		n := &pkgNode{Name: info.Vars["pkgbase"], Dir: dir, Provides: packageNames(info), Stage: meta.Stage, Priority: meta.Priority, Status: meta.Status, Reason: meta.Reason}
+		if n.Name == "" {
+			n.Name = info.PkgName
+		}
+		for _, p := range info.Arrays["provides"] {
+			n.Provides = append(n.Provides, depName(p))
+		}
+		suffixes := []string{""}
+		for _, arch := range info.Arch {
+			if arch != "any" {
+				suffixes = append(suffixes, "_"+arch)
+			}
+		}
+		for _, kind := range []string{"depends", "makedepends", "checkdepends"} {
+			for _, suffix := range suffixes {
+				for _, d := range info.Arrays[kind+suffix] {
+					n.Depends = append(n.Depends, depName(d))
+				}
+			}
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// dbNodes returns a node for every pkgbase of a repository database, so split
+// packages are rebuilt once.
+func dbNodes(db *repodb.DB) []*pkgNode {
+	bases := map[string]*pkgNode{}
+	var nodes []*pkgNode
+	for _, name := range db.Names() {
+		e := db.Entries[name]
+		base := e.Base
+		if base == "" {
+			base = e.Name
+		}
+		n, ok := bases[base]
+		if !ok {
+			n = &pkgNode{Name: base}
+			bases[base] = n
+			nodes = append(nodes, n)
+		}
+		n.Provides = append(n.Provides, e.Name)
+		for _, p := range e.Provides {
+			n.Provides = append(n.Provides, depName(p))
+		}
+		for _, list := range [][]string{e.Depends, e.MakeDepends, e.CheckDepends} {
+			for _, d := range list {
+				n.Depends = append(n.Depends, depName(d))
+			}
+		}
+	}
+	return nodes
+}
+
+// dependents returns the nodes that depend on any of the given names, and with
+// transitive also those depending on them in turn. Nodes providing one of the
+// names themselves are not included.
+func dependents(nodes []*pkgNode, names []string, transitive bool) []*pkgNode {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+	selected := map[*pkgNode]bool{}
+	for {
+		var found []*pkgNode
+		for _, n := range nodes {
+			if selected[n] || slices.ContainsFunc(n.Provides, func(p string) bool { return slices.Contains(names, p) }) {
+				continue
+			}
+			if slices.ContainsFunc(n.Depends, func(d string) bool { return wanted[d] }) {
+				found = append(found, n)
+			}
+		}
+		for _, n := range found {
+			selected[n] = true
+			for _, p := range n.Provides {
+				wanted[p] = true
+			}
+		}
+		if len(found) == 0 || !transitive {
+			break
+		}
+	}
+	var result []*pkgNode
+	for _, n := range nodes {
+		if selected[n] {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// buildOrder sorts nodes so that every node comes after the nodes it depends
+// on and those of lower stages; where that leaves the order free, by
+// descending priority and then by name. Nodes in a dependency cycle, or
+// depending on a node of a later stage, are appended and returned as well.
+func buildOrder(nodes []*pkgNode) (order, cyclic []*pkgNode) {
+	provider := map[string]*pkgNode{}
+	for _, n := range nodes {
+		for _, p := range n.Provides {
+			provider[p] = n
+		}
+	}
+	deps := map[*pkgNode]map[*pkgNode]bool{}
+	for _, n := range nodes {
+		deps[n] = map[*pkgNode]bool{}
+		for _, d := range n.Depends {
+			if p, ok := provider[d]; ok && p != n {
+				deps[n][p] = true
+			}
+		}
+	}
+
+	remaining := slices.Clone(nodes)
+	slices.SortFunc(remaining, func(a, b *pkgNode) int {
+		return cmp.Or(cmp.Compare(a.Stage, b.Stage), cmp.Compare(b.Priority, a.Priority), strings.Compare(a.Name, b.Name))
+	})
+	done := map[*pkgNode]bool{}
+	for len(remaining) > 0 {
+		// remaining is sorted by stage
+		stage := remaining[0].Stage
+		i := slices.IndexFunc(remaining, func(n *pkgNode) bool {
+			if n.Stage > stage {
+				return false
+			}
+			for d := range deps[n] {
+				if !done[d] {
+					return false
+				}
+			}
+			return true
+		})
+		if i < 0 {
+			return order, remaining
+		}
+		done[remaining[i]] = true
+		order = append(order, remaining[i])
+		remaining = slices.Delete(remaining, i, i+1)
+	}
+	return order, nil
+}
+
+// newRebuildListCmd creates the 'rebuild-list' command.
+func newRebuildListCmd() *cobra.Command {
+	var workspace, dbArg, selection string
+	var transitive, dirs, includeQuarantined bool
+	cmd := &cobra.Command{
+		Use:         "rebuild-list <dependency...>",
+		Short:       "Lists our packages that need a rebuild when dependencies change.",
+		Annotations: map[string]string{annotationJSONResult: "true"},
+		Long: `Prints the packages that depend, make-depend or check-depend on any of the given
+dependencies (e.g. python after a toolchain bump), one per line in build
+order: a package comes after those of the list it depends on and those of
+lower package.stage, and higher package.priority first otherwise. Packages are
+read from the PKGBUILDs below --workspace, or from a repository database with
+--db. With --transitive the packages depending on listed packages are added as
+well, giving the full rebuild cascade. Packages with a package.status of broken
+or on-hold are left out and reported, unless --include-quarantined is given.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var nodes []*pkgNode
+			if dbArg != "" {
+				if dirs || selection != "" {
+					return errorf(errConfig, "--dirs and --select need PKGBUILDs, not --db")
+				}
+				db, err := repodb.Read(repoDBPath(dbArg))
+				if err != nil {
+					return errorf(errPublish, "%w", err)
+				}
+				nodes = dbNodes(db)
+			} else {
+				var err error
+				if nodes, err = workspaceNodes(workspace); err != nil {
+					return errorf(errGeneral, "could not scan workspace %s: %w", workspace, err)
+				}
+				if nodes, err = selectNodes(selection, nodes); err != nil {
+					return err
+				}
+			}
+			debugPrint("Scanned %d packages", len(nodes))
+
+			affected := dependents(nodes, args, transitive)
+			if !includeQuarantined {
+				affected = skipQuarantined(affected)
+			}
+			order, cyclic := buildOrder(affected)
+			if len(cyclic) > 0 {
+				var names []string
+				for _, n := range cyclic {
+					names = append(names, n.Name)
+				}
+				log.Printf("Warning: dependency cycle, or dependency on a later package.stage, between %s; they are listed last", strings.Join(names, ", "))
+			}
+			order = append(order, cyclic...)
+			if jsonOutput() {
+				type entry struct {
+					Name string `json:"name"`
+					Dir  string `json:"dir,omitempty"`
+				}
+				entries := []entry{}
+				for _, n := range order {
+					e := entry{Name: n.Name}
+					if n.Dir != "" {
+						e.Dir = filepath.Clean(n.Dir)
+					}
+					entries = append(entries, e)
+				}
+				return printResult(entries)
+			}
+			if len(order) == 0 {
+				log.Printf("No package depends on %s.", strings.Join(args, ", "))
+				return nil
+			}
+			log.Printf("%d package(s) to rebuild for %s:", len(order), strings.Join(args, ", "))
+			for _, n := range order {
+				if dirs {
+					fmt.Println(filepath.Clean(n.Dir))
+				} else {
+					fmt.Println(n.Name)
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&workspace, "workspace", ".", "Directory containing the package sources")
+	cmd.Flags().StringVar(&dbArg, "db", "", "Read the packages from this repository database instead of the workspace")
+	cmd.Flags().BoolVar(&transitive, "transitive", false, "Include packages depending on listed packages, recursively")
+	cmd.Flags().BoolVar(&dirs, "dirs", false, "Print the PKGBUILD directories instead of package names")
+	cmd.Flags().BoolVar(&includeQuarantined, "include-quarantined", false, "List broken and on-hold packages too")
+	cmd.Flags().StringVar(&selection, "select", "", selectUsage)
+	return cmd
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// redactBuiltinPatterns match common token formats, so tokens the builder
+// does not know of, e.g. in authenticated source URLs a PKGBUILD echoes, are
+// masked too. Of patterns with a group only the group is masked.
+var redactBuiltinPatterns = []*regexp.Regexp{
+	// GitLab personal, deploy, runner, trigger and CI job tokens
+	regexp.MustCompile(`\bgl(?:pat|dt|rt|ptt|cbt|soat|ft|imt|oas)-[0-9A-Za-z_-]{20,}`),
+	regexp.MustCompile(`\b(?:ghp|gho|ghu|ghs|ghr)_[0-9A-Za-z]{36,}`),
+	regexp.MustCompile(`\bgithub_pat_[0-9A-Za-z_]{22,}`),
+	regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`\bxox[abprs]-[0-9A-Za-z-]{10,}`),
+	// Passwords of URLs, e.g. https://oauth2:<token>@gitlab.com/...
+	regexp.MustCompile(`\b[A-Za-z][A-Za-z0-9+.-]*://[^/\s:@]*:([^/\s@]+)@`),
+	regexp.MustCompile(`(?i)\b(?:authorization:\s*(?:bearer|basic|token)\s+|private-token:\s*|job-token:\s*)([^\s'"]+)`),
+}
+
+// redactPattern masks the matches of re in s, or their first group.
+func redactPattern(re *regexp.Regexp, s string) string {
+	if re.NumSubexp() == 0 {
+		return re.ReplaceAllLiteralString(s, secretMask)
+	}
+	var b []byte
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		if m[2] < 0 {
+			continue
+		}
+		b = append(append(b, s[last:m[2]]...), secretMask...)
+		last = m[3]
+	}
+	if b == nil {
+		return s
+	}
+	return string(append(b, s[last:]...))
+}
+
+// setupRedaction registers what the configuration masks besides secrets:
+// the values of redact.env and the redact.patterns, and every secret of
+// secretSpecs set in the environment, whether the command reads it or not.
+func setupRedaction(c *config) {
+	for _, spec := range secretSpecs {
+		if _, value, err := lookupSecret(spec); err == nil && value != "" {
+			addMask(value)
+		}
+	}
+	for _, name := range c.Redact.Env {
+		if value := os.Getenv(name); value != "" {
+			addMask(value)
+		}
+	}
+	maskedValues.Lock()
+	defer maskedValues.Unlock()
+	maskedValues.noBuiltin = c.Redact.NoBuiltin
+	maskedValues.patterns = nil
+	for _, p := range c.Redact.Patterns {
+		// Checked with the configuration
+		if re, err := regexp.Compile(p); err == nil {
+			maskedValues.patterns = append(maskedValues.patterns, re)
+		}
+	}
+}
+
+// redactHoldback is how long redactingWriter holds back the end of a line,
+// waiting for the rest of a secret it may be cut off in.
+const redactHoldback = 200 * time.Millisecond
+
+// redactMaxLine is the longest partial line redactingWriter holds back.
+const redactMaxLine = 64 << 10
+
+// redactingWriter masks secrets in streamed command output line by line, so
+// that values split between writes are masked as well. Partial lines are
+// written after redactHoldback, so prompts and progress still show.
+type redactingWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	buf   []byte
+	timer *time.Timer
+}
+
+func newRedactingWriter(w io.Writer) *redactingWriter {
+	return &redactingWriter{w: w}
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, p...)
+	end := bytes.LastIndexAny(r.buf, "\n\r") + 1
+	if len(r.buf)-end > redactMaxLine {
+		end = len(r.buf)
+	}
+	if end > 0 {
+		_, err := io.WriteString(r.w, maskSecrets(string(r.buf[:end])))
+		r.buf = append(r.buf[:0], r.buf[end:]...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(r.buf) > 0 && r.timer == nil {
+		r.timer = time.AfterFunc(redactHoldback, func() { r.Flush() })
+	}
+	return len(p), nil
+}
+
+// Flush writes the partial line held back, if any.
+func (r *redactingWriter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	if len(r.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, maskSecrets(string(r.buf)))
+	r.buf = r.buf[:0]
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ficlone is the FICLONE ioctl, which makes dst share the data blocks of src.
+const ficlone = 0x40049409
+
+// reflink clones src into dst on filesystems that support it.
+func reflink(dst, src *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// copyMetadata applies the mode, timestamps, ownership and extended
+// attributes of src to dst. Ownership and xattrs are best effort, since
+// they usually need privileges the runner does not have.
+func copyMetadata(src *os.File, dst string, info os.FileInfo) error {
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, syscall.EPERM) {
+			debugPrint("Could not keep the owner of %s: %v", dst, err)
+		}
+		atime := time.Unix(st.Atim.Unix())
+		if err := os.Chtimes(dst, atime, info.ModTime()); err != nil {
+			return err
+		}
+	}
+	copyXattrs(src.Name(), dst)
+	return nil
+}
+
+// copyXattrs copies the extended attributes that the filesystems and the
+// current user allow.
+func copyXattrs(src, dst string) {
+	size, err := syscall.Listxattr(src, nil)
+	if err != nil || size == 0 {
+		return
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(src, buf); err != nil {
+		return
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		n, err := syscall.Getxattr(src, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(src, name, value); err != nil {
+			continue
+		}
+		if err := syscall.Setxattr(dst, name, value[:n], 0); err != nil {
+			debugPrint("Could not copy xattr %s of %s: %v", name, src, err)
+		}
+	}
+}
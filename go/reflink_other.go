@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is only implemented on Linux.
+func reflink(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
+
+// copyMetadata applies the mode and modification time of src to dst.
+func copyMetadata(src *os.File, dst string, info os.FileInfo) error {
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
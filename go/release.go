@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Defaults of git.tag_name and git.tag_message.
+const (
+	defaultTagName    = "{{.Version}}"
+	defaultTagMessage = "Release {{.Name}} {{.Version}}"
+)
+
+// releaseTag returns the name and message of the release tag of a package.
+// Colons, as in epochs, are not allowed in tags and become hyphens.
+func releaseTag(info *pkgbuildInfo) (name, message string, err error) {
+	data := newCommitData(info, "")
+	if name, err = renderGitTemplate("tag_name", cfg.Git.TagName, defaultTagName, data); err != nil {
+		return "", "", err
+	}
+	name = strings.ReplaceAll(name, ":", "-")
+	if err := checkTagName(name); err != nil {
+		return "", "", err
+	}
+	if message, err = renderGitTemplate("tag_message", cfg.Git.TagMessage, defaultTagMessage, data); err != nil {
+		return "", "", err
+	}
+	return name, message, nil
+}
+
+// checkTagName validates a tag name by the rules of git check-ref-format.
+func checkTagName(name string) error {
+	invalid := name == "" || name == "@" || strings.ContainsAny(name, " ~^:?*[\\\x7f") ||
+		strings.Contains(name, "..") || strings.Contains(name, "@{") || strings.Contains(name, "//") ||
+		strings.HasPrefix(name, "-") || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") ||
+		strings.HasSuffix(name, ".") || strings.HasSuffix(name, ".lock")
+	for _, c := range name {
+		invalid = invalid || c < 0x20
+	}
+	for part := range strings.SplitSeq(name, "/") {
+		invalid = invalid || strings.HasPrefix(part, ".")
+	}
+	if invalid {
+		return fmt.Errorf("%q is not a valid tag name", name)
+	}
+	return nil
+}
+
+// gitCommitOf resolves a revision of the repository of dir to its commit.
+func gitCommitOf(ctx context.Context, dir, rev string) (string, error) {
+	cmd := newCommand(ctx, "git", "-C", dir, "rev-parse", "--quiet", "--verify", rev+"^{commit}")
+	cmd.Stderr = nil
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s is not a commit", rev)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// tagWithGit creates the annotated tag name at ref in the repository of dir
+// unless it exists there already, and pushes it to git.remote.
+func tagWithGit(ctx context.Context, dir, name, message, ref string, sign, push bool) error {
+	commit, err := gitCommitOf(ctx, dir, ref)
+	if err != nil {
+		return errorf(errConfig, "%w", err)
+	}
+	if existing, err := gitCommitOf(ctx, dir, "refs/tags/"+name); err == nil {
+		if existing != commit {
+			return &builderError{
+				Category: errConfig,
+				Err:      fmt.Errorf("tag %s already exists at %.12s, not %.12s", name, existing, commit),
+				Hint:     "Bump pkgrel for a new release of the same version, or delete the stale tag.",
+			}
+		}
+		log.Printf("Tag %s already exists at %.12s", name, commit)
+	} else {
+		args := []string{"tag", "--annotate", "--message", message}
+		if sign {
+			args = append(args, "--sign")
+			if key := cfg.Git.SignKey; key != "" {
+				args = append(args, "--local-user", key)
+			}
+		}
+		if err := gitRun(ctx, dir, append(args, name, commit)...); err != nil {
+			return &builderError{
+				Category: errGeneral,
+				Err:      err,
+				Hint:     "Check that user.name and user.email are set and, for signed tags, that gpg can sign with git.sign_key or user.signingkey.",
+			}
+		}
+		log.Printf("Created tag %s at %.12s", name, commit)
+	}
+	if !push {
+		return nil
+	}
+	remote := gitRemote()
+	if err := gitRun(ctx, dir, "push", "--quiet", remote, "refs/tags/"+name); err != nil {
+		return &builderError{
+			Category: errPublish,
+			Err:      err,
+			Hint:     fmt.Sprintf("The tag was created but not pushed; check the credentials for %s and run 'release tag' again.", remote),
+		}
+	}
+	log.Printf("Pushed tag %s to %s", name, remote)
+	return nil
+}
+
+// gitlabTag is a tag as returned by the GitLab API.
+type gitlabTag struct {
+	Name   string `json:"name"`
+	Commit struct {
+		ID string `json:"id"`
+	} `json:"commit"`
+}
+
+// tagWithGitLab creates the annotated tag name at ref through the GitLab API,
+// which starts its tag pipeline, unless the tag exists at ref already.
+func tagWithGitLab(ctx context.Context, project, name, message, ref string) error {
+	client, err := newGitlabClient(project)
+	if err != nil {
+		return err
+	}
+	payload := map[string]string{"tag_name": name, "ref": ref, "message": message}
+	var created gitlabTag
+	_, err = client.do(ctx, http.MethodPost, "/repository/tags", payload, &created)
+	if err != nil {
+		var existing gitlabTag
+		if _, getErr := client.do(ctx, http.MethodGet, "/repository/tags/"+url.PathEscape(name), nil, &existing); getErr == nil {
+			if existing.Commit.ID == ref {
+				log.Printf("Tag %s already exists at %.12s", name, ref)
+				return nil
+			}
+			return &builderError{
+				Category: errConfig,
+				Err:      fmt.Errorf("tag %s already exists at %.12s, not %.12s", name, existing.Commit.ID, ref),
+				Hint:     "Bump pkgrel for a new release of the same version, or delete the stale tag.",
+			}
+		}
+		return &builderError{
+			Category: errPublish,
+			Err:      fmt.Errorf("could not create tag %s: %w", name, err),
+			Hint:     "Check that BUILDER_GITLAB_TOKEN is a project or personal access token with the api scope and may create tags; CI_JOB_TOKEN cannot.",
+		}
+	}
+	log.Printf("Created tag %s at %.12s through the GitLab API", name, created.Commit.ID)
+	return nil
+}
+
+// newReleaseCmd creates the 'release' command.
+func newReleaseCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "release",
+		Short: "Releases packages from their packaging repository.",
+	}
+
+	var dir, ref, project string
+	var gitlab, gpgSign, noPush, dryRun bool
+	tagCmd := &cobra.Command{
+		Use:   "tag",
+		Short: "Creates and pushes the release tag of the package.",
+		Long: `Creates an annotated tag named after the version of the PKGBUILD in --dir, by
+git.tag_name (default [epoch-]pkgver-pkgrel), at --ref with the message of
+git.tag_message, and pushes it to git.remote, which starts the tag pipeline
+releasing the package. With --gitlab the tag is created through the GitLab API
+of $CI_PROJECT_ID (or --project) instead, with BUILDER_GITLAB_TOKEN. A tag that
+exists at the same commit is left alone, so failed releases can be retried.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+			if err != nil {
+				return errorf(errParse, "%w", err)
+			}
+			name, message, err := releaseTag(info)
+			if err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+			sign := gpgSign || cfg.Git.GPGSign
+			if dryRun {
+				fmt.Printf("%s\n\n%s\n", name, message)
+				return nil
+			}
+
+			if gitlab {
+				if sign {
+					return errorf(errConfig, "the GitLab API cannot create signed tags; drop --gitlab to sign with git")
+				}
+				if ref == "" {
+					ref = os.Getenv("CI_COMMIT_SHA")
+				}
+				if ref == "" || ref == "HEAD" {
+					if ref, err = gitCommitOf(cmd.Context(), dir, "HEAD"); err != nil {
+						return errorf(errConfig, "no commit to tag: pass --ref or run in GitLab CI")
+					}
+				}
+				if err := tagWithGitLab(cmd.Context(), project, name, message, ref); err != nil {
+					return err
+				}
+			} else {
+				if ref == "" {
+					ref = "HEAD"
+				}
+				if err := tagWithGit(cmd.Context(), dir, name, message, ref, sign, !noPush); err != nil {
+					return err
+				}
+				if noPush {
+					return nil
+				}
+			}
+			if u := os.Getenv("CI_PROJECT_URL"); u != "" {
+				log.Printf("The tag pipeline releases %s %s: %s/-/pipelines?scope=tags&ref=%s", info.PkgName, fullVersion(info), u, url.QueryEscape(name))
+			}
+			return nil
+		},
+	}
+	tagCmd.Flags().StringVar(&dir, "dir", ".", "Package directory")
+	tagCmd.Flags().StringVar(&ref, "ref", "", "Revision to tag (default HEAD, or $CI_COMMIT_SHA with --gitlab)")
+	tagCmd.Flags().BoolVar(&gitlab, "gitlab", false, "Create the tag through the GitLab API instead of git")
+	tagCmd.Flags().StringVar(&project, "project", "", "With --gitlab, project ID or path (default $CI_PROJECT_ID)")
+	tagCmd.Flags().BoolVar(&gpgSign, "gpg-sign", false, "Sign the tag with GPG (see git.gpg_sign)")
+	tagCmd.Flags().BoolVar(&noPush, "no-push", false, "Create the tag without pushing it")
+	tagCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the tag name and message instead of tagging")
+
+	cmd.AddCommand(tagCmd)
+	return cmd
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// signFile creates a detached binary signature <path>.sig with gpg,
+// replacing any previous signature atomically.
+func signFile(ctx context.Context, path, key string) error {
+	tmpSig := path + ".sig.tmp"
+	os.Remove(tmpSig)
+	args := []string{"--detach-sign", "--use-agent", "--no-armor", "--batch", "--yes", "--output", tmpSig}
+	if key != "" {
+		args = append(args, "--local-user", key)
+	}
+	args = append(args, path)
+	passArgs, stdin := gpgPassphraseArgs()
+	cmd := newCommand(ctx, "gpg", append(passArgs, args...)...)
+	cmd.Stdin = stdin
+	fmt.Print(maskSecrets(fmt.Sprintf("+ Running command: gpg %s\n", strings.Join(args, " "))))
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmpSig)
+		return newError(errSigning, fmt.Errorf("could not sign %s: %w", path, err))
+	}
+	if err := os.Rename(tmpSig, path+".sig"); err != nil {
+		return fmt.Errorf("could not replace signature of %s: %w", path, err)
+	}
+	return nil
+}
+
+// repoDBPath resolves a channel name configured under repo.channels to its
+// database path; anything else is taken as a path.
+func repoDBPath(arg string) string {
+	if path, ok := cfg.Repo.Channels[arg]; ok {
+		return path
+	}
+	return arg
+}
+
+// repoName returns the repository name of a database path: the file name up
+// to .db, e.g. myrepo for myrepo.db.tar.gz.
+func repoName(dbPath string) string {
+	base := filepath.Base(dbPath)
+	if i := strings.Index(base, ".db"); i > 0 {
+		base = base[:i]
+	}
+	return base
+}
+
+// runPostPublish mirrors the repository to repo.storage and runs the
+// repo.post_publish commands after packages were published to dbPath, e.g.
+// to compose images from the updated repository.
+func runPostPublish(ctx context.Context, dbPath string) error {
+	if err := mirrorRepoDir(ctx, dbPath); err != nil {
+		return err
+	}
+	for _, hook := range cfg.Repo.PostPublish {
+		log.Printf("Running post-publish hook: %s", hook)
+		c := newCommand(ctx, "sh", "-c", hook)
+		c.Env = append(os.Environ(), "BUILDER_REPO_DB="+dbPath, "BUILDER_REPO_NAME="+repoName(dbPath))
+		if err := c.Run(); err != nil {
+			return errorf(errPublish, "post-publish hook %q failed: %w", hook, err)
+		}
+	}
+	return nil
+}
+
+// openRepoDB reads an existing database, or returns an empty one if it does not exist yet.
+func openRepoDB(dbPath string) (*repodb.DB, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		log.Printf("Creating new repository database %s", dbPath)
+		return repodb.New(), nil
+	}
+	return repodb.Read(dbPath)
+}
+
+// writeRepoDB writes the database (and files database) and signs both if
+// requested or build.sign is set, with key or build.sign_key. The signing
+// key is prepared before the databases are replaced, and when signing fails
+// the signatures of the previous databases are removed, so that clients
+// never see a new database with a stale signature.
+func writeRepoDB(ctx context.Context, db *repodb.DB, dbPath string, sign bool, key string) error {
+	if epoch, ok := sourceDateEpoch(); ok {
+		db.ModTime = epoch
+	}
+	sign = sign || cfg.Build.Sign
+	if sign {
+		if err := prepareSigning(ctx); err != nil {
+			return err
+		}
+	}
+	if err := db.Write(dbPath); err != nil {
+		return err
+	}
+	if err := pruneDeltas(dbPath, db); err != nil {
+		log.Printf("Warning: could not prune the deltas of %s: %v", dbPath, err)
+	}
+	if !sign {
+		return nil
+	}
+	if key == "" {
+		key = cfg.Build.SignKey
+	}
+	paths := []string{dbPath, repodb.FilesPath(dbPath)}
+	for _, path := range paths {
+		if err := signFile(ctx, path, key); err != nil {
+			for _, path := range paths {
+				if rmErr := os.Remove(path + ".sig"); rmErr == nil {
+					log.Printf("  Removed %s.sig, which does not match the database", path)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// repoArches returns the architectures whose repository a package belongs
+// to: its own, or for arch=(any) packages every one in repo.arches.
+func repoArches(e *repodb.Entry) []string {
+	if e.Arch != "any" {
+		return []string{e.Arch}
+	}
+	if len(cfg.Repo.Arches) > 0 {
+		return cfg.Repo.Arches
+	}
+	return []string{carch()}
+}
+
+// linkPackageFiles links package files and their signatures into dir unless
+// they are already there.
+func linkPackageFiles(files []string, dir string) error {
+	for _, file := range files {
+		for _, src := range []string{file, file + ".sig"} {
+			dst := filepath.Join(dir, filepath.Base(src))
+			if _, err := os.Stat(src); os.IsNotExist(err) && src != file {
+				continue
+			}
+			if a, err := os.Stat(dst); err == nil {
+				if b, err := os.Stat(src); err == nil && os.SameFile(a, b) {
+					continue
+				}
+			}
+			os.Remove(dst)
+			if err := linkOrCopy(src, dst); err != nil {
+				return fmt.Errorf("could not copy %s to %s: %w", src, dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// defaultSyncDBs are the pacman sync databases of the official repositories.
+const defaultSyncDBs = "/var/lib/pacman/sync/*.db"
+
+// loadSyncDBs reads the databases of the repositories dependencies may come from.
+func loadSyncDBs(patterns []string) ([]*repodb.DB, error) {
+	if len(patterns) == 0 {
+		patterns = []string{defaultSyncDBs}
+	}
+	var dbs []*repodb.DB
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sync database pattern %q: %w", pattern, err)
+		}
+		for _, path := range paths {
+			db, err := repodb.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			debugPrint("Loaded %d packages from %s", len(db.Entries), path)
+			dbs = append(dbs, db)
+		}
+	}
+	return dbs, nil
+}
+
+// pendingDB returns a copy of db with the entries added, as it will be after
+// publishing them.
+func pendingDB(db *repodb.DB, entries []*repodb.Entry) *repodb.DB {
+	pending := repodb.New()
+	for name, e := range db.Entries {
+		pending.Entries[name] = e
+	}
+	for _, e := range entries {
+		pending.Add(e)
+	}
+	return pending
+}
+
+// checkDependencies verifies that every runtime dependency of the added
+// entries is provided by the target database (including the other new
+// packages) or one of the sync databases.
+func checkDependencies(added []*repodb.Entry, target *repodb.DB, syncDBs []*repodb.DB) error {
+	pool := append([]*repodb.DB{target}, syncDBs...)
+	var missing []string
+	for _, e := range added {
+		for _, dep := range e.Depends {
+			d := repodb.ParseDependency(dep)
+			found := false
+			for _, db := range pool {
+				if db.FindSatisfier(d) != nil {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, fmt.Sprintf("%s requires %s", e.Name, dep))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return &builderError{
+			Category: errPublish,
+			Err:      fmt.Errorf("refusing to publish uninstallable packages, no provider for:\n  %s", strings.Join(missing, "\n  ")),
+			Hint:     "Build and add the missing dependencies first, or pass --no-dep-check if they come from a repository not listed in repo.sync_dbs.",
+		}
+	}
+	return nil
+}
+
+// maxConflictPaths is the number of conflicting paths shown per package pair.
+const maxConflictPaths = 5
+
+// excludes reports whether a and b cannot be installed together because either
+// conflicts with or replaces the other; such packages may share files.
+func excludes(a, b *repodb.Entry) bool {
+	for _, pair := range [][2]*repodb.Entry{{a, b}, {b, a}} {
+		for _, c := range slices.Concat(pair[0].Conflicts, pair[0].Replaces) {
+			if pair[1].Satisfies(repodb.ParseDependency(c)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkFileConflicts verifies that the added entries do not install files that
+// other packages of the target database (as it will be after publishing) own,
+// which pacman would refuse with "exists in filesystem". Directories may be
+// shared, and packages that conflict with each other are never installed
+// together. Entries without a file list (no files database) are not checked.
+func checkFileConflicts(added []*repodb.Entry, target *repodb.DB) error {
+	owners := map[string][]*repodb.Entry{}
+	for _, name := range target.Names() {
+		for _, f := range target.Entries[name].Files {
+			if !strings.HasSuffix(f, "/") {
+				owners[f] = append(owners[f], target.Entries[name])
+			}
+		}
+	}
+	var conflicts []string
+	for _, e := range added {
+		paths := map[string][]string{}
+		for _, f := range e.Files {
+			for _, other := range owners[f] {
+				if other.Name != e.Name && !excludes(e, other) {
+					paths[other.Name] = append(paths[other.Name], f)
+				}
+			}
+		}
+		for _, other := range slices.Sorted(maps.Keys(paths)) {
+			files := paths[other]
+			line := fmt.Sprintf("%s and %s both contain /%s", e.Name, other, strings.Join(files[:min(len(files), maxConflictPaths)], ", /"))
+			if len(files) > maxConflictPaths {
+				line += fmt.Sprintf(" and %d more", len(files)-maxConflictPaths)
+			}
+			conflicts = append(conflicts, line)
+		}
+	}
+	if len(conflicts) > 0 {
+		return &builderError{
+			Category: errPublish,
+			Err:      fmt.Errorf("refusing to publish packages with conflicting files:\n  %s", strings.Join(conflicts, "\n  ")),
+			Hint:     "Move the files to a single package, declare conflicts=() between the packages, or pass --no-file-check.",
+		}
+	}
+	return nil
+}
+
+// removePackageFile deletes the package file of e (and its signature) next to the database.
+func removePackageFile(dbPath string, e *repodb.Entry) {
+	if e.Filename == "" {
+		return
+	}
+	file := filepath.Join(filepath.Dir(dbPath), e.Filename)
+	for _, f := range []string{file, file + ".sig"} {
+		if err := os.Remove(f); err == nil {
+			log.Printf("  Removed: %s", f)
+		}
+	}
+}
+
+// workspacePKGBUILDs finds the PKGBUILDs below root and returns them keyed by
+// directory. PKGBUILDs that cannot be parsed are skipped with a warning.
+func workspacePKGBUILDs(root string) (map[string]*pkgbuildInfo, error) {
+	infos := map[string]*pkgbuildInfo{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		pkgbuild := filepath.Join(path, "PKGBUILD")
+		if _, err := os.Stat(pkgbuild); err != nil {
+			return nil
+		}
+		info, err := parsePKGBUILD(pkgbuild)
+		if err != nil {
+			log.Printf("Warning: skipping %s: %v", pkgbuild, err)
+			return filepath.SkipDir
+		}
+		infos[path] = info
+		// Build directories (src/, pkg/) do not contain further packages
+		return filepath.SkipDir
+	})
+	return infos, err
+}
+
+// packageNames returns the package names a PKGBUILD defines: every pkgname
+// and the pkgbase.
+func packageNames(info *pkgbuildInfo) []string {
+	names := info.Arrays["pkgname"]
+	if len(names) == 0 {
+		names = []string{info.PkgName}
+	}
+	if base := info.Vars["pkgbase"]; base != "" {
+		names = append(slices.Clone(names), base)
+	}
+	return names
+}
+
+// workspacePackages finds the PKGBUILDs below root and returns the directory
+// of every package name and pkgbase they define.
+func workspacePackages(root string) (map[string]string, error) {
+	infos, err := workspacePKGBUILDs(root)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := map[string]string{}
+	for dir, info := range infos {
+		for _, name := range packageNames(info) {
+			pkgs[name] = dir
+		}
+	}
+	return pkgs, nil
+}
+
+// findOrphans returns the entries of db without a PKGBUILD in the workspace,
+// and, if maxAge is set, those not rebuilt within maxAge.
+func findOrphans(db *repodb.DB, workspace map[string]string, maxAge time.Duration) map[string]string {
+	orphans := map[string]string{}
+	for _, name := range db.Names() {
+		e := db.Entries[name]
+		_, ok := workspace[name]
+		if !ok && e.Base != "" {
+			_, ok = workspace[e.Base]
+		}
+		switch {
+		case !ok:
+			orphans[name] = "no PKGBUILD in the workspace"
+		case maxAge > 0 && e.BuildDate > 0 && time.Since(time.Unix(e.BuildDate, 0)) > maxAge:
+			orphans[name] = fmt.Sprintf("last built %s", time.Unix(e.BuildDate, 0).Local().Format(time.DateOnly))
+		}
+	}
+	return orphans
+}
+
+// newRepoCmd creates the 'repo' command and its subcommands.
+func newRepoCmd() *cobra.Command {
+	var sign, snapshot bool
+	var signKey string
+	cmd := &cobra.Command{
+		Use:   "repo",
+		Short: "Manages pacman repository databases without repo-add.",
+	}
+	cmd.PersistentFlags().BoolVar(&sign, "sign", false, "Sign the updated databases using GPG")
+	cmd.PersistentFlags().StringVar(&signKey, "key", "", "GPG key to sign with (default: gpg default key)")
+	cmd.PersistentFlags().BoolVar(&snapshot, "snapshot", false, "Snapshot the repository before changing it (see 'repo snapshot')")
+
+	var removeOld, noDepCheck, noFileCheck bool
+	var march string
+	// addToRepo publishes to dbPath; baseline is the database of the baseline
+	// repository when dbPath holds optimized packages
+	var addToRepo func(ctx context.Context, dbPath, baseline string, files []string, entries []*repodb.Entry) error
+	addCmd := &cobra.Command{
+		Use:   "add [<db>] <package files...>",
+		Short: "Adds packages to a repository database, replacing older versions.",
+		Args:  cobra.MinimumNArgs(1),
+		Long: `Adds packages to a repository database, replacing older versions. The database
+defaults to build.channel, typically set per package in .pkgbuilder.yaml. A
+database path containing $arch is expanded per package: architecture-specific
+packages go to the database of their architecture and arch=(any) packages,
+which are built only once, to the database of every architecture in
+repo.arches. Package files not yet in a database's directory are linked there.
+Packages optimized with --march (or build.march) go to the per-ISA repository
+of the database instead, e.g. prism-v3 for prism (see repo.marches); baseline
+packages drop the older optimized builds they supersede there.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if isPackageFile(args[0]) {
+				if cfg.Build.Channel == "" {
+					return errorf(errConfig, "no database given and build.channel is not set")
+				}
+				args = append([]string{cfg.Build.Channel}, args...)
+			}
+			if len(args) < 2 {
+				return errorf(errConfig, "no package files given")
+			}
+			if march == "" {
+				march = cfg.Build.March
+			}
+			optimized := march != "" && march != baselineMarch
+			baseArg, dbArg := repoDBPath(args[0]), repoDBPath(args[0])
+			if optimized {
+				dbArg = optimizedDBPath(args[0], march)
+				log.Printf("Publishing packages optimized for %s to %s", march, dbArg)
+			}
+			files := args[1:]
+
+			// Reading and checksumming large packages dominates, so do it concurrently
+			entries := make([]*repodb.Entry, len(files))
+			indexes := make([]int, len(entries))
+			for i := range indexes {
+				indexes[i] = i
+			}
+			if err := runParallel(defaultJobs, indexes, func(i int) error {
+				entry, err := repodb.EntryFromPackage(files[i])
+				entries[i] = entry
+				return err
+			}); err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+
+			// Databases are expanded per architecture when the path contains $arch
+			targets := map[string][]int{}
+			for i, e := range entries {
+				arches := []string{""}
+				if strings.Contains(dbArg, "$arch") {
+					arches = repoArches(e)
+				}
+				for _, arch := range arches {
+					targets[arch] = append(targets[arch], i)
+				}
+			}
+			var published []string
+			for _, arch := range slices.Sorted(maps.Keys(targets)) {
+				path := strings.ReplaceAll(dbArg, "$arch", arch)
+				var pathFiles []string
+				var pathEntries []*repodb.Entry
+				for _, i := range targets[arch] {
+					pathFiles = append(pathFiles, files[i])
+					pathEntries = append(pathEntries, entries[i])
+				}
+				baseline := ""
+				if optimized {
+					baseline = strings.ReplaceAll(baseArg, "$arch", arch)
+				}
+				if err := addToRepo(cmd.Context(), path, baseline, pathFiles, pathEntries); err != nil {
+					return err
+				}
+				published = append(published, path)
+				if optimized {
+					continue
+				}
+				for _, level := range cfg.Repo.Marches {
+					opt := strings.ReplaceAll(optimizedDBPath(args[0], level), "$arch", arch)
+					changed, err := pruneOptimized(cmd.Context(), opt, pathEntries, sign, signKey)
+					if err != nil {
+						return errorf(errPublish, "%w", err)
+					}
+					if changed {
+						published = append(published, opt)
+					}
+				}
+			}
+			// Hooks run once the databases are unlocked, as they may read them
+			for _, path := range published {
+				if err := runPostPublish(cmd.Context(), path); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	addToRepo = func(ctx context.Context, dbPath, baseline string, files []string, entries []*repodb.Entry) error {
+		if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+			return errorf(errPublish, "could not create %s: %w", filepath.Dir(dbPath), err)
+		}
+		lock, err := lockRepoDB(ctx, dbPath)
+		if err != nil {
+			return errorf(errPublish, "%w", err)
+		}
+		defer lock.unlock()
+		db, err := openRepoDB(dbPath)
+		if err != nil {
+			return errorf(errPublish, "%w", err)
+		}
+
+		if !noDepCheck {
+			syncDBs, err := loadSyncDBs(cfg.Repo.SyncDBs)
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			if baseline != "" {
+				// Optimized repositories are used together with their baseline
+				if b, err := repodb.Read(baseline); err == nil {
+					syncDBs = append(syncDBs, b)
+				}
+			}
+			if len(syncDBs) == 0 {
+				log.Printf("Warning: no sync databases found (%s); only %s is checked for dependencies", defaultSyncDBs, dbPath)
+			}
+			// Check against the database as it will be after adding the new packages
+			if err := checkDependencies(entries, pendingDB(db, entries), syncDBs); err != nil {
+				return err
+			}
+		}
+		if !noFileCheck {
+			if err := checkFileConflicts(entries, pendingDB(db, entries)); err != nil {
+				return err
+			}
+		}
+		sizes, published := map[string]packageSize{}, map[string]packageSize{}
+		depends, publishedDepends := map[string][]string{}, map[string][]string{}
+		for _, e := range entries {
+			sizes[e.Name] = packageSize{Compressed: e.CSize, Installed: e.ISize}
+			depends[e.Name] = e.Depends
+			if old, ok := db.Entries[e.Name]; ok {
+				published[e.Name] = packageSize{Compressed: old.CSize, Installed: old.ISize}
+				publishedDepends[e.Name] = old.Depends
+			}
+		}
+		if baseline != "" {
+			warnBaselineMismatch(baseline, entries)
+		}
+		reportDependencyChanges(depends, publishedDepends, "the published version")
+		if err := checkSizeGrowth(sizes, published, "the published version"); err != nil {
+			return err
+		}
+
+		if err := snapshotBeforePublish(dbPath, snapshot, "before adding "+strings.Join(files, " ")); err != nil {
+			return errorf(errPublish, "%w", err)
+		}
+		if err := linkPackageFiles(files, filepath.Dir(dbPath)); err != nil {
+			return errorf(errPublish, "%w", err)
+		}
+		for _, entry := range entries {
+			old := db.Add(entry)
+			if old == nil {
+				log.Printf("  Added: %s %s", entry.Name, entry.Version)
+				continue
+			}
+			log.Printf("  Updated: %s %s -> %s", entry.Name, old.Version, entry.Version)
+			makeDeltas(ctx, dbPath, old, entry)
+			if removeOld && old.Filename != entry.Filename {
+				removePackageFile(dbPath, old)
+			}
+		}
+
+		if err := writeRepoDB(ctx, db, dbPath, sign, signKey); err != nil {
+			return errorf(errPublish, "%w", err)
+		}
+		log.Printf("Repository database %s updated (%d packages).", dbPath, len(db.Entries))
+		return nil
+	}
+	addCmd.Flags().BoolVar(&removeOld, "remove", false, "Remove the package files of replaced versions")
+	addCmd.Flags().BoolVar(&noDepCheck, "no-dep-check", false, "Publish even if runtime dependencies cannot be satisfied")
+	addCmd.Flags().BoolVar(&noFileCheck, "no-file-check", false, "Publish even if packages contain files owned by other packages of the repository")
+	addCmd.Flags().StringVar(&march, "march", "", "Microarchitecture level the packages were optimized for; publishes to the per-ISA repository (default build.march)")
+
+	removeCmd := &cobra.Command{
+		Use:               "remove <db> <package names...>",
+		Short:             "Removes packages from a repository database.",
+		Args:              cobra.MinimumNArgs(2),
+		ValidArgsFunction: completeRepoPackages,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbPath := repoDBPath(args[0])
+			lock, err := lockRepoDB(cmd.Context(), dbPath)
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			defer lock.unlock()
+			db, err := repodb.Read(dbPath)
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			if err := snapshotBeforePublish(dbPath, snapshot, "before removing "+strings.Join(args[1:], " ")); err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			for _, name := range args[1:] {
+				if db.Remove(name) {
+					log.Printf("  Removed: %s", name)
+				} else {
+					log.Printf("Warning: package %s not found in %s", name, dbPath)
+				}
+			}
+			if err := writeRepoDB(cmd.Context(), db, dbPath, sign, signKey); err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			log.Printf("Repository database %s updated (%d packages).", dbPath, len(db.Entries))
+			return mirrorRepoDir(cmd.Context(), dbPath)
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list <db>",
+		Short: "Lists the packages of a repository database.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := repodb.Read(repoDBPath(args[0]))
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			for _, name := range db.Names() {
+				fmt.Printf("%s %s\n", name, db.Entries[name].Version)
+			}
+			return nil
+		},
+	}
+
+	var workspace string
+	var olderThan int
+	var removeOrphans bool
+	orphansCmd := &cobra.Command{
+		Use:   "orphans <db>",
+		Short: "Lists packages whose PKGBUILD is gone from the workspace or that are stale.",
+		Long: `Lists the packages of a repository database that no PKGBUILD below --workspace
+defines any more (matched by pkgname or pkgbase), and with --older-than those
+that have not been rebuilt for the given number of days. With --remove they are
+dropped from the database and their package files are deleted.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbPath := repoDBPath(args[0])
+			if removeOrphans {
+				lock, err := lockRepoDB(cmd.Context(), dbPath)
+				if err != nil {
+					return errorf(errPublish, "%w", err)
+				}
+				defer lock.unlock()
+			}
+			db, err := repodb.Read(dbPath)
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			pkgs, err := workspacePackages(workspace)
+			if err != nil {
+				return errorf(errGeneral, "could not scan workspace %s: %w", workspace, err)
+			}
+			debugPrint("Found %d package names in %s", len(pkgs), workspace)
+			orphans := findOrphans(db, pkgs, time.Duration(olderThan)*24*time.Hour)
+			if len(orphans) == 0 {
+				log.Printf("No orphaned packages in %s.", dbPath)
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "PACKAGE\tVERSION\tREASON")
+			for _, name := range db.Names() {
+				if reason, ok := orphans[name]; ok {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", name, db.Entries[name].Version, reason)
+				}
+			}
+			w.Flush()
+			if !removeOrphans {
+				return nil
+			}
+			if err := snapshotBeforePublish(dbPath, snapshot, "before removing orphans"); err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+
+			for _, name := range db.Names() {
+				if _, ok := orphans[name]; !ok {
+					continue
+				}
+				removePackageFile(dbPath, db.Entries[name])
+				db.Remove(name)
+				log.Printf("  Removed: %s", name)
+			}
+			if err := writeRepoDB(cmd.Context(), db, dbPath, sign, signKey); err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			log.Printf("Repository database %s updated (%d packages).", dbPath, len(db.Entries))
+			return mirrorRepoDir(cmd.Context(), dbPath)
+		},
+	}
+	orphansCmd.Flags().StringVar(&workspace, "workspace", ".", "Directory containing the package sources")
+	orphansCmd.Flags().IntVar(&olderThan, "older-than", 0, "Also report packages not rebuilt for this many days")
+	orphansCmd.Flags().BoolVar(&removeOrphans, "remove", false, "Remove the orphaned packages from the database and delete their files")
+
+	cmd.AddCommand(addCmd, removeCmd, listCmd, orphansCmd, newRepoSyncCmd(), newRepoSiteCmd())
+	cmd.AddCommand(newRepoSnapshotCmds()...)
+	return cmd
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// mrNoteMarker identifies the note of a package, so later pipelines update
+// it instead of adding another one.
+const mrNoteMarker = "<!-- builder-report:%s -->"
+
+// mrReport renders the merge request note for the latest build of a package,
+// comparing it with prev, the successful build before it (may be nil).
+func mrReport(rec, prev *buildRecord) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, mrNoteMarker+"\n", rec.Package)
+	icon := ":white_check_mark:"
+	switch rec.Result {
+	case resultFailed:
+		icon = ":x:"
+	case resultCancelled, resultSkipped:
+		icon = ":warning:"
+	}
+	fmt.Fprintf(&b, "### %s `%s` %s: %s\n\n", icon, rec.Package, rec.Version, rec.Result)
+	fmt.Fprintf(&b, "Built in %s", rec.Duration.Round(time.Second))
+	if job := os.Getenv("CI_JOB_URL"); job != "" {
+		fmt.Fprintf(&b, " ([job log](%s))", job)
+	}
+	b.WriteString(".\n")
+	if len(rec.Maintainers) > 0 {
+		// @usernames in notes notify the maintainers
+		fmt.Fprintf(&b, "\n**Maintainers:** %s\n", strings.Join(rec.Maintainers, ", "))
+	}
+
+	if a := rec.Analysis; a != nil {
+		fmt.Fprintf(&b, "\n**Build log:** %s\n", a.Summary())
+		for _, c := range a.Causes {
+			fmt.Fprintf(&b, "- `%s` line %d: %s\n", c.Signature, c.Line, c.Hint)
+		}
+	}
+
+	if c := rec.Cache; c != nil {
+		fmt.Fprintf(&b, "\n**Compiler cache:** %s\n", c)
+	}
+
+	if d := rec.Distributed; d != nil {
+		fmt.Fprintf(&b, "\n**Distributed compilation:** %s\n", d)
+	}
+
+	if a := rec.Audit; a != nil {
+		b.WriteString(auditReport(a))
+	}
+
+	if len(rec.Sizes) > 0 {
+		b.WriteString("\n| Package | Package size | Installed size |\n|---|---|---|\n")
+		for _, name := range slices.Sorted(maps.Keys(rec.Sizes)) {
+			cur := rec.Sizes[name]
+			var old packageSize
+			if prev != nil {
+				old = prev.Sizes[name]
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", name, sizeChange(old.Compressed, cur.Compressed), sizeChange(old.Installed, cur.Installed))
+		}
+	}
+
+	if len(rec.Footprint) > 0 {
+		b.WriteString(footprintReport(rec.Footprint, prev))
+	}
+
+	if prev != nil && prev.Depends != nil {
+		for _, name := range slices.Sorted(maps.Keys(rec.Depends)) {
+			old, ok := prev.Depends[name]
+			if !ok {
+				continue
+			}
+			changes := diffDependencies(old, rec.Depends[name])
+			if len(changes) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "\n**Dependencies of `%s`** changed since %s:\n", name, prev.Version)
+			for _, c := range changes {
+				fmt.Fprintf(&b, "- %s\n", c)
+			}
+		}
+	}
+
+	if len(rec.Artifacts) > 0 {
+		b.WriteString("\n<details><summary>Artifacts</summary>\n\n")
+		for _, name := range slices.Sorted(maps.Keys(rec.Artifacts)) {
+			fmt.Fprintf(&b, "- `%s` sha256 `%.16s…`\n", name, rec.Artifacts[name])
+		}
+		b.WriteString("\n</details>\n")
+	}
+	if rec.Environment != nil {
+		b.WriteString(environmentReport(rec.Environment))
+	}
+	return b.String()
+}
+
+// sizeChange renders a size with its change relative to old, if known.
+func sizeChange(old, new int64) string {
+	if old <= 0 || old == new {
+		return formatSize(new)
+	}
+	return fmt.Sprintf("%s (%+.1f%%)", formatSize(new), float64(new-old)*100/float64(old))
+}
+
+// gitlabClient calls the GitLab REST API of a project.
+type gitlabClient struct {
+	api     string
+	project string
+	header  string
+	token   string
+}
+
+// newGitlabClient configures a client from the CI environment. CI_JOB_TOKEN
+// cannot write notes, so a project or personal access token is preferred.
+func newGitlabClient(project string) (*gitlabClient, error) {
+	api := os.Getenv("CI_API_V4_URL")
+	if api == "" {
+		api = strings.TrimSuffix(os.Getenv("CI_SERVER_URL"), "/") + "/api/v4"
+	}
+	if api == "/api/v4" {
+		return nil, errorf(errConfig, "GitLab API URL unknown: CI_API_V4_URL is not set")
+	}
+	if project == "" {
+		project = os.Getenv("CI_PROJECT_ID")
+	}
+	if project == "" {
+		return nil, errorf(errConfig, "no project: pass --project or run in GitLab CI")
+	}
+	token, err := getSecret("gitlab-token")
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, errorf(errConfig, "no GitLab token: set BUILDER_GITLAB_TOKEN")
+	}
+	header := "PRIVATE-TOKEN"
+	if token == os.Getenv("CI_JOB_TOKEN") {
+		header = "JOB-TOKEN"
+	}
+	return &gitlabClient{api: strings.TrimSuffix(api, "/"), project: url.PathEscape(project), header: header, token: token}, nil
+}
+
+// do sends a request to path below the project and decodes the JSON response
+// into out, if given. It returns the response headers.
+func (c *gitlabClient) do(ctx context.Context, method, path string, body, out any) (http.Header, error) {
+	return c.request(ctx, method, "/projects/"+c.project+path, body, out)
+}
+
+// request sends a request to path below the API, e.g. /users.
+func (c *gitlabClient) request(ctx context.Context, method, path string, body, out any) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.api+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(c.header, c.token)
+	req.Header.Set("User-Agent", "builder/"+version)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: HTTP %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, fmt.Errorf("could not decode %s response: %w", path, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+// gitlabNote is a merge request note as returned by the API.
+type gitlabNote struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+// findNote returns the ID of the merge request note containing marker, or 0.
+func (c *gitlabClient) findNote(ctx context.Context, mr, marker string) (int64, error) {
+	for page := "1"; page != ""; {
+		var notes []gitlabNote
+		header, err := c.do(ctx, http.MethodGet, "/merge_requests/"+mr+"/notes?per_page=100&page="+page, nil, &notes)
+		if err != nil {
+			return 0, err
+		}
+		for _, n := range notes {
+			if strings.Contains(n.Body, marker) {
+				return n.ID, nil
+			}
+		}
+		page = header.Get("X-Next-Page")
+	}
+	return 0, nil
+}
+
+// postNote creates the note, or updates the one left by an earlier pipeline.
+func (c *gitlabClient) postNote(ctx context.Context, mr, marker, body string) error {
+	id, err := c.findNote(ctx, mr, marker)
+	if err != nil {
+		return err
+	}
+	payload := map[string]string{"body": body}
+	if id == 0 {
+		_, err = c.do(ctx, http.MethodPost, "/merge_requests/"+mr+"/notes", payload, nil)
+		return err
+	}
+	debugPrint("Updating note %d", id)
+	_, err = c.do(ctx, http.MethodPut, fmt.Sprintf("/merge_requests/%s/notes/%d", mr, id), payload, nil)
+	return err
+}
+
+// newReportCmd creates the 'report' command.
+func newReportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Publishes build reports for reviewers.",
+	}
+
+	var pkg, project, mr string
+	var dryRun, assign bool
+	mrCmd := &cobra.Command{
+		Use:   "mr",
+		Short: "Posts or updates a merge request note summarizing the last build.",
+		Long: `Summarizes the last recorded build of the package in the current directory
+(result, build log findings, package and installed sizes, dependency changes
+and artifacts, compared with the previous successful build) and posts it as a
+merge request note through the GitLab API. A later pipeline updates the same
+note. The merge request and project default to CI_MERGE_REQUEST_IID and
+CI_PROJECT_ID; the token is read from BUILDER_GITLAB_TOKEN.
+
+The note mentions the maintainers of the package: those listed in a MAINTAINERS
+file in its directory, else the owners of its PKGBUILD by the CODEOWNERS of the
+repository, else the Maintainer comments of the PKGBUILD. --assign also makes
+the maintainers with a GitLab @username reviewers of the merge request.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if pkg == "" {
+				info, err := parsePKGBUILD("PKGBUILD")
+				if err != nil {
+					return errorf(errParse, "%w", err)
+				}
+				pkg = info.PkgName
+			}
+			records, err := loadBuilds(func(r *buildRecord) bool { return r.Package == pkg }, 0)
+			if err != nil {
+				return errorf(errGeneral, "%w", err)
+			}
+			if len(records) == 0 {
+				return errorf(errGeneral, "no build of %s recorded in %s", pkg, stateDBPath)
+			}
+			var prev *buildRecord
+			for _, r := range records[1:] {
+				if r.Result == resultSuccess {
+					prev = r
+					break
+				}
+			}
+			body := mrReport(records[0], prev)
+			if dryRun {
+				fmt.Print(body)
+				return nil
+			}
+
+			if mr == "" {
+				mr = os.Getenv("CI_MERGE_REQUEST_IID")
+			}
+			if mr == "" {
+				log.Println("Not in a merge request pipeline, nothing to report.")
+				return nil
+			}
+			client, err := newGitlabClient(project)
+			if err != nil {
+				return err
+			}
+			if err := client.postNote(cmd.Context(), mr, fmt.Sprintf(mrNoteMarker, pkg), body); err != nil {
+				return &builderError{
+					Category: errPublish,
+					Err:      fmt.Errorf("could not post the merge request note: %w", err),
+					Hint:     "Check that BUILDER_GITLAB_TOKEN is a project or personal access token with the api scope; CI_JOB_TOKEN cannot write notes.",
+				}
+			}
+			log.Printf("Posted the build report of %s to merge request !%s", pkg, mr)
+			if assign {
+				assigned, err := client.assignReviewers(cmd.Context(), mr, records[0].Maintainers)
+				if err != nil {
+					return &builderError{
+						Category: errPublish,
+						Err:      fmt.Errorf("could not assign the maintainers as reviewers: %w", err),
+						Hint:     "Check that BUILDER_GITLAB_TOKEN may update the merge request and that the maintainers are project members.",
+					}
+				}
+				if len(assigned) > 0 {
+					log.Printf("Assigned %s as reviewer(s) of !%s", strings.Join(assigned, ", "), mr)
+				}
+			}
+			return nil
+		},
+	}
+	mrCmd.Flags().StringVar(&pkg, "package", "", "Package to report (default: pkgname of ./PKGBUILD)")
+	mrCmd.Flags().StringVar(&project, "project", "", "Project ID or path (default $CI_PROJECT_ID)")
+	mrCmd.Flags().StringVar(&mr, "mr", "", "Merge request IID (default $CI_MERGE_REQUEST_IID)")
+	mrCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the note instead of posting it")
+	mrCmd.Flags().BoolVar(&assign, "assign", false, "Make the maintainers of the package reviewers of the merge request")
+	mrCmd.RegisterFlagCompletionFunc("package", completeHistoryPackages)
+
+	cmd.AddCommand(mrCmd)
+	return cmd
+}
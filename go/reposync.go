@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// syncStagingDir holds the downloaded databases until all packages are mirrored,
+// so the mirror never references packages it does not have yet.
+const syncStagingDir = ".sync"
+
+// isPackageFile reports whether name is a package or package signature file.
+func isPackageFile(name string) bool {
+	// Not partial downloads or lock files (<pkg>.part, <pkg>.lock)
+	base := strings.TrimSuffix(name, ".sig")
+	i := strings.LastIndex(base, ".pkg.tar")
+	if i < 0 {
+		return false
+	}
+	ext := base[i+len(".pkg.tar"):]
+	return ext == "" || ext[0] == '.' && !strings.Contains(ext[1:], ".")
+}
+
+// verifySignature checks a detached signature against the keys in gpgDir.
+func verifySignature(ctx context.Context, gpgDir, file string) error {
+	out, err := newCommand(ctx, "gpg", "--homedir", gpgDir, "--batch", "--verify", file+".sig", file).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("bad signature for %s: %w\n%s", filepath.Base(file), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// fetchOptional downloads a file that may not exist on the server, such as a
+// signature, without the warnings and retries of the downloader. It reports
+// whether the file was downloaded.
+func fetchOptional(ctx context.Context, d *downloader, url, dest string) (bool, error) {
+	os.Remove(dest + ".part")
+	job := downloadJob{Name: filepath.Base(dest), Dest: dest}
+	if err := d.download(ctx, job, url); err != nil {
+		os.Remove(dest + ".part")
+		var perm permanentError
+		if errors.As(err, &perm) {
+			debugPrint("No %s: %v", url, err)
+			return false, nil
+		}
+		return false, err
+	}
+	return true, os.Rename(dest+".part", dest)
+}
+
+// syncDelta logs how the remote database differs from the mirrored one.
+func syncDelta(local, remote *repodb.DB) {
+	var added, updated, removed int
+	for name, e := range remote.Entries {
+		old, ok := local.Entries[name]
+		switch {
+		case !ok:
+			added++
+			log.Printf("  New: %s %s", name, e.Version)
+		case old.Version != e.Version || old.SHA256Sum != e.SHA256Sum:
+			updated++
+			log.Printf("  Updated: %s %s -> %s", name, old.Version, e.Version)
+		}
+	}
+	for name := range local.Entries {
+		if _, ok := remote.Entries[name]; !ok {
+			removed++
+			debugPrint("Removed upstream: %s", name)
+		}
+	}
+	log.Printf("%d new, %d updated, %d removed upstream, %d unchanged",
+		added, updated, removed, len(remote.Entries)-added-updated)
+}
+
+// newRepoSyncCmd creates the 'repo sync' command.
+func newRepoSyncCmd() *cobra.Command {
+	var from, to, gpgDir string
+	var jobs int
+	var verify, prune bool
+	cmd := &cobra.Command{
+		Use:   "sync --from <db url> --to <dir>",
+		Short: "Mirrors a remote pacman repository into a directory.",
+		Long: `Downloads the database at --from (e.g. https://host/staging/os/x86_64/staging.db)
+together with its files database and signatures, then every package it lists
+that is missing or changed in --to, in parallel. Packages are checked against
+their SHA-256 from the database and, with --verify, against their signatures
+using the keyring in --gpgdir. The databases are only replaced once all
+packages are in place. --prune deletes packages no longer listed.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if from == "" || to == "" {
+				return errorf(errConfig, "--from and --to are required")
+			}
+			baseURL, dbName := path.Split(from)
+			if !strings.Contains(dbName, ".db") {
+				return errorf(errConfig, "--from must point to a repository database (<repo>.db), got %s", from)
+			}
+			if err := os.MkdirAll(to, 0755); err != nil {
+				return errorf(errPublish, "could not create %s: %w", to, err)
+			}
+			lock, err := lockRepoDB(cmd.Context(), filepath.Join(to, dbName))
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			defer lock.unlock()
+			staging := filepath.Join(to, syncStagingDir)
+			if err := os.RemoveAll(staging); err != nil {
+				return errorf(errPublish, "could not clean %s: %w", staging, err)
+			}
+			if err := os.MkdirAll(staging, 0755); err != nil {
+				return errorf(errPublish, "could not create %s: %w", staging, err)
+			}
+			defer os.RemoveAll(staging)
+
+			rate, err := parseRate(cfg.Fetch.LimitRate)
+			if err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+			retries := 3
+			if cfg.Fetch.Retries > 0 {
+				retries = cfg.Fetch.Retries
+			}
+			d := &downloader{client: httpClient(), jobs: jobs, retries: retries, limiter: &rateLimiter{rate: rate}}
+			ctx := cmd.Context()
+
+			// The files database and signatures are optional
+			log.Printf("Fetching %s...", from)
+			if err := d.run(ctx, []downloadJob{{Name: dbName, URLs: []string{from}, Dest: filepath.Join(staging, dbName)}}); err != nil {
+				return errorf(errPublish, "could not download the repository database:\n%w", err)
+			}
+			dbFiles := []string{dbName}
+			for _, name := range []string{dbName + ".sig", repodb.FilesPath(dbName), repodb.FilesPath(dbName) + ".sig"} {
+				ok, err := fetchOptional(ctx, d, baseURL+name, filepath.Join(staging, name))
+				if err != nil {
+					return errorf(errPublish, "could not download %s: %w", name, err)
+				}
+				if ok {
+					dbFiles = append(dbFiles, name)
+				}
+			}
+			if verify {
+				if _, err := os.Stat(filepath.Join(staging, dbName+".sig")); err == nil {
+					if err := verifySignature(ctx, gpgDir, filepath.Join(staging, dbName)); err != nil {
+						return errorf(errSigning, "%w", err)
+					}
+				}
+			}
+
+			remote, err := repodb.ReadFile(filepath.Join(staging, dbName))
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			local := repodb.New()
+			if _, err := os.Stat(filepath.Join(to, dbName)); err == nil {
+				if local, err = repodb.ReadFile(filepath.Join(to, dbName)); err != nil {
+					log.Printf("Warning: could not read the mirrored database, syncing everything: %v", err)
+					local = repodb.New()
+				}
+			}
+			syncDelta(local, remote)
+
+			// Existing files that match their checksum are skipped by the downloader
+			var downloads []downloadJob
+			var unsigned []string
+			wanted := map[string]bool{}
+			for _, name := range remote.Names() {
+				e := remote.Entries[name]
+				if e.Filename == "" || e.Filename != filepath.Base(e.Filename) {
+					return errorf(errPublish, "invalid filename %q for %s in the remote database", e.Filename, name)
+				}
+				wanted[e.Filename], wanted[e.Filename+".sig"] = true, true
+				job := downloadJob{Name: e.Filename, URLs: []string{baseURL + e.Filename}, Dest: filepath.Join(to, e.Filename)}
+				if e.SHA256Sum != "" {
+					job.Checksums = map[string]string{"sha256sums": e.SHA256Sum}
+				}
+				downloads = append(downloads, job)
+
+				sigPath := filepath.Join(to, e.Filename+".sig")
+				if e.PGPSig != "" {
+					sig, err := base64.StdEncoding.DecodeString(e.PGPSig)
+					if err != nil {
+						return errorf(errPublish, "invalid signature for %s in the remote database: %w", name, err)
+					}
+					if err := os.WriteFile(sigPath, sig, 0644); err != nil {
+						return errorf(errPublish, "%w", err)
+					}
+				} else {
+					unsigned = append(unsigned, e.Filename)
+				}
+			}
+			log.Printf("Syncing %d package(s) into %s...", len(downloads), to)
+			if err := d.run(ctx, downloads); err != nil {
+				if ctx.Err() != nil {
+					return errorf(errCancelled, "sync cancelled")
+				}
+				return errorf(errPublish, "could not download packages:\n%w", err)
+			}
+			// Databases created without signatures embedded may still have .sig files
+			for _, name := range unsigned {
+				sigPath := filepath.Join(to, name+".sig")
+				os.Remove(sigPath)
+				if _, err := fetchOptional(ctx, d, baseURL+name+".sig", sigPath); err != nil {
+					return errorf(errPublish, "could not download %s.sig: %w", name, err)
+				}
+			}
+
+			if verify {
+				log.Printf("Verifying signatures...")
+				var errs []error
+				for _, job := range downloads {
+					if _, err := os.Stat(job.Dest + ".sig"); err != nil {
+						errs = append(errs, fmt.Errorf("%s is not signed", job.Name))
+						continue
+					}
+					if err := verifySignature(ctx, gpgDir, job.Dest); err != nil {
+						errs = append(errs, err)
+					}
+				}
+				if len(errs) > 0 {
+					return &builderError{
+						Category: errSigning,
+						Err:      errors.Join(errs...),
+						Hint:     fmt.Sprintf("Import the repository's signing keys into %s (pacman-key --recv-keys/--lsign-key) or use --verify=false.", gpgDir),
+					}
+				}
+			}
+
+			for _, name := range dbFiles {
+				if err := os.Rename(filepath.Join(staging, name), filepath.Join(to, name)); err != nil {
+					return errorf(errPublish, "could not install %s: %w", name, err)
+				}
+			}
+
+			if prune {
+				entries, err := os.ReadDir(to)
+				if err != nil {
+					return errorf(errPublish, "%w", err)
+				}
+				for _, entry := range entries {
+					if name := entry.Name(); entry.Type().IsRegular() && isPackageFile(name) && !wanted[name] {
+						if err := os.Remove(filepath.Join(to, name)); err == nil {
+							log.Printf("  Pruned: %s", name)
+						}
+					}
+				}
+			}
+			log.Printf("Mirror %s is in sync (%d packages).", to, len(remote.Entries))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "URL of the remote repository database")
+	cmd.Flags().StringVar(&to, "to", "", "Directory of the mirror")
+	cmd.Flags().IntVarP(&jobs, "jobs", "j", 4, "Number of parallel downloads")
+	cmd.Flags().BoolVar(&verify, "verify", true, "Verify package and database signatures")
+	cmd.Flags().StringVar(&gpgDir, "gpgdir", pacmanGnupgDir, "GnuPG home with the keys trusted for --verify")
+	cmd.Flags().BoolVar(&prune, "prune", false, "Delete packages that are no longer in the remote database")
+	return cmd
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// Modes of sandbox.mode.
+const (
+	sandboxAuto    = "auto"
+	sandboxRequire = "require"
+	sandboxOff     = "off"
+)
+
+// sandboxHome is the empty HOME of sandboxed commands.
+const sandboxHome = "/tmp/home"
+
+// warnNoSandbox warns once that PKGBUILDs are evaluated without a sandbox.
+var warnNoSandbox sync.Once
+
+// evaluateCommand returns a command running name with args in dir, which
+// sources the PKGBUILD there and so executes its code. Unless sandbox.mode
+// is off, it runs in a bubblewrap sandbox: without network and other
+// namespaces of the host, and without the environment of the job, which
+// holds CI tokens and secrets. Only the system (/usr, /etc, /opt) and dir
+// are visible, read-only, with empty /tmp, HOME, /home, /root and
+// $CI_BUILDS_DIR, so signing keys, SSH and registry credentials and the
+// file variables of the job cannot end up in the output. This keeps
+// PKGBUILDs of merge requests from doing harm when 'check-srcinfo' or 'bump'
+// evaluate them.
+func evaluateCommand(ctx context.Context, dir, name string, args ...string) (*command, error) {
+	mode := cfg.Sandbox.Mode
+	if mode == "" {
+		mode = sandboxAuto
+	}
+	if mode != sandboxOff {
+		if _, err := exec.LookPath("bwrap"); err == nil {
+			abs, err := filepath.Abs(dir)
+			if err != nil {
+				return nil, err
+			}
+			bwrap := []string{"--ro-bind", "/usr", "/usr", "--ro-bind", "/etc", "/etc"}
+			for _, p := range []string{"/opt", "/bin", "/sbin", "/lib", "/lib64"} {
+				bwrap = append(bwrap, "--ro-bind-try", p, p)
+			}
+			bwrap = append(bwrap, "--dev", "/dev", "--proc", "/proc", "--tmpfs", "/tmp", "--dir", sandboxHome,
+				"--tmpfs", "/home", "--tmpfs", "/root")
+			if builds := os.Getenv("CI_BUILDS_DIR"); filepath.IsAbs(builds) {
+				bwrap = append(bwrap, "--tmpfs", builds)
+			}
+			// The package directory is mounted over the empty directories
+			bwrap = append(bwrap, "--ro-bind", abs, abs, "--unshare-all", "--die-with-parent", "--new-session",
+				"--clearenv", "--setenv", "PATH", os.Getenv("PATH"), "--setenv", "HOME", sandboxHome, "--setenv", "LANG", "C.UTF-8",
+				"--chdir", abs, "--", name)
+			debugPrint("Evaluating the PKGBUILD in %s in a bubblewrap sandbox", dir)
+			return newCommand(ctx, "bwrap", append(bwrap, args...)...), nil
+		}
+		if mode == sandboxRequire {
+			return nil, &builderError{
+				Category: errDependency,
+				Err:      fmt.Errorf("sandbox.mode is require, but bwrap is not installed"),
+				Hint:     "Install bubblewrap in the build image, or set sandbox.mode to auto for trusted PKGBUILDs.",
+			}
+		}
+		warnNoSandbox.Do(func() {
+			log.Printf("Warning: bwrap is not installed; PKGBUILDs are evaluated without a sandbox")
+		})
+	}
+	cmd := newCommand(ctx, name, args...)
+	cmd.Dir = dir
+	return cmd, nil
+}
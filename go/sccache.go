@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// compilerCacheStats summarizes the sccache statistics of a build.
+type compilerCacheStats struct {
+	Backend  string `json:"backend"`
+	Requests int64  `json:"requests"`
+	Hits     int64  `json:"hits"`
+	Misses   int64  `json:"misses"`
+}
+
+// HitRate returns the percentage of cacheable compilations served from the cache.
+func (s *compilerCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return 100 * float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// String renders the statistics for build logs and reports.
+func (s *compilerCacheStats) String() string {
+	return fmt.Sprintf("%.0f%% hits (%d of %d cacheable compilations, %d requests) from %s", s.HitRate(), s.Hits, s.Hits+s.Misses, s.Requests, s.Backend)
+}
+
+// sccacheBackend returns cache.sccache.backend, or the backend the SCCACHE_*
+// variables of the CI configure, or "" when no shared cache is set up.
+func sccacheBackend() string {
+	switch {
+	case cfg.Cache.Sccache.Backend != "":
+		return cfg.Cache.Sccache.Backend
+	case os.Getenv("SCCACHE_BUCKET") != "":
+		return "s3"
+	case os.Getenv("SCCACHE_REDIS_ENDPOINT") != "" || os.Getenv("SCCACHE_REDIS") != "":
+		return "redis"
+	}
+	return ""
+}
+
+// sccacheEnv returns the environment pointing sccache at the shared cache and
+// the compilers of cargo and CMake at sccache.
+func sccacheEnv(backend string) ([]string, error) {
+	sc := cfg.Cache.Sccache
+	var env []string
+	set := func(name, value string) {
+		if value != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	switch backend {
+	case "s3":
+		set("SCCACHE_BUCKET", sc.Bucket)
+		set("SCCACHE_ENDPOINT", sc.Endpoint)
+		set("SCCACHE_REGION", sc.Region)
+		set("SCCACHE_S3_KEY_PREFIX", sc.Prefix)
+		// Without keys sccache falls back to the instance credentials
+		for secret, name := range map[string]string{"s3-access-key": "AWS_ACCESS_KEY_ID", "s3-secret-key": "AWS_SECRET_ACCESS_KEY"} {
+			value, err := getSecret(secret)
+			if err != nil {
+				return nil, err
+			}
+			set(name, value)
+		}
+	case "redis":
+		endpoint, err := getSecret("sccache-redis")
+		if err != nil {
+			return nil, err
+		}
+		set("SCCACHE_REDIS_ENDPOINT", endpoint)
+		set("SCCACHE_REDIS_KEY_PREFIX", sc.Prefix)
+	}
+	return append(env, "RUSTC_WRAPPER=sccache", "CMAKE_C_COMPILER_LAUNCHER=sccache", "CMAKE_CXX_COMPILER_LAUNCHER=sccache"), nil
+}
+
+// startSccache starts the sccache server with the shared cache configured,
+// so the first compilation does not pay for connecting to the backend, and
+// returns the build environment using it. Without sccache the build runs
+// uncached.
+func startSccache(ctx context.Context, backend string) ([]string, error) {
+	if _, err := exec.LookPath("sccache"); err != nil {
+		log.Printf("Warning: cache.sccache is configured but sccache is not installed; building without a shared compiler cache")
+		return nil, nil
+	}
+	env, err := sccacheEnv(backend)
+	if err != nil {
+		return nil, err
+	}
+	// The server reads its configuration when it starts
+	stop := newCommand(ctx, "sccache", "--stop-server")
+	stop.Stdout, stop.Stderr = nil, nil
+	stop.Run()
+	log.Printf("Starting sccache with the %s backend...", backend)
+	start := newCommand(ctx, "sccache", "--start-server")
+	start.Env = append(os.Environ(), env...)
+	if err := start.Run(); err != nil {
+		log.Printf("Warning: could not start sccache: %v; building without a shared compiler cache", err)
+		return nil, nil
+	}
+	if err := runCommand(ctx, "sccache", "--zero-stats"); err != nil {
+		log.Printf("Warning: could not reset the sccache statistics: %v", err)
+	}
+	return env, nil
+}
+
+// stopSccache reads the statistics of the build from the sccache server and
+// stops it, which also flushes pending cache writes.
+func stopSccache(ctx context.Context, backend string) *compilerCacheStats {
+	defer func() {
+		stop := newCommand(ctx, "sccache", "--stop-server")
+		stop.Stdout = nil
+		stop.Run()
+	}()
+	cmd := newCommand(ctx, "sccache", "--show-stats", "--stats-format", "json")
+	cmd.Stderr = nil
+	out, err := cmd.Output()
+	if err != nil {
+		log.Printf("Warning: could not read the sccache statistics: %v", err)
+		return nil
+	}
+	var raw struct {
+		Stats struct {
+			CompileRequests int64 `json:"compile_requests"`
+			CacheHits       struct {
+				Counts map[string]int64 `json:"counts"`
+			} `json:"cache_hits"`
+			CacheMisses struct {
+				Counts map[string]int64 `json:"counts"`
+			} `json:"cache_misses"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(out, &raw); err != nil {
+		log.Printf("Warning: could not parse the sccache statistics: %v", err)
+		return nil
+	}
+	stats := &compilerCacheStats{Backend: backend, Requests: raw.Stats.CompileRequests}
+	for _, n := range raw.Stats.CacheHits.Counts {
+		stats.Hits += n
+	}
+	for _, n := range raw.Stats.CacheMisses.Counts {
+		stats.Misses += n
+	}
+	return stats
+}
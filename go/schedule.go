@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression: minute, hour, day of month,
+// month and day of week, in UTC.
+type cronSchedule struct {
+	minute, hour, dom, month, dow []bool
+	// domAny and dowAny record unrestricted fields; when both days are
+	// restricted, either matching is enough, as in cron
+	domAny, dowAny bool
+}
+
+// parseCronField parses one field of a cron expression such as */15, 1-5
+// or 0,30 with values from lo to hi.
+func parseCronField(field string, lo, hi int) ([]bool, error) {
+	set := make([]bool, hi+1)
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return nil, fmt.Errorf("invalid value in %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return nil, fmt.Errorf("invalid range in %q", part)
+				}
+			} else if hasStep {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// parseCron parses a five-field cron expression.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q must have 5 fields: minute hour day month weekday", expr)
+	}
+	limits := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := make([][]bool, 5)
+	for i, f := range fields {
+		set, err := parseCronField(f, limits[i][0], limits[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is 0 or 7
+	sets[4][0] = sets[4][0] || sets[4][7]
+	return &cronSchedule{sets[0], sets[1], sets[2], sets[3], sets[4], fields[2] == "*", fields[4] == "*"}, nil
+}
+
+// next returns the first time after t the schedule matches, or the zero time
+// if it never does, e.g. on 31 February.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	// Every schedule matches within four years (29 February)
+	for limit := t.AddDate(4, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if !c.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC).Add(-time.Minute)
+			continue
+		}
+		dom, dow := c.dom[t.Day()], c.dow[t.Weekday()]
+		dayMatches := dom && dow
+		if !c.domAny && !c.dowAny {
+			dayMatches = dom || dow
+		}
+		if !dayMatches {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC).Add(-time.Minute)
+			continue
+		}
+		if c.hour[t.Hour()] && c.minute[t.Minute()] {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// taskStatus is the state of a scheduled task, as served by the status
+// endpoint.
+type taskStatus struct {
+	Name       string    `json:"name"`
+	Schedule   string    `json:"schedule"`
+	Next       time.Time `json:"next,omitzero"`
+	Running    int       `json:"running"`
+	Runs       int       `json:"runs"`
+	Skipped    int       `json:"skipped"`
+	LastStart  time.Time `json:"last_start,omitzero"`
+	LastFinish time.Time `json:"last_finish,omitzero"`
+	LastResult string    `json:"last_result,omitempty"`
+}
+
+// scheduler runs the tasks of serve.schedule: builder commands on the
+// coordinator and builds queued for the workers.
+type scheduler struct {
+	c           *coordinator
+	builderArgs []string
+
+	mu     sync.Mutex
+	status map[string]*taskStatus
+}
+
+func newScheduler(c *coordinator, builderArgs []string) *scheduler {
+	s := &scheduler{c: c, builderArgs: builderArgs, status: map[string]*taskStatus{}}
+	for _, t := range cfg.Serve.Schedule {
+		schedule := t.Cron
+		if schedule == "" {
+			schedule = "every " + t.Every.String()
+		}
+		s.status[t.Name] = &taskStatus{Name: t.Name, Schedule: schedule}
+	}
+	return s
+}
+
+// snapshot returns the status of every task in configuration order.
+func (s *scheduler) snapshot() []taskStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []taskStatus
+	for _, t := range cfg.Serve.Schedule {
+		list = append(list, *s.status[t.Name])
+	}
+	return list
+}
+
+// run starts every task on its schedule until ctx is cancelled.
+func (s *scheduler) run(ctx context.Context) {
+	for _, t := range cfg.Serve.Schedule {
+		go s.loop(ctx, t)
+	}
+}
+
+// loop runs one task whenever it is due. A run is skipped when the task's
+// concurrency limit is reached.
+func (s *scheduler) loop(ctx context.Context, t scheduledTask) {
+	var cron *cronSchedule
+	if t.Cron != "" {
+		// Validated with the configuration
+		cron, _ = parseCron(t.Cron)
+	}
+	limit := max(t.Concurrency, 1)
+	for {
+		next := time.Now().Add(t.Every)
+		if cron != nil {
+			next = cron.next(time.Now())
+		}
+		if next.IsZero() {
+			// Rejected with the configuration; never run rather than constantly
+			log.Printf("Warning: the schedule of task %s never matches, it is not run", t.Name)
+			return
+		}
+		s.mu.Lock()
+		s.status[t.Name].Next = next.UTC()
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		if len(t.Builds) > 0 {
+			s.queueBuilds(t, limit)
+			continue
+		}
+		s.mu.Lock()
+		st := s.status[t.Name]
+		if st.Running >= limit {
+			st.Skipped++
+			s.mu.Unlock()
+			log.Printf("Warning: task %s is still running, skipping this run", t.Name)
+			continue
+		}
+		st.Running++
+		s.mu.Unlock()
+		go s.runCommand(ctx, t)
+	}
+}
+
+// runCommand runs the builder command of a task, writing its output to
+// <data-dir>/tasks/<name>.log.
+func (s *scheduler) runCommand(ctx context.Context, t scheduledTask) {
+	started := time.Now().UTC()
+	s.mu.Lock()
+	s.status[t.Name].LastStart = started
+	s.mu.Unlock()
+	log.Printf("Running task %s: builder %s", t.Name, strings.Join(t.Run, " "))
+
+	result := "succeeded"
+	err := func() error {
+		logPath := filepath.Join(s.c.dir, "tasks", t.Name+".log")
+		if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(logPath)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		self, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		run := newCommand(ctx, self, append(slices.Clone(s.builderArgs), t.Run...)...)
+		run.Stdout, run.Stderr = run.redacting(out), run.redacting(out)
+		return run.Run()
+	}()
+	if err != nil {
+		result = "failed: " + err.Error()
+		log.Printf("Warning: task %s failed: %v", t.Name, err)
+	} else {
+		log.Printf("  Finished: task %s in %s", t.Name, time.Since(started).Round(time.Second))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status[t.Name]
+	st.Running--
+	st.Runs++
+	st.LastFinish, st.LastResult = time.Now().UTC(), result
+}
+
+// queueBuilds queues the builds of a task, keeping at most limit of its jobs
+// queued or running.
+func (s *scheduler) queueBuilds(t scheduledTask, limit int) {
+	active := 0
+	s.c.mu.Lock()
+	for _, id := range s.c.order {
+		if job := s.c.jobs[id]; job.Task == t.Name && (job.Status == jobQueued || job.Status == jobRunning) {
+			active++
+		}
+	}
+	s.c.mu.Unlock()
+
+	queued, skipped := 0, 0
+	for _, b := range t.Builds {
+		if active >= limit {
+			skipped++
+			continue
+		}
+		src := &gitSource{Repo: b.Repo, Ref: b.Ref, Path: b.Path}
+		if src.Ref == "" {
+			src.Ref = "HEAD"
+		}
+		job := &serveJob{Package: packageOfSource(src), Source: src, Task: t.Name, Project: projectOfRepo(src.Repo), SubmittedBy: "task " + t.Name}
+		if err := s.c.enqueue(job, nil); err != nil {
+			log.Printf("Warning: task %s could not queue %s: %v", t.Name, job.Package, err)
+			continue
+		}
+		log.Printf("  Queued: %s (%s, task %s)", job.ID, job.Package, t.Name)
+		queued++
+		active++
+	}
+	if skipped > 0 {
+		log.Printf("Warning: task %s reached its limit of %d build(s) in progress, skipped %d", t.Name, limit, skipped)
+	}
+
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status[t.Name]
+	st.Runs++
+	st.Skipped += skipped
+	st.LastStart, st.LastFinish = now, now
+	st.LastResult = fmt.Sprintf("queued %d build(s)", queued)
+}
+
+// handle registers the status endpoints of the scheduler.
+func (s *scheduler) handle(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/schedule", s.c.requireRole(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.snapshot())
+	}))
+	mux.HandleFunc("GET /api/v1/schedule/{name}/log", s.c.requireRole(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !validArtifactName(name) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, filepath.Join(s.c.dir, "tasks", name+".log"))
+	}))
+}
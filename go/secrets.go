@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// secretSpec describes a secret and where it is read from. Each variable may
+// hold the value itself, or the path of a file containing it (GitLab CI file
+// variables); <VAR>_FILE may also name such a file.
+type secretSpec struct {
+	Name     string
+	Feature  string
+	Vars     []string
+	Optional bool
+	Desc     string
+}
+
+// Features that need secrets.
+const (
+	featureSigning = "signing"
+	featureSSH     = "ssh"
+	featureS3      = "s3"
+	featureGitLab  = "gitlab"
+	featureImage   = "image"
+	featureSccache = "sccache"
+	featureServe   = "serve"
+	featureGitHub  = "github"
+	featureWebDAV  = "webdav"
+	featureSymbols = "debuginfod"
+)
+
+var secretSpecs = []secretSpec{
+	{Name: "signing-key", Feature: featureSigning, Vars: []string{"BUILDER_SIGNING_KEY"}, Optional: true,
+		Desc: "Armored GPG private key imported before signing"},
+	{Name: "signing-passphrase", Feature: featureSigning, Vars: []string{"BUILDER_SIGNING_PASSPHRASE"}, Optional: true,
+		Desc: "Passphrase of the signing key"},
+	{Name: "ssh-key", Feature: featureSSH, Vars: []string{"BUILDER_SSH_KEY"},
+		Desc: "SSH private key for uploads"},
+	{Name: "s3-access-key", Feature: featureS3, Vars: []string{"BUILDER_S3_ACCESS_KEY", "AWS_ACCESS_KEY_ID"},
+		Desc: "S3 access key ID"},
+	{Name: "s3-secret-key", Feature: featureS3, Vars: []string{"BUILDER_S3_SECRET_KEY", "AWS_SECRET_ACCESS_KEY"},
+		Desc: "S3 secret access key"},
+	{Name: "gitlab-token", Feature: featureGitLab, Vars: []string{"BUILDER_GITLAB_TOKEN", "GITLAB_TOKEN", "CI_JOB_TOKEN"},
+		Desc: "GitLab API token"},
+	{Name: "webdav-user", Feature: featureWebDAV, Vars: []string{"BUILDER_WEBDAV_USER"}, Optional: true,
+		Desc: "WebDAV user of webdav+https storages without a user in the URL"},
+	{Name: "webdav-password", Feature: featureWebDAV, Vars: []string{"BUILDER_WEBDAV_PASSWORD"},
+		Desc: "WebDAV password, or a Nextcloud app password"},
+	{Name: "registry-password", Feature: featureImage, Vars: []string{"BUILDER_REGISTRY_PASSWORD", "CI_REGISTRY_PASSWORD", "CI_JOB_TOKEN"}, Optional: true,
+		Desc: "Password of the container registry the builder image and 'publish oci' artifacts are pushed to"},
+	{Name: "dependency-proxy-password", Feature: featureImage, Vars: []string{"BUILDER_DEPENDENCY_PROXY_PASSWORD", "CI_DEPENDENCY_PROXY_PASSWORD"}, Optional: true,
+		Desc: "Password of the GitLab dependency proxy base images are pulled through"},
+	{Name: "sccache-redis", Feature: featureSccache, Vars: []string{"BUILDER_SCCACHE_REDIS", "SCCACHE_REDIS_ENDPOINT", "SCCACHE_REDIS"}, Optional: true,
+		Desc: "Redis URL, including any password, of the shared compiler cache"},
+	{Name: "serve-token", Feature: featureServe, Vars: []string{"BUILDER_SERVE_TOKEN"}, Optional: true,
+		Desc: "Bearer token of clients and workers of the build queue; on the coordinator, an admin token"},
+	{Name: "serve-id-token", Feature: featureServe, Vars: []string{"BUILDER_ID_TOKEN"}, Optional: true,
+		Desc: "OIDC ID token clients authenticate with instead, e.g. from id_tokens in GitLab CI"},
+	{Name: "webhook-secret", Feature: featureServe, Vars: []string{"BUILDER_WEBHOOK_SECRET"}, Optional: true,
+		Desc: "Secret of the release webhooks accepted by 'serve --webhooks'"},
+	{Name: "github-token", Feature: featureGitHub, Vars: []string{"BUILDER_GITHUB_TOKEN", "GITHUB_TOKEN"}, Optional: true,
+		Desc: "GitHub token raising the API rate limit of 'outdated'"},
+	{Name: "debuginfod-token", Feature: featureSymbols, Vars: []string{"BUILDER_DEBUGINFOD_TOKEN"}, Optional: true,
+		Desc: "Bearer token of uploads to debuginfod.url"},
+}
+
+// secretMask is the replacement for secret values in output.
+const secretMask = "[MASKED]"
+
+// maskedValues holds every secret value read so far, and the patterns of
+// setupRedaction.
+var maskedValues struct {
+	sync.RWMutex
+	values    []string
+	patterns  []*regexp.Regexp
+	noBuiltin bool
+}
+
+// addMask registers a secret value (and each of its lines) for masking.
+func addMask(value string) {
+	maskedValues.Lock()
+	defer maskedValues.Unlock()
+	for _, v := range append(strings.Split(value, "\n"), value) {
+		// Very short values would mask unrelated output
+		if v = strings.TrimSpace(v); len(v) >= 6 {
+			maskedValues.values = append(maskedValues.values, v)
+		}
+	}
+	// Longest first, so a value containing another is masked as a whole
+	sort.Slice(maskedValues.values, func(i, j int) bool {
+		return len(maskedValues.values[i]) > len(maskedValues.values[j])
+	})
+}
+
+// maskSecrets replaces all registered secret values in s, and the matches
+// of the redaction patterns.
+func maskSecrets(s string) string {
+	maskedValues.RLock()
+	defer maskedValues.RUnlock()
+	for _, v := range maskedValues.values {
+		s = strings.ReplaceAll(s, v, secretMask)
+	}
+	if !maskedValues.noBuiltin {
+		for _, re := range redactBuiltinPatterns {
+			s = redactPattern(re, s)
+		}
+	}
+	for _, re := range maskedValues.patterns {
+		s = redactPattern(re, s)
+	}
+	return s
+}
+
+// maskingWriter masks secret values in everything written through it.
+type maskingWriter struct {
+	w io.Writer
+}
+
+func (m maskingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(m.w, maskSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// lookupSecret returns where a secret was found and its value, or empty
+// strings when it is not set.
+func lookupSecret(spec secretSpec) (source, value string, err error) {
+	for _, v := range spec.Vars {
+		if path := os.Getenv(v + "_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", "", fmt.Errorf("could not read %s from %s_FILE: %w", spec.Name, v, err)
+			}
+			return v + "_FILE", strings.TrimRight(string(data), "\n"), nil
+		}
+		value := os.Getenv(v)
+		if value == "" {
+			continue
+		}
+		// GitLab CI file variables contain the path of a temporary file
+		if !strings.Contains(value, "\n") {
+			if info, err := os.Stat(value); err == nil && info.Mode().IsRegular() {
+				data, err := os.ReadFile(value)
+				if err != nil {
+					return "", "", fmt.Errorf("could not read %s from %s: %w", spec.Name, v, err)
+				}
+				return v + " (file)", strings.TrimRight(string(data), "\n"), nil
+			}
+		}
+		return v, value, nil
+	}
+	return "", "", nil
+}
+
+// getSecret returns the value of the named secret, or "" when it is not set.
+// Values are registered for masking as soon as they are read.
+func getSecret(name string) (string, error) {
+	for _, spec := range secretSpecs {
+		if spec.Name != name {
+			continue
+		}
+		_, value, err := lookupSecret(spec)
+		if err != nil {
+			return "", newError(errConfig, err)
+		}
+		if value != "" {
+			addMask(value)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown secret %q", name)
+}
+
+// environWithoutSecrets returns the environment without the variables of
+// secretSpecs and serve.auth.tokens, or their _FILE forms, for builder
+// processes that run untrusted PKGBUILDs.
+func environWithoutSecrets() []string {
+	secret := func(name string) bool {
+		if slices.ContainsFunc(secretSpecs, func(spec secretSpec) bool { return slices.Contains(spec.Vars, name) }) {
+			return true
+		}
+		return slices.ContainsFunc(cfg.Serve.Auth.Tokens, func(t serveToken) bool { return t.Env == name })
+	}
+	return slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return secret(name) || secret(strings.TrimSuffix(name, "_FILE"))
+	})
+}
+
+// requireSecrets checks up front that every mandatory secret of the given
+// features is available and registers all of them for masking.
+func requireSecrets(features ...string) error {
+	var missing []string
+	for _, spec := range secretSpecs {
+		if !slices.Contains(features, spec.Feature) {
+			continue
+		}
+		value, err := getSecret(spec.Name)
+		if err != nil {
+			return err
+		}
+		if value == "" && !spec.Optional {
+			missing = append(missing, fmt.Sprintf("%s (%s)", spec.Name, strings.Join(spec.Vars, ", ")))
+		}
+	}
+	if len(missing) > 0 {
+		return errorf(errConfig, "missing secrets for %s: %s", strings.Join(features, ", "), strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// signingImported ensures the signing key secret is imported only once.
+var signingImported sync.Once
+
+// prepareSigning imports the signing key secret into gpg when it is set, and
+// otherwise checks that gpg already has a secret key.
+func prepareSigning(ctx context.Context) error {
+	key, err := getSecret("signing-key")
+	if err != nil {
+		return err
+	}
+	if _, err := getSecret("signing-passphrase"); err != nil {
+		return err
+	}
+	if key == "" {
+		out, err := newCommand(ctx, "gpg", "--batch", "--list-secret-keys").Output()
+		if err != nil || len(bytes.TrimSpace(out)) == 0 {
+			return errorf(errSigning, "no signing key: set BUILDER_SIGNING_KEY or import a secret key into gpg")
+		}
+		return nil
+	}
+	var importErr error
+	signingImported.Do(func() {
+		log.Println("Importing signing key from BUILDER_SIGNING_KEY...")
+		cmd := newCommand(ctx, "gpg", "--batch", "--import")
+		cmd.Stdin = strings.NewReader(key)
+		if err := cmd.Run(); err != nil {
+			importErr = errorf(errSigning, "could not import signing key: %w", err)
+		}
+	})
+	return importErr
+}
+
+// gpgPassphraseArgs returns the gpg arguments needed to pass the signing
+// passphrase on stdin, and the stdin reader, when a passphrase is set.
+func gpgPassphraseArgs() ([]string, io.Reader) {
+	passphrase, err := getSecret("signing-passphrase")
+	if err != nil || passphrase == "" {
+		return nil, nil
+	}
+	return []string{"--pinentry-mode", "loopback", "--passphrase-fd", "0"}, strings.NewReader(passphrase + "\n")
+}
+
+// secretFeatures returns the features of secretSpecs, in their order.
+func secretFeatures() []string {
+	var features []string
+	for _, spec := range secretSpecs {
+		if !slices.Contains(features, spec.Feature) {
+			features = append(features, spec.Feature)
+		}
+	}
+	return features
+}
+
+// newSecretsCmd creates the 'secrets' command.
+func newSecretsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "secrets",
+		Short: "Inspects the secrets available to the builder.",
+	}
+
+	checkCmd := &cobra.Command{
+		Use:       "check [feature...]",
+		Short:     "Shows which secrets are set and fails if a feature's required secrets are missing.",
+		ValidArgs: secretFeatures(),
+		Args:      cobra.OnlyValidArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "SECRET\tFEATURE\tSOURCE\tDESCRIPTION")
+			for _, spec := range secretSpecs {
+				if len(args) > 0 && !slices.Contains(args, spec.Feature) {
+					continue
+				}
+				source, _, err := lookupSecret(spec)
+				if err != nil {
+					source = "error: " + err.Error()
+				} else if source == "" {
+					source = "not set"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", spec.Name, spec.Feature, source, spec.Desc)
+			}
+			w.Flush()
+			if len(args) == 0 {
+				return nil
+			}
+			return requireSecrets(args...)
+		},
+	}
+
+	cmd.AddCommand(checkCmd)
+	return cmd
+}
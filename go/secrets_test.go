@@ -0,0 +1,28 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestEnvironWithoutSecrets(t *testing.T) {
+	t.Setenv("BUILDER_SERVE_TOKEN", "admin-token")
+	t.Setenv("BUILDER_SIGNING_KEY_FILE", "/run/secrets/key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "s3-secret")
+	t.Setenv("BUILDER_WORKER_TOKEN", "worker-token")
+	t.Setenv("BUILDER_TEST_KEEP", "kept")
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg = &config{}
+	cfg.Serve.Auth.Tokens = []serveToken{{Name: "workers", Env: "BUILDER_WORKER_TOKEN"}}
+
+	env := environWithoutSecrets()
+	for _, kv := range []string{"BUILDER_SERVE_TOKEN=admin-token", "BUILDER_SIGNING_KEY_FILE=/run/secrets/key", "AWS_SECRET_ACCESS_KEY=s3-secret", "BUILDER_WORKER_TOKEN=worker-token"} {
+		if slices.Contains(env, kv) {
+			t.Errorf("environment contains %s", kv)
+		}
+	}
+	if !slices.Contains(env, "BUILDER_TEST_KEEP=kept") {
+		t.Error("environment lacks BUILDER_TEST_KEEP")
+	}
+}
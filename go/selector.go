@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// selectSubject is what selection expressions match a package by.
+type selectSubject struct {
+	// Names are the pkgbase and every pkgname
+	Names  []string
+	Groups []string
+	Labels []string
+	Dir    string
+	// Status is the package.status, empty unless quarantined
+	Status string
+}
+
+// selector is a parsed --select expression.
+type selector interface {
+	match(s *selectSubject) bool
+}
+
+type (
+	selectAnd   struct{ a, b selector }
+	selectOr    struct{ a, b selector }
+	selectNot   struct{ a selector }
+	selectField struct{ field, pattern string }
+)
+
+func (e selectAnd) match(s *selectSubject) bool { return e.a.match(s) && e.b.match(s) }
+func (e selectOr) match(s *selectSubject) bool  { return e.a.match(s) || e.b.match(s) }
+func (e selectNot) match(s *selectSubject) bool { return !e.a.match(s) }
+
+func (e selectField) match(s *selectSubject) bool {
+	var values []string
+	switch e.field {
+	case "name":
+		values = s.Names
+	case "group":
+		values = s.Groups
+	case "label":
+		values = s.Labels
+	case "dir":
+		values = []string{s.Dir}
+	case "status":
+		values = []string{s.Status}
+	case "":
+		// Bare terms, so that 'not broken' works as expected
+		values = append(slices.Clone(s.Labels), s.Status)
+	}
+	return slices.ContainsFunc(values, func(v string) bool {
+		ok, _ := path.Match(e.pattern, v)
+		return ok
+	})
+}
+
+// selectUsage documents the --select flag of workspace commands.
+const selectUsage = "Only packages matching this selection of name:, group:, dir:, status: and label terms with and, or, not, e.g. 'group:gnome or name:foo* and not broken'"
+
+// selectFields are the fields of terms such as name:foo*; a term without a
+// field matches labels and the package.status.
+var selectFields = []string{"name", "group", "label", "dir", "status"}
+
+// parseSelector parses a selection expression: terms combined with and, or,
+// not and parentheses, binding in that order from loosest, e.g.
+// "group:gnome or name:foo* and not broken".
+func parseSelector(expr string) (selector, error) {
+	p := &selectParser{tokens: tokenizeSelector(expr)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("empty selection")
+	}
+	sel, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return sel, nil
+}
+
+// tokenizeSelector splits an expression into words and parentheses.
+func tokenizeSelector(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+// selectParser is a recursive descent parser of selection expressions.
+type selectParser struct {
+	tokens []string
+	pos    int
+}
+
+// accept consumes the next token if it is word.
+func (p *selectParser) accept(word string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos] == word {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectParser) or() (selector, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = selectOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectParser) and() (selector, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = selectAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectParser) not() (selector, error) {
+	if p.accept("not") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return selectNot{e}, nil
+	}
+	return p.term()
+}
+
+func (p *selectParser) term() (selector, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of the selection")
+	}
+	if p.accept("(") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return e, nil
+	}
+	tok := p.tokens[p.pos]
+	if tok == ")" || tok == "and" || tok == "or" {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	p.pos++
+	field, pattern, ok := strings.Cut(tok, ":")
+	if !ok {
+		field, pattern = "", tok
+	} else if !slices.Contains(selectFields, field) {
+		return nil, fmt.Errorf("unknown field %q in %q (expected %s)", field, tok, strings.Join(selectFields, ", "))
+	}
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return nil, fmt.Errorf("invalid pattern %q", tok)
+	}
+	return selectField{field, pattern}, nil
+}
+
+// packageSubject returns what selections match the package in dir by, from
+// its PKGBUILD and the package section of its .pkgbuilder.yaml.
+func packageSubject(dir string) (*selectSubject, error) {
+	info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readPackageMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &selectSubject{
+		Names:  packageNames(info),
+		Groups: info.Arrays["groups"],
+		Labels: meta.Labels,
+		Dir:    filepath.ToSlash(filepath.Clean(dir)),
+		Status: meta.Status,
+	}, nil
+}
+
+// selectDirs returns the package directories matching the --select
+// expression expr, all of them if it is empty.
+func selectDirs(expr string, dirs []string) ([]string, error) {
+	if expr == "" {
+		return dirs, nil
+	}
+	sel, err := parseSelector(expr)
+	if err != nil {
+		return nil, errorf(errConfig, "--select: %w", err)
+	}
+	var selected []string
+	for _, dir := range dirs {
+		s, err := packageSubject(dir)
+		if err != nil {
+			return nil, errorf(errParse, "%s: %w", dir, err)
+		}
+		if sel.match(s) {
+			selected = append(selected, dir)
+		}
+	}
+	debugPrint("--select %s: %d of %d package(s)", expr, len(selected), len(dirs))
+	return selected, nil
+}
+
+// selectNodes returns the workspace nodes matching the --select expression
+// expr, all of them if it is empty.
+func selectNodes(expr string, nodes []*pkgNode) ([]*pkgNode, error) {
+	if expr == "" {
+		return nodes, nil
+	}
+	dirs := make([]string, len(nodes))
+	for i, n := range nodes {
+		dirs[i] = n.Dir
+	}
+	selected, err := selectDirs(expr, dirs)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(slices.Clone(nodes), func(n *pkgNode) bool { return !slices.Contains(selected, n.Dir) }), nil
+}
@@ -0,0 +1,1637 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+// Statuses of queued build jobs.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+const (
+	// claimWait is how long a worker's claim waits for a job before the
+	// coordinator answers that there is none
+	claimWait = 30 * time.Second
+	// workerHeartbeat is how often workers report that a job is still running
+	workerHeartbeat = 30 * time.Second
+	// defaultLease is how long the coordinator waits for a heartbeat before the
+	// job of a vanished worker is queued again
+	defaultLease = 2 * time.Minute
+	// logFlushInterval is how often workers send new build output
+	logFlushInterval = 2 * time.Second
+	// jobLogFile holds the live output of a job at the coordinator
+	jobLogFile = "job.log"
+)
+
+// serveJob is a package build queued at the coordinator.
+type serveJob struct {
+	ID        string    `json:"id"`
+	Package   string    `json:"package"`
+	Args      []string  `json:"args,omitempty"`
+	Status    string    `json:"status"`
+	Worker    string    `json:"worker,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Artifacts []string  `json:"artifacts,omitempty"`
+	Submitted time.Time `json:"submitted"`
+	Started   time.Time `json:"started,omitzero"`
+	Finished  time.Time `json:"finished,omitzero"`
+	// Source is set for builds requested by git ref instead of uploaded sources
+	Source *gitSource `json:"source,omitempty"`
+	// Commit is the commit a build by git ref was made from
+	Commit string `json:"commit,omitempty"`
+	// Bump is the upstream version the package is updated to before building
+	Bump string `json:"bump,omitempty"`
+	// Task is the scheduled task that queued the job
+	Task string `json:"task,omitempty"`
+	// SubmittedBy is the principal, webhook or task that queued the job
+	SubmittedBy string `json:"submitted_by,omitempty"`
+	// Project is the group/name path the job builds, for authorization
+	Project string `json:"project,omitempty"`
+	// Published lists the channels the packages were published to
+	Published []string `json:"published,omitempty"`
+
+	// seen is the time of the worker's last heartbeat
+	seen time.Time
+}
+
+// gitSource is a package directory in a git repository.
+type gitSource struct {
+	Repo string `json:"repo"`
+	Ref  string `json:"ref"`
+	Path string `json:"path,omitempty"`
+}
+
+// check validates a requested source against the repositories allowed in
+// serve.repositories.
+func (g *gitSource) check() error {
+	if !repositoryAllowed(g.Repo, cfg.Serve.Repositories) {
+		return fmt.Errorf("repository %s is not listed in serve.repositories", g.Repo)
+	}
+	if g.Ref == "" || strings.HasPrefix(g.Ref, "-") {
+		return fmt.Errorf("invalid ref %q", g.Ref)
+	}
+	if g.Path != "" && !filepath.IsLocal(g.Path) {
+		return fmt.Errorf("invalid path %q", g.Path)
+	}
+	return nil
+}
+
+// serveBuildFlags are the flags of 'builder build' that clients may pass to
+// jobs, and whether they take a value. Other flags, the global ones among
+// them, could point the worker at other files.
+var serveBuildFlags = map[string]bool{
+	"--clean":         false,
+	"-f":              false,
+	"--force":         false,
+	"--offline-build": false,
+	"--audit":         false,
+	"--variant":       true,
+	"--march":         true,
+}
+
+// checkBuildArgs validates the build arguments of a submitted job.
+func checkBuildArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(args[i], "=")
+		takesValue, ok := serveBuildFlags[name]
+		if !ok {
+			return fmt.Errorf("build argument %q is not allowed (allowed: %s)", args[i], strings.Join(slices.Sorted(maps.Keys(serveBuildFlags)), ", "))
+		}
+		if takesValue && !hasValue {
+			if i++; i == len(args) {
+				return fmt.Errorf("build argument %s needs a value", name)
+			}
+		}
+	}
+	return nil
+}
+
+// splitRepository returns the scheme, host and path segments of a git URL or
+// of an scp-like [user@]host:path, without a trailing .git. It fails for
+// anything git would resolve to another path, such as . or .. segments.
+func splitRepository(repo string) (scheme, host string, segments []string, ok bool) {
+	var p string
+	if strings.Contains(repo, "://") {
+		u, err := url.Parse(repo)
+		if err != nil || u.Host == "" || u.RawPath != "" || u.RawQuery != "" || u.Fragment != "" {
+			return "", "", nil, false
+		}
+		scheme, host, p = strings.ToLower(u.Scheme), strings.ToLower(u.Host), u.Path
+	} else {
+		h, after, found := strings.Cut(repo, ":")
+		if _, name, hasUser := strings.Cut(h, "@"); hasUser {
+			h = name
+		}
+		if !found || h == "" || strings.HasPrefix(h, "-") || strings.Contains(h, "/") {
+			return "", "", nil, false
+		}
+		scheme, host, p = "ssh", strings.ToLower(h), after
+	}
+	if p = strings.TrimSuffix(strings.Trim(p, "/"), ".git"); p != "" {
+		segments = strings.Split(p, "/")
+	}
+	for _, s := range segments {
+		if s == "" || s == "." || s == ".." {
+			return "", "", nil, false
+		}
+	}
+	return scheme, host, segments, true
+}
+
+// repositoryAllowed reports whether repo is one of the allowed repositories
+// or within one of the allowed groups. Hosts and whole path segments are
+// compared, so a group does not admit siblings that share its prefix.
+func repositoryAllowed(repo string, allowed []string) bool {
+	scheme, host, segments, ok := splitRepository(repo)
+	if !ok || len(segments) == 0 {
+		return false
+	}
+	return slices.ContainsFunc(allowed, func(entry string) bool {
+		s, h, prefix, ok := splitRepository(entry)
+		return ok && s == scheme && h == host && len(prefix) <= len(segments) && slices.Equal(segments[:len(prefix)], prefix)
+	})
+}
+
+// packageOfSource names the package of a git source after its directory.
+func packageOfSource(src *gitSource) string {
+	if src.Path != "" {
+		return path.Base(src.Path)
+	}
+	return path.Base(strings.TrimSuffix(src.Repo, ".git"))
+}
+
+// artifactInfo describes a file built by a job in its manifest.
+type artifactInfo struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Package string `json:"package,omitempty"`
+	Version string `json:"version,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+}
+
+// jobManifest lists what a job built.
+type jobManifest struct {
+	Job       serveJob       `json:"job"`
+	Artifacts []artifactInfo `json:"artifacts"`
+	// BuildIDs are the build IDs of the debug symbols by -debug package
+	// name, also of those dropped after their upload to debuginfod
+	BuildIDs map[string][]string `json:"build_ids,omitempty"`
+}
+
+// coordinator queues the build jobs CI jobs submit and hands them to the
+// workers polling it. The queue is kept in memory; sources and artifacts are
+// stored below dir.
+type coordinator struct {
+	dir   string
+	auth  *authenticator
+	lease time.Duration
+	// builderArgs are passed to the builder commands the coordinator runs
+	builderArgs []string
+	// webhookSecret enables the webhook endpoints, see webhookHandler
+	webhookSecret string
+	// sched serves the status of the scheduled tasks, if any
+	sched *scheduler
+	dash  *dashboard
+
+	mu   sync.Mutex
+	seq  int
+	jobs map[string]*serveJob
+	// order holds the job IDs in submission order
+	order []string
+	// queued is closed and replaced whenever a job is queued, waking claims
+	queued chan struct{}
+
+	// auditMu serializes writes to the audit log, publishMu publishing
+	auditMu   sync.Mutex
+	publishMu sync.Mutex
+}
+
+func newCoordinator(dir string, auth *authenticator, lease time.Duration) *coordinator {
+	c := &coordinator{dir: dir, auth: auth, lease: lease, jobs: map[string]*serveJob{}, queued: make(chan struct{})}
+	c.dash = &dashboard{c: c}
+	return c
+}
+
+func (c *coordinator) jobDir(id string) string {
+	return filepath.Join(c.dir, "jobs", id)
+}
+
+// enqueue queues job, whose package sources are read from src unless it has
+// a git source.
+func (c *coordinator) enqueue(job *serveJob, src io.Reader) error {
+	c.mu.Lock()
+	c.seq++
+	now := time.Now().UTC()
+	job.ID, job.Status, job.Submitted = fmt.Sprintf("%s-%d", now.Format("20060102-150405"), c.seq), jobQueued, now
+	c.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(c.jobDir(job.ID), "artifacts"), 0755); err != nil {
+		return err
+	}
+	if src != nil {
+		f, err := os.Create(filepath.Join(c.jobDir(job.ID), "source.tar.gz"))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, src)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.RemoveAll(c.jobDir(job.ID))
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jobs[job.ID] = job
+	c.order = append(c.order, job.ID)
+	close(c.queued)
+	c.queued = make(chan struct{})
+	return nil
+}
+
+// claim assigns the oldest queued job to worker, waiting up to claimWait for
+// one. It returns nil when there is none.
+func (c *coordinator) claim(ctx context.Context, worker string) *serveJob {
+	timeout := time.After(claimWait)
+	for {
+		c.mu.Lock()
+		for _, id := range c.order {
+			if job := c.jobs[id]; job.Status == jobQueued {
+				job.Status, job.Worker = jobRunning, worker
+				job.Started, job.seen = time.Now().UTC(), time.Now()
+				claimed := *job
+				c.mu.Unlock()
+				log.Printf("  Assigned: %s (%s) to %s", job.ID, job.Package, worker)
+				return &claimed
+			}
+		}
+		queued := c.queued
+		c.mu.Unlock()
+		select {
+		case <-queued:
+		case <-timeout:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// get returns a copy of a job.
+func (c *coordinator) get(id string) (serveJob, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	job, ok := c.jobs[id]
+	if !ok {
+		return serveJob{}, false
+	}
+	return *job, true
+}
+
+// readableJob returns the job of a request reading one, if the principal is
+// allowed its project; known is false for jobs of earlier runs of the
+// coordinator, which only unrestricted principals may read as their project
+// is not known. Otherwise it answers 404, so that the jobs of other projects
+// cannot be told from missing ones, and returns ok false.
+func (c *coordinator) readableJob(w http.ResponseWriter, r *http.Request) (job serveJob, known, ok bool) {
+	p, id := principalOf(r), filepath.Base(r.PathValue("id"))
+	job, known = c.get(id)
+	if !known {
+		job.ID = id
+	}
+	if !p.allowed(job.Project) {
+		c.audit(p, "denied read", r.Method+" "+r.URL.Path, job.Project, fmt.Errorf("project not allowed"))
+		http.NotFound(w, r)
+		return job, known, false
+	}
+	return job, known, true
+}
+
+// manifest describes the artifacts of a job, with the package metadata of
+// the packages.
+func (c *coordinator) manifest(job serveJob) jobManifest {
+	m := jobManifest{Job: job, Artifacts: []artifactInfo{}}
+	for _, name := range job.Artifacts {
+		file := filepath.Join(c.jobDir(job.ID), "artifacts", name)
+		a := artifactInfo{Name: name, Size: fileSize(file)}
+		a.SHA256, _ = sha256File(file)
+		if strings.Contains(name, ".pkg.tar.") && !strings.HasSuffix(name, ".sig") {
+			if info, err := pkgarchive.ReadPkgInfo(file); err == nil {
+				a.Package, a.Version, a.Arch = info.PkgName, info.PkgVer, info.Arch
+				if strings.HasSuffix(info.PkgName, "-debug") {
+					if ids, err := debugBuildIDs(file); err == nil && len(ids) > 0 {
+						m.addBuildIDs(map[string][]string{info.PkgName: ids})
+					}
+				}
+			}
+		}
+		if strings.HasSuffix(name, ".buildids.json") {
+			var ids map[string][]string
+			if data, err := os.ReadFile(file); err == nil && json.Unmarshal(data, &ids) == nil {
+				m.addBuildIDs(ids)
+			}
+		}
+		m.Artifacts = append(m.Artifacts, a)
+	}
+	return m
+}
+
+// addBuildIDs adds build IDs by -debug package name to the manifest.
+func (m *jobManifest) addBuildIDs(ids map[string][]string) {
+	if m.BuildIDs == nil {
+		m.BuildIDs = map[string][]string{}
+	}
+	maps.Copy(m.BuildIDs, ids)
+}
+
+// streamLog copies the live output of a job to w; with follow it keeps
+// sending new output until the job finished.
+func (c *coordinator) streamLog(ctx context.Context, w http.ResponseWriter, id string, follow bool) {
+	flusher, _ := w.(http.Flusher)
+	var offset int64
+	for {
+		// Output written before the job finished is sent before returning
+		job, _ := c.get(id)
+		if f, err := os.Open(filepath.Join(c.jobDir(id), jobLogFile)); err == nil {
+			f.Seek(offset, io.SeekStart)
+			n, _ := io.Copy(w, f)
+			f.Close()
+			offset += n
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !follow || job.Status == jobSucceeded || job.Status == jobFailed {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// running returns the job assigned to worker, or nil when it was requeued or
+// finished meanwhile. The caller must hold c.mu.
+func (c *coordinator) running(id, worker string) *serveJob {
+	job := c.jobs[id]
+	if job == nil || job.Status != jobRunning || job.Worker != worker {
+		return nil
+	}
+	return job
+}
+
+// requeueExpired queues the jobs of workers that stopped sending heartbeats
+// again, e.g. after the machine was rebooted.
+func (c *coordinator) requeueExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	requeued := false
+	for _, id := range c.order {
+		job := c.jobs[id]
+		if job.Status == jobRunning && time.Since(job.seen) > c.lease {
+			log.Printf("Warning: worker %s stopped responding, queueing %s (%s) again", job.Worker, job.ID, job.Package)
+			job.Status, job.Worker, job.Started = jobQueued, "", time.Time{}
+			requeued = true
+		}
+	}
+	if requeued {
+		close(c.queued)
+		c.queued = make(chan struct{})
+	}
+}
+
+// recordJob stores a finished job in the build history of the coordinator,
+// which the dashboard shows per package.
+func (c *coordinator) recordJob(job serveJob) {
+	rec := &buildRecord{Package: job.Package, StartedAt: job.Started, Duration: job.Finished.Sub(job.Started), Result: resultSuccess, Job: job.ID}
+	if job.Status == jobFailed {
+		rec.Result = resultFailed
+	}
+	m := c.manifest(job)
+	for _, a := range m.Artifacts {
+		if a.Version != "" {
+			if rec.Version == "" {
+				rec.Version = a.Version
+			}
+			if rec.Artifacts == nil {
+				rec.Artifacts = map[string]string{}
+			}
+			rec.Artifacts[a.Name] = a.SHA256
+		}
+	}
+	if err := recordBuild(rec); err != nil {
+		log.Printf("Warning: could not record %s in the build history: %v", job.ID, err)
+	}
+}
+
+// validArtifactName reports whether name can be stored as a file of a job.
+func validArtifactName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handler returns the HTTP API of the coordinator.
+func (c *coordinator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/jobs", c.requireRole(roleSubmit, func(w http.ResponseWriter, r *http.Request) {
+		p := principalOf(r)
+		job := &serveJob{Package: r.URL.Query().Get("package"), Args: r.URL.Query()["arg"], Project: r.URL.Query().Get("project"), SubmittedBy: p.Name}
+		if job.Package == "" {
+			http.Error(w, "package is required", http.StatusBadRequest)
+			return
+		}
+		if err := checkBuildArgs(job.Args); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Principals of a single project, such as CI jobs, build that one
+		if job.Project == "" && len(p.Projects) == 1 && !strings.ContainsAny(p.Projects[0], "*?[") {
+			job.Project = p.Projects[0]
+		}
+		if !p.allowed(job.Project) {
+			c.audit(p, "denied submit", job.Package, job.Project, fmt.Errorf("project not allowed"))
+			http.Error(w, fmt.Sprintf("%s may not build project %q", p.Name, job.Project), http.StatusForbidden)
+			return
+		}
+		if err := c.enqueue(job, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.audit(p, "submit", job.ID+" "+job.Package, job.Project, nil)
+		log.Printf("  Queued: %s (%s)", job.ID, job.Package)
+		writeJSON(w, http.StatusCreated, job)
+	}))
+	mux.HandleFunc("POST /api/v1/builds", c.requireRole(roleSubmit, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			gitSource
+			Args []string `json:"args"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.gitSource.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err := checkBuildArgs(req.Args); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p, src := principalOf(r), req.gitSource
+		job := &serveJob{Package: packageOfSource(&src), Args: req.Args, Source: &src, Project: projectOfRepo(src.Repo), SubmittedBy: p.Name}
+		if !p.allowed(job.Project) {
+			c.audit(p, "denied build", src.Repo, job.Project, fmt.Errorf("project not allowed"))
+			http.Error(w, fmt.Sprintf("%s may not build project %q", p.Name, job.Project), http.StatusForbidden)
+			return
+		}
+		if err := c.enqueue(job, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.audit(p, "build", fmt.Sprintf("%s %s at %s", job.ID, job.Package, src.Ref), job.Project, nil)
+		log.Printf("  Queued: %s (%s at %s of %s)", job.ID, job.Package, src.Ref, src.Repo)
+		writeJSON(w, http.StatusCreated, job)
+	}))
+	mux.HandleFunc("POST /api/v1/jobs/{id}/publish", c.requireRole(rolePublish, c.publishHandler))
+	mux.HandleFunc("GET /api/v1/audit", c.requireRole(roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		http.ServeFile(w, r, filepath.Join(c.dir, auditLogFile))
+	}))
+	mux.HandleFunc("GET /api/v1/jobs", c.requireRole(roleSubmit, func(w http.ResponseWriter, r *http.Request) {
+		p := principalOf(r)
+		c.mu.Lock()
+		jobs := make([]serveJob, 0, len(c.order))
+		for _, id := range c.order {
+			if job := c.jobs[id]; p.allowed(job.Project) {
+				jobs = append(jobs, *job)
+			}
+		}
+		c.mu.Unlock()
+		writeJSON(w, http.StatusOK, jobs)
+	}))
+	mux.HandleFunc("GET /api/v1/jobs/{id}", c.requireRole(roleSubmit, func(w http.ResponseWriter, r *http.Request) {
+		job, known, ok := c.readableJob(w, r)
+		if !ok {
+			return
+		}
+		if !known {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	}))
+	mux.HandleFunc("GET /api/v1/jobs/{id}/manifest", c.requireRole(roleSubmit, func(w http.ResponseWriter, r *http.Request) {
+		job, known, ok := c.readableJob(w, r)
+		if !ok {
+			return
+		}
+		if !known {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.manifest(job))
+	}))
+	mux.HandleFunc("GET /api/v1/jobs/{id}/log", c.requireRole(roleSubmit, func(w http.ResponseWriter, r *http.Request) {
+		job, known, ok := c.readableJob(w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !known {
+			// Jobs of earlier runs of the coordinator, linked from the history
+			http.ServeFile(w, r, filepath.Join(c.jobDir(job.ID), jobLogFile))
+			return
+		}
+		c.streamLog(r.Context(), w, job.ID, r.URL.Query().Get("follow") != "")
+	}))
+	mux.HandleFunc("GET /api/v1/jobs/{id}/source", func(w http.ResponseWriter, r *http.Request) {
+		// Workers download the sources of the jobs they run
+		if p := principalOf(r); !p.can(roleSubmit) && !p.can(roleWorker) {
+			c.audit(p, "denied", r.Method+" "+r.URL.Path, "", fmt.Errorf("role %s or %s required", roleSubmit, roleWorker))
+			http.Error(w, fmt.Sprintf("%s lacks the %s and %s roles", p.Name, roleSubmit, roleWorker), http.StatusForbidden)
+			return
+		}
+		job, _, ok := c.readableJob(w, r)
+		if !ok {
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(c.jobDir(job.ID), "source.tar.gz"))
+	})
+	mux.HandleFunc("GET /api/v1/jobs/{id}/artifacts/{name}", c.requireRole(roleSubmit, func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !validArtifactName(name) {
+			http.Error(w, "invalid artifact name", http.StatusBadRequest)
+			return
+		}
+		job, _, ok := c.readableJob(w, r)
+		if !ok {
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(c.jobDir(job.ID), "artifacts", name))
+	}))
+
+	// Worker protocol
+	mux.HandleFunc("POST /api/v1/claim", c.requireRole(roleWorker, func(w http.ResponseWriter, r *http.Request) {
+		worker := r.URL.Query().Get("worker")
+		if worker == "" {
+			http.Error(w, "worker is required", http.StatusBadRequest)
+			return
+		}
+		job := c.claim(r.Context(), worker)
+		if job == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	}))
+	mux.HandleFunc("POST /api/v1/jobs/{id}/heartbeat", c.requireRole(roleWorker, func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		job := c.running(r.PathValue("id"), r.URL.Query().Get("worker"))
+		if job == nil {
+			http.Error(w, "job is not assigned to this worker", http.StatusConflict)
+			return
+		}
+		job.seen = time.Now()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("POST /api/v1/jobs/{id}/log", c.requireRole(roleWorker, func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		c.mu.Lock()
+		job := c.running(id, r.URL.Query().Get("worker"))
+		c.mu.Unlock()
+		if job == nil {
+			http.Error(w, "job is not assigned to this worker", http.StatusConflict)
+			return
+		}
+		f, err := os.OpenFile(filepath.Join(c.jobDir(id), jobLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = io.Copy(f, r.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("PUT /api/v1/jobs/{id}/artifacts/{name}", c.requireRole(roleWorker, func(w http.ResponseWriter, r *http.Request) {
+		id, name := r.PathValue("id"), r.PathValue("name")
+		c.mu.Lock()
+		job := c.running(id, r.URL.Query().Get("worker"))
+		c.mu.Unlock()
+		if job == nil {
+			http.Error(w, "job is not assigned to this worker", http.StatusConflict)
+			return
+		}
+		if !validArtifactName(name) {
+			http.Error(w, "invalid artifact name", http.StatusBadRequest)
+			return
+		}
+		dest := filepath.Join(c.jobDir(id), "artifacts", name)
+		f, err := os.Create(dest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = io.Copy(f, r.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dest)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("POST /api/v1/jobs/{id}/finish", c.requireRole(roleWorker, func(w http.ResponseWriter, r *http.Request) {
+		var result struct {
+			Error  string `json:"error"`
+			Commit string `json:"commit"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		job := c.running(r.PathValue("id"), r.URL.Query().Get("worker"))
+		if job == nil {
+			c.mu.Unlock()
+			http.Error(w, "job is not assigned to this worker", http.StatusConflict)
+			return
+		}
+		entries, _ := os.ReadDir(filepath.Join(c.jobDir(job.ID), "artifacts"))
+		job.Artifacts = nil
+		for _, e := range entries {
+			job.Artifacts = append(job.Artifacts, e.Name())
+		}
+		job.Status, job.Error, job.Commit, job.Finished = jobSucceeded, result.Error, result.Commit, time.Now().UTC()
+		if result.Error != "" {
+			job.Status = jobFailed
+		}
+		finished := *job
+		c.mu.Unlock()
+		log.Printf("  Finished: %s (%s) on %s: %s", job.ID, job.Package, job.Worker, job.Status)
+		c.recordJob(finished)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	c.dash.handle(mux)
+	if c.sched != nil {
+		c.sched.handle(mux)
+	}
+	if c.webhookSecret != "" {
+		mux.Handle("POST /webhooks/github", c.webhookHandler(c.webhookSecret, verifyGitHubSignature, parseGitHubRelease))
+		mux.Handle("POST /webhooks/gitlab", c.webhookHandler(c.webhookSecret, verifyGitLabToken, parseGitLabRelease))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Webhooks are authenticated by their own secret
+		if strings.HasPrefix(r.URL.Path, "/webhooks/") {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		p, err := c.auth.authenticate(r)
+		if err != nil {
+			c.audit(&principal{Name: "anonymous from " + r.RemoteAddr}, "denied", r.Method+" "+r.URL.Path, "", err)
+			// Browsers show the dashboard after asking for a token as password
+			if r.URL.Path == "/" || strings.HasPrefix(r.URL.Path, "/ui/") {
+				w.Header().Set("WWW-Authenticate", `Basic realm="builder"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// publishHandler adds the packages of a succeeded job to a channel of
+// repo.channels on the coordinator, with 'builder repo add'.
+func (c *coordinator) publishHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Channel string `json:"channel"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := principalOf(r)
+	job, ok := c.get(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	target := job.ID + " to " + req.Channel
+	if !p.allowed(job.Project) {
+		c.audit(p, "denied publish", target, job.Project, fmt.Errorf("project not allowed"))
+		http.Error(w, fmt.Sprintf("%s may not publish project %q", p.Name, job.Project), http.StatusForbidden)
+		return
+	}
+	if _, ok := cfg.Repo.Channels[req.Channel]; !ok {
+		http.Error(w, fmt.Sprintf("%q is not a channel of repo.channels", req.Channel), http.StatusBadRequest)
+		return
+	}
+	if job.Status != jobSucceeded {
+		http.Error(w, fmt.Sprintf("%s has %s", job.ID, job.Status), http.StatusConflict)
+		return
+	}
+	var files []string
+	for _, name := range job.Artifacts {
+		if isPackageFile(name) && !strings.HasSuffix(name, ".sig") {
+			files = append(files, filepath.Join(c.jobDir(job.ID), "artifacts", name))
+		}
+	}
+	if len(files) == 0 {
+		http.Error(w, job.ID+" built no packages", http.StatusConflict)
+		return
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.publishMu.Lock()
+	add := newCommand(r.Context(), self, append(slices.Clone(c.builderArgs), append([]string{"repo", "add", req.Channel}, files...)...)...)
+	output, err := add.CombinedOutput()
+	c.publishMu.Unlock()
+	if err != nil {
+		c.audit(p, "publish", target, job.Project, err)
+		http.Error(w, fmt.Sprintf("publishing failed: %v\n%s", err, maskSecrets(string(output))), http.StatusInternalServerError)
+		return
+	}
+	c.mu.Lock()
+	if j := c.jobs[job.ID]; !slices.Contains(j.Published, req.Channel) {
+		j.Published = append(j.Published, req.Channel)
+	}
+	c.mu.Unlock()
+	c.audit(p, "publish", target, job.Project, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveClient talks to the coordinator API, for workers and submitting jobs.
+type serveClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newServeClient(server string) (*serveClient, error) {
+	if server == "" {
+		return nil, errorf(errConfig, "no coordinator given: pass --server or set BUILDER_SERVER")
+	}
+	token, err := getSecret("serve-token")
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		if token, err = getSecret("serve-id-token"); err != nil {
+			return nil, err
+		}
+	}
+	// Claims are long-polled, and transfers of large packages take a while
+	client := &http.Client{Transport: httpClient().Transport}
+	return &serveClient{base: strings.TrimSuffix(server, "/"), token: token, http: client}, nil
+}
+
+// do sends a request and decodes a JSON response into out, if not nil. It
+// returns the response status.
+func (c *serveClient) do(ctx context.Context, method, path string, body io.Reader, out any) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "builder/"+version)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s %s: HTTP %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, nil
+}
+
+// download writes a file of the coordinator to dest.
+func (c *serveClient) download(ctx context.Context, path, dest string) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if err := c.copyTo(ctx, path, f); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return err
+	}
+	return f.Close()
+}
+
+// copyTo copies a response of the coordinator to w as it arrives.
+func (c *serveClient) copyTo(ctx context.Context, path string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "builder/"+version)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: HTTP %s", path, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// skipSource reports whether a file of a package directory is left out of
+// the sources sent to the workers: build output and version control data.
+func skipSource(rel string, d fs.DirEntry) bool {
+	if d.IsDir() {
+		return slices.Contains([]string{".git", "src", "pkg"}, rel)
+	}
+	name := d.Name()
+	return strings.Contains(name, ".pkg.tar.") || strings.HasSuffix(name, ".log") || name == pipelineStateFile
+}
+
+// tarSources writes the package directory dir as a gzipped tarball. The
+// walk is in lexical order and headers are normalized to epoch, so the same
+// sources always give the same bytes (and cache keys).
+func tarSources(dir string, epoch time.Time, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if skipSource(filepath.ToSlash(rel), d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		normalizeHeader(hdr, epoch)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// untarSources extracts a tarball written by tarSources into dir, refusing
+// entries outside of it. Files are written through an os.Root, and symlinks
+// may only point down from their directory, so nothing in the tarball can
+// reach outside dir, not even through a chain of symlinks.
+func untarSources(r io.Reader, dir string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid path in sources: %s", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := mkdirAllIn(root, name); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			link := filepath.FromSlash(hdr.Linkname)
+			if link == "" || filepath.IsAbs(link) || slices.Contains(strings.Split(link, string(filepath.Separator)), "..") {
+				return fmt.Errorf("symlink %s in sources points outside its directory: %s", hdr.Name, hdr.Linkname)
+			}
+			if err := mkdirAllIn(root, filepath.Dir(name)); err != nil {
+				return err
+			}
+			if err := os.Symlink(link, filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := mkdirAllIn(root, filepath.Dir(name)); err != nil {
+				return err
+			}
+			f, err := root.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// mkdirAllIn creates the directory name and its parents within root.
+func mkdirAllIn(root *os.Root, name string) error {
+	if name == "." {
+		return nil
+	}
+	if err := mkdirAllIn(root, filepath.Dir(name)); err != nil {
+		return err
+	}
+	if err := root.Mkdir(name, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+// jobLog buffers the output of a job on the worker until it is sent to the
+// coordinator.
+type jobLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+// flush sends the output buffered so far.
+func (l *jobLog) flush(ctx context.Context, c *serveClient, path string) error {
+	l.mu.Lock()
+	data := bytes.Clone(l.buf.Bytes())
+	l.buf.Reset()
+	l.mu.Unlock()
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := c.do(ctx, http.MethodPost, path, bytes.NewReader(data), nil)
+	return err
+}
+
+// checkoutSource fetches the ref of a git source into dir and returns its
+// commit. Credentials come from the git configuration of the worker.
+func checkoutSource(ctx context.Context, src *gitSource, dir string, out io.Writer) (string, error) {
+	for _, args := range [][]string{{"init", "-q"}, {"fetch", "-q", "--depth", "1", src.Repo, src.Ref}, {"checkout", "-q", "FETCH_HEAD"}} {
+		git := newCommand(ctx, "git", args...)
+		git.Dir = dir
+		git.Stdout, git.Stderr = io.MultiWriter(git.Stdout, git.redacting(out)), io.MultiWriter(git.Stderr, git.redacting(out))
+		if err := git.Run(); err != nil {
+			return "", fmt.Errorf("git %s failed: %w", args[0], err)
+		}
+	}
+	rev := newCommand(ctx, "git", "rev-parse", "HEAD")
+	rev.Dir = dir
+	commit, err := rev.Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse failed: %w", err)
+	}
+	return strings.TrimSpace(string(commit)), nil
+}
+
+// runServeJob builds a claimed job in a fresh directory below workDir with
+// 'builder deps' and 'builder build', and uploads the packages and logs.
+func runServeJob(ctx context.Context, c *serveClient, job *serveJob, worker, workDir string, builderArgs []string) error {
+	dir := filepath.Join(workDir, job.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	query := "?worker=" + url.QueryEscape(worker)
+
+	// Stop building when the coordinator gave the job to another worker
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(workerHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			status, err := c.do(ctx, http.MethodPost, "/api/v1/jobs/"+job.ID+"/heartbeat"+query, nil, nil)
+			if status == http.StatusConflict {
+				log.Printf("Warning: %s was taken away from this worker, stopping it", job.ID)
+				cancel()
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Warning: could not send heartbeat for %s: %v", job.ID, err)
+			}
+		}
+	}()
+
+	// The output of the job is streamed to the coordinator
+	jl := &jobLog{}
+	logPath := "/api/v1/jobs/" + job.ID + "/log" + query
+	logCtx, stopLog := context.WithCancel(ctx)
+	logDone := make(chan struct{})
+	go func() {
+		defer close(logDone)
+		ticker := time.NewTicker(logFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-logCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := jl.flush(logCtx, c, logPath); err != nil && logCtx.Err() == nil {
+				debugPrint("Could not send the output of %s: %v", job.ID, err)
+			}
+		}
+	}()
+	finishLog := func() {
+		stopLog()
+		<-logDone
+		if err := jl.flush(ctx, c, logPath); err != nil {
+			log.Printf("Warning: could not send the output of %s: %v", job.ID, err)
+		}
+	}
+	defer stopLog()
+
+	var commit string
+	var buildErr error
+	pkgDir := filepath.Join(dir, "package")
+	if job.Source != nil {
+		fmt.Fprintf(jl, "Fetching %s of %s on %s\n", job.Source.Ref, job.Source.Repo, worker)
+		if err := os.MkdirAll(pkgDir, 0755); err != nil {
+			return err
+		}
+		// A ref that cannot be built fails the job instead of being retried
+		commit, buildErr = checkoutSource(ctx, job.Source, pkgDir, jl)
+		pkgDir = filepath.Join(pkgDir, job.Source.Path)
+		if _, err := os.Stat(filepath.Join(pkgDir, "PKGBUILD")); buildErr == nil && err != nil {
+			buildErr = fmt.Errorf("no PKGBUILD at %s of %s", job.Source.Path, job.Source.Ref)
+		}
+	} else {
+		src := filepath.Join(dir, "source.tar.gz")
+		if err := c.download(ctx, "/api/v1/jobs/"+job.ID+"/source", src); err != nil {
+			return fmt.Errorf("could not download the sources: %w", err)
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		err = untarSources(f, pkgDir)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not extract the sources: %w", err)
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	steps := [][]string{{"deps"}, append([]string{"build"}, job.Args...)}
+	if job.Bump != "" {
+		steps = append([][]string{{"bump", job.Bump}}, steps...)
+	}
+	for _, step := range steps {
+		if buildErr != nil {
+			break
+		}
+		args := append(slices.Clone(builderArgs), step...)
+		run := newCommand(ctx, self, args...)
+		run.Dir = pkgDir
+		// The PKGBUILD is untrusted: it must not get the worker's token
+		run.Env = environWithoutSecrets()
+		run.Stdout, run.Stderr = io.MultiWriter(run.Stdout, run.redacting(jl)), io.MultiWriter(run.Stderr, run.redacting(jl))
+		log.Printf("Running 'builder %s' for %s...", strings.Join(step, " "), job.ID)
+		fmt.Fprintf(jl, "Running 'builder %s' on %s\n", strings.Join(step, " "), worker)
+		if buildErr = run.Run(); buildErr != nil {
+			buildErr = fmt.Errorf("builder %s failed: %w", step[0], buildErr)
+		}
+	}
+	if buildErr != nil {
+		fmt.Fprintf(jl, "Error: %v\n", buildErr)
+	}
+	finishLog()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Updated packages return their PKGBUILD to be committed
+	patterns := []string{"*.pkg.tar.*", "*.log"}
+	if job.Bump != "" {
+		patterns = append(patterns, "PKGBUILD", ".SRCINFO")
+	}
+	var files []string
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(pkgDir, pattern))
+		files = append(files, matches...)
+	}
+	files = append(files, destOutputs(pkgDir, "*.pkg.tar.*", makepkgPKGDEST)...)
+	files = append(files, destOutputs(pkgDir, "*.log", makepkgLOGDEST)...)
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		_, err = c.do(ctx, http.MethodPut, "/api/v1/jobs/"+job.ID+"/artifacts/"+url.PathEscape(filepath.Base(file))+query, f, nil)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not upload %s: %w", filepath.Base(file), err)
+		}
+		log.Printf("  Uploaded: %s", filepath.Base(file))
+	}
+
+	result := map[string]string{"error": "", "commit": commit}
+	if buildErr != nil {
+		result["error"] = buildErr.Error()
+	}
+	body, _ := json.Marshal(result)
+	if _, err := c.do(ctx, http.MethodPost, "/api/v1/jobs/"+job.ID+"/finish"+query, bytes.NewReader(body), nil); err != nil {
+		return fmt.Errorf("could not report the result: %w", err)
+	}
+	return nil
+}
+
+// newServeCmd creates the 'serve' command.
+func newServeCmd() *cobra.Command {
+	var listen, dataDir string
+	var lease time.Duration
+	var webhooks, noAuth bool
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Runs a build queue coordinator for a pool of persistent workers.",
+		Long: `Runs the coordinator of a build queue: CI jobs submit package builds with
+'builder submit', and persistent machines running 'builder worker' build them
+with their warm caches and return the packages, so ephemeral runners do not
+spend their time bootstrapping.
+
+The queue is kept in memory; sources and artifacts are stored below --data-dir.
+The job of a worker that sends no heartbeat for --lease is queued again.
+
+Clients pass a bearer token: BUILDER_SERVE_TOKEN (an admin token), a token of
+serve.auth.tokens or, with serve.auth.oidc, the ID token of a GitLab CI job
+(BUILDER_ID_TOKEN on the client). Their roles allow submitting builds and
+reading jobs, their logs, sources and artifacts (submit), publishing the
+packages of finished jobs to a channel (publish), running jobs (worker) or
+everything (admin); their projects restrict which repositories they may
+build, read and publish, and CI jobs only their own. Without any token
+configured, the API is open, which is refused unless --listen is a loopback
+address or --no-auth is given. Who queued and published what is recorded in
+<data-dir>/audit.log.
+
+Internal tools and bots can request builds through the same API:
+
+  POST /api/v1/builds                   {"repo", "ref", "path", "args"}: build a
+                                        package of a repository in serve.repositories
+  POST /api/v1/jobs?package=<name>      build the uploaded tar.gz of a package directory
+  GET  /api/v1/jobs                     list the jobs
+  GET  /api/v1/jobs/<id>                status of a job
+  GET  /api/v1/jobs/<id>/log?follow=1   build output, streamed until the job finished
+  GET  /api/v1/jobs/<id>/manifest       artifacts with sizes, checksums and versions
+  GET  /api/v1/jobs/<id>/artifacts/<name>
+  POST /api/v1/jobs/<id>/publish        {"channel"}: add the packages to a channel
+                                        of repo.channels on the coordinator
+  GET  /api/v1/audit                    the audit log (admin)
+
+The dashboard at /ui/ shows the recent jobs, the build history of each
+package, the contents of repo.channels and the packages of serve.workspace
+with a newer upstream release. Browsers log in with any user name and a token
+as password.
+
+With --webhooks, GitHub and GitLab release webhooks posted to /webhooks/github
+and /webhooks/gitlab update the packages following the released project
+(serve.webhooks): a worker runs 'builder bump' with the version from the tag
+before building, and returns the updated PKGBUILD and .SRCINFO with the
+packages. Configure BUILDER_WEBHOOK_SECRET as the webhook's secret (GitHub) or
+secret token (GitLab).
+
+The tasks of serve.schedule run periodically (every or a UTC cron expression):
+builder commands on the coordinator, such as outdated, 'repo sync' refreshing
+the staging mirror or clean, and builds of VCS packages queued for the
+workers. A task whose runs (or queued builds) reach its concurrency limit
+skips its next run. GET /api/v1/schedule reports their state, and
+/api/v1/schedule/<name>/log the output of a command's last run.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			token, err := getSecret("serve-token")
+			if err != nil {
+				return err
+			}
+			if dataDir == "" {
+				dataDir = filepath.Join(cacheDir(), "serve")
+			}
+			if err := os.MkdirAll(dataDir, 0755); err != nil {
+				return errorf(errGeneral, "could not create data directory: %w", err)
+			}
+			auth, err := newAuthenticator(token)
+			if err != nil {
+				return err
+			}
+			c := newCoordinator(dataDir, auth, lease)
+			if c.builderArgs, err = childBuilderArgs(cmd); err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+			if webhooks {
+				if c.webhookSecret, err = getSecret("webhook-secret"); err != nil {
+					return err
+				}
+				if c.webhookSecret == "" {
+					return errorf(errConfig, "--webhooks needs BUILDER_WEBHOOK_SECRET to verify the webhooks")
+				}
+			}
+			if !auth.enabled() {
+				if !noAuth && !loopbackAddress(listen) {
+					return &builderError{
+						Category: errConfig,
+						Err:      fmt.Errorf("no tokens are configured, so anyone reaching %s could queue and publish builds", listen),
+						Hint:     "Set BUILDER_SERVE_TOKEN or configure serve.auth, listen on a loopback address such as --listen 127.0.0.1:8080, or pass --no-auth.",
+					}
+				}
+				log.Printf("Warning: no tokens are configured, anyone reaching %s can queue builds", listen)
+			}
+
+			ctx := cmd.Context()
+			if cfg.Serve.Workspace != "" {
+				go c.dash.refreshOutdated(ctx)
+			}
+			if len(cfg.Serve.Schedule) > 0 {
+				c.sched = newScheduler(c, c.builderArgs)
+				c.sched.run(ctx)
+				log.Printf("Scheduled %d task(s)", len(cfg.Serve.Schedule))
+			}
+			go func() {
+				ticker := time.NewTicker(c.lease / 4)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						c.requeueExpired()
+					}
+				}
+			}()
+
+			srv := &http.Server{Addr: listen, Handler: c.handler(), BaseContext: func(net.Listener) context.Context { return ctx }}
+			go func() {
+				<-ctx.Done()
+				shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				srv.Shutdown(shutdown)
+			}()
+			log.Printf("Coordinator listening on %s, storing jobs in %s", listen, dataDir)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return errorf(errGeneral, "coordinator failed: %w", err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&listen, "listen", ":8080", "Address to listen on")
+	cmd.Flags().StringVar(&dataDir, "data-dir", "", "Directory for job sources and artifacts (default: <cache>/serve)")
+	cmd.Flags().DurationVar(&lease, "lease", defaultLease, "Queue the job of a worker again after this long without a heartbeat")
+	cmd.Flags().BoolVar(&webhooks, "webhooks", false, "Accept GitHub and GitLab release webhooks updating the packages of serve.webhooks")
+	cmd.Flags().BoolVar(&noAuth, "no-auth", false, "Serve an open API without tokens on a non-loopback --listen address")
+	return cmd
+}
+
+// loopbackAddress reports whether a listen address only accepts connections
+// from this machine.
+func loopbackAddress(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newWorkerCmd creates the 'worker' command.
+func newWorkerCmd() *cobra.Command {
+	var server, name, workDir string
+	cmd := &cobra.Command{
+		Use:   "worker",
+		Short: "Builds the jobs queued at a coordinator.",
+		Long: `Polls the coordinator started with 'builder serve' for queued builds, runs
+'builder deps' and 'builder build' with the submitted arguments in a fresh
+directory below --work-dir, and uploads the packages and logs. Run it on
+persistent machines, one worker per concurrent build, so the package caches,
+compiler caches and chroots stay warm between jobs.
+
+Give workers a token of serve.auth.tokens with only the worker role, in
+BUILDER_SERVE_TOKEN, rather than the admin token. The builds run without the
+secrets of the worker's environment, the token included.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newServeClient(server)
+			if err != nil {
+				return err
+			}
+			if name == "" {
+				host, _ := os.Hostname()
+				name = fmt.Sprintf("%s-%d", host, os.Getpid())
+			}
+			if workDir == "" {
+				workDir = filepath.Join(cacheDir(), "worker")
+			}
+			builderArgs, err := childBuilderArgs(cmd)
+			if err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+
+			ctx := cmd.Context()
+			log.Printf("Worker %s polling %s", name, c.base)
+			for ctx.Err() == nil {
+				var job serveJob
+				status, err := c.do(ctx, http.MethodPost, "/api/v1/claim?worker="+url.QueryEscape(name), nil, &job)
+				if err != nil {
+					if ctx.Err() != nil {
+						break
+					}
+					log.Printf("Warning: could not claim a job: %v", err)
+					select {
+					case <-ctx.Done():
+					case <-time.After(10 * time.Second):
+					}
+					continue
+				}
+				if status == http.StatusNoContent {
+					continue
+				}
+				log.Printf("Building %s (%s)...", job.ID, job.Package)
+				if err := runServeJob(ctx, c, &job, name, workDir, builderArgs); err != nil {
+					log.Printf("Warning: job %s failed on this worker: %v", job.ID, err)
+				}
+			}
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return newError(errCancelled, ctx.Err())
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&server, "server", os.Getenv("BUILDER_SERVER"), "URL of the coordinator (default $BUILDER_SERVER)")
+	cmd.Flags().StringVar(&name, "name", "", "Name of this worker in the queue (default: <hostname>-<pid>)")
+	cmd.Flags().StringVar(&workDir, "work-dir", "", "Directory jobs are built in (default: <cache>/worker)")
+	return cmd
+}
+
+// newSubmitCmd creates the 'submit' command.
+func newSubmitCmd() *cobra.Command {
+	var server, outDir, repo, ref, project, publish string
+	var noWait, follow bool
+	cmd := &cobra.Command{
+		Use:   "submit [<dir>] [-- <build flags>...]",
+		Short: "Queues a package build at a coordinator and fetches the packages.",
+		Long: `Sends the package directory (default: the current one, without src/, pkg/,
+build output and .git) to the coordinator started with 'builder serve', waits
+until a worker built it and downloads the packages and logs into --dir.
+Arguments after -- are passed to 'builder build' on the worker: --clean,
+--force, --offline-build, --audit, --variant and --march.
+
+With --repo, the workers fetch --ref of that git repository instead and build
+the package at <dir> within it; the repository must be listed in
+serve.repositories of the coordinator. --follow prints the build output while
+waiting. --publish adds the packages to a channel of the coordinator's
+repo.channels once built, which needs the publish role.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			n := cmd.ArgsLenAtDash()
+			if n < 0 {
+				n = len(args)
+			}
+			if n > 1 {
+				return newError(errGeneral, fmt.Errorf("at most one package directory can be submitted"))
+			}
+			dir, buildArgs := ".", args[n:]
+			if n == 1 {
+				dir = args[0]
+			}
+			if noWait && publish != "" {
+				return newError(errConfig, fmt.Errorf("--publish needs to wait for the build"))
+			}
+			if err := checkBuildArgs(buildArgs); err != nil {
+				return newError(errGeneral, err)
+			}
+			c, err := newServeClient(server)
+			if err != nil {
+				return err
+			}
+
+			var job serveJob
+			if repo != "" {
+				if dir == "." {
+					dir = ""
+				}
+				body, _ := json.Marshal(map[string]any{"repo": repo, "ref": ref, "path": dir, "args": buildArgs})
+				if _, err := c.do(cmd.Context(), http.MethodPost, "/api/v1/builds", bytes.NewReader(body), &job); err != nil {
+					return errorf(errGeneral, "could not queue the build: %w", err)
+				}
+				log.Printf("Queued %s at %s as %s", job.Package, ref, job.ID)
+			} else {
+				info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+				if err != nil {
+					return errorf(errParse, "%w", err)
+				}
+				var src bytes.Buffer
+				epoch, _ := sourceEpoch(cmd.Context(), dir)
+				if err := tarSources(dir, epoch, &src); err != nil {
+					return errorf(errGeneral, "could not pack %s: %w", dir, err)
+				}
+				pkg := info.Vars["pkgbase"]
+				if pkg == "" {
+					pkg = info.PkgName
+				}
+				query := url.Values{"package": {pkg}, "arg": buildArgs}
+				if project != "" {
+					query.Set("project", project)
+				}
+				size := int64(src.Len())
+				if _, err := c.do(cmd.Context(), http.MethodPost, "/api/v1/jobs?"+query.Encode(), &src, &job); err != nil {
+					return errorf(errGeneral, "could not queue the build: %w", err)
+				}
+				log.Printf("Queued %s as %s (%s)", job.Package, job.ID, formatSize(size))
+			}
+			if noWait {
+				fmt.Println(job.ID)
+				return nil
+			}
+
+			if follow {
+				// Returns when the job finished; the loop below only fetches its result
+				out := newRedactingWriter(os.Stdout)
+				if err := c.copyTo(cmd.Context(), "/api/v1/jobs/"+job.ID+"/log?follow=1", out); err != nil && cmd.Context().Err() == nil {
+					log.Printf("Warning: could not follow the output of %s: %v", job.ID, err)
+				}
+				out.Flush()
+			}
+			status, delay := job.Status, 5*time.Second
+			if follow {
+				delay = 0
+			}
+			for job.Status == jobQueued || job.Status == jobRunning {
+				select {
+				case <-cmd.Context().Done():
+					return newError(errCancelled, cmd.Context().Err())
+				case <-time.After(delay):
+				}
+				delay = 5 * time.Second
+				if _, err := c.do(cmd.Context(), http.MethodGet, "/api/v1/jobs/"+job.ID, nil, &job); err != nil {
+					log.Printf("Warning: could not get the status of %s: %v", job.ID, err)
+					continue
+				}
+				if job.Status != status {
+					status = job.Status
+					if job.Worker != "" {
+						log.Printf("  %s: %s on %s", job.ID, job.Status, job.Worker)
+					} else {
+						log.Printf("  %s: %s", job.ID, job.Status)
+					}
+				}
+			}
+
+			if err := os.MkdirAll(outDir, 0755); err != nil {
+				return errorf(errArtifact, "could not create %s: %w", outDir, err)
+			}
+			for _, name := range job.Artifacts {
+				dest := filepath.Join(outDir, name)
+				if err := c.download(cmd.Context(), "/api/v1/jobs/"+job.ID+"/artifacts/"+url.PathEscape(name), dest); err != nil {
+					return errorf(errArtifact, "could not download %s: %w", name, err)
+				}
+				log.Printf("  Collected: %s", dest)
+			}
+			if job.Status == jobFailed {
+				output := filepath.Join(outDir, job.ID+".log")
+				if err := c.download(cmd.Context(), "/api/v1/jobs/"+job.ID+"/log", output); err != nil {
+					log.Printf("Warning: could not download the output of %s: %v", job.ID, err)
+				}
+				return &builderError{
+					Category: errBuild,
+					Err:      fmt.Errorf("%s failed on %s: %s", job.ID, job.Worker, job.Error),
+					Hint:     fmt.Sprintf("See %s for the output of the worker.", output),
+				}
+			}
+			if publish != "" {
+				body, _ := json.Marshal(map[string]string{"channel": publish})
+				if _, err := c.do(cmd.Context(), http.MethodPost, "/api/v1/jobs/"+job.ID+"/publish", bytes.NewReader(body), nil); err != nil {
+					return errorf(errPublish, "could not publish %s to %s: %w", job.ID, publish, err)
+				}
+				log.Printf("Published %s to %s", job.Package, publish)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&server, "server", os.Getenv("BUILDER_SERVER"), "URL of the coordinator (default $BUILDER_SERVER)")
+	cmd.Flags().StringVar(&outDir, "dir", ".", "Directory the packages and logs are downloaded to")
+	cmd.Flags().BoolVar(&noWait, "no-wait", false, "Print the job ID and return without waiting for the build")
+	cmd.Flags().BoolVar(&follow, "follow", false, "Print the build output of the worker while waiting")
+	cmd.Flags().StringVar(&repo, "repo", "", "Build from this git repository instead of uploading <dir>")
+	cmd.Flags().StringVar(&ref, "ref", "HEAD", "Branch, tag or commit of --repo to build")
+	cmd.Flags().StringVar(&project, "project", os.Getenv("CI_PROJECT_PATH"), "Project (group/name) of the uploaded package, for authorization (default $CI_PROJECT_PATH)")
+	cmd.Flags().StringVar(&publish, "publish", "", "Publish the packages to this channel of the coordinator once built")
+	return cmd
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepositoryAllowed(t *testing.T) {
+	allowed := []string{
+		"https://gitlab.example.com/prismlinux/packages.git",
+		"https://GitLab.example.com/tools/",
+		"git@gitlab.example.com:prismlinux/extra",
+	}
+	for repo, want := range map[string]bool{
+		"https://gitlab.example.com/prismlinux/packages.git":       true,
+		"https://gitlab.example.com/prismlinux/packages":           true,
+		"https://gitlab.example.com/prismlinux/packages/":          true,
+		"https://gitlab.example.com/tools/foo.git":                 true,
+		"https://gitlab.example.com/tools/sub/foo.git":             true,
+		"git@gitlab.example.com:prismlinux/extra.git":              true,
+		"ssh://git@gitlab.example.com/prismlinux/extra.git":        true,
+		"https://gitlab.example.com/prismlinux/packages-evil.git":  false,
+		"https://gitlab.example.com/prismlinux/packages/../x.git":  false,
+		"https://gitlab.example.com/tools/../prismlinux/other.git": false,
+		"https://gitlab.example.com/tools/./foo.git":               false,
+		"https://gitlab.example.com/tools/%2e%2e/foo.git":          false,
+		"https://gitlab.example.com/tools//foo.git":                false,
+		"https://gitlab.example.com/tools":                         true,
+		"https://gitlab.example.com/toolsx/foo.git":                false,
+		"https://gitlab.example.com.evil.com/tools/foo.git":        false,
+		"http://gitlab.example.com/tools/foo.git":                  false,
+		"https://gitlab.example.com/tools/foo.git?x=1":             false,
+		"git@gitlab.example.com:prismlinux/extra-evil.git":         false,
+		"-oProxyCommand=x:prismlinux/extra":                        false,
+		"":                                                         false,
+	} {
+		if got := repositoryAllowed(repo, allowed); got != want {
+			t.Errorf("repositoryAllowed(%q) = %v, want %v", repo, got, want)
+		}
+	}
+}
+
+// tarOf returns a gzipped tarball of the given headers, with name as the
+// content of regular files.
+func tarOf(t *testing.T, hdrs ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(hdr.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUntarSources(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "patches"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"PKGBUILD": "pkgname=foo\n", "patches/fix.patch": "--- a\n"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("patches/fix.patch", filepath.Join(src, "fix.patch")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := tarSources(src, time.Unix(0, 0), &buf); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := untarSources(&buf, dir); err != nil {
+		t.Fatalf("untarSources() error = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "fix.patch")); err != nil || string(data) != "--- a\n" {
+		t.Errorf("fix.patch = %q, %v", data, err)
+	}
+}
+
+func TestUntarSourcesOutside(t *testing.T) {
+	reg := func(name string) *tar.Header { return &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644} }
+	link := func(name, target string) *tar.Header {
+		return &tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target}
+	}
+	for name, hdrs := range map[string][]*tar.Header{
+		"absolute symlink":       {link("x", "/tmp"), reg("x/authorized_keys")},
+		"symlink up":             {link("x", ".."), reg("x/escaped")},
+		"symlink up from subdir": {reg("a/file"), link("a/x", "../../escaped")},
+		"chain of symlinks":      {link("q/s", "."), link("q/t", "s/../.."), reg("q/t/escaped")},
+		"path outside":           {reg("../escaped")},
+		"absolute path":          {reg("/escaped")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "sources")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := untarSources(bytes.NewReader(tarOf(t, hdrs...)), dir); err == nil {
+				t.Error("untarSources() succeeded, want an error")
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "escaped")); err == nil {
+				t.Error("a file was written outside the directory")
+			}
+		})
+	}
+}
+
+func TestCheckBuildArgs(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"--clean", "--force"},
+		{"-f", "--variant", "lts", "--march=x86-64-v3"},
+		{"--offline-build", "--audit"},
+	} {
+		if err := checkBuildArgs(args); err != nil {
+			t.Errorf("checkBuildArgs(%q) error = %v", args, err)
+		}
+	}
+	for _, args := range [][]string{
+		{"--config", "/tmp/evil.yaml"},
+		{"--state-db=/tmp/x.db"},
+		{"--metrics-file", "/etc/cron.d/x"},
+		{"--error-json=/tmp/x"},
+		{"--profile", "release"},
+		{"--builddir", "/home"},
+		{"--clean", "extra"},
+		{"--variant"},
+	} {
+		if err := checkBuildArgs(args); err == nil {
+			t.Errorf("checkBuildArgs(%q) succeeded, want an error", args)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// commandKillDelay is how long a child process gets to exit after SIGTERM
+// before it is killed.
+const commandKillDelay = 10 * time.Second
+
+// signalContext returns a context cancelled on SIGINT or SIGTERM (e.g. GitLab
+// job cancellation). After the first signal the default handlers are restored,
+// so a second signal terminates immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		signal.Stop(sigCh)
+		log.Printf("Received %s, cancelling and cleaning up (send again to force exit)...", sig)
+		cancel()
+	}()
+	return ctx, func() {
+		signal.Stop(sigCh)
+		cancel()
+	}
+}
+
+// removePartialPackages deletes package files written since a cancelled build
+// started, as they may be incomplete.
+func removePartialPackages(since time.Time) {
+	// File timestamps come from a coarse kernel clock and may lag slightly
+	since = since.Add(-time.Second)
+	for _, f := range builtPackages(".") {
+		if info, err := os.Stat(f); err == nil && !info.ModTime().Before(since) {
+			if err := os.Remove(f); err == nil {
+				log.Printf("  Removed partial package: %s", f)
+			}
+		}
+	}
+}
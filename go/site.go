@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// Directories of the generated site below its output directory.
+const (
+	sitePackagesDir   = "packages"
+	siteChangelogsDir = "changelogs"
+)
+
+// siteIndex is index.json of a repository site.
+type siteIndex struct {
+	Repo      string        `json:"repo"`
+	Title     string        `json:"title"`
+	Generated time.Time     `json:"generated"`
+	Packages  []sitePackage `json:"packages"`
+}
+
+// sitePackage describes a package of the site; URLs are relative to the
+// site root unless --base-url is given.
+type sitePackage struct {
+	Name         string    `json:"name"`
+	Base         string    `json:"base"`
+	Version      string    `json:"version"`
+	Desc         string    `json:"desc,omitempty"`
+	Arch         string    `json:"arch"`
+	URL          string    `json:"url,omitempty"`
+	License      []string  `json:"license,omitempty"`
+	Groups       []string  `json:"groups,omitempty"`
+	Packager     string    `json:"packager,omitempty"`
+	BuildDate    time.Time `json:"build_date,omitzero"`
+	Filename     string    `json:"filename"`
+	Download     string    `json:"download"`
+	Signature    string    `json:"signature,omitempty"`
+	CSize        int64     `json:"csize"`
+	ISize        int64     `json:"isize"`
+	SHA256Sum    string    `json:"sha256sum,omitempty"`
+	Depends      []siteDep `json:"depends,omitempty"`
+	OptDepends   []siteDep `json:"optdepends,omitempty"`
+	MakeDepends  []siteDep `json:"makedepends,omitempty"`
+	CheckDepends []siteDep `json:"checkdepends,omitempty"`
+	Provides     []string  `json:"provides,omitempty"`
+	Conflicts    []string  `json:"conflicts,omitempty"`
+	Replaces     []string  `json:"replaces,omitempty"`
+	Changelog    string    `json:"changelog,omitempty"`
+	RequiredBy   []string  `json:"required_by,omitempty"`
+	Page         string    `json:"page"`
+}
+
+// siteDep is a dependency, with the package of the repository providing it.
+type siteDep struct {
+	Dep      string `json:"dep"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// siteDeps resolves deps against the repository database; optional
+// dependencies keep their description in Dep.
+func siteDeps(db *repodb.DB, deps []string) []siteDep {
+	var out []siteDep
+	for _, dep := range deps {
+		name, _, _ := strings.Cut(dep, ": ")
+		d := siteDep{Dep: dep}
+		if p := db.FindSatisfier(repodb.ParseDependency(strings.TrimSpace(name))); p != nil {
+			d.Provider = p.Name
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// generateSite writes the static site of the repository of dbPath to out:
+// index.html and index.json, a page per package and the changelogs packages
+// ship. Pages of packages no longer in the repository are removed.
+func generateSite(dbPath, out, baseURL, title string) (*siteIndex, error) {
+	db, err := repodb.Read(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	repoDir := filepath.Dir(dbPath)
+	if baseURL == "" {
+		// Link the package files relative to the site
+		rel, err := filepath.Rel(out, repoDir)
+		if err != nil {
+			return nil, err
+		}
+		baseURL = filepath.ToSlash(rel)
+	}
+	if baseURL = strings.TrimSuffix(baseURL, "/"); baseURL == "." {
+		baseURL = ""
+	} else {
+		baseURL += "/"
+	}
+	if title == "" {
+		title = repoName(dbPath)
+	}
+	index := &siteIndex{Repo: repoName(dbPath), Title: title, Generated: time.Now().UTC()}
+
+	pages := map[string]bool{}
+	changelogs := map[string]bool{}
+	for _, name := range db.Names() {
+		e := db.Entries[name]
+		p := sitePackage{
+			Name: e.Name, Base: e.Base, Version: e.Version, Desc: e.Desc, Arch: e.Arch, URL: e.URL,
+			License: e.License, Groups: e.Groups, Packager: e.Packager,
+			Filename: e.Filename, Download: baseURL + e.Filename,
+			CSize: e.CSize, ISize: e.ISize, SHA256Sum: e.SHA256Sum,
+			Depends: siteDeps(db, e.Depends), OptDepends: siteDeps(db, e.OptDepends),
+			MakeDepends: siteDeps(db, e.MakeDepends), CheckDepends: siteDeps(db, e.CheckDepends),
+			Provides: e.Provides, Conflicts: e.Conflicts, Replaces: e.Replaces,
+			Page: sitePackagesDir + "/" + e.Name + ".html",
+		}
+		if p.Base == "" {
+			p.Base = p.Name
+		}
+		if e.BuildDate > 0 {
+			p.BuildDate = time.Unix(e.BuildDate, 0).UTC()
+		}
+		if _, err := os.Stat(filepath.Join(repoDir, e.Filename+".sig")); err == nil || e.PGPSig != "" {
+			p.Signature = p.Download + ".sig"
+		}
+		pages[e.Name+".html"] = true
+
+		// Changelogs are named after the package file, which changes with
+		// every build, so each is extracted once
+		logName := e.Filename + ".txt"
+		logPath := filepath.Join(out, siteChangelogsDir, logName)
+		if _, err := os.Stat(logPath); err == nil {
+			p.Changelog = siteChangelogsDir + "/" + logName
+		} else if changelog, err := pkgarchive.ReadChangelog(filepath.Join(repoDir, e.Filename)); err != nil {
+			log.Printf("Warning: could not read the changelog of %s: %v", e.Filename, err)
+		} else if changelog != nil {
+			if err := writeFileAtomic(logPath, changelog, 0644); err != nil {
+				return nil, err
+			}
+			p.Changelog = siteChangelogsDir + "/" + logName
+		}
+		if p.Changelog != "" {
+			changelogs[logName] = true
+		}
+		index.Packages = append(index.Packages, p)
+	}
+	for i := range index.Packages {
+		for _, other := range index.Packages {
+			for _, dep := range other.Depends {
+				if dep.Provider == index.Packages[i].Name {
+					index.Packages[i].RequiredBy = append(index.Packages[i].RequiredBy, other.Name)
+					break
+				}
+			}
+		}
+	}
+
+	if err := writeSitePage(filepath.Join(out, "index.html"), "index", index); err != nil {
+		return nil, err
+	}
+	for _, p := range index.Packages {
+		if err := writeSitePage(filepath.Join(out, filepath.FromSlash(p.Page)), "package", struct {
+			Site *siteIndex
+			Pkg  sitePackage
+		}{index, p}); err != nil {
+			return nil, err
+		}
+	}
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(index); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(out, "index.json"), data.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	removeStaleSiteFiles(filepath.Join(out, sitePackagesDir), pages)
+	removeStaleSiteFiles(filepath.Join(out, siteChangelogsDir), changelogs)
+	return index, nil
+}
+
+// removeStaleSiteFiles deletes the files of dir not in keep.
+func removeStaleSiteFiles(dir string, keep map[string]bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() && !keep[e.Name()] {
+			debugPrint("Removing stale site file %s", filepath.Join(dir, e.Name()))
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+func writeSitePage(file, name string, data any) error {
+	var buf bytes.Buffer
+	if err := siteTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, buf.Bytes(), 0644)
+}
+
+// newRepoSiteCmd creates the 'repo site' command.
+func newRepoSiteCmd() *cobra.Command {
+	var output, baseURL, title string
+	cmd := &cobra.Command{
+		Use:   "site <db>",
+		Short: "Generates a static HTML and JSON index of a repository.",
+		Long: `Generates a browsable static index of a repository: index.html with all
+packages, a page per package with its dependencies (linked when the
+repository provides them), sizes and changelog, and index.json for scripts.
+The site is written to the repository directory by default, so it can be
+published with the repository, e.g. as GitLab Pages or through post_publish:
+
+  repo:
+    post_publish:
+      - builder repo site "$BUILDER_REPO_DB"`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbPath := repoDBPath(args[0])
+			if output == "" {
+				output = filepath.Dir(dbPath)
+			}
+			index, err := generateSite(dbPath, output, baseURL, title)
+			if err != nil {
+				return errorf(errPublish, "could not generate the site of %s: %w", dbPath, err)
+			}
+			log.Printf("Site of %s written to %s (%d packages).", index.Repo, output, len(index.Packages))
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Directory the site is written to (default: the repository directory)")
+	cmd.Flags().StringVar(&baseURL, "base-url", "", "URL the package files are downloaded from (default: relative to the site)")
+	cmd.Flags().StringVar(&title, "title", "", "Title of the site (default: the repository name)")
+	return cmd
+}
+
+var siteTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"size": formatSize,
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04")
+	},
+	"join": func(s []string) string { return strings.Join(s, ", ") },
+	"root": func(page string) string {
+		return strings.Repeat("../", strings.Count(page, "/"))
+	},
+	// link resolves a site URL on a page below the root
+	"link": func(root, url string) string {
+		if strings.Contains(url, "://") {
+			return url
+		}
+		return root + url
+	},
+}).Parse(siteHTML))
+
+const siteHTML = `
+{{define "head"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: .25em .75em; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f4f4f4; }
+.muted { color: #888; }
+#filter { margin-bottom: 1em; padding: .25em; width: 20em; }
+</style></head><body>{{end}}
+
+{{define "deps"}}{{range $i, $d := .}}{{if $i}}, {{end}}{{if $d.Provider}}<a href="{{$d.Provider}}.html">{{$d.Dep}}</a>{{else}}{{$d.Dep}}{{end}}{{end}}{{end}}
+
+{{define "index"}}{{template "head" .Title}}
+<h1>{{.Title}}</h1>
+<p class="muted">{{len .Packages}} packages, generated {{date .Generated}} UTC. Also available as <a href="index.json">index.json</a>.</p>
+<input id="filter" type="search" placeholder="Filter packages" oninput="for (const r of document.querySelectorAll('tbody tr')) r.hidden = !r.textContent.toLowerCase().includes(this.value.toLowerCase())">
+<table><thead><tr><th>Package</th><th>Version</th><th>Description</th><th>Arch</th><th>Size</th><th>Built</th><th>Files</th></tr></thead>
+<tbody>{{range .Packages}}<tr>
+<td><a href="{{.Page}}">{{.Name}}</a></td><td>{{.Version}}</td><td>{{.Desc}}</td><td>{{.Arch}}</td>
+<td>{{size .CSize}}</td><td>{{date .BuildDate}}</td>
+<td><a href="{{.Download}}">package</a>{{if .Signature}} <a href="{{.Signature}}">sig</a>{{end}}{{if .Changelog}} <a href="{{.Changelog}}">changelog</a>{{end}}</td>
+</tr>{{else}}<tr><td colspan="7" class="muted">The repository is empty.</td></tr>{{end}}</tbody>
+</table>
+</body></html>{{end}}
+
+{{define "package"}}{{$root := root .Pkg.Page}}{{template "head" (printf "%s - %s" .Pkg.Name .Site.Title)}}
+<p><a href="{{$root}}index.html">{{.Site.Title}}</a></p>
+{{with .Pkg}}<h1>{{.Name}} {{.Version}}</h1>
+{{if .Desc}}<p>{{.Desc}}</p>{{end}}
+<table>
+<tr><th>Base</th><td>{{.Base}}</td></tr>
+<tr><th>Architecture</th><td>{{.Arch}}</td></tr>
+{{if .URL}}<tr><th>Upstream</th><td><a href="{{.URL}}">{{.URL}}</a></td></tr>{{end}}
+{{if .License}}<tr><th>Licenses</th><td>{{join .License}}</td></tr>{{end}}
+{{if .Groups}}<tr><th>Groups</th><td>{{join .Groups}}</td></tr>{{end}}
+{{if .Packager}}<tr><th>Packager</th><td>{{.Packager}}</td></tr>{{end}}
+{{if not .BuildDate.IsZero}}<tr><th>Built</th><td>{{date .BuildDate}} UTC</td></tr>{{end}}
+<tr><th>Package</th><td><a href="{{link $root .Download}}">{{.Filename}}</a> ({{size .CSize}}, {{size .ISize}} installed){{if .Signature}} <a href="{{link $root .Signature}}">signature</a>{{end}}</td></tr>
+{{if .SHA256Sum}}<tr><th>SHA-256</th><td><code>{{.SHA256Sum}}</code></td></tr>{{end}}
+{{if .Changelog}}<tr><th>Changelog</th><td><a href="{{$root}}{{.Changelog}}">{{.Filename}}.txt</a></td></tr>{{end}}
+{{if .Depends}}<tr><th>Depends on</th><td>{{template "deps" .Depends}}</td></tr>{{end}}
+{{if .OptDepends}}<tr><th>Optional</th><td>{{template "deps" .OptDepends}}</td></tr>{{end}}
+{{if .MakeDepends}}<tr><th>Build deps</th><td>{{template "deps" .MakeDepends}}</td></tr>{{end}}
+{{if .CheckDepends}}<tr><th>Check deps</th><td>{{template "deps" .CheckDepends}}</td></tr>{{end}}
+{{if .Provides}}<tr><th>Provides</th><td>{{join .Provides}}</td></tr>{{end}}
+{{if .Conflicts}}<tr><th>Conflicts</th><td>{{join .Conflicts}}</td></tr>{{end}}
+{{if .Replaces}}<tr><th>Replaces</th><td>{{join .Replaces}}</td></tr>{{end}}
+{{if .RequiredBy}}<tr><th>Required by</th><td>{{range $i, $r := .RequiredBy}}{{if $i}}, {{end}}<a href="{{$r}}.html">{{$r}}</a>{{end}}</td></tr>{{end}}
+</table>{{end}}
+</body></html>{{end}}
+`
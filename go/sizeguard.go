@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+)
+
+const (
+	defaultSizeWarnPercent = 20
+	// Growth below this is noise in small packages and never reported
+	sizeGuardMinGrowth = 1 << 20
+)
+
+// packageSize is the compressed (package file) and installed size of a package.
+type packageSize struct {
+	Compressed int64 `json:"compressed"`
+	Installed  int64 `json:"installed"`
+}
+
+// packageSizes returns the sizes of the given package files keyed by pkgname.
+// Unreadable packages are skipped.
+func packageSizes(files []string) map[string]packageSize {
+	sizes := map[string]packageSize{}
+	for _, f := range files {
+		info, err := pkgarchive.ReadPkgInfo(f)
+		if err != nil {
+			debugPrint("Could not read %s: %v", f, err)
+			continue
+		}
+		st, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		sizes[info.PkgName] = packageSize{Compressed: st.Size(), Installed: info.Size}
+	}
+	return sizes
+}
+
+// growth returns the growth from old to new in percent, or 0 if it is below
+// sizeGuardMinGrowth.
+func growth(old, new int64) float64 {
+	if old <= 0 || new-old < sizeGuardMinGrowth {
+		return 0
+	}
+	return float64(new-old) * 100 / float64(old)
+}
+
+// checkSizeGrowth compares package sizes with previous ones, described by
+// against (e.g. "1.2-1"), and warns about packages that grew by more than
+// size_guard.warn_percent. Growth beyond size_guard.fail_percent fails,
+// as it usually means debug symbols or vendored assets were bundled by
+// accident.
+func checkSizeGrowth(sizes, previous map[string]packageSize, against string) error {
+	warn := cfg.SizeGuard.WarnPercent
+	if warn == 0 {
+		warn = defaultSizeWarnPercent
+	}
+	fail := cfg.SizeGuard.FailPercent
+
+	var failed []string
+	for _, name := range slices.Sorted(maps.Keys(sizes)) {
+		old, ok := previous[name]
+		if !ok {
+			continue
+		}
+		cur := sizes[name]
+		for _, s := range []struct {
+			kind     string
+			old, new int64
+		}{
+			{"package", old.Compressed, cur.Compressed},
+			{"installed", old.Installed, cur.Installed},
+		} {
+			pct := growth(s.old, s.new)
+			if pct <= warn {
+				continue
+			}
+			msg := fmt.Sprintf("%s %s size grew by %.0f%% since %s (%s -> %s)", name, s.kind, pct, against, formatSize(s.old), formatSize(s.new))
+			if fail > 0 && pct > fail {
+				failed = append(failed, msg)
+				continue
+			}
+			log.Printf("Warning: %s", msg)
+		}
+	}
+	if len(failed) > 0 {
+		return &builderError{
+			Category: errArtifact,
+			Err:      fmt.Errorf("package size regression:\n  %s", strings.Join(failed, "\n  ")),
+			Hint:     "Check for unstripped binaries (options=(!strip) or debug), bundled dependencies or stray files in pkg/, or raise size_guard.fail_percent.",
+		}
+	}
+	return nil
+}
+
+// lastSuccessfulBuild returns the newest successful build of pkg for which
+// has reports true, or nil if there is none.
+func lastSuccessfulBuild(pkg string, has func(*buildRecord) bool) *buildRecord {
+	records, err := loadBuilds(func(r *buildRecord) bool {
+		return r.Package == pkg && r.Result == resultSuccess && has(r)
+	}, 1)
+	if err != nil {
+		log.Printf("Warning: could not read build history: %v", err)
+		return nil
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return records[0]
+}
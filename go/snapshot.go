@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+const (
+	snapshotsDir          = ".snapshots"
+	snapshotManifestFile  = "manifest.json"
+	defaultKeptSnapshots  = 10
+	snapshotTimeLayout    = "20060102T150405Z"
+	snapshotPreRollbackID = "pre-rollback"
+)
+
+// snapshotManifest describes the state of a repository at the time of a snapshot.
+type snapshotManifest struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Note    string    `json:"note,omitempty"`
+	// DBFiles are the database archives and signatures, relative to the repository directory
+	DBFiles []string `json:"db_files"`
+	// Packages maps package names to their package file
+	Packages map[string]string `json:"packages"`
+}
+
+// repoSnapshotsDir returns the directory holding the snapshots of the database at dbPath.
+func repoSnapshotsDir(dbPath string) string {
+	return filepath.Join(filepath.Dir(dbPath), snapshotsDir, repoName(dbPath))
+}
+
+// linkOrCopy hardlinks src to dst, copying when hardlinks are not possible.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// createSnapshot records the database and the package files it references.
+// Package files are hardlinked, so a snapshot costs almost no space and
+// survives packages being deleted from the repository.
+func createSnapshot(dbPath, note string) (*snapshotManifest, error) {
+	real, err := filepath.EvalSymlinks(dbPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	db, err := repodb.Read(real)
+	if err != nil {
+		return nil, err
+	}
+
+	created := time.Now().UTC()
+	m := &snapshotManifest{ID: created.Format(snapshotTimeLayout), Created: created, Note: note, Packages: map[string]string{}}
+	dir := filepath.Join(repoSnapshotsDir(dbPath), m.ID)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			break
+		}
+		m.ID = fmt.Sprintf("%s-%d", created.Format(snapshotTimeLayout), n)
+		dir = filepath.Join(repoSnapshotsDir(dbPath), m.ID)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create snapshot directory: %w", err)
+	}
+
+	repoDir := filepath.Dir(real)
+	link := func(name string) (bool, error) {
+		src := filepath.Join(repoDir, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			return false, nil
+		}
+		if err := linkOrCopy(src, filepath.Join(dir, name)); err != nil {
+			return false, fmt.Errorf("could not snapshot %s: %w", name, err)
+		}
+		return true, nil
+	}
+	for _, path := range []string{real, repodb.FilesPath(real)} {
+		for _, name := range []string{filepath.Base(path), filepath.Base(path) + ".sig"} {
+			ok, err := link(name)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				m.DBFiles = append(m.DBFiles, name)
+			}
+		}
+	}
+	for name, e := range db.Entries {
+		if e.Filename == "" {
+			continue
+		}
+		m.Packages[name] = e.Filename
+		for _, file := range []string{e.Filename, e.Filename + ".sig"} {
+			ok, err := link(file)
+			if err != nil {
+				return nil, err
+			}
+			if !ok && file == e.Filename {
+				log.Printf("Warning: %s is missing, the snapshot cannot restore it", file)
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, snapshotManifestFile), data, 0644); err != nil {
+		return nil, fmt.Errorf("could not write snapshot manifest: %w", err)
+	}
+	return m, nil
+}
+
+// listSnapshots returns the snapshots of the database at dbPath, oldest first.
+func listSnapshots(dbPath string) ([]*snapshotManifest, error) {
+	entries, err := os.ReadDir(repoSnapshotsDir(dbPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*snapshotManifest
+	for _, entry := range entries {
+		m, err := readSnapshot(dbPath, entry.Name())
+		if err != nil {
+			debugPrint("Skipping snapshot %s: %v", entry.Name(), err)
+			continue
+		}
+		snapshots = append(snapshots, m)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// readSnapshot loads the manifest of one snapshot.
+func readSnapshot(dbPath, id string) (*snapshotManifest, error) {
+	if id != filepath.Base(id) {
+		return nil, fmt.Errorf("invalid snapshot id %q", id)
+	}
+	data, err := os.ReadFile(filepath.Join(repoSnapshotsDir(dbPath), id, snapshotManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var m snapshotManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid snapshot manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// pruneSnapshots deletes all but the newest keep snapshots.
+func pruneSnapshots(dbPath string, keep int) error {
+	snapshots, err := listSnapshots(dbPath)
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > keep {
+		debugPrint("Deleting snapshot %s", snapshots[0].ID)
+		if err := os.RemoveAll(filepath.Join(repoSnapshotsDir(dbPath), snapshots[0].ID)); err != nil {
+			return err
+		}
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// snapshotBeforePublish takes a snapshot if enabled by --snapshot or repo.snapshot.
+func snapshotBeforePublish(dbPath string, enabled bool, note string) error {
+	if !enabled && !cfg.Repo.Snapshot {
+		return nil
+	}
+	m, err := createSnapshot(dbPath, note)
+	if err != nil {
+		return fmt.Errorf("could not snapshot %s: %w", dbPath, err)
+	}
+	if m == nil {
+		return nil
+	}
+	log.Printf("Created snapshot %s of %s (%d packages)", m.ID, dbPath, len(m.Packages))
+	keep := cfg.Repo.KeepSnapshots
+	if keep == 0 {
+		keep = defaultKeptSnapshots
+	}
+	return pruneSnapshots(dbPath, keep)
+}
+
+// rollbackSnapshot restores the database of a snapshot and any package files
+// it references that were deleted since. With prune, package files not
+// referenced by the restored database are deleted.
+func rollbackSnapshot(dbPath string, m *snapshotManifest, prune bool) error {
+	real, err := filepath.EvalSymlinks(dbPath)
+	if err != nil {
+		real = dbPath
+	}
+	repoDir := filepath.Dir(real)
+	dir := filepath.Join(repoSnapshotsDir(dbPath), m.ID)
+
+	wanted := map[string]bool{}
+	for _, file := range m.Packages {
+		wanted[file], wanted[file+".sig"] = true, true
+		for _, name := range []string{file, file + ".sig"} {
+			dst := filepath.Join(repoDir, name)
+			if _, err := os.Stat(dst); err == nil {
+				continue
+			}
+			src := filepath.Join(dir, name)
+			if _, err := os.Stat(src); err != nil {
+				continue
+			}
+			if err := linkOrCopy(src, dst); err != nil {
+				return fmt.Errorf("could not restore %s: %w", name, err)
+			}
+			log.Printf("  Restored: %s", name)
+		}
+	}
+
+	// Replace the database archives atomically; drop signatures the snapshot did not have
+	for _, path := range []string{real, repodb.FilesPath(real)} {
+		for _, name := range []string{filepath.Base(path), filepath.Base(path) + ".sig"} {
+			dst := filepath.Join(repoDir, name)
+			src := filepath.Join(dir, name)
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				os.Remove(dst)
+				continue
+			}
+			tmp := dst + ".tmp-rollback"
+			os.Remove(tmp)
+			if err := linkOrCopy(src, tmp); err != nil {
+				return fmt.Errorf("could not restore %s: %w", name, err)
+			}
+			if err := os.Rename(tmp, dst); err != nil {
+				return fmt.Errorf("could not restore %s: %w", name, err)
+			}
+		}
+	}
+
+	if prune {
+		entries, err := os.ReadDir(repoDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if name := entry.Name(); entry.Type().IsRegular() && isPackageFile(name) && !wanted[name] {
+				if err := os.Remove(filepath.Join(repoDir, name)); err == nil {
+					log.Printf("  Removed: %s", name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// newRepoSnapshotCmds creates the 'repo snapshot', 'repo snapshots' and 'repo rollback' commands.
+func newRepoSnapshotCmds() []*cobra.Command {
+	var note string
+	snapshotCmd := &cobra.Command{
+		Use:   "snapshot <db>",
+		Short: "Records the database and package set so they can be restored with 'repo rollback'.",
+		Long: `Saves the database, files database, signatures and hardlinks of all package
+files in <repo dir>/.snapshots/<repo>/<id>/. Set repo.snapshot (or pass
+--snapshot to add/remove) to take one automatically before every publish;
+repo.keep_snapshots limits how many are kept.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbPath := repoDBPath(args[0])
+			lock, err := lockRepoDB(cmd.Context(), dbPath)
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			defer lock.unlock()
+			m, err := createSnapshot(dbPath, note)
+			if err != nil {
+				return errorf(errPublish, "could not snapshot %s: %w", dbPath, err)
+			}
+			if m == nil {
+				return errorf(errPublish, "repository database %s does not exist", dbPath)
+			}
+			log.Printf("Created snapshot %s of %s (%d packages)", m.ID, dbPath, len(m.Packages))
+			fmt.Println(m.ID)
+			return nil
+		},
+	}
+	snapshotCmd.Flags().StringVar(&note, "note", "", "Description stored with the snapshot")
+
+	listCmd := &cobra.Command{
+		Use:   "snapshots <db>",
+		Short: "Lists the snapshots of a repository database.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			snapshots, err := listSnapshots(repoDBPath(args[0]))
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			if len(snapshots) == 0 {
+				log.Printf("No snapshots of %s.", args[0])
+				return nil
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tCREATED\tPACKAGES\tNOTE")
+			for _, m := range snapshots {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", m.ID, m.Created.Local().Format(time.DateTime), len(m.Packages), m.Note)
+			}
+			w.Flush()
+			return nil
+		},
+	}
+
+	var prune bool
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback <db> <snapshot-id>",
+		Short: "Restores a repository database and its packages from a snapshot.",
+		Long: `Restores the database of a snapshot and any package files it references that
+were deleted since. The current state is saved as a snapshot first, so a
+rollback can itself be undone. With --prune, package files that the restored
+database does not reference are deleted.`,
+		Args: cobra.ExactArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) != 1 {
+				return nil, cobra.ShellCompDirectiveDefault
+			}
+			snapshots, _ := listSnapshots(repoDBPath(args[0]))
+			var ids []string
+			for _, m := range snapshots {
+				ids = append(ids, m.ID)
+			}
+			return ids, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dbPath, id := repoDBPath(args[0]), args[1]
+			lock, err := lockRepoDB(cmd.Context(), dbPath)
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			defer lock.unlock()
+			m, err := readSnapshot(dbPath, id)
+			if err != nil {
+				return errorf(errPublish, "could not read snapshot %s: %w", id, err)
+			}
+			current, err := createSnapshot(dbPath, snapshotPreRollbackID+" to "+id)
+			if err != nil {
+				return errorf(errPublish, "could not snapshot the current state: %w", err)
+			}
+			if current != nil {
+				log.Printf("Saved the current state as snapshot %s", current.ID)
+			}
+			if err := rollbackSnapshot(dbPath, m, prune); err != nil {
+				return errorf(errPublish, "rollback failed: %w", err)
+			}
+			log.Printf("Repository database %s rolled back to %s (%d packages).", dbPath, id, len(m.Packages))
+			return mirrorRepoDir(cmd.Context(), dbPath)
+		},
+	}
+	rollbackCmd.Flags().BoolVar(&prune, "prune", false, "Delete package files not referenced by the restored database")
+
+	return []*cobra.Command{snapshotCmd, listCmd, rollbackCmd}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/pkgarchive"
+	"gitlab.com/crystalnetwork-studio/dev-tooling/docker/pkgbuild-archlinux/pkg/repodb"
+)
+
+// sonameInfo holds the sonames a built package provides and requires.
+type sonameInfo struct {
+	PkgName  string
+	File     string
+	Provides []string
+	Requires []string
+}
+
+// pacmanSoname converts an ELF soname into the form makepkg records in
+// provides/depends, e.g. libfoo.so.1 on x86_64 becomes libfoo.so=1-64.
+// Unversioned sonames are returned unchanged.
+func pacmanSoname(soname string, class elf.Class) string {
+	idx := strings.Index(soname, ".so.")
+	if idx < 0 {
+		return soname
+	}
+	bits := "64"
+	if class == elf.ELFCLASS32 {
+		bits = "32"
+	}
+	return fmt.Sprintf("%s=%s-%s", soname[:idx+3], soname[idx+4:], bits)
+}
+
+// scanPackageSonames reads a package archive and collects the sonames of its ELF files.
+func scanPackageSonames(pkgFile string) (*sonameInfo, error) {
+	info, err := pkgarchive.ReadPkgInfo(pkgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	provides := map[string]bool{}
+	requires := map[string]bool{}
+	err = pkgarchive.Walk(pkgFile, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Typeflag != tar.TypeReg || hdr.Size < 4 {
+			return nil
+		}
+		br := bufio.NewReader(r)
+		if magic, err := br.Peek(4); err != nil || !bytes.Equal(magic, []byte(elf.ELFMAG)) {
+			return nil
+		}
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return fmt.Errorf("could not read %s from %s: %w", hdr.Name, pkgFile, err)
+		}
+		f, err := elf.NewFile(bytes.NewReader(data))
+		if err != nil {
+			debugPrint("Skipping malformed ELF file %s: %v", hdr.Name, err)
+			return nil
+		}
+		defer f.Close()
+
+		if sonames, err := f.DynString(elf.DT_SONAME); err == nil {
+			for _, s := range sonames {
+				debugPrint("%s provides %s", hdr.Name, s)
+				provides[pacmanSoname(s, f.Class)] = true
+			}
+		}
+		if needed, err := f.ImportedLibraries(); err == nil {
+			for _, s := range needed {
+				requires[pacmanSoname(s, f.Class)] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not scan %s: %w", pkgFile, err)
+	}
+
+	// A package linking against its own libraries does not require them externally
+	for s := range provides {
+		delete(requires, s)
+	}
+
+	return &sonameInfo{
+		PkgName:  info.PkgName,
+		File:     pkgFile,
+		Provides: sortedKeys(provides),
+		Requires: sortedKeys(requires),
+	}, nil
+}
+
+// sortedKeys returns the keys of a string set in sorted order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// depName strips any version constraint from a dependency string.
+func depName(dep string) string {
+	if idx := strings.IndexAny(dep, "<>="); idx >= 0 {
+		return dep[:idx]
+	}
+	return dep
+}
+
+// rebuildImpact returns, for every repo package, the sonames it depends on that
+// the new packages no longer provide compared to the versions in the database.
+func rebuildImpact(built []*sonameInfo, db *repodb.DB) map[string][]string {
+	newProvides := map[string]bool{}
+	newNames := map[string]bool{}
+	builtNames := map[string]bool{}
+	for _, info := range built {
+		builtNames[info.PkgName] = true
+		for _, s := range info.Provides {
+			newProvides[s] = true
+			newNames[depName(s)] = true
+		}
+	}
+
+	// Sonames that the previous versions provided but the new builds do not
+	removed := map[string]bool{}
+	for name := range builtNames {
+		old, ok := db.Entries[name]
+		if !ok {
+			continue
+		}
+		for _, p := range old.Provides {
+			if strings.Contains(depName(p), ".so") && !newProvides[p] {
+				removed[p] = true
+			}
+		}
+	}
+
+	impact := map[string][]string{}
+	if len(removed) == 0 {
+		return impact
+	}
+	for name, entry := range db.Entries {
+		if builtNames[name] {
+			continue
+		}
+		for _, dep := range entry.Depends {
+			broken := removed[dep]
+			// Unversioned soname dependencies still resolve if the library keeps the name
+			if !broken && dep == depName(dep) && !newNames[dep] {
+				for r := range removed {
+					if depName(r) == dep {
+						broken = true
+						break
+					}
+				}
+			}
+			if broken {
+				impact[name] = append(impact[name], dep)
+			}
+		}
+	}
+	return impact
+}
+
+// newSonamesCmd creates the 'sonames' command.
+func newSonamesCmd() *cobra.Command {
+	var repoDB string
+	cmd := &cobra.Command{
+		Use:   "sonames [package files...]",
+		Short: "Lists provided/required sonames of built packages and their rebuild impact.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			packageFiles := args
+			if len(packageFiles) == 0 {
+				packageFiles = builtPackages(".")
+			}
+			if len(packageFiles) == 0 {
+				return errorf(errArtifact, "no package files (*.pkg.tar.*) found to analyze")
+			}
+			sort.Strings(packageFiles)
+
+			var built []*sonameInfo
+			for _, f := range packageFiles {
+				if strings.HasSuffix(f, ".sig") {
+					continue
+				}
+				info, err := scanPackageSonames(f)
+				if err != nil {
+					return errorf(errArtifact, "%w", err)
+				}
+				built = append(built, info)
+
+				fmt.Printf("%s (%s)\n", info.PkgName, filepath.Base(info.File))
+				fmt.Printf("  provides: %s\n", strings.Join(info.Provides, " "))
+				fmt.Printf("  requires: %s\n", strings.Join(info.Requires, " "))
+			}
+
+			if repoDB == "" {
+				return nil
+			}
+
+			db, err := repodb.Read(repoDB)
+			if err != nil {
+				return errorf(errPublish, "%w", err)
+			}
+			impact := rebuildImpact(built, db)
+			if len(impact) == 0 {
+				log.Println("No repository packages need rebuilding.")
+				return nil
+			}
+
+			names := make([]string, 0, len(impact))
+			for name := range impact {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			log.Printf("%d repository package(s) need rebuilding:", len(names))
+			for _, name := range names {
+				fmt.Printf("%s: %s\n", name, strings.Join(impact[name], " "))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&repoDB, "db", "", "Repository database (e.g. repo.db.tar.gz) to compute rebuild impact against")
+	return cmd
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// vendorSumsFile records the SHA-256 of every vendored source of a package.
+const vendorSumsFile = "SHA256SUMS"
+
+// sourceDownloads returns the download jobs for the remote sources of info, stored in destDir.
+func sourceDownloads(info *pkgbuildInfo, fc fetchConfig, destDir string) []downloadJob {
+	entries, sums := pkgbuildSources(info, carch())
+	var downloads []downloadJob
+	for i, e := range entries {
+		downloads = append(downloads, downloadJob{
+			Name:      e.Name,
+			URLs:      sourceURLs(e.URL, fc),
+			Dest:      filepath.Join(destDir, e.Name),
+			Checksums: sums[i],
+		})
+	}
+	return downloads
+}
+
+// readVendorSums parses the SHA256SUMS file of a vendored package directory.
+func readVendorSums(dir string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(dir, vendorSumsFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if sum, name, ok := strings.Cut(scanner.Text(), "  "); ok {
+			sums[name] = sum
+		}
+	}
+	return sums, scanner.Err()
+}
+
+// writeVendorSums records the checksums of the given files in dir, hashing
+// them concurrently. It is also used for the collected build artifacts.
+func writeVendorSums(dir string, names []string) error {
+	sort.Strings(names)
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(dir, name)
+	}
+	sums := hashFiles(paths, defaultJobs)
+	var b strings.Builder
+	for _, name := range names {
+		sum, ok := sums[name]
+		if !ok {
+			return fmt.Errorf("could not hash %s", name)
+		}
+		fmt.Fprintf(&b, "%s  %s\n", sum, name)
+	}
+	return os.WriteFile(filepath.Join(dir, vendorSumsFile), []byte(b.String()), 0644)
+}
+
+// useVendoredSources copies the sources of info found in the vendor mirror
+// into destDir, so they are not downloaded again. Files that do not match the
+// recorded checksums are skipped. It returns the names that were copied.
+func useVendoredSources(vendorDir string, info *pkgbuildInfo, destDir string) ([]string, error) {
+	dir := filepath.Join(vendorDir, info.PkgName)
+	sums, err := readVendorSums(dir)
+	if os.IsNotExist(err) {
+		debugPrint("No vendored sources for %s in %s", info.PkgName, vendorDir)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read vendored checksums: %w", err)
+	}
+
+	var used []string
+	entries, _ := pkgbuildSources(info, carch())
+	for _, e := range entries {
+		want, ok := sums[e.Name]
+		if !ok {
+			continue
+		}
+		dest := filepath.Join(destDir, e.Name)
+		if sum, err := sha256File(dest); err == nil && sum == want {
+			continue
+		}
+		src := filepath.Join(dir, e.Name)
+		if sum, err := sha256File(src); err != nil || sum != want {
+			log.Printf("Warning: vendored %s does not match %s, ignoring it", src, vendorSumsFile)
+			continue
+		}
+		if err := copyFile(src, dest); err != nil {
+			return used, fmt.Errorf("could not copy vendored source %s: %w", e.Name, err)
+		}
+		log.Printf("  Using vendored: %s", e.Name)
+		used = append(used, e.Name)
+	}
+	return used, nil
+}
+
+// primeVendoredSources copies vendored sources of the PKGBUILD in the current
+// directory to where makepkg looks for them ($SRCDEST or the current directory).
+func primeVendoredSources(vendorDir string) error {
+	info, err := parsePKGBUILD("PKGBUILD")
+	if err != nil {
+		return err
+	}
+	destDir := os.Getenv("SRCDEST")
+	if destDir == "" {
+		destDir = "."
+	}
+	_, err = useVendoredSources(vendorDir, info, destDir)
+	return err
+}
+
+// vendorSources downloads all remote sources of info into <vendorDir>/<pkgname>
+// and records their checksums.
+func vendorSources(ctx context.Context, info *pkgbuildInfo, vendorDir string, d *downloader) (int, error) {
+	dir := filepath.Join(vendorDir, info.PkgName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, fmt.Errorf("could not create vendor directory: %w", err)
+	}
+	downloads := sourceDownloads(info, cfg.Fetch, dir)
+	if len(downloads) == 0 {
+		return 0, nil
+	}
+	// Concurrent jobs vendoring the same package both rewrite SHA256SUMS
+	lock, err := lockFile(ctx, filepath.Join(dir, vendorSumsFile+".lock"), dir)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.unlock()
+	if err := d.run(ctx, downloads); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, job := range downloads {
+		names = append(names, job.Name)
+	}
+	// Keep sources vendored for older versions recorded as well
+	if old, err := readVendorSums(dir); err == nil {
+		for name := range old {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	if err := writeVendorSums(dir, names); err != nil {
+		return 0, fmt.Errorf("could not write %s: %w", vendorSumsFile, err)
+	}
+	return len(downloads), nil
+}
+
+// newSourcesCmd creates the 'sources' command.
+func newSourcesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sources",
+		Short: "Manages a local mirror of package sources.",
+	}
+
+	var dest string
+	var jobs int
+	vendorCmd := &cobra.Command{
+		Use:   "vendor [package-dir...]",
+		Short: "Downloads all sources into a project-local mirror with checksums.",
+		Long: `Downloads the remote sources of each package directory (default: the current
+directory) into <dest>/<pkgname>/ and records their SHA-256 in SHA256SUMS.
+'builder fetch' and 'builder build' with --vendor-dir (or fetch.vendor_dir)
+then prefer these copies over upstream, so disappearing tarballs do not break
+rebuilds. Commit the directory or sync it to object storage.`,
+		ValidArgsFunction: completePackageDirs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				args = []string{"."}
+			}
+			absDest, err := filepath.Abs(dest)
+			if err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+			rate, err := parseRate(cfg.Fetch.LimitRate)
+			if err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+			retries := 3
+			if cfg.Fetch.Retries > 0 {
+				retries = cfg.Fetch.Retries
+			}
+			d := &downloader{client: httpClient(), jobs: jobs, retries: retries, limiter: &rateLimiter{rate: rate}}
+			for _, dir := range args {
+				info, err := parsePKGBUILD(filepath.Join(dir, "PKGBUILD"))
+				if err != nil {
+					return errorf(errParse, "%s: %w", dir, err)
+				}
+				log.Printf("Vendoring sources of %s...", info.PkgName)
+				n, err := vendorSources(cmd.Context(), info, absDest, d)
+				if err != nil {
+					return errorf(errDependency, "could not vendor sources of %s:\n%w", info.PkgName, err)
+				}
+				log.Printf("  Vendored %d source(s) into %s", n, filepath.Join(dest, info.PkgName))
+			}
+			return nil
+		},
+	}
+	vendorCmd.Flags().StringVar(&dest, "dest", "sources", "Directory of the source mirror")
+	vendorCmd.Flags().IntVarP(&jobs, "jobs", "j", 4, "Number of parallel downloads")
+
+	cmd.AddCommand(vendorCmd)
+	return cmd
+}
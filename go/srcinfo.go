@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// srcinfoCacheVersion is part of the cache key of checked directories; bump
+// it whenever the comparison changes.
+const srcinfoCacheVersion = "1"
+
+// generateSrcinfo returns the .SRCINFO makepkg generates for the PKGBUILD
+// in dir, in the sandbox of evaluateCommand.
+func generateSrcinfo(ctx context.Context, dir string) (string, error) {
+	cmd, err := evaluateCommand(ctx, dir, "makepkg", "--printsrcinfo")
+	if err != nil {
+		return "", err
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("makepkg --printsrcinfo failed: %w", err)
+	}
+	return string(out), nil
+}
+
+// srcinfoLines returns the significant lines of a .SRCINFO, ignoring
+// whitespace at the line ends and blank lines.
+func srcinfoLines(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimRight(line, " \t\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// diffSrcinfo lists the lines only the committed (-) or the generated (+)
+// .SRCINFO contains.
+func diffSrcinfo(committed, generated string) []string {
+	have, want := srcinfoLines(committed), srcinfoLines(generated)
+	if slices.Equal(have, want) {
+		return nil
+	}
+	var diff []string
+	for _, line := range have {
+		if !slices.Contains(want, line) {
+			diff = append(diff, "- "+strings.TrimSpace(line))
+		}
+	}
+	for _, line := range want {
+		if !slices.Contains(have, line) {
+			diff = append(diff, "+ "+strings.TrimSpace(line))
+		}
+	}
+	if len(diff) == 0 {
+		diff = append(diff, "(same lines in a different order)")
+	}
+	return diff
+}
+
+// srcinfoCacheKey identifies the state of a package directory whose .SRCINFO
+// was found up to date, so unchanged packages are not checked again.
+func srcinfoCacheKey(dir string) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(srcinfoCacheVersion + "\n"))
+	for _, name := range []string{"PKGBUILD", ".SRCINFO"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d\n", name, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkSrcinfo compares the committed .SRCINFO in dir with the generated one
+// and returns the differences.
+func checkSrcinfo(ctx context.Context, dir string, useCache bool) ([]string, error) {
+	committed, err := os.ReadFile(filepath.Join(dir, ".SRCINFO"))
+	if os.IsNotExist(err) {
+		return []string{".SRCINFO is missing"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var marker string
+	if useCache {
+		if key, err := srcinfoCacheKey(dir); err == nil {
+			marker = filepath.Join(cacheDir(), "srcinfo", key)
+			if _, err := os.Stat(marker); err == nil {
+				debugPrint("%s: unchanged since the last check", dir)
+				return nil, nil
+			}
+		}
+	}
+	generated, err := generateSrcinfo(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	diff := diffSrcinfo(string(committed), generated)
+	if len(diff) == 0 && marker != "" {
+		if err := os.MkdirAll(filepath.Dir(marker), 0755); err == nil {
+			os.WriteFile(marker, nil, 0644)
+		}
+	}
+	return diff, nil
+}
+
+// newCheckSrcinfoCmd creates the 'check-srcinfo' command.
+func newCheckSrcinfoCmd() *cobra.Command {
+	var workspace, base, selection string
+	var changed, noCache bool
+	cmd := &cobra.Command{
+		Use:   "check-srcinfo [<dir>...]",
+		Short: "Fails if a committed .SRCINFO is out of sync with its PKGBUILD.",
+		Long: `Regenerates the metadata of each PKGBUILD with makepkg --printsrcinfo and fails
+if the committed .SRCINFO differs, as the AUR requires them to match. The
+directories default to the current one; --workspace checks every package below
+it, with --changed only those with files changed since --base (see
+generate-pipeline). Packages whose PKGBUILD and .SRCINFO were found in sync
+before are not checked again unless --no-cache is given.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dirs := args
+			if workspace != "" {
+				infos, err := workspacePKGBUILDs(workspace)
+				if err != nil {
+					return errorf(errGeneral, "could not scan workspace %s: %w", workspace, err)
+				}
+				var files []string
+				if changed {
+					if files, err = changedFiles(cmd.Context(), workspace, base); err != nil {
+						return errorf(errGeneral, "%w", err)
+					}
+				}
+				for _, dir := range slices.Sorted(maps.Keys(infos)) {
+					rel, _ := filepath.Rel(workspace, dir)
+					if changed && !slices.ContainsFunc(files, func(f string) bool { return rel == "." || strings.HasPrefix(f, rel+"/") }) {
+						continue
+					}
+					dirs = append(dirs, dir)
+				}
+			}
+			if len(dirs) == 0 && workspace == "" {
+				dirs = []string{"."}
+			}
+			dirs, err := selectDirs(selection, dirs)
+			if err != nil {
+				return err
+			}
+
+			var outOfSync []string
+			for _, dir := range dirs {
+				diff, err := checkSrcinfo(cmd.Context(), dir, !noCache)
+				var be *builderError
+				if errors.As(err, &be) {
+					// e.g. sandbox.mode require without bwrap
+					return err
+				} else if err != nil {
+					return errorf(errParse, "%s: %w", dir, err)
+				}
+				if len(diff) == 0 {
+					log.Printf("  In sync: %s", dir)
+					continue
+				}
+				log.Printf("  Out of sync: %s\n    %s", dir, strings.Join(diff, "\n    "))
+				outOfSync = append(outOfSync, dir)
+			}
+			if len(outOfSync) > 0 {
+				return &builderError{
+					Category: errParse,
+					Err:      fmt.Errorf(".SRCINFO out of sync with the PKGBUILD in %s", strings.Join(outOfSync, ", ")),
+					Hint:     "Regenerate it with 'makepkg --printsrcinfo > .SRCINFO' and commit it together with the PKGBUILD.",
+				}
+			}
+			log.Printf("%d .SRCINFO file(s) in sync.", len(dirs))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&workspace, "workspace", "", "Check every package below this directory")
+	cmd.Flags().BoolVar(&changed, "changed", false, "With --workspace, check only packages with files changed since --base")
+	cmd.Flags().StringVar(&base, "base", "", "Revision to detect changes against (default: merge request diff base or previous commit)")
+	cmd.Flags().BoolVar(&noCache, "no-cache", false, "Check packages found in sync before again")
+	cmd.Flags().StringVar(&selection, "select", "", selectUsage)
+	return cmd
+}
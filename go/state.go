@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Build results stored in the history.
+const (
+	resultSuccess   = "success"
+	resultFailed    = "failed"
+	resultCancelled = "cancelled"
+	resultSkipped   = "skipped"
+)
+
+var buildsBucket = []byte("builds")
+
+// stateDBPath is the location of the build history database.
+var stateDBPath string
+
+// buildRecord is a single build stored in the history database.
+type buildRecord struct {
+	ID          uint64            `json:"id"`
+	Package     string            `json:"package"`
+	Variant     string            `json:"variant,omitempty"`
+	March       string            `json:"march,omitempty"`
+	Version     string            `json:"version"`
+	Fingerprint string            `json:"fingerprint"`
+	StartedAt   time.Time         `json:"started_at"`
+	Duration    time.Duration     `json:"duration"`
+	LockWait    time.Duration     `json:"lock_wait,omitempty"`
+	Result      string            `json:"result"`
+	Artifacts   map[string]string `json:"artifacts,omitempty"`
+	// Sizes of the built packages keyed by pkgname, see checkSizeGrowth
+	Sizes map[string]packageSize `json:"sizes,omitempty"`
+	// Depends are the runtime dependencies of the built packages by pkgname
+	Depends  map[string][]string `json:"depends,omitempty"`
+	Analysis *logAnalysis        `json:"analysis,omitempty"`
+	// Footprint is the installed size with the dependency closure by
+	// pkgname, see dependencyFootprints
+	Footprint map[string]*dependencyFootprint `json:"footprint,omitempty"`
+	// BuildDirUsed is the space a build in a tmpfs used, see --builddir
+	BuildDirUsed int64 `json:"build_dir_used,omitempty"`
+	// Toolchains are the versions of the pinned toolchains, see toolchain
+	Toolchains map[string]string `json:"toolchains,omitempty"`
+	// Cache holds the sccache statistics of the build, see stopSccache
+	Cache *compilerCacheStats `json:"cache,omitempty"`
+	// Distributed is the job distribution of build.distcc
+	Distributed *distributedStats `json:"distributed,omitempty"`
+	// Job is the coordinator job of a build made by a worker
+	Job string `json:"job,omitempty"`
+	// Audit is what the build touched outside of its directory, see --audit
+	Audit *buildAudit `json:"audit,omitempty"`
+	// BuildIDs are the build IDs of the uploaded debug symbols by -debug
+	// package name, see publishDebugInfo
+	BuildIDs map[string][]string `json:"build_ids,omitempty"`
+	// CachedFrom is the build cache key the packages were downloaded from
+	CachedFrom string `json:"cached_from,omitempty"`
+	// Maintainers of the package, see packageMaintainers
+	Maintainers []string `json:"maintainers,omitempty"`
+	// Environment is what the build ran with, see captureEnvironment
+	Environment *buildEnvironment `json:"environment,omitempty"`
+}
+
+// defaultStateDBPath returns $BUILDER_STATE_DB or a history.db in the XDG state directory.
+func defaultStateDBPath() string {
+	if path := os.Getenv("BUILDER_STATE_DB"); path != "" {
+		return path
+	}
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = os.TempDir()
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateHome, "builder", "history.db")
+}
+
+// openStateDB opens (creating if needed) the build history database.
+func openStateDB() (*bolt.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(stateDBPath), 0755); err != nil {
+		return nil, fmt.Errorf("could not create state directory: %w", err)
+	}
+	db, err := bolt.Open(stateDBPath, 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open state database %s: %w", stateDBPath, err)
+	}
+	return db, nil
+}
+
+// recordBuild appends a build record to the history database.
+func recordBuild(rec *buildRecord) error {
+	db, err := openStateDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(buildsBucket)
+		if err != nil {
+			return err
+		}
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		rec.ID = id
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, id)
+		return b.Put(key, data)
+	})
+}
+
+// loadBuilds returns the recorded builds matching filter, newest first.
+// A limit of zero returns all matches.
+func loadBuilds(filter func(*buildRecord) bool, limit int) ([]*buildRecord, error) {
+	if _, err := os.Stat(stateDBPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	db, err := openStateDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var records []*buildRecord
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(buildsBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			rec := &buildRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return fmt.Errorf("corrupt build record %x: %w", k, err)
+			}
+			if filter != nil && !filter(rec) {
+				continue
+			}
+			records = append(records, rec)
+			if limit > 0 && len(records) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+// sha256File returns the hex encoded SHA-256 of a file.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprintFiles lists the inputs of the build in the current directory:
+// the git-tracked files when inside a repository, otherwise just the PKGBUILD.
+func fingerprintFiles() []string {
+	cmd := newCommand(context.Background(), "git", "ls-files", "-z", "--", ".")
+	cmd.Stderr = nil
+	out, err := cmd.Output()
+	if err != nil || len(out) == 0 {
+		return []string{"PKGBUILD"}
+	}
+	var files []string
+	for _, f := range strings.Split(strings.TrimRight(string(out), "\x00"), "\x00") {
+		if info, err := os.Stat(f); err == nil && info.Mode().IsRegular() {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// buildFingerprint hashes the build inputs so identical builds can be recognized.
+func buildFingerprint() (string, error) {
+	h := sha256.New()
+	for _, f := range fingerprintFiles() {
+		sum, err := sha256File(f)
+		if err != nil {
+			return "", fmt.Errorf("could not fingerprint %s: %w", f, err)
+		}
+		fmt.Fprintf(h, "%s %s\n", sum, filepath.ToSlash(f))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// artifactChecksums returns the SHA-256 of every given file, keyed by base name.
+func artifactChecksums(files []string) map[string]string {
+	return hashFiles(files, defaultJobs)
+}
+
+// startBuildRecord prepares a history record for building the PKGBUILD in the current directory.
+func startBuildRecord() *buildRecord {
+	rec := &buildRecord{StartedAt: time.Now().UTC()}
+	if info, err := parsePKGBUILD("PKGBUILD"); err == nil {
+		rec.Package = info.PkgName
+		rec.Version = info.PkgVer + "-" + info.PkgRel
+	} else if wd, err := os.Getwd(); err == nil {
+		rec.Package = filepath.Base(wd)
+	}
+	rec.Maintainers = packageMaintainers(".")
+	if fp, err := buildFingerprint(); err == nil {
+		rec.Fingerprint = fp
+	} else {
+		log.Printf("Warning: could not compute build fingerprint: %v", err)
+	}
+	return rec
+}
+
+// finishBuildRecord stores the outcome of a build. Failing to write the
+// history never fails the build itself.
+func finishBuildRecord(rec *buildRecord, result string, packageFiles []string) {
+	rec.Duration = time.Since(rec.StartedAt)
+	rec.LockWait = lockWaitTime()
+	rec.Result = result
+	rec.Artifacts = artifactChecksums(packageFiles)
+	if err := recordBuild(rec); err != nil {
+		log.Printf("Warning: could not record build history: %v", err)
+		return
+	}
+	debugPrint("Recorded build #%d in %s", rec.ID, stateDBPath)
+}
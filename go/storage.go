@@ -0,0 +1,741 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// storage is a destination repositories, published files and caches are
+// stored in, configured in the storage section. Names are slash-separated
+// paths relative to the storage's root.
+type storage interface {
+	// Put uploads the local file to name, replacing it.
+	Put(ctx context.Context, name, local string) error
+	// Get downloads name to the local file; errors wrap fs.ErrNotExist when
+	// name is not stored.
+	Get(ctx context.Context, name, local string) error
+	// Delete removes name, if it is stored.
+	Delete(ctx context.Context, name string) error
+	// Close releases what the storage holds, such as credentials on disk.
+	Close() error
+	String() string
+}
+
+// openStorage connects to the storage of the given name.
+func openStorage(name string) (storage, error) {
+	sc, ok := cfg.Storage[name]
+	if !ok {
+		return nil, errorf(errConfig, "storage %q is not configured (storage: %s)", name, strings.Join(slices.Sorted(maps.Keys(cfg.Storage)), ", "))
+	}
+	st, err := newStorage(sc)
+	if err != nil {
+		return nil, errorf(errConfig, "storage %s: %w", name, err)
+	}
+	return st, nil
+}
+
+// storageSchemes are the URL schemes of the storage backends.
+var storageSchemes = []string{"file", "s3", "ssh", "gitlab+https", "gitlab+http", "webdav+https", "webdav+http"}
+
+// parseStorageURL checks a storage URL; plain paths are local directories
+// and return nil.
+func parseStorageURL(raw string) (*url.URL, error) {
+	scheme, _, ok := strings.Cut(raw, "://")
+	if !ok {
+		return nil, nil
+	}
+	if !slices.Contains(storageSchemes, scheme) {
+		return nil, fmt.Errorf("unsupported storage URL %s: use a path, file://, s3://, ssh://, gitlab+https:// or webdav+https://", raw)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case scheme != "file" && u.Host == "":
+		return nil, fmt.Errorf("%s has no host", raw)
+	case scheme == "ssh" && u.Path == "":
+		return nil, fmt.Errorf("%s must be ssh://[user@]host[:port]/<dir>", raw)
+	case strings.HasPrefix(scheme, "gitlab+") && !strings.Contains(u.Path, "/packages/generic/"):
+		return nil, fmt.Errorf("%s is not a generic package URL (.../api/v4/projects/<id>/packages/generic/<package>/<version>)", raw)
+	case u.User != nil && strings.HasPrefix(scheme, "webdav+"):
+		if _, ok := u.User.Password(); ok {
+			return nil, fmt.Errorf("%s contains a password: set the webdav-password secret instead", u.Redacted())
+		}
+	}
+	return u, nil
+}
+
+// newStorage returns the backend of a storage URL.
+func newStorage(sc storageConfig) (storage, error) {
+	u, err := parseStorageURL(sc.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return &localStorage{dir: sc.URL}, nil
+	}
+	switch u.Scheme {
+	case "file":
+		return &localStorage{dir: u.Path}, nil
+	case "s3":
+		return newS3Storage(u, sc)
+	case "ssh":
+		return newSSHStorage(u)
+	case "gitlab+https", "gitlab+http":
+		return newGitLabStorage(u)
+	case "webdav+https", "webdav+http":
+		return newWebDAVStorage(u)
+	}
+	return nil, fmt.Errorf("unsupported storage URL %s", sc.URL)
+}
+
+// checkStorageName rejects names escaping the storage root.
+func checkStorageName(name string) error {
+	if name == "" || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return fmt.Errorf("invalid storage path %q", name)
+	}
+	return nil
+}
+
+// localStorage stores files in a local directory, e.g. a mounted share.
+type localStorage struct {
+	dir string
+}
+
+func (s *localStorage) String() string { return s.dir }
+func (s *localStorage) Close() error   { return nil }
+
+func (s *localStorage) Put(ctx context.Context, name, local string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	dest := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	// Readers of the directory never see partial files
+	tmp := dest + ".part"
+	if err := copyFile(local, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+func (s *localStorage) Get(ctx context.Context, name, local string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	return copyFile(filepath.Join(s.dir, filepath.FromSlash(name)), local)
+}
+
+func (s *localStorage) Delete(ctx context.Context, name string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(name))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// httpStorage implements Put, Get and Delete for HTTP backends, which sign
+// or authenticate each request with auth.
+type httpStorage struct {
+	// objectURL returns the URL of a stored name
+	objectURL func(name string) string
+	auth      func(req *http.Request) error
+	// flat backends store no directories
+	flat bool
+}
+
+func (s *httpStorage) do(ctx context.Context, method, name string, body *os.File, header http.Header) (*http.Response, error) {
+	if err := checkStorageName(name); err != nil {
+		return nil, err
+	}
+	if s.flat && strings.Contains(name, "/") {
+		return nil, fmt.Errorf("cannot store %s: %s stores no directories", name, s.objectURL(""))
+	}
+	return s.send(ctx, method, s.objectURL(name), name, body, header)
+}
+
+// send requests target, which is named name in errors.
+func (s *httpStorage) send(ctx context.Context, method, target, name string, body *os.File, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		info, err := body.Stat()
+		if err != nil {
+			return nil, err
+		}
+		req.Body, req.ContentLength = io.NopCloser(body), info.Size()
+		req.GetBody = func() (io.ReadCloser, error) {
+			_, err := body.Seek(0, io.SeekStart)
+			return io.NopCloser(body), err
+		}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("User-Agent", "builder/"+version)
+	if err := s.auth(req); err != nil {
+		return nil, err
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &storageHTTPError{method, name, resp.StatusCode, resp.Status, strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
+
+// storageHTTPError is an unsuccessful response of an HTTP storage.
+type storageHTTPError struct {
+	Method, Name string
+	StatusCode   int
+	Status, Body string
+}
+
+func (e *storageHTTPError) Error() string {
+	return fmt.Sprintf("%s %s: HTTP %s: %s", e.Method, e.Name, e.Status, e.Body)
+}
+
+// Unwrap makes missing files match fs.ErrNotExist.
+func (e *storageHTTPError) Unwrap() error {
+	if e.StatusCode == http.StatusNotFound {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+func (s *httpStorage) Put(ctx context.Context, name, local string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resp, err := s.do(ctx, http.MethodPut, name, f, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *httpStorage) Get(ctx context.Context, name, local string) error {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(local)
+		return err
+	}
+	return f.Close()
+}
+
+func (s *httpStorage) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *httpStorage) Close() error { return nil }
+
+// s3Storage stores objects below a prefix of an S3 bucket, signing requests
+// with AWS Signature Version 4.
+type s3Storage struct {
+	httpStorage
+	bucket, prefix, region string
+	accessKey, secretKey   string
+}
+
+func (s *s3Storage) String() string { return "s3://" + path.Join(s.bucket, s.prefix) }
+
+func newS3Storage(u *url.URL, sc storageConfig) (*s3Storage, error) {
+	s := &s3Storage{bucket: u.Host, prefix: strings.Trim(u.Path, "/"), region: sc.Region}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	var err error
+	if s.accessKey, err = getSecret("s3-access-key"); err != nil {
+		return nil, err
+	}
+	if s.secretKey, err = getSecret("s3-secret-key"); err != nil {
+		return nil, err
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("the s3-access-key and s3-secret-key secrets are required (BUILDER_S3_ACCESS_KEY, BUILDER_S3_SECRET_KEY)")
+	}
+	// Endpoints of MinIO and the like use path-style URLs
+	base := "https://" + s.bucket + ".s3." + s.region + ".amazonaws.com"
+	if sc.Endpoint != "" {
+		base = strings.TrimSuffix(sc.Endpoint, "/") + "/" + s.bucket
+	}
+	s.objectURL = func(name string) string {
+		return base + s3EscapePath("/"+path.Join(s.prefix, name))
+	}
+	s.auth = s.sign
+	return s, nil
+}
+
+// s3EscapePath encodes an object key as SigV4 canonical URIs do: every byte
+// but unreserved characters and slashes.
+func s3EscapePath(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sign adds the SigV4 authorization of an unsigned payload to req.
+func (s *s3Storage) sign(req *http.Request) error {
+	now := time.Now().UTC()
+	amzDate, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD",
+		"x-amz-date:" + amzDate,
+		"",
+		signed,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = mac(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signed, hex.EncodeToString(mac(key, toSign))))
+	return nil
+}
+
+// gitlabStorage stores files in a package of the GitLab generic package
+// registry, whose URL is given as gitlab+https://<host>/api/v4/projects/<id>/packages/generic/<package>/<version>.
+type gitlabStorage struct {
+	httpStorage
+	base string
+}
+
+func (s *gitlabStorage) String() string { return s.base }
+
+func newGitLabStorage(u *url.URL) (*gitlabStorage, error) {
+	u.Scheme = strings.TrimPrefix(u.Scheme, "gitlab+")
+	token, err := getSecret("gitlab-token")
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, errors.New("no GitLab token: set BUILDER_GITLAB_TOKEN")
+	}
+	header := "PRIVATE-TOKEN"
+	if token == os.Getenv("CI_JOB_TOKEN") {
+		header = "JOB-TOKEN"
+	}
+	s := &gitlabStorage{base: strings.TrimSuffix(u.String(), "/")}
+	s.objectURL = func(name string) string { return s.base + "/" + url.PathEscape(name) }
+	s.auth = func(req *http.Request) error {
+		req.Header.Set(header, token)
+		return nil
+	}
+	// The registry holds a list of files per package version
+	s.flat = true
+	return s, nil
+}
+
+// Delete is not supported by the generic package API, which deletes files
+// by their ID only.
+func (s *gitlabStorage) Delete(ctx context.Context, name string) error {
+	return fmt.Errorf("cannot delete %s: the GitLab package registry deletes whole package versions only", name)
+}
+
+// webdavStorage stores files on a WebDAV server such as Nextcloud
+// (webdav+https://<user>@<host>/remote.php/dav/files/<user>/<dir>) or
+// Apache mod_dav, authenticating with the webdav-user and webdav-password
+// secrets.
+type webdavStorage struct {
+	httpStorage
+	base string
+
+	mu sync.Mutex
+	// dirs are the collections known to exist
+	dirs map[string]bool
+}
+
+func (s *webdavStorage) String() string { return s.base }
+
+func newWebDAVStorage(u *url.URL) (*webdavStorage, error) {
+	u.Scheme = strings.TrimPrefix(u.Scheme, "webdav+")
+	user, err := getSecret("webdav-user")
+	if err != nil {
+		return nil, err
+	}
+	if u.User != nil {
+		user = u.User.Username()
+		u.User = nil
+	}
+	password, err := getSecret("webdav-password")
+	if err != nil {
+		return nil, err
+	}
+	if user == "" || password == "" {
+		return nil, errors.New("no WebDAV credentials: set the user in the URL or BUILDER_WEBDAV_USER, and BUILDER_WEBDAV_PASSWORD")
+	}
+	s := &webdavStorage{base: strings.TrimSuffix(u.String(), "/"), dirs: map[string]bool{}}
+	s.objectURL = func(name string) string {
+		var b strings.Builder
+		b.WriteString(s.base)
+		for _, part := range strings.Split(name, "/") {
+			if part != "" && part != "." {
+				b.WriteString("/" + url.PathEscape(part))
+			}
+		}
+		return b.String()
+	}
+	s.auth = func(req *http.Request) error {
+		req.SetBasicAuth(user, password)
+		return nil
+	}
+	return s, nil
+}
+
+// mkdirAll creates the collection of name and, as far as needed, its
+// parents including the storage root.
+func (s *webdavStorage) mkdirAll(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mkcol(ctx, s.objectURL(path.Dir(name)))
+}
+
+// mkcol creates the collection at target. Servers answer 405 for
+// collections that exist already and 409 for missing parents, which are
+// created before retrying.
+func (s *webdavStorage) mkcol(ctx context.Context, target string) error {
+	if s.dirs[target] {
+		return nil
+	}
+	resp, err := s.send(ctx, "MKCOL", target, target, nil, nil)
+	var herr *storageHTTPError
+	if errors.As(err, &herr) && herr.StatusCode == http.StatusConflict {
+		parent := target[:strings.LastIndex(target, "/")]
+		// Stop at the host
+		if _, rest, _ := strings.Cut(parent, "://"); !strings.Contains(rest, "/") {
+			return fmt.Errorf("could not create %s: %w", target, err)
+		}
+		if err := s.mkcol(ctx, parent); err != nil {
+			return err
+		}
+		resp, err = s.send(ctx, "MKCOL", target, target, nil, nil)
+	}
+	if errors.As(err, &herr) && herr.StatusCode == http.StatusMethodNotAllowed {
+		err = nil
+	} else if err == nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("could not create %s: %w", target, err)
+	}
+	s.dirs[target] = true
+	return nil
+}
+
+// Put uploads to a temporary name first and moves the file over name, so
+// that clients never download partial databases or packages.
+func (s *webdavStorage) Put(ctx context.Context, name, local string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	if err := s.mkdirAll(ctx, name); err != nil {
+		return err
+	}
+	// Nextcloud refuses .part names, which it uses for its own uploads
+	tmp := path.Join(path.Dir(name), ".upload-"+path.Base(name))
+	if err := s.httpStorage.Put(ctx, tmp, local); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, "MOVE", tmp, nil, http.Header{
+		"Destination": {s.objectURL(name)},
+		"Overwrite":   {"T"},
+	})
+	if err != nil {
+		s.Delete(ctx, tmp)
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// sshStorage copies files with rsync over SSH, authenticating with the
+// ssh-key secret or the SSH agent.
+type sshStorage struct {
+	host, dir string
+	ssh       []string
+	// keyDir holds the private key of the ssh-key secret
+	keyDir string
+}
+
+func (s *sshStorage) String() string { return s.host + ":" + s.dir }
+
+func newSSHStorage(u *url.URL) (*sshStorage, error) {
+	s := &sshStorage{host: u.Hostname(), dir: u.Path}
+	if u.User != nil {
+		s.host = u.User.Username() + "@" + s.host
+	}
+	s.ssh = []string{"ssh", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=accept-new"}
+	if port := u.Port(); port != "" {
+		s.ssh = append(s.ssh, "-p", port)
+	}
+	key, err := getSecret("ssh-key")
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		if s.keyDir, err = os.MkdirTemp("", "builder-ssh-"); err != nil {
+			return nil, err
+		}
+		keyFile := filepath.Join(s.keyDir, "id")
+		if err := os.WriteFile(keyFile, []byte(strings.TrimRight(key, "\n")+"\n"), 0600); err != nil {
+			os.RemoveAll(s.keyDir)
+			return nil, err
+		}
+		s.ssh = append(s.ssh, "-i", keyFile, "-o", "IdentitiesOnly=yes")
+	}
+	return s, nil
+}
+
+func (s *sshStorage) Close() error {
+	if s.keyDir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.keyDir)
+}
+
+func (s *sshStorage) remote(name string) string {
+	return path.Join(s.dir, name)
+}
+
+func (s *sshStorage) rsync(ctx context.Context, args ...string) error {
+	return newCommand(ctx, "rsync", append([]string{"--times", "--partial", "--mkpath", "-e", strings.Join(s.ssh, " ")}, args...)...).Run()
+}
+
+func (s *sshStorage) Put(ctx context.Context, name, local string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	return s.rsync(ctx, local, s.host+":"+s.remote(name))
+}
+
+func (s *sshStorage) Get(ctx context.Context, name, local string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	if err := newCommand(ctx, s.ssh[0], append(s.ssh[1:], s.host, "test", "-e", s.remote(name))...).Run(); err != nil {
+		return fmt.Errorf("%w: %s on %s", fs.ErrNotExist, name, s.host)
+	}
+	return s.rsync(ctx, s.host+":"+s.remote(name), local)
+}
+
+func (s *sshStorage) Delete(ctx context.Context, name string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	return newCommand(ctx, s.ssh[0], append(s.ssh[1:], s.host, "rm", "-f", "--", s.remote(name))...).Run()
+}
+
+// storageState records the files of a directory last mirrored to a storage,
+// so only changes are transferred.
+type storageState struct {
+	Files map[string]storedFile `json:"files"`
+}
+
+type storedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// repoFile reports whether name belongs to a repository directory: packages,
+// signatures, deltas and database files, but not the lock file of
+// lockRepoDB.
+func repoFile(name string) bool {
+	base := strings.TrimSuffix(name, ".sig")
+	if strings.HasSuffix(base, ".lock") {
+		return false
+	}
+	return isPackageFile(name) || isDeltaFile(name) || strings.HasSuffix(name, ".deltas.json") || strings.Contains(base, ".db") || strings.Contains(base, ".files")
+}
+
+// mirrorRepoDir mirrors the repository directory of dbPath to the storage of
+// repo.storage: new and changed files are uploaded, databases last so that
+// clients never see packages that are not uploaded yet, and files no longer
+// in the directory are deleted.
+func mirrorRepoDir(ctx context.Context, dbPath string) error {
+	if cfg.Repo.Storage == "" {
+		return nil
+	}
+	st, err := openStorage(cfg.Repo.Storage)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	dir := filepath.Dir(dbPath)
+	statePath := filepath.Join(dir, ".builder-storage-"+cfg.Repo.Storage+".json")
+	state := storageState{Files: map[string]storedFile{}}
+	if data, err := os.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			log.Printf("Warning: ignoring invalid %s: %v", statePath, err)
+			state.Files = map[string]storedFile{}
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errorf(errPublish, "%w", err)
+	}
+	current := map[string]storedFile{}
+	var packages, databases []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() && e.Type()&fs.ModeSymlink == 0 || !repoFile(e.Name()) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		current[e.Name()] = storedFile{info.Size(), info.ModTime().UTC()}
+		if state.Files[e.Name()] == current[e.Name()] {
+			continue
+		}
+		if isPackageFile(e.Name()) || isDeltaFile(e.Name()) {
+			packages = append(packages, e.Name())
+		} else {
+			databases = append(databases, e.Name())
+		}
+	}
+
+	log.Printf("Mirroring %s to %s (%d package file(s), %d database file(s) changed)", dir, st, len(packages), len(databases))
+	if err := runParallel(defaultJobs, packages, func(name string) error {
+		if err := st.Put(ctx, name, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("could not upload %s: %w", name, err)
+		}
+		log.Printf("  Uploaded: %s", name)
+		return nil
+	}); err != nil {
+		return errorf(errPublish, "%w", err)
+	}
+	for _, name := range databases {
+		if err := st.Put(ctx, name, filepath.Join(dir, name)); err != nil {
+			return errorf(errPublish, "could not upload %s: %w", name, err)
+		}
+		log.Printf("  Uploaded: %s", name)
+	}
+	for _, name := range slices.Sorted(maps.Keys(state.Files)) {
+		if _, ok := current[name]; ok {
+			continue
+		}
+		if err := st.Delete(ctx, name); err != nil {
+			log.Printf("Warning: could not delete %s from %s: %v", name, st, err)
+			current[name] = state.Files[name]
+			continue
+		}
+		log.Printf("  Deleted: %s", name)
+	}
+	state.Files = current
+	if err := writeJSONAtomic(statePath, state); err != nil {
+		log.Printf("Warning: could not record the mirrored files in %s: %v", statePath, err)
+	}
+	return nil
+}
+
+// newPublishCmd creates the 'publish' command.
+func newPublishCmd() *cobra.Command {
+	var prefix string
+	cmd := &cobra.Command{
+		Use:   "publish <storage> <files...>",
+		Short: "Uploads files to a configured storage.",
+		Long: `Uploads packages, logs or any other files to a storage of the storage
+section: a local directory, an S3 bucket, a GitLab generic package, an SSH
+host (with rsync) or a WebDAV server such as Nextcloud. Files are stored by
+their base name below --prefix. 'publish oci' pushes packages to a container
+registry instead.`,
+		Args: cobra.MinimumNArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return slices.Sorted(maps.Keys(cfg.Storage)), cobra.ShellCompDirectiveNoFileComp
+			}
+			return nil, cobra.ShellCompDirectiveDefault
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			st, err := openStorage(args[0])
+			if err != nil {
+				return err
+			}
+			defer st.Close()
+			return runParallel(defaultJobs, args[1:], func(file string) error {
+				name := path.Join(prefix, filepath.Base(file))
+				if err := st.Put(cmd.Context(), name, file); err != nil {
+					return errorf(errPublish, "could not upload %s to %s: %w", file, st, err)
+				}
+				log.Printf("  Uploaded: %s (%s)", name, formatSize(fileSize(file)))
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVar(&prefix, "prefix", "", "Directory within the storage the files are stored in")
+	cmd.AddCommand(newPublishOCICmd())
+	return cmd
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+// defaultTimeouts limit how long external commands may run, by command
+// name; "default" applies to all others. Builds have no limit unless
+// configured, as they legitimately take hours. Override with timeouts.<name>.
+var defaultTimeouts = map[string]time.Duration{
+	"default":       10 * time.Minute,
+	"which":         30 * time.Second,
+	"ls":            30 * time.Second,
+	"git":           2 * time.Minute,
+	"gpg":           5 * time.Minute,
+	"install":       time.Minute,
+	"pacman-key":    15 * time.Minute,
+	"pacman":        30 * time.Minute,
+	"rm":            30 * time.Minute,
+	"aria2c":        0,
+	"paru":          0,
+	"makepkg":       0,
+	"updpkgsums":    0,
+	"builder":       0,
+	"podman":        0,
+	"docker":        0,
+	"buildah":       0,
+	"oras":          time.Hour,
+	"xdelta3":       time.Hour,
+	"mkarchiso":     0,
+	"pacstrap":      time.Hour,
+	"mkarchroot":    time.Hour,
+	"arch-nspawn":   30 * time.Minute,
+	"makechrootpkg": 0,
+	"unshare":       0,
+	"strace":        0,
+	"rustup":        30 * time.Minute,
+	"sh":            0,
+}
+
+// commandName returns the operation a command line performs, looking
+// through sudo.
+func commandName(name string, args []string) string {
+	if filepath.Base(name) == "sudo" {
+		for _, arg := range args {
+			if !strings.HasPrefix(arg, "-") {
+				return filepath.Base(arg)
+			}
+		}
+	}
+	if self, err := os.Executable(); err == nil && name == self {
+		return "builder"
+	}
+	return filepath.Base(name)
+}
+
+// commandTimeout returns the configured or default timeout of an operation;
+// zero means no limit.
+func commandTimeout(op string) time.Duration {
+	if d, ok := cfg.Timeouts[op]; ok {
+		return d
+	}
+	if d, ok := defaultTimeouts[op]; ok {
+		return d
+	}
+	if d, ok := cfg.Timeouts["default"]; ok {
+		return d
+	}
+	return defaultTimeouts["default"]
+}
+
+// command is an exec.Cmd bounded by its operation's timeout. Its methods
+// that wait for the process release the timeout and report expiry.
+type command struct {
+	*exec.Cmd
+	op      string
+	timeout time.Duration
+	ctx     context.Context
+	cancel  context.CancelFunc
+	// redactors are flushed when the command is done
+	redactors []*redactingWriter
+}
+
+// timeoutError explains a command that ran out of time.
+func (c *command) timeoutError(err error) error {
+	if err != nil && errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out after %s (raise timeouts.%s in the config): %w", c.op, c.timeout, c.op, err)
+	}
+	return err
+}
+
+func (c *command) Run() error {
+	defer c.done()
+	return c.timeoutError(c.Cmd.Run())
+}
+
+func (c *command) Wait() error {
+	defer c.done()
+	return c.timeoutError(c.Cmd.Wait())
+}
+
+// redacting returns a redactingWriter for w that is flushed when the command
+// is done, for copies of its output such as log files.
+func (c *command) redacting(w io.Writer) *redactingWriter {
+	r := newRedactingWriter(w)
+	c.redactors = append(c.redactors, r)
+	return r
+}
+
+// done releases the context of the command and writes the output held back
+// for masking.
+func (c *command) done() {
+	c.cancel()
+	for _, r := range c.redactors {
+		r.Flush()
+	}
+}
+
+// Output runs the command and returns its standard output.
+func (c *command) Output() ([]byte, error) {
+	defer c.done()
+	c.Stdout = nil
+	out, err := c.Cmd.Output()
+	return out, c.timeoutError(err)
+}
+
+// CombinedOutput runs the command and returns its standard output and error.
+func (c *command) CombinedOutput() ([]byte, error) {
+	defer c.done()
+	c.Stdout, c.Stderr = nil, nil
+	out, err := c.Cmd.CombinedOutput()
+	return out, c.timeoutError(err)
+}
+
+// usesProcessGroup reports whether children get their own process group.
+// Without a terminal (CI) that lets a timeout or cancellation stop
+// everything a command started; with one, the children must stay in the
+// foreground group to read from the terminal and get Ctrl+C directly.
+func usesProcessGroup() bool {
+	return !isatty.IsTerminal(os.Stdin.Fd())
+}
+
+// signalCommand sends sig to the process group of cmd, or only to the process
+// when it has none.
+func signalCommand(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	}
+	return cmd.Process.Signal(sig)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var (
+	// reRustVersion matches a pinned Rust release, e.g. 1.79 or 1.79.0,
+	// unlike channels such as stable or nightly-2024-06-01
+	reRustVersion = regexp.MustCompile(`^\d+\.\d+(\.\d+)?$`)
+	reRustc       = regexp.MustCompile(`^rustc (\S+)`)
+	reGoVersion   = regexp.MustCompile(`^go version go(\S+) `)
+)
+
+// toolchainEnv returns the environment selecting the pinned toolchains of
+// toolchain for builds: RUSTUP_TOOLCHAIN, which the rustup proxies of cargo
+// and rustc obey, and GOTOOLCHAIN, with which go runs exactly that release.
+func toolchainEnv() []string {
+	var env []string
+	if tc := cfg.Toolchain.Rust; tc != "" {
+		env = append(env, "RUSTUP_TOOLCHAIN="+tc)
+	}
+	if v := cfg.Toolchain.Go; v != "" {
+		env = append(env, "GOTOOLCHAIN=go"+strings.TrimPrefix(v, "go"))
+	}
+	return env
+}
+
+// versionMatches reports whether version, e.g. 14.1.1, is the pinned one,
+// e.g. 14, 14.1 or 14.1.1.
+func versionMatches(version, pinned string) bool {
+	return version == pinned || strings.HasPrefix(version, pinned+".")
+}
+
+// toolchainError explains a toolchain that does not match its pin.
+func toolchainError(format string, args ...any) *builderError {
+	return &builderError{
+		Category: errDependency,
+		Err:      fmt.Errorf(format, args...),
+		Hint:     "Install the pinned toolchain in the build image or change the pin under toolchain in the configuration.",
+	}
+}
+
+// toolchainPinned reports whether the configuration pins any toolchain.
+func toolchainPinned() bool {
+	tc := cfg.Toolchain
+	return tc.Rust != "" || tc.Go != "" || tc.GCC != ""
+}
+
+// prepareToolchains installs the pinned toolchains that are missing and
+// verifies those the build will use, before it starts, so a mismatch fails
+// clearly instead of in the middle of the build and offline builds find
+// them. It returns the environment the build needs besides toolchainEnv
+// and the versions found by toolchain.
+func prepareToolchains(ctx context.Context) ([]string, map[string]string, error) {
+	tc := cfg.Toolchain
+	var env []string
+	versions := map[string]string{}
+	if tc.Rust != "" {
+		v, err := prepareRust(ctx, tc.Rust)
+		if err != nil {
+			return nil, nil, err
+		}
+		versions["rust"] = v
+	}
+	if tc.Go != "" {
+		v, err := prepareGo(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		versions["go"] = v
+	}
+	if tc.GCC != "" {
+		v, ccEnv, err := findGCC(ctx, tc.GCC)
+		if err != nil {
+			return nil, nil, err
+		}
+		versions["gcc"] = v
+		env = append(env, ccEnv...)
+	}
+	for _, name := range []string{"rust", "go", "gcc"} {
+		if v, ok := versions[name]; ok {
+			log.Printf("Toolchain: %s %s", name, v)
+		}
+	}
+	return env, versions, nil
+}
+
+// prepareRust installs the rustup toolchain tc unless it is installed and
+// returns the version of its rustc.
+func prepareRust(ctx context.Context, tc string) (string, error) {
+	if _, err := exec.LookPath("rustup"); err != nil {
+		return "", toolchainError("toolchain.rust is %s, but rustup is not installed; 'builder deps' installs it", tc)
+	}
+	list := newCommand(ctx, "rustup", "toolchain", "list")
+	out, err := list.Output()
+	if err != nil {
+		return "", toolchainError("could not list the rustup toolchains: %w", err)
+	}
+	installed := false
+	for line := range strings.Lines(string(out)) {
+		// Toolchains are listed with their host, e.g. 1.79.0-x86_64-unknown-linux-gnu
+		if name, _, _ := strings.Cut(strings.TrimSpace(line), " "); name == tc || strings.HasPrefix(name, tc+"-") {
+			installed = true
+		}
+	}
+	if !installed {
+		log.Printf("Installing Rust toolchain %s...", tc)
+		if err := runCommand(ctx, "rustup", "toolchain", "install", tc, "--profile", "minimal", "--no-self-update"); err != nil {
+			return "", toolchainError("could not install the Rust toolchain %s: %w", tc, err)
+		}
+	}
+	rustc := newCommand(ctx, "rustc", "+"+tc, "--version")
+	out, err = rustc.Output()
+	if err != nil {
+		return "", toolchainError("could not run rustc of the toolchain %s: %w", tc, err)
+	}
+	m := reRustc.FindStringSubmatch(string(out))
+	if m == nil {
+		return "", toolchainError("unexpected rustc --version output %q", strings.TrimSpace(string(out)))
+	}
+	if reRustVersion.MatchString(tc) && !versionMatches(m[1], tc) {
+		return "", toolchainError("toolchain.rust is %s, but the toolchain has rustc %s", tc, m[1])
+	}
+	return m[1], nil
+}
+
+// prepareGo runs go with the GOTOOLCHAIN of toolchainEnv, which downloads
+// the pinned release into the module cache unless the installed go is that
+// release, and returns the version it reports.
+func prepareGo(ctx context.Context) (string, error) {
+	pinned := strings.TrimPrefix(cfg.Toolchain.Go, "go")
+	if _, err := exec.LookPath("go"); err != nil {
+		return "", toolchainError("toolchain.go is %s, but go is not installed", pinned)
+	}
+	cmd := newCommand(ctx, "go", "version")
+	cmd.Env = append(os.Environ(), toolchainEnv()...)
+	out, err := cmd.Output()
+	if err != nil {
+		// go 1.20 and older do not know GOTOOLCHAIN
+		return "", toolchainError("could not run go %s: %w", pinned, err)
+	}
+	m := reGoVersion.FindStringSubmatch(string(out))
+	if m == nil || !versionMatches(m[1], pinned) {
+		return "", toolchainError("toolchain.go is %s, but go reports %q; go 1.21 or newer is needed to switch toolchains", pinned, strings.TrimSpace(string(out)))
+	}
+	return m[1], nil
+}
+
+// findGCC returns the version of the gcc matching the pinned version, and
+// the environment selecting it: none for the default gcc, CC and CXX for a
+// versioned one such as gcc-13 of the gcc13 package.
+func findGCC(ctx context.Context, pinned string) (string, []string, error) {
+	major, _, _ := strings.Cut(pinned, ".")
+	var found []string
+	for _, cc := range []string{"gcc", "gcc-" + major} {
+		if _, err := exec.LookPath(cc); err != nil {
+			continue
+		}
+		cmd := newCommand(ctx, cc, "-dumpfullversion")
+		out, err := cmd.Output()
+		if err != nil {
+			continue
+		}
+		v := strings.TrimSpace(string(out))
+		if versionMatches(v, pinned) {
+			if cc == "gcc" {
+				return v, nil, nil
+			}
+			return v, []string{"CC=" + cc, "CXX=g++-" + major}, nil
+		}
+		found = append(found, cc+" "+v)
+	}
+	if len(found) == 0 {
+		return "", nil, toolchainError("toolchain.gcc is %s, but gcc is not installed", pinned)
+	}
+	return "", nil, &builderError{
+		Category: errDependency,
+		Err:      fmt.Errorf("toolchain.gcc is %s, but only %s is installed", pinned, strings.Join(found, ", ")),
+		Hint:     fmt.Sprintf("Install gcc %s, e.g. the gcc%s package providing gcc-%s, or change toolchain.gcc.", pinned, major, major),
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/spf13/cobra"
+)
+
+// tuiLogLines is the number of output lines kept per package.
+const tuiLogLines = 500
+
+// tuiPackage is the state of one package directory shown in the TUI.
+type tuiPackage struct {
+	Dir      string
+	Phase    string
+	Status   string
+	Err      error
+	Started  time.Time
+	Duration time.Duration
+	Log      []string
+}
+
+type (
+	tuiPhaseMsg struct {
+		idx   int
+		phase string
+	}
+	tuiLogMsg struct {
+		idx  int
+		line string
+	}
+	tuiDoneMsg struct {
+		idx int
+		err error
+	}
+	tuiFinishedMsg struct{}
+	tuiTickMsg     time.Time
+)
+
+// tuiModel is the bubbletea model: a package list with phases, the live log
+// of the selected package and a summary line.
+type tuiModel struct {
+	pkgs     []*tuiPackage
+	selected int
+	width    int
+	height   int
+	finished bool
+	cancel   context.CancelFunc
+}
+
+func tuiTick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg { return tuiTickMsg(t) })
+}
+
+func (m *tuiModel) Init() tea.Cmd { return tuiTick() }
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c":
+			m.cancel()
+			return m, tea.Quit
+		case "up", "k":
+			if m.selected > 0 {
+				m.selected--
+			}
+		case "down", "j":
+			if m.selected < len(m.pkgs)-1 {
+				m.selected++
+			}
+		}
+	case tuiPhaseMsg:
+		p := m.pkgs[msg.idx]
+		if p.Started.IsZero() {
+			p.Started = time.Now()
+		}
+		p.Phase, p.Status = msg.phase, "running"
+		m.selected = msg.idx
+	case tuiLogMsg:
+		p := m.pkgs[msg.idx]
+		p.Log = append(p.Log, msg.line)
+		if len(p.Log) > tuiLogLines {
+			p.Log = p.Log[len(p.Log)-tuiLogLines:]
+		}
+	case tuiDoneMsg:
+		p := m.pkgs[msg.idx]
+		p.Duration = time.Since(p.Started)
+		p.Err = msg.err
+		p.Status = resultSuccess
+		var exitErr *exec.ExitError
+		switch {
+		case errors.As(msg.err, &exitErr) && exitErr.ExitCode() == errUnsupportedArch.ExitCode():
+			p.Status = resultSkipped
+		case msg.err != nil:
+			p.Status = resultFailed
+		}
+	case tuiFinishedMsg:
+		m.finished = true
+	case tuiTickMsg:
+		return m, tuiTick()
+	}
+	return m, nil
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+	b.WriteString("builder tui — ↑/↓ select package, q quit\n\n")
+	for i, p := range m.pkgs {
+		cursor := "  "
+		if i == m.selected {
+			cursor = "> "
+		}
+		status := p.Status
+		elapsed := p.Duration
+		if status == "running" {
+			status += " (" + p.Phase + ")"
+			elapsed = time.Since(p.Started)
+		}
+		fmt.Fprintf(&b, "%s%-40s %-28s %s\n", cursor, p.Dir, status, elapsed.Round(time.Second))
+	}
+
+	var ok, failed, skipped, pending int
+	for _, p := range m.pkgs {
+		switch p.Status {
+		case resultSuccess:
+			ok++
+		case resultFailed:
+			failed++
+		case resultSkipped:
+			skipped++
+		default:
+			pending++
+		}
+	}
+	fmt.Fprintf(&b, "\n%d succeeded, %d failed, %d skipped, %d remaining", ok, failed, skipped, pending)
+	if m.finished {
+		b.WriteString(" — all done, press q to exit")
+	}
+	b.WriteString("\n\n")
+
+	if len(m.pkgs) > 0 {
+		p := m.pkgs[m.selected]
+		fmt.Fprintf(&b, "--- %s ---\n", p.Dir)
+		// Fill the rest of the screen with the tail of the selected log
+		rows := m.height - len(m.pkgs) - 7
+		if rows < 5 {
+			rows = 5
+		}
+		start := max(len(p.Log)-rows, 0)
+		for _, line := range p.Log[start:] {
+			if m.width > 0 && len(line) > m.width {
+				line = line[:m.width]
+			}
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
+
+// tuiRun builds every package directory in order, running each step as a
+// child builder process and forwarding its output to the program.
+func tuiRun(ctx context.Context, prog *tea.Program, pkgs []*tuiPackage, steps []string, extraArgs []string) {
+	self, serr := os.Executable()
+	if serr != nil {
+		self = os.Args[0]
+	}
+	for i, p := range pkgs {
+		var err error
+		for _, step := range steps {
+			if ctx.Err() != nil {
+				break
+			}
+			prog.Send(tuiPhaseMsg{i, step})
+			if err = tuiStep(ctx, prog, i, self, p.Dir, append(append([]string{}, extraArgs...), step)); err != nil {
+				break
+			}
+		}
+		prog.Send(tuiDoneMsg{i, err})
+	}
+	prog.Send(tuiFinishedMsg{})
+}
+
+// tuiMaxLine is the longest output line shown in the log, e.g. of a linker
+// command or of progress redrawn with \r.
+const tuiMaxLine = 1024 * 1024
+
+// tuiStep runs one builder subcommand in dir and streams its output lines.
+func tuiStep(ctx context.Context, prog *tea.Program, idx int, self, dir string, args []string) error {
+	cmd := newCommand(ctx, self, args...)
+	cmd.Dir = dir
+	pr, pw := io.Pipe()
+	cmd.Stdout, cmd.Stderr = pw, pw
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(make([]byte, 64*1024), tuiMaxLine)
+		for scanner.Scan() {
+			prog.Send(tuiLogMsg{idx, scanner.Text()})
+		}
+		// Keep reading after an overlong line, or the child blocks writing
+		io.Copy(io.Discard, pr)
+		close(done)
+	}()
+	err := cmd.Wait()
+	pw.Close()
+	<-done
+	return err
+}
+
+func newTuiCmd() *cobra.Command {
+	var steps []string
+	cmd := &cobra.Command{
+		Use:   "tui [package-dir...]",
+		Short: "Interactively builds one or more package directories with live logs.",
+		Long: `Runs the given steps (deps and build by default) for each package directory
+in turn and shows the current phase, a live log of the selected package and a
+summary. Packages whose arch array excludes this machine are skipped rather
+than failed. Intended for local multi-package builds; use the plain commands in CI.`,
+		ValidArgsFunction: completePackageDirs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				args = []string{"."}
+			}
+			var pkgs []*tuiPackage
+			for _, dir := range args {
+				if _, err := os.Stat(filepath.Join(dir, "PKGBUILD")); err != nil {
+					return errorf(errConfig, "%s does not contain a PKGBUILD", dir)
+				}
+				pkgs = append(pkgs, &tuiPackage{Dir: dir, Status: "pending"})
+			}
+
+			extraArgs, err := childBuilderArgs(cmd)
+			if err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+
+			// Quitting the TUI stops the running builds but not the program context
+			ctx, cancel := context.WithCancel(cmd.Context())
+			defer cancel()
+			model := &tuiModel{pkgs: pkgs, cancel: cancel}
+			prog := tea.NewProgram(model, tea.WithAltScreen(), tea.WithContext(cmd.Context()))
+			go tuiRun(ctx, prog, pkgs, steps, extraArgs)
+			if _, err := prog.Run(); err != nil && cmd.Context().Err() == nil {
+				return fmt.Errorf("TUI failed: %w", err)
+			}
+
+			// Leave a plain summary on the terminal after the alternate screen closes
+			var failed int
+			for _, p := range pkgs {
+				log.Printf("  %s: %s (%s)", p.Dir, p.Status, p.Duration.Round(time.Second))
+				if p.Status == resultFailed {
+					failed++
+				}
+			}
+			if !model.finished {
+				return errorf(errCancelled, "quit before all packages were built")
+			}
+			if failed > 0 {
+				return errorf(errBuild, "%d of %d package(s) failed", failed, len(pkgs))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&steps, "steps", []string{"deps", "build"}, "Builder commands to run for each package, in order")
+	cmd.RegisterFlagCompletionFunc("steps", completeCommandNames)
+	return cmd
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// packageModTimes returns the modification times of the package files of
+// dir, see builtPackages.
+func packageModTimes(dir string) map[string]time.Time {
+	times := map[string]time.Time{}
+	for _, f := range builtPackages(dir) {
+		if info, err := os.Stat(f); err == nil {
+			times[f] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// changedPackages returns the package files of dir written since before was
+// taken by packageModTimes.
+func changedPackages(dir string, before map[string]time.Time) []string {
+	var changed []string
+	for f, t := range packageModTimes(dir) {
+		if old, ok := before[f]; !ok || !t.Equal(old) {
+			changed = append(changed, f)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// buildVariants builds every variant of build.variants in turn, each by a
+// builder process of its own so it is recorded as a build of its own, and
+// checks that the variants produce distinctly named packages.
+func buildVariants(cmd *cobra.Command, clean bool) error {
+	self, err := os.Executable()
+	if err != nil {
+		return errorf(errGeneral, "could not find the builder executable: %w", err)
+	}
+	args, err := childBuilderArgs(cmd)
+	if err != nil {
+		return errorf(errConfig, "%w", err)
+	}
+	args = append(args, "build")
+	cmd.LocalNonPersistentFlags().Visit(func(f *pflag.Flag) {
+		if f.Name != "clean" {
+			args = append(args, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+
+	names := slices.Sorted(maps.Keys(cfg.Build.Variants))
+	producedBy := map[string]string{}
+	for i, name := range names {
+		variantArgs := append(slices.Clone(args), "--variant", name)
+		switch {
+		case i == 0 && clean:
+			variantArgs = append(variantArgs, "--clean")
+		case i > 0:
+			// Keep the packages of earlier variants, but not their build trees
+			if _, err := removePaths(cmd.Context(), []string{"src", "pkg"}, false); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+
+		setPhase("variant " + name)
+		log.Printf("=== Variant %s (%d/%d) ===", name, i+1, len(names))
+		before := packageModTimes(".")
+		err := newCommand(cmd.Context(), self, variantArgs...).Run()
+		if cmd.Context().Err() != nil {
+			return errorf(errCancelled, "cancelled while building variant %s", name)
+		}
+		if err != nil {
+			cat := errBuild
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				cat = categoryOfExitCode(exitErr.ExitCode())
+			}
+			return &builderError{Category: cat, Err: fmt.Errorf("variant %s failed: %w", name, err)}
+		}
+
+		for _, f := range changedPackages(".", before) {
+			if other, ok := producedBy[f]; ok {
+				return &builderError{
+					Category: errArtifact,
+					Err:      fmt.Errorf("variants %s and %s both produced %s", other, name, f),
+					Hint:     "Make pkgname depend on the variant, e.g. pkgname=foo${_suffix} with _suffix set in the variant's env.",
+				}
+			}
+			producedBy[f] = name
+		}
+	}
+	log.Printf("Built %d variant(s): %d package file(s).", len(names), len(producedBy))
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// sourceArrays returns the source arrays of info: source and source_<arch>
+// for every architecture it supports.
+func sourceArrays(info *pkgbuildInfo) []string {
+	arrays := []string{"source"}
+	for _, arch := range info.Arch {
+		if arch != "any" {
+			arrays = append(arrays, "source_"+arch)
+		}
+	}
+	return arrays
+}
+
+// checkChecksumArrays reports checksum arrays whose length differs from their
+// source array, which makepkg rejects only after installing dependencies.
+func checkChecksumArrays(info *pkgbuildInfo) []string {
+	var problems []string
+	for _, array := range sourceArrays(info) {
+		suffix := strings.TrimPrefix(array, "source")
+		n := len(info.Arrays[array])
+		found := false
+		for _, kind := range slices.Sorted(maps.Keys(checksumHashes)) {
+			values, ok := info.Arrays[kind+suffix]
+			if !ok {
+				continue
+			}
+			found = true
+			if len(values) != n {
+				problems = append(problems, fmt.Sprintf("%s has %d entries but %s has %d", kind+suffix, len(values), array, n))
+			}
+		}
+		if !found && n > 0 {
+			problems = append(problems, fmt.Sprintf("%s has no checksum array", array))
+		}
+	}
+	return problems
+}
+
+// hasChecksums reports whether sums hold an actual checksum, not only SKIP.
+func hasChecksums(sums map[string]string) bool {
+	for _, v := range sums {
+		if v != "SKIP" {
+			return true
+		}
+	}
+	return false
+}
+
+// newVerifySourcesCmd creates the 'verify-sources' command.
+func newVerifySourcesCmd() *cobra.Command {
+	var destDir string
+	var jobs int
+	var noDownload, skipPGPCheck bool
+	cmd := &cobra.Command{
+		Use:   "verify-sources",
+		Short: "Checks the PKGBUILD sources against all checksum arrays without building.",
+		Long: `Downloads the sources of the PKGBUILD in the current directory (or uses those
+already in --dest) and verifies them against every checksum array, including
+the source_<arch> arrays of all architectures in arch, then checks the source
+signatures against validpgpkeys. Checksum arrays that do not match their source
+array in length are reported as well. No build dependencies are needed, so this
+suits a fast merge request check job.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info, err := parsePKGBUILD("PKGBUILD")
+			if err != nil {
+				return errorf(errParse, "%w", err)
+			}
+			if problems := checkChecksumArrays(info); len(problems) > 0 {
+				return &builderError{
+					Category: errParse,
+					Err:      fmt.Errorf("inconsistent checksum arrays:\n  %s", strings.Join(problems, "\n  ")),
+					Hint:     "Every source array needs a checksum entry per source; run updpkgsums to regenerate them.",
+				}
+			}
+
+			if destDir == "" {
+				destDir = os.Getenv("SRCDEST")
+			}
+			if destDir == "" {
+				destDir = "."
+			}
+			var downloads []downloadJob
+			var failed []string
+			var skipped int
+			seen := map[string]bool{}
+			for _, array := range sourceArrays(info) {
+				entries, sums := arraySources(info, array)
+				for i, e := range entries {
+					if seen[e.Name] {
+						continue
+					}
+					seen[e.Name] = true
+					if !hasChecksums(sums[i]) {
+						skipped++
+						continue
+					}
+					job := downloadJob{Name: e.Name, URLs: sourceURLs(e.URL, cfg.Fetch), Dest: filepath.Join(destDir, e.Name), Checksums: sums[i]}
+					if !e.remote() || noDownload {
+						if !e.remote() {
+							job.Dest = e.Name
+						}
+						if err := verifyChecksums(job.Dest, job.Checksums); err != nil {
+							failed = append(failed, fmt.Sprintf("%s: %v", e.Name, err))
+						} else {
+							log.Printf("  Verified: %s", e.Name)
+						}
+						continue
+					}
+					downloads = append(downloads, job)
+				}
+			}
+
+			if len(downloads) > 0 {
+				if err := os.MkdirAll(destDir, 0755); err != nil {
+					return errorf(errDependency, "could not create source directory: %w", err)
+				}
+				rate, err := parseRate(cfg.Fetch.LimitRate)
+				if err != nil {
+					return errorf(errConfig, "%w", err)
+				}
+				retries := 3
+				if cfg.Fetch.Retries > 0 {
+					retries = cfg.Fetch.Retries
+				}
+				log.Printf("Fetching %d source(s) into %s...", len(downloads), destDir)
+				d := &downloader{client: httpClient(), jobs: jobs, retries: retries, limiter: &rateLimiter{rate: rate}}
+				// Downloads are verified as they complete; a file that still
+				// mismatches after a fresh download is a checksum failure
+				if err := d.run(cmd.Context(), downloads); err != nil {
+					failed = append(failed, strings.Split(err.Error(), "\n")...)
+				}
+			}
+			if skipped > 0 {
+				log.Printf("Warning: %d source(s) have only SKIP checksums and were not verified", skipped)
+			}
+			if len(failed) > 0 {
+				return &builderError{
+					Category: errDependency,
+					Err:      fmt.Errorf("%d source(s) failed verification:\n  %s", len(failed), strings.Join(failed, "\n  ")),
+					Hint:     "Update the checksums with updpkgsums if upstream legitimately changed the files; otherwise the download is corrupt or was tampered with.",
+				}
+			}
+			if !skipPGPCheck {
+				if err := verifySourceSignatures(cmd.Context(), info, destDir); err != nil {
+					return err
+				}
+			}
+			log.Println("All sources verified.")
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&destDir, "dest", "", "Directory holding downloaded sources (default $SRCDEST or the current directory)")
+	cmd.Flags().IntVarP(&jobs, "jobs", "j", 4, "Number of parallel downloads")
+	cmd.Flags().BoolVar(&noDownload, "no-download", false, "Only verify sources already downloaded; missing ones fail")
+	cmd.Flags().BoolVar(&skipPGPCheck, "skip-pgp-check", false, "Do not verify source signatures")
+	return cmd
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxWebhookBody limits the payloads webhooks are read into memory with.
+const maxWebhookBody = 5 << 20
+
+// releaseEvent is an upstream release announced by a webhook.
+type releaseEvent struct {
+	// Upstream is owner/name on GitHub or the project path on GitLab
+	Upstream string
+	Tag      string
+}
+
+// parseGitHubRelease returns the release of a GitHub webhook, or nil for
+// other events and for drafts and pre-releases.
+func parseGitHubRelease(r *http.Request, body []byte) (*releaseEvent, error) {
+	if r.Header.Get("X-GitHub-Event") != "release" {
+		return nil, nil
+	}
+	var payload struct {
+		Action  string `json:"action"`
+		Release struct {
+			TagName    string `json:"tag_name"`
+			Draft      bool   `json:"draft"`
+			Prerelease bool   `json:"prerelease"`
+		} `json:"release"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.Action != "published" || payload.Release.Draft || payload.Release.Prerelease {
+		return nil, nil
+	}
+	return &releaseEvent{Upstream: payload.Repository.FullName, Tag: payload.Release.TagName}, nil
+}
+
+// parseGitLabRelease returns the release of a GitLab webhook, or nil for
+// other events.
+func parseGitLabRelease(r *http.Request, body []byte) (*releaseEvent, error) {
+	if r.Header.Get("X-Gitlab-Event") != "Release Hook" {
+		return nil, nil
+	}
+	var payload struct {
+		Action  string `json:"action"`
+		Tag     string `json:"tag"`
+		Project struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.Action != "create" {
+		return nil, nil
+	}
+	return &releaseEvent{Upstream: payload.Project.PathWithNamespace, Tag: payload.Tag}, nil
+}
+
+// verifyGitHubSignature checks the HMAC of a GitHub webhook payload.
+func verifyGitHubSignature(r *http.Request, body []byte, secret string) bool {
+	sig, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !ok {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	want := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(sig), []byte(want))
+}
+
+// verifyGitLabToken checks the secret token of a GitLab webhook.
+func verifyGitLabToken(r *http.Request, _ []byte, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) == 1
+}
+
+// releaseJobs returns the jobs updating and building the packages of
+// serve.webhooks that follow the upstream of a release.
+func releaseJobs(ev *releaseEvent) ([]*serveJob, error) {
+	var jobs []*serveJob
+	for _, wh := range cfg.Serve.Webhooks {
+		if !strings.EqualFold(wh.Upstream, ev.Upstream) {
+			continue
+		}
+		prefix := wh.TagPrefix
+		if prefix == "" {
+			prefix = "v"
+		}
+		version := strings.TrimPrefix(ev.Tag, prefix)
+		if err := checkPkgver(version); err != nil {
+			return nil, fmt.Errorf("release %s of %s: %w", ev.Tag, ev.Upstream, err)
+		}
+		src := &gitSource{Repo: wh.Repo, Ref: wh.Ref, Path: wh.Path}
+		if src.Ref == "" {
+			src.Ref = "HEAD"
+		}
+		if err := src.check(); err != nil {
+			return nil, err
+		}
+		pkg := wh.Package
+		if pkg == "" {
+			pkg = packageOfSource(src)
+		}
+		jobs = append(jobs, &serveJob{Package: pkg, Source: src, Bump: version, Project: projectOfRepo(src.Repo), SubmittedBy: "release of " + ev.Upstream})
+	}
+	return jobs, nil
+}
+
+// webhookHandler returns the handler of a webhook endpoint, which queues an
+// update of every package following the released project.
+func (c *coordinator) webhookHandler(secret string, verify func(*http.Request, []byte, string) bool, parse func(*http.Request, []byte) (*releaseEvent, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !verify(r, body, secret) {
+			http.Error(w, "invalid webhook signature", http.StatusUnauthorized)
+			return
+		}
+		ev, err := parse(r, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ev == nil {
+			writeJSON(w, http.StatusOK, map[string]any{"ignored": true})
+			return
+		}
+		jobs, err := releaseJobs(ev)
+		if err != nil {
+			log.Printf("Warning: webhook: %v", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if len(jobs) == 0 {
+			debugPrint("Webhook: no package follows %s", ev.Upstream)
+			writeJSON(w, http.StatusOK, map[string]any{"ignored": true})
+			return
+		}
+		var ids []string
+		for _, job := range jobs {
+			if err := c.enqueue(job, nil); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("  Queued: %s (%s %s, released by %s)", job.ID, job.Package, job.Bump, ev.Upstream)
+			c.audit(&principal{Name: job.SubmittedBy}, "bump", fmt.Sprintf("%s %s to %s", job.ID, job.Package, job.Bump), job.Project, nil)
+			ids = append(ids, job.ID)
+		}
+		writeJSON(w, http.StatusAccepted, map[string]any{"jobs": ids})
+	}
+}
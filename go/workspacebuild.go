@@ -0,0 +1,196 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// newBuildWorkspaceCmd creates the 'build-workspace' command.
+func newBuildWorkspaceCmd() *cobra.Command {
+	var workspace, selection, events string
+	var steps []string
+	var includeQuarantined, failFast bool
+	cmd := &cobra.Command{
+		Use:         "build-workspace",
+		Short:       "Builds the packages of a workspace in dependency order.",
+		Annotations: map[string]string{annotationJSONResult: "true"},
+		Long: `Runs the given steps (deps and build by default) as builder processes in every
+package directory below --workspace, in build order: after the packages it
+depends on and those of lower package.stage, and higher package.priority first
+otherwise. --select restricts the run to matching packages. Packages whose
+arch array excludes this machine are skipped rather than failed, as are the
+packages depending on a failed one and, unless --include-quarantined is given,
+those with a package.status of broken or on-hold. --fail-fast stops at the
+first failure.
+
+--events writes an NDJSON event stream to a file, or to an inherited file
+descriptor with fd:N, one JSON object per line with time and event:
+run_started (total), package_started (package, dir, index, total),
+package_succeeded (duration_seconds, artifacts), package_failed (step, error,
+category, exit_code, duration_seconds), package_skipped (reason) and
+run_finished (succeeded, failed, skipped, duration_seconds).`,
+		Example: `  builder build-workspace --events events.ndjson
+  builder build-workspace --select 'not large' --events fd:3 3>&1 >/dev/null`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stream, err := openEventStream(events)
+			if err != nil {
+				return errorf(errConfig, "--events: %w", err)
+			}
+			defer stream.Close()
+			self, err := os.Executable()
+			if err != nil {
+				return errorf(errGeneral, "could not find the builder executable: %w", err)
+			}
+			childArgs, err := childBuilderArgs(cmd)
+			if err != nil {
+				return errorf(errConfig, "%w", err)
+			}
+
+			nodes, err := workspaceNodes(workspace)
+			if err != nil {
+				return errorf(errGeneral, "could not scan workspace %s: %w", workspace, err)
+			}
+			if nodes, err = selectNodes(selection, nodes); err != nil {
+				return err
+			}
+			selected := nodes
+			if !includeQuarantined {
+				selected = skipQuarantined(nodes)
+			}
+			order, cyclic := buildOrder(selected)
+			if len(cyclic) > 0 {
+				var names []string
+				for _, n := range cyclic {
+					names = append(names, n.Name)
+				}
+				log.Printf("Warning: dependency cycle, or dependency on a later package.stage, between %s; they are built last", strings.Join(names, ", "))
+			}
+			order = append(order, cyclic...)
+
+			runStart := time.Now()
+			var succeeded, failed, skipped int
+			// The outcome of every package, the result of --output-format json
+			var outcomes []buildEvent
+			stream.emit(&buildEvent{Event: eventRunStarted, Total: len(order)})
+			for _, n := range nodes {
+				if !slices.Contains(selected, n) {
+					skipped++
+					e := buildEvent{Event: eventPackageSkipped, Package: n.Name, Dir: n.Dir, Reason: fmt.Sprintf("quarantined (%s): %s", n.Status, cmp.Or(n.Reason, "no reason given"))}
+					stream.emit(&e)
+					outcomes = append(outcomes, e)
+				}
+			}
+
+			// A package is not built after one it depends on failed
+			provider := map[string]*pkgNode{}
+			for _, n := range order {
+				for _, p := range n.Provides {
+					provider[p] = n
+				}
+			}
+			notBuilt := map[*pkgNode]bool{}
+			var stopped bool
+			for i, n := range order {
+				skip := buildEvent{Event: eventPackageSkipped, Package: n.Name, Dir: n.Dir, Index: i + 1, Total: len(order)}
+				if stopped || cmd.Context().Err() != nil {
+					skip.Reason = "the run was stopped"
+				}
+				for _, d := range n.Depends {
+					if p, ok := provider[d]; ok && p != n && notBuilt[p] && skip.Reason == "" {
+						skip.Reason = "dependency " + p.Name + " was not built"
+					}
+				}
+				if skip.Reason != "" {
+					log.Printf("=== %s (%d/%d): skipped, %s ===", n.Name, i+1, len(order), skip.Reason)
+					notBuilt[n] = true
+					skipped++
+					stream.emit(&skip)
+					outcomes = append(outcomes, skip)
+					continue
+				}
+
+				log.Printf("=== %s (%d/%d) ===", n.Name, i+1, len(order))
+				stream.emit(&buildEvent{Event: eventPackageStarted, Package: n.Name, Dir: n.Dir, Index: i + 1, Total: len(order)})
+				start := time.Now()
+				before := packageModTimes(n.Dir)
+				var step string
+				var stepErr error
+				for _, step = range steps {
+					run := newCommand(cmd.Context(), self, append(slices.Clone(childArgs), step)...)
+					run.Dir = n.Dir
+					if stepErr = run.Run(); stepErr != nil {
+						break
+					}
+				}
+				done := buildEvent{Package: n.Name, Dir: n.Dir, Index: i + 1, Total: len(order), Duration: time.Since(start).Seconds()}
+				var exitErr *exec.ExitError
+				switch {
+				case stepErr == nil:
+					succeeded++
+					done.Event = eventPackageSucceeded
+					for _, f := range changedPackages(n.Dir, before) {
+						done.Artifacts = append(done.Artifacts, filepath.Clean(f))
+					}
+					log.Printf("  %s: %s (%s)", n.Name, resultSuccess, time.Since(start).Round(time.Second))
+				case errors.As(stepErr, &exitErr) && exitErr.ExitCode() == errUnsupportedArch.ExitCode():
+					// Not built here, but not broken either
+					skipped++
+					notBuilt[n] = true
+					done.Event, done.Reason = eventPackageSkipped, "unsupported architecture"
+					log.Printf("  %s: %s, unsupported architecture", n.Name, resultSkipped)
+				default:
+					failed++
+					notBuilt[n] = true
+					done.Event, done.Step, done.Error = eventPackageFailed, step, stepErr.Error()
+					done.Category = errBuild.String()
+					if errors.As(stepErr, &exitErr) {
+						done.ExitCode = exitErr.ExitCode()
+						done.Category = categoryOfExitCode(done.ExitCode).String()
+					}
+					log.Printf("  %s: %s in %s: %v", n.Name, resultFailed, step, stepErr)
+					stopped = failFast
+				}
+				stream.emit(&done)
+				outcomes = append(outcomes, done)
+			}
+			finished := buildEvent{Event: eventRunFinished, Succeeded: &succeeded, Failed: &failed, Skipped: &skipped, Duration: time.Since(runStart).Seconds()}
+			stream.emit(&finished)
+			if jsonOutput() {
+				if err := printResult(struct {
+					buildEvent
+					Packages []buildEvent `json:"packages"`
+				}{finished, outcomes}); err != nil {
+					return err
+				}
+			}
+			log.Printf("Workspace run finished: %d succeeded, %d failed, %d skipped in %s", succeeded, failed, skipped, time.Since(runStart).Round(time.Second))
+
+			if cmd.Context().Err() != nil {
+				return errorf(errCancelled, "cancelled while building the workspace")
+			}
+			if failed > 0 {
+				return errorf(errBuild, "%d of %d package(s) failed", failed, len(order))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&workspace, "workspace", ".", "Directory containing the package sources")
+	cmd.Flags().StringVar(&selection, "select", "", selectUsage)
+	cmd.Flags().StringSliceVar(&steps, "steps", []string{"deps", "build"}, "Builder commands to run for each package, in order")
+	cmd.RegisterFlagCompletionFunc("steps", completeCommandNames)
+	cmd.Flags().BoolVar(&includeQuarantined, "include-quarantined", false, "Build broken and on-hold packages too")
+	cmd.Flags().BoolVar(&failFast, "fail-fast", false, "Stop at the first failed package")
+	cmd.Flags().StringVar(&events, "events", "", "Write an NDJSON event stream to this file, or fd:N")
+	return cmd
+}